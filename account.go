@@ -0,0 +1,395 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// --- Credential changes ---
+// Changing the password or email needs the current password (or, for an account without
+// one, a fresh OIDC login). Other sessions and the API key can be revoked at the same
+// time; every change is recorded in the audit log.
+
+// Fields shared by the password and email change requests
+type credentialChange struct {
+	CurrentPassword    string `json:"current_password"`
+	InvalidateSessions bool   `json:"invalidate_sessions"` // Log out every other session
+	InvalidateAPIKeys  bool   `json:"invalidate_api_keys"` // Replace the API key
+}
+
+// Check the current password; writes the error response and returns 0 if it doesn't match
+func authorizeCredentialChange(w http.ResponseWriter, r *http.Request, sessionCookieName string, req credentialChange) (int64, string) {
+	email := getUserEmail(r, sessionCookieName)
+	userID, err := getUserIDByEmail(email)
+	if err != nil {
+		apiError(w, "User not found", http.StatusUnauthorized)
+		return 0, ""
+	}
+	if !confirmUser(w, r, sessionCookieName, email, "current_password", req.CurrentPassword) {
+		return 0, ""
+	}
+	return userID, email
+}
+
+// Confirm a sensitive change with the password sent in field. Accounts provisioned by an
+// OIDC login have no password until they set one; for them a session from a login in the
+// last OIDC_REAUTH_WINDOW stands in for it. Writes the error response if not confirmed.
+func confirmUser(w http.ResponseWriter, r *http.Request, sessionCookieName, email, field, password string) bool {
+	var pwHash string
+	if err := db.QueryRow(`SELECT password_hash FROM users WHERE email = ?`, email).Scan(&pwHash); err != nil {
+		apiError(w, "Server error", http.StatusInternalServerError)
+		return false
+	}
+	if pwHash == "" {
+		cookie, err := r.Cookie(sessionCookieName)
+		if err != nil {
+			apiError(w, "Unauthorized", http.StatusUnauthorized)
+			return false
+		}
+		loggedIn, err := sessionCreatedAt(cookie.Value)
+		if err != nil || time.Since(loggedIn) > OIDC_REAUTH_WINDOW {
+			writeAPIError(w, http.StatusForbidden, ERR_FORBIDDEN, "Log in again to confirm this change")
+			return false
+		}
+		return true
+	}
+	if password == "" {
+		apiError(w, "Missing "+field, http.StatusBadRequest)
+		return false
+	}
+	if checkPassword(pwHash, password) != nil {
+		writeAPIError(w, http.StatusForbidden, ERR_FORBIDDEN, "Incorrect password")
+		return false
+	}
+	return true
+}
+
+// Revoke other sessions and the API key as requested. Adds what was done to the
+// response and returns it for the audit log.
+func revokeCredentials(r *http.Request, sessionCookieName string, userID int64, req credentialChange, response map[string]interface{}) []string {
+	var revoked []string
+	if req.InvalidateSessions {
+		current := ""
+		if cookie, err := r.Cookie(sessionCookieName); err == nil {
+			current = cookie.Value
+		}
+		n, err := dbDeleteUserSessions(userID, current)
+		if err != nil {
+			fmt.Printf("ERROR: Could not revoke sessions of user %d: %v\n", userID, err)
+		} else {
+			response["sessions_revoked"] = n
+			revoked = append(revoked, fmt.Sprintf("%d other sessions revoked", n))
+		}
+	}
+	if req.InvalidateAPIKeys {
+		apiKey, err := regenerateAPIKey(userID)
+		if err != nil {
+			fmt.Printf("ERROR: Could not replace API key of user %d: %v\n", userID, err)
+		} else {
+			response["api_key"] = apiKey
+			revoked = append(revoked, "API key replaced")
+		}
+	}
+	return revoked
+}
+
+// POST /api/user/password {"current_password", "new_password", "invalidate_sessions", "invalidate_api_keys"}
+func handleChangePassword(sessionCookieName string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !isAuthenticated(r, sessionCookieName) {
+			apiError(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var req struct {
+			credentialChange
+			NewPassword string `json:"new_password"`
+		}
+		if err := decodeJSONBody(w, r, &req); err != nil {
+			writeBodyError(w, err)
+			return
+		}
+		if req.NewPassword == "" {
+			apiError(w, "Missing new_password", http.StatusBadRequest)
+			return
+		}
+		userID, _ := authorizeCredentialChange(w, r, sessionCookieName, req.credentialChange)
+		if userID == 0 {
+			return
+		}
+		pwHash, err := hashPassword(req.NewPassword)
+		if err != nil {
+			apiError(w, "Failed to hash password", http.StatusInternalServerError)
+			return
+		}
+		if _, err := db.Exec(`UPDATE users SET password_hash = ? WHERE id = ?`, pwHash, userID); err != nil {
+			apiError(w, "Failed to change password", http.StatusInternalServerError)
+			return
+		}
+
+		response := map[string]interface{}{"success": true}
+		revoked := revokeCredentials(r, sessionCookieName, userID, req.credentialChange, response)
+		recordAudit(userID, r, AUDIT_PASSWORD_CHANGED, strings.Join(revoked, ", "))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// POST /api/user/email {"current_password", "new_email", "invalidate_sessions", "invalidate_api_keys"}
+func handleChangeEmail(sessionCookieName, mediaDir, waSessionPrefix string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !isAuthenticated(r, sessionCookieName) {
+			apiError(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var req struct {
+			credentialChange
+			NewEmail string `json:"new_email"`
+		}
+		if err := decodeJSONBody(w, r, &req); err != nil {
+			writeBodyError(w, err)
+			return
+		}
+		req.NewEmail = strings.TrimSpace(req.NewEmail)
+		if !strings.Contains(req.NewEmail, "@") {
+			apiError(w, "Invalid new_email", http.StatusBadRequest)
+			return
+		}
+		userID, email := authorizeCredentialChange(w, r, sessionCookieName, req.credentialChange)
+		if userID == 0 {
+			return
+		}
+		if req.NewEmail == email {
+			apiError(w, "new_email is the current email", http.StatusBadRequest)
+			return
+		}
+		if err := changeUserEmail(userID, email, req.NewEmail, mediaDir, waSessionPrefix); err != nil {
+			if strings.Contains(err.Error(), "UNIQUE") {
+				apiError(w, "Email already registered", http.StatusConflict)
+				return
+			}
+			fmt.Printf("ERROR: Could not change email of %s: %v\n", email, err)
+			apiError(w, "Failed to change email", http.StatusInternalServerError)
+			return
+		}
+
+		response := map[string]interface{}{"success": true, "email": req.NewEmail}
+		revoked := revokeCredentials(r, sessionCookieName, userID, req.credentialChange, response)
+		recordAudit(userID, r, AUDIT_EMAIL_CHANGED, strings.Join(append([]string{email + " -> " + req.NewEmail}, revoked...), ", "))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// Change a user's email. Running state is keyed by email, so the WhatsApp client and
+// channels are stopped and started again under the new email, and the send queue and
+// session file move with it.
+func changeUserEmail(userID int64, oldEmail, newEmail, mediaDir, waSessionPrefix string) error {
+	client := detachUserWAClient(oldEmail)
+	if client != nil {
+		client.Disconnect()
+	}
+	stopUserChannels(oldEmail)
+
+	email := newEmail
+	_, err := db.Exec(`UPDATE users SET email = ? WHERE id = ?`, newEmail, userID)
+	invalidateUserIDCache(oldEmail)
+	if err != nil {
+		email = oldEmail
+	} else {
+		if err := renameUserDevice(oldEmail, newEmail, waSessionPrefix); err != nil {
+			fmt.Printf("ERROR: Could not move the WhatsApp session of %s to %s: %v\n", oldEmail, newEmail, err)
+		}
+		moveUserQueue(oldEmail, newEmail)
+		waUsers.mu.Lock()
+		delete(waUsers.data, oldEmail)
+		waUsers.mu.Unlock()
+	}
+
+	startUserChannels(userID, mediaDir)
+	if client != nil {
+		scheduleWAConnect(email, func() { startUserWhatsMeowConnection(email, mediaDir, waSessionPrefix) })
+	}
+	return err
+}
+
+// Re-key a user's send queue under their new email
+func moveUserQueue(oldEmail, newEmail string) {
+	queueMutex.Lock()
+	queue, ok := messageQueues[oldEmail]
+	if ok {
+		delete(messageQueues, oldEmail)
+		messageQueues[newEmail] = queue
+	}
+	queueMutex.Unlock()
+	if !ok {
+		return
+	}
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	queue.UserEmail = newEmail
+	for _, msg := range queue.Messages {
+		msg.UserEmail = newEmail
+	}
+	for _, msg := range queue.Pending {
+		msg.UserEmail = newEmail
+	}
+}
+
+// --- Account deletion ---
+// Deleting an account stops everything running for it (WhatsApp client, channels,
+// sink connections, queued sends), unlinks and removes its WhatsApp session, deletes
+// all of its rows in one transaction and then its media files.
+
+// Tables with a user_id column, deleted with the account (the users row goes last)
+var accountTables = []string{
+	"webhooks", "webhook_payloads", "webhook_buffer", "sent_messages", "secrets",
+	"capacity_reservations", "campaigns", "media_uploads", "recent_chats",
+	"document_texts", "chat_media", "messages", "conversation_assignments", "agents",
+	"canned_responses", "auto_responders", "auto_responder_replies", "wa_devices",
+	"wa_device_props", "contacts", "channels", "sinks", "google_credentials",
+	"send_risk_settings", "enrichment_settings", "bot_settings", "bot_chats",
+	"bot_replies", "daily_stats", "sessions", "audit_logs", "user_identities",
+	"alert_rules", "media_files", "callback_outbox",
+}
+
+// Delete every row of a user in one transaction. Returns the received media and
+// uploaded files the deleted rows referenced.
+func dbDeleteAccount(userID int64) ([]string, []string, error) {
+	defer invalidateWebhooksCache(userID)
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	media, err := queryStrings(tx, `SELECT file_path FROM chat_media WHERE user_id = ?`, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	uploads, err := queryStrings(tx, `SELECT file_path FROM media_uploads WHERE user_id = ? AND file_path != ''`, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := tx.Exec(`DELETE FROM campaign_recipients WHERE campaign_id IN (SELECT id FROM campaigns WHERE user_id = ?)`, userID); err != nil {
+		return nil, nil, fmt.Errorf("campaign_recipients: %w", err)
+	}
+	for _, table := range accountTables {
+		if _, err := tx.Exec(`DELETE FROM `+table+` WHERE user_id = ?`, userID); err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", table, err)
+		}
+	}
+	if _, err := tx.Exec(`DELETE FROM users WHERE id = ?`, userID); err != nil {
+		return nil, nil, fmt.Errorf("users: %w", err)
+	}
+	return media, uploads, tx.Commit()
+}
+
+// Stop a user's queue and drop the messages waiting in it
+func dropUserQueue(email string) int {
+	queueMutex.Lock()
+	queue, ok := messageQueues[email]
+	delete(messageQueues, email)
+	queueMutex.Unlock()
+	if !ok {
+		return 0
+	}
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	dropped := len(queue.Messages) + len(queue.Pending)
+	queue.Messages = nil
+	queue.Pending = nil
+	return dropped
+}
+
+// POST /api/user/delete {"password": "..."}
+// Session-authenticated, and the current password is required again (see confirmUser).
+func handleDeleteAccount(sessionCookieName, waSessionPrefix string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !isAuthenticated(r, sessionCookieName) {
+			apiError(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		email := getUserEmail(r, sessionCookieName)
+		userID, err := getUserIDByEmail(email)
+		if err != nil {
+			apiError(w, "User not found", http.StatusUnauthorized)
+			return
+		}
+
+		var req struct {
+			Password string `json:"password"`
+		}
+		if err := decodeJSONBody(w, r, &req); err != nil {
+			writeBodyError(w, err)
+			return
+		}
+		if !confirmUser(w, r, sessionCookieName, email, "password", req.Password) {
+			return
+		}
+
+		// Stop what runs for the account before its rows go
+		stopUserChannels(email)
+		if sinks, err := dbListSinks(userID); err == nil {
+			for _, s := range sinks {
+				if t, ok := sinkTypes[s.Type]; ok && t.stop != nil {
+					t.stop(s)
+				}
+			}
+		}
+		dropped := dropUserQueue(email)
+		webhooks, err := dbListWebhooks(userID)
+		if err != nil {
+			fmt.Printf("ERROR: Could not load webhooks of user %s to clear logs: %v\n", email, err)
+		}
+		response := map[string]interface{}{"success": true}
+		// Needs the wa_devices row, so it runs before the rows are deleted
+		if err := logoutUserWhatsMeow(email, waSessionPrefix); err != nil {
+			response["warning"] = "Could not unlink the device from WhatsApp; remove it under Linked devices on the phone"
+		}
+
+		media, uploads, err := dbDeleteAccount(userID)
+		if err != nil {
+			fmt.Printf("ERROR: Could not delete account %s: %v\n", email, err)
+			apiError(w, "Failed to delete account", http.StatusInternalServerError)
+			return
+		}
+		for _, path := range media {
+			releaseMediaFile(path)
+		}
+		for _, path := range uploads {
+			os.Remove(path)
+		}
+		clearWebhookLogs(webhooks, "")
+		invalidateUserIDCache(email)
+		waUsers.mu.Lock()
+		delete(waUsers.data, email)
+		waUsers.mu.Unlock()
+		fmt.Printf("INFO: Deleted account %s (%d queued messages dropped)\n", email, dropped)
+
+		http.SetCookie(w, &http.Cookie{
+			Name:     sessionCookieName,
+			Value:    "",
+			Path:     "/",
+			HttpOnly: true,
+			Expires:  time.Now().Add(-1 * time.Hour),
+		})
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDeleteAccount(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+
+	email := "leaving@example.com"
+	cookies, apiKey := registerWithAPIKey(t, ts, email, "leavingpass123")
+	userID, _ := getUserIDByEmail(email)
+	registerWithAPIKey(t, ts, "staying@example.com", "stayingpass123")
+	otherID, _ := getUserIDByEmail("staying@example.com")
+
+	if resp := apiRequest(t, "POST", ts.URL+"/api/webhooks/create", apiKey, map[string]string{"url": "https://example.com/hook", "method": "POST"}, nil); resp.StatusCode != 200 {
+		t.Fatalf("Create webhook failed, status: %d", resp.StatusCode)
+	}
+	chat := "14155550009@s.whatsapp.net"
+	archiveMessage(userID, chat, map[string]interface{}{"id": "GONE", "text": "bye", "timestamp": int64(1700000000)}, "")
+	archiveMessage(otherID, chat, map[string]interface{}{"id": "KEPT", "text": "hi", "timestamp": int64(1700000000)}, "")
+	media := filepath.Join("test_media", "leaving.jpg")
+	os.WriteFile(media, []byte("leaving"), 0644)
+	dbSaveMediaFileInfo(userID, "leaving.jpg", "image/jpeg", "", "hashleaving")
+	dbRecordChatMedia(userID, chat, "GONE", "image", media, time.Now())
+	// A callback waiting for a retry is dropped with the account
+	db.Exec(`INSERT INTO callback_outbox (user_id, callback_id, callback_url, payload, attempts, next_attempt_at, created_at) VALUES (?, 'cb_gone', 'https://example.com/cb', '{}', 1, ?, ?)`,
+		userID, time.Now().Add(time.Hour).Unix(), time.Now().Unix())
+
+	deleteAccount := func(password string) *http.Response {
+		t.Helper()
+		body, _ := json.Marshal(map[string]string{"password": password})
+		req, _ := http.NewRequest("POST", ts.URL+"/api/user/delete", bytes.NewReader(body))
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Delete account failed: %v", err)
+		}
+		return resp
+	}
+
+	// API keys cannot delete the account, and the password is checked
+	if resp := apiRequest(t, "POST", ts.URL+"/api/user/delete", apiKey, map[string]string{"password": "leavingpass123"}, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 for API key, got %d", resp.StatusCode)
+	}
+	if resp := deleteAccount("wrongpass"); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected 403 for a wrong password, got %d", resp.StatusCode)
+	}
+	if _, err := getUserIDByEmail(email); err != nil {
+		t.Fatal("The account should still exist after a wrong password")
+	}
+
+	if resp := deleteAccount("leavingpass123"); resp.StatusCode != 200 {
+		t.Fatalf("Delete account failed, status: %d", resp.StatusCode)
+	}
+	if _, err := getUserIDByEmail(email); err == nil {
+		t.Fatal("The user should be deleted")
+	}
+	for _, table := range accountTables {
+		var n int
+		db.QueryRow(`SELECT COUNT(*) FROM `+table+` WHERE user_id = ?`, userID).Scan(&n)
+		if n != 0 {
+			t.Fatalf("Expected no %s left, got %d", table, n)
+		}
+	}
+	if _, err := os.Stat(media); !os.IsNotExist(err) {
+		t.Fatal("Media of the account should be deleted")
+	}
+	var kept int
+	db.QueryRow(`SELECT COUNT(*) FROM messages WHERE user_id = ?`, otherID).Scan(&kept)
+	if kept != 1 {
+		t.Fatalf("Other accounts should be untouched, got %d messages", kept)
+	}
+
+	// The session no longer works
+	if resp := deleteAccount("leavingpass123"); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 after deletion, got %d", resp.StatusCode)
+	}
+}
+
+// Every table with a user_id column must be cleared with the account
+func TestAccountTablesCoverUserData(t *testing.T) {
+	_, teardown := setupTestServer()
+	defer teardown()
+
+	covered := map[string]bool{}
+	for _, table := range accountTables {
+		covered[table] = true
+	}
+	rows, err := db.Query(`SELECT m.name FROM sqlite_master m JOIN pragma_table_info(m.name) c
+		WHERE m.type = 'table' AND m.name != 'users' AND c.name = 'user_id'`)
+	if err != nil {
+		t.Fatalf("Listing tables failed: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var table string
+		rows.Scan(&table)
+		if !covered[table] {
+			t.Errorf("Table %s has a user_id column but is not in accountTables", table)
+		}
+	}
+}
+
+func TestChangePasswordAndEmail(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+
+	email := "creds@example.com"
+	cookies, apiKey := registerWithAPIKey(t, ts, email, "credspass123")
+	registerWithAPIKey(t, ts, "taken@example.com", "takenpass123")
+	login := func(email, password string) []*http.Cookie {
+		t.Helper()
+		body, _ := json.Marshal(map[string]string{"email": email, "password": password})
+		resp, err := http.Post(ts.URL+"/api/login", "application/json", bytes.NewReader(body))
+		if err != nil || resp.StatusCode != 200 {
+			return nil
+		}
+		return resp.Cookies()
+	}
+	otherSession := login(email, "credspass123")
+	session := func(cookies []*http.Cookie, method, path string, body, out interface{}) int {
+		t.Helper()
+		var buf bytes.Buffer
+		if body != nil {
+			json.NewEncoder(&buf).Encode(body)
+		}
+		req, _ := http.NewRequest(method, ts.URL+path, &buf)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s failed: %v", method, path, err)
+		}
+		if out != nil {
+			json.NewDecoder(resp.Body).Decode(out)
+		}
+		return resp.StatusCode
+	}
+
+	if status := session(cookies, "POST", "/api/user/password", map[string]string{"current_password": "wrong", "new_password": "newpass456"}, nil); status != http.StatusForbidden {
+		t.Fatalf("Expected 403 for a wrong password, got %d", status)
+	}
+	var changed struct {
+		SessionsRevoked int64  `json:"sessions_revoked"`
+		APIKey          string `json:"api_key"`
+	}
+	status := session(cookies, "POST", "/api/user/password", map[string]interface{}{
+		"current_password": "credspass123", "new_password": "newpass456",
+		"invalidate_sessions": true, "invalidate_api_keys": true,
+	}, &changed)
+	if status != 200 || changed.SessionsRevoked != 1 || changed.APIKey == "" || changed.APIKey == apiKey {
+		t.Fatalf("Unexpected password change result %d: %+v", status, changed)
+	}
+	if login(email, "credspass123") != nil || login(email, "newpass456") == nil {
+		t.Fatal("Only the new password should log in")
+	}
+	if status := session(otherSession, "GET", "/api/user/audit-log", nil, nil); status != http.StatusUnauthorized {
+		t.Fatalf("The other session should be revoked, got %d", status)
+	}
+	if resp := apiRequest(t, "GET", ts.URL+"/api/webhooks", apiKey, nil, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("The old API key should be revoked, got %d", resp.StatusCode)
+	}
+
+	// Email change keeps the current session
+	if status := session(cookies, "POST", "/api/user/email", map[string]string{"current_password": "newpass456", "new_email": "taken@example.com"}, nil); status != http.StatusConflict {
+		t.Fatalf("Expected 409 for a registered email, got %d", status)
+	}
+	if status := session(cookies, "POST", "/api/user/email", map[string]string{"current_password": "newpass456", "new_email": "renamed@example.com"}, nil); status != 200 {
+		t.Fatalf("Email change failed, status: %d", status)
+	}
+	if login(email, "newpass456") != nil || login("renamed@example.com", "newpass456") == nil {
+		t.Fatal("Only the new email should log in")
+	}
+
+	var entries []AuditLogEntry
+	if status := session(cookies, "GET", "/api/user/audit-log", nil, &entries); status != 200 {
+		t.Fatalf("Audit log failed, status: %d", status)
+	}
+	if len(entries) != 2 || entries[0].Action != AUDIT_EMAIL_CHANGED || entries[1].Action != AUDIT_PASSWORD_CHANGED {
+		t.Fatalf("Unexpected audit log: %+v", entries)
+	}
+	if entries[0].Detail != email+" -> renamed@example.com" {
+		t.Fatalf("Unexpected audit detail %q", entries[0].Detail)
+	}
+}
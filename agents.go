@@ -0,0 +1,596 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// --- Agents and conversation routing ---
+// An account can have agents, the people working its shared inbox. With a routing
+// policy, the first message in a chat without an agent assigns the chat round-robin,
+// or to an agent whose keywords the message contains. The agent is notified on their
+// own webhook and/or by email; conversations can be reassigned at any time.
+
+const (
+	ROUTING_OFF         = "off"
+	ROUTING_ROUND_ROBIN = "round_robin"
+	ROUTING_KEYWORD     = "keyword" // Keyword match first, round-robin otherwise
+
+	ASSIGNED_BY_ROUND_ROBIN = "round_robin"
+	ASSIGNED_BY_KEYWORD     = "keyword"
+	ASSIGNED_MANUALLY       = "manual"
+
+	MAX_AGENTS            = 50
+	MAX_AGENT_KEYWORDS    = 20
+	MAX_AGENT_NAME_LENGTH = 100
+)
+
+type Agent struct {
+	ID             int64      `json:"id"`
+	Name           string     `json:"name"` // Unique per account; used as the messages' assigned_to
+	Email          string     `json:"email,omitempty"`
+	WebhookURL     string     `json:"webhook_url,omitempty"`
+	Keywords       []string   `json:"keywords"`
+	Active         bool       `json:"active"` // Inactive agents keep their chats but get no new ones
+	LastAssignedAt *time.Time `json:"last_assigned_at,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+}
+
+type ConversationAssignment struct {
+	ChatJID    string    `json:"chat_jid"`
+	AgentID    int64     `json:"agent_id"`
+	AgentName  string    `json:"agent_name"`
+	Reason     string    `json:"reason"` // "round_robin", "keyword" or "manual"
+	AssignedAt time.Time `json:"assigned_at"`
+}
+
+// Serializes routing decisions, so two messages can't both pick the same "next" agent
+var routingMu sync.Mutex
+
+// Validate and normalize an agent's settings
+func validateAgent(a *Agent) error {
+	a.Name = strings.TrimSpace(a.Name)
+	if a.Name == "" {
+		return errors.New("Missing name")
+	}
+	if utf8.RuneCountInString(a.Name) > MAX_AGENT_NAME_LENGTH {
+		return fmt.Errorf("Name too long (max %d characters)", MAX_AGENT_NAME_LENGTH)
+	}
+	if a.Email = strings.TrimSpace(a.Email); a.Email != "" {
+		addr, err := mail.ParseAddress(a.Email)
+		if err != nil {
+			return errors.New("Invalid email")
+		}
+		a.Email = addr.Address
+	}
+	if a.WebhookURL = strings.TrimSpace(a.WebhookURL); a.WebhookURL != "" {
+		u, err := url.Parse(a.WebhookURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("Invalid webhook_url (http or https URL required)")
+		}
+	}
+	keywords := []string{}
+	seen := map[string]bool{}
+	for _, k := range a.Keywords {
+		k = normalizeSearchText(k)
+		if k == "" || seen[k] {
+			continue
+		}
+		seen[k] = true
+		keywords = append(keywords, k)
+	}
+	if len(keywords) > MAX_AGENT_KEYWORDS {
+		return fmt.Errorf("Too many keywords (max %d)", MAX_AGENT_KEYWORDS)
+	}
+	a.Keywords = keywords
+	return nil
+}
+
+const agentColumns = `id, name, email, webhook_url, keywords, active, last_assigned_at, created_at`
+
+func scanAgent(row interface{ Scan(...interface{}) error }) (Agent, error) {
+	var a Agent
+	var keywords, createdAt string
+	var lastAssigned sql.NullString
+	if err := row.Scan(&a.ID, &a.Name, &a.Email, &a.WebhookURL, &keywords, &a.Active, &lastAssigned, &createdAt); err != nil {
+		return a, err
+	}
+	a.Keywords = []string{}
+	if keywords != "" {
+		a.Keywords = strings.Split(keywords, ",")
+	}
+	if lastAssigned.Valid {
+		if t, err := time.Parse(time.RFC3339, lastAssigned.String); err == nil {
+			a.LastAssignedAt = &t
+		}
+	}
+	a.CreatedAt, _ = time.Parse(time.RFC3339, createdAt)
+	return a, nil
+}
+
+func dbListAgents(userID int64) ([]Agent, error) {
+	rows, err := db.Query(`SELECT `+agentColumns+` FROM agents WHERE user_id = ? ORDER BY id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	agents := []Agent{}
+	for rows.Next() {
+		a, err := scanAgent(rows)
+		if err != nil {
+			return nil, err
+		}
+		agents = append(agents, a)
+	}
+	return agents, rows.Err()
+}
+
+func dbGetAgent(userID, agentID int64) (Agent, error) {
+	return scanAgent(db.QueryRow(`SELECT `+agentColumns+` FROM agents WHERE user_id = ? AND id = ?`, userID, agentID))
+}
+
+func dbCreateAgent(userID int64, a *Agent) error {
+	a.CreatedAt = time.Now().UTC()
+	res, err := db.Exec(`INSERT INTO agents (user_id, name, email, webhook_url, keywords, active, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		userID, a.Name, a.Email, a.WebhookURL, strings.Join(a.Keywords, ","), a.Active, a.CreatedAt.Format(time.RFC3339))
+	if err != nil {
+		return err
+	}
+	a.ID, err = res.LastInsertId()
+	return err
+}
+
+func dbUpdateAgent(userID int64, a Agent) (bool, error) {
+	res, err := db.Exec(`UPDATE agents SET name = ?, email = ?, webhook_url = ?, keywords = ?, active = ? WHERE user_id = ? AND id = ?`,
+		a.Name, a.Email, a.WebhookURL, strings.Join(a.Keywords, ","), a.Active, userID, a.ID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// Delete an agent; its conversations become unassigned
+func dbDeleteAgent(userID, agentID int64) (bool, error) {
+	res, err := db.Exec(`DELETE FROM agents WHERE user_id = ? AND id = ?`, userID, agentID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if n > 0 {
+		db.Exec(`DELETE FROM conversation_assignments WHERE user_id = ? AND agent_id = ?`, userID, agentID)
+	}
+	return n > 0, err
+}
+
+func dbGetRoutingPolicy(userID int64) string {
+	policy := ROUTING_OFF
+	db.QueryRow(`SELECT routing_policy FROM users WHERE id = ?`, userID).Scan(&policy)
+	return policy
+}
+
+func dbSetRoutingPolicy(userID int64, policy string) error {
+	_, err := db.Exec(`UPDATE users SET routing_policy = ? WHERE id = ?`, policy, userID)
+	return err
+}
+
+const assignmentQuery = `SELECT ca.chat_jid, ca.agent_id, a.name, ca.reason, ca.assigned_at
+	FROM conversation_assignments ca JOIN agents a ON a.id = ca.agent_id WHERE ca.user_id = ?`
+
+func scanAssignment(row interface{ Scan(...interface{}) error }) (ConversationAssignment, error) {
+	var c ConversationAssignment
+	var assignedAt string
+	err := row.Scan(&c.ChatJID, &c.AgentID, &c.AgentName, &c.Reason, &assignedAt)
+	c.AssignedAt, _ = time.Parse(time.RFC3339, assignedAt)
+	return c, err
+}
+
+func dbGetAssignment(userID int64, chatJID string) (ConversationAssignment, error) {
+	return scanAssignment(db.QueryRow(assignmentQuery+` AND ca.chat_jid = ?`, userID, chatJID))
+}
+
+// List assignments, optionally only one agent's (agentID 0 = all)
+func dbListAssignments(userID, agentID int64) ([]ConversationAssignment, error) {
+	query, args := assignmentQuery, []interface{}{userID}
+	if agentID != 0 {
+		query += ` AND ca.agent_id = ?`
+		args = append(args, agentID)
+	}
+	rows, err := db.Query(query+` ORDER BY ca.assigned_at DESC`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	assignments := []ConversationAssignment{}
+	for rows.Next() {
+		c, err := scanAssignment(rows)
+		if err != nil {
+			return nil, err
+		}
+		assignments = append(assignments, c)
+	}
+	return assignments, rows.Err()
+}
+
+// Assign a chat to an agent, replacing any current assignment. Open and flagged
+// archived messages of the chat are reassigned too; handled ones keep their assignee.
+func dbAssignConversation(userID int64, chatJID string, agent Agent, reason string, at time.Time) error {
+	_, err := db.Exec(`INSERT INTO conversation_assignments (user_id, chat_jid, agent_id, reason, assigned_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(user_id, chat_jid) DO UPDATE SET agent_id = excluded.agent_id, reason = excluded.reason, assigned_at = excluded.assigned_at`,
+		userID, chatJID, agent.ID, reason, at.UTC().Format(time.RFC3339))
+	if err != nil {
+		return err
+	}
+	// Nanosecond precision keeps round-robin order within the same second
+	db.Exec(`UPDATE agents SET last_assigned_at = ? WHERE id = ?`, at.UTC().Format(time.RFC3339Nano), agent.ID)
+	_, err = db.Exec(`UPDATE messages SET assigned_to = ? WHERE user_id = ? AND chat_jid = ? AND state != ?`,
+		agent.Name, userID, chatJID, ANNOTATION_HANDLED)
+	return err
+}
+
+func dbUnassignConversation(userID int64, chatJID string) error {
+	_, err := db.Exec(`DELETE FROM conversation_assignments WHERE user_id = ? AND chat_jid = ?`, userID, chatJID)
+	return err
+}
+
+// The agent assigned least recently (never-assigned agents first, then by ID)
+func nextRoundRobinAgent(agents []Agent) *Agent {
+	if len(agents) == 0 {
+		return nil
+	}
+	sorted := append([]Agent(nil), agents...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := sorted[i].LastAssignedAt, sorted[j].LastAssignedAt
+		if a == nil || b == nil {
+			return a == nil && b != nil
+		}
+		return a.Before(*b)
+	})
+	return &sorted[0]
+}
+
+// Agents with a keyword appearing as whole words in text
+func agentsMatchingKeywords(agents []Agent, text string) []Agent {
+	padded := " " + normalizeSearchText(text) + " "
+	var matches []Agent
+	for _, a := range agents {
+		for _, k := range a.Keywords {
+			if strings.Contains(padded, " "+k+" ") {
+				matches = append(matches, a)
+				break
+			}
+		}
+	}
+	return matches
+}
+
+// Pick an agent for a new conversation under a routing policy
+func pickAgent(policy string, agents []Agent, text string) (*Agent, string) {
+	active := []Agent{}
+	for _, a := range agents {
+		if a.Active {
+			active = append(active, a)
+		}
+	}
+	if policy == ROUTING_KEYWORD {
+		if agent := nextRoundRobinAgent(agentsMatchingKeywords(active, text)); agent != nil {
+			return agent, ASSIGNED_BY_KEYWORD
+		}
+	}
+	return nextRoundRobinAgent(active), ASSIGNED_BY_ROUND_ROBIN
+}
+
+// Route a received message's chat: returns the name of the chat's agent ("" when
+// unassigned), assigning and notifying an agent first if the chat has none yet.
+func routeConversation(email string, userID int64, chatJID string, payload map[string]interface{}) string {
+	routingMu.Lock()
+	defer routingMu.Unlock()
+
+	if current, err := dbGetAssignment(userID, chatJID); err == nil {
+		return current.AgentName
+	}
+	policy := dbGetRoutingPolicy(userID)
+	if policy == ROUTING_OFF {
+		return ""
+	}
+	agents, err := dbListAgents(userID)
+	if err != nil {
+		fmt.Printf("ERROR: Could not load agents for user %s: %v\n", email, err)
+		return ""
+	}
+	text, _ := payload["text"].(string)
+	if text == "" {
+		text, _ = payload["caption"].(string)
+	}
+	agent, reason := pickAgent(policy, agents, text)
+	if agent == nil {
+		return ""
+	}
+	now := time.Now()
+	if err := dbAssignConversation(userID, chatJID, *agent, reason, now); err != nil {
+		fmt.Printf("ERROR: Could not assign chat %s for user %s: %v\n", chatJID, email, err)
+		return ""
+	}
+	fmt.Printf("INFO: Chat %s of user %s assigned to agent %s (%s)\n", chatJID, email, agent.Name, reason)
+	assignment := ConversationAssignment{ChatJID: chatJID, AgentID: agent.ID, AgentName: agent.Name, Reason: reason, AssignedAt: now.UTC()}
+	go notifyAgentAssignment(email, *agent, assignment, payload)
+	return agent.Name
+}
+
+// Tell an agent about a conversation assigned to them (their webhook and/or email),
+// and send a conversation.assigned event to the account's subscribed webhooks.
+func notifyAgentAssignment(email string, agent Agent, assignment ConversationAssignment, message map[string]interface{}) {
+	data := map[string]interface{}{
+		"chat_jid":    assignment.ChatJID,
+		"agent":       map[string]interface{}{"id": agent.ID, "name": agent.Name},
+		"reason":      assignment.Reason,
+		"assigned_at": assignment.AssignedAt,
+	}
+	if message != nil {
+		data["message"] = message
+	}
+
+	if agent.WebhookURL != "" {
+		payload := map[string]interface{}{"event": EVENT_CONVERSATION_ASSIGNED, "timestamp": time.Now().Unix()}
+		for k, v := range data {
+			payload[k] = v
+		}
+		hook := Webhook{ID: fmt.Sprintf("agent-%d", agent.ID), Method: "POST"}
+		if _, err := sendWebhook(hook, payload, agent.WebhookURL, "POST"); err != nil {
+			fmt.Printf("ERROR: Could not notify agent %s by webhook: %v\n", agent.Name, err)
+		}
+	}
+	if agent.Email != "" && emailConfigured() {
+		body := fmt.Sprintf("Hi %s,\n\nThe conversation with %s has been assigned to you.", agent.Name, assignment.ChatJID)
+		if text, _ := message["text"].(string); text != "" {
+			body += "\n\nLatest message:\n" + text
+		}
+		if err := sendEmail(agent.Email, "New conversation assigned: "+assignment.ChatJID, body); err != nil {
+			fmt.Printf("ERROR: Could not notify agent %s by email: %v\n", agent.Name, err)
+		}
+	}
+	emitWebhookEvent(email, EVENT_CONVERSATION_ASSIGNED, assignment.ChatJID, data)
+}
+
+// Parse the {id} path value of an agent endpoint
+func agentIDFromPath(r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	return id, err == nil && id > 0
+}
+
+// Decode an agent definition; "active" defaults to true
+func decodeAgentRequest(w http.ResponseWriter, r *http.Request) (Agent, error) {
+	var req struct {
+		Name       string   `json:"name"`
+		Email      string   `json:"email"`
+		WebhookURL string   `json:"webhook_url"`
+		Keywords   []string `json:"keywords"`
+		Active     *bool    `json:"active"`
+	}
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		return Agent{}, err
+	}
+	a := Agent{Name: req.Name, Email: req.Email, WebhookURL: req.WebhookURL, Keywords: req.Keywords, Active: req.Active == nil || *req.Active}
+	return a, validateAgent(&a)
+}
+
+// GET/POST /api/agents
+func handleAgents(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(int64)
+
+	switch r.Method {
+	case "GET":
+		agents, err := dbListAgents(userID)
+		if err != nil {
+			apiError(w, "Failed to load agents", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(agents)
+	case "POST":
+		agent, err := decodeAgentRequest(w, r)
+		if err != nil {
+			writeBodyError(w, err)
+			return
+		}
+		if agents, err := dbListAgents(userID); err == nil && len(agents) >= MAX_AGENTS {
+			apiError(w, fmt.Sprintf("Too many agents (max %d)", MAX_AGENTS), http.StatusBadRequest)
+			return
+		}
+		if err := dbCreateAgent(userID, &agent); err != nil {
+			if strings.Contains(err.Error(), "UNIQUE") {
+				apiError(w, "An agent with this name already exists", http.StatusConflict)
+				return
+			}
+			fmt.Println("ERROR: Could not create agent", err)
+			apiError(w, "Failed to create agent", http.StatusInternalServerError)
+			return
+		}
+		fmt.Printf("INFO: Agent %s created for user %d\n", agent.Name, userID)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(agent)
+	default:
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// POST/DELETE /api/agents/{id}
+// POST replaces the agent's settings; DELETE removes the agent and unassigns its chats.
+func handleAgent(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(int64)
+	agentID, ok := agentIDFromPath(r)
+	if !ok {
+		apiError(w, "Invalid agent ID", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case "POST":
+		agent, err := decodeAgentRequest(w, r)
+		if err != nil {
+			writeBodyError(w, err)
+			return
+		}
+		agent.ID = agentID
+		updated, err := dbUpdateAgent(userID, agent)
+		if err != nil {
+			if strings.Contains(err.Error(), "UNIQUE") {
+				apiError(w, "An agent with this name already exists", http.StatusConflict)
+				return
+			}
+			apiError(w, "Failed to update agent", http.StatusInternalServerError)
+			return
+		}
+		if !updated {
+			apiError(w, "Agent not found", http.StatusNotFound)
+			return
+		}
+		agent, err = dbGetAgent(userID, agentID)
+		if err != nil {
+			apiError(w, "Failed to load agent", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(agent)
+	case "DELETE":
+		deleted, err := dbDeleteAgent(userID, agentID)
+		if err != nil {
+			apiError(w, "Failed to delete agent", http.StatusInternalServerError)
+			return
+		}
+		if !deleted {
+			apiError(w, "Agent not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "id": agentID})
+	default:
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// GET/POST /api/routing
+func handleRoutingPolicy(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(int64)
+
+	switch r.Method {
+	case "GET":
+	case "POST":
+		var req struct {
+			Policy string `json:"policy"`
+		}
+		if err := decodeJSONBody(w, r, &req); err != nil {
+			writeBodyError(w, err)
+			return
+		}
+		if req.Policy != ROUTING_OFF && req.Policy != ROUTING_ROUND_ROBIN && req.Policy != ROUTING_KEYWORD {
+			apiError(w, "Invalid policy (use off, round_robin or keyword)", http.StatusBadRequest)
+			return
+		}
+		if err := dbSetRoutingPolicy(userID, req.Policy); err != nil {
+			apiError(w, "Failed to update routing policy", http.StatusInternalServerError)
+			return
+		}
+		fmt.Printf("INFO: Routing policy of user %d set to %s\n", userID, req.Policy)
+	default:
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"policy": dbGetRoutingPolicy(userID)})
+}
+
+// GET /api/conversations?agent_id=
+func handleListConversations(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID := r.Context().Value("userID").(int64)
+	var agentID int64
+	if v := r.URL.Query().Get("agent_id"); v != "" {
+		var err error
+		if agentID, err = strconv.ParseInt(v, 10, 64); err != nil || agentID < 1 {
+			apiError(w, "Invalid agent_id", http.StatusBadRequest)
+			return
+		}
+	}
+	assignments, err := dbListAssignments(userID, agentID)
+	if err != nil {
+		apiError(w, "Failed to load conversations", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(assignments)
+}
+
+// POST /api/conversations/{jid}/assign
+// {"agent_id": 3} reassigns the chat (and notifies the agent); {"agent_id": 0} unassigns it.
+func handleAssignConversation(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID := r.Context().Value("userID").(int64)
+	chatJID, err := normalizeChatJID(r.PathValue("jid"))
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, ERR_INVALID_JID, "Invalid chat JID")
+		return
+	}
+	var req struct {
+		AgentID *int64 `json:"agent_id"`
+	}
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	if req.AgentID == nil {
+		apiError(w, "Missing agent_id", http.StatusBadRequest)
+		return
+	}
+
+	routingMu.Lock()
+	defer routingMu.Unlock()
+
+	if *req.AgentID == 0 {
+		if err := dbUnassignConversation(userID, chatJID.String()); err != nil {
+			apiError(w, "Failed to unassign conversation", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "chat_jid": chatJID.String(), "agent_id": 0})
+		return
+	}
+
+	agent, err := dbGetAgent(userID, *req.AgentID)
+	if err == sql.ErrNoRows {
+		apiError(w, "Agent not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		apiError(w, "Failed to load agent", http.StatusInternalServerError)
+		return
+	}
+	now := time.Now()
+	if err := dbAssignConversation(userID, chatJID.String(), agent, ASSIGNED_MANUALLY, now); err != nil {
+		fmt.Println("ERROR: Could not assign conversation", err)
+		apiError(w, "Failed to assign conversation", http.StatusInternalServerError)
+		return
+	}
+	assignment := ConversationAssignment{ChatJID: chatJID.String(), AgentID: agent.ID, AgentName: agent.Name, Reason: ASSIGNED_MANUALLY, AssignedAt: now.UTC()}
+	fmt.Printf("INFO: Chat %s of user %d reassigned to agent %s\n", assignment.ChatJID, userID, agent.Name)
+	go notifyAgentAssignment(getUserEmailByID(userID), agent, assignment, nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(assignment)
+}
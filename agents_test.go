@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAgentRouting(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+
+	email := "routing@example.com"
+	_, apiKey := registerWithAPIKey(t, ts, email, "routingpass123")
+
+	notified := make(chan map[string]interface{}, 10)
+	agentHook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&payload)
+		notified <- payload
+	}))
+	defer agentHook.Close()
+
+	mails := make(chan string, 10)
+	t.Setenv("SMTP_HOST", "smtp.example.com")
+	sendEmail = func(to, subject, body string) error {
+		mails <- to
+		return nil
+	}
+	defer func() { sendEmail = defaultSendEmail }()
+
+	createAgent := func(body map[string]interface{}) Agent {
+		t.Helper()
+		var agent Agent
+		resp := apiRequest(t, "POST", ts.URL+"/api/agents", apiKey, body, &agent)
+		if resp.StatusCode != 200 {
+			t.Fatalf("Create agent failed, status: %d", resp.StatusCode)
+		}
+		return agent
+	}
+	ann := createAgent(map[string]interface{}{"name": "Ann", "webhook_url": agentHook.URL})
+	bob := createAgent(map[string]interface{}{"name": "Bob", "email": "Bob <bob@example.com>", "keywords": []string{"Refund", "billing"}})
+	if bob.Email != "bob@example.com" || len(bob.Keywords) != 2 || bob.Keywords[0] != "refund" || !bob.Active {
+		t.Fatalf("Unexpected agent: %+v", bob)
+	}
+	if resp := apiRequest(t, "POST", ts.URL+"/api/agents", apiKey, map[string]interface{}{"name": "Ann"}, nil); resp.StatusCode != http.StatusConflict {
+		t.Fatalf("Expected 409 for duplicate name, got %d", resp.StatusCode)
+	}
+	if resp := apiRequest(t, "POST", ts.URL+"/api/agents", apiKey, map[string]interface{}{"name": "Eve", "webhook_url": "ftp://x"}, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for invalid webhook_url, got %d", resp.StatusCode)
+	}
+
+	receive := func(chat, id, text string) {
+		forwardToWebhooks(email, map[string]interface{}{"id": id, "from": chat, "to": chat, "type": "text", "text": text, "timestamp": time.Now().Unix()}, "", "test_media")
+	}
+	userID, _ := getUserIDByEmail(email)
+	assignee := func(chat string) string {
+		c, err := dbGetAssignment(userID, chat)
+		if err != nil {
+			return ""
+		}
+		return c.AgentName
+	}
+
+	// Routing is off by default
+	receive("14155550000@s.whatsapp.net", "m0", "hi")
+	if name := assignee("14155550000@s.whatsapp.net"); name != "" {
+		t.Fatalf("Expected no assignment with routing off, got %s", name)
+	}
+
+	if resp := apiRequest(t, "POST", ts.URL+"/api/routing", apiKey, map[string]string{"policy": "random"}, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for invalid policy, got %d", resp.StatusCode)
+	}
+	apiRequest(t, "POST", ts.URL+"/api/routing", apiKey, map[string]string{"policy": ROUTING_ROUND_ROBIN}, nil)
+
+	// New chats alternate between agents; a known chat stays with its agent
+	var got []string
+	for i := 1; i <= 3; i++ {
+		chat := fmt.Sprintf("1415555000%d@s.whatsapp.net", i)
+		receive(chat, fmt.Sprintf("m%d", i), "hello")
+		got = append(got, assignee(chat))
+	}
+	if got[0] != "Ann" || got[1] != "Bob" || got[2] != "Ann" {
+		t.Fatalf("Expected round-robin Ann, Bob, Ann, got %v", got)
+	}
+	receive("14155550002@s.whatsapp.net", "m4", "me again")
+	if name := assignee("14155550002@s.whatsapp.net"); name != "Bob" {
+		t.Fatalf("Expected chat to stay with Bob, got %s", name)
+	}
+
+	// Archived messages carry the assignee
+	var messages []ArchivedMessage
+	apiRequest(t, "GET", ts.URL+"/api/messages?assigned_to=Bob", apiKey, nil, &messages)
+	if len(messages) != 2 {
+		t.Fatalf("Expected 2 messages assigned to Bob, got %+v", messages)
+	}
+
+	// Notifications are sent concurrently: either of Ann's chats may come first
+	select {
+	case payload := <-notified:
+		if chat := payload["chat_jid"]; payload["event"] != EVENT_CONVERSATION_ASSIGNED || (chat != "14155550001@s.whatsapp.net" && chat != "14155550003@s.whatsapp.net") {
+			t.Fatalf("Unexpected agent notification: %v", payload)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Agent webhook not notified")
+	}
+	select {
+	case to := <-mails:
+		if to != "bob@example.com" {
+			t.Fatalf("Unexpected email recipient %s", to)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Agent email not sent")
+	}
+
+	// Keyword routing picks the matching agent regardless of rotation
+	apiRequest(t, "POST", ts.URL+"/api/routing", apiKey, map[string]string{"policy": ROUTING_KEYWORD}, nil)
+	receive("14155550005@s.whatsapp.net", "m5", "I want a REFUND please")
+	if name := assignee("14155550005@s.whatsapp.net"); name != "Bob" {
+		t.Fatalf("Expected keyword match to Bob, got %s", name)
+	}
+
+	// Reassign and unassign
+	var assignment ConversationAssignment
+	resp := apiRequest(t, "POST", ts.URL+"/api/conversations/14155550005@s.whatsapp.net/assign", apiKey, map[string]int64{"agent_id": ann.ID}, &assignment)
+	if resp.StatusCode != 200 || assignment.AgentName != "Ann" || assignment.Reason != ASSIGNED_MANUALLY {
+		t.Fatalf("Reassign failed: %d %+v", resp.StatusCode, assignment)
+	}
+	apiRequest(t, "GET", ts.URL+"/api/messages?chat_jid=14155550005@s.whatsapp.net", apiKey, nil, &messages)
+	if len(messages) != 1 || messages[0].Annotation.AssignedTo != "Ann" {
+		t.Fatalf("Expected message reassigned to Ann, got %+v", messages)
+	}
+	if resp := apiRequest(t, "POST", ts.URL+"/api/conversations/14155550005@s.whatsapp.net/assign", apiKey, map[string]int64{"agent_id": 999}, nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected 404 for unknown agent, got %d", resp.StatusCode)
+	}
+	apiRequest(t, "POST", ts.URL+"/api/conversations/14155550005@s.whatsapp.net/assign", apiKey, map[string]int64{"agent_id": 0}, nil)
+	if name := assignee("14155550005@s.whatsapp.net"); name != "" {
+		t.Fatalf("Expected chat unassigned, got %s", name)
+	}
+
+	// Inactive agents get no new chats; deleting an agent unassigns its chats
+	bob.Active = false
+	resp = apiRequest(t, "POST", ts.URL+fmt.Sprintf("/api/agents/%d", bob.ID), apiKey, map[string]interface{}{"name": "Bob", "active": false}, &bob)
+	if resp.StatusCode != 200 || bob.Active {
+		t.Fatalf("Deactivate failed: %d %+v", resp.StatusCode, bob)
+	}
+	receive("14155550006@s.whatsapp.net", "m6", "refund")
+	if name := assignee("14155550006@s.whatsapp.net"); name != "Ann" {
+		t.Fatalf("Expected Ann while Bob is inactive, got %s", name)
+	}
+	if resp := apiRequest(t, "DELETE", ts.URL+fmt.Sprintf("/api/agents/%d", ann.ID), apiKey, nil, nil); resp.StatusCode != 200 {
+		t.Fatalf("Delete agent failed, status: %d", resp.StatusCode)
+	}
+	var conversations []ConversationAssignment
+	apiRequest(t, "GET", ts.URL+fmt.Sprintf("/api/conversations?agent_id=%d", ann.ID), apiKey, nil, &conversations)
+	if len(conversations) != 0 {
+		t.Fatalf("Expected deleted agent's chats unassigned, got %+v", conversations)
+	}
+}
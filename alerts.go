@@ -0,0 +1,522 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Delivery alerts ---
+// Users define alert rules on delivery health, e.g. "webhook failure rate above 20%
+// over 10 minutes" or "a message waiting in the queue for more than 5 minutes". A
+// background monitor evaluates them every ALERT_CHECK_INTERVAL. When a rule starts
+// firing it notifies the rule's URL and/or email, and again when it resolves; while it
+// fires, the affected webhooks and queue list it under "alerts" in the API.
+//
+// Metrics:
+//   - webhook_failure_rate: percentage of failed deliveries over the window
+//     (evaluated once a webhook has ALERT_MIN_DELIVERIES deliveries in the window)
+//   - webhook_latency: average delivery time in milliseconds over the window
+//   - queue_wait: seconds the oldest queued message has been waiting (no window)
+
+const (
+	ALERT_WEBHOOK_FAILURE_RATE = "webhook_failure_rate"
+	ALERT_WEBHOOK_LATENCY      = "webhook_latency"
+	ALERT_QUEUE_WAIT           = "queue_wait"
+	ALERT_RESOURCE_QUEUE       = "queue" // Resource name of the user's send queue
+	ALERT_CHECK_INTERVAL       = time.Minute
+	ALERT_MAX_WINDOW           = time.Hour // Delivery outcomes are kept this long
+	ALERT_MIN_DELIVERIES       = 5
+	MAX_ALERT_RULES            = 50
+	EVENT_ALERT_FIRING         = "alert.firing"
+	EVENT_ALERT_RESOLVED       = "alert.resolved"
+)
+
+var alertMetrics = map[string]bool{
+	ALERT_WEBHOOK_FAILURE_RATE: true,
+	ALERT_WEBHOOK_LATENCY:      true,
+	ALERT_QUEUE_WAIT:           true,
+}
+
+type AlertRule struct {
+	ID            string     `json:"id"`
+	Metric        string     `json:"metric"`
+	WebhookID     string     `json:"webhook_id,omitempty"` // Webhook metrics only; empty = each of the user's webhooks
+	Threshold     float64    `json:"threshold"`            // Fires when the metric is above it
+	WindowSeconds int        `json:"window_seconds,omitempty"`
+	NotifyURL     string     `json:"notify_url,omitempty"`
+	NotifyEmail   string     `json:"notify_email,omitempty"`
+	Firing        bool       `json:"firing"`
+	Resources     []string   `json:"resources,omitempty"`  // Webhook IDs or "queue" the rule fires for
+	LastValue     *float64   `json:"last_value,omitempty"` // Worst value at the last check
+	FiredAt       *time.Time `json:"fired_at,omitempty"`
+	CheckedAt     *time.Time `json:"checked_at,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+}
+
+// Check and normalize a new rule
+func validateAlertRule(userID int64, rule *AlertRule) error {
+	if !alertMetrics[rule.Metric] {
+		return fmt.Errorf("metric must be one of %s, %s, %s", ALERT_WEBHOOK_FAILURE_RATE, ALERT_WEBHOOK_LATENCY, ALERT_QUEUE_WAIT)
+	}
+	if rule.Threshold < 0 {
+		return fmt.Errorf("threshold must not be negative")
+	}
+	if rule.Metric == ALERT_QUEUE_WAIT {
+		if rule.WebhookID != "" {
+			return fmt.Errorf("webhook_id only applies to webhook metrics")
+		}
+		rule.WindowSeconds = 0
+	} else {
+		if rule.WindowSeconds <= 0 {
+			rule.WindowSeconds = int((10 * time.Minute).Seconds())
+		}
+		if time.Duration(rule.WindowSeconds)*time.Second > ALERT_MAX_WINDOW {
+			return fmt.Errorf("window_seconds must be at most %d", int(ALERT_MAX_WINDOW.Seconds()))
+		}
+		if rule.WebhookID != "" {
+			if _, err := dbGetWebhook(userID, rule.WebhookID); err != nil {
+				return fmt.Errorf("webhook %s not found", rule.WebhookID)
+			}
+		}
+	}
+	if rule.Metric == ALERT_WEBHOOK_FAILURE_RATE && rule.Threshold >= 100 {
+		return fmt.Errorf("threshold is a percentage and must be below 100")
+	}
+	if rule.NotifyURL == "" && rule.NotifyEmail == "" {
+		return fmt.Errorf("notify_url or notify_email is required")
+	}
+	if rule.NotifyURL != "" {
+		if err := validateOutboundURL(rule.NotifyURL); err != nil {
+			return err
+		}
+	}
+	if rule.NotifyEmail != "" {
+		addr, err := mail.ParseAddress(rule.NotifyEmail)
+		if err != nil {
+			return fmt.Errorf("invalid notify_email %q", rule.NotifyEmail)
+		}
+		rule.NotifyEmail = addr.Address
+	}
+	return nil
+}
+
+// --- Delivery outcomes ---
+// Kept in memory per webhook, in one-minute buckets over the last ALERT_MAX_WINDOW.
+
+type deliveryBucket struct {
+	minute   int64 // Unix time / 60
+	total    int
+	failed   int
+	duration time.Duration // Sum over all deliveries
+}
+
+var webhookOutcomes = struct {
+	sync.Mutex
+	data map[string][]deliveryBucket // By webhook ID, oldest first
+}{data: make(map[string][]deliveryBucket)}
+
+// Record a delivery to a webhook (all of its destinations) that started at start
+func recordWebhookDelivery(webhookID string, start time.Time, deliveryErr error) {
+	now := time.Now()
+	minute := now.Unix() / 60
+	oldest := now.Add(-ALERT_MAX_WINDOW).Unix() / 60
+	recordWebhookHealth(webhookID, now, deliveryErr)
+
+	webhookOutcomes.Lock()
+	defer webhookOutcomes.Unlock()
+	buckets := webhookOutcomes.data[webhookID]
+	for len(buckets) > 0 && buckets[0].minute < oldest {
+		buckets = buckets[1:]
+	}
+	if len(buckets) == 0 || buckets[len(buckets)-1].minute != minute {
+		buckets = append(buckets, deliveryBucket{minute: minute})
+	}
+	b := &buckets[len(buckets)-1]
+	b.total++
+	if deliveryErr != nil {
+		b.failed++
+	}
+	b.duration += now.Sub(start)
+	webhookOutcomes.data[webhookID] = buckets
+}
+
+// Deliveries, failures and total delivery time for a webhook since a time
+func webhookDeliveryStats(webhookID string, since time.Time) (total, failed int, duration time.Duration) {
+	from := since.Unix() / 60
+	webhookOutcomes.Lock()
+	defer webhookOutcomes.Unlock()
+	for _, b := range webhookOutcomes.data[webhookID] {
+		if b.minute >= from {
+			total += b.total
+			failed += b.failed
+			duration += b.duration
+		}
+	}
+	return total, failed, duration
+}
+
+// How long the oldest message waiting to be sent has been in a user's queue
+func oldestQueueWait(email string, now time.Time) time.Duration {
+	queueMutex.RLock()
+	queue := messageQueues[email]
+	queueMutex.RUnlock()
+	if queue == nil {
+		return 0
+	}
+	queue.mu.RLock()
+	defer queue.mu.RUnlock()
+	var wait time.Duration
+	for _, msg := range queue.Messages {
+		if msg.Status != "queued" && msg.Status != "sending" {
+			continue
+		}
+		if d := now.Sub(msg.CreatedAt); d > wait {
+			wait = d
+		}
+	}
+	return wait
+}
+
+// The metric per resource the rule watches, for resources with enough data
+func alertValues(userID int64, email string, rule AlertRule, now time.Time) (map[string]float64, error) {
+	values := map[string]float64{}
+	if rule.Metric == ALERT_QUEUE_WAIT {
+		values[ALERT_RESOURCE_QUEUE] = oldestQueueWait(email, now).Seconds()
+		return values, nil
+	}
+	webhooks, err := dbListWebhooks(userID)
+	if err != nil {
+		return nil, err
+	}
+	since := now.Add(-time.Duration(rule.WindowSeconds) * time.Second)
+	for _, wh := range webhooks {
+		if rule.WebhookID != "" && wh.ID != rule.WebhookID {
+			continue
+		}
+		total, failed, duration := webhookDeliveryStats(wh.ID, since)
+		switch {
+		case rule.Metric == ALERT_WEBHOOK_FAILURE_RATE && total >= ALERT_MIN_DELIVERIES:
+			values[wh.ID] = float64(failed) * 100 / float64(total)
+		case rule.Metric == ALERT_WEBHOOK_LATENCY && total > 0:
+			values[wh.ID] = float64(duration.Milliseconds()) / float64(total)
+		}
+	}
+	return values, nil
+}
+
+// --- Storage ---
+
+const alertRuleColumns = `id, metric, webhook_id, threshold, window_seconds, notify_url, notify_email, firing_resources, last_value, fired_at, checked_at, created_at`
+
+func scanAlertRule(row interface{ Scan(...interface{}) error }, extra ...interface{}) (AlertRule, error) {
+	var rule AlertRule
+	var resources, createdAt string
+	var lastValue sql.NullFloat64
+	var firedAt, checkedAt sql.NullString
+	dest := append(extra, &rule.ID, &rule.Metric, &rule.WebhookID, &rule.Threshold, &rule.WindowSeconds,
+		&rule.NotifyURL, &rule.NotifyEmail, &resources, &lastValue, &firedAt, &checkedAt, &createdAt)
+	if err := row.Scan(dest...); err != nil {
+		return rule, err
+	}
+	if resources != "" {
+		rule.Resources = strings.Split(resources, ",")
+	}
+	rule.Firing = len(rule.Resources) > 0
+	if lastValue.Valid {
+		rule.LastValue = &lastValue.Float64
+	}
+	for _, ts := range []struct {
+		value sql.NullString
+		dest  **time.Time
+	}{{firedAt, &rule.FiredAt}, {checkedAt, &rule.CheckedAt}} {
+		if ts.value.Valid {
+			if t, err := time.Parse(time.RFC3339, ts.value.String); err == nil {
+				*ts.dest = &t
+			}
+		}
+	}
+	rule.CreatedAt, _ = time.Parse(time.RFC3339, createdAt)
+	return rule, nil
+}
+
+func dbCreateAlertRule(userID int64, rule AlertRule) error {
+	return dbCreateAlertRuleWith(db, userID, rule)
+}
+
+func dbCreateAlertRuleWith(exec dbExecer, userID int64, rule AlertRule) error {
+	_, err := exec.Exec(`INSERT INTO alert_rules (id, user_id, metric, webhook_id, threshold, window_seconds, notify_url, notify_email, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		rule.ID, userID, rule.Metric, rule.WebhookID, rule.Threshold, rule.WindowSeconds, rule.NotifyURL, rule.NotifyEmail, rule.CreatedAt.UTC().Format(time.RFC3339))
+	return err
+}
+
+func dbListAlertRules(userID int64) ([]AlertRule, error) {
+	rows, err := db.Query(`SELECT `+alertRuleColumns+` FROM alert_rules WHERE user_id = ? ORDER BY created_at`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	rules := []AlertRule{}
+	for rows.Next() {
+		rule, err := scanAlertRule(rows)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, rows.Err()
+}
+
+func dbDeleteAlertRule(userID int64, id string) (bool, error) {
+	res, err := db.Exec(`DELETE FROM alert_rules WHERE user_id = ? AND id = ?`, userID, id)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// Store the result of a check; firedAt is only changed when the rule starts firing
+func dbSetAlertState(id string, resources []string, lastValue *float64, firedAt *time.Time, checkedAt time.Time) error {
+	var fired interface{}
+	if firedAt != nil {
+		fired = firedAt.UTC().Format(time.RFC3339)
+	}
+	_, err := db.Exec(`UPDATE alert_rules SET firing_resources = ?, last_value = ?, fired_at = ?, checked_at = ? WHERE id = ?`,
+		strings.Join(resources, ","), lastValue, fired, checkedAt.UTC().Format(time.RFC3339), id)
+	return err
+}
+
+// Alert rule IDs firing for each of a user's resources (webhook IDs and "queue")
+func firingAlerts(userID int64) map[string][]string {
+	byResource := map[string][]string{}
+	rules, err := dbListAlertRules(userID)
+	if err != nil {
+		fmt.Printf("ERROR: Could not load alert rules for user %d: %v\n", userID, err)
+		return byResource
+	}
+	for _, rule := range rules {
+		for _, resource := range rule.Resources {
+			byResource[resource] = append(byResource[resource], rule.ID)
+		}
+	}
+	return byResource
+}
+
+// --- Monitor ---
+
+// Check every rule every ALERT_CHECK_INTERVAL
+func startAlertMonitor() {
+	runEvery(ALERT_CHECK_INTERVAL, checkAlerts)
+}
+
+// Evaluate all rules, notifying about the ones that start firing or resolve
+func checkAlerts(now time.Time) {
+	rows, err := db.Query(`SELECT alert_rules.user_id, users.email, ` + prefixColumns("alert_rules", alertRuleColumns) + `
+		FROM alert_rules JOIN users ON users.id = alert_rules.user_id`)
+	if err != nil {
+		fmt.Println("ERROR: Could not load alert rules", err)
+		return
+	}
+	type userRule struct {
+		userID int64
+		email  string
+		rule   AlertRule
+	}
+	var rules []userRule
+	for rows.Next() {
+		var ur userRule
+		rule, err := scanAlertRule(rows, &ur.userID, &ur.email)
+		if err != nil {
+			fmt.Println("ERROR: Could not read alert rule", err)
+			continue
+		}
+		ur.rule = rule
+		rules = append(rules, ur)
+	}
+	rows.Close()
+
+	for _, ur := range rules {
+		evaluateAlertRule(ur.userID, ur.email, ur.rule, now)
+	}
+}
+
+func prefixColumns(table, columns string) string {
+	parts := strings.Split(columns, ", ")
+	for i, c := range parts {
+		parts[i] = table + "." + c
+	}
+	return strings.Join(parts, ", ")
+}
+
+func evaluateAlertRule(userID int64, email string, rule AlertRule, now time.Time) {
+	values, err := alertValues(userID, email, rule, now)
+	if err != nil {
+		fmt.Printf("ERROR: Could not evaluate alert rule %s: %v\n", rule.ID, err)
+		return
+	}
+	var resources []string
+	var worst *float64
+	for resource, value := range values {
+		if worst == nil || value > *worst {
+			v := value
+			worst = &v
+		}
+		if value > rule.Threshold {
+			resources = append(resources, resource)
+		}
+	}
+	sort.Strings(resources)
+
+	firedAt := rule.FiredAt
+	switch {
+	case len(resources) > 0 && !rule.Firing:
+		firedAt = &now
+		notifyAlert(email, rule, EVENT_ALERT_FIRING, resources, worst, now)
+	case len(resources) == 0 && rule.Firing:
+		firedAt = nil
+		notifyAlert(email, rule, EVENT_ALERT_RESOLVED, rule.Resources, worst, now)
+	case len(resources) == 0:
+		firedAt = nil
+	}
+	if err := dbSetAlertState(rule.ID, resources, worst, firedAt, now); err != nil {
+		fmt.Printf("ERROR: Could not store alert rule %s state: %v\n", rule.ID, err)
+	}
+}
+
+// Tell the rule's URL and email that it started firing or resolved
+func notifyAlert(email string, rule AlertRule, event string, resources []string, value *float64, now time.Time) {
+	fmt.Printf("INFO: Alert rule %s of %s: %s for %s\n", rule.ID, email, event, strings.Join(resources, ", "))
+	payload := map[string]interface{}{
+		"event":     event,
+		"rule_id":   rule.ID,
+		"metric":    rule.Metric,
+		"threshold": rule.Threshold,
+		"resources": resources,
+		"timestamp": now.Unix(),
+	}
+	if value != nil {
+		payload["value"] = *value
+	}
+	if rule.NotifyURL != "" {
+		data, _ := json.Marshal(payload)
+		go func() {
+			resp, err := webhookHTTPClient().Post(rule.NotifyURL, "application/json", bytes.NewReader(data))
+			if err != nil {
+				fmt.Printf("ERROR: Could not send alert %s to %s: %v\n", rule.ID, rule.NotifyURL, err)
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+				fmt.Printf("WARNING: Alert notification to %s returned status %d\n", rule.NotifyURL, resp.StatusCode)
+			}
+		}()
+	}
+	if rule.NotifyEmail != "" {
+		state := "firing"
+		if event == EVENT_ALERT_RESOLVED {
+			state = "resolved"
+		}
+		subject := fmt.Sprintf("Alert %s: %s", state, rule.Metric)
+		body := fmt.Sprintf("Alert rule %s (%s above %g) is %s.\nAffected: %s\n", rule.ID, rule.Metric, rule.Threshold, state, strings.Join(resources, ", "))
+		if value != nil {
+			body += fmt.Sprintf("Current value: %.1f\n", *value)
+		}
+		go func() {
+			if err := sendEmail(rule.NotifyEmail, subject, body); err != nil {
+				fmt.Printf("ERROR: Could not email alert %s to %s: %v\n", rule.ID, rule.NotifyEmail, err)
+			}
+		}()
+	}
+}
+
+// --- Handlers ---
+
+// GET/POST /api/alerts
+// POST {"metric", "threshold", "window_seconds"?, "webhook_id"?, "notify_url"?, "notify_email"?} creates a rule.
+func handleAlertRules(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(int64)
+	switch r.Method {
+	case "GET":
+		rules, err := dbListAlertRules(userID)
+		if err != nil {
+			apiError(w, "Failed to load alert rules", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rules)
+	case "POST":
+		var req struct {
+			Metric        string  `json:"metric"`
+			WebhookID     string  `json:"webhook_id"`
+			Threshold     float64 `json:"threshold"`
+			WindowSeconds int     `json:"window_seconds"`
+			NotifyURL     string  `json:"notify_url"`
+			NotifyEmail   string  `json:"notify_email"`
+		}
+		if err := decodeJSONBody(w, r, &req); err != nil {
+			writeBodyError(w, err)
+			return
+		}
+		rules, err := dbListAlertRules(userID)
+		if err != nil {
+			apiError(w, "Failed to load alert rules", http.StatusInternalServerError)
+			return
+		}
+		if len(rules) >= MAX_ALERT_RULES {
+			apiError(w, fmt.Sprintf("Too many alert rules (max %d)", MAX_ALERT_RULES), http.StatusBadRequest)
+			return
+		}
+		rule := AlertRule{
+			ID:            generateWebhookID(),
+			Metric:        req.Metric,
+			WebhookID:     req.WebhookID,
+			Threshold:     req.Threshold,
+			WindowSeconds: req.WindowSeconds,
+			NotifyURL:     strings.TrimSpace(req.NotifyURL),
+			NotifyEmail:   strings.TrimSpace(req.NotifyEmail),
+			CreatedAt:     time.Now(),
+		}
+		if err := validateAlertRule(userID, &rule); err != nil {
+			apiError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := dbCreateAlertRule(userID, rule); err != nil {
+			fmt.Println("ERROR: Could not create alert rule", err)
+			apiError(w, "Failed to create alert rule", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(rule)
+	default:
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// DELETE /api/alerts/{id}
+func handleDeleteAlertRule(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "DELETE" {
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID := r.Context().Value("userID").(int64)
+	deleted, err := dbDeleteAlertRule(userID, r.PathValue("id"))
+	if err != nil {
+		apiError(w, "Failed to delete alert rule", http.StatusInternalServerError)
+		return
+	}
+	if !deleted {
+		apiError(w, "Alert rule not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true})
+}
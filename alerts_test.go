@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDeliveryAlerts(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+
+	_, apiKey := registerWithAPIKey(t, ts, "alerts@example.com", "alertspass123")
+	userID, _ := getUserIDByEmail("alerts@example.com")
+
+	notifications := make(chan map[string]interface{}, 10)
+	notify := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		notifications <- body
+	}))
+	defer notify.Close()
+	emails := make(chan string, 10)
+	sendEmail = func(to, subject, body string) error {
+		emails <- to + ": " + subject
+		return nil
+	}
+	defer func() { sendEmail = defaultSendEmail }()
+	nextNotification := func(event string) map[string]interface{} {
+		t.Helper()
+		select {
+		case n := <-notifications:
+			if n["event"] != event {
+				t.Fatalf("Expected %s, got %v", event, n)
+			}
+			return n
+		case <-time.After(5 * time.Second):
+			t.Fatalf("No %s notification", event)
+		}
+		return nil
+	}
+
+	var wh Webhook
+	if resp := apiRequest(t, "POST", ts.URL+"/api/webhooks/create", apiKey, map[string]interface{}{"url": notify.URL + "/hook", "method": "POST"}, &wh); resp.StatusCode != 200 || wh.ID == "" {
+		t.Fatalf("Create webhook failed: %d", resp.StatusCode)
+	}
+
+	for _, bad := range []map[string]interface{}{
+		{"metric": "cpu", "threshold": 1, "notify_url": notify.URL},
+		{"metric": ALERT_WEBHOOK_FAILURE_RATE, "threshold": 20},
+		{"metric": ALERT_WEBHOOK_FAILURE_RATE, "threshold": 120, "notify_url": notify.URL},
+		{"metric": ALERT_WEBHOOK_LATENCY, "threshold": 500, "window_seconds": 7200, "notify_url": notify.URL},
+		{"metric": ALERT_QUEUE_WAIT, "threshold": 300, "webhook_id": wh.ID, "notify_url": notify.URL},
+		{"metric": ALERT_WEBHOOK_FAILURE_RATE, "threshold": 20, "webhook_id": "missing", "notify_url": notify.URL},
+		{"metric": ALERT_QUEUE_WAIT, "threshold": 300, "notify_email": "not an email"},
+	} {
+		if resp := apiRequest(t, "POST", ts.URL+"/api/alerts", apiKey, bad, nil); resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("Expected 400 for %v, got %d", bad, resp.StatusCode)
+		}
+	}
+
+	var failureRule, queueRule AlertRule
+	if resp := apiRequest(t, "POST", ts.URL+"/api/alerts", apiKey, map[string]interface{}{
+		"metric": ALERT_WEBHOOK_FAILURE_RATE, "threshold": 20, "notify_url": notify.URL,
+	}, &failureRule); resp.StatusCode != http.StatusCreated || failureRule.WindowSeconds != 600 {
+		t.Fatalf("Failed to create rule: %d %+v", resp.StatusCode, failureRule)
+	}
+	apiRequest(t, "POST", ts.URL+"/api/alerts", apiKey, map[string]interface{}{
+		"metric": ALERT_QUEUE_WAIT, "threshold": 300, "notify_email": "Ops <ops@example.com>",
+	}, &queueRule)
+	if queueRule.NotifyEmail != "ops@example.com" {
+		t.Fatalf("Expected the address to be normalized, got %q", queueRule.NotifyEmail)
+	}
+
+	// Too few deliveries to judge, then 2 failures out of 5
+	now := time.Now()
+	for i := 0; i < 4; i++ {
+		recordWebhookDelivery(wh.ID, now, errors.New("status 500"))
+	}
+	checkAlerts(now)
+	var rules []AlertRule
+	apiRequest(t, "GET", ts.URL+"/api/alerts", apiKey, nil, &rules)
+	if len(rules) != 2 || rules[0].Firing || rules[0].CheckedAt == nil {
+		t.Fatalf("Expected no alert yet: %+v", rules)
+	}
+	recordWebhookDelivery(wh.ID, now, nil)
+	checkAlerts(now)
+	n := nextNotification(EVENT_ALERT_FIRING)
+	if n["rule_id"] != failureRule.ID || n["value"] != 80.0 {
+		t.Fatalf("Unexpected notification %v", n)
+	}
+	var webhooks []Webhook
+	apiRequest(t, "GET", ts.URL+"/api/webhooks", apiKey, nil, &webhooks)
+	if len(webhooks) != 1 || len(webhooks[0].Alerts) != 1 || webhooks[0].Alerts[0] != failureRule.ID {
+		t.Fatalf("Expected the webhook to be flagged: %+v", webhooks)
+	}
+
+	// Checking again while it fires sends nothing; it resolves once the failures leave the window
+	checkAlerts(now)
+	select {
+	case n := <-notifications:
+		t.Fatalf("Unexpected repeated notification %v", n)
+	case <-time.After(200 * time.Millisecond):
+	}
+	checkAlerts(now.Add(11 * time.Minute))
+	nextNotification(EVENT_ALERT_RESOLVED)
+	webhooks = nil
+	apiRequest(t, "GET", ts.URL+"/api/webhooks", apiKey, nil, &webhooks)
+	if len(webhooks[0].Alerts) != 0 {
+		t.Fatalf("Expected the flag to be cleared: %+v", webhooks[0])
+	}
+
+	// A message waiting 10 minutes in the queue
+	queueMutex.Lock()
+	messageQueues["alerts@example.com"] = &MessageQueue{UserEmail: "alerts@example.com", Messages: []*QueuedMessage{
+		{ID: "q1", Status: "queued", CreatedAt: now.Add(-10 * time.Minute)},
+	}}
+	queueMutex.Unlock()
+	defer func() {
+		queueMutex.Lock()
+		delete(messageQueues, "alerts@example.com")
+		queueMutex.Unlock()
+	}()
+	checkAlerts(now)
+	select {
+	case email := <-emails:
+		if email != "ops@example.com: Alert firing: queue_wait" {
+			t.Fatalf("Unexpected email %q", email)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("No alert email")
+	}
+	rules, _ = dbListAlertRules(userID)
+	if !rules[1].Firing || len(rules[1].Resources) != 1 || rules[1].Resources[0] != ALERT_RESOURCE_QUEUE {
+		t.Fatalf("Expected the queue rule to fire: %+v", rules[1])
+	}
+
+	if resp := apiRequest(t, "DELETE", ts.URL+"/api/alerts/"+queueRule.ID, apiKey, nil, nil); resp.StatusCode != 200 {
+		t.Fatalf("Failed to delete rule: %d", resp.StatusCode)
+	}
+	if resp := apiRequest(t, "DELETE", ts.URL+"/api/alerts/"+queueRule.ID, apiKey, nil, nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected 404 for a deleted rule, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// --- Analytics ---
+// Daily per-user counters, bucketed by day in the user's timezone.
+
+const (
+	STAT_AUTO_RESPONDER_SENT       = "auto_responder_sent"
+	STAT_AUTO_RESPONDER_SUPPRESSED = "auto_responder_suppressed" // Already replied to the chat within the window
+
+	DEFAULT_ANALYTICS_DAYS = 7
+	MAX_ANALYTICS_DAYS     = 90
+)
+
+// Add one to a counter for today
+func incrementStat(userID int64, metric string) {
+	day := time.Now().In(getUserLocation(userID)).Format("2006-01-02")
+	_, err := db.Exec(`INSERT INTO daily_stats (user_id, day, metric, count) VALUES (?, ?, ?, 1)
+		ON CONFLICT(user_id, day, metric) DO UPDATE SET count = count + 1`, userID, day, metric)
+	if err != nil {
+		fmt.Printf("ERROR: Could not update %s counter for user %d: %v\n", metric, userID, err)
+	}
+}
+
+type DailyStats struct {
+	Date         string           `json:"date"`
+	Timestamp    int64            `json:"timestamp"`     // Start of the day in the user's timezone
+	TimestampISO string           `json:"timestamp_iso"` // The same, as ISO-8601 with the user's offset
+	Counts       map[string]int64 `json:"counts"`
+}
+
+// Counters for each day from `from` to `to` (inclusive, YYYY-MM-DD), oldest first
+func dbGetDailyStats(ctx context.Context, userID int64, from, to string) ([]DailyStats, error) {
+	rows, err := db.QueryContext(ctx, `SELECT day, metric, count FROM daily_stats WHERE user_id = ? AND day >= ? AND day <= ? ORDER BY day`, userID, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	days := []DailyStats{}
+	for rows.Next() {
+		var day, metric string
+		var count int64
+		if err := rows.Scan(&day, &metric, &count); err != nil {
+			return nil, err
+		}
+		if len(days) == 0 || days[len(days)-1].Date != day {
+			days = append(days, DailyStats{Date: day, Counts: map[string]int64{}})
+		}
+		days[len(days)-1].Counts[metric] = count
+	}
+	return days, rows.Err()
+}
+
+// GET /api/analytics?days=7
+// Daily counters for the last N days (including today) and their totals.
+func handleAnalytics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID := r.Context().Value("userID").(int64)
+
+	days := DEFAULT_ANALYTICS_DAYS
+	if v := r.URL.Query().Get("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > MAX_ANALYTICS_DAYS {
+			apiError(w, fmt.Sprintf("Invalid days (1-%d)", MAX_ANALYTICS_DAYS), http.StatusBadRequest)
+			return
+		}
+		days = n
+	}
+	loc := getUserLocation(userID)
+	now := time.Now().In(loc)
+	from := now.AddDate(0, 0, -(days - 1)).Format("2006-01-02")
+	to := now.Format("2006-01-02")
+
+	ctx, cancel := queryContext(r)
+	defer cancel()
+	daily, err := dbGetDailyStats(ctx, userID, from, to)
+	if err != nil {
+		fmt.Println("ERROR: Could not load analytics for user", userID, err)
+		apiError(w, "Failed to load analytics", http.StatusInternalServerError)
+		return
+	}
+	totals := map[string]int64{}
+	for i, d := range daily {
+		if start, err := time.ParseInLocation("2006-01-02", d.Date, loc); err == nil {
+			daily[i].Timestamp = start.Unix()
+			daily[i].TimestampISO = formatLocalTime(start, loc)
+		}
+		for metric, count := range d.Counts {
+			totals[metric] += count
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"from":     from,
+		"to":       to,
+		"timezone": loc.String(),
+		"totals":   totals,
+		"daily":    daily,
+	})
+}
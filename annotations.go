@@ -0,0 +1,303 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+// --- Message archive and annotations ---
+// Received messages are archived so they can be worked through as a shared inbox:
+// each can be marked handled or flagged, assigned to someone and given a note.
+// Annotation changes are sent to webhooks subscribed to "annotation.updated".
+
+const (
+	ANNOTATION_OPEN    = "open"
+	ANNOTATION_HANDLED = "handled"
+	ANNOTATION_FLAGGED = "flagged"
+
+	DEFAULT_MESSAGE_PAGE_SIZE = 50
+	MAX_MESSAGE_PAGE_SIZE     = 200
+	MAX_ASSIGNEE_LENGTH       = 100
+	MAX_NOTE_LENGTH           = 2000
+)
+
+type MessageAnnotation struct {
+	State      string     `json:"state"` // "open", "handled" or "flagged"
+	AssignedTo string     `json:"assigned_to"`
+	Note       string     `json:"note"`
+	UpdatedAt  *time.Time `json:"updated_at,omitempty"`
+}
+
+type ArchivedMessage struct {
+	ChatJID    string                 `json:"chat_jid"`
+	MessageID  string                 `json:"message_id"`
+	Sender     string                 `json:"sender"`
+	Type       string                 `json:"type"`
+	Text       string                 `json:"text"`
+	Timestamp  time.Time              `json:"timestamp"`
+	Payload    map[string]interface{} `json:"payload"` // As forwarded to webhooks
+	Annotation MessageAnnotation      `json:"annotation"`
+}
+
+func validAnnotationState(state string) bool {
+	return state == ANNOTATION_OPEN || state == ANNOTATION_HANDLED || state == ANNOTATION_FLAGGED
+}
+
+// Archive a received message, assigned to the chat's agent if any (duplicates of an
+// archived message are ignored)
+func archiveMessage(userID int64, chatJID string, payload map[string]interface{}, assignedTo string) error {
+	messageID, _ := payload["id"].(string)
+	if chatJID == "" || messageID == "" {
+		return nil
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	sender, _ := payload["from"].(string)
+	msgType, _ := payload["type"].(string)
+	text, _ := payload["text"].(string)
+	if text == "" {
+		text, _ = payload["caption"].(string)
+	}
+	at := time.Now()
+	if ts, ok := payload["timestamp"].(int64); ok {
+		at = time.Unix(ts, 0)
+	}
+	_, err = preparedExec(db, `INSERT OR IGNORE INTO messages (user_id, chat_jid, message_id, sender, type, text, payload, timestamp, assigned_to) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		userID, chatJID, messageID, sender, msgType, text, string(data), at.UTC().Format(time.RFC3339), assignedTo)
+	return err
+}
+
+// Query parameters for GET /api/messages
+type messageListOptions struct {
+	ChatJID    string
+	State      string
+	AssignedTo string
+	Limit      int
+	Offset     int
+}
+
+// Parse ?chat_jid=&state=&assigned_to=&limit=&offset=
+func parseMessageListOptions(q url.Values) (messageListOptions, error) {
+	opts := messageListOptions{
+		State:      q.Get("state"),
+		AssignedTo: q.Get("assigned_to"),
+		Limit:      DEFAULT_MESSAGE_PAGE_SIZE,
+	}
+	if v := q.Get("chat_jid"); v != "" {
+		jid, err := normalizeChatJID(v)
+		if err != nil {
+			return opts, errors.New("Invalid chat_jid")
+		}
+		opts.ChatJID = jid.String()
+	}
+	if opts.State != "" && !validAnnotationState(opts.State) {
+		return opts, errors.New("Invalid state (use open, handled or flagged)")
+	}
+	var err error
+	if v := q.Get("limit"); v != "" {
+		if opts.Limit, err = strconv.Atoi(v); err != nil || opts.Limit < 1 || opts.Limit > MAX_MESSAGE_PAGE_SIZE {
+			return opts, fmt.Errorf("Invalid limit (1-%d)", MAX_MESSAGE_PAGE_SIZE)
+		}
+	}
+	if v := q.Get("offset"); v != "" {
+		if opts.Offset, err = strconv.Atoi(v); err != nil || opts.Offset < 0 {
+			return opts, errors.New("Invalid offset")
+		}
+	}
+	return opts, nil
+}
+
+const archivedMessageColumns = `chat_jid, message_id, sender, type, text, payload, timestamp, state, assigned_to, note, annotated_at`
+
+func scanArchivedMessage(row interface{ Scan(...interface{}) error }) (ArchivedMessage, error) {
+	var m ArchivedMessage
+	var payload, timestamp string
+	var annotatedAt sql.NullString
+	err := row.Scan(&m.ChatJID, &m.MessageID, &m.Sender, &m.Type, &m.Text, &payload, &timestamp,
+		&m.Annotation.State, &m.Annotation.AssignedTo, &m.Annotation.Note, &annotatedAt)
+	if err != nil {
+		return m, err
+	}
+	json.Unmarshal([]byte(payload), &m.Payload)
+	m.Timestamp, _ = time.Parse(time.RFC3339, timestamp)
+	if annotatedAt.Valid {
+		if t, err := time.Parse(time.RFC3339, annotatedAt.String); err == nil {
+			m.Annotation.UpdatedAt = &t
+		}
+	}
+	return m, nil
+}
+
+// List a page of a user's archived messages, newest first, with the total matching the filters
+func dbQueryMessages(userID int64, opts messageListOptions) ([]ArchivedMessage, int, error) {
+	where := `WHERE user_id = ?`
+	args := []interface{}{userID}
+	if opts.ChatJID != "" {
+		where += ` AND chat_jid = ?`
+		args = append(args, opts.ChatJID)
+	}
+	if opts.State != "" {
+		where += ` AND state = ?`
+		args = append(args, opts.State)
+	}
+	if opts.AssignedTo != "" {
+		where += ` AND assigned_to = ?`
+		args = append(args, opts.AssignedTo)
+	}
+
+	var total int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM messages `+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	rows, err := db.Query(`SELECT `+archivedMessageColumns+` FROM messages `+where+` ORDER BY timestamp DESC, message_id LIMIT ? OFFSET ?`,
+		append(args, opts.Limit, opts.Offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	messages := []ArchivedMessage{}
+	for rows.Next() {
+		m, err := scanArchivedMessage(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		messages = append(messages, m)
+	}
+	return messages, total, rows.Err()
+}
+
+func dbGetArchivedMessage(userID int64, chatJID, messageID string) (ArchivedMessage, error) {
+	row := db.QueryRow(`SELECT `+archivedMessageColumns+` FROM messages WHERE user_id = ? AND chat_jid = ? AND message_id = ?`, userID, chatJID, messageID)
+	return scanArchivedMessage(row)
+}
+
+func dbSetMessageAnnotation(userID int64, chatJID, messageID string, a MessageAnnotation) error {
+	_, err := db.Exec(`UPDATE messages SET state = ?, assigned_to = ?, note = ?, annotated_at = ? WHERE user_id = ? AND chat_jid = ? AND message_id = ?`,
+		a.State, a.AssignedTo, a.Note, a.UpdatedAt.UTC().Format(time.RFC3339), userID, chatJID, messageID)
+	return err
+}
+
+// GET /api/messages?chat_jid=&state=&assigned_to=&limit=&offset=
+func handleListMessages(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID := r.Context().Value("userID").(int64)
+
+	opts, err := parseMessageListOptions(r.URL.Query())
+	if err != nil {
+		apiError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	messages, total, err := dbQueryMessages(userID, opts)
+	if err != nil {
+		fmt.Println("ERROR: Could not list messages for user", userID, err)
+		apiError(w, "Failed to load messages", http.StatusInternalServerError)
+		return
+	}
+	// Paging info goes in headers, as for the webhooks list
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	if opts.Offset+len(messages) < total {
+		next := r.URL.Query()
+		next.Set("offset", strconv.Itoa(opts.Offset+opts.Limit))
+		w.Header().Set("Link", fmt.Sprintf(`<%s?%s>; rel="next"`, r.URL.Path, next.Encode()))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(messages)
+}
+
+// POST /api/messages/{jid}/{id}/annotation
+// Updates the fields present in {"state", "assigned_to", "note"}; the others are kept.
+func handleAnnotateMessage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID := r.Context().Value("userID").(int64)
+
+	chatJID, err := normalizeChatJID(r.PathValue("jid"))
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, ERR_INVALID_JID, "Invalid chat JID")
+		return
+	}
+	messageID := r.PathValue("id")
+
+	var req struct {
+		State      *string `json:"state"`
+		AssignedTo *string `json:"assigned_to"`
+		Note       *string `json:"note"`
+	}
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	if req.State == nil && req.AssignedTo == nil && req.Note == nil {
+		apiError(w, "Nothing to update (state, assigned_to or note)", http.StatusBadRequest)
+		return
+	}
+	if req.State != nil && !validAnnotationState(*req.State) {
+		apiError(w, "Invalid state (use open, handled or flagged)", http.StatusBadRequest)
+		return
+	}
+	if req.AssignedTo != nil && utf8.RuneCountInString(*req.AssignedTo) > MAX_ASSIGNEE_LENGTH {
+		apiError(w, fmt.Sprintf("assigned_to too long (max %d characters)", MAX_ASSIGNEE_LENGTH), http.StatusBadRequest)
+		return
+	}
+	if req.Note != nil && utf8.RuneCountInString(*req.Note) > MAX_NOTE_LENGTH {
+		apiError(w, fmt.Sprintf("note too long (max %d characters)", MAX_NOTE_LENGTH), http.StatusBadRequest)
+		return
+	}
+
+	msg, err := dbGetArchivedMessage(userID, chatJID.String(), messageID)
+	if err == sql.ErrNoRows {
+		apiError(w, "Message not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		apiError(w, "Failed to load message", http.StatusInternalServerError)
+		return
+	}
+
+	previous := msg.Annotation
+	annotation := previous
+	if req.State != nil {
+		annotation.State = *req.State
+	}
+	if req.AssignedTo != nil {
+		annotation.AssignedTo = *req.AssignedTo
+	}
+	if req.Note != nil {
+		annotation.Note = *req.Note
+	}
+	now := time.Now().UTC()
+	annotation.UpdatedAt = &now
+	if err := dbSetMessageAnnotation(userID, msg.ChatJID, msg.MessageID, annotation); err != nil {
+		fmt.Println("ERROR: Could not update message annotation", err)
+		apiError(w, "Failed to update annotation", http.StatusInternalServerError)
+		return
+	}
+	fmt.Printf("INFO: Message %s in %s annotated by user %d: state=%s assigned_to=%q\n", msg.MessageID, msg.ChatJID, userID, annotation.State, annotation.AssignedTo)
+
+	goEmitWebhookEvent(getUserEmailByID(userID), EVENT_ANNOTATION_UPDATED, msg.ChatJID, map[string]interface{}{
+		"chat_jid":       msg.ChatJID,
+		"message_id":     msg.MessageID,
+		"annotation":     annotation,
+		"previous_state": previous.State,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"chat_jid":   msg.ChatJID,
+		"message_id": msg.MessageID,
+		"annotation": annotation,
+	})
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMessageAnnotations(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+
+	email := "inbox@example.com"
+	_, apiKey := registerWithAPIKey(t, ts, email, "inboxpass123")
+
+	events := make(chan map[string]interface{}, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&payload)
+		if payload["event"] != nil {
+			events <- payload
+		}
+	}))
+	defer receiver.Close()
+
+	if resp := apiRequest(t, "POST", ts.URL+"/api/webhooks/create", apiKey, map[string]interface{}{
+		"url": receiver.URL, "method": "POST", "events": []string{"bogus"},
+	}, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for unknown event, got %d", resp.StatusCode)
+	}
+	var created Webhook
+	apiRequest(t, "POST", ts.URL+"/api/webhooks/create", apiKey, map[string]interface{}{
+		"url": receiver.URL, "method": "POST", "events": []string{EVENT_ANNOTATION_UPDATED},
+	}, &created)
+	if len(created.Events) != 1 || created.Events[0] != EVENT_ANNOTATION_UPDATED {
+		t.Fatalf("Expected events subscription, got %+v", created.Events)
+	}
+
+	alice, bob := "14155550001@s.whatsapp.net", "14155550002@s.whatsapp.net"
+	now := time.Now().Unix()
+	forwardToWebhooks(email, map[string]interface{}{"id": "m1", "from": alice, "to": alice, "type": "text", "text": "hello", "timestamp": now - 2}, "", "test_media")
+	forwardToWebhooks(email, map[string]interface{}{"id": "m2", "from": bob, "to": bob, "type": "text", "text": "help", "timestamp": now - 1}, "", "test_media")
+	forwardToWebhooks(email, map[string]interface{}{"id": "m2", "from": bob, "to": bob, "type": "text", "text": "help", "timestamp": now - 1}, "", "test_media")
+
+	var messages []ArchivedMessage
+	resp := apiRequest(t, "GET", ts.URL+"/api/messages", apiKey, nil, &messages)
+	if resp.StatusCode != 200 || resp.Header.Get("X-Total-Count") != "2" || len(messages) != 2 {
+		t.Fatalf("Expected 2 archived messages, got %d %+v", resp.StatusCode, messages)
+	}
+	if messages[0].MessageID != "m2" || messages[0].Text != "help" || messages[0].Annotation.State != ANNOTATION_OPEN {
+		t.Fatalf("Unexpected newest message: %+v", messages[0])
+	}
+
+	var annotated struct {
+		Annotation MessageAnnotation `json:"annotation"`
+	}
+	resp = apiRequest(t, "POST", ts.URL+"/api/messages/"+bob+"/m2/annotation", apiKey, map[string]string{
+		"state": ANNOTATION_FLAGGED, "assigned_to": "alice", "note": "Call back",
+	}, &annotated)
+	if resp.StatusCode != 200 || annotated.Annotation.State != ANNOTATION_FLAGGED || annotated.Annotation.UpdatedAt == nil {
+		t.Fatalf("Annotate failed: %d %+v", resp.StatusCode, annotated)
+	}
+
+	select {
+	case event := <-events:
+		if event["event"] != EVENT_ANNOTATION_UPDATED || event["message_id"] != "m2" || event["previous_state"] != ANNOTATION_OPEN {
+			t.Fatalf("Unexpected event: %v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("No annotation event delivered")
+	}
+
+	// Only the fields sent are changed
+	resp = apiRequest(t, "POST", ts.URL+"/api/messages/"+bob+"/m2/annotation", apiKey, map[string]string{"state": ANNOTATION_HANDLED}, &annotated)
+	if resp.StatusCode != 200 || annotated.Annotation.AssignedTo != "alice" || annotated.Annotation.Note != "Call back" {
+		t.Fatalf("Partial update lost fields: %+v", annotated)
+	}
+
+	resp = apiRequest(t, "GET", ts.URL+"/api/messages?state=handled&assigned_to=alice", apiKey, nil, &messages)
+	if resp.StatusCode != 200 || len(messages) != 1 || messages[0].MessageID != "m2" {
+		t.Fatalf("Expected handled message, got %+v", messages)
+	}
+	resp = apiRequest(t, "GET", ts.URL+"/api/messages?state=open&limit=1", apiKey, nil, &messages)
+	if len(messages) != 1 || messages[0].MessageID != "m1" || resp.Header.Get("Link") != "" {
+		t.Fatalf("Expected open message, got %+v (Link %q)", messages, resp.Header.Get("Link"))
+	}
+
+	for name, tc := range map[string]struct {
+		path string
+		body map[string]string
+		want int
+	}{
+		"bad state":   {"/api/messages/" + bob + "/m2/annotation", map[string]string{"state": "done"}, http.StatusBadRequest},
+		"empty":       {"/api/messages/" + bob + "/m2/annotation", map[string]string{}, http.StatusBadRequest},
+		"unknown":     {"/api/messages/" + bob + "/nope/annotation", map[string]string{"state": "handled"}, http.StatusNotFound},
+		"other chat":  {"/api/messages/" + alice + "/m2/annotation", map[string]string{"state": "handled"}, http.StatusNotFound},
+		"invalid jid": {"/api/messages/nope/m2/annotation", map[string]string{"state": "handled"}, http.StatusBadRequest},
+	} {
+		if resp := apiRequest(t, "POST", ts.URL+tc.path, apiKey, tc.body, nil); resp.StatusCode != tc.want {
+			t.Errorf("%s: expected %d, got %d", name, tc.want, resp.StatusCode)
+		}
+	}
+	if resp := apiRequest(t, "GET", ts.URL+"/api/messages?state=done", apiKey, nil, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for invalid state filter, got %d", resp.StatusCode)
+	}
+}
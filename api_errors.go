@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// --- API errors ---
+// Every API error is returned as {"error": {"code": "...", "message": "..."}} so clients
+// can branch on the code; the message is for humans and may change.
+
+const (
+	ERR_BAD_REQUEST          = "bad_request"
+	ERR_UNAUTHORIZED         = "unauthorized"
+	ERR_FORBIDDEN            = "forbidden"
+	ERR_NOT_FOUND            = "not_found"
+	ERR_METHOD_NOT_ALLOWED   = "method_not_allowed"
+	ERR_CONFLICT             = "conflict"
+	ERR_GONE                 = "gone"
+	ERR_PAYLOAD_TOO_LARGE    = "payload_too_large"
+	ERR_RATE_LIMITED         = "rate_limited"
+	ERR_QUOTA_EXCEEDED       = "quota_exceeded"
+	ERR_INTERNAL             = "internal_error"
+	ERR_UPSTREAM             = "upstream_error"
+	ERR_UNAVAILABLE          = "service_unavailable"
+	ERR_MAINTENANCE          = "maintenance"
+	ERR_INVALID_JID          = "invalid_jid"
+	ERR_WA_DISCONNECTED      = "wa_disconnected"
+	ERR_CHANNEL_DISCONNECTED = "channel_disconnected"
+	ERR_SPAM_BLOCKED         = "spam_blocked"
+	ERR_CHAT_NOT_ALLOWED     = "chat_not_allowed"
+	ERR_NOT_ON_WHATSAPP      = "not_on_whatsapp"
+	ERR_RECEIVE_ONLY         = "receive_only"
+	ERR_NO_CAPACITY          = "insufficient_capacity"
+	ERR_RISK_BLOCKED         = "risk_blocked"
+)
+
+// Default error code for an HTTP status
+func errorCodeForStatus(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return ERR_BAD_REQUEST
+	case http.StatusUnauthorized:
+		return ERR_UNAUTHORIZED
+	case http.StatusForbidden:
+		return ERR_FORBIDDEN
+	case http.StatusNotFound:
+		return ERR_NOT_FOUND
+	case http.StatusMethodNotAllowed:
+		return ERR_METHOD_NOT_ALLOWED
+	case http.StatusConflict:
+		return ERR_CONFLICT
+	case http.StatusGone:
+		return ERR_GONE
+	case http.StatusRequestEntityTooLarge:
+		return ERR_PAYLOAD_TOO_LARGE
+	case http.StatusTooManyRequests:
+		return ERR_RATE_LIMITED
+	case http.StatusBadGateway:
+		return ERR_UPSTREAM
+	case http.StatusServiceUnavailable:
+		return ERR_UNAVAILABLE
+	}
+	if status >= 500 {
+		return ERR_INTERNAL
+	}
+	return ERR_BAD_REQUEST
+}
+
+// Write a JSON error with an explicit code
+func writeAPIError(w http.ResponseWriter, status int, code, message string) {
+	writeAPIErrorDetails(w, status, code, message, nil)
+}
+
+// Write a JSON error with extra fields next to the code and message
+func writeAPIErrorDetails(w http.ResponseWriter, status int, code, message string, details map[string]interface{}) {
+	body := map[string]interface{}{"code": code, "message": message}
+	for k, v := range details {
+		body[k] = v
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"error": body})
+}
+
+// Drop-in replacement for http.Error; the code is derived from the status
+func apiError(w http.ResponseWriter, message string, status int) {
+	writeAPIError(w, status, errorCodeForStatus(status), message)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type apiErrorBody struct {
+	Error struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func TestAPIErrorEnvelope(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+
+	email := "errors@example.com"
+	_, apiKey := registerWithAPIKey(t, ts, email, "errorspass123")
+
+	expectCode := func(name string, resp *http.Response, status int, code string) {
+		t.Helper()
+		var body apiErrorBody
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatalf("%s: error body is not JSON: %v", name, err)
+		}
+		if resp.StatusCode != status || body.Error.Code != code || body.Error.Message == "" {
+			t.Fatalf("%s: expected %d %s, got %d %+v", name, status, code, resp.StatusCode, body)
+		}
+	}
+
+	send := func(key, chat string) *http.Response {
+		return apiRequest(t, "POST", ts.URL+"/api/messages/send", key, map[string]string{"chat_jid": chat, "message": "hello"}, nil)
+	}
+	expectCode("missing key", send("", "123@s.whatsapp.net"), http.StatusUnauthorized, ERR_UNAUTHORIZED)
+	expectCode("not connected", send(apiKey, "123@s.whatsapp.net"), http.StatusServiceUnavailable, ERR_WA_DISCONNECTED)
+	expectCode("method", apiRequest(t, "GET", ts.URL+"/api/messages/send", apiKey, nil, nil), http.StatusMethodNotAllowed, ERR_METHOD_NOT_ALLOWED)
+	expectCode("unknown route", apiRequest(t, "GET", ts.URL+"/api/does-not-exist", "", nil, nil), http.StatusNotFound, ERR_NOT_FOUND)
+
+	sendService.isConnected = func(string) bool { return true }
+	defer func() { sendService.isConnected = isUserWAConnected }()
+	expectCode("invalid jid", send(apiKey, "not:a:jid@@"), http.StatusBadRequest, ERR_INVALID_JID)
+
+	// Send errors without an explicit code fall back to the status
+	rec := httptest.NewRecorder()
+	writeSendError(rec, &SendError{Status: http.StatusTooManyRequests, Message: "Daily or hourly message limit reached"})
+	expectCode("send limit", rec.Result(), http.StatusTooManyRequests, ERR_RATE_LIMITED)
+	rec = httptest.NewRecorder()
+	writeSendError(rec, &SendError{Status: http.StatusBadRequest, Code: ERR_SPAM_BLOCKED, Message: "Message blocked"})
+	expectCode("spam", rec.Result(), http.StatusBadRequest, ERR_SPAM_BLOCKED)
+}
@@ -13,7 +13,7 @@ func TestPerUserAPIKeys(t *testing.T) {
 	// Setup test server
 	tmpDB := "test_api_keys.db"
 	tmpMedia := "test_api_media"
-	os.Remove(tmpDB)
+	removeTestDB(tmpDB)
 	os.RemoveAll(tmpMedia)
 	os.Mkdir(tmpMedia, 0755)
 
@@ -22,7 +22,8 @@ func TestPerUserAPIKeys(t *testing.T) {
 	ts := httptest.NewServer(mux)
 	defer func() {
 		ts.Close()
-		os.Remove(tmpDB)
+		stopServer()
+		removeTestDB(tmpDB)
 		os.RemoveAll(tmpMedia)
 	}()
 
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// --- Per-API-key rate limits and send quotas ---
+// Independent of the per-user WhatsApp anti-ban limits: these cap what a single key
+// can do, so a leaked key or a buggy integration can't use up the user's allowance.
+
+const (
+	DEFAULT_API_KEY_RATE_LIMIT  = 120 // requests per minute
+	DEFAULT_API_KEY_DAILY_QUOTA = 500 // messages queued per day
+)
+
+// Names of the limits reported in 429 responses
+const (
+	LIMIT_API_KEY_RATE  = "api_key_rate"
+	LIMIT_API_KEY_QUOTA = "api_key_daily_quota"
+	LIMIT_HOURLY        = "hourly"
+	LIMIT_DAILY         = "daily"
+)
+
+type apiKeyUsage struct {
+	windowStart time.Time
+	requests    int
+	quotaStart  time.Time
+	sends       int
+}
+
+var apiKeyLimits = struct {
+	sync.Mutex
+	usage map[string]*apiKeyUsage
+}{usage: make(map[string]*apiKeyUsage)}
+
+func envInt(name string, fallback int) int {
+	if v, err := strconv.Atoi(os.Getenv(name)); err == nil && v > 0 {
+		return v
+	}
+	return fallback
+}
+
+// Per-minute request limit per key (API_KEY_RATE_LIMIT env)
+func apiKeyRateLimit() int {
+	return envInt("API_KEY_RATE_LIMIT", DEFAULT_API_KEY_RATE_LIMIT)
+}
+
+// Daily send quota per key (API_KEY_DAILY_QUOTA env)
+func apiKeyDailyQuota() int {
+	return envInt("API_KEY_DAILY_QUOTA", DEFAULT_API_KEY_DAILY_QUOTA)
+}
+
+// Must be called with apiKeyLimits locked
+func getAPIKeyUsage(apiKey string, now time.Time) *apiKeyUsage {
+	u, ok := apiKeyLimits.usage[apiKey]
+	if !ok {
+		u = &apiKeyUsage{windowStart: now, quotaStart: now}
+		apiKeyLimits.usage[apiKey] = u
+	}
+	if now.Sub(u.windowStart) >= time.Minute {
+		u.windowStart = now
+		u.requests = 0
+	}
+	if now.Sub(u.quotaStart) >= 24*time.Hour {
+		u.quotaStart = now
+		u.sends = 0
+	}
+	return u
+}
+
+// Count a request against the key's rate limit, setting X-RateLimit-* headers.
+// Returns false (after writing a 429) if the limit is exceeded.
+func allowAPIKeyRequest(w http.ResponseWriter, apiKey string) bool {
+	limit := apiKeyRateLimit()
+	now := time.Now()
+
+	apiKeyLimits.Lock()
+	u := getAPIKeyUsage(apiKey, now)
+	allowed := u.requests < limit
+	if allowed {
+		u.requests++
+	}
+	remaining := limit - u.requests
+	reset := u.windowStart.Add(time.Minute)
+	apiKeyLimits.Unlock()
+
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(limit))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+	w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(reset.Unix(), 10))
+	if !allowed {
+		writeLimitExceeded(w, ERR_RATE_LIMITED, "API key rate limit exceeded", LIMIT_API_KEY_RATE, limit, reset)
+	}
+	return allowed
+}
+
+// Use one message of the key's daily send quota, setting X-Quota-* headers.
+// Returns false (after writing a 429) if the quota is used up.
+func consumeAPIKeySendQuota(w http.ResponseWriter, apiKey string) bool {
+	quota := apiKeyDailyQuota()
+	now := time.Now()
+
+	apiKeyLimits.Lock()
+	u := getAPIKeyUsage(apiKey, now)
+	allowed := u.sends < quota
+	if allowed {
+		u.sends++
+	}
+	remaining := quota - u.sends
+	reset := u.quotaStart.Add(24 * time.Hour)
+	apiKeyLimits.Unlock()
+
+	w.Header().Set("X-Quota-Limit", strconv.Itoa(quota))
+	w.Header().Set("X-Quota-Remaining", strconv.Itoa(remaining))
+	w.Header().Set("X-Quota-Reset", strconv.FormatInt(reset.Unix(), 10))
+	if !allowed {
+		writeLimitExceeded(w, ERR_QUOTA_EXCEEDED, "API key daily send quota exceeded", LIMIT_API_KEY_QUOTA, quota, reset)
+	}
+	return allowed
+}
+
+// Give back a quota unit for a send that was not queued after all
+func refundAPIKeySendQuota(apiKey string) {
+	apiKeyLimits.Lock()
+	defer apiKeyLimits.Unlock()
+	if u, ok := apiKeyLimits.usage[apiKey]; ok && u.sends > 0 {
+		u.sends--
+	}
+}
+
+// API key the request was authenticated with (set by requireAPIKey)
+func requestAPIKey(ctx context.Context) string {
+	apiKey, _ := ctx.Value("apiKey").(string)
+	return apiKey
+}
+
+// Write a 429 naming the limit that was hit and when it resets, with Retry-After.
+// Callers set the limit's X-RateLimit-* or X-Quota-* headers.
+func writeLimitExceeded(w http.ResponseWriter, code, message, limitName string, max int, reset time.Time) {
+	retryAfter := int(time.Until(reset).Seconds()) + 1
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	writeAPIErrorDetails(w, http.StatusTooManyRequests, code, message, map[string]interface{}{
+		"limit":       limitName,
+		"max":         max,
+		"reset_at":    reset.UTC().Format(time.RFC3339),
+		"retry_after": retryAfter,
+	})
+}
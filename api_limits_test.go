@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+type limitErrorBody struct {
+	Error struct {
+		Code       string `json:"code"`
+		Limit      string `json:"limit"`
+		Max        int    `json:"max"`
+		ResetAt    string `json:"reset_at"`
+		RetryAfter int    `json:"retry_after"`
+	} `json:"error"`
+}
+
+func TestAPIKeyRateLimit(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+	t.Setenv("API_KEY_RATE_LIMIT", "3")
+
+	_, apiKey := registerWithAPIKey(t, ts, "ratelimit@example.com", "ratepass123")
+
+	for i := 0; i < 3; i++ {
+		resp := apiRequest(t, "GET", ts.URL+"/api/webhooks", apiKey, nil, nil)
+		if resp.StatusCode != 200 {
+			t.Fatalf("Request %d failed, status: %d", i+1, resp.StatusCode)
+		}
+		if resp.Header.Get("X-RateLimit-Limit") != "3" {
+			t.Fatalf("Missing X-RateLimit-Limit header: %v", resp.Header)
+		}
+	}
+	var limited limitErrorBody
+	resp := apiRequest(t, "GET", ts.URL+"/api/webhooks", apiKey, nil, &limited)
+	if resp.StatusCode != 429 || resp.Header.Get("X-RateLimit-Remaining") != "0" || resp.Header.Get("Retry-After") == "" {
+		t.Fatalf("Expected 429 with rate limit headers, got %d %v", resp.StatusCode, resp.Header)
+	}
+	if limited.Error.Code != ERR_RATE_LIMITED || limited.Error.Limit != LIMIT_API_KEY_RATE || limited.Error.Max != 3 || limited.Error.RetryAfter < 1 || limited.Error.RetryAfter > 61 {
+		t.Fatalf("Unexpected 429 body: %+v", limited.Error)
+	}
+
+	// Another user's key is unaffected
+	_, otherKey := registerWithAPIKey(t, ts, "ratelimit2@example.com", "ratepass123")
+	if resp := apiRequest(t, "GET", ts.URL+"/api/webhooks", otherKey, nil, nil); resp.StatusCode != 200 {
+		t.Fatalf("Other key should not be limited, status: %d", resp.StatusCode)
+	}
+}
+
+func TestAPIKeySendQuota(t *testing.T) {
+	t.Setenv("API_KEY_DAILY_QUOTA", "2")
+	key := "sk_quota_test"
+
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		if !consumeAPIKeySendQuota(w, key) {
+			t.Fatalf("Send %d should be within quota", i+1)
+		}
+	}
+	w := httptest.NewRecorder()
+	if consumeAPIKeySendQuota(w, key) || w.Code != 429 || w.Header().Get("X-Quota-Remaining") != "0" {
+		t.Fatalf("Expected quota exceeded, got %d %v", w.Code, w.Header())
+	}
+
+	// A refunded send frees up quota again
+	refundAPIKeySendQuota(key)
+	if !consumeAPIKeySendQuota(httptest.NewRecorder(), key) {
+		t.Fatalf("Expected refunded quota to be usable")
+	}
+}
+
+func TestSendLimitResponse(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+
+	email := "sendlimit@example.com"
+	_, apiKey := registerWithAPIKey(t, ts, email, "sendlimit123")
+	sendService.isConnected = func(string) bool { return true }
+	defer func() {
+		sendService.isConnected = isUserWAConnected
+		queueMutex.Lock()
+		delete(messageQueues, email)
+		queueMutex.Unlock()
+	}()
+	send := func() *limitErrorBody {
+		t.Helper()
+		var body limitErrorBody
+		resp := apiRequest(t, "POST", ts.URL+"/api/messages/send", apiKey, map[string]string{"chat_jid": "14155550000@s.whatsapp.net", "message": "hello"}, &body)
+		if resp.StatusCode != 429 {
+			t.Fatalf("Expected 429, got %d", resp.StatusCode)
+		}
+		reset, _ := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64)
+		retryAfter, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+		if resp.Header.Get("X-RateLimit-Remaining") != "0" || reset <= time.Now().Unix() || retryAfter != body.Error.RetryAfter {
+			t.Fatalf("Unexpected limit headers: %v", resp.Header)
+		}
+		if at, err := time.Parse(time.RFC3339, body.Error.ResetAt); err != nil || at.Unix() != reset {
+			t.Fatalf("reset_at %q does not match X-RateLimit-Reset %d", body.Error.ResetAt, reset)
+		}
+		return &body
+	}
+
+	queue := getOrCreateQueue(email)
+	queue.mu.Lock()
+	queue.HourlyCount = MAX_HOURLY_MESSAGES
+	queue.mu.Unlock()
+	if body := send(); body.Error.Code != ERR_RATE_LIMITED || body.Error.Limit != LIMIT_HOURLY || body.Error.Max != MAX_HOURLY_MESSAGES || body.Error.RetryAfter > 3601 {
+		t.Fatalf("Unexpected hourly limit body: %+v", body.Error)
+	}
+
+	// With both reached, the daily limit is reported
+	queue.mu.Lock()
+	queue.DailyCount = MAX_DAILY_MESSAGES
+	queue.mu.Unlock()
+	if body := send(); body.Error.Limit != LIMIT_DAILY || body.Error.Max != MAX_DAILY_MESSAGES || body.Error.RetryAfter < 3600 {
+		t.Fatalf("Unexpected daily limit body: %+v", body.Error)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// --- Send approval ---
+// In approval mode, outgoing messages wait as "pending_approval" until a reviewer
+// approves them (they then join the queue) or rejects them. "automation" holds the
+// messages sent by automation (the webhook receiver, webhook auto-replies, the
+// auto-responder, the LLM bot and MQTT commands); "all" holds every send except
+// campaign messages, which are reviewed as a campaign. Like the queue, pending
+// messages are kept in memory.
+
+const (
+	APPROVAL_OFF        = "off"
+	APPROVAL_AUTOMATION = "automation"
+	APPROVAL_ALL        = "all"
+
+	STATUS_PENDING_APPROVAL = "pending_approval"
+	MAX_PENDING_APPROVAL    = 100 // Per user
+)
+
+// SendRequest sources that count as automation
+var automatedSendSources = []string{"webhook ", "auto-reply ", "auto-responder", "llm-bot", "mqtt "}
+
+func dbGetApprovalMode(email string) string {
+	mode := APPROVAL_OFF
+	db.QueryRow(`SELECT approval_mode FROM users WHERE email = ?`, email).Scan(&mode)
+	return mode
+}
+
+func dbSetApprovalMode(email, mode string) error {
+	_, err := db.Exec(`UPDATE users SET approval_mode = ? WHERE email = ?`, mode, email)
+	return err
+}
+
+// Whether a send must be approved before it's queued
+func needsApproval(req SendRequest) bool {
+	if req.Campaign != "" {
+		return false
+	}
+	switch dbGetApprovalMode(req.UserEmail) {
+	case APPROVAL_ALL:
+		return true
+	case APPROVAL_AUTOMATION:
+		for _, prefix := range automatedSendSources {
+			if strings.HasPrefix(req.Source, prefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (q *MessageQueue) addPending(msg *QueuedMessage) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.Pending) >= MAX_PENDING_APPROVAL {
+		return fmt.Errorf("too many messages waiting for approval (max %d)", MAX_PENDING_APPROVAL)
+	}
+	msg.Status = STATUS_PENDING_APPROVAL
+	q.Pending = append(q.Pending, msg)
+	return nil
+}
+
+// Remove a message from those waiting for approval
+func (q *MessageQueue) takePending(id string) *QueuedMessage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, msg := range q.Pending {
+		if msg.ID == id {
+			q.Pending = append(q.Pending[:i:i], q.Pending[i+1:]...)
+			return msg
+		}
+	}
+	return nil
+}
+
+// GET/POST /api/queue/approval {"mode": "off" | "automation" | "all"}
+func handleApprovalMode(sessionCookieName string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isAuthenticated(r, sessionCookieName) {
+			apiError(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		email := getUserEmail(r, sessionCookieName)
+
+		switch r.Method {
+		case "GET":
+		case "POST":
+			var req struct {
+				Mode string `json:"mode"`
+			}
+			if err := decodeJSONBody(w, r, &req); err != nil {
+				writeBodyError(w, err)
+				return
+			}
+			if req.Mode != APPROVAL_OFF && req.Mode != APPROVAL_AUTOMATION && req.Mode != APPROVAL_ALL {
+				apiError(w, "Invalid mode (use off, automation or all)", http.StatusBadRequest)
+				return
+			}
+			if err := dbSetApprovalMode(email, req.Mode); err != nil {
+				apiError(w, "Failed to update approval mode", http.StatusInternalServerError)
+				return
+			}
+			fmt.Printf("INFO: Approval mode of user %s set to %s\n", email, req.Mode)
+		default:
+			apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"mode": dbGetApprovalMode(email)})
+	}
+}
+
+// POST /api/queue/message/{id}/approve and /api/queue/message/{id}/reject
+// Approving adds the message to the end of the queue; rejecting drops it, with a
+// "rejected" callback.
+func handleReviewMessage(sessionCookieName string, approve bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !isAuthenticated(r, sessionCookieName) {
+			apiError(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		email := getUserEmail(r, sessionCookieName)
+
+		queue := getOrCreateQueue(email)
+		msg := queue.takePending(r.PathValue("id"))
+		if msg == nil {
+			apiError(w, "Message not waiting for approval", http.StatusNotFound)
+			return
+		}
+
+		if !approve {
+			queue.mu.Lock()
+			msg.Status = "rejected"
+			queue.mu.Unlock()
+			fmt.Printf("INFO: Message %s of user %s rejected\n", msg.ID, email)
+			sendCallback(msg, "rejected", nil)
+			emitQueueEvent(msg, STATUS_PENDING_APPROVAL, "rejected")
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "id": msg.ID, "status": msg.Status})
+			return
+		}
+
+		queue.mu.Lock()
+		msg.Status = "queued"
+		queue.mu.Unlock()
+		if err := queue.addMessage(msg); err != nil {
+			// Still waiting, so it can be approved once the queue has room
+			queue.addPending(msg)
+			writeAPIError(w, http.StatusServiceUnavailable, ERR_UNAVAILABLE, err.Error())
+			return
+		}
+		emitQueueEvent(msg, STATUS_PENDING_APPROVAL, "queued")
+		recordSentText(email, msg.ChatJID, msg.Message, msg.CreatedAt)
+		position := queue.getQueuePosition(msg.ID)
+		fmt.Printf("INFO: Message %s of user %s approved (position: %d)\n", msg.ID, email, position)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":         true,
+			"id":              msg.ID,
+			"status":          "queued",
+			"position":        position,
+			"estimated_delay": fmt.Sprintf("%.0f seconds", queue.estimateDelay(position).Seconds()),
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSendApproval(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+
+	email := "approver@example.com"
+	cookies, _ := registerWithAPIKey(t, ts, email, "approverpass123")
+	useFakeWAClient(t, email)
+	// Paused, so approved messages stay in the queue to be looked at
+	getOrCreateQueue(email).setPaused(true)
+
+	request := func(method, path string, body interface{}) (int, map[string]interface{}) {
+		t.Helper()
+		data, _ := json.Marshal(body)
+		req, _ := http.NewRequest(method, ts.URL+path, bytes.NewReader(data))
+		req.Header.Set("Content-Type", "application/json")
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s failed: %v", method, path, err)
+		}
+		defer resp.Body.Close()
+		var out map[string]interface{}
+		json.NewDecoder(resp.Body).Decode(&out)
+		return resp.StatusCode, out
+	}
+
+	if status, _ := request("POST", "/api/queue/approval", map[string]string{"mode": "sometimes"}); status != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for an invalid mode, got %d", status)
+	}
+	if status, out := request("POST", "/api/queue/approval", map[string]string{"mode": APPROVAL_AUTOMATION}); status != 200 || out["mode"] != APPROVAL_AUTOMATION {
+		t.Fatalf("Setting the approval mode failed: %d %v", status, out)
+	}
+
+	callbacks := make(chan map[string]interface{}, 2)
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		callbacks <- body
+	}))
+	defer callback.Close()
+
+	send := func(source, text string) *SendResult {
+		t.Helper()
+		result, err := sendService.Enqueue(SendRequest{UserEmail: email, ChatJID: "14155550100@s.whatsapp.net", Message: text, Source: source, CallbackURL: callback.URL})
+		if err != nil {
+			t.Fatalf("Enqueue from %s failed: %v", source, err)
+		}
+		return result
+	}
+	direct := send("api", "typed by a person")
+	if direct.Pending || direct.Position != 1 {
+		t.Fatalf("API sends don't need approval in automation mode: %+v", direct)
+	}
+	first := send("webhook abc123", "from automation")
+	second := send("llm-bot", "from the bot")
+	if !first.Pending || !second.Pending || sendResultResponse(first)["status"] != STATUS_PENDING_APPROVAL {
+		t.Fatalf("Automated sends should wait for approval: %+v %+v", first, second)
+	}
+
+	_, queueStatus := request("GET", "/api/queue/status", nil)
+	pending, _ := queueStatus["pending_approval"].([]interface{})
+	if queueStatus["queue_length"] != float64(1) || len(pending) != 2 || pending[0].(map[string]interface{})["source"] != "webhook abc123" {
+		t.Fatalf("Unexpected queue status: %v", queueStatus)
+	}
+	if status, out := request("GET", "/api/queue/message/"+first.Message.ID, nil); status != 200 || out["status"] != STATUS_PENDING_APPROVAL {
+		t.Fatalf("Unexpected pending message status: %d %v", status, out)
+	}
+
+	status, out := request("POST", "/api/queue/message/"+first.Message.ID+"/approve", nil)
+	if status != 200 || out["status"] != "queued" || out["position"] != float64(2) {
+		t.Fatalf("Approve failed: %d %v", status, out)
+	}
+	if status, out := request("POST", "/api/queue/message/"+second.Message.ID+"/reject", nil); status != 200 || out["status"] != "rejected" {
+		t.Fatalf("Reject failed: %d %v", status, out)
+	}
+	select {
+	case body := <-callbacks:
+		if body["status"] != "rejected" || body["queue_id"] != second.Message.ID {
+			t.Fatalf("Unexpected callback: %v", body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("No callback for the rejected message")
+	}
+	if status, _ := request("POST", "/api/queue/message/"+second.Message.ID+"/approve", nil); status != http.StatusNotFound {
+		t.Fatalf("Expected 404 approving a rejected message, got %d", status)
+	}
+
+	_, queueStatus = request("GET", "/api/queue/status", nil)
+	if pending, _ := queueStatus["pending_approval"].([]interface{}); queueStatus["queue_length"] != float64(2) || len(pending) != 0 {
+		t.Fatalf("Unexpected queue status after review: %v", queueStatus)
+	}
+
+	// All: every send but campaign messages
+	dbSetApprovalMode(email, APPROVAL_ALL)
+	if !send("api", "now reviewed too").Pending {
+		t.Fatal("API sends need approval in all mode")
+	}
+	if result, err := sendService.Enqueue(SendRequest{UserEmail: email, ChatJID: "14155550100@s.whatsapp.net", Message: "campaign", Source: "campaign c1", Campaign: "c1"}); err != nil || result.Pending {
+		t.Fatalf("Campaign sends are not held: %+v %v", result, err)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// --- Audit log ---
+// Security-relevant account changes (password, email, revoked sessions and keys) are
+// recorded per user with the client address. Kept for RETENTION_AUDIT_LOGS.
+
+const (
+	AUDIT_PASSWORD_CHANGED = "password_changed"
+	AUDIT_EMAIL_CHANGED    = "email_changed"
+	AUDIT_LOG_LIMIT        = 200 // Entries returned by GET /api/user/audit-log
+)
+
+type AuditLogEntry struct {
+	ID        int64  `json:"id"`
+	Action    string `json:"action"`
+	Detail    string `json:"detail,omitempty"`
+	IP        string `json:"ip,omitempty"`
+	CreatedAt string `json:"created_at"`
+}
+
+// Record an action of a user; failures are logged, not returned
+func recordAudit(userID int64, r *http.Request, action, detail string) {
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	_, err := db.Exec(`INSERT INTO audit_logs (user_id, action, detail, ip, created_at) VALUES (?, ?, ?, ?, ?)`,
+		userID, action, detail, ip, time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		fmt.Printf("ERROR: Could not record %s in the audit log of user %d: %v\n", action, userID, err)
+	}
+}
+
+// Most recent entries first
+func dbListAuditLogs(userID int64, limit int) ([]AuditLogEntry, error) {
+	rows, err := db.Query(`SELECT id, action, detail, ip, created_at FROM audit_logs WHERE user_id = ? ORDER BY id DESC LIMIT ?`, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entries := []AuditLogEntry{}
+	for rows.Next() {
+		var e AuditLogEntry
+		if err := rows.Scan(&e.ID, &e.Action, &e.Detail, &e.IP, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// GET /api/user/audit-log
+func handleAuditLog(sessionCookieName string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !isAuthenticated(r, sessionCookieName) {
+			apiError(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		userID, err := getUserIDByEmail(getUserEmail(r, sessionCookieName))
+		if err != nil {
+			apiError(w, "User not found", http.StatusUnauthorized)
+			return
+		}
+		entries, err := dbListAuditLogs(userID, AUDIT_LOG_LIMIT)
+		if err != nil {
+			apiError(w, "Failed to load audit log", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(entries)
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// --- Auto-responder ---
+// Replies automatically to people who message the account, at most once per chat per
+// window: either on first contact, or only outside business hours ("We're closed, back
+// at {{opens_at}}"). Groups, broadcasts and channels never get auto-replies. Sent and
+// suppressed replies are counted in analytics.
+
+const (
+	AUTO_RESPONDER_FIRST_CONTACT = "first_contact"
+	AUTO_RESPONDER_OUTSIDE_HOURS = "outside_hours"
+
+	DEFAULT_AUTO_RESPONDER_WINDOW = 24 * 60 // Minutes
+	MIN_AUTO_RESPONDER_WINDOW     = 5
+	MAX_AUTO_RESPONDER_WINDOW     = 30 * 24 * 60
+)
+
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// Opening hours for one weekday, as "HH:MM" in the user's timezone (close may be "24:00")
+type BusinessHours struct {
+	Day   string `json:"day"` // "mon" ... "sun"
+	Open  string `json:"open"`
+	Close string `json:"close"`
+}
+
+type AutoResponder struct {
+	Enabled       bool            `json:"enabled"`
+	Mode          string          `json:"mode"`    // "first_contact" or "outside_hours"
+	Message       string          `json:"message"` // Supports the canned response placeholders and {{opens_at}}
+	BusinessHours []BusinessHours `json:"business_hours"`
+	WindowMinutes int             `json:"window_minutes"` // Reply at most once per chat in this window
+	UpdatedAt     *time.Time      `json:"updated_at,omitempty"`
+}
+
+// Variables an auto-responder message may use
+var autoResponderVars = map[string]bool{"chat_jid": true, "phone": true, "name": true, "date": true, "time": true, "opens_at": true}
+
+// Minutes since midnight for "HH:MM" (up to "24:00")
+func parseClock(s string) (int, bool) {
+	if len(s) != 5 || s[2] != ':' {
+		return 0, false
+	}
+	h, err1 := strconv.ParseUint(s[:2], 10, 8)
+	m, err2 := strconv.ParseUint(s[3:], 10, 8)
+	if err1 != nil || err2 != nil || m > 59 || h > 24 || (h == 24 && m != 0) {
+		return 0, false
+	}
+	return int(h*60 + m), true
+}
+
+func validateAutoResponder(a *AutoResponder) error {
+	if a.Mode == "" {
+		a.Mode = AUTO_RESPONDER_FIRST_CONTACT
+	}
+	if a.Mode != AUTO_RESPONDER_FIRST_CONTACT && a.Mode != AUTO_RESPONDER_OUTSIDE_HOURS {
+		return fmt.Errorf("Invalid mode (use %s or %s)", AUTO_RESPONDER_FIRST_CONTACT, AUTO_RESPONDER_OUTSIDE_HOURS)
+	}
+	if a.WindowMinutes == 0 {
+		a.WindowMinutes = DEFAULT_AUTO_RESPONDER_WINDOW
+	}
+	if a.WindowMinutes < MIN_AUTO_RESPONDER_WINDOW || a.WindowMinutes > MAX_AUTO_RESPONDER_WINDOW {
+		return fmt.Errorf("Invalid window_minutes (%d-%d)", MIN_AUTO_RESPONDER_WINDOW, MAX_AUTO_RESPONDER_WINDOW)
+	}
+	if a.Enabled && strings.TrimSpace(a.Message) == "" {
+		return fmt.Errorf("A message is required to enable the auto-responder")
+	}
+	if utf8.RuneCountInString(a.Message) > MAX_CANNED_RESPONSE_TEXT {
+		return fmt.Errorf("Message too long (max %d characters)", MAX_CANNED_RESPONSE_TEXT)
+	}
+	for _, m := range cannedVarRegex.FindAllStringSubmatch(a.Message, -1) {
+		if !autoResponderVars[m[1]] {
+			return fmt.Errorf("Unknown template variable: %s", m[1])
+		}
+	}
+	if a.BusinessHours == nil {
+		a.BusinessHours = []BusinessHours{}
+	}
+	for i, h := range a.BusinessHours {
+		day := strings.ToLower(h.Day)
+		if len(day) > 3 {
+			day = day[:3]
+		}
+		if _, ok := weekdayNames[day]; !ok {
+			return fmt.Errorf("Invalid day %q in business_hours", h.Day)
+		}
+		open, ok1 := parseClock(h.Open)
+		closeAt, ok2 := parseClock(h.Close)
+		if !ok1 || !ok2 || open >= closeAt {
+			return fmt.Errorf("Invalid hours for %s (use HH:MM, open before close)", day)
+		}
+		a.BusinessHours[i].Day = day
+	}
+	if a.Enabled && a.Mode == AUTO_RESPONDER_OUTSIDE_HOURS && len(a.BusinessHours) == 0 {
+		return fmt.Errorf("business_hours are required for the %s mode", AUTO_RESPONDER_OUTSIDE_HOURS)
+	}
+	return nil
+}
+
+// Whether t (in the user's timezone) falls within the business hours
+func withinBusinessHours(hours []BusinessHours, t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	for _, h := range hours {
+		if weekdayNames[h.Day] != t.Weekday() {
+			continue
+		}
+		open, _ := parseClock(h.Open)
+		closeAt, _ := parseClock(h.Close)
+		if minute >= open && minute < closeAt {
+			return true
+		}
+	}
+	return false
+}
+
+// The next opening after t, e.g. "Monday 09:00" ("" without business hours)
+func nextOpening(hours []BusinessHours, t time.Time) string {
+	minute := t.Hour()*60 + t.Minute()
+	for offset := 0; offset <= 7; offset++ {
+		day := t.AddDate(0, 0, offset)
+		best := -1
+		for _, h := range hours {
+			if weekdayNames[h.Day] != day.Weekday() {
+				continue
+			}
+			open, _ := parseClock(h.Open)
+			if (offset > 0 || open > minute) && (best < 0 || open < best) {
+				best = open
+			}
+		}
+		if best >= 0 {
+			if offset == 0 {
+				return fmt.Sprintf("%02d:%02d", best/60, best%60)
+			}
+			return fmt.Sprintf("%s %02d:%02d", day.Weekday(), best/60, best%60)
+		}
+	}
+	return ""
+}
+
+func dbGetAutoResponder(userID int64) (AutoResponder, error) {
+	a := AutoResponder{Mode: AUTO_RESPONDER_FIRST_CONTACT, WindowMinutes: DEFAULT_AUTO_RESPONDER_WINDOW, BusinessHours: []BusinessHours{}}
+	var hours, updatedAt string
+	err := db.QueryRow(`SELECT enabled, mode, message, business_hours, window_minutes, updated_at FROM auto_responders WHERE user_id = ?`, userID).
+		Scan(&a.Enabled, &a.Mode, &a.Message, &hours, &a.WindowMinutes, &updatedAt)
+	if err == sql.ErrNoRows {
+		return a, nil
+	} else if err != nil {
+		return a, err
+	}
+	json.Unmarshal([]byte(hours), &a.BusinessHours)
+	if t, err := time.Parse(time.RFC3339, updatedAt); err == nil {
+		a.UpdatedAt = &t
+	}
+	return a, nil
+}
+
+func dbSetAutoResponder(userID int64, a AutoResponder) error {
+	return dbSetAutoResponderWith(db, userID, a)
+}
+
+func dbSetAutoResponderWith(exec dbExecer, userID int64, a AutoResponder) error {
+	hours, _ := json.Marshal(a.BusinessHours)
+	_, err := exec.Exec(`INSERT INTO auto_responders (user_id, enabled, mode, message, business_hours, window_minutes, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(user_id) DO UPDATE SET enabled = excluded.enabled, mode = excluded.mode, message = excluded.message,
+			business_hours = excluded.business_hours, window_minutes = excluded.window_minutes, updated_at = excluded.updated_at`,
+		userID, a.Enabled, a.Mode, a.Message, string(hours), a.WindowMinutes, time.Now().UTC().Format(time.RFC3339))
+	return err
+}
+
+// Record an auto-reply to a chat unless one was sent within the window. Returns false
+// if the chat already got one (the claim is atomic, so concurrent messages reply once).
+func claimAutoReply(userID int64, chatJID string, now time.Time, window time.Duration) bool {
+	res, err := db.Exec(`INSERT INTO auto_responder_replies (user_id, chat_jid, replied_at) VALUES (?, ?, ?)
+		ON CONFLICT(user_id, chat_jid) DO UPDATE SET replied_at = excluded.replied_at WHERE replied_at <= ?`,
+		userID, chatJID, now.Unix(), now.Add(-window).Unix())
+	if err != nil {
+		fmt.Printf("ERROR: Could not record auto-reply to %s for user %d: %v\n", chatJID, userID, err)
+		return false
+	}
+	n, _ := res.RowsAffected()
+	return n > 0
+}
+
+func releaseAutoReply(userID int64, chatJID string) {
+	db.Exec(`DELETE FROM auto_responder_replies WHERE user_id = ? AND chat_jid = ?`, userID, chatJID)
+}
+
+// Reply to an incoming message if the auto-responder applies to it
+func autoRespond(email string, userID int64, chatJID string) {
+	if !strings.HasSuffix(chatJID, "@s.whatsapp.net") && !strings.HasSuffix(chatJID, "@lid") {
+		return // Groups, broadcasts and channels
+	}
+	a, err := dbGetAutoResponder(userID)
+	if err != nil {
+		fmt.Printf("ERROR: Could not load auto-responder for user %s: %v\n", email, err)
+		return
+	}
+	if !a.Enabled {
+		return
+	}
+	now := time.Now().In(getUserLocation(userID))
+	if a.Mode == AUTO_RESPONDER_OUTSIDE_HOURS && withinBusinessHours(a.BusinessHours, now) {
+		return
+	}
+	if !claimAutoReply(userID, chatJID, now, time.Duration(a.WindowMinutes)*time.Minute) {
+		incrementStat(userID, STAT_AUTO_RESPONDER_SUPPRESSED)
+		return
+	}
+
+	vars := cannedResponseVars(userID, chatJID)
+	if _, ok := vars["phone"]; !ok {
+		vars["phone"] = ""
+	}
+	vars["opens_at"] = nextOpening(a.BusinessHours, now)
+	text, err := expandCannedResponse(a.Message, vars)
+	if err == nil {
+		_, err = sendService.Enqueue(SendRequest{
+			UserEmail: email,
+			ChatJID:   chatJID,
+			Message:   text,
+			Source:    "auto-responder",
+		})
+	}
+	if err != nil {
+		// Let the next message try again
+		releaseAutoReply(userID, chatJID)
+		fmt.Printf("WARNING: Auto-responder reply to %s for user %s not queued: %v\n", chatJID, email, err)
+		return
+	}
+	incrementStat(userID, STAT_AUTO_RESPONDER_SENT)
+	fmt.Printf("INFO: Auto-responder replied to %s for user %s\n", chatJID, email)
+}
+
+// GET/POST /api/auto-responder
+// POST replaces the settings: {"enabled", "mode", "message", "business_hours", "window_minutes"}.
+func handleAutoResponder(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(int64)
+
+	switch r.Method {
+	case "GET":
+	case "POST":
+		var a AutoResponder
+		if err := decodeJSONBody(w, r, &a); err != nil {
+			writeBodyError(w, err)
+			return
+		}
+		if err := validateAutoResponder(&a); err != nil {
+			apiError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := dbSetAutoResponder(userID, a); err != nil {
+			fmt.Println("ERROR: Could not save auto-responder", err)
+			apiError(w, "Failed to save auto-responder", http.StatusInternalServerError)
+			return
+		}
+		fmt.Printf("INFO: Auto-responder for user %d set: enabled=%v mode=%s\n", userID, a.Enabled, a.Mode)
+	default:
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	a, err := dbGetAutoResponder(userID)
+	if err != nil {
+		apiError(w, "Failed to load auto-responder", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestAutoResponder(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+
+	email := "closed@example.com"
+	_, apiKey := registerWithAPIKey(t, ts, email, "closedpass123")
+	sendService.isConnected = func(string) bool { return true }
+	dbSetQueuePaused(email, true)
+	defer func() {
+		sendService.isConnected = isUserWAConnected
+		queueMutex.Lock()
+		delete(messageQueues, email)
+		queueMutex.Unlock()
+	}()
+	queued := func() []*QueuedMessage {
+		queueMutex.Lock()
+		defer queueMutex.Unlock()
+		if q := messageQueues[email]; q != nil {
+			return q.Messages
+		}
+		return nil
+	}
+	receive := func(chat, id string) {
+		forwardToWebhooks(email, map[string]interface{}{"id": id, "from": chat, "to": chat, "type": "text", "text": "hello", "timestamp": time.Now().Unix()}, "", "test_media")
+	}
+
+	invalid := []map[string]interface{}{
+		{"enabled": true, "message": ""},
+		{"enabled": true, "message": "Hi {{secret.TOKEN}} {{unknown}}"},
+		{"enabled": true, "mode": "outside_hours", "message": "Closed"},
+		{"enabled": true, "message": "x", "business_hours": []map[string]string{{"day": "mon", "open": "17:00", "close": "09:00"}}},
+		{"enabled": true, "message": "x", "window_minutes": 1},
+	}
+	for _, body := range invalid {
+		if resp := apiRequest(t, "POST", ts.URL+"/api/auto-responder", apiKey, body, nil); resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("Expected 400 for %v, got %d", body, resp.StatusCode)
+		}
+	}
+
+	// Open all week, so outside_hours never replies
+	allWeek := []map[string]string{}
+	for _, day := range []string{"Monday", "tue", "wed", "thu", "fri", "sat", "sun"} {
+		allWeek = append(allWeek, map[string]string{"day": day, "open": "00:00", "close": "24:00"})
+	}
+	var settings AutoResponder
+	resp := apiRequest(t, "POST", ts.URL+"/api/auto-responder", apiKey, map[string]interface{}{
+		"enabled": true, "mode": "outside_hours", "message": "Closed, back at {{opens_at}}", "business_hours": allWeek,
+	}, &settings)
+	if resp.StatusCode != 200 || settings.WindowMinutes != DEFAULT_AUTO_RESPONDER_WINDOW || settings.BusinessHours[0].Day != "mon" {
+		t.Fatalf("Unexpected settings, status %d: %+v", resp.StatusCode, settings)
+	}
+	receive("14155550001@s.whatsapp.net", "m1")
+	if n := len(queued()); n != 0 {
+		t.Fatalf("Expected no auto-reply during business hours, got %d", n)
+	}
+
+	// First contact: one reply per chat per window, never to groups
+	apiRequest(t, "POST", ts.URL+"/api/auto-responder", apiKey, map[string]interface{}{
+		"enabled": true, "message": "Thanks {{name}}, we'll get back to you.",
+	}, nil)
+	receive("14155550001@s.whatsapp.net", "m2")
+	receive("14155550001@s.whatsapp.net", "m3")
+	receive("120363000000000001@g.us", "m4")
+	msgs := queued()
+	if len(msgs) != 1 || msgs[0].ChatJID != "14155550001@s.whatsapp.net" || msgs[0].Message != "Thanks 14155550001, we'll get back to you." {
+		t.Fatalf("Expected one auto-reply to the direct chat, got %+v", msgs)
+	}
+
+	var stats struct {
+		Totals map[string]int64 `json:"totals"`
+		Daily  []DailyStats     `json:"daily"`
+	}
+	apiRequest(t, "GET", ts.URL+"/api/analytics?days=1", apiKey, nil, &stats)
+	if stats.Totals[STAT_AUTO_RESPONDER_SENT] != 1 || stats.Totals[STAT_AUTO_RESPONDER_SUPPRESSED] != 1 || len(stats.Daily) != 1 {
+		t.Fatalf("Unexpected analytics: %+v", stats)
+	}
+	if resp := apiRequest(t, "GET", ts.URL+"/api/analytics?days=0", apiKey, nil, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for days=0, got %d", resp.StatusCode)
+	}
+}
+
+func TestBusinessHours(t *testing.T) {
+	hours := []BusinessHours{{Day: "mon", Open: "09:00", Close: "17:00"}, {Day: "fri", Open: "10:00", Close: "12:00"}}
+	monday := time.Date(2026, 10, 12, 0, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		at      time.Time
+		open    bool
+		opensAt string
+	}{
+		{monday.Add(8 * time.Hour), false, "09:00"},
+		{monday.Add(9 * time.Hour), true, "Friday 10:00"},
+		{monday.Add(17 * time.Hour), false, "Friday 10:00"},
+		{monday.AddDate(0, 0, 4).Add(13 * time.Hour), false, "Monday 09:00"},
+	}
+	for _, c := range cases {
+		if got := withinBusinessHours(hours, c.at); got != c.open {
+			t.Errorf("withinBusinessHours(%s) = %v, want %v", c.at, got, c.open)
+		}
+		if got := nextOpening(hours, c.at); got != c.opensAt {
+			t.Errorf("nextOpening(%s) = %q, want %q", c.at, got, c.opensAt)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// --- Response-based auto-reply ---
+// Webhooks with auto_reply enabled can answer a forwarded message directly in their
+// HTTP response: {"reply": "...", "chat_id": "..."} is queued back to WhatsApp.
+// chat_id is optional and defaults to the chat the message came from; the webhook's
+// allowed_chats restrictions apply to replies as well.
+
+const MAX_WEBHOOK_RESPONSE_BYTES = 64 * 1024
+
+type webhookReply struct {
+	Reply  string `json:"reply"`
+	ChatID string `json:"chat_id"`
+}
+
+// Queue the reply contained in a webhook response, if any.
+// Returns nil, nil when the response holds no reply.
+func queueWebhookReply(email string, wh Webhook, defaultChatJID string, body []byte) (*QueuedMessage, error) {
+	var reply webhookReply
+	if err := json.Unmarshal(body, &reply); err != nil || reply.Reply == "" {
+		return nil, nil
+	}
+	if reply.ChatID == "" {
+		reply.ChatID = defaultChatJID
+	}
+	result, err := sendService.Enqueue(SendRequest{
+		UserEmail:    email,
+		ChatJID:      reply.ChatID,
+		Message:      reply.Reply,
+		AllowedChats: wh.AllowedChats,
+		Source:       "auto-reply from webhook " + wh.ID,
+	})
+	if err != nil {
+		fmt.Printf("WARNING: Auto-reply from webhook %s not queued: %v\n", wh.ID, err)
+		return nil, err
+	}
+	return result.Message, nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWebhookAutoReply(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+
+	email := "autoreply@example.com"
+	_, apiKey := registerWithAPIKey(t, ts, email, "autoreplypass123")
+	// Pretend WhatsApp is connected, and keep queued replies in the queue so they can be inspected
+	sendService.isConnected = func(string) bool { return true }
+	dbSetQueuePaused(email, true)
+	defer func() {
+		sendService.isConnected = isUserWAConnected
+		queueMutex.Lock()
+		delete(messageQueues, email)
+		queueMutex.Unlock()
+	}()
+
+	bot := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"reply": "Thanks, we got your message"}`))
+	}))
+	defer bot.Close()
+
+	for _, autoReply := range []bool{true, false} {
+		resp := apiRequest(t, "POST", ts.URL+"/api/webhooks/create", apiKey, map[string]interface{}{
+			"url": bot.URL, "method": "POST", "auto_reply": autoReply,
+		}, nil)
+		if resp.StatusCode != 200 {
+			t.Fatalf("Create webhook failed, status: %d", resp.StatusCode)
+		}
+	}
+
+	chat := "5551234@s.whatsapp.net"
+	forwardToWebhooks(email, map[string]interface{}{"from": chat, "to": chat, "type": "text", "text": "hello"}, "", "test_media")
+
+	// Only the auto_reply webhook's response is queued, to the originating chat
+	queue := getOrCreateQueue(email)
+	queue.mu.RLock()
+	defer queue.mu.RUnlock()
+	if len(queue.Messages) != 1 {
+		t.Fatalf("Expected 1 queued reply, got %d", len(queue.Messages))
+	}
+	if msg := queue.Messages[0]; msg.ChatJID != chat || msg.Message != "Thanks, we got your message" {
+		t.Fatalf("Unexpected queued reply: %+v", msg)
+	}
+}
+
+func TestQueueWebhookReplyIgnoresOtherResponses(t *testing.T) {
+	for _, body := range []string{"", "OK", `{"status": "received"}`, `{"reply": ""}`} {
+		msg, err := queueWebhookReply("nobody@example.com", Webhook{ID: "wh"}, "123@s.whatsapp.net", []byte(body))
+		if msg != nil || err != nil {
+			t.Fatalf("Expected no reply for %q, got %v %v", body, msg, err)
+		}
+	}
+	if _, err := queueWebhookReply("nobody@example.com", Webhook{ID: "wh"}, "", []byte(`{"reply": "hi"}`)); err == nil {
+		t.Fatalf("Expected error without a chat to reply to")
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// --- Background jobs ---
+// The periodic jobs startServer starts (campaigns, alerts, retention, ...) and other
+// long-running goroutines run until stopServer, which cancels their context and waits
+// for them. startServer stops the jobs of a previous start before it reopens the DB,
+// and tests stop theirs in the teardown, so no job uses the DB pools while they are
+// replaced.
+
+var background = struct {
+	mu     sync.Mutex
+	ctx    context.Context // Created by the first job after a stop
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}{}
+
+// Run job in a goroutine that stopServer cancels and waits for
+func goBackground(job func(ctx context.Context)) {
+	background.mu.Lock()
+	if background.ctx == nil {
+		background.ctx, background.cancel = context.WithCancel(context.Background())
+	}
+	ctx := background.ctx
+	background.wg.Add(1)
+	background.mu.Unlock()
+	go func() {
+		defer background.wg.Done()
+		job(ctx)
+	}()
+}
+
+// Run job every interval until the server stops
+func runEvery(interval time.Duration, job func(now time.Time)) {
+	goBackground(func(ctx context.Context) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				job(now)
+			}
+		}
+	})
+}
+
+// Sleep for d, or until ctx is done
+func sleepContext(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
+
+// Stop the background jobs and wait until they have returned
+func stopServer() {
+	background.mu.Lock()
+	if background.cancel != nil {
+		background.cancel()
+	}
+	background.ctx, background.cancel = nil, nil
+	background.mu.Unlock()
+	background.wg.Wait()
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"strings"
+
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+)
+
+// --- Business catalogue messages ---
+// Orders placed from a WhatsApp Business catalogue and products shared from one arrive
+// as their own message types. They are forwarded with their fields parsed ("order" and
+// "product" in the payload), so automations don't have to decode the raw messages.
+// Amounts come from WhatsApp in thousandths of the currency unit; both that value and
+// the decimal amount are included.
+
+func amountFromThousandths(amount1000 int64) float64 {
+	return float64(amount1000) / 1000
+}
+
+// Fields of an order message. WhatsApp only sends the order's totals: the items themselves
+// are not part of the message.
+func orderPayload(order *waProto.OrderMessage) map[string]interface{} {
+	payload := map[string]interface{}{
+		"order_id":   order.GetOrderID(),
+		"title":      order.GetOrderTitle(),
+		"item_count": order.GetItemCount(),
+		"seller_jid": order.GetSellerJID(),
+		"text":       order.GetMessage(),
+	}
+	if order.Status != nil {
+		payload["status"] = strings.ToLower(order.GetStatus().String()) // "inquiry", "accepted" or "declined"
+	}
+	if order.TotalAmount1000 != nil {
+		payload["total"] = amountFromThousandths(order.GetTotalAmount1000())
+		payload["total_amount_1000"] = order.GetTotalAmount1000()
+		payload["currency"] = order.GetTotalCurrencyCode()
+	}
+	return payload
+}
+
+// Fields of a shared catalogue product
+func productPayload(msg *waProto.ProductMessage) map[string]interface{} {
+	product := msg.GetProduct()
+	payload := map[string]interface{}{
+		"product_id":    product.GetProductID(),
+		"retailer_id":   product.GetRetailerID(), // The seller's own SKU, if set
+		"title":         product.GetTitle(),
+		"description":   product.GetDescription(),
+		"url":           product.GetURL(),
+		"business_jid":  msg.GetBusinessOwnerJID(),
+		"catalog_title": msg.GetCatalog().GetTitle(),
+		"body":          msg.GetBody(),
+		"footer":        msg.GetFooter(),
+		"currency":      product.GetCurrencyCode(),
+		"image_count":   product.GetProductImageCount(),
+	}
+	if product.PriceAmount1000 != nil {
+		payload["price"] = amountFromThousandths(product.GetPriceAmount1000())
+		payload["price_amount_1000"] = product.GetPriceAmount1000()
+	}
+	if product.SalePriceAmount1000 != nil {
+		payload["sale_price"] = amountFromThousandths(product.GetSalePriceAmount1000())
+		payload["sale_price_amount_1000"] = product.GetSalePriceAmount1000()
+	}
+	return payload
+}
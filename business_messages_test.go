@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestOrderAndProductMessages(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+
+	email := "shop@example.com"
+	_, apiKey := registerWithAPIKey(t, ts, email, "shoppass123")
+	useFakeWAClient(t, email)
+
+	received := make(chan map[string]interface{}, 2)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		received <- body
+	}))
+	defer receiver.Close()
+	apiRequest(t, "POST", ts.URL+"/api/webhooks/create", apiKey, map[string]interface{}{"url": receiver.URL, "method": "POST"}, nil)
+	waitPayload := func() map[string]interface{} {
+		t.Helper()
+		select {
+		case body := <-received:
+			return body
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Timed out waiting for the webhook")
+		}
+		return nil
+	}
+
+	customer := types.NewJID("14155550100", types.DefaultUserServer)
+	info := types.MessageInfo{MessageSource: types.MessageSource{Chat: customer, Sender: customer}, ID: "ORDER1", Timestamp: time.Now()}
+	handleUserWAEvent(email, &events.Message{Info: info, Message: &waProto.Message{OrderMessage: &waProto.OrderMessage{
+		OrderID:           proto.String("1234567890"),
+		ItemCount:         proto.Int32(3),
+		Status:            waProto.OrderMessage_INQUIRY.Enum(),
+		Message:           proto.String("Please deliver after 5pm"),
+		OrderTitle:        proto.String("Coffee beans"),
+		SellerJID:         proto.String("14155550199@s.whatsapp.net"),
+		TotalAmount1000:   proto.Int64(37500),
+		TotalCurrencyCode: proto.String("EUR"),
+	}}}, "test_media", "test_whatsmeow_")
+
+	body := waitPayload()
+	order, _ := body["order"].(map[string]interface{})
+	if body["type"] != "order" || body["text"] != "Please deliver after 5pm" || order == nil {
+		t.Fatalf("Unexpected order payload: %v", body)
+	}
+	if order["order_id"] != "1234567890" || order["item_count"] != float64(3) || order["status"] != "inquiry" ||
+		order["total"] != 37.5 || order["total_amount_1000"] != float64(37500) || order["currency"] != "EUR" {
+		t.Fatalf("Unexpected order fields: %v", order)
+	}
+
+	info.ID = "PRODUCT1"
+	handleUserWAEvent(email, &events.Message{Info: info, Message: &waProto.Message{ProductMessage: &waProto.ProductMessage{
+		Product: &waProto.ProductMessage_ProductSnapshot{
+			ProductID:       proto.String("98765"),
+			RetailerID:      proto.String("SKU-42"),
+			Title:           proto.String("Espresso blend"),
+			CurrencyCode:    proto.String("EUR"),
+			PriceAmount1000: proto.Int64(12500),
+		},
+		BusinessOwnerJID: proto.String("14155550199@s.whatsapp.net"),
+	}}}, "test_media", "test_whatsmeow_")
+
+	body = waitPayload()
+	product, _ := body["product"].(map[string]interface{})
+	if body["type"] != "product" || body["text"] != "Espresso blend" || product == nil {
+		t.Fatalf("Unexpected product payload: %v", body)
+	}
+	if product["product_id"] != "98765" || product["retailer_id"] != "SKU-42" || product["price"] != 12.5 || product["currency"] != "EUR" || product["sale_price"] != nil {
+		t.Fatalf("Unexpected product fields: %v", product)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// --- Callback outbox ---
+// Send callbacks (callback_url) are written to the callback_outbox table before the
+// first attempt and only removed once the receiver answers 2xx, so a callback survives
+// a crash or restart between the send and its delivery. Failed attempts are retried
+// with exponential backoff, up to MAX_CALLBACK_ATTEMPTS. Delivery is at least once:
+// receivers should use callback_id to drop duplicates.
+
+const (
+	CALLBACK_OUTBOX_INTERVAL = 15 * time.Second // How often due callbacks are looked for
+	CALLBACK_RETRY_DELAY     = 30 * time.Second // Doubled after each failed attempt
+	MAX_CALLBACK_RETRY_DELAY = time.Hour
+	MAX_CALLBACK_ATTEMPTS    = 10
+	// An attempt in progress holds its row this long; after a crash mid-attempt the
+	// callback is due again once it passes. Longer than any webhook timeout.
+	CALLBACK_ATTEMPT_LEASE = 5 * time.Minute
+)
+
+// Store a user's callback and make a first attempt right away
+func enqueueCallback(userID int64, callbackURL, callbackID string, payload []byte) {
+	now := time.Now()
+	res, err := db.Exec(`INSERT INTO callback_outbox (user_id, callback_id, callback_url, payload, attempts, next_attempt_at, created_at) VALUES (?, ?, ?, ?, 0, ?, ?)`,
+		userID, callbackID, callbackURL, string(payload), now.Add(CALLBACK_ATTEMPT_LEASE).Unix(), now.Unix())
+	if err != nil {
+		// Still try once rather than losing it
+		fmt.Printf("ERROR: Could not store callback %s, sending without retries: %v\n", callbackID, err)
+		goBackground(func(context.Context) { postCallback(callbackURL, payload) })
+		return
+	}
+	id, _ := res.LastInsertId()
+	goBackground(func(context.Context) { deliverCallback(id, callbackURL, payload, 0) })
+}
+
+func postCallback(callbackURL string, payload []byte) error {
+	resp, err := webhookHTTPClient().Post(callbackURL, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Delay before the next attempt after a number of failed ones
+func callbackRetryDelay(attempts int) time.Duration {
+	delay := CALLBACK_RETRY_DELAY
+	for i := 1; i < attempts && delay < MAX_CALLBACK_RETRY_DELAY; i++ {
+		delay *= 2
+	}
+	return min(delay, MAX_CALLBACK_RETRY_DELAY)
+}
+
+// Attempt a stored callback; the row is held by its lease while this runs
+func deliverCallback(id int64, callbackURL string, payload []byte, attempts int) {
+	err := postCallback(callbackURL, payload)
+	if err == nil {
+		if _, err := db.Exec(`DELETE FROM callback_outbox WHERE id = ?`, id); err != nil {
+			fmt.Printf("ERROR: Could not remove delivered callback %d: %v\n", id, err)
+		}
+		fmt.Printf("SUCCESS: Callback %d sent to %s\n", id, callbackURL)
+		return
+	}
+	attempts++
+	if attempts >= MAX_CALLBACK_ATTEMPTS {
+		db.Exec(`DELETE FROM callback_outbox WHERE id = ?`, id)
+		fmt.Printf("ERROR: Giving up on callback %d to %s after %d attempts: %v\n", id, callbackURL, attempts, err)
+		return
+	}
+	next := time.Now().Add(callbackRetryDelay(attempts))
+	if _, dbErr := db.Exec(`UPDATE callback_outbox SET attempts = ?, next_attempt_at = ?, last_error = ? WHERE id = ?`,
+		attempts, next.Unix(), err.Error(), id); dbErr != nil {
+		fmt.Printf("ERROR: Could not reschedule callback %d: %v\n", id, dbErr)
+	}
+	fmt.Printf("RETRY: Callback %d to %s failed (%v), attempt %d/%d, next at %s\n",
+		id, callbackURL, err, attempts, MAX_CALLBACK_ATTEMPTS, next.UTC().Format(time.RFC3339))
+}
+
+// Attempt every callback that is due, including ones left over from before a restart
+func deliverDueCallbacks(now time.Time) {
+	rows, err := db.Query(`SELECT id, callback_url, payload, attempts FROM callback_outbox WHERE next_attempt_at <= ? ORDER BY id`, now.Unix())
+	if err != nil {
+		fmt.Println("ERROR: Could not list due callbacks", err)
+		return
+	}
+	type due struct {
+		id       int64
+		url      string
+		payload  string
+		attempts int
+	}
+	var list []due
+	for rows.Next() {
+		var d due
+		if err := rows.Scan(&d.id, &d.url, &d.payload, &d.attempts); err == nil {
+			list = append(list, d)
+		}
+	}
+	rows.Close()
+
+	var wg sync.WaitGroup
+	for _, d := range list {
+		// Claim the row, so a concurrent pass doesn't attempt it too
+		res, err := db.Exec(`UPDATE callback_outbox SET next_attempt_at = ? WHERE id = ? AND next_attempt_at <= ?`,
+			now.Add(CALLBACK_ATTEMPT_LEASE).Unix(), d.id, now.Unix())
+		if err != nil {
+			continue
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			deliverCallback(d.id, d.url, []byte(d.payload), d.attempts)
+		}()
+	}
+	wg.Wait()
+}
+
+// Number of callbacks waiting for delivery
+func pendingCallbackCount() int {
+	var n int
+	if err := readDB.QueryRow(`SELECT COUNT(*) FROM callback_outbox`).Scan(&n); err != nil && err != sql.ErrNoRows {
+		fmt.Println("ERROR: Could not count pending callbacks", err)
+	}
+	return n
+}
+
+func startCallbackOutbox() {
+	runEvery(CALLBACK_OUTBOX_INTERVAL, func(now time.Time) {
+		deliverDueCallbacks(now)
+	})
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+)
+
+func TestCallbackOutbox(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+	registerWithAPIKey(t, ts, "callbacks@example.com", "callbackpass123")
+
+	var requests atomic.Int32
+	received := make(chan map[string]interface{}, 5)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var payload map[string]interface{}
+		json.Unmarshal(body, &payload)
+		received <- payload
+		if requests.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer receiver.Close()
+
+	waitCallback := func() map[string]interface{} {
+		t.Helper()
+		select {
+		case payload := <-received:
+			return payload
+		case <-time.After(5 * time.Second):
+			t.Fatal("Callback not delivered")
+		}
+		return nil
+	}
+	attempts := func() int {
+		var n int
+		db.QueryRow(`SELECT COALESCE(MAX(attempts), -1) FROM callback_outbox`).Scan(&n)
+		return n
+	}
+
+	// The first attempt fails and the callback stays stored for a retry
+	msg := &QueuedMessage{ID: "q1", UserEmail: "callbacks@example.com", CallbackURL: receiver.URL}
+	sendCallback(msg, "sent", &whatsmeow.SendResponse{ID: "3EB0ABC", Timestamp: time.Now()})
+	first := waitCallback()
+	if first["queue_id"] != "q1" || first["callback_id"] == nil || first["message_id"] != "3EB0ABC" {
+		t.Fatalf("Unexpected callback: %v", first)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for attempts() != 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if attempts() != 1 || pendingCallbackCount() != 1 {
+		t.Fatalf("Expected the failed callback to be kept, attempts %d", attempts())
+	}
+
+	// Not retried before its backoff has passed
+	deliverDueCallbacks(time.Now())
+	select {
+	case payload := <-received:
+		t.Fatalf("Retried too early: %v", payload)
+	default:
+	}
+	deliverDueCallbacks(time.Now().Add(CALLBACK_RETRY_DELAY + time.Second))
+	if retry := waitCallback(); retry["callback_id"] != first["callback_id"] {
+		t.Fatalf("Expected the same callback_id on retry, got %v and %v", first["callback_id"], retry["callback_id"])
+	}
+	if pendingCallbackCount() != 0 {
+		t.Fatal("Expected the delivered callback to be removed")
+	}
+
+	// A callback left over by a crash mid-attempt is delivered once its lease passes
+	now := time.Now()
+	db.Exec(`INSERT INTO callback_outbox (callback_id, callback_url, payload, attempts, next_attempt_at, created_at) VALUES (?, ?, ?, 0, ?, ?)`,
+		"cb_left", receiver.URL, `{"callback_id":"cb_left","queue_id":"q2","status":"failed"}`, now.Add(-time.Second).Unix(), now.Add(-CALLBACK_ATTEMPT_LEASE).Unix())
+	deliverDueCallbacks(now)
+	if payload := waitCallback(); payload["queue_id"] != "q2" || pendingCallbackCount() != 0 {
+		t.Fatalf("Leftover callback not delivered: %v", payload)
+	}
+
+	// Callbacks of a deleted user are not stored
+	sendCallback(&QueuedMessage{ID: "q3", UserEmail: "gone@example.com", CallbackURL: receiver.URL}, "failed", nil)
+	if pendingCallbackCount() != 0 {
+		t.Fatal("Expected no callback for a deleted user")
+	}
+
+	if callbackRetryDelay(1) != CALLBACK_RETRY_DELAY || callbackRetryDelay(3) != 4*CALLBACK_RETRY_DELAY || callbackRetryDelay(20) != MAX_CALLBACK_RETRY_DELAY {
+		t.Fatalf("Unexpected backoff: %s %s %s", callbackRetryDelay(1), callbackRetryDelay(3), callbackRetryDelay(20))
+	}
+}
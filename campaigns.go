@@ -0,0 +1,817 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	mathrand "math/rand"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// --- Campaigns ---
+// A campaign drips one templated message to each recipient of an audience list, one
+// every interval_seconds from start_at, through the send service (so spam checks,
+// allowed chats and sending limits apply). Templates use the canned response
+// {{variable}} placeholders plus each recipient's vars. Each recipient's status and
+// first reply are tracked; GET /api/campaigns/{id} is the progress and final report.
+// Instead of one template a campaign can split its audience between variants by
+// percentage; each recipient's variant is recorded and the report compares their
+// reply rates.
+
+const (
+	MAX_CAMPAIGN_RECIPIENTS   = 5000
+	MAX_CAMPAIGN_NAME         = 100
+	MAX_CAMPAIGN_VARIANTS     = 5
+	DEFAULT_CAMPAIGN_INTERVAL = 45 // Seconds between messages
+	MAX_CAMPAIGN_INTERVAL     = 24 * 60 * 60
+	CAMPAIGN_TICK             = 1 * time.Second
+	CAMPAIGN_REPLY_WINDOW     = 7 * 24 * time.Hour // Replies after this long aren't attributed
+)
+
+const (
+	CAMPAIGN_SCHEDULED = "scheduled"
+	CAMPAIGN_RUNNING   = "running"
+	CAMPAIGN_PAUSED    = "paused"
+	CAMPAIGN_COMPLETED = "completed"
+	CAMPAIGN_CANCELLED = "cancelled"
+
+	RECIPIENT_PENDING = "pending"
+	RECIPIENT_QUEUED  = "queued"
+	RECIPIENT_SENT    = "sent"
+	RECIPIENT_FAILED  = "failed"
+)
+
+type CampaignTotals struct {
+	Recipients int `json:"recipients"`
+	Pending    int `json:"pending"`
+	Queued     int `json:"queued"`
+	Sent       int `json:"sent"`
+	Failed     int `json:"failed"`
+	Replied    int `json:"replied"`
+}
+
+// One phrasing of a campaign's message, sent to percent of its recipients
+type CampaignVariant struct {
+	Name     string `json:"name"`
+	Template string `json:"template"`
+	Percent  int    `json:"percent"`
+}
+
+type Campaign struct {
+	ID          string            `json:"id"`
+	Name        string            `json:"name,omitempty"`
+	Template    string            `json:"template,omitempty"`
+	Variants    []CampaignVariant `json:"variants,omitempty"`
+	Interval    int               `json:"interval_seconds"`
+	Reservation string            `json:"reservation_id,omitempty"`
+	Status      string            `json:"status"`
+	StartAt     time.Time         `json:"start_at"`
+	NextSendAt  time.Time         `json:"-"`
+	CreatedAt   time.Time         `json:"created_at"`
+	StartedAt   *time.Time        `json:"started_at,omitempty"`
+	FinishedAt  *time.Time        `json:"finished_at,omitempty"`
+	Totals      CampaignTotals    `json:"totals"`
+}
+
+type CampaignRecipient struct {
+	Position  int               `json:"-"`
+	ChatJID   string            `json:"chat_jid"`
+	Vars      map[string]string `json:"vars,omitempty"`
+	Variant   string            `json:"variant,omitempty"`
+	Status    string            `json:"status"`
+	QueueID   string            `json:"queue_id,omitempty"`
+	Error     string            `json:"error,omitempty"`
+	SentAt    *time.Time        `json:"sent_at,omitempty"`
+	RepliedAt *time.Time        `json:"replied_at,omitempty"`
+	Reply     string            `json:"reply,omitempty"`
+}
+
+var campaignMu sync.Mutex // Serializes campaign runs and status changes
+
+func unixTime(v sql.NullInt64) *time.Time {
+	if !v.Valid || v.Int64 == 0 {
+		return nil
+	}
+	t := time.Unix(v.Int64, 0).UTC()
+	return &t
+}
+
+// Template variables for one recipient: the canned response built-ins, then its own vars
+func campaignVars(userID int64, chatJID string, recipientVars map[string]string) map[string]string {
+	vars := cannedResponseVars(userID, chatJID)
+	for k, v := range recipientVars {
+		vars[k] = v
+	}
+	return vars
+}
+
+// Template for a recipient's variant
+func campaignTemplate(c Campaign, variant string) string {
+	for _, v := range c.Variants {
+		if v.Name == variant {
+			return v.Template
+		}
+	}
+	return c.Template
+}
+
+func validateCampaignVariants(variants []CampaignVariant) error {
+	if len(variants) < 2 || len(variants) > MAX_CAMPAIGN_VARIANTS {
+		return fmt.Errorf("variants must list 2 to %d templates", MAX_CAMPAIGN_VARIANTS)
+	}
+	names := map[string]bool{}
+	total := 0
+	for i := range variants {
+		v := &variants[i]
+		v.Name = strings.TrimSpace(v.Name)
+		if v.Name == "" {
+			v.Name = string(rune('A' + i))
+		}
+		if names[v.Name] {
+			return fmt.Errorf("Duplicate variant name %q", v.Name)
+		}
+		names[v.Name] = true
+		if strings.TrimSpace(v.Template) == "" || utf8.RuneCountInString(v.Template) > MAX_CANNED_RESPONSE_TEXT {
+			return fmt.Errorf("Variant %s needs a template (max %d characters)", v.Name, MAX_CANNED_RESPONSE_TEXT)
+		}
+		if v.Percent < 1 {
+			return fmt.Errorf("Variant %s needs a percent of at least 1", v.Name)
+		}
+		total += v.Percent
+	}
+	if total != 100 {
+		return fmt.Errorf("Variant percentages add up to %d, not 100", total)
+	}
+	return nil
+}
+
+// Split n recipients between variants by percentage (largest remainder), in random
+// order so no variant is favoured by audience order
+func assignCampaignVariants(variants []CampaignVariant, n int) []string {
+	counts := make([]int, len(variants))
+	remainders := make([]int, len(variants))
+	assigned := 0
+	for i, v := range variants {
+		counts[i] = n * v.Percent / 100
+		remainders[i] = n * v.Percent % 100
+		assigned += counts[i]
+	}
+	for ; assigned < n; assigned++ {
+		best := 0
+		for i := range remainders {
+			if remainders[i] > remainders[best] {
+				best = i
+			}
+		}
+		counts[best]++
+		remainders[best] = -1
+	}
+	names := make([]string, 0, n)
+	for i, v := range variants {
+		for j := 0; j < counts[i]; j++ {
+			names = append(names, v.Name)
+		}
+	}
+	mathrand.Shuffle(len(names), func(i, j int) { names[i], names[j] = names[j], names[i] })
+	return names
+}
+
+const campaignColumns = `id, name, template, variants, interval_seconds, reservation_id, status, start_at, next_send_at, created_at, started_at, finished_at`
+
+func scanCampaign(row interface{ Scan(...interface{}) error }) (Campaign, int64, error) {
+	var c Campaign
+	var userID, startAt, nextSendAt int64
+	var variants, createdAt string
+	var startedAt, finishedAt sql.NullInt64
+	if err := row.Scan(&userID, &c.ID, &c.Name, &c.Template, &variants, &c.Interval, &c.Reservation, &c.Status,
+		&startAt, &nextSendAt, &createdAt, &startedAt, &finishedAt); err != nil {
+		return c, 0, err
+	}
+	if variants != "" {
+		json.Unmarshal([]byte(variants), &c.Variants)
+	}
+	c.StartAt = time.Unix(startAt, 0).UTC()
+	c.NextSendAt = time.Unix(nextSendAt, 0).UTC()
+	c.CreatedAt, _ = time.Parse(time.RFC3339, createdAt)
+	c.StartedAt = unixTime(startedAt)
+	c.FinishedAt = unixTime(finishedAt)
+	return c, userID, nil
+}
+
+func addCampaignTotals(t *CampaignTotals, status string, count, replied int) {
+	t.Recipients += count
+	t.Replied += replied
+	switch status {
+	case RECIPIENT_PENDING:
+		t.Pending += count
+	case RECIPIENT_QUEUED:
+		t.Queued += count
+	case RECIPIENT_SENT:
+		t.Sent += count
+	case RECIPIENT_FAILED:
+		t.Failed += count
+	}
+}
+
+func replyRate(t CampaignTotals) float64 {
+	if t.Sent == 0 {
+		return 0
+	}
+	return float64(t.Replied) / float64(t.Sent)
+}
+
+func dbCampaignTotals(campaignID string) (CampaignTotals, error) {
+	t, _, err := dbCampaignVariantTotals(campaignID)
+	return t, err
+}
+
+// Totals for the whole campaign and for each variant
+func dbCampaignVariantTotals(campaignID string) (CampaignTotals, map[string]CampaignTotals, error) {
+	var t CampaignTotals
+	byVariant := map[string]CampaignTotals{}
+	rows, err := db.Query(`SELECT variant, status, COUNT(*), COUNT(replied_at) FROM campaign_recipients WHERE campaign_id = ? GROUP BY variant, status`, campaignID)
+	if err != nil {
+		return t, nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var variant, status string
+		var count, replied int
+		if err := rows.Scan(&variant, &status, &count, &replied); err != nil {
+			return t, nil, err
+		}
+		addCampaignTotals(&t, status, count, replied)
+		vt := byVariant[variant]
+		addCampaignTotals(&vt, status, count, replied)
+		byVariant[variant] = vt
+	}
+	return t, byVariant, rows.Err()
+}
+
+func dbGetCampaign(userID int64, campaignID string) (Campaign, error) {
+	c, _, err := scanCampaign(db.QueryRow(`SELECT user_id, `+campaignColumns+` FROM campaigns WHERE user_id = ? AND id = ?`, userID, campaignID))
+	if err != nil {
+		return c, err
+	}
+	c.Totals, err = dbCampaignTotals(c.ID)
+	return c, err
+}
+
+func dbListCampaigns(userID int64) ([]Campaign, error) {
+	rows, err := db.Query(`SELECT user_id, `+campaignColumns+` FROM campaigns WHERE user_id = ? ORDER BY created_at DESC, id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	campaigns := []Campaign{}
+	for rows.Next() {
+		c, _, err := scanCampaign(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		campaigns = append(campaigns, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for i := range campaigns {
+		if campaigns[i].Totals, err = dbCampaignTotals(campaigns[i].ID); err != nil {
+			return nil, err
+		}
+	}
+	return campaigns, nil
+}
+
+func dbCreateCampaign(userID int64, c Campaign, recipients []CampaignRecipient) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	variants := ""
+	if len(c.Variants) > 0 {
+		data, _ := json.Marshal(c.Variants)
+		variants = string(data)
+	}
+	_, err = tx.Exec(`INSERT INTO campaigns (id, user_id, name, template, variants, interval_seconds, reservation_id, status, start_at, next_send_at, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		c.ID, userID, c.Name, c.Template, variants, c.Interval, c.Reservation, c.Status, c.StartAt.Unix(), c.StartAt.Unix(), c.CreatedAt.UTC().Format(time.RFC3339))
+	if err != nil {
+		return err
+	}
+	for i, rec := range recipients {
+		vars, _ := json.Marshal(rec.Vars)
+		if _, err := tx.Exec(`INSERT INTO campaign_recipients (campaign_id, position, chat_jid, vars, variant, status) VALUES (?, ?, ?, ?, ?, ?)`,
+			c.ID, i, rec.ChatJID, string(vars), rec.Variant, RECIPIENT_PENDING); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func dbListCampaignRecipients(campaignID string) ([]CampaignRecipient, error) {
+	rows, err := db.Query(`SELECT position, chat_jid, vars, variant, status, queue_id, error, sent_at, replied_at, reply
+		FROM campaign_recipients WHERE campaign_id = ? ORDER BY position`, campaignID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	recipients := []CampaignRecipient{}
+	for rows.Next() {
+		var rec CampaignRecipient
+		var vars string
+		var sentAt, repliedAt sql.NullInt64
+		if err := rows.Scan(&rec.Position, &rec.ChatJID, &vars, &rec.Variant, &rec.Status, &rec.QueueID, &rec.Error, &sentAt, &repliedAt, &rec.Reply); err != nil {
+			return nil, err
+		}
+		json.Unmarshal([]byte(vars), &rec.Vars)
+		rec.SentAt = unixTime(sentAt)
+		rec.RepliedAt = unixTime(repliedAt)
+		recipients = append(recipients, rec)
+	}
+	return recipients, rows.Err()
+}
+
+// Next recipient still to be sent to, in audience order
+func dbNextCampaignRecipient(campaignID string) (CampaignRecipient, error) {
+	var rec CampaignRecipient
+	var vars string
+	err := db.QueryRow(`SELECT position, chat_jid, vars, variant FROM campaign_recipients WHERE campaign_id = ? AND status = ? ORDER BY position LIMIT 1`,
+		campaignID, RECIPIENT_PENDING).Scan(&rec.Position, &rec.ChatJID, &vars, &rec.Variant)
+	if err == nil {
+		json.Unmarshal([]byte(vars), &rec.Vars)
+	}
+	return rec, err
+}
+
+func dbSetCampaignStatus(campaignID, status string, now time.Time) error {
+	var err error
+	switch status {
+	case CAMPAIGN_RUNNING:
+		_, err = db.Exec(`UPDATE campaigns SET status = ?, started_at = COALESCE(started_at, ?) WHERE id = ?`, status, now.Unix(), campaignID)
+	case CAMPAIGN_COMPLETED, CAMPAIGN_CANCELLED:
+		_, err = db.Exec(`UPDATE campaigns SET status = ?, finished_at = ? WHERE id = ?`, status, now.Unix(), campaignID)
+	default:
+		_, err = db.Exec(`UPDATE campaigns SET status = ? WHERE id = ?`, status, campaignID)
+	}
+	return err
+}
+
+func dbSetCampaignNextSend(campaignID string, at time.Time) error {
+	_, err := db.Exec(`UPDATE campaigns SET next_send_at = ? WHERE id = ?`, at.Unix(), campaignID)
+	return err
+}
+
+func dbUpdateCampaignRecipient(campaignID string, position int, status, chatJID, queueID, errMsg string) error {
+	_, err := db.Exec(`UPDATE campaign_recipients SET status = ?, chat_jid = ?, queue_id = ?, error = ? WHERE campaign_id = ? AND position = ?`,
+		status, chatJID, queueID, errMsg, campaignID, position)
+	return err
+}
+
+// Record how a campaign message left the queue
+func campaignMessageDone(msg *QueuedMessage, status string) {
+	if msg.Campaign == "" {
+		return
+	}
+	var err error
+	if status == "sent" {
+		_, err = db.Exec(`UPDATE campaign_recipients SET status = ?, sent_at = ? WHERE campaign_id = ? AND queue_id = ?`,
+			RECIPIENT_SENT, time.Now().Unix(), msg.Campaign, msg.ID)
+	} else {
+		reason := "Send failed"
+		if status == STATUS_EXPIRED {
+			reason = "Expired before it was sent"
+		}
+		_, err = db.Exec(`UPDATE campaign_recipients SET status = ?, error = ? WHERE campaign_id = ? AND queue_id = ?`,
+			RECIPIENT_FAILED, reason, msg.Campaign, msg.ID)
+	}
+	if err != nil {
+		fmt.Printf("ERROR: Could not update campaign %s for message %s: %v\n", msg.Campaign, msg.ID, err)
+	}
+}
+
+// Attribute an incoming message to the latest campaign message sent to its chat, if
+// it is that recipient's first reply
+func recordCampaignReply(userID int64, chatJID string, payload map[string]interface{}, at time.Time) {
+	_, err := db.Exec(`UPDATE campaign_recipients SET replied_at = ?, reply = ?
+		WHERE rowid = (SELECT r.rowid FROM campaign_recipients r JOIN campaigns c ON c.id = r.campaign_id
+			WHERE c.user_id = ? AND r.chat_jid = ? AND r.status = ? AND r.sent_at <= ? AND r.sent_at > ?
+			ORDER BY r.sent_at DESC LIMIT 1)
+		AND replied_at IS NULL`,
+		at.Unix(), chatSnippet(payload), userID, chatJID, RECIPIENT_SENT, at.Unix(), at.Add(-CAMPAIGN_REPLY_WINDOW).Unix())
+	if err != nil {
+		fmt.Printf("ERROR: Could not record campaign reply from %s: %v\n", chatJID, err)
+	}
+}
+
+// Start sending due campaigns. Messages queued before a restart were lost with the
+// in-memory queue, so their recipients are sent to again.
+func startCampaignRunner() {
+	if _, err := db.Exec(`UPDATE campaign_recipients SET status = ?, queue_id = '' WHERE status = ?`, RECIPIENT_PENDING, RECIPIENT_QUEUED); err != nil {
+		fmt.Println("ERROR: Could not requeue campaign recipients", err)
+	}
+	runEvery(CAMPAIGN_TICK, runDueCampaigns)
+}
+
+// Send the next message of every campaign that is due
+func runDueCampaigns(now time.Time) {
+	campaignMu.Lock()
+	defer campaignMu.Unlock()
+
+	rows, err := db.Query(`SELECT user_id, `+campaignColumns+` FROM campaigns WHERE status IN (?, ?) AND next_send_at <= ?`,
+		CAMPAIGN_SCHEDULED, CAMPAIGN_RUNNING, now.Unix())
+	if err != nil {
+		fmt.Println("ERROR: Could not load due campaigns", err)
+		return
+	}
+	type due struct {
+		campaign Campaign
+		userID   int64
+	}
+	var campaigns []due
+	for rows.Next() {
+		c, userID, err := scanCampaign(rows)
+		if err != nil {
+			fmt.Println("ERROR: Could not read campaign", err)
+			continue
+		}
+		campaigns = append(campaigns, due{c, userID})
+	}
+	rows.Close()
+
+	for _, d := range campaigns {
+		runCampaignStep(d.userID, d.campaign, now)
+	}
+}
+
+func runCampaignStep(userID int64, c Campaign, now time.Time) {
+	if c.Status == CAMPAIGN_SCHEDULED {
+		if err := dbSetCampaignStatus(c.ID, CAMPAIGN_RUNNING, now); err != nil {
+			fmt.Printf("ERROR: Could not start campaign %s: %v\n", c.ID, err)
+			return
+		}
+		fmt.Printf("INFO: Campaign %s started for user %d\n", c.ID, userID)
+	}
+
+	rec, err := dbNextCampaignRecipient(c.ID)
+	if err == sql.ErrNoRows {
+		// Finished once every queued message has been sent or has failed
+		totals, err := dbCampaignTotals(c.ID)
+		if err == nil && totals.Queued == 0 {
+			dbSetCampaignStatus(c.ID, CAMPAIGN_COMPLETED, now)
+			fmt.Printf("INFO: Campaign %s completed: %d sent, %d failed\n", c.ID, totals.Sent, totals.Failed)
+		}
+		return
+	} else if err != nil {
+		fmt.Printf("ERROR: Could not load next recipient for campaign %s: %v\n", c.ID, err)
+		return
+	}
+
+	jid, err := normalizeChatJID(rec.ChatJID)
+	if err != nil {
+		dbUpdateCampaignRecipient(c.ID, rec.Position, RECIPIENT_FAILED, rec.ChatJID, "", "Invalid chat JID or phone number")
+		return
+	}
+	text, err := expandCannedResponse(campaignTemplate(c, rec.Variant), campaignVars(userID, jid.String(), rec.Vars))
+	if err != nil {
+		dbUpdateCampaignRecipient(c.ID, rec.Position, RECIPIENT_FAILED, rec.ChatJID, "", err.Error())
+		return
+	}
+	allowedChats, err := dbGetAPIKeyAllowedChats(userID)
+	if err != nil {
+		fmt.Printf("ERROR: Failed to load allowed chats for campaign %s: %v\n", c.ID, err)
+		return
+	}
+	result, err := sendService.Enqueue(SendRequest{
+		UserEmail:    getUserEmailByID(userID),
+		ChatJID:      rec.ChatJID,
+		Message:      text,
+		AllowedChats: allowedChats,
+		Source:       "campaign " + c.ID,
+		Reservation:  c.Reservation,
+		Campaign:     c.ID,
+	})
+	if err != nil {
+		// Limits, disconnects and maintenance are retried; anything else fails the recipient
+		sendErr, _ := err.(*SendError)
+		if sendErr == nil || sendErr.Status == http.StatusTooManyRequests || sendErr.Status >= 500 {
+			next := now.Add(time.Duration(c.Interval) * time.Second)
+			if sendErr != nil && sendErr.Limit != nil && sendErr.Limit.Reset.After(next) {
+				next = sendErr.Limit.Reset
+			}
+			dbSetCampaignNextSend(c.ID, next)
+			fmt.Printf("WARNING: Campaign %s waiting until %s: %v\n", c.ID, next.Format(time.RFC3339), err)
+			return
+		}
+		dbUpdateCampaignRecipient(c.ID, rec.Position, RECIPIENT_FAILED, rec.ChatJID, "", err.Error())
+		return
+	}
+	// Store the chat as resolved, so replies from it are matched
+	dbUpdateCampaignRecipient(c.ID, rec.Position, RECIPIENT_QUEUED, result.Message.ChatJID, result.Message.ID, "")
+	dbSetCampaignNextSend(c.ID, now.Add(time.Duration(c.Interval)*time.Second))
+}
+
+// Progress report for a campaign: its settings, totals, reply rate (overall and per
+// variant), estimated completion while sending, and every recipient's status
+func campaignReport(c Campaign, byVariant map[string]CampaignTotals, recipients []CampaignRecipient) map[string]interface{} {
+	report := map[string]interface{}{
+		"id":               c.ID,
+		"name":             c.Name,
+		"interval_seconds": c.Interval,
+		"status":           c.Status,
+		"start_at":         c.StartAt,
+		"created_at":       c.CreatedAt,
+		"totals":           c.Totals,
+		"reply_rate":       replyRate(c.Totals),
+		"recipients":       recipients,
+	}
+	if c.Template != "" {
+		report["template"] = c.Template
+	}
+	if len(c.Variants) > 0 {
+		variants := make([]map[string]interface{}, 0, len(c.Variants))
+		for _, v := range c.Variants {
+			variants = append(variants, map[string]interface{}{
+				"name":       v.Name,
+				"template":   v.Template,
+				"percent":    v.Percent,
+				"totals":     byVariant[v.Name],
+				"reply_rate": replyRate(byVariant[v.Name]),
+			})
+		}
+		report["variants"] = variants
+	}
+	if c.Reservation != "" {
+		report["reservation_id"] = c.Reservation
+	}
+	if c.StartedAt != nil {
+		report["started_at"] = c.StartedAt
+	}
+	if c.FinishedAt != nil {
+		report["finished_at"] = c.FinishedAt
+	}
+	if (c.Status == CAMPAIGN_SCHEDULED || c.Status == CAMPAIGN_RUNNING) && c.Totals.Pending > 0 {
+		next := c.NextSendAt
+		if now := time.Now().UTC(); next.Before(now) {
+			next = now
+		}
+		report["estimated_completion"] = next.Add(time.Duration((c.Totals.Pending-1)*c.Interval) * time.Second)
+	}
+	return report
+}
+
+// GET/POST /api/campaigns
+// POST {"name", "template", "recipients": [{"chat_jid", "vars"}], "interval_seconds", "start_at", "reservation_id"}
+func handleCampaigns(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(int64)
+
+	switch r.Method {
+	case "GET":
+		campaigns, err := dbListCampaigns(userID)
+		if err != nil {
+			fmt.Println("ERROR: Could not list campaigns", err)
+			apiError(w, "Failed to load campaigns", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(campaigns)
+
+	case "POST":
+		var req struct {
+			Name        string              `json:"name"`
+			Template    string              `json:"template"`
+			Variants    []CampaignVariant   `json:"variants"`
+			Recipients  []CampaignRecipient `json:"recipients"`
+			Interval    *int                `json:"interval_seconds"`
+			StartAt     string              `json:"start_at"`
+			Reservation string              `json:"reservation_id"`
+		}
+		if err := decodeJSONBody(w, r, &req); err != nil {
+			writeBodyError(w, err)
+			return
+		}
+		now := time.Now()
+		c := Campaign{
+			ID:          generateMessageID(),
+			Name:        strings.TrimSpace(req.Name),
+			Template:    req.Template,
+			Variants:    req.Variants,
+			Interval:    DEFAULT_CAMPAIGN_INTERVAL,
+			Reservation: req.Reservation,
+			Status:      CAMPAIGN_SCHEDULED,
+			StartAt:     now,
+			CreatedAt:   now,
+		}
+		if req.Interval != nil {
+			c.Interval = *req.Interval
+		}
+		if utf8.RuneCountInString(c.Name) > MAX_CAMPAIGN_NAME {
+			apiError(w, fmt.Sprintf("name too long (max %d characters)", MAX_CAMPAIGN_NAME), http.StatusBadRequest)
+			return
+		}
+		if len(c.Variants) > 0 {
+			if c.Template != "" {
+				apiError(w, "Use either template or variants", http.StatusBadRequest)
+				return
+			}
+			if err := validateCampaignVariants(c.Variants); err != nil {
+				apiError(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		} else if strings.TrimSpace(c.Template) == "" || utf8.RuneCountInString(c.Template) > MAX_CANNED_RESPONSE_TEXT {
+			apiError(w, fmt.Sprintf("template is required (max %d characters)", MAX_CANNED_RESPONSE_TEXT), http.StatusBadRequest)
+			return
+		}
+		if c.Interval < 1 || c.Interval > MAX_CAMPAIGN_INTERVAL {
+			apiError(w, fmt.Sprintf("interval_seconds must be between 1 and %d", MAX_CAMPAIGN_INTERVAL), http.StatusBadRequest)
+			return
+		}
+		if req.StartAt != "" {
+			startAt, err := time.Parse(time.RFC3339, req.StartAt)
+			if err != nil {
+				apiError(w, "start_at must be an RFC3339 time", http.StatusBadRequest)
+				return
+			}
+			if startAt.After(now) {
+				c.StartAt = startAt
+			}
+		}
+		if c.Reservation != "" {
+			reservations, err := dbListActiveReservations(userID, now)
+			if err != nil {
+				apiError(w, "Failed to load reservations", http.StatusInternalServerError)
+				return
+			}
+			if !slices.ContainsFunc(reservations, func(res CapacityReservation) bool { return res.ID == c.Reservation }) {
+				apiError(w, "Unknown or expired reservation_id", http.StatusBadRequest)
+				return
+			}
+		}
+		if len(req.Recipients) == 0 || len(req.Recipients) > MAX_CAMPAIGN_RECIPIENTS {
+			apiError(w, fmt.Sprintf("recipients must list 1 to %d chats", MAX_CAMPAIGN_RECIPIENTS), http.StatusBadRequest)
+			return
+		}
+
+		// Every recipient must be a valid chat with all template variables set (in
+		// every variant); a chat listed twice is sent to once
+		templates := []string{c.Template}
+		if len(c.Variants) > 0 {
+			templates = templates[:0]
+			for _, v := range c.Variants {
+				templates = append(templates, v.Template)
+			}
+		}
+		seen := map[string]bool{}
+		recipients := make([]CampaignRecipient, 0, len(req.Recipients))
+		for i, rec := range req.Recipients {
+			jid, err := normalizeChatJID(rec.ChatJID)
+			if err != nil {
+				writeAPIError(w, http.StatusBadRequest, ERR_INVALID_JID, fmt.Sprintf("Invalid chat JID or phone number for recipient %d", i+1))
+				return
+			}
+			vars := campaignVars(userID, jid.String(), rec.Vars)
+			for _, template := range templates {
+				if _, err := expandCannedResponse(template, vars); err != nil {
+					apiError(w, fmt.Sprintf("Recipient %d: %v", i+1, err), http.StatusBadRequest)
+					return
+				}
+			}
+			if seen[jid.String()] {
+				continue
+			}
+			seen[jid.String()] = true
+			recipients = append(recipients, CampaignRecipient{ChatJID: strings.TrimSpace(rec.ChatJID), Vars: rec.Vars})
+		}
+		if len(c.Variants) > 0 {
+			for i, variant := range assignCampaignVariants(c.Variants, len(recipients)) {
+				recipients[i].Variant = variant
+			}
+		}
+
+		if err := dbCreateCampaign(userID, c, recipients); err != nil {
+			fmt.Println("ERROR: Could not create campaign", err)
+			apiError(w, "Failed to create campaign", http.StatusInternalServerError)
+			return
+		}
+		byVariant := map[string]CampaignTotals{}
+		for _, rec := range recipients {
+			addCampaignTotals(&c.Totals, RECIPIENT_PENDING, 1, 0)
+			vt := byVariant[rec.Variant]
+			addCampaignTotals(&vt, RECIPIENT_PENDING, 1, 0)
+			byVariant[rec.Variant] = vt
+		}
+		c.NextSendAt = c.StartAt
+		stored, _ := dbListCampaignRecipients(c.ID)
+		fmt.Printf("INFO: Campaign %s created for user %d: %d recipients every %ds from %s\n",
+			c.ID, userID, len(recipients), c.Interval, c.StartAt.UTC().Format(time.RFC3339))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(campaignReport(c, byVariant, stored))
+
+	default:
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// GET /api/campaigns/{id}
+func handleGetCampaign(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID := r.Context().Value("userID").(int64)
+
+	c, err := dbGetCampaign(userID, r.PathValue("id"))
+	if err == sql.ErrNoRows {
+		apiError(w, "Campaign not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		apiError(w, "Failed to load campaign", http.StatusInternalServerError)
+		return
+	}
+	_, byVariant, err := dbCampaignVariantTotals(c.ID)
+	if err != nil {
+		apiError(w, "Failed to load campaign totals", http.StatusInternalServerError)
+		return
+	}
+	recipients, err := dbListCampaignRecipients(c.ID)
+	if err != nil {
+		apiError(w, "Failed to load campaign recipients", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(campaignReport(c, byVariant, recipients))
+}
+
+// POST /api/campaigns/{id}/pause, /resume and /cancel
+// Pausing stops new sends (a message already queued still goes out); resuming
+// continues with the next recipient; cancelling is final.
+func handleCampaignAction(action string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		userID := r.Context().Value("userID").(int64)
+
+		campaignMu.Lock()
+		defer campaignMu.Unlock()
+		c, err := dbGetCampaign(userID, r.PathValue("id"))
+		if err == sql.ErrNoRows {
+			apiError(w, "Campaign not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			apiError(w, "Failed to load campaign", http.StatusInternalServerError)
+			return
+		}
+
+		now := time.Now()
+		active := c.Status == CAMPAIGN_SCHEDULED || c.Status == CAMPAIGN_RUNNING
+		status := ""
+		switch action {
+		case "pause":
+			if !active {
+				apiError(w, fmt.Sprintf("Campaign is %s", c.Status), http.StatusConflict)
+				return
+			}
+			status = CAMPAIGN_PAUSED
+		case "resume":
+			if c.Status != CAMPAIGN_PAUSED {
+				apiError(w, fmt.Sprintf("Campaign is %s", c.Status), http.StatusConflict)
+				return
+			}
+			status = CAMPAIGN_RUNNING
+			if c.StartedAt == nil {
+				status = CAMPAIGN_SCHEDULED
+			}
+			next := now
+			if c.StartAt.After(now) {
+				next = c.StartAt
+			}
+			if err := dbSetCampaignNextSend(c.ID, next); err != nil {
+				apiError(w, "Failed to resume campaign", http.StatusInternalServerError)
+				return
+			}
+		case "cancel":
+			if !active && c.Status != CAMPAIGN_PAUSED {
+				apiError(w, fmt.Sprintf("Campaign is %s", c.Status), http.StatusConflict)
+				return
+			}
+			status = CAMPAIGN_CANCELLED
+		}
+		if err := dbSetCampaignStatus(c.ID, status, now); err != nil {
+			fmt.Printf("ERROR: Could not %s campaign %s: %v\n", action, c.ID, err)
+			apiError(w, "Failed to update campaign", http.StatusInternalServerError)
+			return
+		}
+		fmt.Printf("INFO: Campaign %s for user %d is now %s\n", c.ID, userID, status)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "id": c.ID, "status": status})
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCampaigns(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+
+	email := "drip@example.com"
+	_, apiKey := registerWithAPIKey(t, ts, email, "drippass123")
+	userID, _ := getUserIDByEmail(email)
+	sendService.isConnected = func(string) bool { return true }
+	dbSetQueuePaused(email, true)
+	defer func() {
+		sendService.isConnected = isUserWAConnected
+		queueMutex.Lock()
+		delete(messageQueues, email)
+		queueMutex.Unlock()
+	}()
+	queue := getOrCreateQueue(email)
+	queued := func() []*QueuedMessage {
+		queue.mu.RLock()
+		defer queue.mu.RUnlock()
+		return append([]*QueuedMessage(nil), queue.Messages...)
+	}
+
+	start := time.Now().Add(time.Hour).Truncate(time.Second)
+	recipients := []map[string]interface{}{
+		{"chat_jid": "14155550001@s.whatsapp.net", "vars": map[string]string{"first": "Ann"}},
+		{"chat_jid": "14155550002@s.whatsapp.net", "vars": map[string]string{"first": "Bob"}},
+		{"chat_jid": "14155550001@s.whatsapp.net", "vars": map[string]string{"first": "Ann"}},
+		{"chat_jid": "14155550003@s.whatsapp.net", "vars": map[string]string{"first": "Cat"}},
+	}
+	create := func(body map[string]interface{}, out interface{}) *http.Response {
+		return apiRequest(t, "POST", ts.URL+"/api/campaigns", apiKey, body, out)
+	}
+
+	if resp := create(map[string]interface{}{"template": "Hi {{first}}", "recipients": []map[string]string{{"chat_jid": "14155550001@s.whatsapp.net"}}}, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for a missing template variable, got %d", resp.StatusCode)
+	}
+	if resp := create(map[string]interface{}{"template": "Hi", "recipients": []map[string]string{{"chat_jid": "not a jid"}}}, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for an invalid recipient, got %d", resp.StatusCode)
+	}
+	if resp := create(map[string]interface{}{"template": "Hi", "recipients": recipients, "interval_seconds": 0}, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for interval 0, got %d", resp.StatusCode)
+	}
+
+	var created struct {
+		ID     string         `json:"id"`
+		Status string         `json:"status"`
+		Totals CampaignTotals `json:"totals"`
+	}
+	resp := create(map[string]interface{}{
+		"name": "Launch", "template": "Hi {{first}}, the new menu is here", "recipients": recipients,
+		"interval_seconds": 60, "start_at": start.Format(time.RFC3339),
+	}, &created)
+	if resp.StatusCode != http.StatusCreated || created.Status != CAMPAIGN_SCHEDULED || created.Totals.Recipients != 3 {
+		t.Fatalf("Create campaign failed: status %d, %+v", resp.StatusCode, created)
+	}
+	id := created.ID
+
+	// Nothing is sent before start_at, then one message per interval
+	runDueCampaigns(time.Now())
+	if n := len(queued()); n != 0 {
+		t.Fatalf("Expected nothing queued before start, got %d", n)
+	}
+	runDueCampaigns(start)
+	runDueCampaigns(start.Add(30 * time.Second))
+	if msgs := queued(); len(msgs) != 1 || msgs[0].Message != "Hi Ann, the new menu is here" || msgs[0].Campaign != id {
+		t.Fatalf("Expected the first message after start, got %+v", msgs)
+	}
+
+	// Paused campaigns don't send
+	if resp := apiRequest(t, "POST", ts.URL+"/api/campaigns/"+id+"/pause", apiKey, nil, nil); resp.StatusCode != 200 {
+		t.Fatalf("Pause failed, status %d", resp.StatusCode)
+	}
+	runDueCampaigns(start.Add(2 * time.Minute))
+	if n := len(queued()); n != 1 {
+		t.Fatalf("Expected no sends while paused, got %d queued", n)
+	}
+	if resp := apiRequest(t, "POST", ts.URL+"/api/campaigns/"+id+"/resume", apiKey, nil, nil); resp.StatusCode != 200 {
+		t.Fatalf("Resume failed, status %d", resp.StatusCode)
+	}
+	runDueCampaigns(start.Add(2 * time.Minute))
+	runDueCampaigns(start.Add(4 * time.Minute))
+	msgs := queued()
+	if len(msgs) != 3 || msgs[2].Message != "Hi Cat, the new menu is here" {
+		t.Fatalf("Expected all three messages after resume, got %d", len(msgs))
+	}
+
+	campaignMessageDone(msgs[0], "sent")
+	campaignMessageDone(msgs[1], "failed")
+	campaignMessageDone(msgs[2], "sent")
+	recordCampaignReply(userID, "14155550001@s.whatsapp.net", map[string]interface{}{"text": "Looks great"}, time.Now().Add(time.Second))
+	recordCampaignReply(userID, "14155550001@s.whatsapp.net", map[string]interface{}{"text": "Second reply"}, time.Now().Add(2*time.Second))
+	runDueCampaigns(start.Add(6 * time.Minute))
+
+	var report struct {
+		Status     string              `json:"status"`
+		FinishedAt string              `json:"finished_at"`
+		Totals     CampaignTotals      `json:"totals"`
+		ReplyRate  float64             `json:"reply_rate"`
+		Recipients []CampaignRecipient `json:"recipients"`
+	}
+	apiRequest(t, "GET", ts.URL+"/api/campaigns/"+id, apiKey, nil, &report)
+	if report.Status != CAMPAIGN_COMPLETED || report.FinishedAt == "" {
+		t.Fatalf("Expected a completed campaign, got %+v", report)
+	}
+	if report.Totals.Sent != 2 || report.Totals.Failed != 1 || report.Totals.Replied != 1 || report.ReplyRate != 0.5 {
+		t.Fatalf("Unexpected totals: %+v, reply rate %v", report.Totals, report.ReplyRate)
+	}
+	if r := report.Recipients[0]; r.Status != RECIPIENT_SENT || r.Reply != "Looks great" || r.RepliedAt == nil || r.SentAt == nil {
+		t.Fatalf("Unexpected first recipient: %+v", r)
+	}
+	if r := report.Recipients[1]; r.Status != RECIPIENT_FAILED || r.Error == "" {
+		t.Fatalf("Unexpected second recipient: %+v", r)
+	}
+
+	var list []Campaign
+	apiRequest(t, "GET", ts.URL+"/api/campaigns", apiKey, nil, &list)
+	if len(list) != 1 || list[0].Name != "Launch" || list[0].Totals.Sent != 2 {
+		t.Fatalf("Unexpected campaign list: %+v", list)
+	}
+	if resp := apiRequest(t, "POST", ts.URL+"/api/campaigns/"+id+"/resume", apiKey, nil, nil); resp.StatusCode != http.StatusConflict {
+		t.Fatalf("Expected 409 resuming a completed campaign, got %d", resp.StatusCode)
+	}
+	_, otherKey := registerWithAPIKey(t, ts, "other@example.com", "otherpass123")
+	if resp := apiRequest(t, "GET", ts.URL+"/api/campaigns/"+id, otherKey, nil, nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected 404 for another account, got %d", resp.StatusCode)
+	}
+}
+
+func TestAssignCampaignVariants(t *testing.T) {
+	count := func(names []string) map[string]int {
+		counts := map[string]int{}
+		for _, name := range names {
+			counts[name]++
+		}
+		return counts
+	}
+	ab := []CampaignVariant{{Name: "A", Percent: 70}, {Name: "B", Percent: 30}}
+	if c := count(assignCampaignVariants(ab, 10)); c["A"] != 7 || c["B"] != 3 {
+		t.Fatalf("Expected a 7/3 split, got %v", c)
+	}
+	abc := []CampaignVariant{{Name: "A", Percent: 34}, {Name: "B", Percent: 33}, {Name: "C", Percent: 33}}
+	if c := count(assignCampaignVariants(abc, 7)); c["A"] != 3 || c["B"] != 2 || c["C"] != 2 {
+		t.Fatalf("Expected a 3/2/2 split, got %v", c)
+	}
+	if names := assignCampaignVariants(ab, 1); len(names) != 1 || names[0] != "A" {
+		t.Fatalf("Expected the larger variant for a single recipient, got %v", names)
+	}
+
+	bad := [][]CampaignVariant{
+		{{Name: "A", Template: "Hi", Percent: 100}},
+		{{Name: "A", Template: "Hi", Percent: 60}, {Name: "B", Template: "Hey", Percent: 30}},
+		{{Name: "A", Template: "Hi", Percent: 50}, {Name: "A", Template: "Hey", Percent: 50}},
+		{{Name: "A", Template: "", Percent: 50}, {Name: "B", Template: "Hey", Percent: 50}},
+		{{Name: "A", Template: "Hi", Percent: 100}, {Name: "B", Template: "Hey", Percent: 0}},
+	}
+	for i, variants := range bad {
+		if err := validateCampaignVariants(variants); err == nil {
+			t.Errorf("Expected variants %d to be rejected", i)
+		}
+	}
+	unnamed := []CampaignVariant{{Template: "Hi", Percent: 50}, {Template: "Hey", Percent: 50}}
+	if err := validateCampaignVariants(unnamed); err != nil || unnamed[0].Name != "A" || unnamed[1].Name != "B" {
+		t.Fatalf("Expected unnamed variants to be named A and B, got %v %+v", err, unnamed)
+	}
+}
+
+func TestCampaignVariants(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+
+	email := "abtest@example.com"
+	_, apiKey := registerWithAPIKey(t, ts, email, "abtest123")
+	userID, _ := getUserIDByEmail(email)
+	sendService.isConnected = func(string) bool { return true }
+	dbSetQueuePaused(email, true)
+	defer func() {
+		sendService.isConnected = isUserWAConnected
+		queueMutex.Lock()
+		delete(messageQueues, email)
+		queueMutex.Unlock()
+	}()
+
+	variants := []CampaignVariant{
+		{Name: "short", Template: "Menu is out, {{first}}", Percent: 50},
+		{Name: "long", Template: "Hello {{first}}, our new menu is out today", Percent: 50},
+	}
+	recipients := []map[string]interface{}{}
+	for i, first := range []string{"Ann", "Bob", "Cat", "Dan"} {
+		recipients = append(recipients, map[string]interface{}{
+			"chat_jid": fmt.Sprintf("1415555000%d@s.whatsapp.net", i), "vars": map[string]string{"first": first},
+		})
+	}
+	if resp := apiRequest(t, "POST", ts.URL+"/api/campaigns", apiKey, map[string]interface{}{
+		"template": "Hi", "variants": variants, "recipients": recipients,
+	}, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for template and variants together, got %d", resp.StatusCode)
+	}
+
+	start := time.Now().Add(time.Hour).Truncate(time.Second)
+	var created struct {
+		ID         string              `json:"id"`
+		Recipients []CampaignRecipient `json:"recipients"`
+	}
+	resp := apiRequest(t, "POST", ts.URL+"/api/campaigns", apiKey, map[string]interface{}{
+		"variants": variants, "recipients": recipients, "interval_seconds": 60, "start_at": start.Format(time.RFC3339),
+	}, &created)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Create campaign failed, status %d", resp.StatusCode)
+	}
+	got := map[string]int{}
+	for _, rec := range created.Recipients {
+		got[rec.Variant]++
+	}
+	if got["short"] != 2 || got["long"] != 2 {
+		t.Fatalf("Expected a 2/2 split, got %v", got)
+	}
+
+	for i := 0; i < 4; i++ {
+		runDueCampaigns(start.Add(time.Duration(i) * time.Minute))
+	}
+	queue := getOrCreateQueue(email)
+	queue.mu.RLock()
+	msgs := append([]*QueuedMessage(nil), queue.Messages...)
+	queue.mu.RUnlock()
+	if len(msgs) != 4 {
+		t.Fatalf("Expected 4 queued messages, got %d", len(msgs))
+	}
+	for i, msg := range msgs {
+		first := recipients[i]["vars"].(map[string]string)["first"]
+		want, _ := expandCannedResponse(campaignTemplate(Campaign{Variants: variants}, created.Recipients[i].Variant), map[string]string{"first": first})
+		if msg.Message != want {
+			t.Fatalf("Recipient %d got %q, expected its %s variant %q", i, msg.Message, created.Recipients[i].Variant, want)
+		}
+		campaignMessageDone(msg, "sent")
+	}
+	// Both "short" recipients reply, one "long" recipient does
+	replied := map[string]int{}
+	for _, rec := range created.Recipients {
+		if replied[rec.Variant] < 2 && (rec.Variant == "short" || replied["long"] == 0) {
+			recordCampaignReply(userID, rec.ChatJID, map[string]interface{}{"text": "ok"}, time.Now().Add(time.Second))
+			replied[rec.Variant]++
+		}
+	}
+
+	var report struct {
+		ReplyRate float64 `json:"reply_rate"`
+		Variants  []struct {
+			Name      string         `json:"name"`
+			Percent   int            `json:"percent"`
+			Totals    CampaignTotals `json:"totals"`
+			ReplyRate float64        `json:"reply_rate"`
+		} `json:"variants"`
+	}
+	apiRequest(t, "GET", ts.URL+"/api/campaigns/"+created.ID, apiKey, nil, &report)
+	if len(report.Variants) != 2 || report.ReplyRate != 0.75 {
+		t.Fatalf("Unexpected report: %+v", report)
+	}
+	if v := report.Variants[0]; v.Name != "short" || v.Percent != 50 || v.Totals.Sent != 2 || v.Totals.Replied != 2 || v.ReplyRate != 1 {
+		t.Fatalf("Unexpected short variant: %+v", v)
+	}
+	if v := report.Variants[1]; v.Name != "long" || v.Totals.Sent != 2 || v.Totals.Replied != 1 || v.ReplyRate != 0.5 {
+		t.Fatalf("Unexpected long variant: %+v", v)
+	}
+}
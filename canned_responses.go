@@ -0,0 +1,328 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// --- Canned responses ---
+// A per-user library of standard replies, sent by shortcut ("/thanks"). Texts can use
+// {{variable}} placeholders: chat_jid, phone, name, date and time (in the user's
+// timezone), plus any "vars" passed when expanding. Secrets are never expanded.
+
+const (
+	MAX_CANNED_RESPONSES     = 500
+	MAX_CANNED_RESPONSE_TEXT = 4096
+)
+
+var cannedShortcutRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+var cannedVarRegex = regexp.MustCompile(`\{\{\s*([A-Za-z_][A-Za-z0-9_]*)\s*\}\}`)
+
+type CannedResponse struct {
+	Shortcut  string    `json:"shortcut"`
+	Text      string    `json:"text"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Normalize a shortcut: case-insensitive, with or without the leading slash
+func normalizeShortcut(shortcut string) (string, bool) {
+	shortcut = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(shortcut), "/"))
+	return shortcut, cannedShortcutRegex.MatchString(shortcut)
+}
+
+func validateCannedResponse(c *CannedResponse) error {
+	shortcut, ok := normalizeShortcut(c.Shortcut)
+	if !ok {
+		return fmt.Errorf("Invalid shortcut %q (letters, digits, - and _, up to 32 characters)", c.Shortcut)
+	}
+	c.Shortcut = shortcut
+	if strings.TrimSpace(c.Text) == "" {
+		return fmt.Errorf("Text is required for /%s", shortcut)
+	}
+	if utf8.RuneCountInString(c.Text) > MAX_CANNED_RESPONSE_TEXT {
+		return fmt.Errorf("Text too long for /%s (max %d characters)", shortcut, MAX_CANNED_RESPONSE_TEXT)
+	}
+	return nil
+}
+
+func dbListCannedResponses(userID int64) ([]CannedResponse, error) {
+	rows, err := db.Query(`SELECT shortcut, text, updated_at FROM canned_responses WHERE user_id = ? ORDER BY shortcut`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	responses := []CannedResponse{}
+	for rows.Next() {
+		var c CannedResponse
+		var updatedAt string
+		if err := rows.Scan(&c.Shortcut, &c.Text, &updatedAt); err != nil {
+			return nil, err
+		}
+		c.UpdatedAt, _ = time.Parse(time.RFC3339, updatedAt)
+		responses = append(responses, c)
+	}
+	return responses, rows.Err()
+}
+
+func dbGetCannedResponse(userID int64, shortcut string) (CannedResponse, error) {
+	var c CannedResponse
+	var updatedAt string
+	err := db.QueryRow(`SELECT shortcut, text, updated_at FROM canned_responses WHERE user_id = ? AND shortcut = ?`,
+		userID, shortcut).Scan(&c.Shortcut, &c.Text, &updatedAt)
+	c.UpdatedAt, _ = time.Parse(time.RFC3339, updatedAt)
+	return c, err
+}
+
+// Create or update a canned response; fails once the library is full (updates still work)
+func dbSetCannedResponse(userID int64, c CannedResponse) error {
+	var count int
+	db.QueryRow(`SELECT COUNT(*) FROM canned_responses WHERE user_id = ? AND shortcut != ?`, userID, c.Shortcut).Scan(&count)
+	if count >= MAX_CANNED_RESPONSES {
+		return fmt.Errorf("Too many canned responses (max %d)", MAX_CANNED_RESPONSES)
+	}
+	return dbSetCannedResponseWith(db, userID, c)
+}
+
+// Create or update a canned response using the given DB or transaction, without the library limit
+func dbSetCannedResponseWith(exec dbExecer, userID int64, c CannedResponse) error {
+	_, err := exec.Exec(`INSERT INTO canned_responses (user_id, shortcut, text, updated_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT(user_id, shortcut) DO UPDATE SET text = excluded.text, updated_at = excluded.updated_at`,
+		userID, c.Shortcut, c.Text, time.Now().UTC().Format(time.RFC3339))
+	return err
+}
+
+func dbDeleteCannedResponse(userID int64, shortcut string) (bool, error) {
+	res, err := db.Exec(`DELETE FROM canned_responses WHERE user_id = ? AND shortcut = ?`, userID, shortcut)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// Built-in template variables for a chat
+func cannedResponseVars(userID int64, chatJID string) map[string]string {
+	now := time.Now().In(getUserLocation(userID))
+	vars := map[string]string{
+		"chat_jid": chatJID,
+		"date":     now.Format("2006-01-02"),
+		"time":     now.Format("15:04"),
+	}
+	if chatJID == "" {
+		return vars
+	}
+	user := strings.Split(chatJID, "@")[0]
+	if strings.HasSuffix(chatJID, "@s.whatsapp.net") {
+		vars["phone"] = "+" + user
+	}
+	// The saved contact name, then the name the chat was last seen with
+	name := dbGetContactName(userID, chatJID)
+	if name == "" {
+		db.QueryRow(`SELECT name FROM recent_chats WHERE user_id = ? AND chat_jid = ?`, userID, chatJID).Scan(&name)
+	}
+	if name == "" {
+		name = user
+	}
+	vars["name"] = name
+	return vars
+}
+
+// Replace {{variable}} placeholders. Fails listing the variables that have no value.
+func expandCannedResponse(text string, vars map[string]string) (string, error) {
+	missing := map[string]bool{}
+	expanded := cannedVarRegex.ReplaceAllStringFunc(text, func(match string) string {
+		name := cannedVarRegex.FindStringSubmatch(match)[1]
+		value, ok := vars[name]
+		if !ok {
+			missing[name] = true
+		}
+		return value
+	})
+	if len(missing) > 0 {
+		names := make([]string, 0, len(missing))
+		for name := range missing {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return "", fmt.Errorf("Missing template variables: %s", strings.Join(names, ", "))
+	}
+	return expanded, nil
+}
+
+// Request body shared by the expand and send endpoints
+type cannedExpandRequest struct {
+	Shortcut    string            `json:"shortcut"`
+	ChatJID     string            `json:"chat_jid"`
+	Vars        map[string]string `json:"vars,omitempty"`
+	CallbackURL string            `json:"callback_url,omitempty"` // Send only
+}
+
+// Look up and expand a canned response, writing the error response on failure
+func expandCannedRequest(w http.ResponseWriter, userID int64, req cannedExpandRequest) (string, string, bool) {
+	shortcut, ok := normalizeShortcut(req.Shortcut)
+	if !ok {
+		apiError(w, "Invalid shortcut", http.StatusBadRequest)
+		return "", "", false
+	}
+	canned, err := dbGetCannedResponse(userID, shortcut)
+	if err == sql.ErrNoRows {
+		apiError(w, fmt.Sprintf("Canned response /%s not found", shortcut), http.StatusNotFound)
+		return "", "", false
+	} else if err != nil {
+		apiError(w, "Failed to load canned response", http.StatusInternalServerError)
+		return "", "", false
+	}
+
+	chatJID := ""
+	if req.ChatJID != "" {
+		jid, err := normalizeChatJID(req.ChatJID)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, ERR_INVALID_JID, "Invalid chat JID")
+			return "", "", false
+		}
+		chatJID = jid.String()
+	}
+	vars := cannedResponseVars(userID, chatJID)
+	for k, v := range req.Vars {
+		vars[k] = v
+	}
+	text, err := expandCannedResponse(canned.Text, vars)
+	if err != nil {
+		apiError(w, err.Error(), http.StatusBadRequest)
+		return "", "", false
+	}
+	return shortcut, text, true
+}
+
+// GET/POST /api/canned-responses
+// GET lists the library; POST {"shortcut": "...", "text": "..."} creates or updates an entry.
+func handleCannedResponses(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(int64)
+
+	switch r.Method {
+	case "GET":
+		responses, err := dbListCannedResponses(userID)
+		if err != nil {
+			fmt.Println("ERROR: Could not list canned responses", err)
+			apiError(w, "Failed to load canned responses", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(responses)
+	case "POST":
+		var c CannedResponse
+		if err := decodeJSONBody(w, r, &c); err != nil {
+			writeBodyError(w, err)
+			return
+		}
+		if err := validateCannedResponse(&c); err != nil {
+			apiError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := dbSetCannedResponse(userID, c); err != nil {
+			if strings.HasPrefix(err.Error(), "Too many") {
+				apiError(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			fmt.Println("ERROR: Could not save canned response", err)
+			apiError(w, "Failed to save canned response", http.StatusInternalServerError)
+			return
+		}
+		saved, _ := dbGetCannedResponse(userID, c.Shortcut)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(saved)
+	default:
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// DELETE /api/canned-responses/{shortcut}
+func handleDeleteCannedResponse(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "DELETE" {
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID := r.Context().Value("userID").(int64)
+
+	shortcut, ok := normalizeShortcut(r.PathValue("shortcut"))
+	if !ok {
+		apiError(w, "Invalid shortcut", http.StatusBadRequest)
+		return
+	}
+	deleted, err := dbDeleteCannedResponse(userID, shortcut)
+	if err != nil {
+		fmt.Println("ERROR: Could not delete canned response", err)
+		apiError(w, "Failed to delete canned response", http.StatusInternalServerError)
+		return
+	}
+	if !deleted {
+		apiError(w, "Canned response not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"success":true}`))
+}
+
+// POST /api/canned-responses/expand {"shortcut", "chat_jid", "vars"}
+// Returns the expanded text without sending it (e.g. to preview or edit before sending).
+func handleExpandCannedResponse(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID := r.Context().Value("userID").(int64)
+
+	var req cannedExpandRequest
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	shortcut, text, ok := expandCannedRequest(w, userID, req)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"shortcut": shortcut, "text": text})
+}
+
+// POST /api/canned-responses/send {"shortcut", "chat_jid", "vars", "callback_url"}
+// Expands a canned response and queues it like /api/messages/send.
+func handleSendCannedResponse(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID := r.Context().Value("userID").(int64)
+
+	var req cannedExpandRequest
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	if req.ChatJID == "" {
+		apiError(w, "Missing chat_jid", http.StatusBadRequest)
+		return
+	}
+	shortcut, text, ok := expandCannedRequest(w, userID, req)
+	if !ok {
+		return
+	}
+	result := enqueueWithAPIKey(w, r, SendRequest{
+		ChatJID:     req.ChatJID,
+		Message:     text,
+		CallbackURL: req.CallbackURL,
+		Source:      "canned /" + shortcut,
+	})
+	if result == nil {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sendResultResponse(result))
+}
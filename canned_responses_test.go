@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCannedResponses(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+
+	email := "canned@example.com"
+	_, apiKey := registerWithAPIKey(t, ts, email, "cannedpass123")
+	sendService.isConnected = func(string) bool { return true }
+	dbSetQueuePaused(email, true)
+	defer func() {
+		sendService.isConnected = isUserWAConnected
+		queueMutex.Lock()
+		delete(messageQueues, email)
+		queueMutex.Unlock()
+	}()
+
+	var saved CannedResponse
+	resp := apiRequest(t, "POST", ts.URL+"/api/canned-responses", apiKey, map[string]string{
+		"shortcut": "/Thanks", "text": "Thanks {{ name }}, your order {{order}} is on its way.",
+	}, &saved)
+	if resp.StatusCode != 200 || saved.Shortcut != "thanks" {
+		t.Fatalf("Create failed, status %d: %+v", resp.StatusCode, saved)
+	}
+	if resp := apiRequest(t, "POST", ts.URL+"/api/canned-responses", apiKey, map[string]string{"shortcut": "bad shortcut", "text": "x"}, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for invalid shortcut, got %d", resp.StatusCode)
+	}
+
+	chat := "14155550123@s.whatsapp.net"
+	var expanded map[string]string
+	resp = apiRequest(t, "POST", ts.URL+"/api/canned-responses/expand", apiKey, map[string]interface{}{
+		"shortcut": "thanks", "chat_jid": chat, "vars": map[string]string{"order": "A12"},
+	}, &expanded)
+	if resp.StatusCode != 200 || expanded["text"] != "Thanks 14155550123, your order A12 is on its way." {
+		t.Fatalf("Unexpected expansion, status %d: %v", resp.StatusCode, expanded)
+	}
+
+	// Missing variables are rejected rather than sent blank
+	resp = apiRequest(t, "POST", ts.URL+"/api/canned-responses/expand", apiKey, map[string]interface{}{"shortcut": "thanks", "chat_jid": chat}, nil)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for missing variable, got %d", resp.StatusCode)
+	}
+	if resp := apiRequest(t, "POST", ts.URL+"/api/canned-responses/expand", apiKey, map[string]string{"shortcut": "nope"}, nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected 404 for unknown shortcut, got %d", resp.StatusCode)
+	}
+
+	var sent map[string]interface{}
+	resp = apiRequest(t, "POST", ts.URL+"/api/canned-responses/send", apiKey, map[string]interface{}{
+		"shortcut": "/thanks", "chat_jid": chat, "vars": map[string]string{"order": "B7"},
+	}, &sent)
+	if resp.StatusCode != 200 || sent["status"] != "queued" {
+		t.Fatalf("Send failed, status %d: %v", resp.StatusCode, sent)
+	}
+	queueMutex.Lock()
+	queued := messageQueues[email].Messages
+	queueMutex.Unlock()
+	if len(queued) != 1 || !strings.Contains(queued[0].Message, "order B7") {
+		t.Fatalf("Expected expanded message in queue, got %+v", queued)
+	}
+
+	// Export, then import into another account
+	var cfg AccountConfig
+	resp = apiRequest(t, "GET", ts.URL+"/api/config/export", apiKey, nil, &cfg)
+	if resp.StatusCode != 200 || cfg.Version != CONFIG_VERSION || len(cfg.CannedResponses) != 1 {
+		t.Fatalf("Unexpected export, status %d: %+v", resp.StatusCode, cfg)
+	}
+	_, otherKey := registerWithAPIKey(t, ts, "canned2@example.com", "cannedpass123")
+	cfg.CannedResponses = append(cfg.CannedResponses, CannedResponse{Shortcut: "hours", Text: "We're open 9-5."})
+	if resp := apiRequest(t, "POST", ts.URL+"/api/config/import", otherKey, cfg, nil); resp.StatusCode != 200 {
+		t.Fatalf("Import failed, status %d", resp.StatusCode)
+	}
+	var library []CannedResponse
+	apiRequest(t, "GET", ts.URL+"/api/canned-responses", otherKey, nil, &library)
+	if len(library) != 2 || library[0].Shortcut != "hours" || library[1].Text != saved.Text {
+		t.Fatalf("Unexpected imported library: %+v", library)
+	}
+
+	// An invalid entry rejects the whole import
+	bad := AccountConfig{Version: CONFIG_VERSION, CannedResponses: []CannedResponse{{Shortcut: "ok", Text: "x"}, {Shortcut: "", Text: "y"}}}
+	if resp := apiRequest(t, "POST", ts.URL+"/api/config/import", otherKey, bad, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for invalid import, got %d", resp.StatusCode)
+	}
+	otherID, _ := getUserIDByEmail("canned2@example.com")
+	if _, err := dbGetCannedResponse(otherID, "ok"); err == nil {
+		t.Fatal("Expected nothing saved from a rejected import")
+	}
+
+	if resp := apiRequest(t, "DELETE", ts.URL+"/api/canned-responses/THANKS", apiKey, nil, nil); resp.StatusCode != 200 {
+		t.Fatalf("Delete failed, status %d", resp.StatusCode)
+	}
+	if resp := apiRequest(t, "DELETE", ts.URL+"/api/canned-responses/thanks", apiKey, nil, nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected 404 deleting twice, got %d", resp.StatusCode)
+	}
+}
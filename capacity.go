@@ -0,0 +1,453 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// --- Send capacity reservations ---
+// Bulk jobs can check whether N sends fit in a time window under the per-user hourly
+// and daily limits, and reserve that capacity instead of failing midway. Plans follow
+// the queue's hourly and daily windows, send as early as possible and leave room for
+// earlier reservations. Sends with a reservation_id use its slots; other sends can't
+// use what active reservations hold (the rest of their current slot, and what they
+// still need before the daily window resets).
+
+const (
+	MAX_RESERVATION_COUNT   = 10000
+	MAX_RESERVATION_WINDOW  = 7 * 24 * time.Hour
+	MAX_RESERVATION_NAME    = 100
+	MAX_ACTIVE_RESERVATIONS = 20
+	LIMIT_RESERVATION       = "reservation"
+)
+
+// Sends planned in one hourly window (or the part of it before the deadline)
+type CapacitySlot struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	Count int       `json:"count"`
+}
+
+type CapacityReservation struct {
+	ID        string         `json:"id"`
+	Name      string         `json:"name,omitempty"`
+	Count     int            `json:"count"`
+	Used      int            `json:"used"`
+	Schedule  []CapacitySlot `json:"schedule"`
+	CreatedAt time.Time      `json:"created_at"`
+	ExpiresAt time.Time      `json:"expires_at"`
+}
+
+// Serializes planning and booking so two reservations can't take the same capacity
+var capacityMu sync.Mutex
+
+// A user's current sending windows
+type sendWindows struct {
+	hourlyUsed  int
+	hourlyReset time.Time
+	dailyUsed   int
+	dailyReset  time.Time
+}
+
+func (q *MessageQueue) windows(now time.Time) sendWindows {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.resetLimitCounters(now)
+	return sendWindows{q.HourlyCount, q.HourlyReset, q.DailyCount, q.DailyReset}
+}
+
+// Time before the n-th of a run of messages can start, from message delay and burst
+// cooldowns alone
+func paceDelay(n int) time.Duration {
+	if n <= 0 {
+		return 0
+	}
+	delay := time.Duration(n-1) * MESSAGE_DELAY
+	delay += time.Duration((n-1)/BURST_ALLOWANCE) * BURST_COOLDOWN
+	return delay
+}
+
+// Most messages the queue's pacing can start within d
+func (q *MessageQueue) paceCapacity(d time.Duration) int {
+	n := 0
+	for n < MAX_HOURLY_MESSAGES && paceDelay(n+1) < d {
+		n++
+	}
+	return n
+}
+
+// Sends of a reservation's slots that have started by now
+func reservationStarted(r CapacityReservation, now time.Time) int {
+	started := 0
+	for _, s := range r.Schedule {
+		if !s.Start.After(now) {
+			started += s.Count
+		}
+	}
+	return started
+}
+
+// Capacity a reservation holds in the current hourly window: the unused part of its
+// current slot (slots it fell behind on can be caught up, but aren't held)
+func reservationHourlyHold(r CapacityReservation, now time.Time) int {
+	for _, s := range r.Schedule {
+		if !s.Start.After(now) && now.Before(s.End) {
+			return min(max(reservationStarted(r, now)-r.Used, 0), s.Count)
+		}
+	}
+	return 0
+}
+
+// Capacity a reservation still needs before the daily window resets
+func reservationDailyHold(r CapacityReservation, dailyReset time.Time) int {
+	needed := 0
+	for _, s := range r.Schedule {
+		if s.Start.Before(dailyReset) {
+			needed += s.Count
+		}
+	}
+	return max(needed-r.Used, 0)
+}
+
+// Index of the daily window t falls in: 0 is the current one
+func dailyWindowIndex(t, dailyReset time.Time) int {
+	if t.Before(dailyReset) {
+		return 0
+	}
+	return 1 + int(t.Sub(dailyReset)/(24*time.Hour))
+}
+
+// Spread count sends over the hourly windows from now until the deadline, as early as
+// the limits, the queue's pacing and other reservations allow. Returns the slots and
+// the number of sends they hold, which is less than count if they don't all fit.
+func planCapacity(q *MessageQueue, w sendWindows, others []CapacityReservation, count int, now, until time.Time) ([]CapacitySlot, int) {
+	dailyLeft := map[int]int{}
+	for _, r := range others {
+		dailyLeft[0] -= reservationDailyHold(r, w.dailyReset)
+		for _, s := range r.Schedule {
+			if day := dailyWindowIndex(s.Start, w.dailyReset); day > 0 {
+				dailyLeft[day] -= s.Count
+			}
+		}
+	}
+
+	var slots []CapacitySlot
+	planned := 0
+	start, end := now, w.hourlyReset
+	hourlyLeft := MAX_HOURLY_MESSAGES - w.hourlyUsed
+	for planned < count && start.Before(until) {
+		if end.After(until) {
+			end = until
+		}
+		for _, r := range others {
+			if start.Equal(now) {
+				hourlyLeft -= reservationHourlyHold(r, now)
+				continue
+			}
+			// Slots planned against other windows count where most of them falls
+			for _, s := range r.Schedule {
+				if mid := s.Start.Add(s.End.Sub(s.Start) / 2); !mid.Before(start) && mid.Before(end) {
+					hourlyLeft -= s.Count
+				}
+			}
+		}
+		day := dailyWindowIndex(start, w.dailyReset)
+		dailyMax := MAX_DAILY_MESSAGES
+		if day == 0 {
+			dailyMax -= w.dailyUsed
+		}
+		n := min(count-planned, hourlyLeft, dailyMax+dailyLeft[day], q.paceCapacity(end.Sub(start)))
+		if n > 0 {
+			slots = append(slots, CapacitySlot{Start: start, End: end, Count: n})
+			planned += n
+			dailyLeft[day] -= n
+		}
+		start, end = end, end.Add(time.Hour)
+		hourlyLeft = MAX_HOURLY_MESSAGES
+	}
+	return slots, planned
+}
+
+// Check a send against the user's active reservations. A send for a reservation must
+// fit its schedule; other sends can't use the capacity reservations hold.
+func checkReservedCapacity(userID int64, reservationID string, q *MessageQueue) *SendError {
+	now := time.Now()
+	active, err := dbListActiveReservations(userID, now)
+	if err != nil {
+		fmt.Printf("ERROR: Could not load capacity reservations for user %d: %v\n", userID, err)
+		return nil
+	}
+	w := q.windows(now)
+	hourlyHeld, dailyHeld := 0, 0
+	for _, r := range active {
+		if r.ID != reservationID {
+			hourlyHeld += reservationHourlyHold(r, now)
+			dailyHeld += reservationDailyHold(r, w.dailyReset)
+			continue
+		}
+		if r.Used >= r.Count {
+			return &SendError{Status: http.StatusConflict, Message: "Reservation is used up"}
+		}
+		if reservationStarted(r, now) <= r.Used {
+			for _, s := range r.Schedule {
+				if s.Start.After(now) {
+					return &SendError{Status: http.StatusTooManyRequests, Code: ERR_RATE_LIMITED, Message: "Reservation has no capacity until its next slot",
+						Limit: &SendLimit{Name: LIMIT_RESERVATION, Max: s.Count, Reset: s.Start}}
+				}
+			}
+		}
+		return nil
+	}
+	if reservationID != "" {
+		return &SendError{Status: http.StatusBadRequest, Message: "Unknown or expired reservation_id"}
+	}
+	if w.dailyUsed+dailyHeld >= MAX_DAILY_MESSAGES {
+		return &SendError{Status: http.StatusTooManyRequests, Code: ERR_RATE_LIMITED, Message: "Daily capacity is reserved for campaigns",
+			Limit: &SendLimit{Name: LIMIT_DAILY, Max: MAX_DAILY_MESSAGES, Reset: w.dailyReset}}
+	}
+	if w.hourlyUsed+hourlyHeld >= MAX_HOURLY_MESSAGES {
+		return &SendError{Status: http.StatusTooManyRequests, Code: ERR_RATE_LIMITED, Message: "Hourly capacity is reserved for campaigns",
+			Limit: &SendLimit{Name: LIMIT_HOURLY, Max: MAX_HOURLY_MESSAGES, Reset: w.hourlyReset}}
+	}
+	return nil
+}
+
+func scanReservation(row interface{ Scan(...interface{}) error }) (CapacityReservation, error) {
+	var r CapacityReservation
+	var schedule, createdAt string
+	var expiresAt int64
+	if err := row.Scan(&r.ID, &r.Name, &r.Count, &r.Used, &schedule, &createdAt, &expiresAt); err != nil {
+		return r, err
+	}
+	if err := json.Unmarshal([]byte(schedule), &r.Schedule); err != nil {
+		return r, err
+	}
+	r.CreatedAt, _ = time.Parse(time.RFC3339, createdAt)
+	r.ExpiresAt = time.Unix(expiresAt, 0).UTC()
+	return r, nil
+}
+
+func dbListActiveReservations(userID int64, now time.Time) ([]CapacityReservation, error) {
+	rows, err := db.Query(`SELECT id, name, count, used, schedule, created_at, expires_at FROM capacity_reservations
+		WHERE user_id = ? AND expires_at > ? ORDER BY created_at, id`, userID, now.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	reservations := []CapacityReservation{}
+	for rows.Next() {
+		r, err := scanReservation(rows)
+		if err != nil {
+			return nil, err
+		}
+		reservations = append(reservations, r)
+	}
+	return reservations, rows.Err()
+}
+
+func dbCreateReservation(userID int64, r CapacityReservation) error {
+	schedule, err := json.Marshal(r.Schedule)
+	if err != nil {
+		return err
+	}
+	if _, err := db.Exec(`DELETE FROM capacity_reservations WHERE expires_at <= ?`, r.CreatedAt.Unix()); err != nil {
+		return err
+	}
+	_, err = db.Exec(`INSERT INTO capacity_reservations (id, user_id, name, count, used, schedule, created_at, expires_at) VALUES (?, ?, ?, ?, 0, ?, ?, ?)`,
+		r.ID, userID, r.Name, r.Count, string(schedule), r.CreatedAt.UTC().Format(time.RFC3339), r.ExpiresAt.Unix())
+	return err
+}
+
+// Count one send against a reservation; false if it is used up
+func dbUseReservation(userID int64, reservationID string) (bool, error) {
+	res, err := db.Exec(`UPDATE capacity_reservations SET used = used + 1 WHERE user_id = ? AND id = ? AND used < count`, userID, reservationID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// Give back a send that was counted but not queued
+func dbReleaseReservationUse(userID int64, reservationID string) error {
+	_, err := db.Exec(`UPDATE capacity_reservations SET used = used - 1 WHERE user_id = ? AND id = ? AND used > 0`, userID, reservationID)
+	return err
+}
+
+func dbDeleteReservation(userID int64, reservationID string) (bool, error) {
+	res, err := db.Exec(`DELETE FROM capacity_reservations WHERE user_id = ? AND id = ?`, userID, reservationID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// GET /api/capacity
+// Current hourly and daily capacity, what reservations hold of it, and the reservations
+func handleGetCapacity(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID := r.Context().Value("userID").(int64)
+	queue := getOrCreateQueue(getUserEmailByID(userID))
+
+	now := time.Now()
+	reservations, err := dbListActiveReservations(userID, now)
+	if err != nil {
+		apiError(w, "Failed to load reservations", http.StatusInternalServerError)
+		return
+	}
+	win := queue.windows(now)
+	hourlyHeld, dailyHeld := 0, 0
+	for _, res := range reservations {
+		hourlyHeld += reservationHourlyHold(res, now)
+		dailyHeld += reservationDailyHold(res, win.dailyReset)
+	}
+	window := func(maxCount, used, held int, reset time.Time) map[string]interface{} {
+		return map[string]interface{}{
+			"max":       maxCount,
+			"used":      used,
+			"reserved":  held,
+			"available": max(maxCount-used-held, 0),
+			"reset_at":  reset.UTC().Format(time.RFC3339),
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"hourly":       window(MAX_HOURLY_MESSAGES, win.hourlyUsed, hourlyHeld, win.hourlyReset),
+		"daily":        window(MAX_DAILY_MESSAGES, win.dailyUsed, dailyHeld, win.dailyReset),
+		"reservations": reservations,
+	})
+}
+
+// GET/POST /api/capacity/reservations
+// POST {"count": 300, "within_minutes": 120, "name": "...", "dry_run": false}
+func handleCapacityReservations(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(int64)
+
+	switch r.Method {
+	case "GET":
+		reservations, err := dbListActiveReservations(userID, time.Now())
+		if err != nil {
+			apiError(w, "Failed to load reservations", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(reservations)
+
+	case "POST":
+		var req struct {
+			Count         int    `json:"count"`
+			WithinMinutes int    `json:"within_minutes"`
+			Name          string `json:"name"`
+			DryRun        bool   `json:"dry_run"`
+		}
+		if err := decodeJSONBody(w, r, &req); err != nil {
+			writeBodyError(w, err)
+			return
+		}
+		within := time.Duration(req.WithinMinutes) * time.Minute
+		req.Name = strings.TrimSpace(req.Name)
+		if req.Count < 1 || req.Count > MAX_RESERVATION_COUNT {
+			apiError(w, fmt.Sprintf("count must be between 1 and %d", MAX_RESERVATION_COUNT), http.StatusBadRequest)
+			return
+		}
+		if within <= 0 || within > MAX_RESERVATION_WINDOW {
+			apiError(w, fmt.Sprintf("within_minutes must be between 1 and %d", int(MAX_RESERVATION_WINDOW.Minutes())), http.StatusBadRequest)
+			return
+		}
+		if utf8.RuneCountInString(req.Name) > MAX_RESERVATION_NAME {
+			apiError(w, fmt.Sprintf("name too long (max %d characters)", MAX_RESERVATION_NAME), http.StatusBadRequest)
+			return
+		}
+
+		capacityMu.Lock()
+		defer capacityMu.Unlock()
+		now := time.Now()
+		others, err := dbListActiveReservations(userID, now)
+		if err != nil {
+			apiError(w, "Failed to load reservations", http.StatusInternalServerError)
+			return
+		}
+		if !req.DryRun && len(others) >= MAX_ACTIVE_RESERVATIONS {
+			apiError(w, fmt.Sprintf("Too many active reservations (max %d)", MAX_ACTIVE_RESERVATIONS), http.StatusBadRequest)
+			return
+		}
+		queue := getOrCreateQueue(getUserEmailByID(userID))
+		win := queue.windows(now)
+		slots, planned := planCapacity(queue, win, others, req.Count, now, now.Add(within))
+
+		// When it doesn't fit, say when it would
+		var earliest interface{}
+		if planned < req.Count {
+			if full, n := planCapacity(queue, win, others, req.Count, now, now.Add(MAX_RESERVATION_WINDOW)); n == req.Count {
+				earliest = full[len(full)-1].End.UTC().Format(time.RFC3339)
+			}
+		}
+		if req.DryRun {
+			response := map[string]interface{}{"feasible": planned == req.Count, "available": planned, "schedule": slots}
+			if planned == req.Count {
+				response["completes_by"] = slots[len(slots)-1].End.UTC().Format(time.RFC3339)
+			} else {
+				response["earliest_completion"] = earliest
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+		if planned < req.Count {
+			writeAPIErrorDetails(w, http.StatusConflict, ERR_NO_CAPACITY,
+				fmt.Sprintf("Only %d of %d sends fit within %d minutes", planned, req.Count, req.WithinMinutes),
+				map[string]interface{}{"available": planned, "earliest_completion": earliest})
+			return
+		}
+
+		reservation := CapacityReservation{
+			ID:        generateMessageID(),
+			Name:      req.Name,
+			Count:     req.Count,
+			Schedule:  slots,
+			CreatedAt: now,
+			ExpiresAt: slots[len(slots)-1].End,
+		}
+		if err := dbCreateReservation(userID, reservation); err != nil {
+			fmt.Println("ERROR: Could not create capacity reservation", err)
+			apiError(w, "Failed to create reservation", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(reservation)
+
+	default:
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// DELETE /api/capacity/reservations/{id}
+// Release a reservation's remaining capacity
+func handleDeleteCapacityReservation(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "DELETE" {
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID := r.Context().Value("userID").(int64)
+	deleted, err := dbDeleteReservation(userID, r.PathValue("id"))
+	if err != nil {
+		apiError(w, "Failed to delete reservation", http.StatusInternalServerError)
+		return
+	}
+	if !deleted {
+		apiError(w, "Reservation not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true})
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestPlanCapacity(t *testing.T) {
+	q := &MessageQueue{}
+	now := time.Date(2025, 3, 1, 10, 0, 0, 0, time.UTC)
+	w := sendWindows{hourlyUsed: 150, hourlyReset: now.Add(30 * time.Minute), dailyUsed: 900, dailyReset: now.Add(5 * time.Hour)}
+
+	// 50 left this hour, then the daily limit holds the rest until the
+	// first window after it resets
+	slots, planned := planCapacity(q, w, nil, 300, now, now.Add(6*time.Hour))
+	if planned != 300 || len(slots) != 3 {
+		t.Fatalf("Expected 300 sends in 3 slots, got %d in %+v", planned, slots)
+	}
+	if slots[0].Count != 50 || !slots[0].End.Equal(w.hourlyReset) || slots[1].Count != 50 || slots[2].Count != 200 || !slots[2].Start.Equal(w.dailyReset.Add(30*time.Minute)) {
+		t.Fatalf("Unexpected schedule: %+v", slots)
+	}
+
+	// A short deadline leaves part of the window for pacing only
+	slots, planned = planCapacity(q, sendWindows{hourlyReset: now.Add(time.Hour), dailyReset: now.Add(24 * time.Hour)}, nil, 500, now, now.Add(10*time.Second))
+	if planned == 0 || planned > 10 || len(slots) != 1 {
+		t.Fatalf("Expected a few paced sends in 10 seconds, got %d in %+v", planned, slots)
+	}
+
+	// Other reservations' slots are left alone
+	other := CapacityReservation{ID: "r1", Count: 300, Schedule: []CapacitySlot{
+		{Start: now, End: now.Add(time.Hour), Count: 150},
+		{Start: now.Add(time.Hour), End: now.Add(2 * time.Hour), Count: 150},
+	}}
+	w = sendWindows{hourlyReset: now.Add(time.Hour), dailyReset: now.Add(24 * time.Hour)}
+	slots, planned = planCapacity(q, w, []CapacityReservation{other}, 400, now, now.Add(3*time.Hour))
+	if planned != 300 || slots[0].Count != 50 || slots[1].Count != 50 || slots[2].Count != 200 {
+		t.Fatalf("Expected 50+50+200 around the other reservation, got %d in %+v", planned, slots)
+	}
+}
+
+func TestCapacityReservations(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+
+	email := "campaign@example.com"
+	_, apiKey := registerWithAPIKey(t, ts, email, "campaign123")
+	sendService.isConnected = func(string) bool { return true }
+	dbSetQueuePaused(email, true)
+	defer func() {
+		sendService.isConnected = isUserWAConnected
+		queueMutex.Lock()
+		delete(messageQueues, email)
+		queueMutex.Unlock()
+	}()
+	queue := getOrCreateQueue(email)
+	queue.mu.Lock()
+	queue.HourlyCount = 150
+	queue.mu.Unlock()
+
+	reserve := func(body map[string]interface{}, out interface{}) *http.Response {
+		return apiRequest(t, "POST", ts.URL+"/api/capacity/reservations", apiKey, body, out)
+	}
+	send := func(reservation string) *http.Response {
+		return apiRequest(t, "POST", ts.URL+"/api/messages/send", apiKey, map[string]string{
+			"chat_jid": "14155550000@s.whatsapp.net", "message": "Spring catalogue is out", "reservation_id": reservation,
+		}, nil)
+	}
+
+	if resp := reserve(map[string]interface{}{"count": 0, "within_minutes": 60}, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for count 0, got %d", resp.StatusCode)
+	}
+
+	// A pre-check doesn't book anything
+	var check map[string]interface{}
+	reserve(map[string]interface{}{"count": 100, "within_minutes": 120, "dry_run": true}, &check)
+	if check["feasible"] != true || check["completes_by"] == nil {
+		t.Fatalf("Expected a feasible plan, got %v", check)
+	}
+
+	var reservation CapacityReservation
+	if resp := reserve(map[string]interface{}{"count": 100, "within_minutes": 120, "name": "spring"}, &reservation); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Reserve failed, status %d", resp.StatusCode)
+	}
+	if reservation.Count != 100 || len(reservation.Schedule) != 2 || reservation.Schedule[0].Count != 50 || reservation.Schedule[1].Count != 50 {
+		t.Fatalf("Unexpected reservation: %+v", reservation)
+	}
+
+	// The rest of this hour is held; the next hour has 150 left, plus a send or two
+	// paced into the seconds the deadline runs past it
+	var rejected struct {
+		Error struct {
+			Code               string `json:"code"`
+			Available          int    `json:"available"`
+			EarliestCompletion string `json:"earliest_completion"`
+		} `json:"error"`
+	}
+	if resp := reserve(map[string]interface{}{"count": 400, "within_minutes": 120}, &rejected); resp.StatusCode != http.StatusConflict {
+		t.Fatalf("Expected 409 for an infeasible reservation, got %d", resp.StatusCode)
+	}
+	if rejected.Error.Code != ERR_NO_CAPACITY || rejected.Error.Available < 150 || rejected.Error.Available > 155 || rejected.Error.EarliestCompletion == "" {
+		t.Fatalf("Unexpected rejection: %+v", rejected.Error)
+	}
+
+	if resp := send(""); resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("Expected sends outside the reservation to be limited, got %d", resp.StatusCode)
+	}
+	if resp := send(reservation.ID); resp.StatusCode != 200 {
+		t.Fatalf("Send with reservation failed, status %d", resp.StatusCode)
+	}
+	if resp := send("unknown"); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for an unknown reservation, got %d", resp.StatusCode)
+	}
+
+	var capacity struct {
+		Hourly struct {
+			Used      int `json:"used"`
+			Reserved  int `json:"reserved"`
+			Available int `json:"available"`
+		} `json:"hourly"`
+		Reservations []CapacityReservation `json:"reservations"`
+	}
+	apiRequest(t, "GET", ts.URL+"/api/capacity", apiKey, nil, &capacity)
+	if capacity.Hourly.Used != 150 || capacity.Hourly.Reserved != 49 || capacity.Hourly.Available != 1 || len(capacity.Reservations) != 1 || capacity.Reservations[0].Used != 1 {
+		t.Fatalf("Unexpected capacity: %+v", capacity)
+	}
+
+	// Releasing the reservation frees the capacity
+	if resp := apiRequest(t, "DELETE", ts.URL+"/api/capacity/reservations/"+reservation.ID, apiKey, nil, nil); resp.StatusCode != 200 {
+		t.Fatalf("Delete reservation failed, status %d", resp.StatusCode)
+	}
+	if resp := send(""); resp.StatusCode != 200 {
+		t.Fatalf("Expected send after release to succeed, got %d", resp.StatusCode)
+	}
+	if resp := apiRequest(t, "DELETE", ts.URL+"/api/capacity/reservations/"+reservation.ID, apiKey, nil, nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected 404 deleting twice, got %d", resp.StatusCode)
+	}
+}
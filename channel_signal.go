@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// --- Signal channel ---
+// A Signal account registered with signal-cli-rest-api (github.com/bbernhard/signal-cli-rest-api,
+// in "normal" or "native" mode), which is polled for messages. Direct chats only: chats are
+// "<phone digits>@signal", and group messages are skipped.
+
+const SIGNAL_POLL_INTERVAL = 3 * time.Second
+
+type signalBackend struct {
+	channelUnsupported
+	baseURL string
+	number  string // +<digits>
+}
+
+type signalEnvelope struct {
+	Envelope struct {
+		Source       string `json:"source"`
+		SourceNumber string `json:"sourceNumber"`
+		SourceName   string `json:"sourceName"`
+		Timestamp    int64  `json:"timestamp"` // Milliseconds; also the message's ID
+		DataMessage  *struct {
+			Message   string      `json:"message"`
+			GroupInfo interface{} `json:"groupInfo"`
+		} `json:"dataMessage"`
+	} `json:"envelope"`
+}
+
+func newSignalClient(baseURL, number string) *signalBackend {
+	return &signalBackend{channelUnsupported: channelUnsupported{CHANNEL_SIGNAL}, baseURL: strings.TrimRight(baseURL, "/"), number: number}
+}
+
+// Check the REST API is reachable and build the backend
+func newSignalBackend(config *ChannelConfig) (ChannelBackend, error) {
+	u, err := url.Parse(strings.TrimSpace(config.URL))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, errors.New("url must be the http(s) address of signal-cli-rest-api")
+	}
+	if err := validateOutboundURL(u.String()); err != nil {
+		return nil, fmt.Errorf("url: %v", err)
+	}
+	phone, ok := normalizePhone(config.Number)
+	if !ok {
+		return nil, errors.New("number must be the account's phone number with country code")
+	}
+	config.URL, config.Number, config.Token, config.BotUsername = u.String(), "+"+phone, "", ""
+	s := newSignalClient(config.URL, config.Number)
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+	if err := channelRequest(ctx, "GET", s.baseURL+"/v1/about", nil, nil); err != nil {
+		return nil, fmt.Errorf("Could not reach signal-cli-rest-api: %v", err)
+	}
+	return s, nil
+}
+
+func (s *signalBackend) SendMessage(ctx context.Context, to types.JID, message *waProto.Message, extra ...whatsmeow.SendRequestExtra) (whatsmeow.SendResponse, error) {
+	text, err := channelMessageText(message)
+	if err != nil {
+		return whatsmeow.SendResponse{}, err
+	}
+	var sent struct {
+		Timestamp string `json:"timestamp"`
+	}
+	err = channelRequest(ctx, "POST", s.baseURL+"/v2/send", map[string]interface{}{
+		"number":     s.number,
+		"recipients": []string{"+" + to.User},
+		"message":    text,
+	}, &sent)
+	if err != nil {
+		return whatsmeow.SendResponse{}, err
+	}
+	ms, _ := strconv.ParseInt(sent.Timestamp, 10, 64)
+	return whatsmeow.SendResponse{ID: sent.Timestamp, Timestamp: time.UnixMilli(ms)}, nil
+}
+
+func (s *signalBackend) SendChatPresence(jid types.JID, state types.ChatPresence, media types.ChatPresenceMedia) error {
+	method := "PUT"
+	if state != types.ChatPresenceComposing {
+		method = "DELETE"
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+	return channelRequest(ctx, method, s.baseURL+"/v1/typing-indicator/"+url.PathEscape(s.number), map[string]string{"recipient": "+" + jid.User}, nil)
+}
+
+// Messages are deleted by the timestamp they were sent with, which is their ID
+func (s *signalBackend) RevokeMessage(chat types.JID, id types.MessageID) (whatsmeow.SendResponse, error) {
+	timestamp, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return whatsmeow.SendResponse{}, fmt.Errorf("invalid Signal message ID %q", id)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), waSendTimeout)
+	defer cancel()
+	err = channelRequest(ctx, "DELETE", s.baseURL+"/v1/remote-delete/"+url.PathEscape(s.number), map[string]interface{}{
+		"recipient": "+" + chat.User,
+		"timestamp": timestamp,
+	}, nil)
+	return whatsmeow.SendResponse{ID: id}, err
+}
+
+func (s *signalBackend) Receive(ctx context.Context) ([]ChannelMessage, error) {
+	var envelopes []signalEnvelope
+	if err := channelRequest(ctx, "GET", s.baseURL+"/v1/receive/"+url.PathEscape(s.number), nil, &envelopes); err != nil {
+		return nil, err
+	}
+	var messages []ChannelMessage
+	for _, e := range envelopes {
+		env := e.Envelope
+		if env.DataMessage == nil || env.DataMessage.Message == "" {
+			continue // Receipts, typing and the like
+		}
+		if env.DataMessage.GroupInfo != nil {
+			fmt.Printf("DEBUG: Skipping Signal group message %d\n", env.Timestamp)
+			continue
+		}
+		sender := env.SourceNumber
+		if sender == "" {
+			sender = env.Source
+		}
+		phone, ok := normalizePhone(sender)
+		if !ok {
+			continue // Senders who hide their number can't be replied to by number
+		}
+		messages = append(messages, ChannelMessage{
+			ID:         strconv.FormatInt(env.Timestamp, 10),
+			ChatID:     phone,
+			SenderID:   phone,
+			SenderName: env.SourceName,
+			Text:       env.DataMessage.Message,
+			Timestamp:  time.UnixMilli(env.Timestamp),
+		})
+	}
+	if len(messages) == 0 {
+		select {
+		case <-ctx.Done():
+		case <-time.After(SIGNAL_POLL_INTERVAL):
+		}
+	}
+	return messages, nil
+}
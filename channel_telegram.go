@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// --- Telegram channel ---
+// A Telegram bot, through the Bot API. Updates are long-polled with getUpdates, so the
+// bot must not have a webhook set. Chats are "<chat id>@telegram"; group IDs are negative.
+
+const TELEGRAM_POLL_TIMEOUT = 25 // Seconds getUpdates waits for an update
+
+func telegramAPIURL() string {
+	return strings.TrimRight(getEnv("TELEGRAM_API_URL", "https://api.telegram.org"), "/")
+}
+
+type telegramBackend struct {
+	channelUnsupported
+	token   string
+	baseURL string
+	offset  int64 // Next update to fetch
+}
+
+// Bot API responses: {"ok": true, "result": ...} or {"ok": false, "description": ...}
+type telegramResponse struct {
+	OK          bool        `json:"ok"`
+	Description string      `json:"description"`
+	Result      interface{} `json:"result"` // Decoded into the caller's value
+}
+
+type telegramMessage struct {
+	MessageID int64  `json:"message_id"`
+	Date      int64  `json:"date"`
+	Text      string `json:"text"`
+	Caption   string `json:"caption"`
+	From      *struct {
+		ID        int64  `json:"id"`
+		FirstName string `json:"first_name"`
+		LastName  string `json:"last_name"`
+		Username  string `json:"username"`
+		IsBot     bool   `json:"is_bot"`
+	} `json:"from"`
+	Chat struct {
+		ID   int64  `json:"id"`
+		Type string `json:"type"` // "private", "group", "supergroup" or "channel"
+	} `json:"chat"`
+}
+
+type telegramUpdate struct {
+	UpdateID int64            `json:"update_id"`
+	Message  *telegramMessage `json:"message"`
+}
+
+func newTelegramClient(token string) *telegramBackend {
+	return &telegramBackend{channelUnsupported: channelUnsupported{CHANNEL_TELEGRAM}, token: token, baseURL: telegramAPIURL()}
+}
+
+// Check a bot token with getMe and build its backend
+func newTelegramBackend(config *ChannelConfig) (ChannelBackend, error) {
+	config.Token = strings.TrimSpace(config.Token)
+	if config.Token == "" {
+		return nil, errors.New("Missing token")
+	}
+	config.URL, config.Number = "", ""
+	t := newTelegramClient(config.Token)
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+	var me struct {
+		Username string `json:"username"`
+	}
+	if err := t.call(ctx, "getMe", nil, &me); err != nil {
+		return nil, fmt.Errorf("Telegram rejected the bot token: %v", err)
+	}
+	config.BotUsername = me.Username
+	return t, nil
+}
+
+func (t *telegramBackend) call(ctx context.Context, method string, params map[string]interface{}, out interface{}) error {
+	resp := telegramResponse{Result: out}
+	err := channelRequest(ctx, "POST", fmt.Sprintf("%s/bot%s/%s", t.baseURL, t.token, method), params, &resp)
+	if err != nil {
+		// Errors name the URL, which contains the token
+		return errors.New(strings.ReplaceAll(err.Error(), t.token, "***"))
+	}
+	if !resp.OK {
+		return fmt.Errorf("%s: %s", method, resp.Description)
+	}
+	return nil
+}
+
+func (t *telegramBackend) SendMessage(ctx context.Context, to types.JID, message *waProto.Message, extra ...whatsmeow.SendRequestExtra) (whatsmeow.SendResponse, error) {
+	text, err := channelMessageText(message)
+	if err != nil {
+		return whatsmeow.SendResponse{}, err
+	}
+	var sent telegramMessage
+	if err := t.call(ctx, "sendMessage", map[string]interface{}{"chat_id": to.User, "text": text}, &sent); err != nil {
+		return whatsmeow.SendResponse{}, err
+	}
+	return whatsmeow.SendResponse{ID: strconv.FormatInt(sent.MessageID, 10), Timestamp: time.Unix(sent.Date, 0)}, nil
+}
+
+func (t *telegramBackend) SendChatPresence(jid types.JID, state types.ChatPresence, media types.ChatPresenceMedia) error {
+	if state != types.ChatPresenceComposing {
+		return nil // Telegram's typing action ends by itself
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+	return t.call(ctx, "sendChatAction", map[string]interface{}{"chat_id": jid.User, "action": "typing"}, nil)
+}
+
+func (t *telegramBackend) RevokeMessage(chat types.JID, id types.MessageID) (whatsmeow.SendResponse, error) {
+	messageID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return whatsmeow.SendResponse{}, fmt.Errorf("invalid Telegram message ID %q", id)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), waSendTimeout)
+	defer cancel()
+	err = t.call(ctx, "deleteMessage", map[string]interface{}{"chat_id": chat.User, "message_id": messageID}, nil)
+	return whatsmeow.SendResponse{ID: id}, err
+}
+
+func (t *telegramBackend) Receive(ctx context.Context) ([]ChannelMessage, error) {
+	var updates []telegramUpdate
+	err := t.call(ctx, "getUpdates", map[string]interface{}{
+		"offset":          t.offset,
+		"timeout":         TELEGRAM_POLL_TIMEOUT,
+		"allowed_updates": []string{"message"},
+	}, &updates)
+	if err != nil {
+		return nil, err
+	}
+	var messages []ChannelMessage
+	for _, u := range updates {
+		t.offset = u.UpdateID + 1
+		m := u.Message
+		if m == nil || m.From == nil || m.From.IsBot {
+			continue
+		}
+		text := m.Text
+		if text == "" {
+			text = m.Caption
+		}
+		if text == "" {
+			fmt.Printf("DEBUG: Skipping Telegram message %d without text\n", m.MessageID)
+			continue
+		}
+		messages = append(messages, ChannelMessage{
+			ID:         strconv.FormatInt(m.MessageID, 10),
+			ChatID:     strconv.FormatInt(m.Chat.ID, 10),
+			SenderID:   strconv.FormatInt(m.From.ID, 10),
+			SenderName: strings.TrimSpace(m.From.FirstName + " " + m.From.LastName),
+			Text:       text,
+			IsGroup:    m.Chat.Type != "private",
+			Timestamp:  time.Unix(m.Date, 0),
+		})
+	}
+	return messages, nil
+}
@@ -0,0 +1,481 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/appstate"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// --- Channels ---
+// Besides WhatsApp, a user can connect a Telegram bot or a Signal account (through
+// signal-cli-rest-api). Their chats are addressed like WhatsApp JIDs with the channel
+// as server, e.g. "123456789@telegram" or "14155550100@signal", so incoming messages go
+// through the same webhook filtering and sends through the same queue and send API.
+
+const (
+	CHANNEL_TELEGRAM    = "telegram"
+	CHANNEL_SIGNAL      = "signal"
+	CHANNEL_RETRY_DELAY = 10 * time.Second // After a failed receive
+)
+
+// A connected channel: sends go through its WAClient methods, and Receive waits for
+// incoming messages (returning none when there were none for a while)
+type ChannelBackend interface {
+	WAClient
+	Receive(ctx context.Context) ([]ChannelMessage, error)
+}
+
+// An incoming message from a channel
+type ChannelMessage struct {
+	ID         string
+	ChatID     string // Chat the message is in; the sender's ID for direct messages
+	SenderID   string
+	SenderName string
+	Text       string
+	IsGroup    bool
+	Timestamp  time.Time
+}
+
+// A channel as returned by the API; credentials are never returned
+type ChannelInfo struct {
+	Channel   string    `json:"channel"`
+	Account   string    `json:"account"` // Bot username or Signal number
+	Running   bool      `json:"running"`
+	LastError string    `json:"last_error,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Settings of a channel, stored as JSON
+type ChannelConfig struct {
+	Token       string `json:"token,omitempty"`        // Telegram bot token
+	BotUsername string `json:"bot_username,omitempty"` // Telegram, from getMe
+	URL         string `json:"url,omitempty"`          // signal-cli-rest-api base URL
+	Number      string `json:"number,omitempty"`       // Signal account, +<digits>
+}
+
+// Build a channel's backend, checking its settings with the service
+func newChannelBackend(channel string, config *ChannelConfig) (ChannelBackend, error) {
+	switch channel {
+	case CHANNEL_TELEGRAM:
+		return newTelegramBackend(config)
+	case CHANNEL_SIGNAL:
+		return newSignalBackend(config)
+	}
+	return nil, fmt.Errorf("channel must be %s or %s", CHANNEL_TELEGRAM, CHANNEL_SIGNAL)
+}
+
+// Whether a chat JID (or its server) belongs to a channel other than WhatsApp
+func isChannelServer(server string) bool {
+	return server == CHANNEL_TELEGRAM || server == CHANNEL_SIGNAL
+}
+
+// The channel a chat address is on, or "" for WhatsApp
+func chatChannel(chatJID string) string {
+	if i := strings.LastIndex(chatJID, "@"); i >= 0 && isChannelServer(chatJID[i+1:]) {
+		return chatJID[i+1:]
+	}
+	return ""
+}
+
+// A user's running channels, by email then channel
+var channelRunners = struct {
+	mu   sync.Mutex
+	data map[string]map[string]*channelRunner
+}{
+	data: make(map[string]map[string]*channelRunner),
+}
+
+type channelRunner struct {
+	backend   ChannelBackend
+	account   string
+	cancel    context.CancelFunc
+	mu        sync.Mutex
+	lastError string
+}
+
+func (cr *channelRunner) setError(err error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	cr.lastError = ""
+	if err != nil {
+		cr.lastError = err.Error()
+	}
+}
+
+// The client to send to a chat with: the chat's channel, or the user's WhatsApp client.
+// nil when that isn't connected.
+func userClientForChat(email string, chat types.JID) WAClient {
+	if !isChannelServer(chat.Server) {
+		return userWAClient(email)
+	}
+	channelRunners.mu.Lock()
+	defer channelRunners.mu.Unlock()
+	if runner, ok := channelRunners.data[email][chat.Server]; ok {
+		return runner.backend
+	}
+	return nil
+}
+
+// Start receiving from a channel, replacing a running one
+func startChannel(email, channel string, config ChannelConfig, backend ChannelBackend, mediaDir string) {
+	stopChannel(email, channel)
+	ctx, cancel := context.WithCancel(context.Background())
+	runner := &channelRunner{backend: backend, account: channelAccount(config), cancel: cancel}
+	channelRunners.mu.Lock()
+	if channelRunners.data[email] == nil {
+		channelRunners.data[email] = make(map[string]*channelRunner)
+	}
+	channelRunners.data[email][channel] = runner
+	channelRunners.mu.Unlock()
+
+	fmt.Printf("INFO: Started %s channel %s for %s\n", channel, runner.account, email)
+	go func() {
+		for ctx.Err() == nil {
+			messages, err := backend.Receive(ctx)
+			if ctx.Err() != nil {
+				return
+			}
+			runner.setError(err)
+			if err != nil {
+				fmt.Printf("ERROR: Receiving from %s for %s: %v\n", channel, email, err)
+				select {
+				case <-ctx.Done():
+				case <-time.After(CHANNEL_RETRY_DELAY):
+				}
+				continue
+			}
+			for _, msg := range messages {
+				forwardToWebhooks(email, channelMessagePayload(channel, msg), "", mediaDir)
+			}
+		}
+	}()
+}
+
+func stopChannel(email, channel string) {
+	channelRunners.mu.Lock()
+	defer channelRunners.mu.Unlock()
+	if runner, ok := channelRunners.data[email][channel]; ok {
+		runner.cancel()
+		delete(channelRunners.data[email], channel)
+	}
+}
+
+// Stop all of a user's channels
+func stopUserChannels(email string) {
+	for _, channel := range []string{CHANNEL_TELEGRAM, CHANNEL_SIGNAL} {
+		stopChannel(email, channel)
+	}
+}
+
+// Start every configured channel, at server start
+func startChannels(mediaDir string) {
+	startSavedChannels(mediaDir, `SELECT u.email, c.channel, c.config FROM channels c JOIN users u ON u.id = c.user_id`)
+}
+
+// Start a user's configured channels again (after their email changed)
+func startUserChannels(userID int64, mediaDir string) {
+	startSavedChannels(mediaDir, `SELECT u.email, c.channel, c.config FROM channels c JOIN users u ON u.id = c.user_id WHERE c.user_id = ?`, userID)
+}
+
+func startSavedChannels(mediaDir, query string, args ...interface{}) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		fmt.Println("ERROR: Could not load channels", err)
+		return
+	}
+	type saved struct {
+		email, channel string
+		config         ChannelConfig
+	}
+	var all []saved
+	for rows.Next() {
+		var s saved
+		var config string
+		if err := rows.Scan(&s.email, &s.channel, &config); err != nil {
+			continue
+		}
+		if json.Unmarshal([]byte(config), &s.config) == nil {
+			all = append(all, s)
+		}
+	}
+	rows.Close()
+
+	for _, s := range all {
+		backend, err := channelBackendFromConfig(s.channel, s.config)
+		if err != nil {
+			fmt.Printf("ERROR: Could not start %s channel for %s: %v\n", s.channel, s.email, err)
+			continue
+		}
+		startChannel(s.email, s.channel, s.config, backend, mediaDir)
+	}
+}
+
+// Build a backend from saved settings, without contacting the service
+func channelBackendFromConfig(channel string, config ChannelConfig) (ChannelBackend, error) {
+	switch channel {
+	case CHANNEL_TELEGRAM:
+		return newTelegramClient(config.Token), nil
+	case CHANNEL_SIGNAL:
+		return newSignalClient(config.URL, config.Number), nil
+	}
+	return nil, fmt.Errorf("unknown channel %q", channel)
+}
+
+func channelAccount(config ChannelConfig) string {
+	if config.BotUsername != "" {
+		return "@" + config.BotUsername
+	}
+	return config.Number
+}
+
+// Webhook payload for a channel message, shaped like a WhatsApp text message
+func channelMessagePayload(channel string, msg ChannelMessage) map[string]interface{} {
+	payload := map[string]interface{}{
+		"id":        msg.ID,
+		"timestamp": msg.Timestamp.Unix(),
+		"from":      msg.SenderID + "@" + channel,
+		"to":        msg.ChatID + "@" + channel,
+		"type":      "text",
+		"text":      msg.Text,
+		"channel":   channel,
+	}
+	if msg.SenderName != "" {
+		payload["name"] = msg.SenderName
+	} else {
+		payload["name"] = msg.SenderID
+	}
+	if msg.IsGroup {
+		payload["is_group"] = true
+	}
+	return payload
+}
+
+// Text of an outgoing message; channels send text only
+func channelMessageText(message *waProto.Message) (string, error) {
+	if text := message.GetConversation(); text != "" {
+		return text, nil
+	}
+	if text := message.GetExtendedTextMessage().GetText(); text != "" {
+		return text, nil
+	}
+	return "", errors.New("only text messages can be sent on this channel")
+}
+
+// WAClient methods a channel doesn't support, embedded in the backends
+type channelUnsupported struct {
+	channel string
+}
+
+func (c channelUnsupported) unsupported(what string) error {
+	return fmt.Errorf("%s is not supported on %s", what, c.channel)
+}
+
+func (c channelUnsupported) SendChatPresence(jid types.JID, state types.ChatPresence, media types.ChatPresenceMedia) error {
+	return nil // Typing indicators are cosmetic
+}
+
+func (c channelUnsupported) RevokeMessage(chat types.JID, id types.MessageID) (whatsmeow.SendResponse, error) {
+	return whatsmeow.SendResponse{}, c.unsupported("Deleting messages")
+}
+
+func (c channelUnsupported) SendAppState(ctx context.Context, patch appstate.PatchInfo) error {
+	return c.unsupported("Starring messages")
+}
+
+func (c channelUnsupported) UploadReader(ctx context.Context, r io.Reader, tempFile io.ReadWriteSeeker, appInfo whatsmeow.MediaType) (whatsmeow.UploadResponse, error) {
+	return whatsmeow.UploadResponse{}, c.unsupported("Media")
+}
+
+func (c channelUnsupported) Download(ctx context.Context, msg whatsmeow.DownloadableMessage) ([]byte, error) {
+	return nil, c.unsupported("Media")
+}
+
+func (c channelUnsupported) GetJoinedGroups() ([]*types.GroupInfo, error) {
+	return nil, c.unsupported("Listing groups")
+}
+
+func (c channelUnsupported) JoinGroupWithLink(code string) (types.JID, error) {
+	return types.EmptyJID, c.unsupported("Joining groups")
+}
+
+func (c channelUnsupported) JoinGroupWithInvite(jid, inviter types.JID, code string, expiration int64) error {
+	return c.unsupported("Joining groups")
+}
+
+func (c channelUnsupported) IsOnWhatsApp(phones []string) ([]types.IsOnWhatsAppResponse, error) {
+	return nil, c.unsupported("Phone number lookup")
+}
+
+func (c channelUnsupported) Paired() bool {
+	return true
+}
+
+func (c channelUnsupported) GetAllContacts(ctx context.Context) (map[types.JID]types.ContactInfo, error) {
+	return map[types.JID]types.ContactInfo{}, nil
+}
+
+func (c channelUnsupported) GetPNForLID(ctx context.Context, lid types.JID) (types.JID, error) {
+	return types.EmptyJID, nil
+}
+
+// The Signal server is chosen by the user, so channel requests are guarded like webhooks
+var channelHTTPClient = guardedHTTPClient(0)
+
+// Call a channel's JSON API: send body (if any) and decode the response into out (if any)
+func channelRequest(ctx context.Context, method, url string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, _ := json.Marshal(body)
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := channelHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, MAX_WEBHOOK_RESPONSE_BYTES))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("%s returned status %d: %s", method, resp.StatusCode, truncateRunes(strings.TrimSpace(string(data)), 200))
+	}
+	if out != nil && len(data) > 0 {
+		return json.Unmarshal(data, out)
+	}
+	return nil
+}
+
+func dbSaveChannel(userID int64, channel string, config ChannelConfig) error {
+	data, _ := json.Marshal(config)
+	_, err := db.Exec(`INSERT INTO channels (user_id, channel, config, created_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT(user_id, channel) DO UPDATE SET config = excluded.config`,
+		userID, channel, string(data), time.Now().UTC().Format(time.RFC3339))
+	return err
+}
+
+func dbDeleteChannel(userID int64, channel string) (bool, error) {
+	res, err := db.Exec(`DELETE FROM channels WHERE user_id = ? AND channel = ?`, userID, channel)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func dbListChannels(userID int64) ([]ChannelInfo, error) {
+	rows, err := db.Query(`SELECT channel, config, created_at FROM channels WHERE user_id = ? ORDER BY channel`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	channels := []ChannelInfo{}
+	for rows.Next() {
+		var info ChannelInfo
+		var config, createdAt string
+		if err := rows.Scan(&info.Channel, &config, &createdAt); err != nil {
+			return nil, err
+		}
+		var c ChannelConfig
+		json.Unmarshal([]byte(config), &c)
+		info.Account = channelAccount(c)
+		info.CreatedAt, _ = time.Parse(time.RFC3339, createdAt)
+		channels = append(channels, info)
+	}
+	return channels, rows.Err()
+}
+
+// GET/POST /api/channels
+// POST {"channel": "telegram", "token"} or {"channel": "signal", "url", "number"}
+// checks the settings with the service, saves them and starts receiving.
+func handleChannels(mediaDir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := r.Context().Value("userID").(int64)
+		email := getUserEmailByID(userID)
+
+		switch r.Method {
+		case "GET":
+		case "POST":
+			var req struct {
+				Channel string `json:"channel"`
+				ChannelConfig
+			}
+			if err := decodeJSONBody(w, r, &req); err != nil {
+				writeBodyError(w, err)
+				return
+			}
+			config := req.ChannelConfig
+			config.BotUsername = ""
+			backend, err := newChannelBackend(req.Channel, &config)
+			if err != nil {
+				writeAPIError(w, http.StatusBadRequest, ERR_BAD_REQUEST, err.Error())
+				return
+			}
+			if err := dbSaveChannel(userID, req.Channel, config); err != nil {
+				fmt.Println("ERROR: Could not save channel", err)
+				apiError(w, "Failed to save channel", http.StatusInternalServerError)
+				return
+			}
+			startChannel(email, req.Channel, config, backend, mediaDir)
+		default:
+			apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		channels, err := dbListChannels(userID)
+		if err != nil {
+			apiError(w, "Failed to load channels", http.StatusInternalServerError)
+			return
+		}
+		channelRunners.mu.Lock()
+		for i := range channels {
+			if runner, ok := channelRunners.data[email][channels[i].Channel]; ok {
+				channels[i].Running = true
+				runner.mu.Lock()
+				channels[i].LastError = runner.lastError
+				runner.mu.Unlock()
+			}
+		}
+		channelRunners.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(channels)
+	}
+}
+
+// DELETE /api/channels/{channel}
+func handleDeleteChannel(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "DELETE" {
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID := r.Context().Value("userID").(int64)
+	channel := r.PathValue("channel")
+	deleted, err := dbDeleteChannel(userID, channel)
+	if err != nil {
+		apiError(w, "Failed to delete channel", http.StatusInternalServerError)
+		return
+	}
+	if !deleted {
+		apiError(w, "Channel not found", http.StatusNotFound)
+		return
+	}
+	stopChannel(getUserEmailByID(userID), channel)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true})
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+// A Bot API stand-in: one incoming message, then empty polls; sent messages are recorded
+func fakeTelegramAPI(t *testing.T, token string) (*httptest.Server, chan map[string]interface{}) {
+	sent := make(chan map[string]interface{}, 4)
+	var once sync.Once
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/bot"+token+"/") {
+			json.NewEncoder(w).Encode(map[string]interface{}{"ok": false, "description": "Unauthorized"})
+			return
+		}
+		var params map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&params)
+		var result interface{} = true
+		switch strings.TrimPrefix(r.URL.Path, "/bot"+token+"/") {
+		case "getMe":
+			result = map[string]interface{}{"id": 1, "username": "hub_bot"}
+		case "getUpdates":
+			updates := []interface{}{}
+			once.Do(func() {
+				updates = append(updates, map[string]interface{}{"update_id": 7, "message": map[string]interface{}{
+					"message_id": 11, "date": time.Now().Unix(), "text": "hello from telegram",
+					"from": map[string]interface{}{"id": 42, "first_name": "Tess", "last_name": "Gram"},
+					"chat": map[string]interface{}{"id": 42, "type": "private"},
+				}})
+			})
+			if len(updates) == 0 {
+				time.Sleep(50 * time.Millisecond)
+			}
+			result = updates
+		case "sendMessage":
+			sent <- params
+			result = map[string]interface{}{"message_id": 12, "date": time.Now().Unix()}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"ok": true, "result": result})
+	}))
+	t.Cleanup(srv.Close)
+	return srv, sent
+}
+
+func TestTelegramChannel(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+
+	email := "telegram@example.com"
+	_, apiKey := registerWithAPIKey(t, ts, email, "telegrampass123")
+	defer stopUserChannels(email)
+
+	api, sent := fakeTelegramAPI(t, "123:secret")
+	t.Setenv("TELEGRAM_API_URL", api.URL)
+
+	received := make(chan map[string]interface{}, 4)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		received <- body
+	}))
+	defer receiver.Close()
+	if resp := apiRequest(t, "POST", ts.URL+"/api/webhooks/create", apiKey, map[string]interface{}{"url": receiver.URL, "method": "POST"}, nil); resp.StatusCode != 200 {
+		t.Fatalf("Create webhook failed, status: %d", resp.StatusCode)
+	}
+
+	// Sending before the channel exists
+	resp := apiRequest(t, "POST", ts.URL+"/api/messages/send", apiKey, map[string]string{"chat_jid": "42@telegram", "message": "hi"}, nil)
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("Expected 503 without a channel, got %d", resp.StatusCode)
+	}
+
+	// A bad token is rejected when saving
+	if resp := apiRequest(t, "POST", ts.URL+"/api/channels", apiKey, map[string]string{"channel": "telegram", "token": "wrong"}, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for a bad token, got %d", resp.StatusCode)
+	}
+	var channels []map[string]interface{}
+	resp = apiRequest(t, "POST", ts.URL+"/api/channels", apiKey, map[string]string{"channel": "telegram", "token": "123:secret"}, &channels)
+	if resp.StatusCode != 200 || len(channels) != 1 || channels[0]["account"] != "@hub_bot" || channels[0]["running"] != true {
+		t.Fatalf("Add channel failed: %d %v", resp.StatusCode, channels)
+	}
+	if _, ok := channels[0]["token"]; ok {
+		t.Fatalf("Token must not be returned: %v", channels[0])
+	}
+
+	// Incoming messages reach the webhooks like WhatsApp messages
+	select {
+	case body := <-received:
+		if body["from"] != "42@telegram" || body["to"] != "42@telegram" || body["text"] != "hello from telegram" || body["name"] != "Tess Gram" || body["channel"] != "telegram" {
+			t.Fatalf("Unexpected webhook payload: %v", body)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Timed out waiting for the Telegram message")
+	}
+
+	// Replies go through the queue to the bot
+	resp = apiRequest(t, "POST", ts.URL+"/api/messages/send", apiKey, map[string]string{"chat_jid": "42@telegram", "message": "hi back"}, nil)
+	if resp.StatusCode != 200 {
+		t.Fatalf("Send failed: %d", resp.StatusCode)
+	}
+	select {
+	case params := <-sent:
+		if params["chat_id"] != "42" || params["text"] != "hi back" {
+			t.Fatalf("Unexpected sendMessage: %v", params)
+		}
+	case <-time.After(15 * time.Second):
+		t.Fatalf("Timed out waiting for sendMessage")
+	}
+
+	if resp := apiRequest(t, "DELETE", ts.URL+"/api/channels/telegram", apiKey, nil, nil); resp.StatusCode != 200 {
+		t.Fatalf("Delete channel failed: %d", resp.StatusCode)
+	}
+	if userClientForChat(email, types.NewJID("42", CHANNEL_TELEGRAM)) != nil {
+		t.Fatalf("Channel should be stopped after delete")
+	}
+}
+
+func TestSignalChannelReceive(t *testing.T) {
+	var once sync.Once
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/v1/about":
+			w.Write([]byte(`{"versions":["v1","v2"]}`))
+		case r.URL.Path == "/v1/receive/+14155550100":
+			envelopes := `[]`
+			once.Do(func() {
+				envelopes = `[{"envelope":{"sourceNumber":"+14155550199","sourceName":"Sig","timestamp":1700000000000,"dataMessage":{"message":"hi"}}},
+					{"envelope":{"sourceNumber":"+14155550199","timestamp":1700000000001,"dataMessage":{"message":"in a group","groupInfo":{"groupId":"abc"}}}},
+					{"envelope":{"sourceNumber":"+14155550199","timestamp":1700000000002,"receiptMessage":{}}}]`
+			})
+			w.Write([]byte(envelopes))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer api.Close()
+
+	config := ChannelConfig{URL: api.URL, Number: "+1 415 555 0100"}
+	backend, err := newChannelBackend(CHANNEL_SIGNAL, &config)
+	if err != nil {
+		t.Fatalf("Signal backend: %v", err)
+	}
+	if config.Number != "+14155550100" {
+		t.Fatalf("Expected a normalized number, got %q", config.Number)
+	}
+	messages, err := backend.Receive(t.Context())
+	if err != nil || len(messages) != 1 {
+		t.Fatalf("Expected one direct message, got %v %v", messages, err)
+	}
+	payload := channelMessagePayload(CHANNEL_SIGNAL, messages[0])
+	if payload["from"] != "14155550199@signal" || payload["id"] != "1700000000000" || payload["name"] != "Sig" {
+		t.Fatalf("Unexpected payload: %v", payload)
+	}
+}
+
+func TestParseChannelChatJID(t *testing.T) {
+	for input, want := range map[string]string{
+		"42@telegram":            "42@telegram",
+		"-1001234@telegram":      "-1001234@telegram",
+		"+1 415 555 0100@signal": "14155550100@signal",
+		"14155550100@signal":     "14155550100@signal",
+	} {
+		jid, _, err := parseChatJID(input)
+		if err != nil || jid.String() != want {
+			t.Errorf("parseChatJID(%q) = %v, %v; want %s", input, jid, err, want)
+		}
+	}
+	for _, input := range []string{"bob@telegram", "abc@signal"} {
+		if _, _, err := parseChatJID(input); err == nil {
+			t.Errorf("Expected %q to be invalid", input)
+		}
+	}
+	if chatTypeForJID("-1001234@telegram") != "group" || chatTypeForJID("42@telegram") != "chat" {
+		t.Errorf("Telegram chat types wrong")
+	}
+}
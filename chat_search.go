@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// --- Chat search ---
+// GET /api/wa/chats/search?q= ranks contacts, groups and recent chats by how well the
+// query matches their names (full, first, push and business names, group subjects) or
+// phone number, instead of returning the full (possibly huge) chat list.
+
+const (
+	DEFAULT_CHAT_SEARCH_LIMIT = 20
+	MAX_CHAT_SEARCH_LIMIT     = 100
+	GROUP_CACHE_TTL           = 5 * time.Minute
+)
+
+// A chat that can be searched, with every name it is known by
+type chatCandidate struct {
+	Chat
+	names []string
+	phone string // Digits of the JID user part, for direct chats
+}
+
+type chatSearchResult struct {
+	Chat
+	Score int `json:"score"`
+}
+
+// Joined groups per user, cached because fetching them is a round trip to WhatsApp
+var groupCache = struct {
+	mu   sync.Mutex
+	data map[string]cachedGroups // email -> groups
+}{
+	data: make(map[string]cachedGroups),
+}
+
+type cachedGroups struct {
+	chats     []chatCandidate
+	fetchedAt time.Time
+}
+
+func getCachedGroups(email string, client WAClient) []chatCandidate {
+	groupCache.mu.Lock()
+	cached, ok := groupCache.data[email]
+	groupCache.mu.Unlock()
+	if ok && time.Since(cached.fetchedAt) < GROUP_CACHE_TTL {
+		return cached.chats
+	}
+
+	groups, err := client.GetJoinedGroups()
+	if err != nil {
+		fmt.Printf("DEBUG: Error getting groups for search: %v\n", err)
+		return cached.chats // Possibly stale, better than nothing
+	}
+	chats := make([]chatCandidate, 0, len(groups))
+	for _, group := range groups {
+		rememberGroupSubject(group.JID.String(), group.Name)
+		chats = append(chats, chatCandidate{
+			Chat:  Chat{ID: group.JID.String(), Name: group.Name, Type: "group"},
+			names: []string{group.Name},
+		})
+	}
+	groupCache.mu.Lock()
+	groupCache.data[email] = cachedGroups{chats: chats, fetchedAt: time.Now()}
+	groupCache.mu.Unlock()
+	return chats
+}
+
+// Everything a user's chats can be found by: stored contacts, joined groups and recent chats
+func collectChatCandidates(ctx context.Context, email string) []chatCandidate {
+	var candidates []chatCandidate
+	seen := map[string]int{} // chat ID -> index in candidates
+
+	client := userWAClient(email)
+	if client != nil && client.Paired() {
+		contacts, err := client.GetAllContacts(ctx)
+		if err != nil {
+			fmt.Printf("DEBUG: Error getting contacts for search: %v\n", err)
+		}
+		for jid, contact := range contacts {
+			if jid.Server != "s.whatsapp.net" {
+				continue
+			}
+			c := chatCandidate{
+				Chat:  Chat{ID: jid.String(), Type: "chat"},
+				names: []string{contact.FullName, contact.FirstName, contact.PushName, contact.BusinessName},
+				phone: jid.User,
+			}
+			for _, name := range c.names {
+				if name != "" {
+					c.Name = name
+					break
+				}
+			}
+			if c.Name == "" {
+				c.Name = jid.User
+			}
+			seen[c.ID] = len(candidates)
+			candidates = append(candidates, c)
+		}
+		for _, g := range getCachedGroups(email, client) {
+			seen[g.ID] = len(candidates)
+			candidates = append(candidates, g)
+		}
+	}
+
+	// Recent chats add activity, and chats the stores don't know about
+	for _, recent := range getRecentChats(ctx, email) {
+		if i, ok := seen[recent.ID]; ok {
+			candidates[i].LastMessageAt, candidates[i].LastText, candidates[i].Unread = recent.LastMessageAt, recent.LastText, recent.Unread
+			candidates[i].names = append(candidates[i].names, recent.Name)
+			continue
+		}
+		c := chatCandidate{Chat: recent, names: []string{recent.Name}}
+		if recent.Type == "chat" {
+			c.phone = strings.Split(recent.ID, "@")[0]
+		}
+		candidates = append(candidates, c)
+	}
+	return candidates
+}
+
+// Lowercase and drop everything but letters, digits and spaces
+func normalizeSearchText(s string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(s) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(r)
+		} else if unicode.IsSpace(r) || r == '-' || r == '_' || r == '.' {
+			b.WriteRune(' ')
+		}
+	}
+	return strings.Join(strings.Fields(b.String()), " ")
+}
+
+func digitsOnly(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if r >= '0' && r <= '9' {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// Whether every rune of query appears in s in order (e.g. "jdoe" in "john doe")
+func isSubsequence(query, s string) bool {
+	q := []rune(query)
+	i := 0
+	for _, r := range s {
+		if i < len(q) && r == q[i] {
+			i++
+		}
+	}
+	return i == len(q)
+}
+
+// Edit distance between two short strings, counting a swap of adjacent letters as one edit
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	d := make([][]int, len(ra)+1)
+	for i := range d {
+		d[i] = make([]int, len(rb)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			d[i][j] = min(d[i-1][j]+1, d[i][j-1]+1, d[i-1][j-1]+cost)
+			if i > 1 && j > 1 && ra[i-1] == rb[j-2] && ra[i-2] == rb[j-1] {
+				d[i][j] = min(d[i][j], d[i-2][j-2]+1)
+			}
+		}
+	}
+	return d[len(ra)][len(rb)]
+}
+
+// Score how well a normalized query matches one name; 0 means no match
+func scoreName(query, name string) int {
+	name = normalizeSearchText(name)
+	switch {
+	case name == "":
+		return 0
+	case name == query:
+		return 100
+	case strings.HasPrefix(name, query):
+		return 80
+	case strings.Contains(" "+name, " "+query):
+		return 70 // A later word starts with the query
+	case strings.Contains(name, query):
+		return 60
+	}
+	// Typo tolerance: a query word within one edit of a name word
+	if len([]rune(query)) >= 4 {
+		for _, word := range strings.Fields(name) {
+			if editDistance(query, word) <= 1 {
+				return 40
+			}
+		}
+	}
+	if isSubsequence(strings.ReplaceAll(query, " ", ""), name) {
+		return 20
+	}
+	return 0
+}
+
+// Score a chat for a query: the best name match, or a phone number match
+func scoreChat(query string, c chatCandidate) int {
+	best := 0
+	for _, name := range c.names {
+		best = max(best, scoreName(query, name))
+	}
+	if digits := digitsOnly(query); len(digits) >= 3 && len(digits) == len(strings.ReplaceAll(query, " ", "")) && c.phone != "" {
+		if strings.HasPrefix(c.phone, digits) {
+			best = max(best, 90)
+		} else if strings.Contains(c.phone, digits) {
+			best = max(best, 75)
+		}
+	}
+	return best
+}
+
+// Rank candidates for a query: by score, then recent activity, then name
+func rankChats(query string, candidates []chatCandidate, limit int) []chatSearchResult {
+	query = normalizeSearchText(query)
+	results := []chatSearchResult{}
+	if query == "" {
+		return results
+	}
+	for _, c := range candidates {
+		if score := scoreChat(query, c); score > 0 {
+			results = append(results, chatSearchResult{Chat: c.Chat, Score: score})
+		}
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		if (a.LastMessageAt == nil) != (b.LastMessageAt == nil) {
+			return a.LastMessageAt != nil
+		}
+		if a.LastMessageAt != nil && !a.LastMessageAt.Equal(*b.LastMessageAt) {
+			return a.LastMessageAt.After(*b.LastMessageAt)
+		}
+		return strings.ToLower(a.Name) < strings.ToLower(b.Name)
+	})
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results
+}
+
+// GET /api/wa/chats/search?q=&limit=
+func handleChatSearch(sessionCookieName string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isAuthenticated(r, sessionCookieName) {
+			apiError(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != "GET" {
+			apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		query := strings.TrimSpace(r.URL.Query().Get("q"))
+		if query == "" {
+			apiError(w, "Missing q", http.StatusBadRequest)
+			return
+		}
+		limit := DEFAULT_CHAT_SEARCH_LIMIT
+		if v := r.URL.Query().Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > MAX_CHAT_SEARCH_LIMIT {
+				apiError(w, fmt.Sprintf("Invalid limit (1-%d)", MAX_CHAT_SEARCH_LIMIT), http.StatusBadRequest)
+				return
+			}
+			limit = n
+		}
+
+		email := getUserEmail(r, sessionCookieName)
+		ctx, cancel := queryContext(r)
+		defer cancel()
+		results := rankChats(query, collectChatCandidates(ctx, email), limit)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(results)
+	}
+}
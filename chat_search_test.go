@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRankChats(t *testing.T) {
+	recent := time.Now()
+	candidates := []chatCandidate{
+		{Chat: Chat{ID: "14155550001@s.whatsapp.net", Name: "Jonathan Smith", Type: "chat"}, names: []string{"Jonathan Smith", "Jon"}, phone: "14155550001"},
+		{Chat: Chat{ID: "14155550002@s.whatsapp.net", Name: "Jane Doe", Type: "chat"}, names: []string{"Jane Doe"}, phone: "14155550002"},
+		{Chat: Chat{ID: "1203630001@g.us", Name: "Smith Family", Type: "group"}, names: []string{"Smith Family"}},
+		{Chat: Chat{ID: "1203630002@g.us", Name: "Blacksmiths Guild", Type: "group", LastMessageAt: &recent}, names: []string{"Blacksmiths Guild"}},
+	}
+	ids := func(results []chatSearchResult) []string {
+		var out []string
+		for _, r := range results {
+			out = append(out, r.ID)
+		}
+		return out
+	}
+	expect := func(query string, want ...string) {
+		t.Helper()
+		got := ids(rankChats(query, candidates, 10))
+		if len(got) != len(want) {
+			t.Fatalf("%q: expected %v, got %v", query, want, got)
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Fatalf("%q: expected %v, got %v", query, want, got)
+			}
+		}
+	}
+
+	// Prefix beats word prefix beats substring
+	expect("smith", "1203630001@g.us", "14155550001@s.whatsapp.net", "1203630002@g.us")
+	// Push/first names are searched too, case-insensitively
+	expect("JON", "14155550001@s.whatsapp.net")
+	// One typo is tolerated
+	expect("jnae", "14155550002@s.whatsapp.net")
+	// Phone numbers, ignoring formatting
+	expect("+1 415-555-0002", "14155550002@s.whatsapp.net")
+	expect("5550001", "14155550001@s.whatsapp.net")
+	expect("zzz")
+
+	if results := rankChats("a", candidates, 2); len(results) != 2 {
+		t.Fatalf("Expected limit to apply, got %d", len(results))
+	}
+}
+
+func TestChatSearchEndpoint(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+
+	email := "chatsearch@example.com"
+	cookies, _ := registerWithAPIKey(t, ts, email, "chatsearchpass123")
+	recordChatActivity(email, "5551234@s.whatsapp.net", "Maria Garcia", "chat", "hola", true, time.Now())
+	recordChatActivity(email, "120363000000000009@g.us", "Marketing Team", "group", "", true, time.Now())
+
+	search := func(query string) (*http.Response, []chatSearchResult) {
+		req, _ := http.NewRequest("GET", ts.URL+"/api/wa/chats/search?q="+query, nil)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Search failed: %v", err)
+		}
+		var results []chatSearchResult
+		json.NewDecoder(resp.Body).Decode(&results)
+		return resp, results
+	}
+
+	resp, results := search("mar")
+	if resp.StatusCode != 200 || len(results) != 2 {
+		t.Fatalf("Expected 2 results, got %d %+v", resp.StatusCode, results)
+	}
+	if _, results = search("garcia"); len(results) != 1 || results[0].ID != "5551234@s.whatsapp.net" || results[0].LastText != "hola" {
+		t.Fatalf("Unexpected results: %+v", results)
+	}
+	if resp, _ = search(""); resp.StatusCode != 400 {
+		t.Fatalf("Expected 400 without q, got %d", resp.StatusCode)
+	}
+}
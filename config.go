@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// --- Config export/import ---
+// Shareable account configuration, so a team can copy a setup from one account to
+// another: the canned response library and the auto-responder.
+
+const CONFIG_VERSION = 1
+
+type AccountConfig struct {
+	Version         int              `json:"version"`
+	ExportedAt      *time.Time       `json:"exported_at,omitempty"`
+	CannedResponses []CannedResponse `json:"canned_responses"`
+	AutoResponder   *AutoResponder   `json:"auto_responder,omitempty"` // Left unchanged on import if absent
+}
+
+// GET /api/config/export
+func handleConfigExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID := r.Context().Value("userID").(int64)
+
+	responses, err := dbListCannedResponses(userID)
+	if err != nil {
+		fmt.Println("ERROR: Could not export canned responses", err)
+		apiError(w, "Failed to export config", http.StatusInternalServerError)
+		return
+	}
+	autoResponder, err := dbGetAutoResponder(userID)
+	if err != nil {
+		fmt.Println("ERROR: Could not export auto-responder", err)
+		apiError(w, "Failed to export config", http.StatusInternalServerError)
+		return
+	}
+	autoResponder.UpdatedAt = nil
+	now := time.Now().UTC()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="config.json"`)
+	json.NewEncoder(w).Encode(AccountConfig{
+		Version:         CONFIG_VERSION,
+		ExportedAt:      &now,
+		CannedResponses: responses,
+		AutoResponder:   &autoResponder,
+	})
+}
+
+// POST /api/config/import
+// Merges an exported config: canned responses are created or overwritten by shortcut,
+// entries not in the import are kept. Everything is validated before anything is saved.
+func handleConfigImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID := r.Context().Value("userID").(int64)
+
+	var cfg AccountConfig
+	if err := decodeJSONBody(w, r, &cfg); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	if cfg.Version != CONFIG_VERSION {
+		apiError(w, fmt.Sprintf("Unsupported config version %d (expected %d)", cfg.Version, CONFIG_VERSION), http.StatusBadRequest)
+		return
+	}
+	if len(cfg.CannedResponses) > MAX_CANNED_RESPONSES {
+		apiError(w, fmt.Sprintf("Too many canned responses (max %d)", MAX_CANNED_RESPONSES), http.StatusBadRequest)
+		return
+	}
+	for i := range cfg.CannedResponses {
+		if err := validateCannedResponse(&cfg.CannedResponses[i]); err != nil {
+			apiError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if cfg.AutoResponder != nil {
+		if err := validateAutoResponder(cfg.AutoResponder); err != nil {
+			apiError(w, "auto_responder: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	imported := 0
+	for _, c := range cfg.CannedResponses {
+		if err := dbSetCannedResponse(userID, c); err != nil {
+			fmt.Printf("ERROR: Config import for user %d stopped at /%s: %v\n", userID, c.Shortcut, err)
+			apiError(w, fmt.Sprintf("Failed to import /%s: %v", c.Shortcut, err), http.StatusBadRequest)
+			return
+		}
+		imported++
+	}
+	if cfg.AutoResponder != nil {
+		if err := dbSetAutoResponder(userID, *cfg.AutoResponder); err != nil {
+			fmt.Println("ERROR: Could not import auto-responder", err)
+			apiError(w, "Failed to import auto_responder", http.StatusInternalServerError)
+			return
+		}
+	}
+	fmt.Printf("INFO: Imported config for user %d: %d canned responses, auto-responder %v\n", userID, imported, cfg.AutoResponder != nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":          true,
+		"canned_responses": imported,
+		"auto_responder":   cfg.AutoResponder != nil,
+	})
+}
@@ -0,0 +1,502 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// --- Declarative config ---
+// POST /api/config/apply takes the desired configuration of the account and reconciles
+// it: webhooks, alert rules, canned responses and the auto-responder are created,
+// updated or deleted to match, so they can be kept in git and applied from CI. A section
+// left out of the spec is not touched; a section that is present is authoritative, and
+// what it doesn't list is deleted. The answer is the change plan; with "dry_run" nothing
+// is saved. Everything is validated first and saved in one transaction.
+//
+// Matching existing entries:
+//   - webhooks: by "id" when given, else by url, filter_type and filter_value
+//   - alert rules: by "id" when given, else by metric, webhook_id and notify target
+//   - canned responses: by shortcut
+
+const (
+	CONFIG_CHANGE_CREATE = "create"
+	CONFIG_CHANGE_UPDATE = "update"
+	CONFIG_CHANGE_DELETE = "delete"
+)
+
+type ConfigSpec struct {
+	Version         int               `json:"version"`
+	Webhooks        *[]Webhook        `json:"webhooks,omitempty"`
+	AlertRules      *[]AlertRule      `json:"alert_rules,omitempty"`
+	CannedResponses *[]CannedResponse `json:"canned_responses,omitempty"`
+	AutoResponder   *AutoResponder    `json:"auto_responder,omitempty"`
+	DryRun          bool              `json:"dry_run,omitempty"`
+	Verify          bool              `json:"verify,omitempty"` // Challenge created webhooks, as "verify" on create
+}
+
+// One step of the change plan
+type ConfigChange struct {
+	Action string   `json:"action"` // "create", "update" or "delete"
+	Kind   string   `json:"kind"`   // "webhook", "alert_rule", "canned_response" or "auto_responder"
+	ID     string   `json:"id,omitempty"`
+	Name   string   `json:"name,omitempty"`   // Webhook URL, alert metric or /shortcut
+	Fields []string `json:"fields,omitempty"` // What an update changes
+
+	// Verification of a created webhook, with "verify"
+	Unverified        *bool  `json:"unverified,omitempty"`
+	VerificationError string `json:"verification_error,omitempty"`
+
+	apply  func(tx *sql.Tx) error
+	verify *Webhook
+}
+
+// Fields that are state rather than configuration, per kind
+var (
+	webhookStateFields        = []string{"id", "unverified", "last_delivery_at", "alerts", "health", "created_at"}
+	alertRuleStateFields      = []string{"id", "firing", "resources", "last_value", "fired_at", "checked_at", "created_at"}
+	cannedResponseStateFields = []string{"updated_at"}
+)
+
+// The configuration fields of a value as JSON, without state fields and empty values,
+// so a spec and the stored entry compare equal when nothing would change
+func configFields(v interface{}, state []string) map[string]interface{} {
+	data, _ := json.Marshal(v)
+	fields := map[string]interface{}{}
+	json.Unmarshal(data, &fields)
+	for _, name := range state {
+		delete(fields, name)
+	}
+	for name, value := range fields {
+		switch value := value.(type) {
+		case nil:
+			delete(fields, name)
+		case string, bool, float64:
+			if reflect.ValueOf(value).IsZero() {
+				delete(fields, name)
+			}
+		case []interface{}:
+			if len(value) == 0 {
+				delete(fields, name)
+			}
+		case map[string]interface{}:
+			if len(value) == 0 {
+				delete(fields, name)
+			}
+		}
+	}
+	return fields
+}
+
+// Names of the fields that differ, sorted
+func changedConfigFields(current, desired interface{}, state []string) []string {
+	a, b := configFields(current, state), configFields(desired, state)
+	changed := []string{}
+	for name, value := range b {
+		if !reflect.DeepEqual(a[name], value) {
+			changed = append(changed, name)
+		}
+	}
+	for name := range a {
+		if _, ok := b[name]; !ok {
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+func webhookMatchKey(wh Webhook) string {
+	return wh.URL + "\x00" + wh.FilterType + "\x00" + wh.FilterValue
+}
+
+func alertRuleMatchKey(rule AlertRule) string {
+	return strings.Join([]string{rule.Metric, rule.WebhookID, rule.NotifyURL, rule.NotifyEmail}, "\x00")
+}
+
+// Pair desired entries with existing ones, by ID first and then by key. Returns the
+// index of the existing entry for each desired one (-1 = create) and the unmatched
+// existing entries (to delete).
+func matchConfigEntries(kind string, desiredIDs, desiredKeys, existingIDs, existingKeys []string) ([]int, []int, error) {
+	matched := make([]int, len(desiredIDs))
+	used := make([]bool, len(existingIDs))
+	seen := map[string]bool{}
+	for i, id := range desiredIDs {
+		matched[i] = -1
+		if id == "" {
+			continue
+		}
+		if seen["id:"+id] {
+			return nil, nil, fmt.Errorf("%s %s is listed twice", kind, id)
+		}
+		seen["id:"+id] = true
+		for j, existing := range existingIDs {
+			if existing == id {
+				matched[i], used[j] = j, true
+			}
+		}
+		if matched[i] < 0 {
+			return nil, nil, fmt.Errorf("%s %s not found (leave out id to create it)", kind, id)
+		}
+	}
+	for i, id := range desiredIDs {
+		if id != "" {
+			continue
+		}
+		if seen["key:"+desiredKeys[i]] {
+			return nil, nil, fmt.Errorf("%s #%d is listed twice (give each an id to keep both)", kind, i+1)
+		}
+		seen["key:"+desiredKeys[i]] = true
+		for j, key := range existingKeys {
+			if !used[j] && key == desiredKeys[i] {
+				matched[i], used[j] = j, true
+				break
+			}
+		}
+	}
+	unmatched := []int{}
+	for j := range existingIDs {
+		if !used[j] {
+			unmatched = append(unmatched, j)
+		}
+	}
+	return matched, unmatched, nil
+}
+
+func planWebhooks(userID int64, desired []Webhook, verify bool) ([]ConfigChange, map[string]bool, error) {
+	if len(desired) > MAX_BULK_WEBHOOKS {
+		return nil, nil, fmt.Errorf("Too many webhooks (max %d)", MAX_BULK_WEBHOOKS)
+	}
+	existing, err := dbListWebhooks(userID)
+	if err != nil {
+		fmt.Println("ERROR: Could not load webhooks for config apply", err)
+		return nil, nil, &bodyError{Status: http.StatusInternalServerError, Message: "Failed to load current config"}
+	}
+	desiredIDs, desiredKeys := make([]string, len(desired)), make([]string, len(desired))
+	for i := range desired {
+		wh := &desired[i]
+		if wh.URL == "" {
+			return nil, nil, fmt.Errorf("webhooks #%d: Missing URL", i+1)
+		}
+		if wh.Method == "" {
+			wh.Method = "POST"
+		}
+		if err := validateWebhookConfig(wh); err != nil {
+			return nil, nil, fmt.Errorf("webhooks #%d: %v", i+1, err)
+		}
+		if wh.AllowedChats, err = limitToAPIKeyChats(userID, wh.AllowedChats); err != nil {
+			return nil, nil, err
+		}
+		desiredIDs[i], desiredKeys[i] = wh.ID, webhookMatchKey(*wh)
+	}
+	existingIDs, existingKeys := make([]string, len(existing)), make([]string, len(existing))
+	for j, wh := range existing {
+		existingIDs[j], existingKeys[j] = wh.ID, webhookMatchKey(wh)
+	}
+	matched, unmatched, err := matchConfigEntries("webhook", desiredIDs, desiredKeys, existingIDs, existingKeys)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	changes := []ConfigChange{}
+	for i, wh := range desired {
+		if matched[i] < 0 {
+			// Like a clone, an entry copied from an unverified webhook stays unverified
+			wh.ID, wh.Unverified, wh.CreatedAt = generateWebhookID(), wh.Unverified || verify, time.Now()
+			change := ConfigChange{Action: CONFIG_CHANGE_CREATE, Kind: "webhook", ID: wh.ID, Name: wh.URL,
+				apply: func(tx *sql.Tx) error { return dbCreateWebhookWith(tx, userID, wh) }}
+			if verify {
+				change.verify = &wh
+			}
+			changes = append(changes, change)
+			continue
+		}
+		current := existing[matched[i]]
+		wh.ID = current.ID
+		if fields := changedConfigFields(current, wh, webhookStateFields); len(fields) > 0 {
+			changes = append(changes, ConfigChange{Action: CONFIG_CHANGE_UPDATE, Kind: "webhook", ID: wh.ID, Name: wh.URL, Fields: fields,
+				apply: func(tx *sql.Tx) error { return dbUpdateWebhookWith(tx, userID, wh) }})
+		}
+	}
+	deleted := map[string]bool{}
+	for _, j := range unmatched {
+		wh := existing[j]
+		deleted[wh.ID] = true
+		changes = append(changes, ConfigChange{Action: CONFIG_CHANGE_DELETE, Kind: "webhook", ID: wh.ID, Name: wh.URL,
+			apply: func(tx *sql.Tx) error { return dbDeleteWebhookWith(tx, userID, wh.ID) }})
+	}
+	return changes, deleted, nil
+}
+
+func planAlertRules(userID int64, desired []AlertRule, deletedWebhooks map[string]bool) ([]ConfigChange, error) {
+	if len(desired) > MAX_ALERT_RULES {
+		return nil, fmt.Errorf("Too many alert rules (max %d)", MAX_ALERT_RULES)
+	}
+	existing, err := dbListAlertRules(userID)
+	if err != nil {
+		fmt.Println("ERROR: Could not load alert rules for config apply", err)
+		return nil, &bodyError{Status: http.StatusInternalServerError, Message: "Failed to load current config"}
+	}
+	desiredIDs, desiredKeys := make([]string, len(desired)), make([]string, len(desired))
+	for i := range desired {
+		rule := &desired[i]
+		rule.NotifyURL, rule.NotifyEmail = strings.TrimSpace(rule.NotifyURL), strings.TrimSpace(rule.NotifyEmail)
+		if err := validateAlertRule(userID, rule); err != nil {
+			return nil, fmt.Errorf("alert_rules #%d: %v", i+1, err)
+		}
+		if deletedWebhooks[rule.WebhookID] {
+			return nil, fmt.Errorf("alert_rules #%d: webhook %s is deleted by this config", i+1, rule.WebhookID)
+		}
+		desiredIDs[i], desiredKeys[i] = rule.ID, alertRuleMatchKey(*rule)
+	}
+	existingIDs, existingKeys := make([]string, len(existing)), make([]string, len(existing))
+	for j, rule := range existing {
+		existingIDs[j], existingKeys[j] = rule.ID, alertRuleMatchKey(rule)
+	}
+	matched, unmatched, err := matchConfigEntries("alert rule", desiredIDs, desiredKeys, existingIDs, existingKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := []ConfigChange{}
+	for i, rule := range desired {
+		if matched[i] < 0 {
+			rule.ID, rule.CreatedAt = generateWebhookID(), time.Now()
+			changes = append(changes, ConfigChange{Action: CONFIG_CHANGE_CREATE, Kind: "alert_rule", ID: rule.ID, Name: rule.Metric,
+				apply: func(tx *sql.Tx) error { return dbCreateAlertRuleWith(tx, userID, rule) }})
+			continue
+		}
+		current := existing[matched[i]]
+		rule.ID = current.ID
+		if fields := changedConfigFields(current, rule, alertRuleStateFields); len(fields) > 0 {
+			changes = append(changes, ConfigChange{Action: CONFIG_CHANGE_UPDATE, Kind: "alert_rule", ID: rule.ID, Name: rule.Metric, Fields: fields,
+				apply: func(tx *sql.Tx) error {
+					_, err := tx.Exec(`UPDATE alert_rules SET metric = ?, webhook_id = ?, threshold = ?, window_seconds = ?, notify_url = ?, notify_email = ? WHERE user_id = ? AND id = ?`,
+						rule.Metric, rule.WebhookID, rule.Threshold, rule.WindowSeconds, rule.NotifyURL, rule.NotifyEmail, userID, rule.ID)
+					return err
+				}})
+		}
+	}
+	for _, j := range unmatched {
+		rule := existing[j]
+		changes = append(changes, ConfigChange{Action: CONFIG_CHANGE_DELETE, Kind: "alert_rule", ID: rule.ID, Name: rule.Metric,
+			apply: func(tx *sql.Tx) error {
+				_, err := tx.Exec(`DELETE FROM alert_rules WHERE user_id = ? AND id = ?`, userID, rule.ID)
+				return err
+			}})
+	}
+	return changes, nil
+}
+
+func planCannedResponses(userID int64, desired []CannedResponse) ([]ConfigChange, error) {
+	if len(desired) > MAX_CANNED_RESPONSES {
+		return nil, fmt.Errorf("Too many canned responses (max %d)", MAX_CANNED_RESPONSES)
+	}
+	existing, err := dbListCannedResponses(userID)
+	if err != nil {
+		fmt.Println("ERROR: Could not load canned responses for config apply", err)
+		return nil, &bodyError{Status: http.StatusInternalServerError, Message: "Failed to load current config"}
+	}
+	current := map[string]CannedResponse{}
+	for _, c := range existing {
+		current[c.Shortcut] = c
+	}
+	changes := []ConfigChange{}
+	listed := map[string]bool{}
+	for i := range desired {
+		c := desired[i]
+		if err := validateCannedResponse(&c); err != nil {
+			return nil, fmt.Errorf("canned_responses #%d: %v", i+1, err)
+		}
+		if listed[c.Shortcut] {
+			return nil, fmt.Errorf("canned response /%s is listed twice", c.Shortcut)
+		}
+		listed[c.Shortcut] = true
+		apply := func(tx *sql.Tx) error { return dbSetCannedResponseWith(tx, userID, c) }
+		old, ok := current[c.Shortcut]
+		if !ok {
+			changes = append(changes, ConfigChange{Action: CONFIG_CHANGE_CREATE, Kind: "canned_response", Name: "/" + c.Shortcut, apply: apply})
+		} else if fields := changedConfigFields(old, c, cannedResponseStateFields); len(fields) > 0 {
+			changes = append(changes, ConfigChange{Action: CONFIG_CHANGE_UPDATE, Kind: "canned_response", Name: "/" + c.Shortcut, Fields: fields, apply: apply})
+		}
+	}
+	for _, c := range existing {
+		if listed[c.Shortcut] {
+			continue
+		}
+		shortcut := c.Shortcut
+		changes = append(changes, ConfigChange{Action: CONFIG_CHANGE_DELETE, Kind: "canned_response", Name: "/" + shortcut,
+			apply: func(tx *sql.Tx) error {
+				_, err := tx.Exec(`DELETE FROM canned_responses WHERE user_id = ? AND shortcut = ?`, userID, shortcut)
+				return err
+			}})
+	}
+	return changes, nil
+}
+
+func planAutoResponder(userID int64, desired AutoResponder) ([]ConfigChange, error) {
+	if err := validateAutoResponder(&desired); err != nil {
+		return nil, fmt.Errorf("auto_responder: %v", err)
+	}
+	current, err := dbGetAutoResponder(userID)
+	if err != nil {
+		fmt.Println("ERROR: Could not load auto-responder for config apply", err)
+		return nil, &bodyError{Status: http.StatusInternalServerError, Message: "Failed to load current config"}
+	}
+	fields := changedConfigFields(current, desired, []string{"updated_at"})
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	return []ConfigChange{{Action: CONFIG_CHANGE_UPDATE, Kind: "auto_responder", Fields: fields,
+		apply: func(tx *sql.Tx) error { return dbSetAutoResponderWith(tx, userID, desired) }}}, nil
+}
+
+// The changes that reconcile the account to a spec; validation errors are returned as is
+func planConfig(userID int64, spec ConfigSpec) ([]ConfigChange, error) {
+	changes := []ConfigChange{}
+	deletedWebhooks := map[string]bool{}
+	if spec.Webhooks != nil {
+		planned, deleted, err := planWebhooks(userID, *spec.Webhooks, spec.Verify)
+		if err != nil {
+			return nil, err
+		}
+		changes, deletedWebhooks = append(changes, planned...), deleted
+	}
+	if spec.AlertRules != nil {
+		planned, err := planAlertRules(userID, *spec.AlertRules, deletedWebhooks)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, planned...)
+	}
+	if spec.CannedResponses != nil {
+		planned, err := planCannedResponses(userID, *spec.CannedResponses)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, planned...)
+	}
+	if spec.AutoResponder != nil {
+		planned, err := planAutoResponder(userID, *spec.AutoResponder)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, planned...)
+	}
+	return changes, nil
+}
+
+func applyConfigChanges(userID int64, changes []ConfigChange) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, change := range changes {
+		if err := change.apply(tx); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("%s %s %s: %v", change.Action, change.Kind, change.ID+change.Name, err)
+		}
+	}
+	err = tx.Commit()
+	invalidateWebhooksCache(userID)
+	return err
+}
+
+// GET /api/config/apply returns the current config as a spec
+// POST /api/config/apply reconciles the account to a spec and returns the change plan
+func handleConfigApply(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(int64)
+
+	switch r.Method {
+	case "GET":
+		webhooks, err := dbListWebhooks(userID)
+		if err != nil {
+			apiError(w, "Failed to load webhooks", http.StatusInternalServerError)
+			return
+		}
+		if webhooks == nil {
+			webhooks = []Webhook{}
+		}
+		rules, err := dbListAlertRules(userID)
+		if err != nil {
+			apiError(w, "Failed to load alert rules", http.StatusInternalServerError)
+			return
+		}
+		responses, err := dbListCannedResponses(userID)
+		if err != nil {
+			apiError(w, "Failed to load canned responses", http.StatusInternalServerError)
+			return
+		}
+		autoResponder, err := dbGetAutoResponder(userID)
+		if err != nil {
+			apiError(w, "Failed to load auto-responder", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ConfigSpec{
+			Version:         CONFIG_VERSION,
+			Webhooks:        &webhooks,
+			AlertRules:      &rules,
+			CannedResponses: &responses,
+			AutoResponder:   &autoResponder,
+		})
+		return
+	case "POST":
+	default:
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var spec ConfigSpec
+	if err := decodeJSONBody(w, r, &spec); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	if spec.Version != CONFIG_VERSION {
+		apiError(w, fmt.Sprintf("Unsupported config version %d (expected %d)", spec.Version, CONFIG_VERSION), http.StatusBadRequest)
+		return
+	}
+	changes, err := planConfig(userID, spec)
+	if err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	summary := map[string]int{CONFIG_CHANGE_CREATE: 0, CONFIG_CHANGE_UPDATE: 0, CONFIG_CHANGE_DELETE: 0}
+	for i, change := range changes {
+		summary[change.Action]++
+		if spec.DryRun && change.Action == CONFIG_CHANGE_CREATE {
+			changes[i].ID = "" // Not created, so no ID yet
+		}
+	}
+	if !spec.DryRun && len(changes) > 0 {
+		if err := applyConfigChanges(userID, changes); err != nil {
+			fmt.Printf("ERROR: Config apply for user %d failed: %v\n", userID, err)
+			apiError(w, "Failed to apply config, nothing was changed", http.StatusInternalServerError)
+			return
+		}
+		fmt.Printf("INFO: Applied config for user %d: %d created, %d updated, %d deleted\n",
+			userID, summary[CONFIG_CHANGE_CREATE], summary[CONFIG_CHANGE_UPDATE], summary[CONFIG_CHANGE_DELETE])
+		// As on create, webhooks that fail the challenge stay unverified
+		for i := range changes {
+			if wh := changes[i].verify; wh != nil {
+				if err := verifyWebhook(userID, wh); err != nil {
+					changes[i].VerificationError = err.Error()
+				}
+				changes[i].Unverified = &wh.Unverified
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"dry_run": spec.DryRun,
+		"applied": !spec.DryRun && len(changes) > 0,
+		"changes": changes,
+		"summary": summary,
+	})
+}
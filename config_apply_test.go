@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type configApplyResult struct {
+	Applied bool           `json:"applied"`
+	Changes []ConfigChange `json:"changes"`
+	Summary map[string]int `json:"summary"`
+}
+
+func TestConfigApply(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+
+	_, apiKey := registerWithAPIKey(t, ts, "gitops@example.com", "gitopspass123")
+	apiRequest(t, "POST", ts.URL+"/api/webhooks/create", apiKey, map[string]interface{}{"url": "https://example.com/a", "method": "POST", "tags": []string{"crm"}}, nil)
+	apiRequest(t, "POST", ts.URL+"/api/canned-responses", apiKey, map[string]string{"shortcut": "hello", "text": "Hi!"}, nil)
+	apiRequest(t, "POST", ts.URL+"/api/canned-responses", apiKey, map[string]string{"shortcut": "old", "text": "Retired"}, nil)
+
+	spec := map[string]interface{}{
+		"version": CONFIG_VERSION,
+		"webhooks": []map[string]interface{}{
+			{"url": "https://example.com/a", "tags": []string{"crm"}, "paused": true},
+			{"url": "https://example.com/b", "filter_type": "group", "filter_value": "120363000000000001@g.us"},
+		},
+		"canned_responses": []map[string]string{{"shortcut": "hello", "text": "Hi!"}, {"shortcut": "/Thanks", "text": "Thank you"}},
+	}
+	apply := func(spec map[string]interface{}) configApplyResult {
+		t.Helper()
+		var result configApplyResult
+		if resp := apiRequest(t, "POST", ts.URL+"/api/config/apply", apiKey, spec, &result); resp.StatusCode != 200 {
+			t.Fatalf("Apply failed: %d", resp.StatusCode)
+		}
+		return result
+	}
+	plan := func(result configApplyResult) map[string]bool {
+		steps := map[string]bool{}
+		for _, c := range result.Changes {
+			steps[fmt.Sprintf("%s %s %s %v", c.Action, c.Kind, c.Name, c.Fields)] = true
+		}
+		return steps
+	}
+
+	// A dry run only plans
+	spec["dry_run"] = true
+	result := apply(spec)
+	steps := plan(result)
+	for _, want := range []string{
+		"update webhook https://example.com/a [paused]",
+		"create webhook https://example.com/b []",
+		"create canned_response /thanks []",
+		"delete canned_response /old []",
+	} {
+		if !steps[want] {
+			t.Errorf("Missing %q in plan %v", want, steps)
+		}
+	}
+	if result.Applied || len(result.Changes) != 4 || result.Summary["create"] != 2 {
+		t.Fatalf("Unexpected dry run: %+v", result)
+	}
+	var current ConfigSpec
+	apiRequest(t, "GET", ts.URL+"/api/config/apply", apiKey, nil, &current)
+	if len(*current.Webhooks) != 1 || len(*current.CannedResponses) != 2 {
+		t.Fatalf("Dry run changed the config: %+v", current)
+	}
+
+	delete(spec, "dry_run")
+	if result := apply(spec); !result.Applied || len(result.Changes) != 4 {
+		t.Fatalf("Unexpected apply: %+v", result)
+	}
+	apiRequest(t, "GET", ts.URL+"/api/config/apply", apiKey, nil, &current)
+	if len(*current.Webhooks) != 2 || len(*current.CannedResponses) != 2 {
+		t.Fatalf("Config not applied: %+v", current)
+	}
+
+	// Applying the same spec, or the current config, changes nothing
+	if result := apply(spec); result.Applied || len(result.Changes) != 0 {
+		t.Fatalf("Expected no changes on re-apply, got %+v", result.Changes)
+	}
+	var exported map[string]interface{}
+	apiRequest(t, "GET", ts.URL+"/api/config/apply", apiKey, nil, &exported)
+	if result := apply(exported); len(result.Changes) != 0 {
+		t.Fatalf("Expected no changes applying the current config, got %+v", result.Changes)
+	}
+
+	// An empty section deletes everything in it; a missing one is left alone
+	result = apply(map[string]interface{}{"version": CONFIG_VERSION, "webhooks": []interface{}{}})
+	if result.Summary["delete"] != 2 || len(result.Changes) != 2 {
+		t.Fatalf("Expected both webhooks deleted, got %+v", result)
+	}
+	apiRequest(t, "GET", ts.URL+"/api/config/apply", apiKey, nil, &current)
+	if len(*current.Webhooks) != 0 || len(*current.CannedResponses) != 2 {
+		t.Fatalf("Unexpected config after deleting webhooks: %+v", current)
+	}
+
+	for _, bad := range []map[string]interface{}{
+		{"version": 2},
+		{"version": CONFIG_VERSION, "webhooks": []map[string]interface{}{{"id": "missing", "url": "https://example.com/a"}}},
+		{"version": CONFIG_VERSION, "webhooks": []map[string]interface{}{{"url": "https://example.com/a"}, {"url": "https://example.com/a"}}},
+		{"version": CONFIG_VERSION, "canned_responses": []map[string]string{{"shortcut": "bad shortcut", "text": "x"}}},
+	} {
+		if resp := apiRequest(t, "POST", ts.URL+"/api/config/apply", apiKey, bad, nil); resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("Expected 400 for %v, got %d", bad, resp.StatusCode)
+		}
+	}
+}
+
+func TestConfigApplyVerifiesAndDeletesWebhooks(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+
+	_, apiKey := registerWithAPIKey(t, ts, "gitverify@example.com", "gitverifypass123")
+	userID, _ := getUserIDByEmail("gitverify@example.com")
+	dest := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})) // Doesn't echo
+	defer dest.Close()
+
+	var result configApplyResult
+	spec := map[string]interface{}{"version": CONFIG_VERSION, "verify": true, "webhooks": []map[string]interface{}{{"url": dest.URL}}}
+	if resp := apiRequest(t, "POST", ts.URL+"/api/config/apply", apiKey, spec, &result); resp.StatusCode != 200 || len(result.Changes) != 1 {
+		t.Fatalf("Apply failed: %d %+v", resp.StatusCode, result)
+	}
+	created := result.Changes[0]
+	if created.Unverified == nil || !*created.Unverified || created.VerificationError == "" {
+		t.Fatalf("Expected the created webhook to fail verification: %+v", created)
+	}
+	if wh, err := dbGetWebhook(userID, created.ID); err != nil || !wh.Unverified {
+		t.Fatalf("Expected the webhook to be stored unverified: %+v %v", wh, err)
+	}
+
+	// Deleting it also drops its buffered payloads
+	db.Exec(`INSERT INTO webhook_buffer (user_id, webhook_id, payload, created_at) VALUES (?, ?, '{}', ?)`, userID, created.ID, time.Now().Unix())
+	spec = map[string]interface{}{"version": CONFIG_VERSION, "webhooks": []map[string]interface{}{}}
+	if resp := apiRequest(t, "POST", ts.URL+"/api/config/apply", apiKey, spec, nil); resp.StatusCode != 200 {
+		t.Fatalf("Apply failed: %d", resp.StatusCode)
+	}
+	var buffered int
+	db.QueryRow(`SELECT COUNT(*) FROM webhook_buffer WHERE webhook_id = ?`, created.ID).Scan(&buffered)
+	if buffered != 0 {
+		t.Fatalf("Expected the buffered payloads to be deleted, got %d", buffered)
+	}
+}
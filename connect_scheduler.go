@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	mathrand "math/rand"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// --- WhatsApp connect scheduling ---
+// When many users connect at once (say everyone after a restart), opening all their
+// sockets together trips WhatsApp's server-side limits. Connections are started one
+// at a time instead, WA_CONNECT_INTERVAL plus up to WA_CONNECT_JITTER apart, and at
+// most WA_MAX_PAIRING QR pairing flows run at once; further ones wait for a slot.
+// A user can ask to connect once per WA_CONNECT_COOLDOWN.
+
+const (
+	DEFAULT_WA_CONNECT_INTERVAL = 250 * time.Millisecond
+	DEFAULT_WA_CONNECT_JITTER   = 500 * time.Millisecond
+	DEFAULT_WA_MAX_PAIRING      = 10
+	WA_CONNECT_COOLDOWN         = 10 * time.Second
+)
+
+var (
+	waConnectInterval = DEFAULT_WA_CONNECT_INTERVAL
+	waConnectJitter   = DEFAULT_WA_CONNECT_JITTER
+	pairingSlots      = make(chan struct{}, DEFAULT_WA_MAX_PAIRING)
+)
+
+var waConnects = struct {
+	sync.Mutex
+	next        time.Time                // Earliest start of the next connection
+	waiting     map[string]chan struct{} // Scheduled, not started yet; closed to cancel
+	lastRequest map[string]time.Time     // For the per-user cooldown
+}{waiting: make(map[string]chan struct{}), lastRequest: make(map[string]time.Time)}
+
+// Read WA_CONNECT_INTERVAL, WA_CONNECT_JITTER and WA_MAX_PAIRING; invalid values keep
+// the default
+func initWAConnects() {
+	waConnectInterval, waConnectJitter = DEFAULT_WA_CONNECT_INTERVAL, DEFAULT_WA_CONNECT_JITTER
+	for env, d := range map[string]*time.Duration{
+		"WA_CONNECT_INTERVAL": &waConnectInterval,
+		"WA_CONNECT_JITTER":   &waConnectJitter,
+	} {
+		value := os.Getenv(env)
+		if value == "" {
+			continue
+		}
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed < 0 {
+			fmt.Printf("WARNING: Ignoring %s=%q, expected a duration like 500ms\n", env, value)
+			continue
+		}
+		*d = parsed
+	}
+	maxPairing := DEFAULT_WA_MAX_PAIRING
+	if value := os.Getenv("WA_MAX_PAIRING"); value != "" {
+		if n, err := strconv.Atoi(value); err == nil && n >= 1 {
+			maxPairing = n
+		} else {
+			fmt.Printf("WARNING: Ignoring WA_MAX_PAIRING=%q, expected a positive number\n", value)
+		}
+	}
+	pairingSlots = make(chan struct{}, maxPairing)
+
+	waConnects.Lock()
+	waConnects.next = time.Time{}
+	waConnects.waiting = make(map[string]chan struct{})
+	waConnects.lastRequest = make(map[string]time.Time)
+	waConnects.Unlock()
+}
+
+// How long until the user may ask to connect again; 0 if they may now, which also
+// starts a new cooldown
+func waConnectCooldown(email string, now time.Time) time.Duration {
+	waConnects.Lock()
+	defer waConnects.Unlock()
+	if wait := waConnects.lastRequest[email].Add(WA_CONNECT_COOLDOWN).Sub(now); wait > 0 {
+		return wait
+	}
+	waConnects.lastRequest[email] = now
+	return 0
+}
+
+// Run connect in the next free start slot. Returns false if the user is already
+// waiting for one.
+func scheduleWAConnect(email string, connect func()) bool {
+	waConnects.Lock()
+	if _, ok := waConnects.waiting[email]; ok {
+		waConnects.Unlock()
+		return false
+	}
+	now := time.Now()
+	start := waConnects.next
+	if start.Before(now) {
+		start = now
+	}
+	spacing := waConnectInterval
+	if waConnectJitter > 0 {
+		spacing += time.Duration(mathrand.Int63n(int64(waConnectJitter)))
+	}
+	waConnects.next = start.Add(spacing)
+	cancelled := make(chan struct{})
+	waConnects.waiting[email] = cancelled
+	waConnects.Unlock()
+
+	wait := start.Sub(now)
+	if wait > 0 {
+		setUserWAStatus(email, "connecting")
+		updateUserLoginState(email, fmt.Sprintf("Waiting to connect (about %ds)...", int(wait.Seconds()+0.5)))
+	}
+	go func() {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-cancelled:
+			return
+		}
+		waConnects.Lock()
+		if waConnects.waiting[email] != cancelled {
+			waConnects.Unlock()
+			return
+		}
+		delete(waConnects.waiting, email)
+		waConnects.Unlock()
+		connect()
+	}()
+	return true
+}
+
+// Drop a connection that hasn't started yet
+func cancelScheduledWAConnect(email string) {
+	waConnects.Lock()
+	defer waConnects.Unlock()
+	if cancelled, ok := waConnects.waiting[email]; ok {
+		close(cancelled)
+		delete(waConnects.waiting, email)
+	}
+}
+
+// Wait for one of the WA_MAX_PAIRING pairing slots; the returned func frees it
+func acquirePairingSlot(ctx context.Context, email string) (func(), error) {
+	slots := pairingSlots
+	select {
+	case slots <- struct{}{}:
+	default:
+		fmt.Printf("INFO: Pairing of %s waits for one of %d slots\n", email, cap(slots))
+		updateUserLoginState(email, "Waiting for a free pairing slot...")
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	var once sync.Once
+	return func() { once.Do(func() { <-slots }) }, nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWAConnectScheduler(t *testing.T) {
+	t.Cleanup(initWAConnects)
+	t.Setenv("WA_CONNECT_INTERVAL", "100ms")
+	t.Setenv("WA_CONNECT_JITTER", "0s")
+	t.Setenv("WA_MAX_PAIRING", "1")
+	initWAConnects()
+
+	// Connections start one at a time, spaced by the interval
+	var mu sync.Mutex
+	started := map[string]time.Time{}
+	done := make(chan string, 4)
+	connect := func(email string) func() {
+		return func() {
+			mu.Lock()
+			started[email] = time.Now()
+			mu.Unlock()
+			done <- email
+		}
+	}
+	users := []string{"first@example.com", "second@example.com", "cancelled@example.com", "third@example.com"}
+	for _, email := range users {
+		if !scheduleWAConnect(email, connect(email)) {
+			t.Fatalf("Expected %s to be scheduled", email)
+		}
+	}
+	if scheduleWAConnect("second@example.com", connect("second@example.com")) {
+		t.Fatal("Expected a user already waiting not to be scheduled twice")
+	}
+	if status := getUserWAStatus("third@example.com"); status != "connecting" {
+		t.Fatalf("Expected a waiting user to show as connecting, got %s", status)
+	}
+	cancelScheduledWAConnect("cancelled@example.com")
+	for i := 0; i < 3; i++ {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for the scheduled connections")
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := started["cancelled@example.com"]; ok {
+		t.Fatal("A cancelled connection was started")
+	}
+	if gap := started["second@example.com"].Sub(started["first@example.com"]); gap < 90*time.Millisecond {
+		t.Fatalf("Expected connections at least the interval apart, got %s", gap)
+	}
+	if gap := started["third@example.com"].Sub(started["first@example.com"]); gap < 290*time.Millisecond {
+		t.Fatalf("Expected the cancelled slot to still be waited out, got %s", gap)
+	}
+
+	// One connect request per user per cooldown
+	now := time.Now()
+	if waConnectCooldown("first@example.com", now) != 0 {
+		t.Fatal("Expected the first connect request to be allowed")
+	}
+	if wait := waConnectCooldown("first@example.com", now.Add(time.Second)); wait != WA_CONNECT_COOLDOWN-time.Second {
+		t.Fatalf("Expected to wait out the cooldown, got %s", wait)
+	}
+	if waConnectCooldown("first@example.com", now.Add(WA_CONNECT_COOLDOWN)) != 0 {
+		t.Fatal("Expected a connect request after the cooldown to be allowed")
+	}
+
+	// Pairing flows beyond WA_MAX_PAIRING wait for a slot
+	release, err := acquirePairingSlot(context.Background(), "first@example.com")
+	if err != nil {
+		t.Fatalf("Expected a free pairing slot: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := acquirePairingSlot(ctx, "second@example.com"); err == nil {
+		t.Fatal("Expected the second pairing flow to wait")
+	}
+	release()
+	release() // Freeing twice is harmless
+	if release, err := acquirePairingSlot(context.Background(), "second@example.com"); err != nil {
+		t.Fatalf("Expected the freed slot: %v", err)
+	} else {
+		release()
+	}
+}
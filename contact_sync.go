@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/appstate"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// --- Contact sync ---
+// Contact names come from WhatsApp's app state, which a newly paired device doesn't
+// have yet, so chats show up as bare numbers. On connect with an empty contact store,
+// every app state patch is fetched in full. Patches whose keys haven't arrived from the
+// phone yet are fetched by whatsmeow once they do; the sync waits for those, then
+// copies the contacts into the contacts table. Progress is part of /api/wa/status.
+
+const (
+	CONTACT_SYNC_SYNCING = "syncing"
+	CONTACT_SYNC_DONE    = "done"
+	CONTACT_SYNC_FAILED  = "failed"
+
+	CONTACT_SYNC_TIMEOUT = 2 * time.Minute
+)
+
+type ContactSync struct {
+	Status     string     `json:"status"`
+	Synced     int        `json:"synced"` // App state patches fetched
+	Total      int        `json:"total"`
+	Contacts   int        `json:"contacts"` // Contacts stored when done
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	pending    map[appstate.WAPatchName]bool
+}
+
+var contactSyncs = map[string]*ContactSync{}
+var contactSyncMu sync.Mutex
+
+// Fetch one app state patch in full; a variable so tests can stub out WhatsApp
+var fetchAppState = func(ctx context.Context, client *whatsmeow.Client, name appstate.WAPatchName) error {
+	return client.FetchAppState(ctx, name, true, false)
+}
+
+// Progress of a user's last contact sync, if any
+func getContactSync(email string) *ContactSync {
+	contactSyncMu.Lock()
+	defer contactSyncMu.Unlock()
+	s, ok := contactSyncs[email]
+	if !ok {
+		return nil
+	}
+	copied := *s
+	copied.pending = nil
+	return &copied
+}
+
+// Handle the client events the contact sync cares about
+func handleContactSyncEvent(email string, client *whatsmeow.Client, evt interface{}) {
+	switch v := evt.(type) {
+	case *events.Connected:
+		contacts, err := client.Store.Contacts.GetAllContacts(context.Background())
+		if err == nil && len(contacts) == 0 {
+			go runContactSync(email, client)
+		}
+	case *events.AppStateSyncComplete:
+		contactSyncPatchDone(email, v.Name)
+	}
+}
+
+func contactSyncPatchDone(email string, name appstate.WAPatchName) {
+	contactSyncMu.Lock()
+	defer contactSyncMu.Unlock()
+	if s, ok := contactSyncs[email]; ok && s.pending[name] {
+		delete(s.pending, name)
+		s.Synced = s.Total - len(s.pending)
+	}
+}
+
+// Fetch all app state for a user and wait for it, then refresh their contacts table
+func runContactSync(email string, client *whatsmeow.Client) {
+	contactSyncMu.Lock()
+	if s, ok := contactSyncs[email]; ok && s.Status == CONTACT_SYNC_SYNCING {
+		contactSyncMu.Unlock()
+		return
+	}
+	s := &ContactSync{Status: CONTACT_SYNC_SYNCING, Total: len(appstate.AllPatchNames), StartedAt: time.Now().UTC(), pending: map[appstate.WAPatchName]bool{}}
+	for _, name := range appstate.AllPatchNames {
+		s.pending[name] = true
+	}
+	contactSyncs[email] = s
+	contactSyncMu.Unlock()
+	fmt.Println("INFO: Syncing WhatsApp contacts for", email)
+
+	ctx, cancel := context.WithTimeout(context.Background(), CONTACT_SYNC_TIMEOUT)
+	defer cancel()
+	var fetchErr error
+	for _, name := range appstate.AllPatchNames {
+		err := fetchAppState(ctx, client, name)
+		if err == nil {
+			contactSyncPatchDone(email, name)
+		} else if errors.Is(err, appstate.ErrKeyNotFound) {
+			fmt.Printf("DEBUG: App state %s for %s waits for keys from the phone\n", name, email)
+		} else {
+			fmt.Printf("ERROR: Could not sync app state %s for %s: %v\n", name, email, err)
+			fetchErr = err
+		}
+	}
+
+	// The rest arrives when the phone shares its keys
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for contactSyncPending(email) > 0 && ctx.Err() == nil {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+		}
+	}
+
+	count, err := refreshContactsCache(email, client)
+	now := time.Now().UTC()
+	contactSyncMu.Lock()
+	s.FinishedAt = &now
+	s.Contacts = count
+	switch {
+	case err != nil:
+		s.Status, s.Error = CONTACT_SYNC_FAILED, err.Error()
+	case len(s.pending) > 0:
+		// Store whatever did arrive; the missing patches may still come later
+		s.Status, s.Error = CONTACT_SYNC_FAILED, fmt.Sprintf("Timed out waiting for %d of %d app state patches", len(s.pending), s.Total)
+	case fetchErr != nil:
+		s.Status, s.Error = CONTACT_SYNC_DONE, fetchErr.Error()
+	default:
+		s.Status = CONTACT_SYNC_DONE
+	}
+	status := s.Status
+	contactSyncMu.Unlock()
+	fmt.Printf("INFO: Contact sync for %s %s with %d contacts\n", email, status, count)
+}
+
+func contactSyncPending(email string) int {
+	contactSyncMu.Lock()
+	defer contactSyncMu.Unlock()
+	if s, ok := contactSyncs[email]; ok {
+		return len(s.pending)
+	}
+	return 0
+}
+
+// Display name of a contact: the saved name, then the first name, push name or business name
+func contactDisplayName(contact types.ContactInfo) string {
+	for _, name := range []string{contact.FullName, contact.FirstName, contact.PushName, contact.BusinessName} {
+		if name != "" {
+			return name
+		}
+	}
+	return ""
+}
+
+// Replace a user's contacts table with the client's contact store
+func refreshContactsCache(email string, client *whatsmeow.Client) (int, error) {
+	userID, err := getUserIDByEmail(email)
+	if err != nil {
+		return 0, err
+	}
+	contacts, err := client.Store.Contacts.GetAllContacts(context.Background())
+	if err != nil {
+		return 0, err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM contacts WHERE user_id = ?`, userID); err != nil {
+		return 0, err
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	count := 0
+	for jid, contact := range contacts {
+		if jid.Server != types.DefaultUserServer {
+			continue
+		}
+		_, err := tx.Exec(`INSERT INTO contacts (user_id, jid, name, full_name, first_name, push_name, business_name, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			userID, jid.String(), contactDisplayName(contact), contact.FullName, contact.FirstName, contact.PushName, contact.BusinessName, now)
+		if err != nil {
+			return 0, err
+		}
+		count++
+	}
+	return count, tx.Commit()
+}
+
+// A contact's name from the contacts table, or "" if unknown
+func dbGetContactName(userID int64, jid string) string {
+	var name string
+	if err := db.QueryRow(`SELECT name FROM contacts WHERE user_id = ? AND jid = ?`, userID, jid).Scan(&name); err != nil && err != sql.ErrNoRows {
+		fmt.Println("ERROR: Could not look up contact name", err)
+	}
+	return name
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/appstate"
+	"go.mau.fi/whatsmeow/store"
+	"go.mau.fi/whatsmeow/store/sqlstore"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+func TestContactSync(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+
+	email := "contacts@example.com"
+	registerWithAPIKey(t, ts, email, "contactspass123")
+	userID, _ := getUserIDByEmail(email)
+
+	ctx := context.Background()
+	container, err := sqlstore.New(ctx, "sqlite", "file:contact_sync_test?mode=memory&_pragma=foreign_keys(1)", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer container.Close()
+	device := container.NewDevice()
+	jid := types.NewJID("14155550100", types.DefaultUserServer)
+	device.ID = &jid
+	device.Account = testDeviceAccount()
+	if err := container.PutDevice(ctx, device); err != nil {
+		t.Fatal(err)
+	}
+	client := whatsmeow.NewClient(device, nil)
+	defer func() {
+		contactSyncMu.Lock()
+		delete(contactSyncs, email)
+		contactSyncMu.Unlock()
+		waUsers.mu.Lock()
+		delete(waUsers.data, email)
+		waUsers.mu.Unlock()
+	}()
+
+	// The contact patch has to wait for keys from the phone; the others arrive at once
+	ann := types.NewJID("14155550101", types.DefaultUserServer)
+	fetched := make(chan appstate.WAPatchName, len(appstate.AllPatchNames))
+	fetchAppState = func(ctx context.Context, client *whatsmeow.Client, name appstate.WAPatchName) error {
+		fetched <- name
+		if name == appstate.WAPatchCriticalUnblockLow {
+			return fmt.Errorf("failed to decode app state %s patches: %w", name, appstate.ErrKeyNotFound)
+		}
+		return nil
+	}
+	defer func() {
+		fetchAppState = func(ctx context.Context, client *whatsmeow.Client, name appstate.WAPatchName) error {
+			return client.FetchAppState(ctx, name, true, false)
+		}
+	}()
+
+	handleContactSyncEvent(email, client, &events.Connected{})
+	for range appstate.AllPatchNames {
+		select {
+		case <-fetched:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Expected every app state patch to be fetched")
+		}
+	}
+	sync := getContactSync(email)
+	if sync == nil || sync.Status != CONTACT_SYNC_SYNCING || sync.Synced != sync.Total-1 {
+		t.Fatalf("Expected the sync to wait for one patch, got %+v", sync)
+	}
+	if status := userWAStatusResponse(email); status["contact_sync"] == nil {
+		t.Fatalf("Expected sync progress in the status, got %v", status)
+	}
+
+	// whatsmeow fetches it once the keys arrive
+	client.Store.Contacts.PutAllContactNames(ctx, []store.ContactEntry{{JID: ann, FirstName: "Ann", FullName: "Ann Lee"}})
+	handleContactSyncEvent(email, client, &events.AppStateSyncComplete{Name: appstate.WAPatchCriticalUnblockLow})
+	deadline := time.Now().Add(3 * time.Second)
+	for sync = getContactSync(email); sync.Status == CONTACT_SYNC_SYNCING && time.Now().Before(deadline); sync = getContactSync(email) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if sync.Status != CONTACT_SYNC_DONE || sync.Synced != sync.Total || sync.Contacts != 1 || sync.FinishedAt == nil {
+		t.Fatalf("Expected a finished sync with 1 contact, got %+v", sync)
+	}
+	if name := dbGetContactName(userID, ann.String()); name != "Ann Lee" {
+		t.Fatalf("Expected the contacts table to have Ann Lee, got %q", name)
+	}
+	if vars := cannedResponseVars(userID, ann.String()); vars["name"] != "Ann Lee" {
+		t.Fatalf("Expected {{name}} from the contacts table, got %q", vars["name"])
+	}
+
+	// With contacts in the store, connecting again doesn't sync
+	handleContactSyncEvent(email, client, &events.Connected{})
+	select {
+	case name := <-fetched:
+		t.Fatalf("Expected no sync with contacts stored, fetched %s", name)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
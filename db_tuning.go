@@ -0,0 +1,163 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"os"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// --- SQLite tuning ---
+// The dashboard DB runs in WAL mode, so reads don't block the writer or each other.
+// Writes go through db, whose transactions take the write lock up front
+// (_txlock=immediate) so two of them can't deadlock upgrading from a read; a write
+// that finds the lock taken waits up to DB_BUSY_TIMEOUT instead of failing with
+// "database is locked". The hot read paths (forwarding a message, session and API key
+// lookups) use readDB, a pool of query_only connections, and the statements they run
+// for every message or request are prepared once and reused.
+//
+// DB_READ_CONNECTIONS: size of the read pool (default: the number of CPUs, at least 4)
+// DB_BUSY_TIMEOUT: how long a write waits for the lock, as a Go duration (default 5s)
+
+const (
+	DB_WRITE_CONNECTIONS    = 4 // Writes are serialized by SQLite; a few connections let reads in a write path proceed
+	DEFAULT_DB_BUSY_TIMEOUT = 5 * time.Second
+)
+
+var readDB *sql.DB
+
+// Prepared statements, per pool and query
+var preparedStmts = struct {
+	sync.Mutex
+	data map[preparedKey]*sql.Stmt
+}{data: make(map[preparedKey]*sql.Stmt)}
+
+type preparedKey struct {
+	pool  *sql.DB
+	query string
+}
+
+func dbBusyTimeout() time.Duration {
+	if value := os.Getenv("DB_BUSY_TIMEOUT"); value != "" {
+		if d, err := time.ParseDuration(value); err == nil && d >= 0 {
+			return d
+		}
+		fmt.Printf("WARNING: Ignoring DB_BUSY_TIMEOUT=%q, expected a duration like 5s\n", value)
+	}
+	return DEFAULT_DB_BUSY_TIMEOUT
+}
+
+func dbReadConnections() int {
+	n := max(runtime.NumCPU(), 4)
+	if value := os.Getenv("DB_READ_CONNECTIONS"); value != "" {
+		if v, err := strconv.Atoi(value); err == nil && v > 0 {
+			return v
+		}
+		fmt.Printf("WARNING: Ignoring DB_READ_CONNECTIONS=%q, expected a positive number\n", value)
+	}
+	return n
+}
+
+// Connection string with the pragmas every connection of a pool gets. The path is
+// escaped, since a "?" or "#" in it would otherwise end the file name of the URI.
+func sqliteDSN(dbPath string, readOnly bool) string {
+	dsn := fmt.Sprintf("file:%s?_pragma=busy_timeout(%d)&_pragma=synchronous(NORMAL)&_pragma=temp_store(MEMORY)&_pragma=cache_size(-8000)",
+		(&url.URL{Path: dbPath}).EscapedPath(), dbBusyTimeout().Milliseconds())
+	if readOnly {
+		return dsn + "&_pragma=query_only(1)"
+	}
+	return dsn + "&_pragma=journal_mode(WAL)&_txlock=immediate"
+}
+
+// Open the write and read pools, closing any opened before (tests start the server repeatedly)
+func openDB(dbPath string) error {
+	closeDB()
+	var err error
+	db, err = sql.Open("sqlite", sqliteDSN(dbPath, false))
+	if err != nil {
+		return err
+	}
+	db.SetMaxOpenConns(DB_WRITE_CONNECTIONS)
+	db.SetMaxIdleConns(DB_WRITE_CONNECTIONS)
+	// Switch the file to WAL before the read pool opens it
+	var mode string
+	if err := db.QueryRow(`PRAGMA journal_mode`).Scan(&mode); err != nil {
+		return err
+	}
+	if mode != "wal" {
+		fmt.Printf("WARNING: SQLite journal mode is %s, not WAL; reads and writes will block each other\n", mode)
+	}
+
+	readDB, err = sql.Open("sqlite", sqliteDSN(dbPath, true))
+	if err != nil {
+		return err
+	}
+	n := dbReadConnections()
+	readDB.SetMaxOpenConns(n)
+	readDB.SetMaxIdleConns(n)
+	return nil
+}
+
+func closeDB() {
+	preparedStmts.Lock()
+	for key, stmt := range preparedStmts.data {
+		stmt.Close()
+		delete(preparedStmts.data, key)
+	}
+	preparedStmts.Unlock()
+	// The closed pools stay assigned, so a goroutine still running from before gets
+	// "database is closed" instead of a nil pointer
+	for _, pool := range []*sql.DB{db, readDB} {
+		if pool != nil {
+			pool.Close()
+		}
+	}
+}
+
+// A statement prepared once per pool and reused; for queries run on every message or request
+func prepared(pool *sql.DB, query string) (*sql.Stmt, error) {
+	key := preparedKey{pool, query}
+	preparedStmts.Lock()
+	defer preparedStmts.Unlock()
+	if stmt, ok := preparedStmts.data[key]; ok {
+		return stmt, nil
+	}
+	stmt, err := pool.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	preparedStmts.data[key] = stmt
+	return stmt, nil
+}
+
+// QueryRow with a reused statement
+func preparedQueryRow(pool *sql.DB, query string, args ...interface{}) *sql.Row {
+	stmt, err := prepared(pool, query)
+	if err != nil {
+		// Let the caller see the error when it scans
+		return pool.QueryRow(query, args...)
+	}
+	return stmt.QueryRow(args...)
+}
+
+// Query with a reused statement
+func preparedQuery(pool *sql.DB, query string, args ...interface{}) (*sql.Rows, error) {
+	stmt, err := prepared(pool, query)
+	if err != nil {
+		return nil, err
+	}
+	return stmt.Query(args...)
+}
+
+// Exec with a reused statement
+func preparedExec(pool *sql.DB, query string, args ...interface{}) (sql.Result, error) {
+	stmt, err := prepared(pool, query)
+	if err != nil {
+		return nil, err
+	}
+	return stmt.Exec(args...)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestSQLiteTuning(t *testing.T) {
+	_, teardown := setupTestServer()
+	defer teardown()
+
+	var mode string
+	if err := db.QueryRow(`PRAGMA journal_mode`).Scan(&mode); err != nil || mode != "wal" {
+		t.Fatalf("Expected WAL mode, got %q (%v)", mode, err)
+	}
+	if _, err := readDB.Exec(`INSERT INTO users (email, password_hash) VALUES ('ro@example.com', 'x')`); err == nil {
+		t.Fatal("The read pool should refuse writes")
+	}
+
+	first, err := prepared(readDB, `SELECT id FROM users WHERE email = ?`)
+	if err != nil {
+		t.Fatalf("Prepare failed: %v", err)
+	}
+	if again, _ := prepared(readDB, `SELECT id FROM users WHERE email = ?`); again != first {
+		t.Fatal("Expected the prepared statement to be reused")
+	}
+
+	// Concurrent writers and readers, as when group traffic is archived while handlers run
+	var wg sync.WaitGroup
+	errs := make(chan error, 200)
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				email := fmt.Sprintf("load%d-%d@example.com", i, j)
+				tx, err := db.Begin()
+				if err != nil {
+					errs <- err
+					return
+				}
+				if _, err := tx.Exec(`INSERT INTO users (email, password_hash) VALUES (?, 'x')`, email); err != nil {
+					tx.Rollback()
+					errs <- err
+					return
+				}
+				if err := tx.Commit(); err != nil {
+					errs <- err
+				}
+			}
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				if _, err := getUserIDByEmail(fmt.Sprintf("load%d-%d@example.com", i, j)); err != nil && err != sql.ErrNoRows {
+					errs <- err
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("Concurrent access failed: %v", err)
+	}
+	var count int
+	db.QueryRow(`SELECT COUNT(*) FROM users WHERE email LIKE 'load%'`).Scan(&count)
+	if count != 100 {
+		t.Fatalf("Expected 100 users, got %d", count)
+	}
+}
+
+func TestSQLiteDSNEscapesPath(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "what?#%20.db")
+	conn, err := sql.Open("sqlite", sqliteDSN(path, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Exec(`CREATE TABLE t (x INTEGER)`); err != nil {
+		t.Fatalf("Could not open %s: %v", path, err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("Expected the database at %s: %v", path, err)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/proto/waCompanionReg"
+	"go.mau.fi/whatsmeow/proto/waWa6"
+	"go.mau.fi/whatsmeow/store"
+	"go.mau.fi/whatsmeow/store/sqlstore"
+	"google.golang.org/protobuf/proto"
+)
+
+// --- WhatsApp device properties ---
+// The name and platform in WhatsApp's linked devices list are sent once, when pairing,
+// so they can only be changed while the user has no paired device (before the first
+// connect or after logging out). Defaults come from WA_DEVICE_NAME and
+// WA_DEVICE_PLATFORM, falling back to whatsmeow's.
+
+const MAX_DEVICE_NAME_LENGTH = 50
+
+type WADeviceProps struct {
+	Name      string     `json:"name"`
+	Platform  string     `json:"platform"` // e.g. "chrome", "desktop"; see /api/wa/device-props
+	Paired    bool       `json:"paired"`   // Read-only: changes apply to the next pairing
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+}
+
+func defaultWADeviceProps() WADeviceProps {
+	return WADeviceProps{
+		Name:     getEnv("WA_DEVICE_NAME", store.DeviceProps.GetOs()),
+		Platform: strings.ToLower(getEnv("WA_DEVICE_PLATFORM", store.DeviceProps.GetPlatformType().String())),
+	}
+}
+
+// Platform names accepted in settings, lowercase
+func waDevicePlatforms() []string {
+	var names []string
+	for name := range waCompanionReg.DeviceProps_PlatformType_value {
+		names = append(names, strings.ToLower(name))
+	}
+	sort.Strings(names)
+	return names
+}
+
+func validateWADeviceProps(p *WADeviceProps) error {
+	p.Name = strings.TrimSpace(p.Name)
+	if p.Name == "" || len(p.Name) > MAX_DEVICE_NAME_LENGTH {
+		return fmt.Errorf("name must be 1 to %d characters", MAX_DEVICE_NAME_LENGTH)
+	}
+	p.Platform = strings.ToLower(strings.TrimSpace(p.Platform))
+	if p.Platform == "" {
+		p.Platform = defaultWADeviceProps().Platform
+	}
+	if _, ok := waCompanionReg.DeviceProps_PlatformType_value[strings.ToUpper(p.Platform)]; !ok {
+		return fmt.Errorf("platform must be one of %s", strings.Join(waDevicePlatforms(), ", "))
+	}
+	return nil
+}
+
+func dbGetWADeviceProps(userID int64) (WADeviceProps, error) {
+	p := defaultWADeviceProps()
+	var updatedAt string
+	err := db.QueryRow(`SELECT name, platform, updated_at FROM wa_device_props WHERE user_id = ?`, userID).Scan(&p.Name, &p.Platform, &updatedAt)
+	if err == sql.ErrNoRows {
+		return p, nil
+	} else if err != nil {
+		return p, err
+	}
+	if t, err := time.Parse(time.RFC3339, updatedAt); err == nil {
+		p.UpdatedAt = &t
+	}
+	return p, nil
+}
+
+func dbSetWADeviceProps(userID int64, p WADeviceProps) error {
+	_, err := db.Exec(`INSERT INTO wa_device_props (user_id, name, platform, updated_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT(user_id) DO UPDATE SET name = excluded.name, platform = excluded.platform, updated_at = excluded.updated_at`,
+		userID, p.Name, p.Platform, time.Now().UTC().Format(time.RFC3339))
+	return err
+}
+
+// Pair a new client with the user's device properties instead of whatsmeow's global ones
+func applyWADeviceProps(client *whatsmeow.Client, email string) {
+	userID, err := getUserIDByEmail(email)
+	if err != nil {
+		return
+	}
+	p, err := dbGetWADeviceProps(userID)
+	if err != nil {
+		fmt.Println("ERROR: Could not load device properties for", email, err)
+		return
+	}
+	props := proto.Clone(store.DeviceProps).(*waCompanionReg.DeviceProps)
+	props.Os = proto.String(p.Name)
+	props.PlatformType = waCompanionReg.DeviceProps_PlatformType(waCompanionReg.DeviceProps_PlatformType_value[strings.ToUpper(p.Platform)]).Enum()
+	encoded, err := proto.Marshal(props)
+	if err != nil {
+		return
+	}
+	client.GetClientPayload = func() *waWa6.ClientPayload {
+		payload := client.Store.GetClientPayload()
+		if payload.DevicePairingData != nil {
+			payload.DevicePairingData.DeviceProps = encoded
+		}
+		return payload
+	}
+}
+
+// Whether the user has a paired WhatsApp device, without creating a session file
+func userDevicePaired(email, waSessionPrefix string) (bool, error) {
+	if waStoreMode != WA_STORE_PER_USER {
+		userID, err := getUserIDByEmail(email)
+		if err != nil {
+			return false, err
+		}
+		_, ok, err := dbGetUserDeviceJID(userID)
+		return ok, err
+	}
+	sessionFile := sessionFilePath(email, waSessionPrefix)
+	if _, err := os.Stat(sessionFile); os.IsNotExist(err) {
+		return false, nil
+	}
+	ctx := context.Background()
+	container, err := sqlstore.New(ctx, "sqlite", sqliteStoreAddress(sessionFile), nil)
+	if err != nil {
+		return false, err
+	}
+	defer container.Close()
+	device, err := container.GetFirstDevice(ctx)
+	if err != nil {
+		return false, err
+	}
+	return device.ID != nil, nil
+}
+
+// GET/POST /api/wa/device-props
+// POST sets {"name", "platform"} for the next pairing; 409 while a device is paired.
+func handleWADeviceProps(waSessionPrefix string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := r.Context().Value("userID").(int64)
+		email := getUserEmailByID(userID)
+		paired, err := userDevicePaired(email, waSessionPrefix)
+		if err != nil {
+			fmt.Println("ERROR: Could not check for a paired device", err)
+			apiError(w, "Failed to load the WhatsApp session", http.StatusInternalServerError)
+			return
+		}
+
+		switch r.Method {
+		case "GET":
+		case "POST":
+			if paired {
+				writeAPIError(w, http.StatusConflict, ERR_CONFLICT, "Device properties are sent when pairing; log out of WhatsApp first to change them")
+				return
+			}
+			var props WADeviceProps
+			if err := decodeJSONBody(w, r, &props); err != nil {
+				writeBodyError(w, err)
+				return
+			}
+			if err := validateWADeviceProps(&props); err != nil {
+				apiError(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := dbSetWADeviceProps(userID, props); err != nil {
+				fmt.Println("ERROR: Could not save device properties", err)
+				apiError(w, "Failed to save device properties", http.StatusInternalServerError)
+				return
+			}
+			fmt.Printf("INFO: Device properties for user %d set: name=%q platform=%s\n", userID, props.Name, props.Platform)
+		default:
+			apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		props, err := dbGetWADeviceProps(userID)
+		if err != nil {
+			apiError(w, "Failed to load device properties", http.StatusInternalServerError)
+			return
+		}
+		props.Paired = paired
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(props)
+	}
+}
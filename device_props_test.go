@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/proto/waCompanionReg"
+	"go.mau.fi/whatsmeow/store/sqlstore"
+	"go.mau.fi/whatsmeow/types"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestWADeviceProps(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+	dir := useTestWAStore(t, WA_STORE_PER_USER)
+	t.Setenv("WA_DEVICE_NAME", "Dashboard")
+
+	email := "deviceprops@example.com"
+	_, apiKey := registerWithAPIKey(t, ts, email, "devicepropspass123")
+	url := ts.URL + "/api/wa/device-props"
+
+	var props WADeviceProps
+	if resp := apiRequest(t, "GET", url, apiKey, nil, &props); resp.StatusCode != 200 || props.Name != "Dashboard" || props.Platform != "unknown" || props.Paired {
+		t.Fatalf("Expected the defaults, got %d %+v", resp.StatusCode, props)
+	}
+	if resp := apiRequest(t, "POST", url, apiKey, map[string]string{"name": "Acme", "platform": "toaster"}, nil); resp.StatusCode != 400 {
+		t.Fatalf("Expected an unknown platform to be rejected, got %d", resp.StatusCode)
+	}
+	if resp := apiRequest(t, "POST", url, apiKey, map[string]string{"name": " Acme Dashboard ", "platform": "Chrome"}, &props); resp.StatusCode != 200 || props.Name != "Acme Dashboard" || props.Platform != "chrome" {
+		t.Fatalf("Expected the properties to be saved, got %d %+v", resp.StatusCode, props)
+	}
+
+	// A new client pairs with them
+	container, err := sqlstore.New(context.Background(), "sqlite", "file:device_props_test?mode=memory&_pragma=foreign_keys(1)", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer container.Close()
+	client := whatsmeow.NewClient(container.NewDevice(), nil)
+	applyWADeviceProps(client, email)
+	var sent waCompanionReg.DeviceProps
+	if err := proto.Unmarshal(client.GetClientPayload().GetDevicePairingData().GetDeviceProps(), &sent); err != nil {
+		t.Fatal(err)
+	}
+	if sent.GetOs() != "Acme Dashboard" || sent.GetPlatformType() != waCompanionReg.DeviceProps_CHROME {
+		t.Fatalf("Expected the pairing payload to carry the properties, got %v", &sent)
+	}
+
+	// Once paired they can't change
+	writeTestSession(t, filepath.Join(dir, "test_whatsmeow_"+email+".db"), types.NewJID("14155550128", types.DefaultUserServer))
+	if resp := apiRequest(t, "POST", url, apiKey, map[string]string{"name": "Other"}, nil); resp.StatusCode != 409 {
+		t.Fatalf("Expected a paired device to refuse changes, got %d", resp.StatusCode)
+	}
+	if apiRequest(t, "GET", url, apiKey, nil, &props); !props.Paired || props.Name != "Acme Dashboard" {
+		t.Fatalf("Expected the paired properties, got %+v", props)
+	}
+}
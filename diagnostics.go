@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"runtime"
+	rpprof "runtime/pprof"
+	"sort"
+	"strings"
+	"time"
+)
+
+// --- Runtime diagnostics ---
+// For tracking down leaks in long-running deployments. /api/admin/diagnostics reports
+// goroutines (by state), memory, database connections and what each user keeps in
+// memory: the WhatsApp client, the send queue and its goroutine, channel receivers.
+// With ENABLE_PPROF=true the Go profiler is served at /debug/pprof/, behind the same
+// admin token; its heap profile is the way to see what holds memory, as the Go runtime
+// can't attribute heap to individual clients.
+
+var serverStartedAt = time.Now()
+
+// Register /debug/pprof/ if ENABLE_PPROF=true
+func registerPprof(mux *http.ServeMux) {
+	if os.Getenv("ENABLE_PPROF") != "true" {
+		return
+	}
+	mux.HandleFunc("/debug/pprof/", requireAdminToken(pprof.Index))
+	mux.HandleFunc("/debug/pprof/cmdline", requireAdminToken(pprof.Cmdline))
+	mux.HandleFunc("/debug/pprof/profile", requireAdminToken(pprof.Profile))
+	mux.HandleFunc("/debug/pprof/symbol", requireAdminToken(pprof.Symbol))
+	mux.HandleFunc("/debug/pprof/trace", requireAdminToken(pprof.Trace))
+	fmt.Println("INFO: pprof enabled at /debug/pprof/")
+}
+
+// Number of goroutines per state ("running", "select", "chan receive", "IO wait", ...)
+func goroutineStates() map[string]int {
+	var buf bytes.Buffer
+	rpprof.Lookup("goroutine").WriteTo(&buf, 2)
+	states := map[string]int{}
+	scanner := bufio.NewScanner(&buf)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		// Headers look like "goroutine 42 [chan receive, 5 minutes]:"
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "goroutine ") || !strings.HasSuffix(line, "]:") {
+			continue
+		}
+		start := strings.Index(line, "[")
+		if start < 0 {
+			continue
+		}
+		state, _, _ := strings.Cut(line[start+1:len(line)-2], ",")
+		states[state]++
+	}
+	return states
+}
+
+// What one user keeps in memory
+type userDiagnostics struct {
+	Email            string     `json:"email"`
+	WAStatus         string     `json:"wa_status"`
+	HasClient        bool       `json:"has_client"`
+	ConnectedSince   *time.Time `json:"connected_since,omitempty"`
+	LastSeenAt       *time.Time `json:"last_seen_at,omitempty"` // Last event or passed health check
+	Queued           int        `json:"queued"`
+	PendingApproval  int        `json:"pending_approval"`
+	QueuedBytes      int        `json:"queued_bytes"`    // Text and callback URLs of queued and held messages
+	QueueGoroutine   string     `json:"queue_goroutine"` // "running", "idle" or "none" (no queue)
+	QueuePaused      bool       `json:"queue_paused"`
+	ChannelReceivers int        `json:"channel_receivers"` // Non-WhatsApp channels being received from
+}
+
+func collectUserDiagnostics() []userDiagnostics {
+	users := map[string]*userDiagnostics{}
+	get := func(email string) *userDiagnostics {
+		if u, ok := users[email]; ok {
+			return u
+		}
+		u := &userDiagnostics{Email: email, WAStatus: "disconnected", QueueGoroutine: "none"}
+		users[email] = u
+		return u
+	}
+
+	waUsers.mu.Lock()
+	states := make(map[string]*UserWAState, len(waUsers.data))
+	for email, state := range waUsers.data {
+		states[email] = state
+	}
+	waUsers.mu.Unlock()
+	for email, state := range states {
+		u := get(email)
+		state.mu.RLock()
+		u.WAStatus = state.waStatus
+		u.HasClient = state.waClient != nil
+		if !state.connectedSince.IsZero() {
+			since := state.connectedSince
+			u.ConnectedSince = &since
+		}
+		if !state.lastSeenAt.IsZero() {
+			seen := state.lastSeenAt
+			u.LastSeenAt = &seen
+		}
+		state.mu.RUnlock()
+	}
+
+	queueMutex.RLock()
+	queues := make(map[string]*MessageQueue, len(messageQueues))
+	for email, queue := range messageQueues {
+		queues[email] = queue
+	}
+	queueMutex.RUnlock()
+	for email, queue := range queues {
+		u := get(email)
+		queue.mu.RLock()
+		u.Queued = len(queue.Messages)
+		u.PendingApproval = len(queue.Pending)
+		for _, list := range [][]*QueuedMessage{queue.Messages, queue.Pending} {
+			for _, msg := range list {
+				u.QueuedBytes += len(msg.Message) + len(msg.CallbackURL)
+			}
+		}
+		u.QueueGoroutine = "idle"
+		if queue.IsProcessing {
+			u.QueueGoroutine = "running"
+		}
+		u.QueuePaused = queue.Paused
+		queue.mu.RUnlock()
+	}
+
+	channelRunners.mu.Lock()
+	for email, runners := range channelRunners.data {
+		if len(runners) > 0 {
+			get(email).ChannelReceivers = len(runners)
+		}
+	}
+	channelRunners.mu.Unlock()
+
+	list := make([]userDiagnostics, 0, len(users))
+	for _, u := range users {
+		list = append(list, *u)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Email < list[j].Email })
+	return list
+}
+
+// GET /api/admin/diagnostics
+func handleDiagnostics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	dbStats, readStats := db.Stats(), readDB.Stats()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"uptime_seconds":   int64(time.Since(serverStartedAt).Seconds()),
+		"go_version":       runtime.Version(),
+		"goroutines":       runtime.NumGoroutine(),
+		"goroutine_states": goroutineStates(),
+		"memory": map[string]interface{}{
+			"heap_alloc_bytes":  mem.HeapAlloc,
+			"heap_inuse_bytes":  mem.HeapInuse,
+			"heap_objects":      mem.HeapObjects,
+			"stack_inuse_bytes": mem.StackInuse,
+			"sys_bytes":         mem.Sys,
+			"num_gc":            mem.NumGC,
+		},
+		"database": map[string]interface{}{
+			"open_connections": dbStats.OpenConnections,
+			"in_use":           dbStats.InUse,
+			"idle":             dbStats.Idle,
+			"wait_count":       dbStats.WaitCount,
+			"wait_ms":          dbStats.WaitDuration.Milliseconds(),
+		},
+		"read_database": map[string]interface{}{
+			"open_connections": readStats.OpenConnections,
+			"in_use":           readStats.InUse,
+			"idle":             readStats.Idle,
+			"wait_count":       readStats.WaitCount,
+			"wait_ms":          readStats.WaitDuration.Milliseconds(),
+		},
+		"caches":            lookupCacheStats(),
+		"pending_callbacks": pendingCallbackCount(), // Stored for delivery or retry (callback_outbox.go)
+		"users":             collectUserDiagnostics(),
+		"pprof":             os.Getenv("ENABLE_PPROF") == "true",
+	})
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDiagnostics(t *testing.T) {
+	t.Setenv("ADMIN_TOKEN", "admin-secret")
+	t.Setenv("ENABLE_PPROF", "true")
+	ts, teardown := setupTestServer()
+	defer teardown()
+
+	registerWithAPIKey(t, ts, "diag@example.com", "diagpass123")
+	queueMutex.Lock()
+	messageQueues["diag@example.com"] = &MessageQueue{UserEmail: "diag@example.com", Paused: true, Messages: []*QueuedMessage{{ID: "q1", Message: "hello", Status: "queued"}}}
+	queueMutex.Unlock()
+	defer func() {
+		queueMutex.Lock()
+		delete(messageQueues, "diag@example.com")
+		queueMutex.Unlock()
+	}()
+
+	get := func(path, token string) *http.Response {
+		req, _ := http.NewRequest("GET", ts.URL+path, nil)
+		req.Header.Set("X-Admin-Token", token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET %s failed: %v", path, err)
+		}
+		return resp
+	}
+	for _, path := range []string{"/api/admin/diagnostics", "/debug/pprof/"} {
+		if resp := get(path, "wrong"); resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("Expected 401 for %s with a wrong token, got %d", path, resp.StatusCode)
+		}
+	}
+
+	var diag struct {
+		Goroutines      int            `json:"goroutines"`
+		GoroutineStates map[string]int `json:"goroutine_states"`
+		Database        struct {
+			OpenConnections int `json:"open_connections"`
+		} `json:"database"`
+		Users []userDiagnostics `json:"users"`
+	}
+	json.NewDecoder(get("/api/admin/diagnostics", "admin-secret").Body).Decode(&diag)
+	states := 0
+	for _, n := range diag.GoroutineStates {
+		states += n
+	}
+	if diag.Goroutines == 0 || states == 0 || diag.Database.OpenConnections == 0 {
+		t.Fatalf("Missing runtime figures: %+v", diag)
+	}
+	var user *userDiagnostics
+	for i := range diag.Users {
+		if diag.Users[i].Email == "diag@example.com" {
+			user = &diag.Users[i]
+		}
+	}
+	if user == nil || user.Queued != 1 || user.QueuedBytes != 5 || !user.QueuePaused || user.QueueGoroutine != "idle" {
+		t.Fatalf("Unexpected user diagnostics: %+v", diag.Users)
+	}
+
+	profile := func(base string) string {
+		req, _ := http.NewRequest("GET", base+"/debug/pprof/goroutine?debug=1", nil)
+		req.Header.Set("X-Admin-Token", "admin-secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Profile request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+	if body := profile(ts.URL); !strings.HasPrefix(body, "goroutine profile:") {
+		t.Fatalf("Expected the goroutine profile, got %.100q", body)
+	}
+
+	// pprof is opt-in
+	t.Setenv("ENABLE_PPROF", "")
+	mux := http.NewServeMux()
+	registerPprof(mux)
+	disabled := httptest.NewServer(mux)
+	defer disabled.Close()
+	if body := profile(disabled.URL); strings.HasPrefix(body, "goroutine profile:") {
+		t.Fatal("pprof should be disabled without ENABLE_PPROF=true")
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// --- Received document text extraction ---
+// With EXTRACT_DOCUMENT_TEXT=true, the text of received PDF, DOCX and plain-text
+// documents is extracted before forwarding. Payloads carry a truncated
+// "document_text"; the full text is stored and served per message. PDFs are
+// converted with PDF_TEXT_COMMAND (default pdftotext).
+
+const (
+	DEFAULT_PDF_TEXT_COMMAND = "pdftotext -q -enc UTF-8 {file} -"
+	DOCUMENT_TEXT_TIMEOUT    = time.Minute
+	DOCUMENT_TEXT_PREVIEW    = 2000 // Runes in the payload
+	MAX_DOCUMENT_TEXT_BYTES  = 1024 * 1024
+	DOCX_BODY_PART           = "word/document.xml"
+)
+
+var errUnsupportedDocument = errors.New("unsupported document type")
+
+func documentTextEnabled() bool {
+	return os.Getenv("EXTRACT_DOCUMENT_TEXT") == "true"
+}
+
+// Extract the text of a document by its MIME type or extension
+func extractDocumentText(filePath, mimeType string) (string, error) {
+	ext := strings.ToLower(filepath.Ext(filePath))
+	switch {
+	case mimeType == "application/pdf" || ext == ".pdf":
+		command := os.Getenv("PDF_TEXT_COMMAND")
+		if command == "" {
+			command = DEFAULT_PDF_TEXT_COMMAND
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), DOCUMENT_TEXT_TIMEOUT)
+		defer cancel()
+		return runExtractCommand(ctx, command, filePath)
+	case mimeType == "application/vnd.openxmlformats-officedocument.wordprocessingml.document" || ext == ".docx":
+		return extractDocxText(filePath)
+	case strings.HasPrefix(mimeType, "text/") || ext == ".txt" || ext == ".csv":
+		f, err := os.Open(filePath)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		data, err := io.ReadAll(io.LimitReader(f, MAX_DOCUMENT_TEXT_BYTES))
+		if err != nil {
+			return "", err
+		}
+		return strings.ToValidUTF8(string(data), ""), nil
+	}
+	return "", errUnsupportedDocument
+}
+
+// Read the paragraphs of a DOCX body, one per line
+func extractDocxText(filePath string) (string, error) {
+	zr, err := zip.OpenReader(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer zr.Close()
+	part, err := zr.Open(DOCX_BODY_PART)
+	if err != nil {
+		return "", err
+	}
+	defer part.Close()
+
+	var b strings.Builder
+	decoder := xml.NewDecoder(io.LimitReader(part, 8*MAX_DOCUMENT_TEXT_BYTES))
+	inText := false
+	for b.Len() < MAX_DOCUMENT_TEXT_BYTES {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return "", err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "t":
+				inText = true
+			case "tab":
+				b.WriteString("\t")
+			case "br":
+				b.WriteString("\n")
+			}
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "t":
+				inText = false
+			case "p":
+				b.WriteString("\n")
+			}
+		case xml.CharData:
+			if inText {
+				b.Write(t)
+			}
+		}
+	}
+	return b.String(), nil
+}
+
+// Extract a received document's text and attach a preview to the payload.
+// Returns the full text to store, or "" if there is none.
+func extractReceivedDocumentText(filePath, mimeType string, payload map[string]interface{}) string {
+	if !documentTextEnabled() {
+		return ""
+	}
+	text, err := extractDocumentText(filePath, mimeType)
+	if err == errUnsupportedDocument {
+		return ""
+	} else if err != nil {
+		fmt.Printf("WARNING: Text extraction failed for %s: %v\n", filePath, err)
+		return ""
+	}
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return ""
+	}
+	payload["document_text"] = truncateRunes(text, DOCUMENT_TEXT_PREVIEW)
+	if utf8.RuneCountInString(text) > DOCUMENT_TEXT_PREVIEW {
+		payload["document_text_truncated"] = true
+	}
+	return text
+}
+
+func dbSaveDocumentText(userID int64, chatJID, messageID, text string) error {
+	_, err := db.Exec(`INSERT INTO document_texts (user_id, chat_jid, message_id, text, created_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(user_id, chat_jid, message_id) DO UPDATE SET text = excluded.text, created_at = excluded.created_at`,
+		userID, chatJID, messageID, text, time.Now().UTC().Format(time.RFC3339))
+	return err
+}
+
+func dbGetDocumentText(userID int64, chatJID, messageID string) (string, error) {
+	var text string
+	err := db.QueryRow(`SELECT text FROM document_texts WHERE user_id = ? AND chat_jid = ? AND message_id = ?`, userID, chatJID, messageID).Scan(&text)
+	return text, err
+}
+
+// GET /api/messages/{jid}/{id}/document-text
+func handleGetDocumentText(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID := r.Context().Value("userID").(int64)
+
+	chatJID, err := normalizeChatJID(r.PathValue("jid"))
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, ERR_INVALID_JID, "Invalid chat JID")
+		return
+	}
+	messageID := r.PathValue("id")
+	text, err := dbGetDocumentText(userID, chatJID.String(), messageID)
+	if err == sql.ErrNoRows {
+		apiError(w, "No document text for this message", http.StatusNotFound)
+		return
+	} else if err != nil {
+		apiError(w, "Failed to load document text", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"chat_jid":   chatJID.String(),
+		"message_id": messageID,
+		"text":       text,
+		"length":     utf8.RuneCountInString(text),
+	})
+}
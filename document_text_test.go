@@ -0,0 +1,99 @@
+package main
+
+import (
+	"archive/zip"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeTestDocx(t *testing.T, path, body string) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zw := zip.NewWriter(f)
+	w, _ := zw.Create(DOCX_BODY_PART)
+	w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?><w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main"><w:body>` + body + `</w:body></w:document>`))
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExtractReceivedDocumentText(t *testing.T) {
+	dir := t.TempDir()
+	docx := filepath.Join(dir, "1_ABC_contract.docx")
+	writeTestDocx(t, docx, `<w:p><w:r><w:t>Contract</w:t></w:r></w:p><w:p><w:r><w:t>Name:</w:t><w:tab/><w:t xml:space="preserve">Ann &amp; Bob</w:t></w:r></w:p>`)
+	pdf := filepath.Join(dir, "2_DEF_invoice.pdf")
+	os.WriteFile(pdf, []byte("Invoice 42"), 0644)
+	zipFile := filepath.Join(dir, "3_GHI_photos.zip")
+	os.WriteFile(zipFile, []byte("PK"), 0644)
+
+	// Off unless enabled
+	t.Setenv("EXTRACT_DOCUMENT_TEXT", "")
+	payload := map[string]interface{}{}
+	if text := extractReceivedDocumentText(docx, "", payload); text != "" || payload["document_text"] != nil {
+		t.Fatalf("Expected no extraction when disabled, got %q %v", text, payload)
+	}
+
+	t.Setenv("EXTRACT_DOCUMENT_TEXT", "true")
+	payload = map[string]interface{}{}
+	if text := extractReceivedDocumentText(docx, "", payload); text != "Contract\nName:\tAnn & Bob" || payload["document_text"] != text {
+		t.Fatalf("Unexpected DOCX text %q, payload %v", text, payload)
+	}
+
+	// PDFs go through the configured command
+	t.Setenv("PDF_TEXT_COMMAND", "cat {file}")
+	payload = map[string]interface{}{}
+	if text := extractReceivedDocumentText(pdf, "application/pdf", payload); text != "Invoice 42" {
+		t.Fatalf("Unexpected PDF text %q", text)
+	}
+	t.Setenv("PDF_TEXT_COMMAND", "/nonexistent/pdftotext")
+	payload = map[string]interface{}{}
+	if text := extractReceivedDocumentText(pdf, "application/pdf", payload); text != "" || payload["document_text"] != nil {
+		t.Fatalf("Expected no text after a failure, got %q", text)
+	}
+
+	// Unsupported types are skipped
+	payload = map[string]interface{}{}
+	if text := extractReceivedDocumentText(zipFile, "application/zip", payload); text != "" {
+		t.Fatalf("Expected no text for a zip, got %q", text)
+	}
+
+	// Long text is truncated in the payload only
+	long := filepath.Join(dir, "4_JKL_notes.txt")
+	os.WriteFile(long, []byte(strings.Repeat("é", DOCUMENT_TEXT_PREVIEW+10)), 0644)
+	payload = map[string]interface{}{}
+	text := extractReceivedDocumentText(long, "text/plain", payload)
+	if len([]rune(text)) != DOCUMENT_TEXT_PREVIEW+10 || payload["document_text_truncated"] != true ||
+		len([]rune(payload["document_text"].(string))) != DOCUMENT_TEXT_PREVIEW+1 {
+		t.Fatalf("Unexpected truncation: %d runes stored, payload truncated=%v", len([]rune(text)), payload["document_text_truncated"])
+	}
+}
+
+func TestDocumentTextEndpoint(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+
+	email := "docs@example.com"
+	_, apiKey := registerWithAPIKey(t, ts, email, "docspass123")
+	userID, _ := getUserIDByEmail(email)
+	chat := "14155550000@s.whatsapp.net"
+	full := strings.Repeat("line of text\n", 500)
+	if err := dbSaveDocumentText(userID, chat, "MSG1", full); err != nil {
+		t.Fatal(err)
+	}
+
+	var got map[string]interface{}
+	resp := apiRequest(t, "GET", ts.URL+"/api/messages/+1 415 555 0000/MSG1/document-text", apiKey, nil, &got)
+	if resp.StatusCode != 200 || got["text"] != full || got["chat_jid"] != chat || got["length"] != float64(len(full)) {
+		t.Fatalf("Unexpected document text, status %d: chat=%v length=%v", resp.StatusCode, got["chat_jid"], got["length"])
+	}
+	if resp := apiRequest(t, "GET", ts.URL+"/api/messages/"+chat+"/MSG2/document-text", apiKey, nil, nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected 404 for a message without text, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// --- Egress identity ---
+// Webhook deliveries, send callbacks, alert notifications and triggers carry a
+// User-Agent (WEBHOOK_USER_AGENT) so receivers can tell this dashboard's traffic apart,
+// and /api/meta/egress tells receivers what to allowlist. The server can't see its own
+// address behind NAT, so the outbound IPs are whatever the operator lists in EGRESS_IPS.
+
+const DEFAULT_WEBHOOK_USER_AGENT = "whatsmeow-webhook-dashboard"
+
+var (
+	webhookUserAgent = DEFAULT_WEBHOOK_USER_AGENT
+	egressIPs        []string
+)
+
+// Read WEBHOOK_USER_AGENT and EGRESS_IPS; invalid IPs are skipped
+func initEgress() {
+	webhookUserAgent = DEFAULT_WEBHOOK_USER_AGENT
+	if ua := strings.TrimSpace(os.Getenv("WEBHOOK_USER_AGENT")); ua != "" {
+		webhookUserAgent = ua
+	}
+	egressIPs = nil
+	for _, entry := range strings.Split(os.Getenv("EGRESS_IPS"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		addr, err := netip.ParseAddr(entry)
+		if err != nil {
+			fmt.Printf("WARNING: Ignoring %q in EGRESS_IPS, expected an IP\n", entry)
+			continue
+		}
+		egressIPs = append(egressIPs, addr.String())
+	}
+}
+
+// Sets the User-Agent on requests that don't have one from the webhook's headers
+type userAgentTransport struct {
+	next http.RoundTripper
+}
+
+func (t userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("User-Agent") == "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("User-Agent", webhookUserAgent)
+	}
+	return t.next.RoundTrip(req)
+}
+
+// GET /api/meta/egress
+// Public, like /api/health, so receivers can look it up themselves.
+func handleEgressInfo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ips := egressIPs
+	if ips == nil {
+		ips = []string{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"user_agent":   webhookUserAgent,
+		"outbound_ips": ips,
+		// Deliveries aren't signed; receivers authenticate them with a secret header
+		// ({{secret.NAME}}) and can require the verification challenge
+		"signature": map[string]interface{}{
+			"signed":             false,
+			"verification_event": EVENT_WEBHOOK_VERIFICATION,
+		},
+	})
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestEgressIdentity(t *testing.T) {
+	t.Cleanup(initEgress)
+	t.Setenv("WEBHOOK_USER_AGENT", "acme-dashboard/2.0")
+	t.Setenv("EGRESS_IPS", "203.0.113.7, not-an-ip, 2001:db8::1")
+	ts, teardown := setupTestServer()
+	defer teardown()
+
+	// Public, no session or API key needed
+	resp, err := http.Get(ts.URL + "/api/meta/egress")
+	if err != nil || resp.StatusCode != 200 {
+		t.Fatalf("Egress info failed: %v", err)
+	}
+	var info struct {
+		UserAgent   string   `json:"user_agent"`
+		OutboundIPs []string `json:"outbound_ips"`
+		Signature   struct {
+			Signed bool `json:"signed"`
+		} `json:"signature"`
+	}
+	json.NewDecoder(resp.Body).Decode(&info)
+	if info.UserAgent != "acme-dashboard/2.0" || len(info.OutboundIPs) != 2 || info.OutboundIPs[0] != "203.0.113.7" || info.OutboundIPs[1] != "2001:db8::1" || info.Signature.Signed {
+		t.Fatalf("Unexpected egress info: %+v", info)
+	}
+
+	// Deliveries carry the User-Agent unless the webhook sets its own
+	agents := make(chan string, 2)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		agents <- r.UserAgent()
+	}))
+	defer receiver.Close()
+	if _, err := sendWebhook(Webhook{ID: "ua"}, map[string]interface{}{"n": 1}, receiver.URL, "POST"); err != nil {
+		t.Fatalf("Delivery failed: %v", err)
+	}
+	if ua := <-agents; ua != "acme-dashboard/2.0" {
+		t.Fatalf("Expected the configured User-Agent, got %q", ua)
+	}
+	if _, err := sendWebhook(Webhook{ID: "ua", Headers: map[string]string{"User-Agent": "crm-sync"}}, nil, receiver.URL, "GET"); err != nil {
+		t.Fatalf("Delivery failed: %v", err)
+	}
+	if ua := <-agents; ua != "crm-sync" {
+		t.Fatalf("Expected the webhook's own User-Agent, got %q", ua)
+	}
+}
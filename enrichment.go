@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// --- LLM enrichment ---
+// Before forwarding, a message's text can be sent to an OpenAI-compatible chat
+// completions endpoint (per-user endpoint, key, model and prompt) to classify intent
+// or sentiment. The answer is attached as "enrichment"; if the call fails or times
+// out the message is forwarded without it.
+
+const (
+	DEFAULT_ENRICHMENT_TIMEOUT_MS = 5000
+	MAX_ENRICHMENT_TIMEOUT_MS     = 30000
+	MAX_ENRICHMENT_PROMPT         = 4000
+	MAX_ENRICHMENT_RESPONSE_BYTES = 64 * 1024
+
+	DEFAULT_ENRICHMENT_PROMPT = `Classify the intent and sentiment of this WhatsApp message.
+Reply with JSON only, like {"intent": "question", "sentiment": "neutral"}; sentiment is positive, neutral or negative.
+
+Message: {{text}}`
+
+	STAT_ENRICHMENT_OK     = "enrichment_ok"
+	STAT_ENRICHMENT_FAILED = "enrichment_failed"
+)
+
+// Variables an enrichment prompt may use
+var enrichmentPromptVars = map[string]bool{"text": true, "type": true, "name": true, "chat_jid": true, "ocr_text": true, "document_text": true}
+
+type EnrichmentSettings struct {
+	Enabled   bool   `json:"enabled"`
+	Endpoint  string `json:"endpoint"` // Base URL, e.g. https://api.openai.com/v1
+	APIKey    string `json:"-"`        // May be a {{secret.NAME}} reference
+	Model     string `json:"model"`
+	Prompt    string `json:"prompt"`
+	TimeoutMS int    `json:"timeout_ms"`
+}
+
+var enrichmentClient = guardedHTTPClient(0) // Timed out per request with timeout_ms
+
+func validateEnrichmentSettings(s *EnrichmentSettings) error {
+	if s.Prompt == "" {
+		s.Prompt = DEFAULT_ENRICHMENT_PROMPT
+	}
+	if utf8.RuneCountInString(s.Prompt) > MAX_ENRICHMENT_PROMPT {
+		return fmt.Errorf("Prompt too long (max %d characters)", MAX_ENRICHMENT_PROMPT)
+	}
+	for _, m := range cannedVarRegex.FindAllStringSubmatch(s.Prompt, -1) {
+		if !enrichmentPromptVars[m[1]] {
+			return fmt.Errorf("Unknown prompt variable: %s", m[1])
+		}
+	}
+	if s.TimeoutMS == 0 {
+		s.TimeoutMS = DEFAULT_ENRICHMENT_TIMEOUT_MS
+	}
+	if s.TimeoutMS < 100 || s.TimeoutMS > MAX_ENRICHMENT_TIMEOUT_MS {
+		return fmt.Errorf("Invalid timeout_ms (100-%d)", MAX_ENRICHMENT_TIMEOUT_MS)
+	}
+	s.Endpoint = strings.TrimRight(strings.TrimSpace(s.Endpoint), "/")
+	if s.Endpoint != "" {
+		u, err := url.Parse(s.Endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("Invalid endpoint (http or https URL required)")
+		}
+		if err := validateOutboundURL(s.Endpoint); err != nil {
+			return fmt.Errorf("Invalid endpoint: %v", err)
+		}
+	}
+	if s.Enabled && (s.Endpoint == "" || s.Model == "") {
+		return errors.New("endpoint and model are required to enable enrichment")
+	}
+	return nil
+}
+
+func dbGetEnrichmentSettings(userID int64) (EnrichmentSettings, error) {
+	s := EnrichmentSettings{Prompt: DEFAULT_ENRICHMENT_PROMPT, TimeoutMS: DEFAULT_ENRICHMENT_TIMEOUT_MS}
+	err := db.QueryRow(`SELECT enabled, endpoint, api_key, model, prompt, timeout_ms FROM enrichment_settings WHERE user_id = ?`, userID).
+		Scan(&s.Enabled, &s.Endpoint, &s.APIKey, &s.Model, &s.Prompt, &s.TimeoutMS)
+	if err == sql.ErrNoRows {
+		return s, nil
+	}
+	return s, err
+}
+
+func dbSetEnrichmentSettings(userID int64, s EnrichmentSettings) error {
+	_, err := db.Exec(`INSERT INTO enrichment_settings (user_id, enabled, endpoint, api_key, model, prompt, timeout_ms, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(user_id) DO UPDATE SET enabled = excluded.enabled, endpoint = excluded.endpoint, api_key = excluded.api_key,
+			model = excluded.model, prompt = excluded.prompt, timeout_ms = excluded.timeout_ms, updated_at = excluded.updated_at`,
+		userID, s.Enabled, s.Endpoint, s.APIKey, s.Model, s.Prompt, s.TimeoutMS, time.Now().UTC().Format(time.RFC3339))
+	return err
+}
+
+// One message of a chat completions conversation
+type chatMessage struct {
+	Role    string `json:"role"` // "system", "user" or "assistant"
+	Content string `json:"content"`
+}
+
+// Call the user's OpenAI-compatible chat completions endpoint and return the answer text
+func callChatCompletion(userID int64, s EnrichmentSettings, messages []chatMessage, temperature float64) (string, error) {
+	apiKey := s.APIKey
+	if secretTemplateRegex.MatchString(apiKey) {
+		secrets, err := dbGetSecretValues(userID)
+		if err != nil {
+			return "", err
+		}
+		if apiKey, err = renderSecretTemplate(apiKey, secrets); err != nil {
+			return "", err
+		}
+	}
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"model":       s.Model,
+		"messages":    messages,
+		"temperature": temperature,
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(s.TimeoutMS)*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", s.Endpoint+"/chat/completions", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+	resp, err := enrichmentClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, MAX_ENRICHMENT_RESPONSE_BYTES))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return "", fmt.Errorf("endpoint returned status %d", resp.StatusCode)
+	}
+
+	var completion struct {
+		Choices []struct {
+			Message chatMessage `json:"message"`
+		} `json:"choices"`
+	}
+	if err := json.Unmarshal(data, &completion); err != nil || len(completion.Choices) == 0 {
+		return "", errors.New("unexpected response from endpoint")
+	}
+	return strings.TrimSpace(completion.Choices[0].Message.Content), nil
+}
+
+// Run the enrichment prompt. A JSON object answer (optionally in a ``` block) is
+// returned as-is, anything else as {"result": "..."}.
+func callEnrichment(userID int64, s EnrichmentSettings, vars map[string]string) (map[string]interface{}, error) {
+	prompt, err := expandCannedResponse(s.Prompt, vars)
+	if err != nil {
+		return nil, err
+	}
+	content, err := callChatCompletion(userID, s, []chatMessage{{Role: "user", Content: prompt}}, 0)
+	if err != nil {
+		return nil, err
+	}
+	content = strings.TrimPrefix(strings.TrimPrefix(content, "```json"), "```")
+	content = strings.TrimSpace(strings.TrimSuffix(content, "```"))
+	var result map[string]interface{}
+	if err := json.Unmarshal([]byte(content), &result); err != nil || result == nil {
+		result = map[string]interface{}{"result": content}
+	}
+	return result, nil
+}
+
+// Prompt variables for a message payload
+func enrichmentVars(payload map[string]interface{}) map[string]string {
+	vars := map[string]string{}
+	for _, key := range []string{"type", "name", "text", "ocr_text", "document_text"} {
+		vars[key], _ = payload[key].(string)
+	}
+	if vars["text"] == "" {
+		vars["text"], _ = payload["caption"].(string)
+	}
+	// Images and documents without a caption are classified by their text
+	if vars["text"] == "" {
+		vars["text"] = vars["ocr_text"]
+	}
+	if vars["text"] == "" {
+		vars["text"] = vars["document_text"]
+	}
+	vars["chat_jid"], _ = payload["to"].(string)
+	return vars
+}
+
+// Pipeline stage: attach "enrichment" to a received message when enabled
+func enrichPayload(email string, userID int64, payload map[string]interface{}) {
+	s, err := dbGetEnrichmentSettings(userID)
+	if err != nil {
+		fmt.Printf("ERROR: Could not load enrichment settings for user %s: %v\n", email, err)
+		return
+	}
+	vars := enrichmentVars(payload)
+	if !s.Enabled || strings.TrimSpace(vars["text"]) == "" {
+		return
+	}
+	result, err := callEnrichment(userID, s, vars)
+	if err != nil {
+		incrementStat(userID, STAT_ENRICHMENT_FAILED)
+		fmt.Printf("WARNING: Enrichment failed for user %s, forwarding without it: %v\n", email, err)
+		return
+	}
+	incrementStat(userID, STAT_ENRICHMENT_OK)
+	result["model"] = s.Model
+	payload["enrichment"] = result
+}
+
+// Settings as returned by the API: the key is never returned
+func enrichmentSettingsResponse(s EnrichmentSettings) map[string]interface{} {
+	return map[string]interface{}{
+		"enabled":     s.Enabled,
+		"endpoint":    s.Endpoint,
+		"api_key_set": s.APIKey != "",
+		"model":       s.Model,
+		"prompt":      s.Prompt,
+		"timeout_ms":  s.TimeoutMS,
+	}
+}
+
+// GET/POST /api/enrichment
+// POST replaces the settings {"enabled", "endpoint", "api_key", "model", "prompt", "timeout_ms"};
+// api_key is kept if left out, and removed with "".
+func handleEnrichmentSettings(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(int64)
+
+	current, err := dbGetEnrichmentSettings(userID)
+	if err != nil {
+		apiError(w, "Failed to load enrichment settings", http.StatusInternalServerError)
+		return
+	}
+	switch r.Method {
+	case "GET":
+	case "POST":
+		var req struct {
+			EnrichmentSettings
+			APIKey *string `json:"api_key"`
+		}
+		if err := decodeJSONBody(w, r, &req); err != nil {
+			writeBodyError(w, err)
+			return
+		}
+		s := req.EnrichmentSettings
+		s.APIKey = current.APIKey
+		if req.APIKey != nil {
+			s.APIKey = *req.APIKey
+		}
+		if err := validateEnrichmentSettings(&s); err != nil {
+			apiError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := dbSetEnrichmentSettings(userID, s); err != nil {
+			fmt.Println("ERROR: Could not save enrichment settings", err)
+			apiError(w, "Failed to save enrichment settings", http.StatusInternalServerError)
+			return
+		}
+		fmt.Printf("INFO: Enrichment for user %d set: enabled=%v model=%s\n", userID, s.Enabled, s.Model)
+		current = s
+	default:
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(enrichmentSettingsResponse(current))
+}
+
+// POST /api/enrichment/test {"text": "..."}
+// Runs the saved settings on a sample message (even if disabled) and returns the enrichment.
+func handleTestEnrichment(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID := r.Context().Value("userID").(int64)
+
+	var req struct {
+		Text string `json:"text"`
+	}
+	if err := decodeJSONBody(w, r, &req); err != nil && err != io.EOF {
+		writeBodyError(w, err)
+		return
+	}
+	if strings.TrimSpace(req.Text) == "" {
+		apiError(w, "Missing text", http.StatusBadRequest)
+		return
+	}
+	s, err := dbGetEnrichmentSettings(userID)
+	if err != nil {
+		apiError(w, "Failed to load enrichment settings", http.StatusInternalServerError)
+		return
+	}
+	if s.Endpoint == "" || s.Model == "" {
+		apiError(w, "Enrichment is not configured", http.StatusBadRequest)
+		return
+	}
+	result, err := callEnrichment(userID, s, map[string]string{"text": req.Text, "type": "text", "name": "", "chat_jid": "", "ocr_text": "", "document_text": ""})
+	if err != nil {
+		writeAPIError(w, http.StatusBadGateway, ERR_UPSTREAM, "Enrichment failed: "+err.Error())
+		return
+	}
+	result["model"] = s.Model
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"enrichment": result})
+}
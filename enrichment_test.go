@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMessageEnrichment(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+
+	email := "enrich@example.com"
+	_, apiKey := registerWithAPIKey(t, ts, email, "enrichpass123")
+
+	var mu sync.Mutex
+	var gotAuth, gotPrompt string
+	answer := "```json\n{\"intent\": \"refund\", \"sentiment\": \"negative\"}\n```"
+	llm := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/chat/completions" {
+			http.NotFound(w, r)
+			return
+		}
+		var req struct {
+			Messages []struct {
+				Content string `json:"content"`
+			} `json:"messages"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		if strings.Contains(req.Messages[0].Content, "slow") {
+			time.Sleep(300 * time.Millisecond)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		gotAuth = r.Header.Get("Authorization")
+		gotPrompt = req.Messages[0].Content
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"choices": []map[string]interface{}{{"message": map[string]string{"role": "assistant", "content": answer}}},
+		})
+	}))
+	defer llm.Close()
+
+	hook := make(chan map[string]interface{}, 5)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&payload)
+		hook <- payload
+	}))
+	defer receiver.Close()
+	apiRequest(t, "POST", ts.URL+"/api/webhooks/create", apiKey, map[string]string{"url": receiver.URL, "method": "POST"}, nil)
+
+	if resp := apiRequest(t, "POST", ts.URL+"/api/enrichment", apiKey, map[string]interface{}{"enabled": true, "model": "m"}, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected 400 without endpoint, got %d", resp.StatusCode)
+	}
+	if resp := apiRequest(t, "POST", ts.URL+"/api/enrichment", apiKey, map[string]interface{}{"prompt": "{{unknown}}"}, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for unknown prompt variable, got %d", resp.StatusCode)
+	}
+
+	apiRequest(t, "POST", ts.URL+"/api/secrets", apiKey, map[string]string{"name": "LLM_KEY", "value": "sk-test"}, nil)
+	var settings map[string]interface{}
+	resp := apiRequest(t, "POST", ts.URL+"/api/enrichment", apiKey, map[string]interface{}{
+		"enabled": true, "endpoint": llm.URL + "/v1/", "api_key": "{{secret.LLM_KEY}}", "model": "tiny",
+		"prompt": "From {{name}}: {{text}}", "timeout_ms": 200,
+	}, &settings)
+	if resp.StatusCode != 200 || settings["api_key_set"] != true || settings["api_key"] != nil || settings["endpoint"] != llm.URL+"/v1" {
+		t.Fatalf("Unexpected settings, status %d: %v", resp.StatusCode, settings)
+	}
+
+	receive := func(text string) map[string]interface{} {
+		forwardToWebhooks(email, map[string]interface{}{"id": text, "from": "14155550000@s.whatsapp.net", "to": "14155550000@s.whatsapp.net",
+			"name": "Ann", "type": "text", "text": text, "timestamp": time.Now().Unix()}, "", "test_media")
+		select {
+		case payload := <-hook:
+			return payload
+		case <-time.After(5 * time.Second):
+			t.Fatal("Webhook not called")
+			return nil
+		}
+	}
+
+	payload := receive("I want my money back")
+	enrichment, _ := payload["enrichment"].(map[string]interface{})
+	if enrichment["intent"] != "refund" || enrichment["model"] != "tiny" {
+		t.Fatalf("Unexpected enrichment: %v", payload["enrichment"])
+	}
+	mu.Lock()
+	auth, prompt := gotAuth, gotPrompt
+	mu.Unlock()
+	if auth != "Bearer sk-test" || prompt != "From Ann: I want my money back" {
+		t.Fatalf("Unexpected LLM request: auth=%q prompt=%q", auth, prompt)
+	}
+
+	// A timeout forwards the message without enrichment
+	if payload := receive("slow one"); payload["enrichment"] != nil {
+		t.Fatalf("Expected no enrichment after a timeout, got %v", payload["enrichment"])
+	}
+
+	// Saving without api_key keeps it; plain-text answers are wrapped
+	apiRequest(t, "POST", ts.URL+"/api/enrichment", apiKey, map[string]interface{}{
+		"enabled": false, "endpoint": llm.URL + "/v1", "model": "tiny",
+	}, &settings)
+	if settings["api_key_set"] != true {
+		t.Fatalf("Expected api key kept, got %v", settings)
+	}
+	mu.Lock()
+	answer = "complaint"
+	mu.Unlock()
+	var tested map[string]map[string]interface{}
+	if resp := apiRequest(t, "POST", ts.URL+"/api/enrichment/test", apiKey, map[string]string{"text": "this is broken"}, &tested); resp.StatusCode != 200 || tested["enrichment"]["result"] != "complaint" {
+		t.Fatalf("Unexpected test result, status %d: %v", resp.StatusCode, tested)
+	}
+	if payload := receive("disabled now"); payload["enrichment"] != nil {
+		t.Fatalf("Expected no enrichment when disabled, got %v", payload["enrichment"])
+	}
+}
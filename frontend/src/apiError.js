@@ -0,0 +1,11 @@
+// API errors are JSON: {"error": {"code": "...", "message": "..."}}.
+// Returns the human-readable message, falling back to the raw body.
+export async function apiErrorMessage(res) {
+  const text = await res.text()
+  try {
+    const data = JSON.parse(text)
+    return (data.error && data.error.message) || text
+  } catch (e) {
+    return text
+  }
+}
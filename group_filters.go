@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// --- Group name filters ---
+// Group filters can pick groups by subject: "name:Support" matches groups whose
+// subject contains "Support", "name:Support*" those starting with it (case-insensitive,
+// * matches anything). Subjects come from the cached joined-group list and are kept
+// up to date from group change events, so renaming a group into or out of a pattern
+// takes effect on its next message.
+
+const (
+	GROUP_NAME_PREFIX             = "name:"
+	MAX_GROUP_NAME_PATTERN_LENGTH = 100
+)
+
+// Group subjects by JID; a group has the same subject for every user in it
+var groupSubjects = struct {
+	sync.RWMutex
+	data map[string]string
+}{data: make(map[string]string)}
+
+func rememberGroupSubject(groupJID, subject string) {
+	groupSubjects.Lock()
+	groupSubjects.data[groupJID] = subject
+	groupSubjects.Unlock()
+}
+
+func groupSubject(groupJID string) (string, bool) {
+	groupSubjects.RLock()
+	defer groupSubjects.RUnlock()
+	subject, ok := groupSubjects.data[groupJID]
+	return subject, ok
+}
+
+// Make sure a group's subject is known before filters are applied to its messages,
+// refreshing the user's group list if it isn't
+func loadGroupSubject(email, groupJID string) {
+	if !strings.HasSuffix(groupJID, "@g.us") {
+		return
+	}
+	if _, ok := groupSubject(groupJID); ok {
+		return
+	}
+	if client := userWAClient(email); client != nil {
+		getCachedGroups(email, client)
+	}
+}
+
+// Track subject changes and newly joined groups
+func handleGroupInfoEvent(evt interface{}) {
+	switch v := evt.(type) {
+	case *events.GroupInfo:
+		if v.Name != nil {
+			fmt.Printf("DEBUG: Group %s renamed to %q\n", v.JID, v.Name.Name)
+			rememberGroupSubject(v.JID.String(), v.Name.Name)
+		}
+	case *events.JoinedGroup:
+		rememberGroupSubject(v.JID.String(), v.Name)
+	}
+}
+
+// The pattern of a "name:" filter entry
+func validateGroupNamePattern(pattern string) error {
+	if pattern == "" || pattern == "*" {
+		return errors.New("empty group name pattern")
+	}
+	if len(pattern) > MAX_GROUP_NAME_PATTERN_LENGTH {
+		return fmt.Errorf("group name pattern too long (max %d characters)", MAX_GROUP_NAME_PATTERN_LENGTH)
+	}
+	return nil
+}
+
+// Whether a subject matches a lowercased pattern: a substring, or with * a glob
+// over the whole subject
+func groupNameMatches(pattern, subject string) bool {
+	subject = strings.ToLower(subject)
+	if !strings.Contains(pattern, "*") {
+		return strings.Contains(subject, pattern)
+	}
+	parts := strings.Split(pattern, "*")
+	if !strings.HasPrefix(subject, parts[0]) {
+		return false
+	}
+	subject = subject[len(parts[0]):]
+	last := parts[len(parts)-1]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(subject, part)
+		if i < 0 {
+			return false
+		}
+		subject = subject[i+len(part):]
+	}
+	return len(subject) >= len(last) && strings.HasSuffix(subject, last)
+}
+
+func matchesAnyGroupName(patterns []string, groupJID string) bool {
+	if len(patterns) == 0 {
+		return false
+	}
+	subject, ok := groupSubject(groupJID)
+	if !ok {
+		return false
+	}
+	for _, pattern := range patterns {
+		if groupNameMatches(pattern, subject) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+func TestGroupNameFilters(t *testing.T) {
+	if _, err := normalizeFilterValue("chat", "name:Support"); err == nil {
+		t.Fatal("Expected name: entries to be rejected in chat filters")
+	}
+	for _, value := range []string{"name:", "name: *"} {
+		if _, err := normalizeFilterValue("group", value); err == nil {
+			t.Fatalf("Expected %q to be rejected", value)
+		}
+	}
+
+	// Subjects come from the user's group list the first time a group is seen
+	email := "groupnames@example.com"
+	fake := useFakeWAClient(t, email)
+	support := types.NewJID("120363000000000101", types.GroupServer)
+	fake.groups = []*types.GroupInfo{{JID: support, GroupName: types.GroupName{Name: "Support EU"}}}
+	loadGroupSubject(email, support.String())
+	if subject, ok := groupSubject(support.String()); !ok || subject != "Support EU" {
+		t.Fatalf("Expected the subject from the group list, got %q", subject)
+	}
+
+	wh := Webhook{URL: "https://example.com/hook", Method: "POST", FilterType: "group", FilterValue: " name:support , !name:*test*"}
+	if err := validateWebhookConfig(&wh); err != nil || wh.FilterValue != "name:support,!name:*test*" {
+		t.Fatalf("Unexpected filter: %q %v", wh.FilterValue, err)
+	}
+	if !webhookMatchesChat(wh, support.String(), "") {
+		t.Fatal("Expected the support group to match")
+	}
+	if webhookMatchesChat(wh, "120363000000000102@g.us", "") {
+		t.Fatal("Expected a group with an unknown subject not to match")
+	}
+
+	// Renames are picked up from group events
+	handleGroupInfoEvent(&events.GroupInfo{JID: support, Name: &types.GroupName{Name: "Support EU (test)"}})
+	if webhookMatchesChat(wh, support.String(), "") {
+		t.Fatal("Expected the renamed group to be excluded")
+	}
+	handleGroupInfoEvent(&events.GroupInfo{JID: support, Name: &types.GroupName{Name: "Sales"}})
+	if webhookMatchesChat(wh, support.String(), "") {
+		t.Fatal("Expected a group renamed away from the pattern not to match")
+	}
+
+	for pattern, want := range map[string]bool{
+		"sales": true, "sa*": true, "*les": true, "s*l*s": true, "*x*": false, "ales*": false,
+	} {
+		if got := groupNameMatches(pattern, "Sales"); got != want {
+			t.Errorf("Pattern %q on Sales: got %v, want %v", pattern, got, want)
+		}
+	}
+}
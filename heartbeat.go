@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// --- Heartbeat event ---
+// Webhooks subscribed to "heartbeat" get one every WEBHOOK_HEARTBEAT_INTERVAL, with
+// the WhatsApp connection status, queue counters and received-message counters. A
+// receiver that stops getting them (allowing for interval_seconds) knows the bridge
+// itself is down, rather than the chats just being quiet.
+
+const (
+	DEFAULT_WEBHOOK_HEARTBEAT_INTERVAL = 5 * time.Minute
+	MIN_WEBHOOK_HEARTBEAT_INTERVAL     = 10 * time.Second
+)
+
+var webhookHeartbeatInterval = DEFAULT_WEBHOOK_HEARTBEAT_INTERVAL
+
+// Messages received per user since the server started
+var receivedCounters = struct {
+	sync.Mutex
+	data map[string]*receivedCounter
+}{data: make(map[string]*receivedCounter)}
+
+type receivedCounter struct {
+	count  int64
+	lastAt time.Time
+}
+
+// Read WEBHOOK_HEARTBEAT_INTERVAL; 0 turns heartbeats off
+func initHeartbeat() {
+	webhookHeartbeatInterval = DEFAULT_WEBHOOK_HEARTBEAT_INTERVAL
+	if value := os.Getenv("WEBHOOK_HEARTBEAT_INTERVAL"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || (d != 0 && d < MIN_WEBHOOK_HEARTBEAT_INTERVAL) {
+			fmt.Printf("WARNING: Ignoring WEBHOOK_HEARTBEAT_INTERVAL=%q, expected 0 or a duration of at least %s\n", value, MIN_WEBHOOK_HEARTBEAT_INTERVAL)
+		} else {
+			webhookHeartbeatInterval = d
+		}
+	}
+}
+
+func recordMessageReceived(email string, at time.Time) {
+	receivedCounters.Lock()
+	defer receivedCounters.Unlock()
+	c, ok := receivedCounters.data[email]
+	if !ok {
+		c = &receivedCounter{}
+		receivedCounters.data[email] = c
+	}
+	c.count++
+	if at.After(c.lastAt) {
+		c.lastAt = at
+	}
+}
+
+// The heartbeat of one user: connection, queue and received-message counters
+func heartbeatPayload(email string, now time.Time) map[string]interface{} {
+	data := map[string]interface{}{
+		"interval_seconds": int(webhookHeartbeatInterval.Seconds()),
+		"uptime_seconds":   int64(now.Sub(serverStartedAt).Seconds()),
+	}
+	wa := map[string]interface{}{"status": "disconnected"}
+	status := userWAStatusResponse(email)
+	for _, key := range []string{"status", "connected_since", "last_seen_at", "last_error"} {
+		if value, ok := status[key]; ok && value != "" {
+			wa[key] = value
+		}
+	}
+	data["whatsapp"] = wa
+
+	queue := map[string]interface{}{"queued": 0, "pending_approval": 0, "paused": false, "sent_last_hour": 0, "sent_today": 0}
+	queueMutex.RLock()
+	q, ok := messageQueues[email]
+	queueMutex.RUnlock()
+	if ok {
+		q.mu.Lock()
+		q.resetLimitCounters(now)
+		queue["queued"], queue["pending_approval"], queue["paused"] = len(q.Messages), len(q.Pending), q.Paused
+		queue["sent_last_hour"], queue["sent_today"] = q.HourlyCount, q.DailyCount
+		q.mu.Unlock()
+	}
+	data["queue"] = queue
+
+	received := map[string]interface{}{"count": int64(0)}
+	receivedCounters.Lock()
+	if c, ok := receivedCounters.data[email]; ok {
+		received["count"] = c.count
+		received["last_message_at"] = c.lastAt.UTC().Format(time.RFC3339)
+	}
+	receivedCounters.Unlock()
+	data["received"] = received
+	return data
+}
+
+// Send a heartbeat to every webhook subscribed to it
+func sendHeartbeats(now time.Time) {
+	rows, err := readDB.Query(`SELECT DISTINCT user_id FROM webhooks WHERE events LIKE ?`, "%"+EVENT_HEARTBEAT+"%")
+	if err != nil {
+		fmt.Println("ERROR: Could not list heartbeat subscribers", err)
+		return
+	}
+	var userIDs []int64
+	for rows.Next() {
+		var id int64
+		if rows.Scan(&id) == nil {
+			userIDs = append(userIDs, id)
+		}
+	}
+	rows.Close()
+	for _, userID := range userIDs {
+		if email := getUserEmailByID(userID); email != "" {
+			emitWebhookEvent(email, EVENT_HEARTBEAT, "", heartbeatPayload(email, now))
+		}
+	}
+}
+
+func startHeartbeats() {
+	if webhookHeartbeatInterval <= 0 {
+		return
+	}
+	runEvery(webhookHeartbeatInterval, func(now time.Time) {
+		sendHeartbeats(now)
+	})
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWebhookHeartbeat(t *testing.T) {
+	t.Cleanup(initHeartbeat)
+	t.Setenv("WEBHOOK_HEARTBEAT_INTERVAL", "5s")
+	initHeartbeat()
+	if webhookHeartbeatInterval != DEFAULT_WEBHOOK_HEARTBEAT_INTERVAL {
+		t.Fatalf("Expected an interval below the minimum to be ignored, got %s", webhookHeartbeatInterval)
+	}
+	t.Setenv("WEBHOOK_HEARTBEAT_INTERVAL", "1m")
+	initHeartbeat()
+
+	ts, teardown := setupTestServer()
+	defer teardown()
+	email := "heartbeat@example.com"
+	_, apiKey := registerWithAPIKey(t, ts, email, "heartbeatpass123")
+
+	received := make(chan map[string]interface{}, 5)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var payload map[string]interface{}
+		json.Unmarshal(body, &payload)
+		received <- payload
+	}))
+	defer receiver.Close()
+	// Filtered on a group no message comes from, so only the heartbeat arrives
+	apiRequest(t, "POST", ts.URL+"/api/webhooks/create", apiKey, map[string]interface{}{
+		"url": receiver.URL, "method": "POST", "filter_type": "group", "filter_value": "120363000000000999@g.us", "events": []string{"heartbeat"},
+	}, nil)
+	apiRequest(t, "POST", ts.URL+"/api/webhooks/create", apiKey, map[string]interface{}{"url": receiver.URL, "method": "POST", "filter_type": "group", "filter_value": "120363000000000999@g.us"}, nil)
+
+	forwardToWebhooks(email, map[string]interface{}{"id": "HB1", "from": "14155550000@s.whatsapp.net", "to": "14155550000@s.whatsapp.net",
+		"type": "text", "text": "hi", "timestamp": time.Now().Unix()}, "", "test_media")
+	getOrCreateQueue(email)
+
+	sendHeartbeats(time.Now())
+	var payload map[string]interface{}
+	select {
+	case payload = <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Heartbeat not delivered")
+	}
+	whatsapp, _ := payload["whatsapp"].(map[string]interface{})
+	queue, _ := payload["queue"].(map[string]interface{})
+	counts, _ := payload["received"].(map[string]interface{})
+	if payload["event"] != EVENT_HEARTBEAT || payload["interval_seconds"] != float64(60) || whatsapp["status"] != "disconnected" || queue["queued"] != float64(0) || counts["count"] != float64(1) || counts["last_message_at"] == nil {
+		t.Fatalf("Unexpected heartbeat: %v", payload)
+	}
+	select {
+	case extra := <-received:
+		t.Fatalf("Expected one heartbeat, for the subscribed webhook only, got %v", extra)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
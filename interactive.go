@@ -0,0 +1,222 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+// --- Interactive messages ---
+// A send can offer structured choices: up to 3 reply buttons, or a list of rows in
+// sections opened from a button. WhatsApp clients that render them show the choices,
+// and the pick comes back as an "interactive_reply" message with the chosen ID. Where
+// they can't be shown (Telegram and Signal chats) the message is sent as fallback text
+// listing the choices as numbered lines.
+
+const (
+	MAX_INTERACTIVE_BUTTONS  = 3
+	MAX_INTERACTIVE_ROWS     = 10 // Across all sections of a list
+	MAX_INTERACTIVE_SECTIONS = 10
+	MAX_BUTTON_TITLE_LENGTH  = 20
+	MAX_ROW_TITLE_LENGTH     = 24
+	MAX_ROW_DESC_LENGTH      = 72
+	MAX_FOOTER_LENGTH        = 60
+	MAX_CHOICE_ID_LENGTH     = 200
+)
+
+type InteractiveButton struct {
+	ID    string `json:"id"`
+	Title string `json:"title"`
+}
+
+type InteractiveRow struct {
+	ID          string `json:"id"`
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+}
+
+type InteractiveSection struct {
+	Title string           `json:"title,omitempty"`
+	Rows  []InteractiveRow `json:"rows"`
+}
+
+type InteractiveList struct {
+	Button   string               `json:"button"` // Text of the button that opens the list
+	Sections []InteractiveSection `json:"sections"`
+}
+
+// Choices to send with a message's text (the body); either Buttons or List
+type InteractiveMessage struct {
+	Buttons  []InteractiveButton `json:"buttons,omitempty"`
+	List     *InteractiveList    `json:"list,omitempty"`
+	Footer   string              `json:"footer,omitempty"`
+	Fallback string              `json:"fallback_text,omitempty"` // Sent where choices can't be shown; generated if empty
+}
+
+func checkChoice(kind, id, title string, maxTitle int, ids map[string]bool) error {
+	if id == "" || title == "" {
+		return fmt.Errorf("Every %s needs an id and a title", kind)
+	}
+	if len(id) > MAX_CHOICE_ID_LENGTH {
+		return fmt.Errorf("%s id %q is longer than %d characters", kind, id, MAX_CHOICE_ID_LENGTH)
+	}
+	if utf8.RuneCountInString(title) > maxTitle {
+		return fmt.Errorf("%s title %q is longer than %d characters", kind, title, maxTitle)
+	}
+	if ids[id] {
+		return fmt.Errorf("Duplicate %s id %q", kind, id)
+	}
+	ids[id] = true
+	return nil
+}
+
+// Check an interactive message against WhatsApp's limits
+func validateInteractive(m *InteractiveMessage) error {
+	if (len(m.Buttons) > 0) == (m.List != nil) {
+		return errors.New("Interactive messages need either buttons or a list")
+	}
+	if utf8.RuneCountInString(m.Footer) > MAX_FOOTER_LENGTH {
+		return fmt.Errorf("Footer is longer than %d characters", MAX_FOOTER_LENGTH)
+	}
+	ids := map[string]bool{}
+	if len(m.Buttons) > MAX_INTERACTIVE_BUTTONS {
+		return fmt.Errorf("At most %d buttons", MAX_INTERACTIVE_BUTTONS)
+	}
+	for _, b := range m.Buttons {
+		if err := checkChoice("button", b.ID, b.Title, MAX_BUTTON_TITLE_LENGTH, ids); err != nil {
+			return err
+		}
+	}
+	if m.List == nil {
+		return nil
+	}
+	if m.List.Button == "" || utf8.RuneCountInString(m.List.Button) > MAX_BUTTON_TITLE_LENGTH {
+		return fmt.Errorf("The list needs a button text of at most %d characters", MAX_BUTTON_TITLE_LENGTH)
+	}
+	if len(m.List.Sections) == 0 || len(m.List.Sections) > MAX_INTERACTIVE_SECTIONS {
+		return fmt.Errorf("The list needs 1 to %d sections", MAX_INTERACTIVE_SECTIONS)
+	}
+	rows := 0
+	for _, section := range m.List.Sections {
+		if len(section.Rows) == 0 {
+			return errors.New("Every list section needs rows")
+		}
+		if utf8.RuneCountInString(section.Title) > MAX_ROW_TITLE_LENGTH {
+			return fmt.Errorf("Section title %q is longer than %d characters", section.Title, MAX_ROW_TITLE_LENGTH)
+		}
+		for _, row := range section.Rows {
+			if err := checkChoice("row", row.ID, row.Title, MAX_ROW_TITLE_LENGTH, ids); err != nil {
+				return err
+			}
+			if utf8.RuneCountInString(row.Description) > MAX_ROW_DESC_LENGTH {
+				return fmt.Errorf("Row description is longer than %d characters", MAX_ROW_DESC_LENGTH)
+			}
+			rows++
+		}
+	}
+	if rows > MAX_INTERACTIVE_ROWS {
+		return fmt.Errorf("At most %d rows in a list", MAX_INTERACTIVE_ROWS)
+	}
+	return nil
+}
+
+// Plain text version of an interactive message: the body, then the choices numbered
+func interactiveFallbackText(body string, m *InteractiveMessage) string {
+	if m.Fallback != "" {
+		return m.Fallback
+	}
+	var b strings.Builder
+	b.WriteString(body)
+	b.WriteString("\n")
+	n := 0
+	choice := func(title, description string) {
+		n++
+		fmt.Fprintf(&b, "\n%d. %s", n, title)
+		if description != "" {
+			b.WriteString(" - " + description)
+		}
+	}
+	for _, button := range m.Buttons {
+		choice(button.Title, "")
+	}
+	if m.List != nil {
+		for _, section := range m.List.Sections {
+			if section.Title != "" {
+				b.WriteString("\n" + section.Title)
+			}
+			for _, row := range section.Rows {
+				choice(row.Title, row.Description)
+			}
+		}
+	}
+	if m.Footer != "" {
+		b.WriteString("\n\n" + m.Footer)
+	}
+	return b.String()
+}
+
+// Build the WhatsApp buttons or list message
+func buildInteractiveMessage(body string, m *InteractiveMessage) *waProto.Message {
+	if m.List == nil {
+		buttons := make([]*waProto.ButtonsMessage_Button, len(m.Buttons))
+		for i, button := range m.Buttons {
+			buttons[i] = &waProto.ButtonsMessage_Button{
+				ButtonID:   proto.String(button.ID),
+				ButtonText: &waProto.ButtonsMessage_Button_ButtonText{DisplayText: proto.String(button.Title)},
+				Type:       waProto.ButtonsMessage_Button_RESPONSE.Enum(),
+			}
+		}
+		return &waProto.Message{ButtonsMessage: &waProto.ButtonsMessage{
+			ContentText: proto.String(body),
+			FooterText:  proto.String(m.Footer),
+			HeaderType:  waProto.ButtonsMessage_EMPTY.Enum(),
+			Buttons:     buttons,
+		}}
+	}
+
+	sections := make([]*waProto.ListMessage_Section, len(m.List.Sections))
+	for i, section := range m.List.Sections {
+		rows := make([]*waProto.ListMessage_Row, len(section.Rows))
+		for j, row := range section.Rows {
+			rows[j] = &waProto.ListMessage_Row{
+				RowID:       proto.String(row.ID),
+				Title:       proto.String(row.Title),
+				Description: proto.String(row.Description),
+			}
+		}
+		sections[i] = &waProto.ListMessage_Section{Title: proto.String(section.Title), Rows: rows}
+	}
+	return &waProto.Message{ListMessage: &waProto.ListMessage{
+		Description: proto.String(body),
+		ButtonText:  proto.String(m.List.Button),
+		ListType:    waProto.ListMessage_SINGLE_SELECT.Enum(),
+		Sections:    sections,
+		FooterText:  proto.String(m.Footer),
+	}}
+}
+
+// The choice picked in a reply to buttons or a list, as forwarded to webhooks; nil for
+// other messages
+func interactiveReplyPayload(msg *waProto.Message) map[string]interface{} {
+	if reply := msg.GetButtonsResponseMessage(); reply != nil {
+		return map[string]interface{}{
+			"kind":          "button",
+			"id":            reply.GetSelectedButtonID(),
+			"title":         reply.GetSelectedDisplayText(),
+			"to_message_id": reply.GetContextInfo().GetStanzaID(),
+		}
+	}
+	if reply := msg.GetListResponseMessage(); reply != nil {
+		return map[string]interface{}{
+			"kind":          "list",
+			"id":            reply.GetSingleSelectReply().GetSelectedRowID(),
+			"title":         reply.GetTitle(),
+			"to_message_id": reply.GetContextInfo().GetStanzaID(),
+		}
+	}
+	return nil
+}
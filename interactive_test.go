@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestInteractiveMessages(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+
+	email := "menu@example.com"
+	_, apiKey := registerWithAPIKey(t, ts, email, "menupass123")
+	fake := useFakeWAClient(t, email)
+	chat := "14155550100@s.whatsapp.net"
+
+	list := &InteractiveMessage{
+		List: &InteractiveList{Button: "Menu", Sections: []InteractiveSection{
+			{Title: "Orders", Rows: []InteractiveRow{{ID: "track", Title: "Track my order"}, {ID: "cancel", Title: "Cancel", Description: "Before it ships"}}},
+		}},
+		Footer: "Reply anytime",
+	}
+	resp := apiRequest(t, "POST", ts.URL+"/api/messages/send", apiKey, map[string]interface{}{"chat_jid": chat, "message": "How can we help?", "interactive": list}, nil)
+	if resp.StatusCode != 200 {
+		t.Fatalf("Send failed: %d", resp.StatusCode)
+	}
+	deadline := time.Now().Add(15 * time.Second)
+	for len(fake.sentMessages()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	sent := fake.sentMessages()
+	if len(sent) != 1 {
+		t.Fatalf("Expected the list to be sent, got %+v", sent)
+	}
+	listMsg := sent[0].Message.GetListMessage()
+	if listMsg.GetDescription() != "How can we help?" || listMsg.GetButtonText() != "Menu" || len(listMsg.GetSections()[0].GetRows()) != 2 ||
+		listMsg.GetSections()[0].GetRows()[1].GetRowID() != "cancel" {
+		t.Fatalf("Unexpected list message: %+v", sent[0].Message)
+	}
+
+	fallback := interactiveFallbackText("How can we help?", list)
+	if want := "How can we help?\n\nOrders\n1. Track my order\n2. Cancel - Before it ships\n\nReply anytime"; fallback != want {
+		t.Fatalf("Unexpected fallback text:\n%s", fallback)
+	}
+	buttons := buildInteractiveMessage("Confirm?", &InteractiveMessage{Buttons: []InteractiveButton{{ID: "yes", Title: "Yes"}, {ID: "no", Title: "No"}}})
+	if b := buttons.GetButtonsMessage().GetButtons(); len(b) != 2 || b[0].GetButtonID() != "yes" || b[1].GetButtonText().GetDisplayText() != "No" {
+		t.Fatalf("Unexpected buttons message: %+v", buttons)
+	}
+
+	for _, bad := range []*InteractiveMessage{
+		{},
+		{Buttons: []InteractiveButton{{ID: "a", Title: "A"}, {ID: "b", Title: "B"}, {ID: "c", Title: "C"}, {ID: "d", Title: "D"}}},
+		{Buttons: []InteractiveButton{{ID: "a", Title: "A"}, {ID: "a", Title: "Again"}}},
+		{Buttons: []InteractiveButton{{ID: "a", Title: strings.Repeat("x", MAX_BUTTON_TITLE_LENGTH+1)}}},
+		{List: &InteractiveList{Button: "Menu"}},
+	} {
+		if resp := apiRequest(t, "POST", ts.URL+"/api/messages/send", apiKey, map[string]interface{}{"chat_jid": chat, "message": "Pick one", "interactive": bad}, nil); resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("Expected 400 for %+v, got %d", bad, resp.StatusCode)
+		}
+	}
+
+	reply := interactiveReplyPayload(&waProto.Message{ListResponseMessage: &waProto.ListResponseMessage{
+		Title:             proto.String("Cancel"),
+		SingleSelectReply: &waProto.ListResponseMessage_SingleSelectReply{SelectedRowID: proto.String("cancel")},
+		ContextInfo:       &waProto.ContextInfo{StanzaID: proto.String("3EB0LIST")},
+	}})
+	if reply["kind"] != "list" || reply["id"] != "cancel" || reply["title"] != "Cancel" || reply["to_message_id"] != "3EB0LIST" {
+		t.Fatalf("Unexpected reply payload: %v", reply)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// Matches chat.whatsapp.com invite links, with or without scheme
+var groupInviteLinkRegex = regexp.MustCompile(`(?i)(?:https?://)?chat\.whatsapp\.com/(?:invite/)?([A-Za-z0-9]{20,24})`)
+
+// Extract the invite code from the first group invite link found in text
+func extractGroupInviteCode(text string) string {
+	match := groupInviteLinkRegex.FindStringSubmatch(text)
+	if match == nil {
+		return ""
+	}
+	return match[1]
+}
+
+// Build the structured group_invite payload field for an incoming message.
+// Returns nil if the message carries neither an invite link nor an invite message.
+func groupInvitePayload(msg *waProto.Message, sender types.JID) map[string]interface{} {
+	if inv := msg.GetGroupInviteMessage(); inv != nil {
+		return map[string]interface{}{
+			"source":     "invite_message",
+			"code":       inv.GetInviteCode(),
+			"group_jid":  inv.GetGroupJID(),
+			"group_name": inv.GetGroupName(),
+			"inviter":    sender.String(),
+			"expiration": inv.GetInviteExpiration(),
+			"caption":    inv.GetCaption(),
+		}
+	}
+
+	text := msg.GetConversation()
+	if text == "" {
+		text = msg.GetExtendedTextMessage().GetText()
+	}
+	code := extractGroupInviteCode(text)
+	if code == "" {
+		return nil
+	}
+	return map[string]interface{}{
+		"source": "link",
+		"code":   code,
+		"link":   whatsmeow.InviteLinkPrefix + code,
+	}
+}
+
+// POST /api/wa/groups/join
+// Accepts either an invite link (or bare code), or the fields of a
+// group_invite payload from an invite message (code, group_jid, inviter, expiration).
+func handleJoinGroup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Link       string `json:"link"`
+		Code       string `json:"code"`
+		GroupJID   string `json:"group_jid"`
+		Inviter    string `json:"inviter"`
+		Expiration int64  `json:"expiration"`
+	}
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+
+	code := req.Code
+	if req.Link != "" {
+		code = extractGroupInviteCode(req.Link)
+		if code == "" {
+			apiError(w, "Invalid group invite link", http.StatusBadRequest)
+			return
+		}
+	}
+	if code == "" {
+		apiError(w, "Missing link or code", http.StatusBadRequest)
+		return
+	}
+
+	userID := r.Context().Value("userID").(int64)
+	email := getUserEmailByID(userID)
+
+	client := userWAClient(email)
+	if client == nil {
+		writeAPIError(w, http.StatusServiceUnavailable, ERR_WA_DISCONNECTED, "WhatsApp client not connected")
+		return
+	}
+
+	var groupJID types.JID
+	var err error
+	if req.GroupJID != "" {
+		// Invite messages are accepted differently from invite links
+		groupJID, err = types.ParseJID(req.GroupJID)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, ERR_INVALID_JID, "Invalid group_jid")
+			return
+		}
+		inviter, perr := types.ParseJID(req.Inviter)
+		if perr != nil || req.Inviter == "" {
+			writeAPIError(w, http.StatusBadRequest, ERR_INVALID_JID, "Invalid or missing inviter")
+			return
+		}
+		err = client.JoinGroupWithInvite(groupJID, inviter, code, req.Expiration)
+	} else {
+		groupJID, err = client.JoinGroupWithLink(code)
+	}
+	if err != nil {
+		fmt.Printf("ERROR: Failed to join group for user %s: %v\n", email, err)
+		if errors.Is(err, whatsmeow.ErrInviteLinkRevoked) || errors.Is(err, whatsmeow.ErrInviteLinkInvalid) {
+			apiError(w, "Invite link is invalid or revoked", http.StatusBadRequest)
+			return
+		}
+		apiError(w, "Failed to join group", http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Printf("SUCCESS: User %s joined group %s\n", email, groupJID)
+	addRecentChat(email, groupJID.String(), "", "group")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":   true,
+		"group_jid": groupJID.String(),
+	})
+}
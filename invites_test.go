@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+)
+
+func TestExtractGroupInviteCode(t *testing.T) {
+	cases := map[string]string{
+		"join us https://chat.whatsapp.com/AbCdEfGhIjKlMnOpQrStUv ok": "AbCdEfGhIjKlMnOpQrStUv",
+		"chat.whatsapp.com/invite/AbCdEfGhIjKlMnOpQrStUv":             "AbCdEfGhIjKlMnOpQrStUv",
+		"no link here": "",
+		"https://example.com/AbCdEfGhIjKlMnOpQrStUv": "",
+	}
+	for text, want := range cases {
+		if got := extractGroupInviteCode(text); got != want {
+			t.Errorf("extractGroupInviteCode(%q) = %q, want %q", text, got, want)
+		}
+	}
+}
+
+func TestGroupInvitePayload(t *testing.T) {
+	sender := types.NewJID("12345", types.DefaultUserServer)
+
+	// Plain text without a link
+	if p := groupInvitePayload(&waProto.Message{Conversation: strPtr("hello")}, sender); p != nil {
+		t.Fatalf("Expected no invite payload, got %v", p)
+	}
+
+	// Extended text with a link
+	msg := &waProto.Message{ExtendedTextMessage: &waProto.ExtendedTextMessage{
+		Text: strPtr("https://chat.whatsapp.com/AbCdEfGhIjKlMnOpQrStUv"),
+	}}
+	p := groupInvitePayload(msg, sender)
+	if p == nil || p["source"] != "link" || p["code"] != "AbCdEfGhIjKlMnOpQrStUv" {
+		t.Fatalf("Unexpected link invite payload: %v", p)
+	}
+
+	// Invite message
+	msg = &waProto.Message{GroupInviteMessage: &waProto.GroupInviteMessage{
+		GroupJID:   strPtr("123-456@g.us"),
+		InviteCode: strPtr("xyz"),
+		GroupName:  strPtr("Team"),
+	}}
+	p = groupInvitePayload(msg, sender)
+	if p == nil || p["source"] != "invite_message" || p["group_jid"] != "123-456@g.us" || p["inviter"] != sender.String() {
+		t.Fatalf("Unexpected invite message payload: %v", p)
+	}
+}
+
+func strPtr(s string) *string {
+	return &s
+}
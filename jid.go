@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+// --- JID normalization ---
+// Chats can be given as JIDs or as phone numbers in international format
+// ("+44 20 7946 0958", "5511987654321"). Phone numbers are checked with WhatsApp
+// before sending, which also resolves Brazilian numbers registered without the
+// extra mobile 9 and gives a clear error for numbers that aren't on WhatsApp.
+
+const (
+	PHONE_LOOKUP_TTL          = 24 * time.Hour
+	PHONE_LOOKUP_NEGATIVE_TTL = time.Hour
+)
+
+var errNotOnWhatsApp = errors.New("Phone number is not on WhatsApp")
+
+// Parse a chat given as a JID or a phone number. isPhone reports that the input was a
+// phone number, whose JID should be confirmed with resolvePhoneJID before sending.
+// "@c.us" JIDs are accepted as an alias for "@s.whatsapp.net"; device suffixes are dropped.
+func parseChatJID(input string) (jid types.JID, isPhone bool, err error) {
+	input = strings.TrimSpace(input)
+	if input == "" {
+		return jid, false, errors.New("Empty chat JID")
+	}
+	if !strings.Contains(input, "@") {
+		phone, ok := normalizePhone(input)
+		if !ok {
+			return jid, false, fmt.Errorf("Invalid chat JID or phone number: %q", input)
+		}
+		return types.NewJID(phone, types.DefaultUserServer), true, nil
+	}
+
+	jid, err = types.ParseJID(input)
+	if err != nil || jid.User == "" {
+		return jid, false, fmt.Errorf("Invalid chat JID: %q", input)
+	}
+	switch jid.Server {
+	case types.LegacyUserServer:
+		jid.Server = types.DefaultUserServer
+	case types.DefaultUserServer, types.HiddenUserServer, types.GroupServer, types.NewsletterServer, types.BroadcastServer:
+	case CHANNEL_TELEGRAM:
+		if _, err := strconv.ParseInt(jid.User, 10, 64); err != nil {
+			return jid, false, fmt.Errorf("Invalid Telegram chat ID: %q", jid.User)
+		}
+	case CHANNEL_SIGNAL:
+		phone, ok := normalizePhone(jid.User)
+		if !ok {
+			return jid, false, fmt.Errorf("Invalid Signal phone number: %q", jid.User)
+		}
+		jid.User = phone
+	default:
+		return jid, false, fmt.Errorf("Unsupported JID server: %q", jid.Server)
+	}
+	if jid.Server == types.DefaultUserServer || jid.Server == types.HiddenUserServer {
+		jid = jid.ToNonAD()
+	}
+	return jid, false, nil
+}
+
+// Parse a chat without contacting WhatsApp (phone numbers are used as given)
+func normalizeChatJID(input string) (types.JID, error) {
+	jid, _, err := parseChatJID(input)
+	return jid, err
+}
+
+// Digits of a phone number written with an optional +, spaces, dashes, dots or parentheses.
+// Numbers must include the country code (7-15 digits, E.164).
+func normalizePhone(input string) (string, bool) {
+	input = strings.TrimPrefix(strings.TrimSpace(input), "+")
+	var b strings.Builder
+	for _, r := range input {
+		switch {
+		case r >= '0' && r <= '9':
+			b.WriteRune(r)
+		case r == ' ' || r == '-' || r == '.' || r == '(' || r == ')':
+		default:
+			return "", false
+		}
+	}
+	phone := b.String()
+	if len(phone) < 7 || len(phone) > 15 || phone[0] == '0' {
+		return "", false
+	}
+	return phone, true
+}
+
+// Numbers to look up for a phone. Brazilian mobiles (+55, 2-digit area code) may be
+// registered with or without the 9 that was added to mobile numbers, so both are tried.
+func phoneCandidates(phone string) []string {
+	candidates := []string{phone}
+	if strings.HasPrefix(phone, "55") {
+		switch {
+		case len(phone) == 13 && phone[4] == '9':
+			candidates = append(candidates, phone[:4]+phone[5:])
+		case len(phone) == 12 && phone[4] >= '6':
+			candidates = append(candidates, phone[:4]+"9"+phone[4:])
+		}
+	}
+	return candidates
+}
+
+type phoneLookup struct {
+	jid       types.JID
+	found     bool
+	checkedAt time.Time
+}
+
+// IsOnWhatsApp results per phone number; registrations are global, so shared by all users
+var phoneLookups = struct {
+	mu   sync.Mutex
+	data map[string]phoneLookup
+}{
+	data: make(map[string]phoneLookup),
+}
+
+// Resolve a phone number to the JID WhatsApp knows it by
+func resolvePhoneJID(client WAClient, phone string) (types.JID, error) {
+	phoneLookups.mu.Lock()
+	cached, ok := phoneLookups.data[phone]
+	phoneLookups.mu.Unlock()
+	if ok {
+		ttl := PHONE_LOOKUP_TTL
+		if !cached.found {
+			ttl = PHONE_LOOKUP_NEGATIVE_TTL
+		}
+		if time.Since(cached.checkedAt) < ttl {
+			if !cached.found {
+				return types.JID{}, errNotOnWhatsApp
+			}
+			return cached.jid, nil
+		}
+	}
+
+	candidates := phoneCandidates(phone)
+	queries := make([]string, len(candidates))
+	for i, c := range candidates {
+		queries[i] = "+" + c
+	}
+	results, err := client.IsOnWhatsApp(queries)
+	if err != nil {
+		return types.JID{}, err
+	}
+	lookup := phoneLookup{checkedAt: time.Now()}
+	// Prefer the number as given over the Brazilian variant
+	for _, c := range candidates {
+		for _, res := range results {
+			if res.IsIn && strings.TrimPrefix(res.Query, "+") == c && !lookup.found {
+				lookup.jid, lookup.found = res.JID.ToNonAD(), true
+			}
+		}
+	}
+
+	phoneLookups.mu.Lock()
+	phoneLookups.data[phone] = lookup
+	phoneLookups.mu.Unlock()
+	if !lookup.found {
+		return types.JID{}, errNotOnWhatsApp
+	}
+	if lookup.jid.User != phone {
+		fmt.Printf("INFO: Phone %s is registered on WhatsApp as %s\n", phone, lookup.jid)
+	}
+	return lookup.jid, nil
+}
+
+// Resolve a phone number with the user's WhatsApp client
+func resolveUserPhone(email, phone string) (types.JID, error) {
+	client := userWAClient(email)
+	if client == nil {
+		return types.JID{}, errors.New("WhatsApp client not connected")
+	}
+	return resolvePhoneJID(client, phone)
+}
+
+// --- LIDs ---
+// Newer accounts are addressed by a hidden user ID ("@lid") instead of their phone number.
+// Payloads use the phone-number JID when WhatsApp has shared the mapping, with the LID
+// alongside, so filters and allowed chats keyed on @s.whatsapp.net keep working.
+
+// Phone-number JID for a LID, if the mapping is known
+func lidToPN(client WAClient, lid types.JID) (types.JID, bool) {
+	if client == nil || lid.Server != types.HiddenUserServer {
+		return types.EmptyJID, false
+	}
+	pn, err := client.GetPNForLID(context.Background(), lid.ToNonAD())
+	if err != nil || pn.IsEmpty() {
+		return types.EmptyJID, false
+	}
+	return pn.ToNonAD(), true
+}
+
+// Map a LID with the user's WhatsApp client
+func userLIDToPN(email string, lid types.JID) (types.JID, bool) {
+	return lidToPN(userWAClient(email), lid)
+}
+
+// Phone-number and LID forms of an address; either may be empty. alt is the other form
+// WhatsApp sent with the message, if any.
+func addressForms(client WAClient, jid, alt types.JID) (pn, lid types.JID) {
+	jid, alt = jid.ToNonAD(), alt.ToNonAD()
+	switch jid.Server {
+	case types.HiddenUserServer:
+		lid = jid
+		if alt.Server == types.DefaultUserServer {
+			pn = alt
+		} else if mapped, ok := lidToPN(client, jid); ok {
+			pn = mapped
+		}
+	case types.DefaultUserServer:
+		pn = jid
+		if alt.Server == types.HiddenUserServer {
+			lid = alt
+		}
+	default:
+		pn = jid
+	}
+	return pn, lid
+}
+
+// Set "from"/"to" (phone-number JIDs when known) and "from_lid"/"to_lid" on a message payload
+func addMessageAddresses(client WAClient, payload map[string]interface{}, info types.MessageInfo) {
+	setAddress := func(key string, pn, lid types.JID) {
+		if pn.IsEmpty() {
+			pn = lid // Unknown phone number: the LID is all we have
+		}
+		payload[key] = pn.String()
+		if !lid.IsEmpty() {
+			payload[key+"_lid"] = lid.String()
+		}
+	}
+	senderPN, senderLID := addressForms(client, info.Sender, info.SenderAlt)
+	setAddress("from", senderPN, senderLID)
+	if info.IsGroup {
+		payload["to"] = info.Chat.String()
+		return
+	}
+	// In direct chats the chat is the sender, so the sender's alternative address applies
+	chatPN, chatLID := addressForms(client, info.Chat, info.SenderAlt)
+	setAddress("to", chatPN, chatLID)
+}
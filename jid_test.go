@@ -0,0 +1,205 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+func TestParseChatJID(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    string
+		isPhone bool
+		wantErr bool
+	}{
+		{"5511987654321@s.whatsapp.net", "5511987654321@s.whatsapp.net", false, false},
+		{"5511987654321@c.us", "5511987654321@s.whatsapp.net", false, false},
+		{"5511987654321:12@s.whatsapp.net", "5511987654321@s.whatsapp.net", false, false},
+		{"123456789012345@lid", "123456789012345@lid", false, false},
+		{"120363000000000000@g.us", "120363000000000000@g.us", false, false},
+		{"+55 (11) 98765-4321", "5511987654321@s.whatsapp.net", true, false},
+		{"44.20.7946.0958", "442079460958@s.whatsapp.net", true, false},
+		{"  14155550001 ", "14155550001@s.whatsapp.net", true, false},
+		{"", "", false, true},
+		{"12345", "", false, true},            // Too short
+		{"0611223344", "", false, true},       // No country code
+		{"1234567890123456", "", false, true}, // Too long
+		{"call me", "", false, true},
+		{"123@example.com", "", false, true},
+	}
+	for _, tt := range tests {
+		jid, isPhone, err := parseChatJID(tt.input)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseChatJID(%q) error = %v, wantErr %v", tt.input, err, tt.wantErr)
+			continue
+		}
+		if err == nil && (jid.String() != tt.want || isPhone != tt.isPhone) {
+			t.Errorf("parseChatJID(%q) = %s, %v; want %s, %v", tt.input, jid, isPhone, tt.want, tt.isPhone)
+		}
+	}
+}
+
+func TestPhoneCandidates(t *testing.T) {
+	tests := map[string][]string{
+		"5511987654321": {"5511987654321", "551187654321"}, // Brazilian mobile with the 9
+		"551187654321":  {"551187654321", "5511987654321"}, // ... and without
+		"551133334444":  {"551133334444"},                  // Brazilian landline
+		"14155550001":   {"14155550001"},
+	}
+	for phone, want := range tests {
+		if got := phoneCandidates(phone); !reflect.DeepEqual(got, want) {
+			t.Errorf("phoneCandidates(%s) = %v, want %v", phone, got, want)
+		}
+	}
+}
+
+func TestSendServiceResolvesPhoneNumbers(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+
+	email := "phones@example.com"
+	registerWithAPIKey(t, ts, email, "phonespass123")
+	dbSetQueuePaused(email, true)
+	defer func() {
+		queueMutex.Lock()
+		delete(messageQueues, email)
+		queueMutex.Unlock()
+	}()
+
+	lookupErr := error(nil)
+	svc := &SendService{
+		isConnected: func(string) bool { return true },
+		resolvePhone: func(_, phone string) (types.JID, error) {
+			if lookupErr != nil {
+				return types.JID{}, lookupErr
+			}
+			if phone == "5511987654321" {
+				// Registered without the extra 9
+				return types.NewJID("551187654321", types.DefaultUserServer), nil
+			}
+			return types.JID{}, errNotOnWhatsApp
+		},
+	}
+
+	result, err := svc.Enqueue(SendRequest{UserEmail: email, ChatJID: "+55 11 98765-4321", Message: "oi", Source: "test"})
+	if err != nil {
+		t.Fatalf("Enqueue failed: %v", err)
+	}
+	if result.Message.ChatJID != "551187654321@s.whatsapp.net" {
+		t.Fatalf("Expected resolved JID, got %s", result.Message.ChatJID)
+	}
+
+	_, err = svc.Enqueue(SendRequest{UserEmail: email, ChatJID: "14155550001", Message: "hi", Source: "test"})
+	if sendErr, ok := err.(*SendError); !ok || sendErr.Status != http.StatusBadRequest || sendErr.Code != ERR_NOT_ON_WHATSAPP {
+		t.Fatalf("Expected not_on_whatsapp, got %v", err)
+	}
+
+	lookupErr = errors.New("timeout")
+	_, err = svc.Enqueue(SendRequest{UserEmail: email, ChatJID: "14155550001", Message: "hi", Source: "test"})
+	if sendErr, ok := err.(*SendError); !ok || sendErr.Status != http.StatusBadGateway {
+		t.Fatalf("Expected 502 on lookup failure, got %v", err)
+	}
+
+	// JIDs are used without a lookup
+	result, err = svc.Enqueue(SendRequest{UserEmail: email, ChatJID: "14155550001@c.us", Message: "hi", Source: "test"})
+	if err != nil || result.Message.ChatJID != "14155550001@s.whatsapp.net" {
+		t.Fatalf("Expected normalized JID, got %v %v", result, err)
+	}
+}
+
+func TestWebhookFilterValueNormalized(t *testing.T) {
+	wh := Webhook{Method: "POST", FilterType: "chat", FilterValue: "+1 415 555 0001"}
+	if err := validateWebhookConfig(&wh); err != nil {
+		t.Fatalf("validateWebhookConfig failed: %v", err)
+	}
+	if wh.FilterValue != "14155550001@s.whatsapp.net" {
+		t.Fatalf("Expected normalized filter value, got %s", wh.FilterValue)
+	}
+	wh = Webhook{Method: "POST", FilterType: "chat", FilterValue: "not a chat"}
+	if err := validateWebhookConfig(&wh); err == nil {
+		t.Fatal("Expected invalid filter_value to be rejected")
+	}
+}
+
+func TestMessageAddressesWithLIDs(t *testing.T) {
+	pn := types.NewJID("14155550001", types.DefaultUserServer)
+	lid := types.NewJID("123456789012345", types.HiddenUserServer)
+	group := types.NewJID("120363000000000000", types.GroupServer)
+
+	// Direct message from a LID, with the phone number sent along
+	payload := map[string]interface{}{}
+	info := types.MessageInfo{MessageSource: types.MessageSource{Chat: lid, Sender: lid, SenderAlt: pn}}
+	addMessageAddresses(nil, payload, info)
+	if payload["from"] != pn.String() || payload["from_lid"] != lid.String() || payload["to"] != pn.String() || payload["to_lid"] != lid.String() {
+		t.Fatalf("Unexpected addresses: %v", payload)
+	}
+
+	// Unknown phone number: the LID is used as the address
+	payload = map[string]interface{}{}
+	info = types.MessageInfo{MessageSource: types.MessageSource{Chat: lid, Sender: lid}}
+	addMessageAddresses(nil, payload, info)
+	if payload["from"] != lid.String() || payload["to"] != lid.String() || payload["from_lid"] != lid.String() {
+		t.Fatalf("Unexpected addresses: %v", payload)
+	}
+
+	// Group message: the group stays the chat
+	payload = map[string]interface{}{}
+	info = types.MessageInfo{MessageSource: types.MessageSource{Chat: group, Sender: pn, SenderAlt: lid, IsGroup: true}}
+	addMessageAddresses(nil, payload, info)
+	if payload["from"] != pn.String() || payload["from_lid"] != lid.String() || payload["to"] != group.String() {
+		t.Fatalf("Unexpected addresses: %v", payload)
+	}
+	if _, ok := payload["to_lid"]; ok {
+		t.Fatalf("Group messages should not have to_lid: %v", payload)
+	}
+}
+
+func TestSendServiceMapsLIDs(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+
+	email := "lids@example.com"
+	registerWithAPIKey(t, ts, email, "lidspass123")
+	dbSetQueuePaused(email, true)
+	defer func() {
+		queueMutex.Lock()
+		delete(messageQueues, email)
+		queueMutex.Unlock()
+	}()
+
+	svc := &SendService{
+		isConnected: func(string) bool { return true },
+		lidToPN: func(_ string, lid types.JID) (types.JID, bool) {
+			if lid.User == "111111111111111" {
+				return types.NewJID("14155550001", types.DefaultUserServer), true
+			}
+			return types.EmptyJID, false
+		},
+	}
+
+	// A known LID is sent to as its phone number, and an allowed list may name either
+	for _, allowed := range [][]string{nil, {"14155550001@s.whatsapp.net"}, {"111111111111111@lid"}} {
+		result, err := svc.Enqueue(SendRequest{UserEmail: email, ChatJID: "111111111111111@lid", Message: "hi", AllowedChats: allowed, Source: "test"})
+		if err != nil {
+			t.Fatalf("Enqueue with allowed %v failed: %v", allowed, err)
+		}
+		if result.Message.ChatJID != "14155550001@s.whatsapp.net" {
+			t.Fatalf("Expected LID mapped to phone JID, got %s", result.Message.ChatJID)
+		}
+	}
+
+	// An unknown LID is sent to as-is
+	result, err := svc.Enqueue(SendRequest{UserEmail: email, ChatJID: "222222222222222@lid", Message: "hi", Source: "test"})
+	if err != nil || result.Message.ChatJID != "222222222222222@lid" {
+		t.Fatalf("Expected unmapped LID, got %v %v", result, err)
+	}
+
+	_, err = svc.Enqueue(SendRequest{UserEmail: email, ChatJID: "111111111111111@lid", Message: "hi", AllowedChats: []string{"14155550002@s.whatsapp.net"}, Source: "test"})
+	if sendErr, ok := err.(*SendError); !ok || sendErr.Code != ERR_CHAT_NOT_ALLOWED {
+		t.Fatalf("Expected chat_not_allowed, got %v", err)
+	}
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// --- LLM auto-reply bot ---
+// On chats where the bot is switched on, each incoming text is answered by the LLM
+// configured in /api/enrichment, with the chat's recent history from the message
+// archive as context. Replies go through the send queue and are capped per chat per
+// hour. A message containing the off-switch keyword turns the bot off for that chat
+// and sends a "bot.handoff" event so a person can take over.
+
+const (
+	DEFAULT_BOT_SYSTEM_PROMPT    = "You are a helpful assistant answering WhatsApp messages on behalf of a business. Keep replies short and friendly."
+	DEFAULT_BOT_CONTEXT_MESSAGES = 10
+	MAX_BOT_CONTEXT_MESSAGES     = 50
+	DEFAULT_BOT_REPLIES_PER_HOUR = 10
+	MAX_BOT_REPLIES_PER_HOUR     = 60
+	DEFAULT_BOT_OFF_KEYWORD      = "human"
+	MAX_BOT_CHATS                = 500
+
+	BOT_OFF_KEYWORD = "keyword" // Reason the bot was switched off
+	BOT_OFF_MANUAL  = "manual"
+
+	STAT_BOT_REPLIES      = "bot_replies"
+	STAT_BOT_RATE_LIMITED = "bot_rate_limited"
+	STAT_BOT_FAILED       = "bot_failed"
+)
+
+type BotSettings struct {
+	SystemPrompt      string     `json:"system_prompt"`
+	ContextMessages   int        `json:"context_messages"`     // Archived messages sent as context
+	MaxRepliesPerHour int        `json:"max_replies_per_hour"` // Per chat
+	OffKeyword        string     `json:"off_keyword"`          // Switches the bot off for the chat
+	UpdatedAt         *time.Time `json:"updated_at,omitempty"`
+}
+
+type BotChat struct {
+	ChatJID   string    `json:"chat_jid"`
+	Active    bool      `json:"active"`
+	OffReason string    `json:"off_reason,omitempty"` // "keyword" or "manual" once switched off
+	EnabledAt time.Time `json:"enabled_at"`
+}
+
+// One bot run at a time per chat, so quick successive messages get ordered replies
+var botChatLocks sync.Map
+
+func validateBotSettings(s *BotSettings) error {
+	if strings.TrimSpace(s.SystemPrompt) == "" {
+		s.SystemPrompt = DEFAULT_BOT_SYSTEM_PROMPT
+	}
+	if utf8.RuneCountInString(s.SystemPrompt) > MAX_ENRICHMENT_PROMPT {
+		return fmt.Errorf("system_prompt too long (max %d characters)", MAX_ENRICHMENT_PROMPT)
+	}
+	if s.ContextMessages == 0 {
+		s.ContextMessages = DEFAULT_BOT_CONTEXT_MESSAGES
+	}
+	if s.ContextMessages < 1 || s.ContextMessages > MAX_BOT_CONTEXT_MESSAGES {
+		return fmt.Errorf("Invalid context_messages (1-%d)", MAX_BOT_CONTEXT_MESSAGES)
+	}
+	if s.MaxRepliesPerHour == 0 {
+		s.MaxRepliesPerHour = DEFAULT_BOT_REPLIES_PER_HOUR
+	}
+	if s.MaxRepliesPerHour < 1 || s.MaxRepliesPerHour > MAX_BOT_REPLIES_PER_HOUR {
+		return fmt.Errorf("Invalid max_replies_per_hour (1-%d)", MAX_BOT_REPLIES_PER_HOUR)
+	}
+	s.OffKeyword = normalizeSearchText(s.OffKeyword)
+	if s.OffKeyword == "" {
+		s.OffKeyword = DEFAULT_BOT_OFF_KEYWORD
+	}
+	return nil
+}
+
+func dbGetBotSettings(userID int64) (BotSettings, error) {
+	s := BotSettings{
+		SystemPrompt:      DEFAULT_BOT_SYSTEM_PROMPT,
+		ContextMessages:   DEFAULT_BOT_CONTEXT_MESSAGES,
+		MaxRepliesPerHour: DEFAULT_BOT_REPLIES_PER_HOUR,
+		OffKeyword:        DEFAULT_BOT_OFF_KEYWORD,
+	}
+	var updatedAt string
+	err := db.QueryRow(`SELECT system_prompt, context_messages, max_replies_per_hour, off_keyword, updated_at FROM bot_settings WHERE user_id = ?`, userID).
+		Scan(&s.SystemPrompt, &s.ContextMessages, &s.MaxRepliesPerHour, &s.OffKeyword, &updatedAt)
+	if err == sql.ErrNoRows {
+		return s, nil
+	} else if err != nil {
+		return s, err
+	}
+	if t, err := time.Parse(time.RFC3339, updatedAt); err == nil {
+		s.UpdatedAt = &t
+	}
+	return s, nil
+}
+
+func dbSetBotSettings(userID int64, s BotSettings) error {
+	_, err := db.Exec(`INSERT INTO bot_settings (user_id, system_prompt, context_messages, max_replies_per_hour, off_keyword, updated_at) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT(user_id) DO UPDATE SET system_prompt = excluded.system_prompt, context_messages = excluded.context_messages,
+			max_replies_per_hour = excluded.max_replies_per_hour, off_keyword = excluded.off_keyword, updated_at = excluded.updated_at`,
+		userID, s.SystemPrompt, s.ContextMessages, s.MaxRepliesPerHour, s.OffKeyword, time.Now().UTC().Format(time.RFC3339))
+	return err
+}
+
+func scanBotChat(row interface{ Scan(...interface{}) error }) (BotChat, error) {
+	var c BotChat
+	var enabledAt string
+	err := row.Scan(&c.ChatJID, &c.Active, &c.OffReason, &enabledAt)
+	c.EnabledAt, _ = time.Parse(time.RFC3339, enabledAt)
+	return c, err
+}
+
+func dbListBotChats(userID int64) ([]BotChat, error) {
+	rows, err := db.Query(`SELECT chat_jid, active, off_reason, enabled_at FROM bot_chats WHERE user_id = ? ORDER BY enabled_at DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	chats := []BotChat{}
+	for rows.Next() {
+		c, err := scanBotChat(rows)
+		if err != nil {
+			return nil, err
+		}
+		chats = append(chats, c)
+	}
+	return chats, rows.Err()
+}
+
+func dbGetBotChat(userID int64, chatJID string) (BotChat, error) {
+	return scanBotChat(db.QueryRow(`SELECT chat_jid, active, off_reason, enabled_at FROM bot_chats WHERE user_id = ? AND chat_jid = ?`, userID, chatJID))
+}
+
+func dbEnableBotChat(userID int64, chatJID string) error {
+	var count int
+	db.QueryRow(`SELECT COUNT(*) FROM bot_chats WHERE user_id = ? AND chat_jid != ?`, userID, chatJID).Scan(&count)
+	if count >= MAX_BOT_CHATS {
+		return fmt.Errorf("Too many bot chats (max %d)", MAX_BOT_CHATS)
+	}
+	_, err := db.Exec(`INSERT INTO bot_chats (user_id, chat_jid, active, off_reason, enabled_at) VALUES (?, ?, 1, '', ?)
+		ON CONFLICT(user_id, chat_jid) DO UPDATE SET active = 1, off_reason = '', enabled_at = excluded.enabled_at`,
+		userID, chatJID, time.Now().UTC().Format(time.RFC3339))
+	return err
+}
+
+// Switch the bot off for a chat; false if it wasn't on
+func dbDisableBotChat(userID int64, chatJID, reason string) (bool, error) {
+	res, err := db.Exec(`UPDATE bot_chats SET active = 0, off_reason = ? WHERE user_id = ? AND chat_jid = ? AND active = 1`, reason, userID, chatJID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func dbRecordBotReply(userID int64, chatJID, text string, at time.Time) error {
+	_, err := db.Exec(`INSERT INTO bot_replies (user_id, chat_jid, text, sent_at) VALUES (?, ?, ?, ?)`,
+		userID, chatJID, text, at.Unix())
+	return err
+}
+
+func dbCountBotReplies(userID int64, chatJID string, since time.Time) int {
+	var n int
+	db.QueryRow(`SELECT COUNT(*) FROM bot_replies WHERE user_id = ? AND chat_jid = ? AND sent_at > ?`, userID, chatJID, since.Unix()).Scan(&n)
+	return n
+}
+
+// The chat's last `limit` archived messages and bot replies, oldest first
+func botConversation(userID int64, chatJID string, limit int) ([]chatMessage, error) {
+	type entry struct {
+		at  time.Time
+		msg chatMessage
+	}
+	var entries []entry
+	archived, _, err := dbQueryMessages(userID, messageListOptions{ChatJID: chatJID, Limit: limit})
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range archived {
+		if strings.TrimSpace(m.Text) != "" {
+			entries = append(entries, entry{m.Timestamp, chatMessage{Role: "user", Content: m.Text}})
+		}
+	}
+	rows, err := db.Query(`SELECT text, sent_at FROM bot_replies WHERE user_id = ? AND chat_jid = ? ORDER BY sent_at DESC LIMIT ?`, userID, chatJID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var text string
+		var sentAt int64
+		if err := rows.Scan(&text, &sentAt); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry{time.Unix(sentAt, 0), chatMessage{Role: "assistant", Content: text}})
+	}
+	// Stable, so a reply sent in the same second as a message stays after it
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].at.Before(entries[j].at) })
+	if len(entries) > limit {
+		entries = entries[len(entries)-limit:]
+	}
+	conversation := make([]chatMessage, len(entries))
+	for i, e := range entries {
+		conversation[i] = e.msg
+	}
+	return conversation, rows.Err()
+}
+
+// Answer an incoming message with the LLM if the bot is on for the chat
+func llmBotRespond(email string, userID int64, chatJID string, payload map[string]interface{}) {
+	text, _ := payload["text"].(string)
+	if text == "" {
+		text, _ = payload["caption"].(string)
+	}
+	if strings.TrimSpace(text) == "" {
+		return
+	}
+	chat, err := dbGetBotChat(userID, chatJID)
+	if err != nil || !chat.Active {
+		return
+	}
+	lock, _ := botChatLocks.LoadOrStore(fmt.Sprintf("%d:%s", userID, chatJID), &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+
+	settings, err := dbGetBotSettings(userID)
+	if err != nil {
+		fmt.Printf("ERROR: Could not load bot settings for user %s: %v\n", email, err)
+		return
+	}
+	// The off-switch hands the chat back to a person
+	if strings.Contains(" "+normalizeSearchText(text)+" ", " "+settings.OffKeyword+" ") {
+		if off, _ := dbDisableBotChat(userID, chatJID, BOT_OFF_KEYWORD); off {
+			fmt.Printf("INFO: Bot switched off by keyword in chat %s of user %s\n", chatJID, email)
+			goEmitWebhookEvent(email, EVENT_BOT_HANDOFF, chatJID, map[string]interface{}{
+				"chat_jid": chatJID,
+				"reason":   BOT_OFF_KEYWORD,
+				"message":  payload,
+			})
+		}
+		return
+	}
+	now := time.Now()
+	if dbCountBotReplies(userID, chatJID, now.Add(-time.Hour)) >= settings.MaxRepliesPerHour {
+		incrementStat(userID, STAT_BOT_RATE_LIMITED)
+		fmt.Printf("WARNING: Bot reply limit reached for chat %s of user %s\n", chatJID, email)
+		return
+	}
+
+	llm, err := dbGetEnrichmentSettings(userID)
+	if err != nil || llm.Endpoint == "" || llm.Model == "" {
+		fmt.Printf("WARNING: Bot is on for chat %s of user %s but no LLM endpoint is configured\n", chatJID, email)
+		return
+	}
+	conversation, err := botConversation(userID, chatJID, settings.ContextMessages)
+	if err != nil {
+		fmt.Printf("ERROR: Could not load bot context for chat %s: %v\n", chatJID, err)
+		return
+	}
+	messages := append([]chatMessage{{Role: "system", Content: settings.SystemPrompt}}, conversation...)
+	reply, err := callChatCompletion(userID, llm, messages, 0.3)
+	if err == nil && reply == "" {
+		err = errors.New("empty reply")
+	}
+	if err == nil {
+		_, err = sendService.Enqueue(SendRequest{
+			UserEmail: email,
+			ChatJID:   chatJID,
+			Message:   reply,
+			Source:    "llm-bot",
+		})
+	}
+	if err != nil {
+		incrementStat(userID, STAT_BOT_FAILED)
+		fmt.Printf("WARNING: Bot reply to chat %s of user %s failed: %v\n", chatJID, email, err)
+		return
+	}
+	if err := dbRecordBotReply(userID, chatJID, reply, time.Now()); err != nil {
+		fmt.Printf("ERROR: Could not record bot reply for chat %s: %v\n", chatJID, err)
+	}
+	incrementStat(userID, STAT_BOT_REPLIES)
+	fmt.Printf("INFO: Bot replied in chat %s of user %s\n", chatJID, email)
+}
+
+// GET/POST /api/bot
+// POST replaces the settings {"system_prompt", "context_messages", "max_replies_per_hour", "off_keyword"}.
+func handleBotSettings(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(int64)
+
+	switch r.Method {
+	case "GET":
+	case "POST":
+		var s BotSettings
+		if err := decodeJSONBody(w, r, &s); err != nil {
+			writeBodyError(w, err)
+			return
+		}
+		if err := validateBotSettings(&s); err != nil {
+			apiError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := dbSetBotSettings(userID, s); err != nil {
+			fmt.Println("ERROR: Could not save bot settings", err)
+			apiError(w, "Failed to save bot settings", http.StatusInternalServerError)
+			return
+		}
+	default:
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s, err := dbGetBotSettings(userID)
+	if err != nil {
+		apiError(w, "Failed to load bot settings", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
+
+// GET /api/bot/chats
+func handleListBotChats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID := r.Context().Value("userID").(int64)
+
+	chats, err := dbListBotChats(userID)
+	if err != nil {
+		fmt.Println("ERROR: Could not list bot chats", err)
+		apiError(w, "Failed to load bot chats", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(chats)
+}
+
+// POST/DELETE /api/bot/chats/{jid}
+// POST switches the bot on for the chat (again, after an off-switch); DELETE switches it off.
+func handleBotChat(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(int64)
+
+	jid, err := normalizeChatJID(r.PathValue("jid"))
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, ERR_INVALID_JID, "Invalid chat JID")
+		return
+	}
+	chatJID := jid.String()
+
+	switch r.Method {
+	case "POST":
+		llm, err := dbGetEnrichmentSettings(userID)
+		if err != nil || llm.Endpoint == "" || llm.Model == "" {
+			apiError(w, "Configure an LLM endpoint and model in /api/enrichment first", http.StatusBadRequest)
+			return
+		}
+		if err := dbEnableBotChat(userID, chatJID); err != nil {
+			if strings.HasPrefix(err.Error(), "Too many") {
+				apiError(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			fmt.Println("ERROR: Could not enable bot", err)
+			apiError(w, "Failed to enable bot", http.StatusInternalServerError)
+			return
+		}
+		fmt.Printf("INFO: Bot switched on for chat %s of user %d\n", chatJID, userID)
+	case "DELETE":
+		off, err := dbDisableBotChat(userID, chatJID, BOT_OFF_MANUAL)
+		if err != nil {
+			fmt.Println("ERROR: Could not disable bot", err)
+			apiError(w, "Failed to disable bot", http.StatusInternalServerError)
+			return
+		}
+		if !off {
+			apiError(w, "Bot is not on for this chat", http.StatusNotFound)
+			return
+		}
+		fmt.Printf("INFO: Bot switched off for chat %s of user %d\n", chatJID, userID)
+	default:
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	chat, err := dbGetBotChat(userID, chatJID)
+	if err != nil {
+		apiError(w, "Failed to load bot chat", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(chat)
+}
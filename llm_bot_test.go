@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLLMBot(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+
+	email := "bot@example.com"
+	_, apiKey := registerWithAPIKey(t, ts, email, "botpass123")
+	sendService.isConnected = func(string) bool { return true }
+	dbSetQueuePaused(email, true)
+	defer func() {
+		sendService.isConnected = isUserWAConnected
+		queueMutex.Lock()
+		delete(messageQueues, email)
+		queueMutex.Unlock()
+	}()
+	queued := func() []*QueuedMessage {
+		queueMutex.Lock()
+		defer queueMutex.Unlock()
+		if q := messageQueues[email]; q != nil {
+			return append([]*QueuedMessage(nil), q.Messages...)
+		}
+		return nil
+	}
+
+	var mu sync.Mutex
+	var lastConversation []chatMessage
+	llm := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Messages []chatMessage `json:"messages"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		mu.Lock()
+		lastConversation = req.Messages
+		mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"choices": []map[string]interface{}{{"message": chatMessage{Role: "assistant", Content: fmt.Sprintf("reply %d", len(req.Messages))}}},
+		})
+	}))
+	defer llm.Close()
+
+	events := make(chan map[string]interface{}, 5)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&payload)
+		if payload["event"] != nil {
+			events <- payload
+		}
+	}))
+	defer receiver.Close()
+	apiRequest(t, "POST", ts.URL+"/api/webhooks/create", apiKey, map[string]interface{}{
+		"url": receiver.URL, "method": "POST", "events": []string{EVENT_BOT_HANDOFF},
+	}, nil)
+
+	chat := "14155550000@s.whatsapp.net"
+	if resp := apiRequest(t, "POST", ts.URL+"/api/bot/chats/"+chat, apiKey, nil, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected 400 without an LLM endpoint, got %d", resp.StatusCode)
+	}
+	apiRequest(t, "POST", ts.URL+"/api/enrichment", apiKey, map[string]interface{}{"endpoint": llm.URL, "model": "tiny"}, nil)
+	apiRequest(t, "POST", ts.URL+"/api/bot", apiKey, map[string]interface{}{
+		"system_prompt": "Be brief.", "max_replies_per_hour": 2, "off_keyword": "Agent",
+	}, nil)
+	var botChat BotChat
+	if resp := apiRequest(t, "POST", ts.URL+"/api/bot/chats/+1 415 555 0000", apiKey, nil, &botChat); resp.StatusCode != 200 || !botChat.Active || botChat.ChatJID != chat {
+		t.Fatalf("Enable bot failed, status %d: %+v", resp.StatusCode, botChat)
+	}
+
+	// Wait for the bot's replies to reach n queued messages
+	receive := func(id, text string, want int) {
+		t.Helper()
+		forwardToWebhooks(email, map[string]interface{}{"id": id, "from": chat, "to": chat, "type": "text", "text": text, "timestamp": time.Now().Unix()}, "", "test_media")
+		deadline := time.Now().Add(5 * time.Second)
+		for len(queued()) < want && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		time.Sleep(50 * time.Millisecond)
+		if got := len(queued()); got != want {
+			t.Fatalf("After %q expected %d queued replies, got %d", text, want, got)
+		}
+	}
+
+	receive("m1", "Hi, are you open today?", 1)
+	// Replies are ordered by the second they were sent in
+	time.Sleep(1100 * time.Millisecond)
+	receive("m2", "And tomorrow?", 2)
+	mu.Lock()
+	conversation := lastConversation
+	mu.Unlock()
+	if len(conversation) != 4 || conversation[0].Role != "system" || conversation[0].Content != "Be brief." ||
+		conversation[2].Role != "assistant" || conversation[2].Content != "reply 2" || conversation[3].Content != "And tomorrow?" {
+		t.Fatalf("Unexpected conversation context: %+v", conversation)
+	}
+
+	// Over the hourly limit: no reply
+	receive("m3", "Hello?", 2)
+
+	// The off-switch hands the chat over
+	receive("m4", "let me talk to an agent", 2)
+	select {
+	case event := <-events:
+		if event["event"] != EVENT_BOT_HANDOFF || event["chat_jid"] != chat || event["reason"] != BOT_OFF_KEYWORD {
+			t.Fatalf("Unexpected handoff event: %v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Handoff event not sent")
+	}
+	var chats []BotChat
+	apiRequest(t, "GET", ts.URL+"/api/bot/chats", apiKey, nil, &chats)
+	if len(chats) != 1 || chats[0].Active || chats[0].OffReason != BOT_OFF_KEYWORD {
+		t.Fatalf("Expected bot switched off by keyword, got %+v", chats)
+	}
+	if resp := apiRequest(t, "DELETE", ts.URL+"/api/bot/chats/"+chat, apiKey, nil, nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected 404 switching off twice, got %d", resp.StatusCode)
+	}
+}
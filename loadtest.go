@@ -0,0 +1,291 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// --- Load test mode ---
+// `--loadtest` starts the server on a throwaway database, creates a user whose webhooks
+// point at an in-process mock receiver and pushes synthetic inbound messages through
+// forwardToWebhooks at a fixed rate, the way received WhatsApp messages arrive. It
+// reports how many messages the pipeline kept up with, throughput and latency, to size
+// a deployment before rollout. Delivery settings (WEBHOOK_TIMEOUT, WEBHOOK_HOST_*, ...)
+// are read from the environment as in production; all webhooks share the receiver's
+// host, so WEBHOOK_HOST_CONCURRENCY caps concurrent deliveries.
+//
+//	go run . --loadtest -rate 200 -duration 1m -webhooks 3 -receiver-latency 50ms
+
+const LOADTEST_EMAIL = "loadtest@example.com"
+
+type loadTestConfig struct {
+	Rate            float64       // Messages per second
+	Duration        time.Duration // How long to inject for
+	Webhooks        int           // Webhooks of the test user, each receiving every message
+	Chats           int           // Distinct chats the messages come from
+	Workers         int           // Messages forwarded at once; a tick with none free is skipped
+	ReceiverLatency time.Duration // Time the mock receiver takes to respond
+	ReceiverStatus  int           // Status the mock receiver responds with
+	Verbose         bool          // Keep the server's log output
+}
+
+var defaultLoadTestConfig = loadTestConfig{
+	Rate:           50,
+	Duration:       30 * time.Second,
+	Webhooks:       1,
+	Chats:          20,
+	Workers:        64,
+	ReceiverStatus: http.StatusOK,
+}
+
+// Latency distribution of a load test stage, in milliseconds
+type latencySummary struct {
+	Count  int     `json:"count"`
+	MeanMs float64 `json:"mean_ms"`
+	P50Ms  float64 `json:"p50_ms"`
+	P95Ms  float64 `json:"p95_ms"`
+	P99Ms  float64 `json:"p99_ms"`
+	MaxMs  float64 `json:"max_ms"`
+}
+
+func summarizeLatencies(samples []time.Duration) latencySummary {
+	s := latencySummary{Count: len(samples)}
+	if len(samples) == 0 {
+		return s
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+	at := func(q float64) float64 { return ms(samples[int(q*float64(len(samples)-1))]) }
+	var total time.Duration
+	for _, d := range samples {
+		total += d
+	}
+	s.MeanMs = ms(total / time.Duration(len(samples)))
+	s.P50Ms, s.P95Ms, s.P99Ms = at(0.50), at(0.95), at(0.99)
+	s.MaxMs = ms(samples[len(samples)-1])
+	return s
+}
+
+type loadTestReport struct {
+	Config     loadTestConfig `json:"-"`
+	Injected   int            `json:"injected"`
+	Skipped    int            `json:"skipped"` // No free worker: the pipeline fell behind the rate
+	Forwarded  int            `json:"forwarded"`
+	Deliveries int            `json:"deliveries"`      // Requests the mock receiver got
+	Elapsed    float64        `json:"elapsed_seconds"` // From the first message until the last forward returned
+	Throughput float64        `json:"throughput"`      // Forwarded messages per second
+	Forward    latencySummary `json:"forward"`         // Time forwardToWebhooks took per message
+	Delivery   latencySummary `json:"delivery"`        // Injection until the receiver got the request
+}
+
+// Mock webhook receiver recording when each message arrived
+type loadTestReceiver struct {
+	mu        sync.Mutex
+	count     int
+	latencies []time.Duration
+}
+
+func (rcv *loadTestReceiver) handler(latency time.Duration, status int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var payload struct {
+			InjectedAt int64 `json:"loadtest_injected_at"`
+		}
+		body, _ := io.ReadAll(r.Body)
+		json.Unmarshal(body, &payload)
+		rcv.mu.Lock()
+		rcv.count++
+		if payload.InjectedAt > 0 {
+			rcv.latencies = append(rcv.latencies, time.Since(time.UnixMicro(payload.InjectedAt)))
+		}
+		rcv.mu.Unlock()
+		if latency > 0 {
+			time.Sleep(latency)
+		}
+		w.WriteHeader(status)
+	}
+}
+
+// The load test user, with webhooks delivering every message to receiverURL
+func createLoadTestUser(receiverURL string, webhooks int) error {
+	res, err := db.Exec(`INSERT INTO users (email, password_hash) VALUES (?, '')`, LOADTEST_EMAIL)
+	if err != nil {
+		return err
+	}
+	userID, _ := res.LastInsertId()
+	for i := 0; i < webhooks; i++ {
+		wh := Webhook{ID: fmt.Sprintf("loadtest-%d", i+1), URL: fmt.Sprintf("%s/hook/%d", receiverURL, i+1), Method: "POST", CreatedAt: time.Now()}
+		if err := validateWebhookConfig(&wh); err != nil {
+			return err
+		}
+		if err := dbCreateWebhook(userID, wh); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The n-th synthetic inbound text message, from one of chats direct chats
+func loadTestMessage(n, chats int) map[string]interface{} {
+	chat := fmt.Sprintf("1415555%04d@s.whatsapp.net", n%chats)
+	return map[string]interface{}{
+		"id":                   fmt.Sprintf("LOADTEST%08d", n),
+		"from":                 chat,
+		"to":                   chat,
+		"name":                 "Load Test",
+		"type":                 "text",
+		"text":                 fmt.Sprintf("Load test message %d", n),
+		"timestamp":            time.Now().Unix(),
+		"loadtest_injected_at": time.Now().UnixMicro(),
+	}
+}
+
+// Run a load test and report what the pipeline managed
+func loadTest(cfg loadTestConfig) (*loadTestReport, error) {
+	if cfg.Rate <= 0 || cfg.Duration <= 0 || cfg.Webhooks < 1 || cfg.Chats < 1 || cfg.Workers < 1 {
+		return nil, fmt.Errorf("rate, duration, webhooks, chats and workers must be positive")
+	}
+	dir, err := os.MkdirTemp("", "whatsmeow-loadtest")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	mediaDir := filepath.Join(dir, "media")
+	if err := os.Mkdir(mediaDir, 0755); err != nil {
+		return nil, err
+	}
+
+	receiver := &loadTestReceiver{}
+	sink := httptest.NewServer(receiver.handler(cfg.ReceiverLatency, cfg.ReceiverStatus))
+	defer sink.Close()
+
+	// The receiver listens on loopback, which webhooks may not normally reach
+	allowed, hadAllowed := os.LookupEnv("OUTBOUND_ALLOWED_NETWORKS")
+	os.Setenv("OUTBOUND_ALLOWED_NETWORKS", allowed+",127.0.0.1/32")
+	defer func() {
+		if hadAllowed {
+			os.Setenv("OUTBOUND_ALLOWED_NETWORKS", allowed)
+		} else {
+			os.Unsetenv("OUTBOUND_ALLOWED_NETWORKS")
+		}
+		initOutboundGuard()
+	}()
+
+	if !cfg.Verbose {
+		if devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0); err == nil {
+			stdout := os.Stdout
+			os.Stdout = devNull
+			defer func() {
+				os.Stdout = stdout
+				devNull.Close()
+			}()
+		}
+	}
+
+	startServer(http.NewServeMux(), "0", "loadtest_session", filepath.Join(dir, "loadtest.db"), mediaDir, "loadtest_wa_")
+	if err := createLoadTestUser(sink.URL, cfg.Webhooks); err != nil {
+		return nil, err
+	}
+
+	report := &loadTestReport{Config: cfg}
+	var (
+		mu       sync.Mutex
+		forwards []time.Duration
+		wg       sync.WaitGroup
+	)
+	workers := make(chan struct{}, cfg.Workers)
+	interval := time.Duration(float64(time.Second) / cfg.Rate)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	start := time.Now()
+	for n := 0; time.Since(start) < cfg.Duration; n++ {
+		report.Injected++
+		select {
+		case workers <- struct{}{}:
+		default:
+			report.Skipped++
+			<-ticker.C
+			continue
+		}
+		payload := loadTestMessage(n, cfg.Chats)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-workers }()
+			began := time.Now()
+			forwardToWebhooks(LOADTEST_EMAIL, payload, "", mediaDir)
+			took := time.Since(began)
+			mu.Lock()
+			forwards = append(forwards, took)
+			mu.Unlock()
+		}()
+		<-ticker.C
+	}
+	wg.Wait()
+	report.Elapsed = time.Since(start).Seconds()
+
+	report.Forwarded = len(forwards)
+	report.Throughput = float64(report.Forwarded) / report.Elapsed
+	report.Forward = summarizeLatencies(forwards)
+	receiver.mu.Lock()
+	report.Deliveries = receiver.count
+	report.Delivery = summarizeLatencies(receiver.latencies)
+	receiver.mu.Unlock()
+	return report, nil
+}
+
+func (r *loadTestReport) print(w io.Writer) {
+	cfg := r.Config
+	fmt.Fprintf(w, "Load test: %.0f msg/s for %s, %d webhooks, %d chats, %d workers, receiver latency %s\n",
+		cfg.Rate, cfg.Duration, cfg.Webhooks, cfg.Chats, cfg.Workers, cfg.ReceiverLatency)
+	fmt.Fprintf(w, "Messages:   %d injected, %d forwarded, %d skipped (no free worker)\n", r.Injected, r.Forwarded, r.Skipped)
+	fmt.Fprintf(w, "Deliveries: %d of %d expected\n", r.Deliveries, r.Forwarded*cfg.Webhooks)
+	fmt.Fprintf(w, "Throughput: %.1f msg/s over %.1fs\n", r.Throughput, r.Elapsed)
+	for _, stage := range []struct {
+		name string
+		s    latencySummary
+	}{{"Forward", r.Forward}, {"Delivery", r.Delivery}} {
+		fmt.Fprintf(w, "%-11s mean %.2fms  p50 %.2fms  p95 %.2fms  p99 %.2fms  max %.2fms\n", stage.name+":",
+			stage.s.MeanMs, stage.s.P50Ms, stage.s.P95Ms, stage.s.P99Ms, stage.s.MaxMs)
+	}
+}
+
+// `--loadtest [flags]`
+func runLoadTest(args []string) int {
+	cfg := defaultLoadTestConfig
+	flags := flag.NewFlagSet("--loadtest", flag.ContinueOnError)
+	flags.Float64Var(&cfg.Rate, "rate", cfg.Rate, "synthetic inbound messages per second")
+	flags.DurationVar(&cfg.Duration, "duration", cfg.Duration, "how long to inject messages")
+	flags.IntVar(&cfg.Webhooks, "webhooks", cfg.Webhooks, "webhooks receiving every message")
+	flags.IntVar(&cfg.Chats, "chats", cfg.Chats, "distinct chats the messages come from")
+	flags.IntVar(&cfg.Workers, "workers", cfg.Workers, "messages forwarded concurrently")
+	flags.DurationVar(&cfg.ReceiverLatency, "receiver-latency", cfg.ReceiverLatency, "response time of the mock webhook receiver")
+	flags.IntVar(&cfg.ReceiverStatus, "receiver-status", cfg.ReceiverStatus, "HTTP status the mock receiver responds with")
+	flags.BoolVar(&cfg.Verbose, "verbose", false, "show the server's log output")
+	jsonOutput := flags.Bool("json", false, "print the report as JSON")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	report, err := loadTest(cfg)
+	if err != nil {
+		fmt.Println("ERROR: Load test failed:", err)
+		return 1
+	}
+	if *jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+	} else {
+		report.print(os.Stdout)
+	}
+	return 0
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLoadTest(t *testing.T) {
+	cfg := defaultLoadTestConfig
+	cfg.Rate = 100
+	cfg.Duration = 300 * time.Millisecond
+	cfg.Webhooks = 2
+	report, err := loadTest(cfg)
+	if err != nil {
+		t.Fatalf("Load test failed: %v", err)
+	}
+	if report.Injected == 0 || report.Forwarded != report.Injected-report.Skipped {
+		t.Fatalf("Unexpected message counts: %+v", report)
+	}
+	if report.Deliveries != report.Forwarded*2 || report.Delivery.Count != report.Deliveries {
+		t.Fatalf("Expected every message delivered to both webhooks: %+v", report)
+	}
+	if report.Throughput <= 0 || report.Forward.P50Ms <= 0 || report.Forward.MaxMs < report.Forward.P99Ms {
+		t.Fatalf("Unexpected throughput or latency: %+v", report)
+	}
+
+	if _, err := loadTest(loadTestConfig{Rate: 0, Duration: time.Second, Webhooks: 1, Chats: 1, Workers: 1}); err == nil {
+		t.Fatal("Expected a zero rate to be rejected")
+	}
+}
+
+func TestSummarizeLatencies(t *testing.T) {
+	var samples []time.Duration
+	for i := 100; i >= 1; i-- {
+		samples = append(samples, time.Duration(i)*time.Millisecond)
+	}
+	s := summarizeLatencies(samples)
+	if s.Count != 100 || s.P50Ms != 50 || s.P95Ms != 95 || s.P99Ms != 99 || s.MaxMs != 100 || s.MeanMs != 50.5 {
+		t.Fatalf("Unexpected summary: %+v", s)
+	}
+	if s := summarizeLatencies(nil); s.Count != 0 || s.MaxMs != 0 {
+		t.Fatalf("Expected an empty summary, got %+v", s)
+	}
+}
+
+// Forwarding one message to n webhooks on a local receiver
+func benchmarkForward(b *testing.B, webhooks int, parallel bool) {
+	_, teardown := setupTestServer()
+	defer teardown()
+	var received atomic.Int64
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received.Add(1)
+	}))
+	defer receiver.Close()
+	if err := createLoadTestUser(receiver.URL, webhooks); err != nil {
+		b.Fatalf("Could not create the load test user: %v", err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	if parallel {
+		var n atomic.Int64
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				forwardToWebhooks(LOADTEST_EMAIL, loadTestMessage(int(n.Add(1)), 20), "", "test_media")
+			}
+		})
+	} else {
+		for i := 0; i < b.N; i++ {
+			forwardToWebhooks(LOADTEST_EMAIL, loadTestMessage(i, 20), "", "test_media")
+		}
+	}
+	b.StopTimer()
+	if got := received.Load(); got != int64(b.N*webhooks) {
+		b.Fatalf("Expected %d deliveries, got %d", b.N*webhooks, got)
+	}
+}
+
+func BenchmarkForwardToWebhooks(b *testing.B) {
+	for _, webhooks := range []int{1, 5} {
+		b.Run(fmt.Sprintf("webhooks=%d", webhooks), func(b *testing.B) {
+			benchmarkForward(b, webhooks, false)
+		})
+	}
+}
+
+func BenchmarkForwardToWebhooksParallel(b *testing.B) {
+	benchmarkForward(b, 1, true)
+}
+
+// Picking the webhooks for a message among 20 with chat filters and keyword routes
+func BenchmarkSelectWebhooks(b *testing.B) {
+	var webhooks []Webhook
+	for i := 0; i < 20; i++ {
+		wh := Webhook{ID: fmt.Sprintf("wh%d", i), FilterType: "all"}
+		switch i % 3 {
+		case 1:
+			wh.FilterType, wh.FilterValue = "group", fmt.Sprintf("12036300000000%04d@g.us", i)
+		case 2:
+			wh.Keywords = []string{"order", fmt.Sprintf("ticket%d", i)}
+		}
+		webhooks = append(webhooks, wh)
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		selectWebhooksForMessage(webhooks, "120363000000000004@g.us", "", "Where is my order?")
+	}
+}
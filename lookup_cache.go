@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// --- Lookup caches ---
+// Every received message looks up the user by email and loads their webhooks, which
+// for busy groups means a steady stream of identical queries. Both lookups are cached
+// for LOOKUP_CACHE_TTL (default 30s, 0 turns caching off) and invalidated by the
+// helpers that change the underlying rows, so edits apply to the next message; the TTL
+// only bounds how long a change made any other way goes unnoticed. A webhook's
+// last_delivery_at is not an edit and may lag by up to the TTL in cached lists.
+
+const DEFAULT_LOOKUP_CACHE_TTL = 30 * time.Second
+
+// A time.Duration set by initLookupCaches; atomic since lookups of goroutines still
+// running read it while a restarted (test) server sets it again
+var lookupCacheTTL atomic.Int64
+
+func cacheTTL() time.Duration {
+	return time.Duration(lookupCacheTTL.Load())
+}
+
+type cacheEntry struct {
+	value   interface{}
+	expires time.Time
+}
+
+type lookupCache struct {
+	mu            sync.Mutex
+	data          map[interface{}]cacheEntry
+	hits          int64
+	misses        int64
+	invalidations int64
+}
+
+var (
+	userIDCache   = &lookupCache{data: make(map[interface{}]cacheEntry)} // Email -> user ID
+	webhooksCache = &lookupCache{data: make(map[interface{}]cacheEntry)} // User ID -> []Webhook
+)
+
+// Read LOOKUP_CACHE_TTL and empty the caches (the DB may have been replaced)
+func initLookupCaches() {
+	ttl := DEFAULT_LOOKUP_CACHE_TTL
+	if value := os.Getenv("LOOKUP_CACHE_TTL"); value != "" {
+		if d, err := time.ParseDuration(value); err == nil && d >= 0 {
+			ttl = d
+		} else {
+			fmt.Printf("WARNING: Ignoring LOOKUP_CACHE_TTL=%q, expected a duration like 30s\n", value)
+		}
+	}
+	lookupCacheTTL.Store(int64(ttl))
+	for _, c := range []*lookupCache{userIDCache, webhooksCache} {
+		c.mu.Lock()
+		c.data = make(map[interface{}]cacheEntry)
+		c.hits, c.misses, c.invalidations = 0, 0, 0
+		c.mu.Unlock()
+	}
+}
+
+func (c *lookupCache) get(key interface{}) (interface{}, bool) {
+	if cacheTTL() <= 0 {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.data[key]
+	if !ok || time.Now().After(entry.expires) {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	return entry.value, true
+}
+
+func (c *lookupCache) set(key, value interface{}) {
+	if cacheTTL() <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	// Drop expired entries now and then so departed users don't accumulate
+	if len(c.data) > 0 && len(c.data)%256 == 0 {
+		for k, e := range c.data {
+			if now.After(e.expires) {
+				delete(c.data, k)
+			}
+		}
+	}
+	c.data[key] = cacheEntry{value: value, expires: now.Add(cacheTTL())}
+}
+
+func (c *lookupCache) invalidate(key interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.data[key]; ok {
+		delete(c.data, key)
+		c.invalidations++
+	}
+}
+
+func (c *lookupCache) stats() map[string]interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	hitRate := 0.0
+	if total := c.hits + c.misses; total > 0 {
+		hitRate = float64(c.hits) / float64(total)
+	}
+	return map[string]interface{}{
+		"entries":       len(c.data),
+		"hits":          c.hits,
+		"misses":        c.misses,
+		"hit_rate":      hitRate,
+		"invalidations": c.invalidations,
+	}
+}
+
+// Forget a user's cached webhooks; called by every helper that changes a webhook
+func invalidateWebhooksCache(userID int64) {
+	webhooksCache.invalidate(userID)
+}
+
+// Forget a cached email -> user ID mapping (email changed or account deleted)
+func invalidateUserIDCache(email string) {
+	userIDCache.invalidate(email)
+}
+
+// Hits, misses and size of each cache, for /api/admin/diagnostics
+func lookupCacheStats() map[string]interface{} {
+	return map[string]interface{}{
+		"ttl_seconds": cacheTTL().Seconds(),
+		"user_ids":    userIDCache.stats(),
+		"webhooks":    webhooksCache.stats(),
+	}
+}
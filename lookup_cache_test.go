@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLookupCaches(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+
+	_, apiKey := registerWithAPIKey(t, ts, "cache@example.com", "cachepass123")
+	userID, err := getUserIDByEmail("cache@example.com")
+	if err != nil {
+		t.Fatalf("User lookup failed: %v", err)
+	}
+	before := userIDCache.stats()["hits"].(int64)
+	if id, _ := getUserIDByEmail("cache@example.com"); id != userID || userIDCache.stats()["hits"].(int64) != before+1 {
+		t.Fatal("Expected the second user lookup to be served from the cache")
+	}
+
+	list := func() []Webhook {
+		var webhooks []Webhook
+		apiRequest(t, "GET", ts.URL+"/api/webhooks", apiKey, nil, &webhooks)
+		return webhooks
+	}
+	list()
+	hits := webhooksCache.stats()["hits"].(int64)
+	list()
+	if webhooksCache.stats()["hits"].(int64) != hits+1 {
+		t.Fatal("Expected the second webhook list to be served from the cache")
+	}
+
+	// Changes show up on the next lookup
+	var created struct {
+		ID string `json:"id"`
+	}
+	if resp := apiRequest(t, "POST", ts.URL+"/api/webhooks/create", apiKey, map[string]string{"url": "https://example.com/hook", "method": "POST"}, &created); resp.StatusCode != 200 {
+		t.Fatalf("Create webhook failed: %d", resp.StatusCode)
+	}
+	if webhooks := list(); len(webhooks) != 1 {
+		t.Fatalf("Expected the new webhook to be listed, got %d webhooks", len(webhooks))
+	}
+	apiRequest(t, "POST", ts.URL+"/api/webhooks/"+created.ID+"/tags", apiKey, map[string][]string{"tags": {"crm"}}, nil)
+	if webhooks := list(); len(webhooks) != 1 || len(webhooks[0].Tags) != 1 || webhooks[0].Tags[0] != "crm" {
+		t.Fatalf("Expected the new tags to be listed, got %+v", webhooks)
+	}
+	apiRequest(t, "POST", ts.URL+"/api/webhooks/delete", apiKey, map[string]string{"id": created.ID}, nil)
+	if webhooks := list(); len(webhooks) != 0 {
+		t.Fatalf("Expected no webhooks after delete, got %d", len(webhooks))
+	}
+
+	// Callers can't modify the cached list
+	dbCreateWebhook(userID, Webhook{ID: "wh-cache", URL: "https://example.com/other", Method: "POST", CreatedAt: time.Now()})
+	webhooks, _ := dbListWebhooks(userID)
+	webhooks[0].URL = "https://changed.example.com"
+	if again, _ := dbListWebhooks(userID); again[0].URL != "https://example.com/other" {
+		t.Fatalf("Cached webhook was modified through a returned list: %s", again[0].URL)
+	}
+
+	// Entries expire after the TTL
+	lookupCacheTTL.Store(int64(10 * time.Millisecond))
+	defer initLookupCaches()
+	webhooksCache.set(userID, []Webhook{})
+	time.Sleep(20 * time.Millisecond)
+	if _, ok := webhooksCache.get(userID); ok {
+		t.Fatal("Expected the entry to expire")
+	}
+}
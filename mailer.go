@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+)
+
+// --- Email ---
+// Plain-text email over SMTP, configured with SMTP_HOST, SMTP_PORT (default 587),
+// SMTP_USERNAME, SMTP_PASSWORD and SMTP_FROM. Email is disabled without SMTP_HOST.
+
+var errEmailDisabled = errors.New("email is not configured (SMTP_HOST)")
+
+func emailConfigured() bool {
+	return os.Getenv("SMTP_HOST") != ""
+}
+
+// Send an email; a variable so tests can capture mail instead of sending it
+var sendEmail = defaultSendEmail
+
+func defaultSendEmail(to, subject, body string) error {
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		return errEmailDisabled
+	}
+	from := getEnv("SMTP_FROM", os.Getenv("SMTP_USERNAME"))
+	if from == "" {
+		return errors.New("SMTP_FROM is not set")
+	}
+	var auth smtp.Auth
+	if username := os.Getenv("SMTP_USERNAME"); username != "" {
+		auth = smtp.PlainAuth("", username, os.Getenv("SMTP_PASSWORD"), host)
+	}
+	// Header values must not contain line breaks
+	clean := strings.NewReplacer("\r", "", "\n", " ")
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nMIME-Version: 1.0\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n%s\r\n",
+		clean.Replace(from), clean.Replace(to), clean.Replace(subject), body)
+	addr := net.JoinHostPort(host, getEnv("SMTP_PORT", "587"))
+	return smtp.SendMail(addr, auth, from, []string{to}, []byte(msg))
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"strings"
 
 	"github.com/joho/godotenv"
 )
@@ -24,9 +25,45 @@ func main() {
 	mediaDir := getEnv("MEDIA_DIR", "media")
 	waSessionPrefix := getEnv("WA_SESSION_PREFIX", "whatsmeow_")
 
+	if len(os.Args) > 1 && os.Args[1] == "migrate-sessions" {
+		os.Exit(runSessionMigration(dbPath, waSessionPrefix))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "--loadtest" {
+		os.Exit(runLoadTest(os.Args[2:]))
+	}
+
 	fmt.Println("main.go: main() is running, about to call startServer()...")
 	mux := http.NewServeMux()
 	startServer(mux, port, sessionCookieName, dbPath, mediaDir, waSessionPrefix)
 	fmt.Printf("Starting web server at http://localhost:%s\n", port)
-	http.ListenAndServe(":"+port, withCORS(mux))
+	http.ListenAndServe(":"+port, withRecovery(withCORS(mux)))
+}
+
+// `migrate-sessions`: copy per-user session files into the shared WhatsApp store
+func runSessionMigration(dbPath, waSessionPrefix string) int {
+	if err := initDB(dbPath); err != nil {
+		fmt.Println("ERROR: Failed to initialize DB:", err)
+		return 1
+	}
+	if err := initWAStore(dbPath); err != nil {
+		fmt.Println("ERROR:", err)
+		return 1
+	}
+	results, err := migrateWASessions(waSessionPrefix)
+	if err != nil {
+		fmt.Println("ERROR: Migration failed:", err)
+		return 1
+	}
+	failed := 0
+	for _, result := range results {
+		fmt.Printf("%s (%s): %s %s\n", result.File, result.Email, result.Status, result.JID)
+		if strings.HasPrefix(result.Status, "failed") {
+			failed++
+		}
+	}
+	fmt.Printf("INFO: %d session files checked, %d failed\n", len(results), failed)
+	if failed > 0 {
+		return 1
+	}
+	return 0
 }
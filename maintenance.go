@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// --- Maintenance mode ---
+// While enabled, new outgoing sends are rejected with 503 + Retry-After, incoming
+// messages are still received and forwarded, and already queued messages drain normally.
+
+const DEFAULT_MAINTENANCE_RETRY_AFTER = 300 // seconds
+
+var maintenance = struct {
+	sync.RWMutex
+	enabled    bool
+	since      time.Time
+	retryAfter int
+	message    string
+}{}
+
+// Whether new sends should be rejected, and the Retry-After value (seconds) to send
+func maintenanceStatus() (bool, int) {
+	maintenance.RLock()
+	defer maintenance.RUnlock()
+	return maintenance.enabled, maintenance.retryAfter
+}
+
+func setMaintenance(enabled bool, retryAfter int, message string) {
+	maintenance.Lock()
+	defer maintenance.Unlock()
+	if enabled && !maintenance.enabled {
+		maintenance.since = time.Now()
+	}
+	maintenance.enabled = enabled
+	maintenance.retryAfter = retryAfter
+	maintenance.message = message
+}
+
+// Total number of messages still waiting in all user queues
+func totalQueuedMessages() int {
+	queueMutex.RLock()
+	defer queueMutex.RUnlock()
+	total := 0
+	for _, q := range messageQueues {
+		q.mu.RLock()
+		total += len(q.Messages)
+		q.mu.RUnlock()
+	}
+	return total
+}
+
+// Admin endpoints are authenticated with the ADMIN_TOKEN env var (X-Admin-Token header)
+// and are disabled when it is not set.
+func requireAdminToken(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		adminToken := os.Getenv("ADMIN_TOKEN")
+		if adminToken == "" {
+			apiError(w, "Not found", http.StatusNotFound)
+			return
+		}
+		token := r.Header.Get("X-Admin-Token")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+			apiError(w, "Invalid admin token", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// GET/POST /api/admin/maintenance
+// POST {"enabled": true, "retry_after": 600, "message": "..."} toggles maintenance mode;
+// GET reports it along with the number of messages left to drain.
+func handleMaintenance(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		var req struct {
+			Enabled    bool   `json:"enabled"`
+			RetryAfter int    `json:"retry_after"`
+			Message    string `json:"message"`
+		}
+		if err := decodeJSONBody(w, r, &req); err != nil && err != io.EOF {
+			writeBodyError(w, err)
+			return
+		}
+		if req.RetryAfter < 0 {
+			apiError(w, "Invalid retry_after", http.StatusBadRequest)
+			return
+		}
+		if req.RetryAfter == 0 {
+			req.RetryAfter = DEFAULT_MAINTENANCE_RETRY_AFTER
+		}
+		setMaintenance(req.Enabled, req.RetryAfter, req.Message)
+		fmt.Printf("INFO: Maintenance mode enabled=%v (retry after %ds)\n", req.Enabled, req.RetryAfter)
+	} else if r.Method != "GET" {
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	maintenance.RLock()
+	response := map[string]interface{}{
+		"enabled":     maintenance.enabled,
+		"retry_after": maintenance.retryAfter,
+		"message":     maintenance.message,
+	}
+	if maintenance.enabled {
+		response["since"] = maintenance.since.UTC().Format(time.RFC3339)
+	}
+	maintenance.RUnlock()
+	queued := totalQueuedMessages()
+	response["queued_messages"] = queued
+	response["drained"] = queued == 0
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
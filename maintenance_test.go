@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestMaintenanceMode(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+	defer setMaintenance(false, 0, "")
+
+	_, apiKey := registerWithAPIKey(t, ts, "maintuser@example.com", "maintpass123")
+
+	admin := func(token string, body interface{}) (*http.Response, map[string]interface{}) {
+		method := "GET"
+		var buf bytes.Buffer
+		if body != nil {
+			method = "POST"
+			json.NewEncoder(&buf).Encode(body)
+		}
+		req, _ := http.NewRequest(method, ts.URL+"/api/admin/maintenance", &buf)
+		req.Header.Set("X-Admin-Token", token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Admin request failed: %v", err)
+		}
+		var data map[string]interface{}
+		json.NewDecoder(resp.Body).Decode(&data)
+		return resp, data
+	}
+
+	// Disabled without ADMIN_TOKEN
+	t.Setenv("ADMIN_TOKEN", "")
+	if resp, _ := admin("anything", nil); resp.StatusCode != 404 {
+		t.Fatalf("Expected 404 without ADMIN_TOKEN, got %d", resp.StatusCode)
+	}
+
+	t.Setenv("ADMIN_TOKEN", "admin-secret")
+	if resp, _ := admin("wrong", nil); resp.StatusCode != 401 {
+		t.Fatalf("Expected 401 for wrong token, got %d", resp.StatusCode)
+	}
+
+	resp, data := admin("admin-secret", map[string]interface{}{"enabled": true, "retry_after": 120})
+	if resp.StatusCode != 200 || data["enabled"] != true || data["queued_messages"] == nil {
+		t.Fatalf("Enable maintenance failed: %d %v", resp.StatusCode, data)
+	}
+
+	// New sends are rejected with Retry-After
+	resp = apiRequest(t, "POST", ts.URL+"/api/messages/send", apiKey, map[string]string{
+		"chat_jid": "123@s.whatsapp.net", "message": "hello",
+	}, nil)
+	if resp.StatusCode != 503 || resp.Header.Get("Retry-After") != "120" {
+		t.Fatalf("Expected 503 with Retry-After 120, got %d %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+
+	// Disable again
+	_, data = admin("admin-secret", map[string]interface{}{"enabled": false})
+	if data["enabled"] != false {
+		t.Fatalf("Disable maintenance failed: %v", data)
+	}
+	if enabled, _ := maintenanceStatus(); enabled {
+		t.Fatalf("Maintenance should be disabled")
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Media file received in a chat, indexed so it can be bundled per chat
+type ChatMedia struct {
+	MessageID string
+	MediaType string
+	FilePath  string
+	Timestamp time.Time
+}
+
+// Record a downloaded media file against the chat it was received in
+func dbRecordChatMedia(userID int64, chatJID, messageID, mediaType, filePath string, ts time.Time) error {
+	_, err := db.Exec(`INSERT INTO chat_media (user_id, chat_jid, message_id, media_type, file_path, timestamp) VALUES (?, ?, ?, ?, ?, ?)`,
+		userID, chatJID, messageID, mediaType, filePath, ts.UTC().Format(time.RFC3339))
+	return err
+}
+
+// List a chat's media received in [from, to], oldest first
+func dbListChatMedia(ctx context.Context, userID int64, chatJID string, from, to time.Time) ([]ChatMedia, error) {
+	rows, err := db.QueryContext(ctx, `SELECT message_id, media_type, file_path, timestamp FROM chat_media
+		WHERE user_id = ? AND chat_jid = ? AND timestamp >= ? AND timestamp <= ? ORDER BY timestamp, id`,
+		userID, chatJID, from.UTC().Format(time.RFC3339), to.UTC().Format(time.RFC3339))
+	if err != nil {
+		return nil, err
+	}
+	return scanChatMedia(rows)
+}
+
+// List all media received by a user, oldest first
+func dbListUserMedia(ctx context.Context, userID int64) ([]ChatMedia, error) {
+	rows, err := db.QueryContext(ctx, `SELECT message_id, media_type, file_path, timestamp FROM chat_media
+		WHERE user_id = ? ORDER BY timestamp, id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	return scanChatMedia(rows)
+}
+
+func scanChatMedia(rows *sql.Rows) ([]ChatMedia, error) {
+	defer rows.Close()
+	var media []ChatMedia
+	for rows.Next() {
+		var m ChatMedia
+		var ts string
+		if err := rows.Scan(&m.MessageID, &m.MediaType, &m.FilePath, &ts); err != nil {
+			return nil, err
+		}
+		m.Timestamp, _ = time.Parse(time.RFC3339, ts)
+		media = append(media, m)
+	}
+	return media, rows.Err()
+}
+
+// Parse an archive range bound: RFC3339, or a YYYY-MM-DD date in the user's timezone.
+// Dates used as the upper bound include the whole day.
+func parseArchiveTime(value string, loc *time.Location, endOfDay bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", value, loc)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if endOfDay {
+		t = t.AddDate(0, 0, 1).Add(-time.Second)
+	}
+	return t, nil
+}
+
+// GET /api/wa/chats/{jid}/media/archive?from=&to=
+// Streams a ZIP of all stored media for a chat, optionally limited to a date range.
+func handleChatMediaArchive(sessionCookieName string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !isAuthenticated(r, sessionCookieName) {
+			apiError(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		email := getUserEmail(r, sessionCookieName)
+		userID, err := getUserIDByEmail(email)
+		if err != nil {
+			apiError(w, "User not found", http.StatusUnauthorized)
+			return
+		}
+
+		chatJID, err := normalizeChatJID(r.PathValue("jid"))
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, ERR_INVALID_JID, "Invalid chat JID")
+			return
+		}
+
+		loc := getUserLocation(userID)
+		from := time.Unix(0, 0)
+		to := time.Now()
+		if v := r.URL.Query().Get("from"); v != "" {
+			if from, err = parseArchiveTime(v, loc, false); err != nil {
+				apiError(w, "Invalid from date", http.StatusBadRequest)
+				return
+			}
+		}
+		if v := r.URL.Query().Get("to"); v != "" {
+			if to, err = parseArchiveTime(v, loc, true); err != nil {
+				apiError(w, "Invalid to date", http.StatusBadRequest)
+				return
+			}
+		}
+		if to.Before(from) {
+			apiError(w, "from must be before to", http.StatusBadRequest)
+			return
+		}
+
+		ctx, cancel := queryContext(r)
+		defer cancel()
+		media, err := dbListChatMedia(ctx, userID, chatJID.String(), from, to)
+		if err != nil {
+			fmt.Println("ERROR: Could not list chat media", err)
+			apiError(w, "Failed to load media", http.StatusInternalServerError)
+			return
+		}
+		if len(media) == 0 {
+			apiError(w, "No media found", http.StatusNotFound)
+			return
+		}
+
+		archiveName := fmt.Sprintf("%s-media.zip", strings.ReplaceAll(chatJID.User, ".", "_"))
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, archiveName))
+
+		zw := zip.NewWriter(w)
+		added := 0
+		seen := make(map[string]bool)
+		for _, m := range media {
+			// Deduplicated media can be referenced by several messages
+			if seen[m.FilePath] {
+				continue
+			}
+			seen[m.FilePath] = true
+			f, err := os.Open(m.FilePath)
+			if err != nil {
+				// Already removed by media cleanup
+				continue
+			}
+			entry, err := zw.CreateHeader(&zip.FileHeader{
+				Name:     filepath.Base(m.FilePath),
+				Method:   zip.Deflate,
+				Modified: m.Timestamp,
+			})
+			if err == nil {
+				_, err = io.Copy(entry, f)
+			}
+			f.Close()
+			if err != nil {
+				fmt.Printf("ERROR: Media archive for %s aborted: %v\n", chatJID, err)
+				return
+			}
+			added++
+		}
+		if err := zw.Close(); err != nil {
+			fmt.Printf("ERROR: Could not finish media archive for %s: %v\n", chatJID, err)
+			return
+		}
+		fmt.Printf("DEBUG: Streamed media archive for %s with %d files\n", chatJID, added)
+	}
+}
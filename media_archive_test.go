@@ -0,0 +1,76 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestChatMediaArchive(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+
+	cookies, _ := registerWithAPIKey(t, ts, "archiveuser@example.com", "archivepass123")
+	userID, _ := getUserIDByEmail("archiveuser@example.com")
+
+	chat := "1234567890@s.whatsapp.net"
+	files := map[string]time.Time{
+		"1_a.jpg": time.Date(2025, 3, 1, 10, 0, 0, 0, time.UTC),
+		"2_b.ogg": time.Date(2025, 3, 2, 10, 0, 0, 0, time.UTC),
+		"3_c.pdf": time.Date(2025, 3, 5, 10, 0, 0, 0, time.UTC),
+	}
+	for name, when := range files {
+		p := filepath.Join("test_media", name)
+		os.WriteFile(p, []byte("data "+name), 0644)
+		if err := dbRecordChatMedia(userID, chat, name, "image", p, when); err != nil {
+			t.Fatalf("Record media failed: %v", err)
+		}
+	}
+	// Media from another chat is never included
+	dbRecordChatMedia(userID, "999@s.whatsapp.net", "x", "image", filepath.Join("test_media", "1_a.jpg"), time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC))
+
+	get := func(query string) *http.Response {
+		req, _ := http.NewRequest("GET", ts.URL+"/api/wa/chats/"+chat+"/media/archive"+query, nil)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Archive request failed: %v", err)
+		}
+		return resp
+	}
+
+	resp := get("?from=2025-03-01&to=2025-03-02")
+	if resp.StatusCode != 200 || resp.Header.Get("Content-Type") != "application/zip" {
+		t.Fatalf("Archive failed, status: %d", resp.StatusCode)
+	}
+	data, _ := io.ReadAll(resp.Body)
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("Invalid zip: %v", err)
+	}
+	if len(zr.File) != 2 || zr.File[0].Name != "1_a.jpg" || zr.File[1].Name != "2_b.ogg" {
+		t.Fatalf("Unexpected archive entries: %v", zr.File)
+	}
+
+	// Empty range
+	if resp := get("?from=2024-01-01&to=2024-01-31"); resp.StatusCode != 404 {
+		t.Fatalf("Expected 404 for empty range, got %d", resp.StatusCode)
+	}
+	// Bad dates
+	if resp := get("?from=yesterday"); resp.StatusCode != 400 {
+		t.Fatalf("Expected 400 for invalid date, got %d", resp.StatusCode)
+	}
+
+	// Requires a session
+	resp, _ = http.Get(ts.URL + "/api/wa/chats/" + chat + "/media/archive")
+	if resp.StatusCode != 401 {
+		t.Fatalf("Expected 401 without session, got %d", resp.StatusCode)
+	}
+}
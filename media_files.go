@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+)
+
+// --- Stored media files ---
+// The original WhatsApp mimetype and file name are kept alongside each stored file
+// so /media/ can serve it with the right Content-Type and Content-Disposition.
+
+// File extensions for the mimetypes WhatsApp commonly sends
+var mediaExtensions = map[string]string{
+	"image/jpeg":      ".jpg",
+	"image/png":       ".png",
+	"image/webp":      ".webp",
+	"image/gif":       ".gif",
+	"video/mp4":       ".mp4",
+	"video/3gpp":      ".3gp",
+	"audio/ogg":       ".ogg",
+	"audio/mpeg":      ".mp3",
+	"audio/mp4":       ".m4a",
+	"audio/aac":       ".aac",
+	"application/pdf": ".pdf",
+}
+
+// Pick a file extension for a mimetype, falling back to the given default
+func mediaExtension(mimeType, fallback string) string {
+	if base, _, err := mime.ParseMediaType(mimeType); err == nil {
+		if ext, ok := mediaExtensions[base]; ok {
+			return ext
+		}
+	}
+	return fallback
+}
+
+func dbSaveMediaFileInfo(userID int64, name, mimeType, originalName, hash string) error {
+	_, err := db.Exec(`INSERT OR REPLACE INTO media_files (name, user_id, mime_type, original_name, sha256, refcount, created_at) VALUES (?, ?, ?, ?, ?, 1, ?)`,
+		name, userID, mimeType, originalName, hash, time.Now().UTC().Format(time.RFC3339))
+	return err
+}
+
+func dbDeleteMediaFileInfo(name string) error {
+	_, err := db.Exec(`DELETE FROM media_files WHERE name = ?`, name)
+	return err
+}
+
+// Find the most recent file the user stored with the given content hash and metadata.
+// Files are not shared between users, nor between uploads with a different mimetype or
+// file name, since those are served with the file.
+func dbFindMediaFileByHash(userID int64, hash, mimeType, originalName string) (string, error) {
+	var name string
+	err := db.QueryRow(`SELECT name FROM media_files WHERE sha256 = ? AND user_id = ? AND mime_type = ? AND original_name = ? ORDER BY created_at DESC LIMIT 1`,
+		hash, userID, mimeType, originalName).Scan(&name)
+	return name, err
+}
+
+// Count another reference to an already stored file
+func dbAddMediaFileRef(name string) error {
+	_, err := db.Exec(`UPDATE media_files SET refcount = refcount + 1 WHERE name = ?`, name)
+	return err
+}
+
+// Drop a reference to a stored media file, deleting the file with its last reference.
+// Files stored before reference counting (no info row) are deleted right away.
+// Reports whether the file was deleted.
+func releaseMediaFile(filePath string) bool {
+	name := filepath.Base(filePath)
+	var refcount int
+	err := db.QueryRow(`UPDATE media_files SET refcount = refcount - 1 WHERE name = ? RETURNING refcount`, name).Scan(&refcount)
+	if err != nil && err != sql.ErrNoRows {
+		fmt.Printf("ERROR: Could not release media file %s: %v\n", name, err)
+		return false
+	}
+	if err == nil && refcount > 0 {
+		return false
+	}
+	deleted := true
+	if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+		fmt.Printf("ERROR: Could not delete media file %s: %v\n", filePath, err)
+		deleted = false
+	}
+	dbDeleteMediaFileInfo(name)
+	return deleted
+}
+
+// Get the stored mimetype and original file name of a media file
+func dbGetMediaFileInfo(name string) (mimeType, originalName string, err error) {
+	err = db.QueryRow(`SELECT mime_type, original_name FROM media_files WHERE name = ?`, name).Scan(&mimeType, &originalName)
+	return
+}
+
+// Download a received media message into mediaDir and record its metadata.
+// Returns the stored file name (which may be an existing duplicate), or "" on failure.
+func storeReceivedMedia(client WAClient, userID int64, mediaDir string, media whatsmeow.DownloadableMessage, filename, mimeType, originalName string) string {
+	ctx, cancel := context.WithTimeout(context.Background(), waDownloadTimeout)
+	defer cancel()
+	data, err := client.Download(ctx, media)
+	if err != nil {
+		fmt.Printf("ERROR: Failed to download media %s: %v\n", filename, err)
+		return ""
+	}
+	return storeMediaData(userID, mediaDir, data, filename, mimeType, originalName)
+}
+
+// Store media content under filename, unless the user already stored identical content
+// with the same metadata, in which case the existing file is reused and its reference
+// count incremented.
+func storeMediaData(userID int64, mediaDir string, data []byte, filename, mimeType, originalName string) string {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+
+	if existing, err := dbFindMediaFileByHash(userID, hash, mimeType, originalName); err == nil {
+		existingPath := filepath.Join(mediaDir, existing)
+		if _, err := os.Stat(existingPath); err == nil {
+			// Reset the retention clock, as if the file had just been stored
+			now := time.Now()
+			os.Chtimes(existingPath, now, now)
+			if err := dbAddMediaFileRef(existing); err != nil {
+				fmt.Println("ERROR: Could not update media refcount", err)
+			}
+			fmt.Printf("DEBUG: Reusing stored media %s for %s\n", existing, filename)
+			return existing
+		}
+		// File already removed by cleanup; store it again
+		dbDeleteMediaFileInfo(existing)
+	}
+
+	os.MkdirAll(mediaDir, 0755)
+	if err := os.WriteFile(filepath.Join(mediaDir, filename), data, 0644); err != nil {
+		fmt.Printf("ERROR: Failed to store media %s: %v\n", filename, err)
+		return ""
+	}
+	if err := dbSaveMediaFileInfo(userID, filename, mimeType, originalName, hash); err != nil {
+		fmt.Println("ERROR: Could not save media file info", err)
+	}
+	return filename
+}
+
+// Work out the Content-Type for a media file: the mimetype recorded from WhatsApp,
+// otherwise content sniffing, otherwise the file extension.
+func detectMediaContentType(name, storedType string, head []byte) string {
+	if storedType != "" {
+		return storedType
+	}
+	sniffed := http.DetectContentType(head)
+	if sniffed != "application/octet-stream" && !strings.HasPrefix(sniffed, "text/plain") {
+		return sniffed
+	}
+	if byExt := mime.TypeByExtension(path.Ext(name)); byExt != "" {
+		return byExt
+	}
+	return sniffed
+}
+
+// Types that are safe for browsers to render inline from our origin
+func isInlineMediaType(contentType string) bool {
+	base, _, _ := mime.ParseMediaType(contentType)
+	if base == "image/svg+xml" {
+		return false
+	}
+	return strings.HasPrefix(base, "image/") || strings.HasPrefix(base, "video/") ||
+		strings.HasPrefix(base, "audio/") || base == "application/pdf"
+}
+
+// GET /media/{file}
+func handleServeMedia(mediaDir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		mediaFile := path.Base(r.URL.Path)
+		f, err := os.Open(filepath.Join(mediaDir, mediaFile))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil || info.IsDir() {
+			http.NotFound(w, r)
+			return
+		}
+
+		storedType, originalName, err := dbGetMediaFileInfo(mediaFile)
+		if err != nil && err != sql.ErrNoRows {
+			fmt.Println("ERROR: Could not load media file info", err)
+		}
+		head := make([]byte, 512)
+		n, _ := f.Read(head)
+		f.Seek(0, 0)
+		contentType := detectMediaContentType(mediaFile, storedType, head[:n])
+
+		if originalName == "" {
+			originalName = mediaFile
+		}
+		disposition := "attachment"
+		if isInlineMediaType(contentType) {
+			disposition = "inline"
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": originalName}))
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		// ServeContent also handles Range requests (needed for video/audio seeking)
+		http.ServeContent(w, r, mediaFile, info.ModTime(), f)
+	}
+}
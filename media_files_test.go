@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMediaExtension(t *testing.T) {
+	cases := map[string]string{
+		"image/png":              ".png",
+		"audio/ogg; codecs=opus": ".ogg",
+		"video/mp4":              ".mp4",
+		"application/x-unknown":  ".bin",
+		"":                       ".bin",
+	}
+	for mimeType, want := range cases {
+		if got := mediaExtension(mimeType, ".bin"); got != want {
+			t.Errorf("mediaExtension(%q) = %q, want %q", mimeType, got, want)
+		}
+	}
+}
+
+func TestServeMediaContentType(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+
+	write := func(name string, data []byte) {
+		os.WriteFile(filepath.Join("test_media", name), data, 0644)
+	}
+	get := func(name string) *http.Response {
+		resp, err := http.Get(ts.URL + "/media/" + name)
+		if err != nil {
+			t.Fatalf("Get media failed: %v", err)
+		}
+		return resp
+	}
+
+	// Sniffed from content despite a misleading extension
+	write("1_pdf.jpg", []byte("%PDF-1.4 test"))
+	resp := get("1_pdf.jpg")
+	if ct := resp.Header.Get("Content-Type"); ct != "application/pdf" {
+		t.Fatalf("Expected sniffed application/pdf, got %q", ct)
+	}
+	if cd := resp.Header.Get("Content-Disposition"); cd != `inline; filename=1_pdf.jpg` {
+		t.Fatalf("Unexpected Content-Disposition: %q", cd)
+	}
+
+	// Stored WhatsApp mimetype and original file name take precedence
+	write("2_doc_report.csv", []byte("a,b\n1,2\n"))
+	dbSaveMediaFileInfo(0, "2_doc_report.csv", "text/csv", "Q3 report.csv", "")
+	resp = get("2_doc_report.csv")
+	if ct := resp.Header.Get("Content-Type"); ct != "text/csv" {
+		t.Fatalf("Expected stored text/csv, got %q", ct)
+	}
+	if cd := resp.Header.Get("Content-Disposition"); cd != `attachment; filename="Q3 report.csv"` {
+		t.Fatalf("Unexpected Content-Disposition: %q", cd)
+	}
+
+	// HTML is never rendered inline
+	write("3_page", []byte("<html><body>hi</body></html>"))
+	resp = get("3_page")
+	if cd := resp.Header.Get("Content-Disposition"); cd != `attachment; filename=3_page` {
+		t.Fatalf("Expected HTML as attachment, got %q", cd)
+	}
+
+	if resp := get("missing.jpg"); resp.StatusCode != 404 {
+		t.Fatalf("Expected 404 for missing media, got %d", resp.StatusCode)
+	}
+}
+
+func TestStoreMediaDataDeduplicates(t *testing.T) {
+	_, teardown := setupTestServer()
+	defer teardown()
+
+	first := storeMediaData(1, "test_media", []byte("same image"), "1_a.jpg", "image/jpeg", "")
+	second := storeMediaData(1, "test_media", []byte("same image"), "2_b.jpg", "image/jpeg", "")
+	other := storeMediaData(1, "test_media", []byte("other image"), "3_c.jpg", "image/jpeg", "")
+	if first != "1_a.jpg" || second != "1_a.jpg" || other != "3_c.jpg" {
+		t.Fatalf("Unexpected stored names: %s, %s, %s", first, second, other)
+	}
+	// Not shared with another user, nor served under another upload's name or type
+	otherUser := storeMediaData(2, "test_media", []byte("same image"), "5_e.jpg", "image/jpeg", "")
+	renamed := storeMediaData(1, "test_media", []byte("same image"), "6_f", "application/octet-stream", "secret.bin")
+	if otherUser != "5_e.jpg" || renamed != "6_f" {
+		t.Fatalf("Expected separate copies, got %s and %s", otherUser, renamed)
+	}
+	if _, err := os.Stat(filepath.Join("test_media", "2_b.jpg")); !os.IsNotExist(err) {
+		t.Fatalf("Duplicate content should not be written again")
+	}
+	var refcount int
+	db.QueryRow(`SELECT refcount FROM media_files WHERE name = ?`, "1_a.jpg").Scan(&refcount)
+	if refcount != 2 {
+		t.Fatalf("Expected refcount 2, got %d", refcount)
+	}
+
+	// Once the file is gone (retention cleanup), the content is stored again
+	os.Remove(filepath.Join("test_media", "1_a.jpg"))
+	if got := storeMediaData(1, "test_media", []byte("same image"), "4_d.jpg", "image/jpeg", ""); got != "4_d.jpg" {
+		t.Fatalf("Expected content to be stored again, got %s", got)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// --- Received media scanning ---
+// Documents can be passed through an external scanner before their URL is exposed.
+// Configure either SCAN_COMMAND (run with the file path appended; exit 0 = clean,
+// exit 1 = infected, as with clamscan) or CLAMAV_ADDRESS (clamd unix socket path or host:port).
+
+const (
+	SCAN_CLEAN          = "clean"
+	SCAN_INFECTED       = "infected"
+	SCAN_ERROR          = "error"
+	SCAN_TIMEOUT        = 2 * time.Minute
+	QUARANTINE_SUBDIR   = "quarantine"
+	CLAMD_CHUNK_SIZE    = 64 * 1024
+	CLAMD_RESPONSE_SIZE = 1024
+)
+
+// Scan a file with the configured scanner. Returns "" when scanning is disabled.
+func scanMediaFile(filePath string) string {
+	var infected bool
+	var err error
+	if command := os.Getenv("SCAN_COMMAND"); command != "" {
+		infected, err = scanWithCommand(command, filePath)
+	} else if address := os.Getenv("CLAMAV_ADDRESS"); address != "" {
+		infected, err = scanWithClamd(address, filePath)
+	} else {
+		return ""
+	}
+	if err != nil {
+		fmt.Printf("ERROR: Media scan failed for %s: %v\n", filePath, err)
+		return SCAN_ERROR
+	}
+	if infected {
+		return SCAN_INFECTED
+	}
+	return SCAN_CLEAN
+}
+
+func scanWithCommand(command, filePath string) (bool, error) {
+	args := strings.Fields(command)
+	cmd := exec.Command(args[0], append(args[1:], filePath)...)
+	timer := time.AfterFunc(SCAN_TIMEOUT, func() {
+		if cmd.Process != nil {
+			cmd.Process.Kill()
+		}
+	})
+	defer timer.Stop()
+
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		return true, nil
+	}
+	return false, err
+}
+
+// Stream a file to clamd using the INSTREAM command
+func scanWithClamd(address, filePath string) (bool, error) {
+	network := "tcp"
+	if strings.HasPrefix(address, "/") {
+		network = "unix"
+	}
+	conn, err := net.DialTimeout(network, address, 10*time.Second)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(SCAN_TIMEOUT))
+
+	f, err := os.Open(filePath)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return false, err
+	}
+	buf := make([]byte, CLAMD_CHUNK_SIZE)
+	size := make([]byte, 4)
+	for {
+		n, readErr := f.Read(buf)
+		if n > 0 {
+			binary.BigEndian.PutUint32(size, uint32(n))
+			if _, err := conn.Write(append(size, buf[:n]...)); err != nil {
+				return false, err
+			}
+		}
+		if readErr == io.EOF {
+			break
+		} else if readErr != nil {
+			return false, readErr
+		}
+	}
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return false, err
+	}
+
+	reply, err := bufio.NewReader(io.LimitReader(conn, CLAMD_RESPONSE_SIZE)).ReadString(0)
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	reply = strings.TrimRight(reply, "\x00\n")
+	switch {
+	case strings.HasSuffix(reply, "FOUND"):
+		return true, nil
+	case strings.HasSuffix(reply, "OK"):
+		return false, nil
+	}
+	return false, fmt.Errorf("unexpected clamd reply: %q", reply)
+}
+
+// Move an infected or unscanned file out of the served media directory
+func quarantineMediaFile(filePath string) error {
+	dir := filepath.Join(filepath.Dir(filePath), QUARANTINE_SUBDIR)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	return os.Rename(filePath, filepath.Join(dir, filepath.Base(filePath)))
+}
+
+// Scan a received document and record the result in the payload.
+// Returns false if the file was quarantined and must not be exposed. Scanning fails
+// closed: a file the scanner could not check is quarantined like an infected one.
+func scanReceivedMedia(filePath string, payload map[string]interface{}) bool {
+	status := scanMediaFile(filePath)
+	if status == "" {
+		return true
+	}
+	payload["scan_status"] = status
+	if status == SCAN_CLEAN {
+		return true
+	}
+	fmt.Printf("WARNING: Media quarantined (scan %s): %s\n", status, filePath)
+	if err := quarantineMediaFile(filePath); err != nil {
+		fmt.Println("ERROR: Could not quarantine media, deleting it", err)
+		os.Remove(filePath)
+	}
+	// Forget the file, so identical media received later isn't deduplicated onto it
+	if err := dbDeleteMediaFileInfo(filepath.Base(filePath)); err != nil {
+		fmt.Printf("ERROR: Could not remove info of quarantined media %s: %v\n", filePath, err)
+	}
+	return false
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestScanReceivedMediaCommand(t *testing.T) {
+	_, teardown := setupTestServer()
+	defer teardown()
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "doc.pdf")
+
+	// No scanner configured
+	t.Setenv("SCAN_COMMAND", "")
+	t.Setenv("CLAMAV_ADDRESS", "")
+	payload := map[string]interface{}{}
+	os.WriteFile(file, []byte("hello"), 0644)
+	if !scanReceivedMedia(file, payload) || payload["scan_status"] != nil {
+		t.Fatalf("Expected no scan without a scanner, got %v", payload)
+	}
+
+	// Clean file (exit 0)
+	t.Setenv("SCAN_COMMAND", "true")
+	payload = map[string]interface{}{}
+	if !scanReceivedMedia(file, payload) || payload["scan_status"] != SCAN_CLEAN {
+		t.Fatalf("Expected clean scan, got %v", payload)
+	}
+
+	// Infected file (exit 1) is quarantined and forgotten
+	dbSaveMediaFileInfo(1, "doc.pdf", "application/pdf", "doc.pdf", "hash")
+	t.Setenv("SCAN_COMMAND", "false")
+	payload = map[string]interface{}{}
+	if scanReceivedMedia(file, payload) || payload["scan_status"] != SCAN_INFECTED {
+		t.Fatalf("Expected infected scan, got %v", payload)
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Fatalf("Infected file should have been moved")
+	}
+	if _, err := os.Stat(filepath.Join(dir, QUARANTINE_SUBDIR, "doc.pdf")); err != nil {
+		t.Fatalf("Infected file not in quarantine: %v", err)
+	}
+	if _, _, err := dbGetMediaFileInfo("doc.pdf"); err == nil {
+		t.Fatal("Quarantined file should no longer be recorded")
+	}
+
+	// Scanner failure fails closed: the file is quarantined too
+	t.Setenv("SCAN_COMMAND", "/nonexistent/scanner")
+	os.WriteFile(file, []byte("hello"), 0644)
+	payload = map[string]interface{}{}
+	if scanReceivedMedia(file, payload) || payload["scan_status"] != SCAN_ERROR {
+		t.Fatalf("Expected scan error, got %v", payload)
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Fatalf("Unscanned file should have been moved")
+	}
+}
+
+// Minimal clamd INSTREAM server flagging files that contain "EICAR"
+func fakeClamd(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func(conn net.Conn) {
+			defer conn.Close()
+			cmd := make([]byte, len("zINSTREAM\x00"))
+			io.ReadFull(conn, cmd)
+			var data []byte
+			size := make([]byte, 4)
+			for {
+				if _, err := io.ReadFull(conn, size); err != nil {
+					return
+				}
+				n := binary.BigEndian.Uint32(size)
+				if n == 0 {
+					break
+				}
+				chunk := make([]byte, n)
+				io.ReadFull(conn, chunk)
+				data = append(data, chunk...)
+			}
+			if strings.Contains(string(data), "EICAR") {
+				conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+			} else {
+				conn.Write([]byte("stream: OK\x00"))
+			}
+		}(conn)
+	}
+}
+
+func TestScanMediaFileClamd(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer l.Close()
+	go fakeClamd(l)
+
+	t.Setenv("SCAN_COMMAND", "")
+	t.Setenv("CLAMAV_ADDRESS", l.Addr().String())
+
+	dir := t.TempDir()
+	clean := filepath.Join(dir, "clean.txt")
+	infected := filepath.Join(dir, "infected.txt")
+	os.WriteFile(clean, []byte("just a document"), 0644)
+	os.WriteFile(infected, []byte("X5O!P%@AP EICAR test"), 0644)
+
+	if got := scanMediaFile(clean); got != SCAN_CLEAN {
+		t.Fatalf("Expected clean, got %s", got)
+	}
+	if got := scanMediaFile(infected); got != SCAN_INFECTED {
+		t.Fatalf("Expected infected, got %s", got)
+	}
+}
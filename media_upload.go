@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+// --- Outgoing media uploads ---
+// Large media is uploaded out-of-band to a single-use URL, then referenced
+// by media_id in /api/messages/send instead of being pushed through JSON.
+
+const (
+	MEDIA_UPLOAD_URL_TTL   = 15 * time.Minute
+	DEFAULT_MAX_UPLOAD_MB  = 512
+	MEDIA_UPLOADS_SUBDIR   = "uploads"
+	MEDIA_UPLOAD_PENDING   = "pending"
+	MEDIA_UPLOAD_COMPLETED = "uploaded"
+)
+
+type MediaUpload struct {
+	ID        string    `json:"media_id"`
+	UserID    int64     `json:"-"`
+	Status    string    `json:"status"`
+	MediaType string    `json:"media_type"` // "image", "video", "audio" or "document"
+	FileName  string    `json:"file_name,omitempty"`
+	MimeType  string    `json:"mime_type,omitempty"`
+	Size      int64     `json:"size"`
+	FilePath  string    `json:"-"`
+	ExpiresAt time.Time `json:"expires_at"` // Of the upload URL, then of the uploaded file
+}
+
+// Expiry of uploaded files while media is kept forever (RETENTION_MEDIA=0)
+var mediaUploadKeptForever = time.Date(9999, 12, 31, 23, 59, 59, 0, time.UTC)
+
+// When a file uploaded at uploadedAt expires, after the media retention window
+func mediaUploadExpiry(uploadedAt time.Time) time.Time {
+	window := retentionWindows[RETENTION_MEDIA]
+	if window <= 0 {
+		return mediaUploadKeptForever
+	}
+	return uploadedAt.Add(window)
+}
+
+// Maximum accepted upload size in bytes (MAX_UPLOAD_MB env, default 512 MB)
+func maxUploadBytes() int64 {
+	mb, err := strconv.Atoi(os.Getenv("MAX_UPLOAD_MB"))
+	if err != nil || mb <= 0 {
+		mb = DEFAULT_MAX_UPLOAD_MB
+	}
+	return int64(mb) << 20
+}
+
+// Unguessable token identifying a single upload URL
+func generateUploadToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Public base URL for links handed out to clients (BASE_URL env, else the request host)
+func publicBaseURL(r *http.Request) string {
+	if baseURL := os.Getenv("BASE_URL"); baseURL != "" {
+		return strings.TrimRight(baseURL, "/")
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s", scheme, r.Host)
+}
+
+// Map a MIME type to the WhatsApp media kind used for sending
+func mediaTypeForMime(mimeType string) string {
+	switch {
+	case strings.HasPrefix(mimeType, "image/"):
+		return "image"
+	case strings.HasPrefix(mimeType, "video/"):
+		return "video"
+	case strings.HasPrefix(mimeType, "audio/"):
+		return "audio"
+	}
+	return "document"
+}
+
+var (
+	errUploadTooLarge = errors.New("Upload too large")
+	errEmptyUpload    = errors.New("Empty upload")
+)
+
+// Create a media upload row; token is empty for uploads stored directly by the server
+func dbCreateMediaUpload(m MediaUpload, token string) error {
+	var tokenValue interface{}
+	if token != "" {
+		tokenValue = token
+	}
+	_, err := db.Exec(`INSERT INTO media_uploads (id, user_id, token, status, media_type, file_name, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		m.ID, m.UserID, tokenValue, m.Status, m.MediaType, m.FileName, m.ExpiresAt.UTC().Format(time.RFC3339))
+	return err
+}
+
+const mediaUploadColumns = `id, user_id, status, media_type, file_name, mime_type, size, file_path, expires_at`
+
+func scanMediaUpload(row interface{ Scan(...interface{}) error }) (MediaUpload, error) {
+	var m MediaUpload
+	var expiresAt string
+	err := row.Scan(&m.ID, &m.UserID, &m.Status, &m.MediaType, &m.FileName, &m.MimeType, &m.Size, &m.FilePath, &expiresAt)
+	if err != nil {
+		return m, err
+	}
+	m.ExpiresAt, _ = time.Parse(time.RFC3339, expiresAt)
+	return m, nil
+}
+
+// Get a media upload owned by a user
+func dbGetMediaUpload(userID int64, mediaID string) (MediaUpload, error) {
+	row := db.QueryRow(`SELECT `+mediaUploadColumns+` FROM media_uploads WHERE user_id = ? AND id = ?`, userID, mediaID)
+	return scanMediaUpload(row)
+}
+
+// Atomically claim a pending upload token so only one upload can use it at a time
+func dbClaimMediaUploadToken(token string) (MediaUpload, error) {
+	row := db.QueryRow(`UPDATE media_uploads SET token = NULL WHERE token = ? AND status = ? RETURNING `+mediaUploadColumns,
+		token, MEDIA_UPLOAD_PENDING)
+	return scanMediaUpload(row)
+}
+
+// Give a claimed token back after a failed upload, so the URL can be retried
+func dbReleaseMediaUploadToken(mediaID, token string) error {
+	_, err := db.Exec(`UPDATE media_uploads SET token = ? WHERE id = ? AND status = ?`, token, mediaID, MEDIA_UPLOAD_PENDING)
+	return err
+}
+
+// Record the chat an upload is sent to, so erasing the chat's data removes it
+func dbSetMediaUploadChat(mediaID, chatJID string) error {
+	_, err := db.Exec(`UPDATE media_uploads SET chat_jid = ? WHERE id = ?`, chatJID, mediaID)
+	return err
+}
+
+func dbCompleteMediaUpload(m MediaUpload) error {
+	_, err := db.Exec(`UPDATE media_uploads SET status = ?, media_type = ?, mime_type = ?, size = ?, file_path = ?, expires_at = ? WHERE id = ?`,
+		MEDIA_UPLOAD_COMPLETED, m.MediaType, m.MimeType, m.Size, m.FilePath, m.ExpiresAt.UTC().Format(time.RFC3339), m.ID)
+	return err
+}
+
+// POST /api/media/upload-url
+// Returns a one-time upload URL; the uploaded file is later referenced by media_id when sending.
+func handleCreateUploadURL(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID := r.Context().Value("userID").(int64)
+
+	var req struct {
+		MediaType string `json:"media_type"`
+		FileName  string `json:"file_name"`
+	}
+	if err := decodeJSONBody(w, r, &req); err != nil && err != io.EOF {
+		writeBodyError(w, err)
+		return
+	}
+	switch req.MediaType {
+	case "", "image", "video", "audio", "document":
+	default:
+		apiError(w, "Invalid media_type", http.StatusBadRequest)
+		return
+	}
+
+	upload := MediaUpload{
+		ID:        "med_" + generateWebhookID(),
+		UserID:    userID,
+		Status:    MEDIA_UPLOAD_PENDING,
+		MediaType: req.MediaType,
+		ExpiresAt: time.Now().Add(MEDIA_UPLOAD_URL_TTL),
+	}
+	if req.FileName != "" {
+		upload.FileName = filepath.Base(req.FileName)
+	}
+	token := generateUploadToken()
+	if err := dbCreateMediaUpload(upload, token); err != nil {
+		fmt.Println("ERROR: Could not create media upload", err)
+		apiError(w, "Failed to create upload URL", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"media_id":   upload.ID,
+		"upload_url": publicBaseURL(r) + "/api/media/upload/" + token,
+		"method":     "PUT",
+		"expires_at": upload.ExpiresAt.UTC().Format(time.RFC3339),
+		"max_bytes":  maxUploadBytes(),
+	})
+}
+
+// PUT /api/media/upload/{token}
+// The raw request body is the file. The token authenticates the upload and is single-use:
+// it is used up once the file is stored, and a failed upload can be retried.
+func handleMediaUpload(mediaDir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "PUT" && r.Method != "POST" {
+			apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		upload, err := dbClaimMediaUploadToken(r.PathValue("token"))
+		if err == sql.ErrNoRows {
+			apiError(w, "Upload URL is invalid or already used", http.StatusNotFound)
+			return
+		} else if err != nil {
+			fmt.Println("ERROR: Could not claim upload token", err)
+			apiError(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		if time.Now().After(upload.ExpiresAt) {
+			apiError(w, "Upload URL has expired", http.StatusGone)
+			return
+		}
+
+		body := http.MaxBytesReader(w, r.Body, maxUploadBytes())
+		if err := storeMediaUpload(mediaDir, &upload, body, r.Header.Get("Content-Type")); err != nil {
+			if err := dbReleaseMediaUploadToken(upload.ID, r.PathValue("token")); err != nil {
+				fmt.Println("ERROR: Could not release upload token", err)
+			}
+			switch err {
+			case errUploadTooLarge:
+				apiError(w, err.Error(), http.StatusRequestEntityTooLarge)
+			case errEmptyUpload:
+				apiError(w, err.Error(), http.StatusBadRequest)
+			default:
+				fmt.Println("ERROR: Could not store media upload", err)
+				apiError(w, "Failed to store upload", http.StatusInternalServerError)
+			}
+			return
+		}
+		fmt.Printf("SUCCESS: Stored media upload %s (%d bytes, %s)\n", upload.ID, upload.Size, upload.MimeType)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(upload)
+	}
+}
+
+// Write an upload's content to disk and mark it completed. An empty (or octet-stream)
+// mimeType is sniffed from the content, and an empty media type derived from it.
+func storeMediaUpload(mediaDir string, upload *MediaUpload, src io.Reader, mimeType string) error {
+	dir := filepath.Join(mediaDir, MEDIA_UPLOADS_SUBDIR)
+	os.MkdirAll(dir, 0755)
+	upload.FilePath = filepath.Join(dir, upload.ID)
+	f, err := os.Create(upload.FilePath)
+	if err != nil {
+		return err
+	}
+
+	// Stream to disk, keeping the first bytes for content sniffing
+	maxBytes := maxUploadBytes()
+	src = io.LimitReader(src, maxBytes+1)
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(src, head)
+	head = head[:n]
+	written, err := io.Copy(f, io.MultiReader(bytes.NewReader(head), src))
+	f.Close()
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) || written > maxBytes {
+		os.Remove(upload.FilePath)
+		return errUploadTooLarge
+	}
+	if err != nil {
+		os.Remove(upload.FilePath)
+		return err
+	}
+	if written == 0 {
+		os.Remove(upload.FilePath)
+		return errEmptyUpload
+	}
+
+	upload.Size = written
+	upload.MimeType = mimeType
+	if upload.MimeType == "" || upload.MimeType == "application/octet-stream" {
+		upload.MimeType = http.DetectContentType(head)
+	}
+	if upload.MediaType == "" {
+		upload.MediaType = mediaTypeForMime(upload.MimeType)
+	}
+	upload.Status = MEDIA_UPLOAD_COMPLETED
+	upload.ExpiresAt = mediaUploadExpiry(time.Now())
+	if err := dbCompleteMediaUpload(*upload); err != nil {
+		os.Remove(upload.FilePath)
+		return err
+	}
+	return nil
+}
+
+// Remove a media upload and its file, e.g. when the send it was created for is rejected
+func discardMediaUpload(upload MediaUpload) {
+	if upload.FilePath != "" {
+		os.Remove(upload.FilePath)
+	}
+	db.Exec(`DELETE FROM media_uploads WHERE id = ?`, upload.ID)
+}
+
+// Upload a stored media file to WhatsApp and build the message to send
+func buildMediaMessage(ctx context.Context, client WAClient, upload MediaUpload, caption string) (*waProto.Message, error) {
+	f, err := os.Open(upload.FilePath)
+	if err != nil {
+		return nil, fmt.Errorf("media file unavailable: %w", err)
+	}
+	defer f.Close()
+
+	appInfo := map[string]whatsmeow.MediaType{
+		"image":    whatsmeow.MediaImage,
+		"video":    whatsmeow.MediaVideo,
+		"audio":    whatsmeow.MediaAudio,
+		"document": whatsmeow.MediaDocument,
+	}[upload.MediaType]
+	if appInfo == "" {
+		appInfo = whatsmeow.MediaDocument
+	}
+
+	resp, err := client.UploadReader(ctx, f, nil, appInfo)
+	if err != nil {
+		return nil, fmt.Errorf("failed to upload media: %w", err)
+	}
+
+	switch upload.MediaType {
+	case "image":
+		return &waProto.Message{ImageMessage: &waProto.ImageMessage{
+			Caption:       proto.String(caption),
+			Mimetype:      proto.String(upload.MimeType),
+			URL:           &resp.URL,
+			DirectPath:    &resp.DirectPath,
+			MediaKey:      resp.MediaKey,
+			FileEncSHA256: resp.FileEncSHA256,
+			FileSHA256:    resp.FileSHA256,
+			FileLength:    &resp.FileLength,
+		}}, nil
+	case "video":
+		return &waProto.Message{VideoMessage: &waProto.VideoMessage{
+			Caption:       proto.String(caption),
+			Mimetype:      proto.String(upload.MimeType),
+			URL:           &resp.URL,
+			DirectPath:    &resp.DirectPath,
+			MediaKey:      resp.MediaKey,
+			FileEncSHA256: resp.FileEncSHA256,
+			FileSHA256:    resp.FileSHA256,
+			FileLength:    &resp.FileLength,
+		}}, nil
+	case "audio":
+		return &waProto.Message{AudioMessage: &waProto.AudioMessage{
+			Mimetype:      proto.String(upload.MimeType),
+			URL:           &resp.URL,
+			DirectPath:    &resp.DirectPath,
+			MediaKey:      resp.MediaKey,
+			FileEncSHA256: resp.FileEncSHA256,
+			FileSHA256:    resp.FileSHA256,
+			FileLength:    &resp.FileLength,
+		}}, nil
+	}
+	fileName := upload.FileName
+	if fileName == "" {
+		fileName = upload.ID
+	}
+	return &waProto.Message{DocumentMessage: &waProto.DocumentMessage{
+		Caption:       proto.String(caption),
+		Title:         proto.String(fileName),
+		FileName:      proto.String(fileName),
+		Mimetype:      proto.String(upload.MimeType),
+		URL:           &resp.URL,
+		DirectPath:    &resp.DirectPath,
+		MediaKey:      resp.MediaKey,
+		FileEncSHA256: resp.FileEncSHA256,
+		FileSHA256:    resp.FileSHA256,
+		FileLength:    &resp.FileLength,
+	}}, nil
+}
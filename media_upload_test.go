@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestMediaUploadURL(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+
+	_, apiKey := registerWithAPIKey(t, ts, "uploaduser@example.com", "uploadpass123")
+
+	var created map[string]interface{}
+	resp := apiRequest(t, "POST", ts.URL+"/api/media/upload-url", apiKey, map[string]string{"file_name": "../report.pdf"}, &created)
+	if resp.StatusCode != 200 {
+		t.Fatalf("Create upload URL failed, status: %d", resp.StatusCode)
+	}
+	mediaID, _ := created["media_id"].(string)
+	uploadURL, _ := created["upload_url"].(string)
+	if mediaID == "" || uploadURL == "" {
+		t.Fatalf("Missing media_id or upload_url: %v", created)
+	}
+
+	// Invalid media type is rejected
+	resp = apiRequest(t, "POST", ts.URL+"/api/media/upload-url", apiKey, map[string]string{"media_type": "sticker"}, nil)
+	if resp.StatusCode != 400 {
+		t.Fatalf("Expected 400 for invalid media_type, got %d", resp.StatusCode)
+	}
+
+	// Upload without Content-Type; the type is sniffed from the content
+	putBody := func(body []byte) *http.Response {
+		req, _ := http.NewRequest("PUT", uploadURL, bytes.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Upload failed: %v", err)
+		}
+		return resp
+	}
+	put := func() *http.Response { return putBody([]byte("%PDF-1.4 test document")) }
+
+	// A failed upload doesn't use up the URL
+	if resp := putBody(nil); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for an empty upload, got %d", resp.StatusCode)
+	}
+	resp = put()
+	if resp.StatusCode != 200 {
+		t.Fatalf("Upload failed, status: %d", resp.StatusCode)
+	}
+
+	userID, _ := getUserIDByEmail("uploaduser@example.com")
+	upload, err := dbGetMediaUpload(userID, mediaID)
+	if err != nil {
+		t.Fatalf("Upload not stored: %v", err)
+	}
+	if upload.Status != MEDIA_UPLOAD_COMPLETED || upload.MimeType != "application/pdf" || upload.MediaType != "document" || upload.FileName != "report.pdf" {
+		t.Fatalf("Unexpected upload: %+v", upload)
+	}
+	// The stored file expires with the media retention window, not the upload URL
+	if upload.ExpiresAt.Before(time.Now().Add(MEDIA_UPLOAD_URL_TTL)) {
+		t.Fatalf("Upload should expire with the media retention window, expires at %v", upload.ExpiresAt)
+	}
+
+	// Upload URLs are single-use
+	resp = put()
+	if resp.StatusCode != 404 {
+		t.Fatalf("Expected 404 when reusing upload URL, got %d", resp.StatusCode)
+	}
+
+	// Unknown media IDs can't be sent
+	resp = apiRequest(t, "POST", ts.URL+"/api/messages/send", apiKey, map[string]string{
+		"chat_jid": "1234567890@s.whatsapp.net",
+		"media_id": "med_doesnotexist",
+	}, nil)
+	if resp.StatusCode != 400 {
+		t.Fatalf("Expected 400 for unknown media_id, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+	"google.golang.org/protobuf/proto"
+)
+
+// --- Message edits ---
+// /api/messages/edit replaces the text of a message sent earlier. The edit is queued like
+// any other send (same checks, limits, callbacks and queue.status events) and goes out as
+// a WhatsApp edit of the original message ID. WhatsApp only accepts edits for a while
+// after sending: for messages sent from the queue (see sent_messages.go) the window is
+// checked when the edit is made, and an edit still queued when it closes expires.
+
+const MESSAGE_EDIT_WINDOW = 15 * time.Minute
+
+// Wrap new content as an edit of one of our own messages, like whatsmeow's BuildEdit
+func buildEditMessage(chat types.JID, id string, content *waProto.Message) *waProto.Message {
+	return &waProto.Message{
+		EditedMessage: &waProto.FutureProofMessage{
+			Message: &waProto.Message{
+				ProtocolMessage: &waProto.ProtocolMessage{
+					Key: &waProto.MessageKey{
+						FromMe:    proto.Bool(true),
+						ID:        proto.String(id),
+						RemoteJID: proto.String(chat.String()),
+					},
+					Type:          waProto.ProtocolMessage_MESSAGE_EDIT.Enum(),
+					EditedMessage: content,
+					TimestampMS:   proto.Int64(time.Now().UnixMilli()),
+				},
+			},
+		},
+	}
+}
+
+// When the edit window of a sent message closes. The zero time if the message wasn't
+// sent from the queue, in which case WhatsApp enforces the window itself.
+func messageEditDeadline(userID int64, chatJID, messageID string, now time.Time) (time.Time, error) {
+	var sentAt string
+	err := db.QueryRow(`SELECT server_timestamp FROM sent_messages WHERE user_id = ? AND chat_jid = ? AND message_id = ? AND edit_of = ''`,
+		userID, chatJID, messageID).Scan(&sentAt)
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	t, err := time.Parse(time.RFC3339, sentAt)
+	if err != nil {
+		return time.Time{}, nil
+	}
+	deadline := t.Add(MESSAGE_EDIT_WINDOW)
+	if !now.Before(deadline) {
+		return deadline, &SendError{Status: http.StatusConflict, Message: fmt.Sprintf("Messages can only be edited within %d minutes of sending", int(MESSAGE_EDIT_WINDOW.Minutes()))}
+	}
+	return deadline, nil
+}
+
+// POST /api/messages/edit {"chat_jid", "message_id", "message", "callback_url"?}
+func handleEditMessage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		ChatJID     string `json:"chat_jid"`
+		MessageID   string `json:"message_id"` // WhatsApp ID of the message to edit
+		Message     string `json:"message"`    // The new text
+		CallbackURL string `json:"callback_url,omitempty"`
+	}
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	if req.MessageID == "" {
+		apiError(w, "Missing message_id", http.StatusBadRequest)
+		return
+	}
+
+	result := enqueueWithAPIKey(w, r, SendRequest{
+		ChatJID:     req.ChatJID,
+		Message:     req.Message,
+		CallbackURL: req.CallbackURL,
+		Source:      "api",
+		EditID:      req.MessageID,
+	})
+	if result == nil {
+		return
+	}
+
+	response := sendResultResponse(result)
+	response["edit_of"] = req.MessageID
+	response["message"] = "Edit queued successfully"
+	if result.Pending {
+		response["message"] = "Edit is waiting for approval"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestEditSentMessage(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+
+	email := "edits@example.com"
+	_, apiKey := registerWithAPIKey(t, ts, email, "editspass123")
+	fake := useFakeWAClient(t, email)
+
+	callbacks := make(chan map[string]interface{}, 2)
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		callbacks <- body
+	}))
+	defer callback.Close()
+	waitCallback := func() map[string]interface{} {
+		t.Helper()
+		select {
+		case body := <-callbacks:
+			return body
+		case <-time.After(15 * time.Second):
+			t.Fatalf("Timed out waiting for a callback")
+		}
+		return nil
+	}
+
+	chat := "14155550100@s.whatsapp.net"
+	apiRequest(t, "POST", ts.URL+"/api/messages/send", apiKey, map[string]string{"chat_jid": chat, "message": "Driver is 10 minutes away", "callback_url": callback.URL}, nil)
+	messageID := waitCallback()["message_id"].(string)
+
+	var queued map[string]interface{}
+	resp := apiRequest(t, "POST", ts.URL+"/api/messages/edit", apiKey, map[string]string{
+		"chat_jid": chat, "message_id": messageID, "message": "Driver is outside", "callback_url": callback.URL,
+	}, &queued)
+	if resp.StatusCode != 200 || queued["edit_of"] != messageID || queued["expires_at"] == nil {
+		t.Fatalf("Edit not queued: %d %v", resp.StatusCode, queued)
+	}
+	if body := waitCallback(); body["status"] != "sent" || body["queue_id"] != queued["queue_id"] {
+		t.Fatalf("Unexpected edit callback: %v", body)
+	}
+
+	sent := fake.sentMessages()
+	if len(sent) != 2 {
+		t.Fatalf("Expected the message and its edit, got %+v", sent)
+	}
+	edit := sent[1].Message.GetEditedMessage().GetMessage().GetProtocolMessage()
+	if edit.GetKey().GetID() != messageID || edit.GetEditedMessage().GetConversation() != "Driver is outside" {
+		t.Fatalf("Unexpected edit message: %+v", sent[1].Message)
+	}
+
+	// The original shows the new text, and the edit is listed with edit_of
+	var listed []SentMessage
+	apiRequest(t, "GET", ts.URL+"/api/messages/sent", apiKey, nil, &listed)
+	if len(listed) != 2 {
+		t.Fatalf("Unexpected listing: %+v", listed)
+	}
+	for _, m := range listed {
+		if m.Text != "Driver is outside" || (m.MessageID != messageID && m.EditOf != messageID) {
+			t.Fatalf("Unexpected sent message: %+v", m)
+		}
+	}
+
+	// Past the edit window
+	db.Exec(`UPDATE sent_messages SET server_timestamp = ? WHERE message_id = ?`, time.Now().Add(-MESSAGE_EDIT_WINDOW).UTC().Format(time.RFC3339), messageID)
+	resp = apiRequest(t, "POST", ts.URL+"/api/messages/edit", apiKey, map[string]string{"chat_jid": chat, "message_id": messageID, "message": "Too late"}, nil)
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("Expected 409 past the edit window, got %d", resp.StatusCode)
+	}
+	for _, bad := range []map[string]string{
+		{"chat_jid": chat, "message": "No ID"},
+		{"chat_jid": chat, "message_id": messageID},
+	} {
+		if resp := apiRequest(t, "POST", ts.URL+"/api/messages/edit", apiKey, bad, nil); resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("Expected 400 for %v, got %d", bad, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+// --- Message forwarding ---
+// /api/messages/forward sends an archived message (text or media) to another chat, marked
+// as forwarded like a forward from the phone. It is queued and checked like any other send.
+// Media is copied from the stored file into a media upload, as the webhook receiver does
+// for attachments.
+
+var errForwardMediaUnavailable = errors.New("The message's media is not available")
+
+// Mark an outgoing message as forwarded. Plain text becomes extended text, which can carry
+// the forwarding context.
+func markForwarded(msg *waProto.Message) *waProto.Message {
+	forwarded := &waProto.ContextInfo{IsForwarded: proto.Bool(true), ForwardingScore: proto.Uint32(1)}
+	switch {
+	case msg.ImageMessage != nil:
+		msg.ImageMessage.ContextInfo = forwarded
+	case msg.VideoMessage != nil:
+		msg.VideoMessage.ContextInfo = forwarded
+	case msg.AudioMessage != nil:
+		msg.AudioMessage.ContextInfo = forwarded
+	case msg.DocumentMessage != nil:
+		msg.DocumentMessage.ContextInfo = forwarded
+	default:
+		return &waProto.Message{ExtendedTextMessage: &waProto.ExtendedTextMessage{
+			Text:        proto.String(msg.GetConversation()),
+			ContextInfo: forwarded,
+		}}
+	}
+	return msg
+}
+
+// Copy an archived message's media into a completed upload, to send it by media_id
+func forwardedMediaUpload(mediaDir string, userID int64, m ArchivedMessage) (*MediaUpload, error) {
+	mediaURL, _ := m.Payload["media_url"].(string)
+	if mediaURL == "" {
+		return nil, errForwardMediaUnavailable
+	}
+	f, err := os.Open(filepath.Join(mediaDir, path.Base(mediaURL)))
+	if err != nil {
+		return nil, errForwardMediaUnavailable
+	}
+	defer f.Close()
+
+	fileName, _ := m.Payload["file_name"].(string)
+	mimeType, _ := m.Payload["mime_type"].(string)
+	upload := MediaUpload{
+		ID:        "med_" + generateWebhookID(),
+		UserID:    userID,
+		Status:    MEDIA_UPLOAD_PENDING,
+		MediaType: m.Type,
+		ExpiresAt: time.Now().Add(MEDIA_UPLOAD_URL_TTL),
+	}
+	if fileName != "" {
+		upload.FileName = filepath.Base(fileName)
+	}
+	if err := dbCreateMediaUpload(upload, ""); err != nil {
+		return nil, err
+	}
+	if err := storeMediaUpload(mediaDir, &upload, f, mimeType); err != nil {
+		discardMediaUpload(upload)
+		return nil, err
+	}
+	return &upload, nil
+}
+
+// POST /api/messages/forward {"source_chat_jid", "message_id", "chat_jid", "callback_url"?}
+func handleForwardMessage(mediaDir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		userID := r.Context().Value("userID").(int64)
+
+		var req struct {
+			SourceChatJID string `json:"source_chat_jid"` // Chat of the archived message
+			MessageID     string `json:"message_id"`
+			ChatJID       string `json:"chat_jid"` // Chat to forward it to
+			CallbackURL   string `json:"callback_url,omitempty"`
+		}
+		if err := decodeJSONBody(w, r, &req); err != nil {
+			writeBodyError(w, err)
+			return
+		}
+		if req.SourceChatJID == "" || req.MessageID == "" {
+			apiError(w, "Missing source_chat_jid or message_id", http.StatusBadRequest)
+			return
+		}
+		source, err := normalizeChatJID(req.SourceChatJID)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, ERR_INVALID_JID, "Invalid source_chat_jid")
+			return
+		}
+		archived, err := dbGetArchivedMessage(userID, source.String(), req.MessageID)
+		if err == sql.ErrNoRows {
+			apiError(w, "Message not found in the archive", http.StatusNotFound)
+			return
+		} else if err != nil {
+			fmt.Println("ERROR: Could not load archived message", err)
+			apiError(w, "Failed to load message", http.StatusInternalServerError)
+			return
+		}
+
+		send := SendRequest{ChatJID: req.ChatJID, CallbackURL: req.CallbackURL, Source: "api", Forwarded: true}
+		var stored *MediaUpload
+		switch archived.Type {
+		case "text":
+			send.Message = archived.Text
+		case "image", "video", "audio", "document":
+			if stored, err = forwardedMediaUpload(mediaDir, userID, archived); err == errForwardMediaUnavailable {
+				apiError(w, err.Error(), http.StatusConflict)
+				return
+			} else if err != nil {
+				fmt.Printf("ERROR: Could not copy media of message %s for forwarding: %v\n", archived.MessageID, err)
+				apiError(w, "Failed to prepare media", http.StatusInternalServerError)
+				return
+			}
+			send.MediaID = stored.ID
+			send.Message, _ = archived.Payload["caption"].(string)
+		default:
+			apiError(w, "Only text and media messages can be forwarded", http.StatusBadRequest)
+			return
+		}
+
+		result := enqueueWithAPIKey(w, r, send)
+		if result == nil {
+			if stored != nil {
+				discardMediaUpload(*stored)
+			}
+			return
+		}
+
+		response := sendResultResponse(result)
+		response["forwarded_from"] = map[string]string{"chat_jid": archived.ChatJID, "message_id": archived.MessageID}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestForwardArchivedMessages(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+
+	email := "forward@example.com"
+	_, apiKey := registerWithAPIKey(t, ts, email, "forwardpass123")
+	fake := useFakeWAClient(t, email)
+	userID, _ := getUserIDByEmail(email)
+
+	customer := "14155550100@s.whatsapp.net"
+	team := "120363000000000001@g.us"
+	os.WriteFile("test_media/receipt.jpg", []byte("\xff\xd8\xff fake jpeg"), 0644)
+	archiveMessage(userID, customer, map[string]interface{}{"id": "TEXT1", "from": customer, "type": "text", "text": "My order never arrived"}, "")
+	archiveMessage(userID, customer, map[string]interface{}{"id": "IMG1", "from": customer, "type": "image", "caption": "The receipt", "media_url": "/media/receipt.jpg", "mime_type": "image/jpeg"}, "")
+	archiveMessage(userID, customer, map[string]interface{}{"id": "INVITE1", "from": customer, "type": "group_invite"}, "")
+	archiveMessage(userID, customer, map[string]interface{}{"id": "IMG2", "from": customer, "type": "image"}, "")
+
+	for _, id := range []string{"TEXT1", "IMG1"} {
+		var queued map[string]interface{}
+		resp := apiRequest(t, "POST", ts.URL+"/api/messages/forward", apiKey, map[string]string{"source_chat_jid": customer, "message_id": id, "chat_jid": team}, &queued)
+		if resp.StatusCode != 200 || queued["queue_id"] == nil {
+			t.Fatalf("Forward of %s failed: %d %v", id, resp.StatusCode, queued)
+		}
+	}
+
+	deadline := time.Now().Add(30 * time.Second)
+	for len(fake.sentMessages()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	sent := fake.sentMessages()
+	if len(sent) != 2 || sent[0].To.String() != team || sent[1].To.String() != team {
+		t.Fatalf("Expected both forwards sent to the team, got %+v", sent)
+	}
+	text := sent[0].Message.GetExtendedTextMessage()
+	if text.GetText() != "My order never arrived" || !text.GetContextInfo().GetIsForwarded() {
+		t.Fatalf("Unexpected forwarded text: %+v", sent[0].Message)
+	}
+	img := sent[1].Message.GetImageMessage()
+	if img.GetCaption() != "The receipt" || img.GetMimetype() != "image/jpeg" || !img.GetContextInfo().GetIsForwarded() {
+		t.Fatalf("Unexpected forwarded image: %+v", sent[1].Message)
+	}
+
+	for _, c := range []struct {
+		id     string
+		status int
+	}{
+		{"MISSING", http.StatusNotFound},
+		{"INVITE1", http.StatusBadRequest},
+		{"IMG2", http.StatusConflict},
+	} {
+		resp := apiRequest(t, "POST", ts.URL+"/api/messages/forward", apiKey, map[string]string{"source_chat_jid": customer, "message_id": c.id, "chat_jid": team}, nil)
+		if resp.StatusCode != c.status {
+			t.Fatalf("Expected %d forwarding %s, got %d", c.status, c.id, resp.StatusCode)
+		}
+	}
+}
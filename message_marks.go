@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"go.mau.fi/whatsmeow/appstate"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+	"google.golang.org/protobuf/proto"
+)
+
+// --- Starred and pinned messages ---
+// Messages can be starred (an app state change, private to the account) and pinned in
+// their chat (a message, seen by everyone in the chat) through the API. Stars and pins
+// made anywhere, including on the phone, are sent to webhooks subscribed to
+// "message.starred" and "message.pinned".
+
+const DEFAULT_PIN_DAYS = 7
+
+// How long a pin can last, in days, as offered by WhatsApp
+var pinDurations = map[int]bool{1: true, 7: true, 30: true}
+
+// Who sent a message we know of: one sent from the queue, or one in the message archive
+func dbMessageAuthor(userID int64, chatJID, messageID string) (sender types.JID, fromMe bool, err error) {
+	var queueID string
+	err = db.QueryRow(`SELECT queue_id FROM sent_messages WHERE user_id = ? AND chat_jid = ? AND message_id = ?`, userID, chatJID, messageID).Scan(&queueID)
+	if err == nil {
+		return types.EmptyJID, true, nil
+	} else if err != sql.ErrNoRows {
+		return types.EmptyJID, false, err
+	}
+	archived, err := dbGetArchivedMessage(userID, chatJID, messageID)
+	if err != nil {
+		return types.EmptyJID, false, err
+	}
+	sender, _ = types.ParseJID(archived.Sender)
+	return sender, false, nil
+}
+
+// Build a pin (days > 0) or unpin of a message, for everyone in the chat
+func buildPinMessage(chat, sender types.JID, messageID string, fromMe bool, days int) *waProto.Message {
+	key := &waProto.MessageKey{
+		RemoteJID: proto.String(chat.String()),
+		FromMe:    proto.Bool(fromMe),
+		ID:        proto.String(messageID),
+	}
+	if chat.Server == types.GroupServer && !fromMe && !sender.IsEmpty() {
+		key.Participant = proto.String(sender.String())
+	}
+	pin := &waProto.PinInChatMessage{
+		Key:               key,
+		Type:              waProto.PinInChatMessage_UNPIN_FOR_ALL.Enum(),
+		SenderTimestampMS: proto.Int64(time.Now().UnixMilli()),
+	}
+	msg := &waProto.Message{PinInChatMessage: pin}
+	if days > 0 {
+		pin.Type = waProto.PinInChatMessage_PIN_FOR_ALL.Enum()
+		msg.MessageContextInfo = &waProto.MessageContextInfo{
+			MessageAddOnDurationInSecs: proto.Uint32(uint32(days * 24 * 60 * 60)),
+		}
+	}
+	return msg
+}
+
+// POST (star) or DELETE (unstar) /api/messages/{jid}/{id}/star, and the same for /pin.
+// A pin takes an optional {"days": 1 | 7 | 30}.
+func handleMarkMessage(mark string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" && r.Method != "DELETE" {
+			apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		userID := r.Context().Value("userID").(int64)
+		email := getUserEmailByID(userID)
+		on := r.Method == "POST"
+
+		chatJID, err := normalizeChatJID(r.PathValue("jid"))
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, ERR_INVALID_JID, "Invalid chat JID")
+			return
+		}
+		messageID := r.PathValue("id")
+
+		days := 0
+		if mark == "pin" && on {
+			var req struct {
+				Days int `json:"days"`
+			}
+			if err := decodeJSONBody(w, r, &req); err != nil && err != io.EOF {
+				writeBodyError(w, err)
+				return
+			}
+			days = req.Days
+			if days == 0 {
+				days = DEFAULT_PIN_DAYS
+			}
+			if !pinDurations[days] {
+				apiError(w, "Invalid days (use 1, 7 or 30)", http.StatusBadRequest)
+				return
+			}
+		}
+
+		if dbGetReceiveOnly(email) {
+			writeAPIError(w, http.StatusForbidden, ERR_RECEIVE_ONLY, "Sending is disabled: account is in receive-only mode")
+			return
+		}
+		if channel := chatChannel(chatJID.String()); channel != "" {
+			apiError(w, fmt.Sprintf("Messages can't be starred or pinned on %s", channel), http.StatusBadRequest)
+			return
+		}
+		sender, fromMe, err := dbMessageAuthor(userID, chatJID.String(), messageID)
+		if err == sql.ErrNoRows {
+			apiError(w, "Message not found among sent or archived messages", http.StatusNotFound)
+			return
+		} else if err != nil {
+			fmt.Println("ERROR: Could not look up message", messageID, err)
+			apiError(w, "Failed to load message", http.StatusInternalServerError)
+			return
+		}
+		client := userWAClient(email)
+		if client == nil {
+			writeAPIError(w, http.StatusServiceUnavailable, ERR_WA_DISCONNECTED, "WhatsApp client not connected")
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), waSendTimeout)
+		defer cancel()
+		response := map[string]interface{}{"success": true, "chat_jid": chatJID.String(), "message_id": messageID}
+		if mark == "star" {
+			// The change comes back from WhatsApp as a message.starred event
+			if chatJID.Server != types.GroupServer {
+				sender = chatJID
+			}
+			err = client.SendAppState(ctx, appstate.BuildStar(chatJID, sender, messageID, fromMe, on))
+			response["starred"] = on
+		} else {
+			_, err = client.SendMessage(ctx, chatJID, buildPinMessage(chatJID, sender, messageID, fromMe, days))
+			response["pinned"] = on
+			event := map[string]interface{}{"chat_jid": chatJID.String(), "message_id": messageID, "pinned": on, "from_me": fromMe, "source": "api"}
+			if on {
+				expiresAt := time.Now().Add(time.Duration(days) * 24 * time.Hour).UTC().Format(time.RFC3339)
+				response["expires_at"] = expiresAt
+				event["expires_at"] = expiresAt
+			}
+			if err == nil {
+				goEmitWebhookEvent(email, EVENT_MESSAGE_PINNED, chatJID.String(), event)
+			}
+		}
+		if err != nil {
+			fmt.Printf("ERROR: Failed to %s message %s in chat %s: %v\n", mark, messageID, chatJID, err)
+			apiError(w, fmt.Sprintf("Failed to %s message", mark), http.StatusBadGateway)
+			return
+		}
+
+		fmt.Printf("SUCCESS: Set %s=%v on message %s in chat %s\n", mark, on, messageID, chatJID)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// Report stars and pins made on WhatsApp to webhooks
+func handleMessageMarkEvent(email string, evt interface{}) {
+	switch v := evt.(type) {
+	case *events.Star:
+		if v.FromFullSync {
+			return // Old stars restored by a full sync, not changes
+		}
+		data := map[string]interface{}{
+			"chat_jid":   v.ChatJID.String(),
+			"message_id": v.MessageID,
+			"starred":    v.Action.GetStarred(),
+			"from_me":    v.IsFromMe,
+			"source":     "whatsapp",
+		}
+		if !v.SenderJID.IsEmpty() {
+			data["sender"] = v.SenderJID.String()
+		}
+		goEmitWebhookEvent(email, EVENT_MESSAGE_STARRED, v.ChatJID.String(), data)
+	case *events.Message:
+		pin := v.Message.GetPinInChatMessage()
+		if pin == nil {
+			return
+		}
+		pinned := pin.GetType() == waProto.PinInChatMessage_PIN_FOR_ALL
+		data := map[string]interface{}{
+			"chat_jid":   v.Info.Chat.String(),
+			"message_id": pin.GetKey().GetID(),
+			"pinned":     pinned,
+			"pinned_by":  v.Info.Sender.ToNonAD().String(),
+			"source":     "whatsapp",
+		}
+		if secs := v.Message.GetMessageContextInfo().GetMessageAddOnDurationInSecs(); pinned && secs > 0 {
+			data["expires_at"] = v.Info.Timestamp.Add(time.Duration(secs) * time.Second).UTC().Format(time.RFC3339)
+		}
+		goEmitWebhookEvent(email, EVENT_MESSAGE_PINNED, v.Info.Chat.String(), data)
+	}
+}
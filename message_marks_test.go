@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.mau.fi/whatsmeow/appstate"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+func TestStarAndPinMessages(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+
+	email := "marks@example.com"
+	_, apiKey := registerWithAPIKey(t, ts, email, "markspass123")
+	fake := useFakeWAClient(t, email)
+	userID, _ := getUserIDByEmail(email)
+
+	received := make(chan map[string]interface{}, 5)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&payload)
+		received <- payload
+	}))
+	defer receiver.Close()
+	apiRequest(t, "POST", ts.URL+"/api/webhooks/create", apiKey, map[string]interface{}{
+		"url": receiver.URL, "method": "POST", "events": []string{EVENT_MESSAGE_PINNED, EVENT_MESSAGE_STARRED},
+	}, nil)
+	waitEvent := func() map[string]interface{} {
+		t.Helper()
+		select {
+		case payload := <-received:
+			return payload
+		case <-time.After(5 * time.Second):
+			t.Fatal("Event not delivered")
+		}
+		return nil
+	}
+
+	group := "120363000000000001@g.us"
+	archiveMessage(userID, group, map[string]interface{}{"id": "ORDER1", "from": "14155550100@s.whatsapp.net", "type": "text", "text": "Urgent order"}, "")
+	base := ts.URL + "/api/messages/" + group + "/ORDER1"
+
+	var starred map[string]interface{}
+	if resp := apiRequest(t, "POST", base+"/star", apiKey, nil, &starred); resp.StatusCode != 200 || starred["starred"] != true {
+		t.Fatalf("Star failed: %d %v", resp.StatusCode, starred)
+	}
+	fake.mu.Lock()
+	patches := fake.appState
+	fake.mu.Unlock()
+	if len(patches) != 1 || len(patches[0].Mutations) != 1 || patches[0].Mutations[0].Index[0] != appstate.IndexStar || patches[0].Mutations[0].Index[2] != "ORDER1" {
+		t.Fatalf("Unexpected app state patches: %+v", patches)
+	}
+
+	var pinned map[string]interface{}
+	if resp := apiRequest(t, "POST", base+"/pin", apiKey, map[string]int{"days": 30}, &pinned); resp.StatusCode != 200 || pinned["expires_at"] == nil {
+		t.Fatalf("Pin failed: %d %v", resp.StatusCode, pinned)
+	}
+	sent := fake.sentMessages()
+	pin := sent[len(sent)-1].Message
+	if pin.GetPinInChatMessage().GetKey().GetID() != "ORDER1" || pin.GetPinInChatMessage().GetKey().GetParticipant() != "14155550100@s.whatsapp.net" ||
+		pin.GetMessageContextInfo().GetMessageAddOnDurationInSecs() != 30*24*60*60 {
+		t.Fatalf("Unexpected pin message: %+v", pin)
+	}
+	if event := waitEvent(); event["event"] != EVENT_MESSAGE_PINNED || event["pinned"] != true || event["source"] != "api" {
+		t.Fatalf("Unexpected pin event: %v", event)
+	}
+
+	// An unpin made on the phone
+	chat, _ := types.ParseJID(group)
+	admin := types.NewJID("14155550199", types.DefaultUserServer)
+	handleMessageMarkEvent(email, &events.Message{
+		Info:    types.MessageInfo{MessageSource: types.MessageSource{Chat: chat, Sender: admin}, Timestamp: time.Now()},
+		Message: buildPinMessage(chat, types.EmptyJID, "ORDER1", false, 0),
+	})
+	if event := waitEvent(); event["pinned"] != false || event["pinned_by"] != admin.String() || event["source"] != "whatsapp" {
+		t.Fatalf("Unexpected unpin event: %v", event)
+	}
+
+	if resp := apiRequest(t, "POST", base+"/pin", apiKey, map[string]int{"days": 3}, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for an invalid pin duration, got %d", resp.StatusCode)
+	}
+	if resp := apiRequest(t, "DELETE", ts.URL+"/api/messages/"+group+"/MISSING/star", apiKey, nil, nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected 404 for an unknown message, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// --- OCR for received images ---
+// Text in received images (receipts, IDs, forms) can be extracted before forwarding
+// and attached as "ocr_text". Configure either OCR_COMMAND (run with the file path
+// appended, or substituted for {file}; the text is read from stdout, as with
+// "tesseract {file} stdout") or OCR_API_URL (the image is POSTed as the request body;
+// the reply is {"text": "..."} or plain text, with OCR_API_KEY sent as a Bearer token).
+
+const (
+	OCR_TIMEOUT        = time.Minute
+	MAX_OCR_TEXT       = 8000 // Runes
+	MAX_OCR_READ_BYTES = 256 * 1024
+)
+
+// Extract the text of an image with the configured OCR. Returns "" when OCR is disabled.
+func ocrImageFile(filePath, mimeType string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), OCR_TIMEOUT)
+	defer cancel()
+	if command := os.Getenv("OCR_COMMAND"); command != "" {
+		return runExtractCommand(ctx, command, filePath)
+	} else if apiURL := os.Getenv("OCR_API_URL"); apiURL != "" {
+		return ocrWithAPI(ctx, apiURL, os.Getenv("OCR_API_KEY"), filePath, mimeType)
+	}
+	return "", nil
+}
+
+// Run a text extraction command on a file and return its stdout
+func runExtractCommand(ctx context.Context, command, filePath string) (string, error) {
+	args := strings.Fields(command)
+	substituted := false
+	for i, arg := range args {
+		if arg == "{file}" {
+			args[i] = filePath
+			substituted = true
+		}
+	}
+	if !substituted {
+		args = append(args, filePath)
+	}
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	if err := cmd.Run(); err != nil {
+		return "", err
+	}
+	return stdout.String(), nil
+}
+
+func ocrWithAPI(ctx context.Context, apiURL, apiKey, filePath, mimeType string) (string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	req, err := http.NewRequestWithContext(ctx, "POST", apiURL, f)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", mimeType)
+	if apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, MAX_OCR_READ_BYTES))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return "", fmt.Errorf("OCR API returned status %d", resp.StatusCode)
+	}
+	var result struct {
+		Text *string `json:"text"`
+	}
+	if json.Unmarshal(body, &result) == nil && result.Text != nil {
+		return *result.Text, nil
+	}
+	return string(body), nil
+}
+
+// Run OCR on a received image and attach the text to the payload.
+// Failures are logged and the message is forwarded without it.
+func ocrReceivedImage(filePath, mimeType string, payload map[string]interface{}) {
+	text, err := ocrImageFile(filePath, mimeType)
+	if err != nil {
+		fmt.Printf("WARNING: OCR failed for %s: %v\n", filePath, err)
+		return
+	}
+	if text = strings.TrimSpace(text); text != "" {
+		payload["ocr_text"] = truncateRunes(text, MAX_OCR_TEXT)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOCRReceivedImageCommand(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "receipt.jpg")
+	os.WriteFile(file, []byte("  TOTAL 12.50 EUR\n"), 0644)
+
+	// No OCR configured
+	t.Setenv("OCR_COMMAND", "")
+	t.Setenv("OCR_API_URL", "")
+	payload := map[string]interface{}{}
+	ocrReceivedImage(file, "image/jpeg", payload)
+	if payload["ocr_text"] != nil {
+		t.Fatalf("Expected no OCR without a command, got %v", payload)
+	}
+
+	// The file path is appended, or substituted for {file}
+	for _, command := range []string{"cat", "cat {file}"} {
+		t.Setenv("OCR_COMMAND", command)
+		payload = map[string]interface{}{}
+		ocrReceivedImage(file, "image/jpeg", payload)
+		if payload["ocr_text"] != "TOTAL 12.50 EUR" {
+			t.Fatalf("%q: unexpected OCR text %v", command, payload["ocr_text"])
+		}
+	}
+
+	// A failing command forwards without text
+	t.Setenv("OCR_COMMAND", "/nonexistent/tesseract")
+	payload = map[string]interface{}{}
+	ocrReceivedImage(file, "image/jpeg", payload)
+	if payload["ocr_text"] != nil {
+		t.Fatalf("Expected no OCR text after a failure, got %v", payload)
+	}
+}
+
+func TestOCRReceivedImageAPI(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "id.png")
+	os.WriteFile(file, []byte("PNGDATA"), 0644)
+
+	reply := `{"text": "PASSPORT X1234567"}`
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if string(body) != "PNGDATA" || r.Header.Get("Content-Type") != "image/png" || r.Header.Get("Authorization") != "Bearer ocr-key" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(reply))
+	}))
+	defer api.Close()
+
+	t.Setenv("OCR_COMMAND", "")
+	t.Setenv("OCR_API_URL", api.URL)
+	t.Setenv("OCR_API_KEY", "ocr-key")
+	payload := map[string]interface{}{}
+	ocrReceivedImage(file, "image/png", payload)
+	if payload["ocr_text"] != "PASSPORT X1234567" {
+		t.Fatalf("Unexpected OCR text from JSON reply: %v", payload)
+	}
+
+	// Plain-text replies are used as-is
+	reply = "plain text"
+	payload = map[string]interface{}{}
+	ocrReceivedImage(file, "image/png", payload)
+	if payload["ocr_text"] != "plain text" {
+		t.Fatalf("Unexpected OCR text from plain reply: %v", payload)
+	}
+
+	// Error statuses forward without text
+	t.Setenv("OCR_API_KEY", "wrong")
+	payload = map[string]interface{}{}
+	ocrReceivedImage(file, "image/png", payload)
+	if payload["ocr_text"] != nil {
+		t.Fatalf("Expected no OCR text after an API error, got %v", payload)
+	}
+}
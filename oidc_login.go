@@ -0,0 +1,406 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- OIDC login ---
+// Users can log in with Google or any OpenID Connect provider instead of a password.
+// The provider's subject is mapped to a local user in user_identities; an unknown
+// subject is linked to the user signed in in the same browser, to the user with the
+// same verified email if the provider is trusted with emails, or gets a new account
+// if OIDC_AUTO_PROVISION=true.
+//
+// Providers:
+//   - google: OIDC_GOOGLE_CLIENT_ID, OIDC_GOOGLE_CLIENT_SECRET (default GOOGLE_CLIENT_ID and GOOGLE_CLIENT_SECRET)
+//   - oidc:   OIDC_ISSUER, OIDC_CLIENT_ID, OIDC_CLIENT_SECRET, OIDC_NAME (shown on the login page),
+//     OIDC_TRUST_EMAIL=true if the issuer's verified emails may link existing accounts
+//
+// The redirect URI to register with the provider is BASE_URL/auth/oidc/<provider>/callback.
+
+const (
+	OIDC_GOOGLE_ISSUER = "https://accounts.google.com"
+	OIDC_STATE_TTL     = 10 * time.Minute
+	OIDC_REAUTH_WINDOW = 10 * time.Minute // How recent a login must be to stand in for the password
+	OIDC_SCOPES        = "openid email profile"
+	OIDC_LOGIN_COOKIE  = "oidc_login" // Ties a login to the browser that started it
+)
+
+// An existing account with the login's email, which an untrusted provider may not link
+var errOIDCLinkNeedsSignIn = errors.New("sign in to link this login")
+
+type oidcProvider struct {
+	ID           string `json:"id"`
+	Name         string `json:"name"`
+	Issuer       string `json:"-"`
+	ClientID     string `json:"-"`
+	ClientSecret string `json:"-"`
+	TrustEmail   bool   `json:"-"` // Verified emails may link existing accounts
+}
+
+// The configured providers, by ID
+func oidcProviders() map[string]oidcProvider {
+	providers := map[string]oidcProvider{}
+	google := oidcProvider{
+		ID:           "google",
+		Name:         "Google",
+		Issuer:       getEnv("OIDC_GOOGLE_ISSUER", OIDC_GOOGLE_ISSUER),
+		ClientID:     getEnv("OIDC_GOOGLE_CLIENT_ID", os.Getenv("GOOGLE_CLIENT_ID")),
+		ClientSecret: getEnv("OIDC_GOOGLE_CLIENT_SECRET", os.Getenv("GOOGLE_CLIENT_SECRET")),
+		TrustEmail:   true,
+	}
+	if google.ClientID != "" && google.ClientSecret != "" {
+		providers[google.ID] = google
+	}
+	generic := oidcProvider{
+		ID:           "oidc",
+		Name:         getEnv("OIDC_NAME", "SSO"),
+		Issuer:       strings.TrimRight(os.Getenv("OIDC_ISSUER"), "/"),
+		ClientID:     os.Getenv("OIDC_CLIENT_ID"),
+		ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+		TrustEmail:   os.Getenv("OIDC_TRUST_EMAIL") == "true",
+	}
+	if generic.Issuer != "" && generic.ClientID != "" && generic.ClientSecret != "" {
+		providers[generic.ID] = generic
+	}
+	return providers
+}
+
+func oidcAutoProvision() bool {
+	return os.Getenv("OIDC_AUTO_PROVISION") == "true"
+}
+
+func oidcCallbackURL(r *http.Request, provider string) string {
+	return publicBaseURL(r) + "/auth/oidc/" + provider + "/callback"
+}
+
+// Endpoints from the issuer's discovery document
+type oidcEndpoints struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+}
+
+var oidcDiscovery = struct {
+	mu   sync.Mutex
+	data map[string]oidcEndpoints // By issuer
+}{
+	data: make(map[string]oidcEndpoints),
+}
+
+// Fetch (once) the issuer's /.well-known/openid-configuration
+func discoverOIDC(issuer string) (oidcEndpoints, error) {
+	oidcDiscovery.mu.Lock()
+	defer oidcDiscovery.mu.Unlock()
+	if e, ok := oidcDiscovery.data[issuer]; ok {
+		return e, nil
+	}
+	var e oidcEndpoints
+	resp, err := serviceHTTPClient().Get(issuer + "/.well-known/openid-configuration")
+	if err != nil {
+		return e, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return e, fmt.Errorf("discovery returned %d", resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&e); err != nil {
+		return e, err
+	}
+	if e.Issuer != issuer || e.AuthorizationEndpoint == "" || e.TokenEndpoint == "" {
+		return e, fmt.Errorf("invalid discovery document for %s", issuer)
+	}
+	oidcDiscovery.data[issuer] = e
+	return e, nil
+}
+
+// Pending logins: state -> provider, nonce and browser binding
+var oidcLoginStates = struct {
+	mu   sync.Mutex
+	data map[string]oidcLoginState
+}{
+	data: make(map[string]oidcLoginState),
+}
+
+type oidcLoginState struct {
+	provider  string
+	nonce     string
+	binding   string // The OIDC_LOGIN_COOKIE value set on the browser
+	expiresAt time.Time
+}
+
+// Take (and forget) a login state issued for a provider. The binding must match, so a
+// callback link from someone else's login can't sign this browser in as them.
+func takeOIDCLoginState(state, provider, binding string) (oidcLoginState, bool) {
+	oidcLoginStates.mu.Lock()
+	defer oidcLoginStates.mu.Unlock()
+	s, ok := oidcLoginStates.data[state]
+	delete(oidcLoginStates.data, state)
+	for key, other := range oidcLoginStates.data {
+		if time.Now().After(other.expiresAt) {
+			delete(oidcLoginStates.data, key)
+		}
+	}
+	if !ok || s.provider != provider || time.Now().After(s.expiresAt) || subtle.ConstantTimeCompare([]byte(s.binding), []byte(binding)) != 1 {
+		return s, false
+	}
+	return s, true
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Claims used from the ID token
+type oidcClaims struct {
+	Issuer   string          `json:"iss"`
+	Subject  string          `json:"sub"`
+	Audience json.RawMessage `json:"aud"` // A string or a list
+	Expiry   int64           `json:"exp"`
+	Nonce    string          `json:"nonce"`
+	Email    string          `json:"email"`
+	Verified interface{}     `json:"email_verified"` // Some providers send "true"
+}
+
+func (c oidcClaims) hasAudience(clientID string) bool {
+	var one string
+	if json.Unmarshal(c.Audience, &one) == nil {
+		return one == clientID
+	}
+	var many []string
+	json.Unmarshal(c.Audience, &many)
+	for _, aud := range many {
+		if aud == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+func (c oidcClaims) emailVerified() bool {
+	return c.Verified == true || c.Verified == "true"
+}
+
+// Decode and check an ID token. It comes straight from the token endpoint over TLS,
+// which authenticates the issuer, so its signature isn't checked (OIDC Core 3.1.3.7).
+func parseIDToken(idToken string, p oidcProvider, nonce string, now time.Time) (oidcClaims, error) {
+	var claims oidcClaims
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return claims, errors.New("malformed ID token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return claims, errors.New("malformed ID token")
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return claims, errors.New("malformed ID token")
+	}
+	switch {
+	case claims.Issuer != p.Issuer:
+		return claims, fmt.Errorf("unexpected issuer %q", claims.Issuer)
+	case !claims.hasAudience(p.ClientID):
+		return claims, errors.New("ID token is for another client")
+	case now.Unix() > claims.Expiry:
+		return claims, errors.New("ID token expired")
+	case claims.Nonce != nonce:
+		return claims, errors.New("ID token nonce mismatch")
+	case claims.Subject == "":
+		return claims, errors.New("ID token has no subject")
+	}
+	return claims, nil
+}
+
+// Exchange an authorization code for the ID token
+func oidcTokenRequest(p oidcProvider, tokenURL, code, redirectURI string) (string, error) {
+	resp, err := serviceHTTPClient().PostForm(tokenURL, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURI},
+		"client_id":     {p.ClientID},
+		"client_secret": {p.ClientSecret},
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var token struct {
+		IDToken     string `json:"id_token"`
+		Error       string `json:"error"`
+		Description string `json:"error_description"`
+	}
+	json.NewDecoder(resp.Body).Decode(&token)
+	if resp.StatusCode != http.StatusOK || token.IDToken == "" {
+		return "", fmt.Errorf("token request failed (%d): %s %s", resp.StatusCode, token.Error, token.Description)
+	}
+	return token.IDToken, nil
+}
+
+// The local user for an identity: already linked, linked now to the signed-in user (0
+// if none) or by verified email, or provisioned. Returns sql.ErrNoRows if there is none
+// and provisioning is off, and errOIDCLinkNeedsSignIn if only an untrusted email matches.
+func dbUserForIdentity(p oidcProvider, claims oidcClaims, signedInUserID int64) (int64, error) {
+	provider := p.ID
+	var userID int64
+	err := db.QueryRow(`SELECT user_id FROM user_identities WHERE provider = ? AND subject = ?`, provider, claims.Subject).Scan(&userID)
+	if err != sql.ErrNoRows {
+		return userID, err
+	}
+	if signedInUserID != 0 {
+		userID = signedInUserID
+		fmt.Printf("INFO: Linking %s login to signed-in user %d\n", provider, userID)
+	} else if claims.Email == "" || !claims.emailVerified() {
+		return 0, sql.ErrNoRows
+	} else if userID, err = getUserIDByEmail(claims.Email); err == nil && !p.TrustEmail {
+		return 0, errOIDCLinkNeedsSignIn
+	} else if err == sql.ErrNoRows {
+		if !oidcAutoProvision() {
+			return 0, sql.ErrNoRows
+		}
+		// No password: account changes are confirmed by a fresh login until the user sets one
+		res, err := db.Exec(`INSERT INTO users (email, password_hash) VALUES (?, '')`, claims.Email)
+		if err != nil {
+			return 0, err
+		}
+		userID, _ = res.LastInsertId()
+		fmt.Printf("INFO: Provisioned user %s from %s\n", claims.Email, provider)
+	} else if err != nil {
+		return 0, err
+	}
+	_, err = db.Exec(`INSERT INTO user_identities (provider, subject, user_id, email, created_at) VALUES (?, ?, ?, ?, ?)`,
+		provider, claims.Subject, userID, claims.Email, time.Now().UTC().Format(time.RFC3339))
+	return userID, err
+}
+
+// GET /api/auth/providers
+// The OIDC providers to offer on the login page.
+func handleOIDCProviders(w http.ResponseWriter, r *http.Request) {
+	list := []oidcProvider{}
+	for _, id := range []string{"google", "oidc"} {
+		if p, ok := oidcProviders()[id]; ok {
+			list = append(list, p)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// GET /auth/oidc/{provider}/login
+// Sends the browser to the provider.
+func handleOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	p, ok := oidcProviders()[r.PathValue("provider")]
+	if !ok {
+		http.Error(w, "Unknown login provider.", http.StatusNotFound)
+		return
+	}
+	endpoints, err := discoverOIDC(p.Issuer)
+	if err != nil {
+		fmt.Printf("ERROR: OIDC discovery for %s failed: %v\n", p.ID, err)
+		http.Error(w, "The login provider is unavailable.", http.StatusBadGateway)
+		return
+	}
+	state, nonce, binding := randomHex(16), randomHex(16), randomHex(16)
+	oidcLoginStates.mu.Lock()
+	oidcLoginStates.data[state] = oidcLoginState{provider: p.ID, nonce: nonce, binding: binding, expiresAt: time.Now().Add(OIDC_STATE_TTL)}
+	oidcLoginStates.mu.Unlock()
+	http.SetCookie(w, &http.Cookie{
+		Name:     OIDC_LOGIN_COOKIE,
+		Value:    binding,
+		Path:     "/auth/oidc/" + p.ID + "/callback",
+		MaxAge:   int(OIDC_STATE_TTL / time.Second),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode, // Sent on the top-level redirect back from the provider
+	})
+
+	q := url.Values{
+		"client_id":     {p.ClientID},
+		"redirect_uri":  {oidcCallbackURL(r, p.ID)},
+		"response_type": {"code"},
+		"scope":         {OIDC_SCOPES},
+		"state":         {state},
+		"nonce":         {nonce},
+	}
+	http.Redirect(w, r, endpoints.AuthorizationEndpoint+"?"+q.Encode(), http.StatusFound)
+}
+
+// GET /auth/oidc/{provider}/callback?code=&state=
+// Where the provider sends the browser back to; logs in and redirects to the dashboard.
+func handleOIDCCallback(sessionCookieName string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p, ok := oidcProviders()[r.PathValue("provider")]
+		if !ok {
+			http.Error(w, "Unknown login provider.", http.StatusNotFound)
+			return
+		}
+		q := r.URL.Query()
+		binding := ""
+		if cookie, err := r.Cookie(OIDC_LOGIN_COOKIE); err == nil {
+			binding = cookie.Value
+		}
+		http.SetCookie(w, &http.Cookie{Name: OIDC_LOGIN_COOKIE, Path: "/auth/oidc/" + p.ID + "/callback", MaxAge: -1})
+		state, ok := takeOIDCLoginState(q.Get("state"), p.ID, binding)
+		if !ok {
+			http.Error(w, "This login link has expired or was opened in another browser; start again from the login page.", http.StatusBadRequest)
+			return
+		}
+		if e := q.Get("error"); e != "" {
+			http.Error(w, p.Name+" login was not granted: "+e, http.StatusBadRequest)
+			return
+		}
+		endpoints, err := discoverOIDC(p.Issuer)
+		if err != nil {
+			http.Error(w, "The login provider is unavailable.", http.StatusBadGateway)
+			return
+		}
+		idToken, err := oidcTokenRequest(p, endpoints.TokenEndpoint, q.Get("code"), oidcCallbackURL(r, p.ID))
+		if err != nil {
+			fmt.Printf("ERROR: OIDC login with %s failed: %v\n", p.ID, err)
+			http.Error(w, "Could not log in with "+p.Name+".", http.StatusBadGateway)
+			return
+		}
+		claims, err := parseIDToken(idToken, p, state.nonce, time.Now())
+		if err != nil {
+			fmt.Printf("ERROR: Rejected ID token from %s: %v\n", p.ID, err)
+			http.Error(w, "Could not log in with "+p.Name+".", http.StatusBadGateway)
+			return
+		}
+		var signedInUserID int64
+		if email := getUserEmail(r, sessionCookieName); email != "" {
+			signedInUserID, _ = getUserIDByEmail(email)
+		}
+		userID, err := dbUserForIdentity(p, claims, signedInUserID)
+		if err == sql.ErrNoRows {
+			http.Error(w, "No account for this "+p.Name+" login. Ask an administrator to create one.", http.StatusForbidden)
+			return
+		} else if err == errOIDCLinkNeedsSignIn {
+			http.Error(w, "An account with this email already exists. Log in with its password, then log in with "+p.Name+" again to link it.", http.StatusForbidden)
+			return
+		} else if err != nil {
+			fmt.Printf("ERROR: Could not map %s subject to a user: %v\n", p.ID, err)
+			http.Error(w, "Could not log in.", http.StatusInternalServerError)
+			return
+		}
+		token, err := createSession(userID)
+		if err != nil {
+			http.Error(w, "Could not log in.", http.StatusInternalServerError)
+			return
+		}
+		setSessionCookie(w, sessionCookieName, token)
+		http.Redirect(w, r, "/", http.StatusFound)
+	}
+}
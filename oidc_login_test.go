@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestOIDCLogin(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+
+	var issuer, nonce string
+	claims := map[string]interface{}{}
+	idp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]string{
+				"issuer":                 issuer,
+				"authorization_endpoint": issuer + "/authorize",
+				"token_endpoint":         issuer + "/token",
+			})
+		case "/token":
+			if r.FormValue("code") != "good-code" || r.FormValue("client_secret") != "secret" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			claims["iss"], claims["aud"], claims["nonce"] = issuer, "client", nonce
+			claims["exp"] = time.Now().Add(time.Hour).Unix()
+			payload, _ := json.Marshal(claims)
+			token := "eyJhbGciOiJub25lIn0." + base64.RawURLEncoding.EncodeToString(payload) + ".sig"
+			json.NewEncoder(w).Encode(map[string]string{"id_token": token})
+		}
+	}))
+	defer idp.Close()
+	issuer = idp.URL
+	t.Setenv("OIDC_ISSUER", issuer)
+	t.Setenv("OIDC_CLIENT_ID", "client")
+	t.Setenv("OIDC_CLIENT_SECRET", "secret")
+	t.Setenv("OIDC_NAME", "Okta")
+
+	var providers []oidcProvider
+	resp, _ := http.Get(ts.URL + "/api/auth/providers")
+	json.NewDecoder(resp.Body).Decode(&providers)
+	if len(providers) != 1 || providers[0].ID != "oidc" || providers[0].Name != "Okta" {
+		t.Fatalf("Unexpected providers: %+v", providers)
+	}
+
+	noRedirect := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	// Log in: follow the redirect to the IdP, then come back with a code in the same
+	// browser (with its login cookie and any session cookies)
+	login := func(code string, sessionCookies ...*http.Cookie) *http.Response {
+		t.Helper()
+		resp, err := noRedirect.Get(ts.URL + "/auth/oidc/oidc/login")
+		if err != nil || resp.StatusCode != http.StatusFound {
+			t.Fatalf("Login redirect failed: %v", err)
+		}
+		location, _ := url.Parse(resp.Header.Get("Location"))
+		if location.Path != "/authorize" || location.Query().Get("client_id") != "client" {
+			t.Fatalf("Unexpected redirect %s", location)
+		}
+		nonce = location.Query().Get("nonce")
+		req, _ := http.NewRequest("GET", ts.URL+"/auth/oidc/oidc/callback?code="+code+"&state="+location.Query().Get("state"), nil)
+		for _, c := range append(resp.Cookies(), sessionCookies...) {
+			req.AddCookie(c)
+		}
+		resp, err = noRedirect.Do(req)
+		if err != nil {
+			t.Fatalf("Callback failed: %v", err)
+		}
+		return resp
+	}
+	sessionEmailOf := func(resp *http.Response) string {
+		req, _ := http.NewRequest("GET", ts.URL+"/api/session", nil)
+		for _, c := range resp.Cookies() {
+			req.AddCookie(c)
+		}
+		sessResp, _ := http.DefaultClient.Do(req)
+		var data struct {
+			Email string `json:"email"`
+		}
+		json.NewDecoder(sessResp.Body).Decode(&data)
+		return data.Email
+	}
+
+	// Unknown user without provisioning
+	claims["sub"], claims["email"], claims["email_verified"] = "sub-1", "sso@example.com", true
+	if resp := login("good-code"); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected 403 without provisioning, got %d", resp.StatusCode)
+	}
+	if resp := login("bad-code"); resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("Expected 502 for a rejected code, got %d", resp.StatusCode)
+	}
+
+	// A callback opened in another browser than the login (login CSRF) is refused
+	resp, _ = noRedirect.Get(ts.URL + "/auth/oidc/oidc/login")
+	location, _ := url.Parse(resp.Header.Get("Location"))
+	if resp, _ := noRedirect.Get(ts.URL + "/auth/oidc/oidc/callback?code=good-code&state=" + location.Query().Get("state")); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for a callback without the login cookie, got %d", resp.StatusCode)
+	}
+
+	// Provisioned on first login, then found by subject even if the email changes
+	t.Setenv("OIDC_AUTO_PROVISION", "true")
+	resp = login("good-code")
+	if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "/" {
+		t.Fatalf("Expected a redirect to the dashboard, got %d", resp.StatusCode)
+	}
+	if email := sessionEmailOf(resp); email != "sso@example.com" {
+		t.Fatalf("Expected a session for the provisioned user, got %q", email)
+	}
+
+	// The provisioned account has no password: a fresh login confirms setting one
+	sessionCookies := resp.Cookies()
+	setPassword := func(body map[string]string) int {
+		t.Helper()
+		data, _ := json.Marshal(body)
+		req, _ := http.NewRequest("POST", ts.URL+"/api/user/password", bytes.NewReader(data))
+		for _, c := range sessionCookies {
+			req.AddCookie(c)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Password change failed: %v", err)
+		}
+		return resp.StatusCode
+	}
+	if _, err := db.Exec(`UPDATE sessions SET created_at = ?`, time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)); err != nil {
+		t.Fatal(err)
+	}
+	if status := setPassword(map[string]string{"new_password": "ssopass123"}); status != http.StatusForbidden {
+		t.Fatalf("Expected 403 for an old login, got %d", status)
+	}
+	sessionCookies = login("good-code").Cookies()
+	if status := setPassword(map[string]string{"new_password": "ssopass123"}); status != 200 {
+		t.Fatalf("Setting a password after a fresh login failed, status: %d", status)
+	}
+	if status := setPassword(map[string]string{"new_password": "other123"}); status != http.StatusBadRequest {
+		t.Fatalf("Expected the new password to be required, got %d", status)
+	}
+	if status := setPassword(map[string]string{"current_password": "ssopass123", "new_password": "other123"}); status != 200 {
+		t.Fatalf("Password change with the new password failed, status: %d", status)
+	}
+	claims["email"] = "renamed@example.com"
+	if email := sessionEmailOf(login("good-code")); email != "sso@example.com" {
+		t.Fatalf("Expected the linked user, got %q", email)
+	}
+
+	// An unverified email is not linked to an existing account
+	registerWithAPIKey(t, ts, "existing@example.com", "existingpass123")
+	t.Setenv("OIDC_AUTO_PROVISION", "false")
+	claims["sub"], claims["email"], claims["email_verified"] = "sub-2", "existing@example.com", false
+	if resp := login("good-code"); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected 403 for an unverified email, got %d", resp.StatusCode)
+	}
+	// A verified email only links an existing account if the provider is trusted with emails
+	claims["email_verified"] = "true"
+	if resp := login("good-code"); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected 403 for an untrusted provider, got %d", resp.StatusCode)
+	}
+	t.Setenv("OIDC_TRUST_EMAIL", "true")
+	if email := sessionEmailOf(login("good-code")); email != "existing@example.com" {
+		t.Fatalf("Expected the verified email to link the existing user, got %q", email)
+	}
+
+	// Signed in, any new login is linked to the signed-in user
+	t.Setenv("OIDC_TRUST_EMAIL", "false")
+	cookies, _ := registerWithAPIKey(t, ts, "linker@example.com", "linkerpass123")
+	claims["sub"], claims["email"] = "sub-3", "someone-else@example.com"
+	if email := sessionEmailOf(login("good-code", cookies...)); email != "linker@example.com" {
+		t.Fatalf("Expected the login linked to the signed-in user, got %q", email)
+	}
+	if email := sessionEmailOf(login("good-code")); email != "linker@example.com" {
+		t.Fatalf("Expected the linked user on the next login, got %q", email)
+	}
+}
+
+func TestParseIDToken(t *testing.T) {
+	p := oidcProvider{Issuer: "https://idp.example.com", ClientID: "client"}
+	now := time.Now()
+	token := func(claims map[string]interface{}) string {
+		payload, _ := json.Marshal(claims)
+		return "e30." + base64.RawURLEncoding.EncodeToString(payload) + ".sig"
+	}
+	valid := map[string]interface{}{"iss": p.Issuer, "aud": []string{"other", "client"}, "exp": now.Add(time.Minute).Unix(), "nonce": "n", "sub": "s"}
+	if _, err := parseIDToken(token(valid), p, "n", now); err != nil {
+		t.Fatalf("Valid token rejected: %v", err)
+	}
+	for field, value := range map[string]interface{}{"iss": "https://evil.example.com", "aud": "other", "exp": now.Add(-time.Minute).Unix(), "nonce": "x", "sub": ""} {
+		bad := map[string]interface{}{}
+		for k, v := range valid {
+			bad[k] = v
+		}
+		bad[field] = value
+		if _, err := parseIDToken(token(bad), p, "n", now); err == nil {
+			t.Fatalf("Expected a token with a bad %s to be rejected", field)
+		}
+	}
+	if _, err := parseIDToken("not-a-token", p, "n", now); err == nil {
+		t.Fatal("Expected a malformed token to be rejected")
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// --- Outbound URL guard (SSRF protection) ---
+// Webhook deliveries, send callbacks, trigger subscriptions, media_url fetches, LLM
+// endpoints and Signal servers are URLs chosen by users, so they must not reach the
+// server's own network: loopback, private,
+// link-local (e.g. cloud metadata at 169.254.169.254), CGNAT and other non-public
+// addresses are refused. URLs are checked when they are saved, and every connection
+// is checked again against the address actually dialed, so a DNS answer that changes
+// after validation (rebinding) can't get through. Guarded requests don't go through
+// HTTP_PROXY: the proxy would dial the destination, bypassing the check.
+//
+// OUTBOUND_ALLOWED_NETWORKS: comma-separated CIDRs or IPs allowed anyway (e.g. a receiver on the LAN)
+// WEBHOOK_HTTPS_ONLY=true: refuse plain http URLs, redirects included
+
+const OUTBOUND_RESOLVE_TIMEOUT = 5 * time.Second
+
+var errBlockedDestination = errors.New("destination address is not allowed")
+
+var (
+	outboundAllowed  []netip.Prefix
+	webhookHTTPSOnly bool
+)
+
+// Non-public ranges the netip.Addr predicates don't cover
+var outboundBlockedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),      // "This network"
+	netip.MustParsePrefix("100.64.0.0/10"),  // Carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),   // IETF protocol assignments
+	netip.MustParsePrefix("198.18.0.0/15"),  // Benchmarking
+	netip.MustParsePrefix("240.0.0.0/4"),    // Reserved and broadcast
+	netip.MustParsePrefix("64:ff9b::/96"),   // NAT64, may map to private IPv4
+	netip.MustParsePrefix("64:ff9b:1::/48"), // Local-use NAT64
+	netip.MustParsePrefix("2001:db8::/32"),  // Documentation
+	netip.MustParsePrefix("2002::/16"),      // 6to4, may embed private IPv4
+	netip.MustParsePrefix("fec0::/10"),      // Deprecated site-local
+	netip.MustParsePrefix("100::/64"),       // Discard-only
+	netip.MustParsePrefix("2001::/32"),      // Teredo
+	netip.MustParsePrefix("2001:10::/28"),   // ORCHID
+	netip.MustParsePrefix("2001:20::/28"),   // ORCHIDv2
+}
+
+// Read OUTBOUND_ALLOWED_NETWORKS and WEBHOOK_HTTPS_ONLY; invalid entries are skipped
+func initOutboundGuard() {
+	outboundAllowed = nil
+	for _, entry := range strings.Split(os.Getenv("OUTBOUND_ALLOWED_NETWORKS"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(entry)
+			if addrErr != nil {
+				fmt.Printf("WARNING: Ignoring %q in OUTBOUND_ALLOWED_NETWORKS, expected a CIDR or IP\n", entry)
+				continue
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		outboundAllowed = append(outboundAllowed, prefix.Masked())
+	}
+	webhookHTTPSOnly = os.Getenv("WEBHOOK_HTTPS_ONLY") == "true"
+}
+
+// Whether outbound requests may connect to an address
+func outboundAddrAllowed(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range outboundAllowed {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	if addr.IsLoopback() || addr.IsPrivate() || addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() ||
+		addr.IsInterfaceLocalMulticast() || addr.IsMulticast() || addr.IsUnspecified() {
+		return false
+	}
+	for _, prefix := range outboundBlockedPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// Check a user-supplied URL before saving or using it: http(s) only (https only with
+// WEBHOOK_HTTPS_ONLY), and a host that isn't, or doesn't resolve to, a blocked address.
+// URLs with {{secret.NAME}} references are checked when they are dialed.
+func validateOutboundURL(raw string) error {
+	if strings.Contains(raw, "{{") {
+		return nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("invalid URL %q", raw)
+	}
+	if u.Scheme != "https" && (u.Scheme != "http" || webhookHTTPSOnly) {
+		if webhookHTTPSOnly {
+			return fmt.Errorf("URL %q must use https", raw)
+		}
+		return fmt.Errorf("URL %q must use http or https", raw)
+	}
+	host := u.Hostname()
+	if addr, err := netip.ParseAddr(host); err == nil {
+		if !outboundAddrAllowed(addr) {
+			return fmt.Errorf("URL %q: %w", raw, errBlockedDestination)
+		}
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), OUTBOUND_RESOLVE_TIMEOUT)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		// Not resolvable now; connections are still checked when made
+		return nil
+	}
+	for _, addr := range addrs {
+		if !outboundAddrAllowed(addr) {
+			return fmt.Errorf("URL %q resolves to %s: %w", raw, addr, errBlockedDestination)
+		}
+	}
+	return nil
+}
+
+// Refuse connections to blocked addresses, after DNS resolution
+func guardOutboundDial(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil || !outboundAddrAllowed(addr) {
+		return fmt.Errorf("%w: %s", errBlockedDestination, host)
+	}
+	return nil
+}
+
+var guardedTransport = &http.Transport{
+	DialContext:           (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, Control: guardOutboundDial}).DialContext,
+	ForceAttemptHTTP2:     true,
+	MaxIdleConns:          100,
+	IdleConnTimeout:       90 * time.Second,
+	TLSHandshakeTimeout:   10 * time.Second,
+	ExpectContinueTimeout: time.Second,
+}
+
+// HTTP client for user-chosen URLs that aren't webhook deliveries
+func guardedHTTPClient(timeout time.Duration) *http.Client {
+	return &http.Client{Timeout: timeout, Transport: guardedTransport, CheckRedirect: guardRedirect}
+}
+
+// Redirects are followed like the original request, except to plain http in https-only mode
+func guardRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	if webhookHTTPSOnly && req.URL.Scheme != "https" {
+		return fmt.Errorf("redirect to %q refused: https only", req.URL)
+	}
+	return nil
+}
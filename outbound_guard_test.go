@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestOutboundAddrAllowed(t *testing.T) {
+	t.Cleanup(initOutboundGuard) // Back to the test allowlist once t.Setenv restores it
+	t.Setenv("OUTBOUND_ALLOWED_NETWORKS", "192.168.10.0/24, 10.1.2.3, bogus")
+	initOutboundGuard()
+
+	for addr, want := range map[string]bool{
+		"8.8.8.8":          true,
+		"2606:4700::1111":  true,
+		"169.254.169.254":  false,
+		"127.0.0.1":        false,
+		"10.0.0.1":         false,
+		"172.16.5.4":       false,
+		"192.168.1.1":      false,
+		"100.64.0.1":       false,
+		"0.0.0.0":          false,
+		"::1":              false,
+		"fe80::1":          false,
+		"fd00::1":          false,
+		"::ffff:127.0.0.1": false,
+		"192.168.10.20":    true, // Allowlisted network
+		"10.1.2.3":         true, // Allowlisted address
+		"10.1.2.4":         false,
+	} {
+		if got := outboundAddrAllowed(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("outboundAddrAllowed(%s) = %v, want %v", addr, got, want)
+		}
+	}
+}
+
+func TestValidateOutboundURL(t *testing.T) {
+	t.Cleanup(initOutboundGuard)
+	t.Setenv("OUTBOUND_ALLOWED_NETWORKS", "")
+	initOutboundGuard()
+
+	for _, raw := range []string{"http://169.254.169.254/latest/meta-data", "http://[::1]:8080/hook", "http://localhost/hook", "ftp://example.com/hook", "not a url"} {
+		if err := validateOutboundURL(raw); err == nil {
+			t.Errorf("Expected %q to be rejected", raw)
+		}
+	}
+	for _, raw := range []string{"https://93.184.216.34/hook", "http://93.184.216.34/hook", "https://{{secret.HOST}}/hook"} {
+		if err := validateOutboundURL(raw); err != nil {
+			t.Errorf("Expected %q to be accepted: %v", raw, err)
+		}
+	}
+
+	t.Setenv("WEBHOOK_HTTPS_ONLY", "true")
+	initOutboundGuard()
+	if err := validateOutboundURL("http://93.184.216.34/hook"); err == nil {
+		t.Error("Expected plain http to be rejected in https-only mode")
+	}
+}
+
+func TestWebhookClientRefusesBlockedDestinations(t *testing.T) {
+	dest := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer dest.Close()
+
+	if resp, err := webhookHTTPClient().Get(dest.URL); err != nil {
+		t.Fatalf("Allowlisted loopback should be reachable: %v", err)
+	} else {
+		resp.Body.Close()
+	}
+
+	t.Cleanup(initOutboundGuard)
+	t.Setenv("OUTBOUND_ALLOWED_NETWORKS", "")
+	initOutboundGuard()
+	guardedTransport.CloseIdleConnections()
+	if _, err := webhookHTTPClient().Get(dest.URL); !errors.Is(err, errBlockedDestination) {
+		t.Fatalf("Expected the dial to be refused, got %v", err)
+	}
+}
+
+func TestGuardedClientsRefuseBlockedDestinations(t *testing.T) {
+	dest := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer dest.Close()
+
+	t.Cleanup(initOutboundGuard)
+	t.Setenv("OUTBOUND_ALLOWED_NETWORKS", "")
+	t.Setenv("HTTP_PROXY", "http://93.184.216.34:3128") // Must not be used to reach the destination
+	initOutboundGuard()
+	guardedTransport.CloseIdleConnections()
+
+	for name, client := range map[string]*http.Client{"media_url": mediaFetchClient, "enrichment": enrichmentClient, "channel": channelHTTPClient} {
+		if _, err := client.Get(dest.URL); !errors.Is(err, errBlockedDestination) {
+			t.Errorf("Expected the %s client's dial to be refused, got %v", name, err)
+		}
+	}
+	if err := validateEnrichmentSettings(&EnrichmentSettings{Endpoint: "http://169.254.169.254/v1"}); err == nil {
+		t.Error("Expected a metadata endpoint to be rejected")
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"time"
+
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// --- Payment messages ---
+// WhatsApp Pay activity in the account's chats (payment requests, payments, cancelled
+// and declined requests, and invites to set up payments), whether from the other side
+// or from the account's own phone, is sent to webhooks subscribed to "payment.activity"
+// with its fields parsed. These messages are not forwarded as chat messages.
+
+// Amount of a payment request: the newer Money field, or the older thousandths one
+func paymentRequestAmount(req *waProto.RequestPaymentMessage) (amount float64, currency string, ok bool) {
+	if money := req.GetAmount(); money != nil && money.GetOffset() > 0 {
+		return float64(money.GetValue()) / float64(money.GetOffset()), money.GetCurrencyCode(), true
+	}
+	if req.Amount1000 != nil {
+		return amountFromThousandths(int64(req.GetAmount1000())), req.GetCurrencyCodeIso4217(), true
+	}
+	return 0, "", false
+}
+
+func paymentNote(note *waProto.Message) string {
+	if text := note.GetConversation(); text != "" {
+		return text
+	}
+	return note.GetExtendedTextMessage().GetText()
+}
+
+// Fields of a payment message, with "kind" naming what happened; nil for other messages
+func paymentPayload(msg *waProto.Message) map[string]interface{} {
+	switch {
+	case msg.GetRequestPaymentMessage() != nil:
+		req := msg.GetRequestPaymentMessage()
+		payload := map[string]interface{}{
+			"kind":         "request",
+			"note":         paymentNote(req.GetNoteMessage()),
+			"request_from": req.GetRequestFrom(),
+		}
+		if amount, currency, ok := paymentRequestAmount(req); ok {
+			payload["amount"] = amount
+			payload["currency"] = currency
+		}
+		if req.Amount1000 != nil {
+			payload["amount_1000"] = req.GetAmount1000()
+		}
+		if expiry := req.GetExpiryTimestamp(); expiry > 0 {
+			payload["expires_at"] = time.Unix(expiry, 0).UTC().Format(time.RFC3339)
+		}
+		return payload
+	case msg.GetSendPaymentMessage() != nil:
+		send := msg.GetSendPaymentMessage()
+		return map[string]interface{}{
+			"kind":               "payment",
+			"note":               paymentNote(send.GetNoteMessage()),
+			"request_message_id": send.GetRequestMessageKey().GetID(), // The request it pays, if any
+		}
+	case msg.GetCancelPaymentRequestMessage() != nil:
+		return map[string]interface{}{
+			"kind":               "request_cancelled",
+			"request_message_id": msg.GetCancelPaymentRequestMessage().GetKey().GetID(),
+		}
+	case msg.GetDeclinePaymentRequestMessage() != nil:
+		return map[string]interface{}{
+			"kind":               "request_declined",
+			"request_message_id": msg.GetDeclinePaymentRequestMessage().GetKey().GetID(),
+		}
+	case msg.GetPaymentInviteMessage() != nil:
+		invite := msg.GetPaymentInviteMessage()
+		payload := map[string]interface{}{
+			"kind":         "invite",
+			"service_type": invite.GetServiceType().String(),
+		}
+		if expiry := invite.GetExpiryTimestamp(); expiry > 0 {
+			payload["expires_at"] = time.Unix(expiry, 0).UTC().Format(time.RFC3339)
+		}
+		return payload
+	}
+	return nil
+}
+
+// Report payment messages, sent or received, to webhooks
+func handlePaymentEvent(email string, evt interface{}) {
+	v, ok := evt.(*events.Message)
+	if !ok || v.Message == nil {
+		return
+	}
+	data := paymentPayload(v.Message)
+	if data == nil {
+		return
+	}
+	data["chat_jid"] = v.Info.Chat.String()
+	data["message_id"] = v.Info.ID
+	data["from"] = v.Info.Sender.ToNonAD().String()
+	data["from_me"] = v.Info.IsFromMe
+	data["sent_at"] = v.Info.Timestamp.UTC().Format(time.RFC3339)
+	goEmitWebhookEvent(email, EVENT_PAYMENT_ACTIVITY, v.Info.Chat.String(), data)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestPaymentPayload(t *testing.T) {
+	request := paymentPayload(&waProto.Message{RequestPaymentMessage: &waProto.RequestPaymentMessage{
+		NoteMessage:         &waProto.Message{Conversation: proto.String("Invoice 42")},
+		CurrencyCodeIso4217: proto.String("INR"),
+		Amount1000:          proto.Uint64(1250500),
+		RequestFrom:         proto.String("14155550100@s.whatsapp.net"),
+		ExpiryTimestamp:     proto.Int64(1760000000),
+	}})
+	if request["kind"] != "request" || request["amount"] != 1250.5 || request["currency"] != "INR" || request["note"] != "Invoice 42" ||
+		request["expires_at"] != "2025-10-09T08:53:20Z" {
+		t.Fatalf("Unexpected request payload: %v", request)
+	}
+
+	money := paymentPayload(&waProto.Message{RequestPaymentMessage: &waProto.RequestPaymentMessage{
+		Amount: &waProto.Money{Value: proto.Int64(1999), Offset: proto.Uint32(100), CurrencyCode: proto.String("BRL")},
+	}})
+	if money["amount"] != 19.99 || money["currency"] != "BRL" || money["amount_1000"] != nil {
+		t.Fatalf("Unexpected request payload with Money amount: %v", money)
+	}
+
+	paid := paymentPayload(&waProto.Message{SendPaymentMessage: &waProto.SendPaymentMessage{
+		NoteMessage:       &waProto.Message{ExtendedTextMessage: &waProto.ExtendedTextMessage{Text: proto.String("Thanks")}},
+		RequestMessageKey: &waProto.MessageKey{ID: proto.String("REQ1")},
+	}})
+	if paid["kind"] != "payment" || paid["note"] != "Thanks" || paid["request_message_id"] != "REQ1" {
+		t.Fatalf("Unexpected payment payload: %v", paid)
+	}
+
+	declined := paymentPayload(&waProto.Message{DeclinePaymentRequestMessage: &waProto.DeclinePaymentRequestMessage{
+		Key: &waProto.MessageKey{ID: proto.String("REQ1")},
+	}})
+	if declined["kind"] != "request_declined" || declined["request_message_id"] != "REQ1" {
+		t.Fatalf("Unexpected decline payload: %v", declined)
+	}
+
+	if payload := paymentPayload(&waProto.Message{Conversation: proto.String("hello")}); payload != nil {
+		t.Fatalf("Expected no payload for a text message, got %v", payload)
+	}
+}
+
+func TestPaymentActivityEvent(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+
+	email := "payments@example.com"
+	_, apiKey := registerWithAPIKey(t, ts, email, "paypass123")
+
+	received := make(chan map[string]interface{}, 5)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&payload)
+		received <- payload
+	}))
+	defer receiver.Close()
+	apiRequest(t, "POST", ts.URL+"/api/webhooks/create", apiKey, map[string]interface{}{
+		"url": receiver.URL, "method": "POST", "events": []string{EVENT_PAYMENT_ACTIVITY},
+	}, nil)
+
+	// A payment made from the account's own phone
+	chat := types.NewJID("14155550100", types.DefaultUserServer)
+	own := types.NewJID("14155550111", types.DefaultUserServer)
+	handlePaymentEvent(email, &events.Message{
+		Info: types.MessageInfo{
+			MessageSource: types.MessageSource{Chat: chat, Sender: own, IsFromMe: true},
+			ID:            "PAY1",
+			Timestamp:     time.Now(),
+		},
+		Message: &waProto.Message{SendPaymentMessage: &waProto.SendPaymentMessage{
+			RequestMessageKey: &waProto.MessageKey{ID: proto.String("REQ1")},
+		}},
+	})
+
+	select {
+	case event := <-received:
+		if event["event"] != EVENT_PAYMENT_ACTIVITY || event["kind"] != "payment" || event["message_id"] != "PAY1" ||
+			event["from_me"] != true || event["chat_jid"] != chat.String() || event["request_message_id"] != "REQ1" {
+			t.Fatalf("Unexpected payment event: %v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Payment event not delivered")
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// --- Presence policy ---
+// How the user's WhatsApp client shows itself to contacts:
+//   - "default": nothing is sent on connect, so the account stays unavailable and
+//     delivery receipts go out as inactive; typing is shown before each send
+//   - "natural": available presence on connect, active delivery receipts and typing,
+//     like someone using the app (the phone then gets no notifications)
+//   - "passive": unavailable presence, inactive receipts and no typing indicator, for
+//     observing only (compliance archives)
+// whatsmeow acknowledges every received message, so even "passive" can't stop delivery
+// receipts altogether; inactive ones are what a linked device nobody uses sends.
+
+const (
+	PRESENCE_DEFAULT = "default"
+	PRESENCE_NATURAL = "natural"
+	PRESENCE_PASSIVE = "passive"
+)
+
+func dbGetPresenceMode(email string) string {
+	mode := PRESENCE_DEFAULT
+	db.QueryRow(`SELECT presence_mode FROM users WHERE email = ?`, email).Scan(&mode)
+	return mode
+}
+
+func dbSetPresenceMode(email, mode string) error {
+	_, err := db.Exec(`UPDATE users SET presence_mode = ? WHERE email = ?`, mode, email)
+	return err
+}
+
+// Send the presence the user's policy asks for; called on connect and when the policy
+// changes. "default" sends nothing on connect, but going back to it marks the client
+// unavailable again.
+func applyPresenceMode(client *whatsmeow.Client, email string, changed bool) {
+	mode := dbGetPresenceMode(email)
+	if mode == PRESENCE_DEFAULT && !changed {
+		return
+	}
+	presence := types.PresenceUnavailable
+	if mode == PRESENCE_NATURAL {
+		presence = types.PresenceAvailable
+	}
+	if err := client.SendPresence(presence); err != nil {
+		fmt.Printf("WARNING: Could not send %s presence for %s: %v\n", presence, email, err)
+	}
+}
+
+// Whether typing is shown before the user's messages are sent
+func showsTyping(email string) bool {
+	return dbGetPresenceMode(email) != PRESENCE_PASSIVE
+}
+
+// GET/POST /api/user/presence {"mode": "default" | "natural" | "passive"}
+func handlePresenceMode(sessionCookieName string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isAuthenticated(r, sessionCookieName) {
+			apiError(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		email := getUserEmail(r, sessionCookieName)
+
+		switch r.Method {
+		case "GET":
+		case "POST":
+			var req struct {
+				Mode string `json:"mode"`
+			}
+			if err := decodeJSONBody(w, r, &req); err != nil {
+				writeBodyError(w, err)
+				return
+			}
+			if req.Mode != PRESENCE_DEFAULT && req.Mode != PRESENCE_NATURAL && req.Mode != PRESENCE_PASSIVE {
+				apiError(w, "Invalid mode (use default, natural or passive)", http.StatusBadRequest)
+				return
+			}
+			if err := dbSetPresenceMode(email, req.Mode); err != nil {
+				apiError(w, "Failed to update presence mode", http.StatusInternalServerError)
+				return
+			}
+			fmt.Printf("INFO: Presence mode of user %s set to %s\n", email, req.Mode)
+
+			// A connected client switches right away
+			state := getUserWAState(email)
+			state.mu.RLock()
+			client, connected := state.waClient, state.waStatus == "connected"
+			state.mu.RUnlock()
+			if client != nil && connected {
+				go applyPresenceMode(client, email, true)
+			}
+		default:
+			apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"mode": dbGetPresenceMode(email)})
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestPresenceMode(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+
+	email := "presence@example.com"
+	cookies, apiKey := registerWithAPIKey(t, ts, email, "presencepass123")
+	fake := useFakeWAClient(t, email)
+	defer dropUserQueue(email)
+
+	setMode := func(mode string) *http.Response {
+		t.Helper()
+		var buf bytes.Buffer
+		json.NewEncoder(&buf).Encode(map[string]string{"mode": mode})
+		req, _ := http.NewRequest("POST", ts.URL+"/api/user/presence", &buf)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Set presence mode failed: %v", err)
+		}
+		return resp
+	}
+
+	if mode := dbGetPresenceMode(email); mode != PRESENCE_DEFAULT {
+		t.Fatalf("Expected the default mode for a new user, got %s", mode)
+	}
+	if resp := setMode("invisible"); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for an unknown mode, got %d", resp.StatusCode)
+	}
+	resp := setMode(PRESENCE_PASSIVE)
+	var out map[string]string
+	json.NewDecoder(resp.Body).Decode(&out)
+	if resp.StatusCode != 200 || out["mode"] != PRESENCE_PASSIVE {
+		t.Fatalf("Expected passive mode, got %d %v", resp.StatusCode, out)
+	}
+
+	// The API key cannot change the policy
+	if resp := apiRequest(t, "POST", ts.URL+"/api/user/presence", apiKey, map[string]string{"mode": PRESENCE_NATURAL}, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 for API key, got %d", resp.StatusCode)
+	}
+
+	// Passive users send without showing typing
+	result, err := sendService.Enqueue(SendRequest{UserEmail: email, ChatJID: "14155550100@s.whatsapp.net", Message: "quiet", Source: "api"})
+	if err != nil {
+		t.Fatalf("Enqueue failed: %v", err)
+	}
+	deadline := time.Now().Add(15 * time.Second)
+	for len(fake.sentMessages()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for message %s to be sent", result.Message.ID)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	fake.mu.Lock()
+	presence := fake.presence
+	fake.mu.Unlock()
+	if len(presence) != 0 {
+		t.Fatalf("Expected no typing presence in passive mode, got %v", presence)
+	}
+}
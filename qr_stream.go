@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// --- QR login stream ---
+// /api/wa/qr/stream pushes the QR login flow to the dashboard as server-sent events
+// instead of it polling /api/wa/status: "code" for each new QR code, then "success",
+// "connected", "timeout" or "error". A client that subscribes mid-flow first gets the
+// code currently shown.
+
+const (
+	QR_EVENT_CODE      = "code"
+	QR_EVENT_SUCCESS   = "success"
+	QR_EVENT_CONNECTED = "connected"
+	QR_EVENT_TIMEOUT   = "timeout"
+	QR_EVENT_ERROR     = "error"
+
+	QR_STREAM_KEEPALIVE = 15 * time.Second
+)
+
+type QRStreamEvent struct {
+	Event      string `json:"event"`
+	Code       string `json:"code,omitempty"`
+	ExpiresAt  string `json:"expires_at,omitempty"`
+	Attempt    int    `json:"attempt,omitempty"`
+	Restarting bool   `json:"restarting,omitempty"` // timeout: a new QR code follows
+	Error      string `json:"error,omitempty"`
+}
+
+var qrStreams = map[string]map[chan QRStreamEvent]bool{}
+var qrStreamsMu sync.Mutex
+
+func subscribeQRStream(email string) chan QRStreamEvent {
+	ch := make(chan QRStreamEvent, 8)
+	qrStreamsMu.Lock()
+	defer qrStreamsMu.Unlock()
+	if qrStreams[email] == nil {
+		qrStreams[email] = map[chan QRStreamEvent]bool{}
+	}
+	qrStreams[email][ch] = true
+	return ch
+}
+
+func unsubscribeQRStream(email string, ch chan QRStreamEvent) {
+	qrStreamsMu.Lock()
+	defer qrStreamsMu.Unlock()
+	delete(qrStreams[email], ch)
+	if len(qrStreams[email]) == 0 {
+		delete(qrStreams, email)
+	}
+}
+
+// Send an event to a user's open streams; a stream that isn't keeping up misses it
+func publishQREvent(email string, evt QRStreamEvent) {
+	qrStreamsMu.Lock()
+	defer qrStreamsMu.Unlock()
+	for ch := range qrStreams[email] {
+		select {
+		case ch <- evt:
+		default:
+			fmt.Printf("WARNING: QR stream for %s is full, dropping %s event\n", email, evt.Event)
+		}
+	}
+}
+
+// The code currently shown to a user, if the flow is waiting for a scan
+func currentQREvent(email string) (QRStreamEvent, bool) {
+	state := getUserWAState(email)
+	state.mu.RLock()
+	defer state.mu.RUnlock()
+	if state.waStatus != "waiting_qr" || state.qrCode == "" {
+		return QRStreamEvent{}, false
+	}
+	return QRStreamEvent{Event: QR_EVENT_CODE, Code: state.qrCode, ExpiresAt: state.qrExpiresAt.Format(time.RFC3339), Attempt: state.qrAttempt}, true
+}
+
+func writeQRStreamEvent(w http.ResponseWriter, evt QRStreamEvent) error {
+	data, _ := json.Marshal(evt)
+	_, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", evt.Event, data)
+	return err
+}
+
+func handleQRStream(sessionCookieName string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isAuthenticated(r, sessionCookieName) {
+			apiError(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			apiError(w, "Streaming not supported", http.StatusInternalServerError)
+			return
+		}
+		email := getUserEmail(r, sessionCookieName)
+
+		ch := subscribeQRStream(email)
+		defer unsubscribeQRStream(email, ch)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.WriteHeader(http.StatusOK)
+		if evt, ok := currentQREvent(email); ok {
+			writeQRStreamEvent(w, evt)
+		}
+		flusher.Flush()
+
+		keepalive := time.NewTicker(QR_STREAM_KEEPALIVE)
+		defer keepalive.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case evt := <-ch:
+				if err := writeQRStreamEvent(w, evt); err != nil {
+					return
+				}
+			case <-keepalive.C:
+				if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+					return
+				}
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQRStream(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+
+	email := "qrstream@example.com"
+	cookies, _ := registerWithAPIKey(t, ts, email, "qrstreampass123")
+	defer func() {
+		waUsers.mu.Lock()
+		delete(waUsers.data, email)
+		waUsers.mu.Unlock()
+	}()
+
+	if resp, err := http.Get(ts.URL + "/api/wa/qr/stream"); err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 without a session, got %v, %v", resp, err)
+	}
+
+	// A code shown before subscribing comes first
+	resetUserQR(email)
+	showUserQRCode(email, "first-code", 20*time.Second)
+
+	req, _ := http.NewRequest("GET", ts.URL+"/api/wa/qr/stream", nil)
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Expected an event stream, got %s", ct)
+	}
+
+	events := make(chan QRStreamEvent, 10)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			if data, ok := strings.CutPrefix(scanner.Text(), "data: "); ok {
+				var evt QRStreamEvent
+				json.Unmarshal([]byte(data), &evt)
+				events <- evt
+			}
+		}
+	}()
+	next := func() QRStreamEvent {
+		select {
+		case evt := <-events:
+			return evt
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Expected a stream event")
+		}
+		return QRStreamEvent{}
+	}
+
+	if evt := next(); evt.Event != QR_EVENT_CODE || evt.Code != "first-code" || evt.Attempt != 1 || evt.ExpiresAt == "" {
+		t.Fatalf("Expected the current code, got %+v", evt)
+	}
+	showUserQRCode(email, "second-code", 20*time.Second)
+	if evt := next(); evt.Event != QR_EVENT_CODE || evt.Code != "second-code" || evt.Attempt != 2 {
+		t.Fatalf("Expected the new code, got %+v", evt)
+	}
+	publishQREvent(email, QRStreamEvent{Event: QR_EVENT_SUCCESS})
+	if evt := next(); evt.Event != QR_EVENT_SUCCESS {
+		t.Fatalf("Expected success, got %+v", evt)
+	}
+}
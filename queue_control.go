@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// --- Queue pausing ---
+// A paused queue keeps accepting messages but sends nothing until resumed.
+// The paused flag is persisted per user so it survives restarts.
+
+func dbGetQueuePaused(email string) bool {
+	var paused bool
+	db.QueryRow(`SELECT queue_paused FROM users WHERE email = ?`, email).Scan(&paused)
+	return paused
+}
+
+func dbSetQueuePaused(email string, paused bool) error {
+	_, err := db.Exec(`UPDATE users SET queue_paused = ? WHERE email = ?`, paused, email)
+	return err
+}
+
+func (q *MessageQueue) isPaused() bool {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return q.Paused
+}
+
+// Pause or resume sending; resuming restarts processing of any waiting messages
+func (q *MessageQueue) setPaused(paused bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.Paused = paused
+	if !paused && len(q.Messages) > 0 && !q.IsProcessing {
+		q.IsProcessing = true
+		goBackground(q.processQueue)
+	}
+}
+
+// POST /api/queue/pause and /api/queue/resume
+func handleSetQueuePaused(sessionCookieName string, paused bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !isAuthenticated(r, sessionCookieName) {
+			apiError(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		email := getUserEmail(r, sessionCookieName)
+
+		if err := dbSetQueuePaused(email, paused); err != nil {
+			fmt.Println("ERROR: Could not persist queue pause state", err)
+			apiError(w, "Failed to update queue", http.StatusInternalServerError)
+			return
+		}
+		queue := getOrCreateQueue(email)
+		queue.setPaused(paused)
+
+		queue.mu.RLock()
+		queueLength := len(queue.Messages)
+		queue.mu.RUnlock()
+
+		if paused {
+			fmt.Printf("INFO: Queue paused for user %s (%d messages waiting)\n", email, queueLength)
+		} else {
+			fmt.Printf("INFO: Queue resumed for user %s (%d messages waiting)\n", email, queueLength)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":      true,
+			"paused":       paused,
+			"queue_length": queueLength,
+		})
+	}
+}
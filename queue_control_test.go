@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestQueuePauseResume(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+
+	email := "pauseuser@example.com"
+	cookies, _ := registerWithAPIKey(t, ts, email, "pausepass123")
+
+	post := func(path string) map[string]interface{} {
+		req, _ := http.NewRequest("POST", ts.URL+path, nil)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil || resp.StatusCode != 200 {
+			t.Fatalf("POST %s failed: %v, status: %d", path, err, resp.StatusCode)
+		}
+		var data map[string]interface{}
+		json.NewDecoder(resp.Body).Decode(&data)
+		return data
+	}
+	status := func() map[string]interface{} {
+		req, _ := http.NewRequest("GET", ts.URL+"/api/queue/status", nil)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Queue status failed: %v", err)
+		}
+		var data map[string]interface{}
+		json.NewDecoder(resp.Body).Decode(&data)
+		return data
+	}
+
+	if data := post("/api/queue/pause"); data["paused"] != true {
+		t.Fatalf("Expected paused response, got %v", data)
+	}
+	if !dbGetQueuePaused(email) {
+		t.Fatalf("Paused state should be persisted")
+	}
+
+	// Messages added while paused wait in the queue
+	queue := getOrCreateQueue(email)
+	queue.addMessage(&QueuedMessage{ID: "msg_paused", UserEmail: email, ChatJID: "123@s.whatsapp.net", Message: "hi", CreatedAt: time.Now(), Status: "queued"})
+	data := status()
+	if data["paused"] != true || data["queue_length"] != float64(1) || data["is_processing"] != false {
+		t.Fatalf("Expected paused queue holding 1 message, got %v", data)
+	}
+
+	// Resuming restarts processing
+	if data := post("/api/queue/resume"); data["paused"] != false {
+		t.Fatalf("Expected resumed response, got %v", data)
+	}
+	if dbGetQueuePaused(email) || queue.isPaused() {
+		t.Fatalf("Queue should no longer be paused")
+	}
+	if data := status(); data["paused"] != false {
+		t.Fatalf("Expected queue status not paused, got %v", data)
+	}
+
+	// Requires a session
+	resp, _ := http.Post(ts.URL+"/api/queue/pause", "application/json", nil)
+	if resp.StatusCode != 401 {
+		t.Fatalf("Expected 401 without session, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import "time"
+
+// --- Send time estimates ---
+// estimated_delay is worked out by replaying the queue loop (processQueue) from the
+// queue's current state, message by message in queue order: a hourly or daily limit
+// that is used up waits for its window to reset, a burst cooldown in progress is
+// waited out, then the message delay, typing time for the message's length and the
+// pause after sending apply. The random parts use their average, and a queue that hits
+// a limit checks again every minute, so estimates can be off by a minute around window
+// resets. A paused queue is estimated as if it were resumed now.
+
+const (
+	AVG_POST_TYPING_PAUSE = 250 * time.Millisecond  // After typing, before sending (simulateTyping)
+	AVG_HUMAN_DELAY       = 1250 * time.Millisecond // After sending (addHumanDelay)
+)
+
+// Estimated time until each queued message is sent, in queue order, plus extra
+// messages queued after them. Must be called with q.mu held.
+func (q *MessageQueue) estimateSendTimes(now time.Time, extra int) []time.Duration {
+	hourly, hourlyReset := q.HourlyCount, q.HourlyReset
+	daily, dailyReset := q.DailyCount, q.DailyReset
+	burst, lastSent := q.BurstCount, q.LastSent
+
+	delays := make([]time.Duration, 0, len(q.Messages)+extra)
+	t := now
+	for i := 0; i < len(q.Messages)+extra; i++ {
+		text := ""
+		if i < len(q.Messages) {
+			text = q.Messages[i].Message
+		}
+
+		// Limits, checked first: a used-up window waits for its reset
+		for {
+			if t.After(hourlyReset) {
+				hourly, hourlyReset = 0, t.Add(time.Hour)
+			}
+			if t.After(dailyReset) {
+				daily, dailyReset = 0, t.Add(24*time.Hour)
+			}
+			if daily >= MAX_DAILY_MESSAGES {
+				t = dailyReset.Add(time.Nanosecond)
+			} else if hourly >= MAX_HOURLY_MESSAGES {
+				t = hourlyReset.Add(time.Nanosecond)
+			} else {
+				break
+			}
+		}
+
+		// Burst cooldown, then the delay between messages
+		if burst >= BURST_ALLOWANCE {
+			if until := lastSent.Add(BURST_COOLDOWN); t.Before(until) {
+				t = until
+			}
+			burst = 0
+		}
+		if !lastSent.IsZero() {
+			if until := lastSent.Add(MESSAGE_DELAY); t.Before(until) {
+				t = until
+			}
+		}
+
+		sent := t.Add(typingDuration(text) + AVG_POST_TYPING_PAUSE)
+		delays = append(delays, sent.Sub(now))
+		lastSent = sent
+		burst++
+		hourly++
+		daily++
+		t = sent.Add(AVG_HUMAN_DELAY)
+	}
+	return delays
+}
+
+// Estimated time until the message at position (1-based) in the queue is sent
+func (q *MessageQueue) estimateDelay(position int) time.Duration {
+	if position <= 0 {
+		return 0
+	}
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	delays := q.estimateSendTimes(time.Now(), max(position-len(q.Messages), 0))
+	return delays[position-1]
+}
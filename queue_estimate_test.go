@@ -0,0 +1,64 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEstimateSendTimes(t *testing.T) {
+	now := time.Now()
+	newQueue := func(messages ...string) *MessageQueue {
+		q := &MessageQueue{HourlyReset: now.Add(time.Hour), DailyReset: now.Add(24 * time.Hour)}
+		for i, text := range messages {
+			q.Messages = append(q.Messages, &QueuedMessage{ID: string(rune('a' + i)), Message: text})
+		}
+		return q
+	}
+	short := typingDuration("hi") + AVG_POST_TYPING_PAUSE
+
+	// Idle queue: typing, then sent
+	if d := newQueue("hi").estimateSendTimes(now, 0)[0]; d != short {
+		t.Fatalf("Expected %s for the first message, got %s", short, d)
+	}
+
+	// Longer messages type longer, and later messages wait for earlier ones
+	delays := newQueue(strings.Repeat("x", 200), "hi").estimateSendTimes(now, 0)
+	if delays[0] != 4*time.Second+AVG_POST_TYPING_PAUSE || delays[1] != delays[0]+AVG_HUMAN_DELAY+short {
+		t.Fatalf("Unexpected delays: %v", delays)
+	}
+
+	// A burst cooldown in progress is waited out
+	q := newQueue("hi")
+	q.BurstCount, q.LastSent = BURST_ALLOWANCE, now
+	if d := q.estimateSendTimes(now, 0)[0]; d != BURST_COOLDOWN+short {
+		t.Fatalf("Expected the burst cooldown to be waited out, got %s", d)
+	}
+
+	// Used-up hourly limit: wait for the window to reset
+	q = newQueue("hi")
+	q.HourlyCount, q.HourlyReset = MAX_HOURLY_MESSAGES, now.Add(10*time.Minute)
+	if d := q.estimateSendTimes(now, 0)[0]; d < 10*time.Minute || d > 10*time.Minute+time.Second {
+		t.Fatalf("Expected about 10 minutes for a used-up hourly limit, got %s", d)
+	}
+
+	// The last message of the hour goes now, the next one after the reset
+	q = newQueue("hi", "hi")
+	q.HourlyCount, q.HourlyReset = MAX_HOURLY_MESSAGES-1, now.Add(20*time.Minute)
+	if delays := q.estimateSendTimes(now, 0); delays[0] != short || delays[1] < 20*time.Minute {
+		t.Fatalf("Expected the second message to wait for the hourly reset: %v", delays)
+	}
+
+	// The daily limit wins over the hourly one
+	q = newQueue("hi")
+	q.DailyCount, q.DailyReset = MAX_DAILY_MESSAGES, now.Add(5*time.Hour)
+	if d := q.estimateSendTimes(now, 0)[0]; d < 5*time.Hour {
+		t.Fatalf("Expected about 5 hours for a used-up daily limit, got %s", d)
+	}
+
+	// Positions past the end of the queue are estimated too
+	q = newQueue("hi")
+	if d := q.estimateDelay(3); d <= q.estimateDelay(2) || q.estimateDelay(0) != 0 {
+		t.Fatalf("Expected later positions to take longer, got %s", d)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// --- Queue status events ---
+// Webhooks subscribed to "queue.status" receive every state change of the user's
+// outgoing messages: pending_approval -> queued -> sending -> sent, or retrying,
+// failed and rejected, so a dashboard can mirror the queue without polling
+// /api/queue/status. Unlike callback_url, which only reports how a message ended, this
+// covers every message regardless of how it was sent. A user's events are delivered
+// one at a time in the order they happened; "at" is when the change happened, which is
+// earlier than delivery when a receiver is slow.
+
+const MAX_PENDING_QUEUE_EVENTS = 1000 // Per user; the oldest are dropped beyond this
+
+type queueEvent struct {
+	chatJID string
+	data    map[string]interface{}
+}
+
+// Events of one user waiting for delivery
+type queueEventStream struct {
+	mu      sync.Mutex
+	events  []queueEvent
+	running bool
+}
+
+var queueEventStreams = struct {
+	sync.Mutex
+	data map[string]*queueEventStream
+}{data: make(map[string]*queueEventStream)}
+
+// Whether any of the user's webhooks listens for queue events
+func queueEventsWanted(email string) bool {
+	userID, err := getUserIDByEmail(email)
+	if err != nil {
+		return false
+	}
+	webhooks, err := dbListWebhooks(userID)
+	if err != nil {
+		return false
+	}
+	for _, wh := range webhooks {
+		if !wh.Paused && webhookSubscribed(wh, EVENT_QUEUE_STATUS) {
+			return true
+		}
+	}
+	return false
+}
+
+// Report that msg went from previous (empty for a new message) to status
+func emitQueueEvent(msg *QueuedMessage, previous, status string) {
+	if !queueEventsWanted(msg.UserEmail) {
+		return
+	}
+	data := map[string]interface{}{
+		"queue_id":   msg.ID,
+		"status":     status,
+		"chat_jid":   msg.ChatJID,
+		"retries":    msg.Retries,
+		"created_at": msg.CreatedAt.UTC().Format(time.RFC3339),
+		"at":         time.Now().UTC().Format(time.RFC3339Nano),
+	}
+	if previous != "" {
+		data["previous_status"] = previous
+	}
+	if msg.Source != "" {
+		data["source"] = msg.Source
+	}
+	if msg.Campaign != "" {
+		data["campaign_id"] = msg.Campaign
+	}
+	if msg.SentID != "" {
+		data["message_id"] = msg.SentID
+	}
+	if msg.EditID != "" {
+		data["edit_of"] = msg.EditID
+	}
+	if msg.SentAt != nil {
+		data["server_timestamp"] = msg.SentAt.Format(time.RFC3339)
+	}
+
+	queueEventStreams.Lock()
+	stream, ok := queueEventStreams.data[msg.UserEmail]
+	if !ok {
+		stream = &queueEventStream{}
+		queueEventStreams.data[msg.UserEmail] = stream
+	}
+	queueEventStreams.Unlock()
+
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+	if len(stream.events) >= MAX_PENDING_QUEUE_EVENTS {
+		fmt.Printf("WARNING: Dropping queue event for message %s of user %s: receiver is falling behind\n", stream.events[0].data["queue_id"], msg.UserEmail)
+		stream.events = stream.events[1:]
+	}
+	stream.events = append(stream.events, queueEvent{chatJID: msg.ChatJID, data: data})
+	if !stream.running {
+		stream.running = true
+		goBackground(func(ctx context.Context) { stream.deliver(ctx, msg.UserEmail) })
+	}
+}
+
+// Deliver the stream's events in order until it is empty or the server stops; the
+// rest are delivered after the next event
+func (s *queueEventStream) deliver(ctx context.Context, email string) {
+	for {
+		s.mu.Lock()
+		if len(s.events) == 0 || ctx.Err() != nil {
+			s.running = false
+			s.mu.Unlock()
+			return
+		}
+		event := s.events[0]
+		s.events = s.events[1:]
+		s.mu.Unlock()
+		emitWebhookEvent(email, EVENT_QUEUE_STATUS, event.chatJID, event.data)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestQueueStatusEvents(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+
+	email := "queueevents@example.com"
+	_, apiKey := registerWithAPIKey(t, ts, email, "queueeventspass123")
+	useFakeWAClient(t, email)
+
+	events := make(chan map[string]interface{}, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&payload)
+		if payload["event"] == EVENT_QUEUE_STATUS {
+			events <- payload
+		}
+	}))
+	defer receiver.Close()
+	if resp := apiRequest(t, "POST", ts.URL+"/api/webhooks/create", apiKey, map[string]interface{}{
+		"url": receiver.URL, "method": "POST", "events": []string{EVENT_QUEUE_STATUS},
+	}, nil); resp.StatusCode != 200 {
+		t.Fatalf("Creating the queue events webhook failed: %d", resp.StatusCode)
+	}
+
+	result, err := sendService.Enqueue(SendRequest{UserEmail: email, ChatJID: "14155550100@s.whatsapp.net", Message: "tracked", Source: "api"})
+	if err != nil {
+		t.Fatalf("Enqueue failed: %v", err)
+	}
+
+	var transitions []string
+	var sent map[string]interface{}
+	for sent == nil {
+		select {
+		case event := <-events:
+			if event["queue_id"] != result.Message.ID || event["chat_jid"] != "14155550100@s.whatsapp.net" || event["at"] == nil {
+				t.Fatalf("Unexpected event: %v", event)
+			}
+			previous, _ := event["previous_status"].(string)
+			transitions = append(transitions, previous+">"+event["status"].(string))
+			if event["status"] == "sent" {
+				sent = event
+			}
+		case <-time.After(15 * time.Second):
+			t.Fatalf("Timed out waiting for queue events, got %v", transitions)
+		}
+	}
+	if len(transitions) != 3 || transitions[0] != ">queued" || transitions[1] != "queued>sending" || transitions[2] != "sending>sent" {
+		t.Fatalf("Unexpected transitions: %v", transitions)
+	}
+	if id, _ := sent["message_id"].(string); id == "" {
+		t.Fatalf("Expected the WhatsApp message ID in the sent event: %v", sent)
+	}
+	if sent["source"] != "api" {
+		t.Fatalf("Expected the source in the event: %v", sent)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// --- Message expiry ---
+// Time-sensitive sends (one-time codes, "your driver is outside") can set expires_in,
+// in seconds. A message still queued or waiting for approval when it expires is
+// dropped with status "expired", an "expired" callback and a queue.status event,
+// instead of being sent late. The queue checks right before sending; a sweep every
+// QUEUE_EXPIRY_INTERVAL catches messages held up in a paused queue or behind a limit.
+
+const (
+	STATUS_EXPIRED        = "expired"
+	MAX_MESSAGE_TTL       = 24 * time.Hour
+	QUEUE_EXPIRY_INTERVAL = 10 * time.Second
+)
+
+// Validate expires_in (seconds; 0 means the message doesn't expire)
+func messageTTL(expiresIn int) (time.Duration, error) {
+	ttl := time.Duration(expiresIn) * time.Second
+	if expiresIn < 0 || ttl > MAX_MESSAGE_TTL {
+		return 0, fmt.Errorf("expires_in must be between 1 and %d seconds", int(MAX_MESSAGE_TTL.Seconds()))
+	}
+	return ttl, nil
+}
+
+func messageExpired(msg *QueuedMessage, now time.Time) bool {
+	return msg.ExpiresAt != nil && !now.Before(*msg.ExpiresAt)
+}
+
+// Remove the expired messages from the queue and from those waiting for approval
+func (q *MessageQueue) takeExpired(now time.Time) []*QueuedMessage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var expired []*QueuedMessage
+	keep := func(list []*QueuedMessage) []*QueuedMessage {
+		kept := list[:0:0]
+		for _, msg := range list {
+			if messageExpired(msg, now) {
+				expired = append(expired, msg)
+			} else {
+				kept = append(kept, msg)
+			}
+		}
+		return kept
+	}
+	if len(q.Messages) > 0 {
+		q.Messages = keep(q.Messages)
+	}
+	if len(q.Pending) > 0 {
+		q.Pending = keep(q.Pending)
+	}
+	return expired
+}
+
+// Mark a message that is no longer in the queue as expired and report it
+func (q *MessageQueue) expire(msg *QueuedMessage) {
+	q.mu.Lock()
+	previous := msg.Status
+	msg.Status = STATUS_EXPIRED
+	q.mu.Unlock()
+	fmt.Printf("INFO: Message %s of user %s expired before it was sent\n", msg.ID, q.UserEmail)
+	sendCallback(msg, STATUS_EXPIRED, nil)
+	emitQueueEvent(msg, previous, STATUS_EXPIRED)
+	campaignMessageDone(msg, STATUS_EXPIRED)
+}
+
+// Drop the expired messages of every queue
+func expireQueuedMessages(now time.Time) int {
+	queueMutex.RLock()
+	queues := make([]*MessageQueue, 0, len(messageQueues))
+	for _, queue := range messageQueues {
+		queues = append(queues, queue)
+	}
+	queueMutex.RUnlock()
+
+	n := 0
+	for _, queue := range queues {
+		for _, msg := range queue.takeExpired(now) {
+			queue.expire(msg)
+			n++
+		}
+	}
+	return n
+}
+
+func startQueueExpiry() {
+	runEvery(QUEUE_EXPIRY_INTERVAL, func(now time.Time) {
+		expireQueuedMessages(now)
+	})
+}
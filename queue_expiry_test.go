@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMessageExpiry(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+
+	email := "expiry@example.com"
+	_, apiKey := registerWithAPIKey(t, ts, email, "expirypass123")
+	fake := useFakeWAClient(t, email)
+	queue := getOrCreateQueue(email)
+	queue.setPaused(true)
+	defer dropUserQueue(email)
+
+	for _, expiresIn := range []int{-1, int(MAX_MESSAGE_TTL.Seconds()) + 1} {
+		resp := apiRequest(t, "POST", ts.URL+"/api/messages/send", apiKey, map[string]interface{}{
+			"chat_jid": "14155550100@s.whatsapp.net", "message": "code 1234", "expires_in": expiresIn,
+		}, nil)
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("Expected 400 for expires_in %d, got %d", expiresIn, resp.StatusCode)
+		}
+	}
+
+	callbacks := make(chan map[string]interface{}, 4)
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		callbacks <- body
+	}))
+	defer callback.Close()
+	waitCallback := func(queueID string) {
+		t.Helper()
+		select {
+		case body := <-callbacks:
+			if body["status"] != STATUS_EXPIRED || body["queue_id"] != queueID {
+				t.Fatalf("Unexpected callback: %v", body)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for the expired callback")
+		}
+	}
+
+	var queued map[string]interface{}
+	resp := apiRequest(t, "POST", ts.URL+"/api/messages/send", apiKey, map[string]interface{}{
+		"chat_jid": "14155550100@s.whatsapp.net", "message": "code 1234", "expires_in": 60, "callback_url": callback.URL,
+	}, &queued)
+	if resp.StatusCode != 200 || queued["expires_at"] == nil {
+		t.Fatalf("Send with expires_in failed: %d %v", resp.StatusCode, queued)
+	}
+	keep, err := sendService.Enqueue(SendRequest{UserEmail: email, ChatJID: "14155550100@s.whatsapp.net", Message: "no expiry", Source: "api"})
+	if err != nil {
+		t.Fatalf("Enqueue failed: %v", err)
+	}
+
+	// The sweep drops the expired message from the paused queue and keeps the other
+	if n := expireQueuedMessages(time.Now().Add(30 * time.Second)); n != 0 {
+		t.Fatalf("Expected nothing to expire yet, got %d", n)
+	}
+	if n := expireQueuedMessages(time.Now().Add(61 * time.Second)); n != 1 {
+		t.Fatalf("Expected one expired message, got %d", n)
+	}
+	waitCallback(queued["queue_id"].(string))
+	if queue.getQueuePosition(queued["queue_id"].(string)) != -1 || queue.getQueuePosition(keep.Message.ID) != 1 {
+		t.Fatal("Expected only the expired message to leave the queue")
+	}
+
+	// A message that expires while waiting is dropped instead of sent
+	late, err := sendService.Enqueue(SendRequest{UserEmail: email, ChatJID: "14155550100@s.whatsapp.net", Message: "driver outside", Source: "api", ExpiresIn: 1, CallbackURL: callback.URL})
+	if err != nil {
+		t.Fatalf("Enqueue failed: %v", err)
+	}
+	queue.mu.Lock()
+	queue.Messages = append([]*QueuedMessage{late.Message}, queue.Messages[:len(queue.Messages)-1]...)
+	*late.Message.ExpiresAt = time.Now().Add(-time.Second)
+	queue.mu.Unlock()
+	queue.setPaused(false)
+	waitCallback(late.Message.ID)
+	for _, sent := range fake.sentMessages() {
+		if sent.Message.GetConversation() == "driver outside" {
+			t.Fatal("Expired message was sent")
+		}
+	}
+}
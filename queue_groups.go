@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"time"
+	"unicode/utf8"
+)
+
+// --- Message groups ---
+// A multi-part answer can set the same group_key on each part so other sends don't
+// interleave with it. A grouped message is queued right after the last queued message
+// of its group, and while a group is being sent (up to MESSAGE_GROUP_HOLD after its
+// last part went out) a new part goes to the front of the queue. Parts keep the order
+// they were queued in; a part that is retried goes back to the front.
+
+const (
+	MAX_GROUP_KEY_LENGTH = 100
+	MESSAGE_GROUP_HOLD   = 30 * time.Second
+)
+
+func validateGroupKey(key string) error {
+	if utf8.RuneCountInString(key) > MAX_GROUP_KEY_LENGTH {
+		return fmt.Errorf("group_key must be at most %d characters", MAX_GROUP_KEY_LENGTH)
+	}
+	return nil
+}
+
+// Where a new message goes in the queue. Must be called with q.mu held.
+func (q *MessageQueue) insertIndex(msg *QueuedMessage, now time.Time) int {
+	if msg.GroupKey == "" {
+		return len(q.Messages)
+	}
+	for i := len(q.Messages) - 1; i >= 0; i-- {
+		if q.Messages[i].GroupKey == msg.GroupKey {
+			return i + 1
+		}
+	}
+	if q.Group == msg.GroupKey && now.Before(q.GroupUntil) {
+		return 0
+	}
+	return len(q.Messages)
+}
+
+// Insert a message at index. Must be called with q.mu held.
+func (q *MessageQueue) insertAt(i int, msg *QueuedMessage) {
+	q.Messages = append(q.Messages, nil)
+	copy(q.Messages[i+1:], q.Messages[i:])
+	q.Messages[i] = msg
+}
+
+// Keep the group of a message being sent open for its next parts. Must be called with
+// q.mu held.
+func (q *MessageQueue) holdGroup(msg *QueuedMessage, now time.Time) {
+	if msg.GroupKey == "" {
+		q.Group = ""
+		return
+	}
+	q.Group, q.GroupUntil = msg.GroupKey, now.Add(MESSAGE_GROUP_HOLD)
+}
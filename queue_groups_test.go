@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMessageGroups(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+
+	email := "groups@example.com"
+	_, apiKey := registerWithAPIKey(t, ts, email, "groupspass123")
+	useFakeWAClient(t, email)
+	queue := getOrCreateQueue(email)
+	queue.setPaused(true)
+	defer dropUserQueue(email)
+
+	resp := apiRequest(t, "POST", ts.URL+"/api/messages/send", apiKey, map[string]interface{}{
+		"chat_jid": "14155550100@s.whatsapp.net", "message": "hi", "group_key": strings.Repeat("k", MAX_GROUP_KEY_LENGTH+1),
+	}, nil)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for a long group_key, got %d", resp.StatusCode)
+	}
+
+	// Later parts of a group are queued right after the earlier ones
+	send := func(message, groupKey string) map[string]interface{} {
+		t.Helper()
+		var result map[string]interface{}
+		resp := apiRequest(t, "POST", ts.URL+"/api/messages/send", apiKey, map[string]interface{}{
+			"chat_jid": "14155550100@s.whatsapp.net", "message": message, "group_key": groupKey,
+		}, &result)
+		if resp.StatusCode != 200 {
+			t.Fatalf("Send failed: %d %v", resp.StatusCode, result)
+		}
+		return result
+	}
+	send("answer 1/3", "answer")
+	send("other", "")
+	if part := send("answer 2/3", "answer"); part["position"] != float64(2) || part["group_key"] != "answer" {
+		t.Fatalf("Expected the second part right after the first: %v", part)
+	}
+	send("answer 3/3", "answer")
+	order := func() string {
+		queue.mu.RLock()
+		defer queue.mu.RUnlock()
+		var texts []string
+		for _, msg := range queue.Messages {
+			texts = append(texts, msg.Message)
+		}
+		return strings.Join(texts, ",")
+	}
+	if got := order(); got != "answer 1/3,answer 2/3,answer 3/3,other" {
+		t.Fatalf("Unexpected queue order: %s", got)
+	}
+
+	// While a group is being sent, its next part goes first
+	queue.mu.Lock()
+	queue.Messages = queue.Messages[3:]
+	queue.holdGroup(&QueuedMessage{GroupKey: "answer"}, time.Now())
+	queue.mu.Unlock()
+	send("answer late", "answer")
+	send("other group", "reply")
+	if got := order(); got != "answer late,other,other group" {
+		t.Fatalf("Unexpected queue order: %s", got)
+	}
+
+	// Once the hold is over, a part queues at the end
+	queue.mu.Lock()
+	queue.holdGroup(&QueuedMessage{GroupKey: "answer"}, time.Now().Add(-MESSAGE_GROUP_HOLD))
+	queue.Messages = queue.Messages[1:]
+	queue.mu.Unlock()
+	send("answer later", "answer")
+	if got := order(); got != "other,other group,answer later" {
+		t.Fatalf("Unexpected queue order: %s", got)
+	}
+}
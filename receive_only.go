@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// --- Receive-only mode ---
+// Users who only ingest messages (e.g. compliance archiving) can switch sending off.
+// Every send path is refused server-side: the send API, the /webhook/{id} receiver,
+// auto-replies, message deletion, and messages that were already queued.
+
+func dbGetReceiveOnly(email string) bool {
+	var receiveOnly bool
+	db.QueryRow(`SELECT receive_only FROM users WHERE email = ?`, email).Scan(&receiveOnly)
+	return receiveOnly
+}
+
+func dbSetReceiveOnly(email string, receiveOnly bool) error {
+	_, err := db.Exec(`UPDATE users SET receive_only = ? WHERE email = ?`, receiveOnly, email)
+	return err
+}
+
+// GET/POST /api/user/receive-only
+// Session-authenticated, so an API key cannot switch sending back on.
+func handleReceiveOnly(sessionCookieName string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isAuthenticated(r, sessionCookieName) {
+			apiError(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		email := getUserEmail(r, sessionCookieName)
+
+		switch r.Method {
+		case "GET":
+		case "POST":
+			var req struct {
+				ReceiveOnly *bool `json:"receive_only"`
+			}
+			if err := decodeJSONBody(w, r, &req); err != nil {
+				writeBodyError(w, err)
+				return
+			}
+			if req.ReceiveOnly == nil {
+				apiError(w, "Missing receive_only", http.StatusBadRequest)
+				return
+			}
+			if err := dbSetReceiveOnly(email, *req.ReceiveOnly); err != nil {
+				fmt.Println("ERROR: Could not update receive-only mode", err)
+				apiError(w, "Failed to update receive-only mode", http.StatusInternalServerError)
+				return
+			}
+			fmt.Printf("INFO: Receive-only mode for user %s set to %v\n", email, *req.ReceiveOnly)
+		default:
+			apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]bool{"receive_only": dbGetReceiveOnly(email)})
+	}
+}
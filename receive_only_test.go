@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestReceiveOnlyMode(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+
+	email := "archive@example.com"
+	cookies, apiKey := registerWithAPIKey(t, ts, email, "archivepass123")
+	sendService.isConnected = func(string) bool { return true }
+	dbSetQueuePaused(email, true)
+	defer func() {
+		sendService.isConnected = isUserWAConnected
+		queueMutex.Lock()
+		delete(messageQueues, email)
+		queueMutex.Unlock()
+	}()
+
+	setReceiveOnly := func(enabled bool) {
+		t.Helper()
+		var buf bytes.Buffer
+		json.NewEncoder(&buf).Encode(map[string]bool{"receive_only": enabled})
+		req, _ := http.NewRequest("POST", ts.URL+"/api/user/receive-only", &buf)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil || resp.StatusCode != 200 {
+			t.Fatalf("Set receive-only failed: %v", err)
+		}
+		var out map[string]bool
+		json.NewDecoder(resp.Body).Decode(&out)
+		if out["receive_only"] != enabled {
+			t.Fatalf("Expected receive_only %v, got %v", enabled, out)
+		}
+	}
+
+	chat := "5551234@s.whatsapp.net"
+	send := func() *http.Response {
+		return apiRequest(t, "POST", ts.URL+"/api/messages/send", apiKey, map[string]string{"chat_jid": chat, "message": "hi"}, nil)
+	}
+	if resp := send(); resp.StatusCode != 200 {
+		t.Fatalf("Expected send to be queued, got %d", resp.StatusCode)
+	}
+
+	setReceiveOnly(true)
+
+	// The API key cannot switch sending back on
+	if resp := apiRequest(t, "POST", ts.URL+"/api/user/receive-only", apiKey, map[string]bool{"receive_only": false}, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 for API key, got %d", resp.StatusCode)
+	}
+
+	var apiErr struct {
+		Error struct{ Code string } `json:"error"`
+	}
+	resp := apiRequest(t, "POST", ts.URL+"/api/messages/send", apiKey, map[string]string{"chat_jid": chat, "message": "hi"}, &apiErr)
+	if resp.StatusCode != http.StatusForbidden || apiErr.Error.Code != ERR_RECEIVE_ONLY {
+		t.Fatalf("Expected 403 receive_only from send API, got %d %q", resp.StatusCode, apiErr.Error.Code)
+	}
+
+	var created map[string]interface{}
+	apiRequest(t, "POST", ts.URL+"/api/webhooks/create", apiKey, map[string]interface{}{"url": "http://example.com/hook", "method": "POST"}, &created)
+	id, _ := created["id"].(string)
+	resp = apiRequest(t, "POST", ts.URL+"/webhook/"+id, "", map[string]string{"chat_id": chat, "message": "hi"}, nil)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected 403 from webhook receiver, got %d", resp.StatusCode)
+	}
+
+	if _, err := queueWebhookReply(email, Webhook{ID: id}, chat, []byte(`{"reply": "thanks"}`)); err == nil {
+		t.Fatal("Expected auto-reply to be refused")
+	}
+
+	// The message queued before the switch is dropped instead of sent
+	queue := getOrCreateQueue(email)
+	queue.mu.Lock()
+	queue.Paused = false
+	msg := queue.Messages[0]
+	queue.mu.Unlock()
+	queue.processQueue(context.Background())
+	queue.mu.RLock()
+	remaining := len(queue.Messages)
+	queue.mu.RUnlock()
+	if remaining != 0 || msg.Status != "failed" {
+		t.Fatalf("Expected queued message dropped, got %d remaining, status %s", remaining, msg.Status)
+	}
+
+	setReceiveOnly(false)
+	dbSetQueuePaused(email, true)
+	queue.setPaused(true)
+	if resp := send(); resp.StatusCode != 200 {
+		t.Fatalf("Expected send to work again, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// --- Recent chat activity ---
+// Chats with recent messages are kept in the recent_chats table (last message time,
+// a short snippet and an unread flag) so the dashboard's chat picker survives restarts.
+
+const (
+	MAX_RECENT_CHATS    = 100 // Stored per user; older chats are pruned
+	CHAT_SNIPPET_LENGTH = 100 // Runes of the last text kept as a snippet
+)
+
+func chatTypeForJID(chatJID string) string {
+	if strings.HasSuffix(chatJID, "@g.us") || (strings.HasSuffix(chatJID, "@"+CHANNEL_TELEGRAM) && strings.HasPrefix(chatJID, "-")) {
+		return "group"
+	}
+	return "chat"
+}
+
+// Short preview of a forwarded message payload: its text or caption, else the media kind
+func chatSnippet(payload map[string]interface{}) string {
+	text, _ := payload["text"].(string)
+	if text == "" {
+		text, _ = payload["caption"].(string)
+	}
+	if text == "" {
+		if msgType, _ := payload["type"].(string); msgType != "" && msgType != "text" {
+			text = "[" + msgType + "]"
+		}
+	}
+	return truncateRunes(text, CHAT_SNIPPET_LENGTH)
+}
+
+func truncateRunes(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	return string(runes[:n]) + "…"
+}
+
+// Record a message in a chat. Incoming messages mark the chat unread, outgoing ones read.
+// An empty name or snippet keeps the stored one.
+func recordChatActivity(email, chatID, name, chatType, snippet string, incoming bool, at time.Time) {
+	if chatID == "" {
+		return // Skip empty chat IDs
+	}
+	userID, err := getUserIDByEmail(email)
+	if err != nil {
+		fmt.Printf("ERROR: Could not record chat activity for %s: %v\n", email, err)
+		return
+	}
+	_, err = db.Exec(`INSERT INTO recent_chats (user_id, chat_jid, name, type, last_message_at, last_text, unread) VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(user_id, chat_jid) DO UPDATE SET
+			name = CASE WHEN excluded.name != '' THEN excluded.name ELSE recent_chats.name END,
+			type = excluded.type,
+			last_message_at = excluded.last_message_at,
+			last_text = CASE WHEN excluded.last_text != '' THEN excluded.last_text ELSE recent_chats.last_text END,
+			unread = excluded.unread`,
+		userID, chatID, name, chatType, at.UTC().Format(time.RFC3339), snippet, incoming)
+	if err != nil {
+		fmt.Printf("ERROR: Could not record chat activity for %s: %v\n", email, err)
+		return
+	}
+	// Keep only the most recent chats
+	db.Exec(`DELETE FROM recent_chats WHERE user_id = ? AND chat_jid NOT IN (
+		SELECT chat_jid FROM recent_chats WHERE user_id = ? ORDER BY last_message_at DESC LIMIT ?)`,
+		userID, userID, MAX_RECENT_CHATS)
+}
+
+// Add or update recent chat for a user (activity without a message, e.g. joining a group)
+func addRecentChat(email string, chatID string, chatName string, chatType string) {
+	recordChatActivity(email, chatID, chatName, chatType, "", false, time.Now())
+}
+
+// Recent chats for a user, most recent first
+func getRecentChats(ctx context.Context, email string) []Chat {
+	chats := []Chat{}
+	userID, err := getUserIDByEmail(email)
+	if err != nil {
+		return chats
+	}
+	rows, err := db.QueryContext(ctx, `SELECT chat_jid, name, type, last_message_at, last_text, unread FROM recent_chats
+		WHERE user_id = ? ORDER BY last_message_at DESC LIMIT ?`, userID, MAX_RECENT_CHATS)
+	if err != nil {
+		fmt.Printf("ERROR: Could not load recent chats for %s: %v\n", email, err)
+		return chats
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c Chat
+		var lastMessageAt string
+		if err := rows.Scan(&c.ID, &c.Name, &c.Type, &lastMessageAt, &c.LastText, &c.Unread); err != nil {
+			return chats
+		}
+		if t, err := time.Parse(time.RFC3339, lastMessageAt); err == nil {
+			c.LastMessageAt = &t
+		}
+		if c.Name == "" {
+			c.Name = strings.Split(c.ID, "@")[0]
+		}
+		chats = append(chats, c)
+	}
+	return chats
+}
+
+// Attach recent activity to a chat list. Chats with activity come first, most recent
+// first; active chats missing from the list (e.g. unknown contacts) are added.
+func mergeChatActivity(chats []Chat, recent []Chat) []Chat {
+	activity := make(map[string]Chat, len(recent))
+	for _, c := range recent {
+		activity[c.ID] = c
+	}
+	merged := make([]Chat, 0, len(chats)+len(recent))
+	for _, c := range chats {
+		if a, ok := activity[c.ID]; ok {
+			c.LastMessageAt, c.LastText, c.Unread = a.LastMessageAt, a.LastText, a.Unread
+			delete(activity, c.ID)
+		}
+		merged = append(merged, c)
+	}
+	for _, c := range recent {
+		if _, missing := activity[c.ID]; missing {
+			merged = append(merged, c)
+		}
+	}
+	sort.SliceStable(merged, func(i, j int) bool {
+		a, b := merged[i].LastMessageAt, merged[j].LastMessageAt
+		if a == nil || b == nil {
+			return a != nil && b == nil
+		}
+		return a.After(*b)
+	})
+	return merged
+}
+
+// POST /api/wa/chats/{jid}/read
+// Clears the unread flag of a chat.
+func handleMarkChatRead(sessionCookieName string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isAuthenticated(r, sessionCookieName) {
+			apiError(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != "POST" {
+			apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		userID, err := getUserIDByEmail(getUserEmail(r, sessionCookieName))
+		if err != nil {
+			apiError(w, "User not found", http.StatusUnauthorized)
+			return
+		}
+		chatJID, err := normalizeChatJID(r.PathValue("jid"))
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, ERR_INVALID_JID, "Invalid chat JID")
+			return
+		}
+		res, err := db.Exec(`UPDATE recent_chats SET unread = 0 WHERE user_id = ? AND chat_jid = ?`, userID, chatJID.String())
+		if err != nil {
+			apiError(w, "Failed to update chat", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			apiError(w, "Chat not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "chat_jid": chatJID.String(), "unread": false})
+	}
+}
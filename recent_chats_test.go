@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRecentChatActivity(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+
+	email := "recentchats@example.com"
+	cookies, _ := registerWithAPIKey(t, ts, email, "recentpass123")
+	do := func(method, path string) *http.Response {
+		req, _ := http.NewRequest(method, ts.URL+path, nil)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s failed: %v", method, path, err)
+		}
+		return resp
+	}
+	chats := func() []Chat {
+		var result []Chat
+		json.NewDecoder(do("GET", "/api/wa/chats").Body).Decode(&result)
+		return result
+	}
+
+	now := time.Now().Unix()
+	forwardToWebhooks(email, map[string]interface{}{
+		"from": "5551111@s.whatsapp.net", "to": "5551111@s.whatsapp.net", "name": "Alice",
+		"type": "text", "text": "Hello there", "timestamp": now - 60,
+	}, "", "test_media")
+	forwardToWebhooks(email, map[string]interface{}{
+		"from": "5552222@s.whatsapp.net", "to": "120363000000000001@g.us", "name": "Bob",
+		"type": "image", "timestamp": now,
+	}, "", "test_media")
+
+	// Stored activity is returned without a WhatsApp client, most recent first
+	result := chats()
+	if len(result) != 2 {
+		t.Fatalf("Expected 2 recent chats, got %+v", result)
+	}
+	group, direct := result[0], result[1]
+	if group.ID != "120363000000000001@g.us" || group.Type != "group" || group.Name == "Bob" || group.LastText != "[image]" || !group.Unread {
+		t.Fatalf("Unexpected group chat: %+v", group)
+	}
+	if direct.Name != "Alice" || direct.LastText != "Hello there" || direct.LastMessageAt == nil || direct.LastMessageAt.Unix() != now-60 {
+		t.Fatalf("Unexpected direct chat: %+v", direct)
+	}
+
+	if resp := do("POST", "/api/wa/chats/5551111@s.whatsapp.net/read"); resp.StatusCode != 200 {
+		t.Fatalf("Mark read failed, status: %d", resp.StatusCode)
+	}
+	if result = chats(); result[1].Unread {
+		t.Fatalf("Chat should be read: %+v", result[1])
+	}
+	if resp := do("POST", "/api/wa/chats/999@s.whatsapp.net/read"); resp.StatusCode != 404 {
+		t.Fatalf("Expected 404 for unknown chat, got %d", resp.StatusCode)
+	}
+}
+
+func TestMergeChatActivity(t *testing.T) {
+	older, newer := time.Now().Add(-time.Hour), time.Now()
+	contacts := []Chat{{ID: "a@s.whatsapp.net", Name: "A"}, {ID: "b@s.whatsapp.net", Name: "B"}, {ID: "c@s.whatsapp.net", Name: "C"}}
+	recent := []Chat{
+		{ID: "x@s.whatsapp.net", Name: "X", LastMessageAt: &newer},
+		{ID: "b@s.whatsapp.net", LastMessageAt: &older, LastText: "hi", Unread: true},
+	}
+	merged := mergeChatActivity(contacts, recent)
+	order := []string{"x@s.whatsapp.net", "b@s.whatsapp.net", "a@s.whatsapp.net", "c@s.whatsapp.net"}
+	if len(merged) != len(order) {
+		t.Fatalf("Unexpected merged chats: %+v", merged)
+	}
+	for i, id := range order {
+		if merged[i].ID != id {
+			t.Fatalf("Position %d: expected %s, got %s", i, id, merged[i].ID)
+		}
+	}
+	if merged[1].Name != "B" || merged[1].LastText != "hi" || !merged[1].Unread {
+		t.Fatalf("Activity not attached to contact: %+v", merged[1])
+	}
+}
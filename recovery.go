@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// --- Panic recovery ---
+// A panicking handler gets a 500 JSON error instead of a dropped connection, and the
+// panic is logged with its stack and the request. With SENTRY_DSN set, it is also
+// reported to Sentry (or anything speaking Sentry's store API, e.g. GlitchTip).
+
+const SENTRY_TIMEOUT = 5 * time.Second
+
+// Report a recovered panic; a variable so tests can capture reports
+var reportPanic = reportPanicToSentry
+
+// Remembers whether the response was started, so a panic after the first write
+// doesn't try to send a second status
+type recoveryWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (w *recoveryWriter) WriteHeader(status int) {
+	w.wroteHeader = true
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recoveryWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(b)
+}
+
+// Streaming handlers (e.g. the QR stream) need to flush through the wrapper
+func (w *recoveryWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		w.wroteHeader = true
+		f.Flush()
+	}
+}
+
+func (w *recoveryWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func withRecovery(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rw := &recoveryWriter{ResponseWriter: w}
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			if recovered == http.ErrAbortHandler {
+				// Deliberate abort of the response; net/http handles it quietly
+				panic(recovered)
+			}
+			fmt.Printf("ERROR: Panic serving %s %s from %s: %v\n%s", r.Method, r.URL.Path, r.RemoteAddr, recovered, debug.Stack())
+			reportPanic(r, recovered, panicFrames())
+			if !rw.wroteHeader {
+				apiError(rw, "Internal server error", http.StatusInternalServerError)
+			}
+		}()
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// A Sentry stack frame
+type sentryFrame struct {
+	Function string `json:"function"`
+	Filename string `json:"filename"`
+	Lineno   int    `json:"lineno"`
+	InApp    bool   `json:"in_app"`
+}
+
+// Prefix of this package's function names, e.g. "whatsmeowtest."
+var appFuncPrefix = func() string {
+	pc, _, _, _ := runtime.Caller(0)
+	name := runtime.FuncForPC(pc).Name()
+	return name[:strings.Index(name, ".")+1]
+}()
+
+// Frames of the panicking goroutine from where the panic was raised, oldest first as
+// Sentry expects. Call from the deferred recover.
+func panicFrames() []sentryFrame {
+	pcs := make([]uintptr, 64)
+	n := runtime.Callers(3, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+	var out []sentryFrame
+	for {
+		frame, more := frames.Next()
+		if !strings.HasPrefix(frame.Function, "runtime.") {
+			out = append(out, sentryFrame{
+				Function: frame.Function,
+				Filename: frame.File,
+				Lineno:   frame.Line,
+				InApp:    strings.HasPrefix(frame.Function, appFuncPrefix),
+			})
+		}
+		if !more {
+			break
+		}
+	}
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return out
+}
+
+// Where to send events for a DSN like https://<key>@<host>/<project>
+func parseSentryDSN(dsn string) (storeURL, key string, err error) {
+	u, err := url.Parse(dsn)
+	if err != nil || u.User == nil || u.User.Username() == "" || u.Host == "" {
+		return "", "", fmt.Errorf("invalid Sentry DSN")
+	}
+	path := strings.Trim(u.Path, "/")
+	project := path
+	prefix := ""
+	if i := strings.LastIndex(path, "/"); i >= 0 {
+		prefix, project = "/"+path[:i], path[i+1:]
+	}
+	if project == "" {
+		return "", "", fmt.Errorf("invalid Sentry DSN: no project ID")
+	}
+	return fmt.Sprintf("%s://%s%s/api/%s/store/", u.Scheme, u.Host, prefix, project), u.User.Username(), nil
+}
+
+// Build the Sentry event for a panic. Only the method, path, query and user agent of
+// the request are sent; cookies and API keys stay here.
+func sentryPanicEvent(r *http.Request, recovered interface{}, frames []sentryFrame) map[string]interface{} {
+	id := make([]byte, 16)
+	rand.Read(id)
+	hostname, _ := os.Hostname()
+	return map[string]interface{}{
+		"event_id":    hex.EncodeToString(id),
+		"timestamp":   time.Now().UTC().Format(time.RFC3339),
+		"level":       "fatal",
+		"platform":    "go",
+		"logger":      "http",
+		"server_name": hostname,
+		"environment": getEnv("SENTRY_ENVIRONMENT", "production"),
+		"exception": map[string]interface{}{
+			"values": []map[string]interface{}{{
+				"type":       fmt.Sprintf("panic: %T", recovered),
+				"value":      fmt.Sprint(recovered),
+				"stacktrace": map[string]interface{}{"frames": frames},
+			}},
+		},
+		"request": map[string]interface{}{
+			"method":       r.Method,
+			"url":          r.URL.Path,
+			"query_string": r.URL.RawQuery,
+			"headers":      map[string]string{"User-Agent": r.UserAgent()},
+		},
+		"tags": map[string]string{"path": r.URL.Path},
+	}
+}
+
+// Send a panic to SENTRY_DSN in the background, if set
+func reportPanicToSentry(r *http.Request, recovered interface{}, frames []sentryFrame) {
+	dsn := os.Getenv("SENTRY_DSN")
+	if dsn == "" {
+		return
+	}
+	storeURL, key, err := parseSentryDSN(dsn)
+	if err != nil {
+		fmt.Println("ERROR: Could not report panic:", err)
+		return
+	}
+	body, _ := json.Marshal(sentryPanicEvent(r, recovered, frames))
+	go func() {
+		req, err := http.NewRequest("POST", storeURL, bytes.NewReader(body))
+		if err != nil {
+			fmt.Println("ERROR: Could not report panic:", err)
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Sentry-Auth", fmt.Sprintf("Sentry sentry_version=7, sentry_client=whatsmeow-dashboard/1.0, sentry_key=%s", key))
+		resp, err := (&http.Client{Timeout: SENTRY_TIMEOUT}).Do(req)
+		if err != nil {
+			fmt.Println("ERROR: Could not report panic:", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			fmt.Printf("ERROR: Sentry rejected the panic report with status %d\n", resp.StatusCode)
+		}
+	}()
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPanicRecovery(t *testing.T) {
+	reports := make(chan map[string]interface{}, 1)
+	sentry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if auth := r.Header.Get("X-Sentry-Auth"); !strings.Contains(auth, "sentry_key=public") {
+			t.Errorf("Expected the DSN key in X-Sentry-Auth, got %q", auth)
+		}
+		if r.URL.Path != "/api/42/store/" {
+			t.Errorf("Expected the project's store endpoint, got %s", r.URL.Path)
+		}
+		var event map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&event)
+		reports <- event
+	}))
+	defer sentry.Close()
+	t.Setenv("SENTRY_DSN", strings.Replace(sentry.URL, "http://", "http://public@", 1)+"/42")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/boom", func(w http.ResponseWriter, r *http.Request) {
+		var webhooks map[string]Webhook
+		webhooks["x"] = Webhook{} // nil map
+	})
+	mux.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("fine"))
+	})
+	ts := httptest.NewServer(withRecovery(mux))
+	defer ts.Close()
+
+	req, _ := http.NewRequest("GET", ts.URL+"/boom?x=1", nil)
+	req.Header.Set("X-API-Key", "secret-key")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body struct {
+		Error struct{ Code string } `json:"error"`
+	}
+	json.NewDecoder(resp.Body).Decode(&body)
+	resp.Body.Close()
+	if resp.StatusCode != 500 || body.Error.Code != ERR_INTERNAL {
+		t.Fatalf("Expected a 500 JSON error, got %d %+v", resp.StatusCode, body)
+	}
+
+	select {
+	case event := <-reports:
+		exception := event["exception"].(map[string]interface{})["values"].([]interface{})[0].(map[string]interface{})
+		if !strings.Contains(exception["value"].(string), "nil map") {
+			t.Fatalf("Expected the panic value, got %v", exception)
+		}
+		frames := exception["stacktrace"].(map[string]interface{})["frames"].([]interface{})
+		last := frames[len(frames)-1].(map[string]interface{})
+		if last["function"] != appFuncPrefix+"TestPanicRecovery.func2" || last["in_app"] != true {
+			t.Fatalf("Expected the panicking handler as the last frame, got %v", last)
+		}
+		encoded, _ := json.Marshal(event)
+		if strings.Contains(string(encoded), "secret-key") {
+			t.Fatalf("Expected request headers other than the user agent to stay out of the report")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Expected a Sentry report")
+	}
+
+	// The server keeps serving
+	resp, err = http.Get(ts.URL + "/ok")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(data) != "fine" {
+		t.Fatalf("Expected the next request to be served, got %q", data)
+	}
+}
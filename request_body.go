@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// --- Request bodies ---
+// JSON bodies are capped in size and decoded strictly: a misspelled field is an error
+// rather than silently ignored. Errors say what was wrong and where, e.g.
+// `Unknown field "chatjid"` or `Field "priority" must be a number`.
+
+const (
+	DEFAULT_MAX_JSON_BODY_KB   = 1024
+	DEFAULT_MAX_MESSAGE_LENGTH = 65536 // WhatsApp's own limit, in characters
+)
+
+// Routes that take bigger bodies than MAX_JSON_BODY_KB, by path prefix
+var largeJSONBodyRoutes = map[string]int64{
+	"/api/config":    16 << 20, // Whole-account config import
+	"/api/campaigns": 16 << 20, // Recipient lists
+}
+
+// An invalid request body, with the status to answer with
+type bodyError struct {
+	Status  int
+	Message string
+}
+
+func (e *bodyError) Error() string {
+	return e.Message
+}
+
+func maxJSONBodyBytes(path string) int64 {
+	for prefix, limit := range largeJSONBodyRoutes {
+		if strings.HasPrefix(path, prefix) {
+			return limit
+		}
+	}
+	kb, err := strconv.Atoi(os.Getenv("MAX_JSON_BODY_KB"))
+	if err != nil || kb <= 0 {
+		kb = DEFAULT_MAX_JSON_BODY_KB
+	}
+	return int64(kb) << 10
+}
+
+// Longest text message accepted for sending, in characters
+func maxMessageLength() int {
+	n, err := strconv.Atoi(os.Getenv("MAX_MESSAGE_LENGTH"))
+	if err != nil || n <= 0 {
+		return DEFAULT_MAX_MESSAGE_LENGTH
+	}
+	return n
+}
+
+// Decode a request's JSON body into dst, limited to limit bytes. An empty body returns
+// io.EOF, so optional bodies can be told apart from invalid ones.
+func decodeJSONLimited(w http.ResponseWriter, r *http.Request, dst interface{}, limit int64) error {
+	return decodeStrict(http.MaxBytesReader(w, r.Body, limit), dst, limit)
+}
+
+// Decode already read JSON (e.g. part of a body) as strictly as a request body
+func unmarshalStrict(data []byte, dst interface{}) error {
+	return decodeStrict(bytes.NewReader(data), dst, 0)
+}
+
+func decodeStrict(body io.Reader, dst interface{}, limit int64) error {
+	dec := json.NewDecoder(body)
+	dec.DisallowUnknownFields()
+	err := dec.Decode(dst)
+	if err == nil {
+		if dec.More() {
+			return &bodyError{http.StatusBadRequest, "Request body must be a single JSON value"}
+		}
+		return nil
+	}
+
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	var maxErr *http.MaxBytesError
+	switch {
+	case err == io.EOF:
+		return err
+	case errors.As(err, &maxErr):
+		return &bodyError{http.StatusRequestEntityTooLarge, fmt.Sprintf("Request body is larger than %d KB", limit>>10)}
+	case errors.As(err, &syntaxErr):
+		return &bodyError{http.StatusBadRequest, fmt.Sprintf("Invalid JSON at byte %d: %v", syntaxErr.Offset, err)}
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return &bodyError{http.StatusBadRequest, "Invalid JSON: the body ends too early"}
+	case errors.As(err, &typeErr) && typeErr.Field != "":
+		return &bodyError{http.StatusBadRequest, fmt.Sprintf("Field %q must be %s", typeErr.Field, jsonTypeName(typeErr.Type.Kind().String()))}
+	case errors.As(err, &typeErr):
+		return &bodyError{http.StatusBadRequest, fmt.Sprintf("Request body must be %s", jsonTypeName(typeErr.Type.Kind().String()))}
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		return &bodyError{http.StatusBadRequest, "Unknown field " + strings.TrimPrefix(err.Error(), "json: unknown field ")}
+	}
+	return &bodyError{http.StatusBadRequest, "Invalid request body: " + err.Error()}
+}
+
+// Decode a request's JSON body with the route's size limit
+func decodeJSONBody(w http.ResponseWriter, r *http.Request, dst interface{}) error {
+	return decodeJSONLimited(w, r, dst, maxJSONBodyBytes(r.URL.Path))
+}
+
+// Answer with an error from decodeJSONBody; any other error is a 400 with its message
+func writeBodyError(w http.ResponseWriter, err error) {
+	var bodyErr *bodyError
+	switch {
+	case errors.As(err, &bodyErr):
+		apiError(w, bodyErr.Message, bodyErr.Status)
+	case err == io.EOF:
+		apiError(w, "Missing request body", http.StatusBadRequest)
+	default:
+		apiError(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+// How a Go kind reads in an error about JSON
+func jsonTypeName(kind string) string {
+	switch {
+	case strings.HasPrefix(kind, "int"), strings.HasPrefix(kind, "uint"), strings.HasPrefix(kind, "float"):
+		return "a number"
+	case kind == "bool":
+		return "true or false"
+	case kind == "string":
+		return "a string"
+	case kind == "slice", kind == "array":
+		return "an array"
+	case kind == "map", kind == "struct":
+		return "an object"
+	}
+	return "a different type"
+}
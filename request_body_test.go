@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRequestBodyLimits(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+	_, apiKey := registerWithAPIKey(t, ts, "bodies@example.com", "bodiespass123")
+
+	post := func(path, body string) (int, apiErrorBody) {
+		req, _ := http.NewRequest("POST", ts.URL+path, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-API-Key", apiKey)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var out apiErrorBody
+		json.NewDecoder(resp.Body).Decode(&out)
+		return resp.StatusCode, out
+	}
+
+	for _, c := range []struct{ body, message string }{
+		{`{"cold_links": "warn", "coldlinks": "block"}`, `Unknown field "coldlinks"`},
+		{`{"similar_recipients": "20"}`, `Field "similar_recipients" must be a number`},
+		{`["warn"]`, `Request body must be an object`},
+		{`{"cold_links": "warn"`, `Invalid JSON: the body ends too early`},
+		{`{"cold_links": "warn"} {}`, `Request body must be a single JSON value`},
+		{``, `Missing request body`},
+	} {
+		status, out := post("/api/send-risk", c.body)
+		if status != http.StatusBadRequest || out.Error.Message != c.message {
+			t.Fatalf("%s: expected 400 %q, got %d %q", c.body, c.message, status, out.Error.Message)
+		}
+	}
+
+	t.Setenv("MAX_JSON_BODY_KB", "1")
+	status, out := post("/api/send-risk", `{"cold_links": "`+strings.Repeat("x", 2048)+`"}`)
+	if status != http.StatusRequestEntityTooLarge || out.Error.Code != ERR_PAYLOAD_TOO_LARGE {
+		t.Fatalf("Expected 413 for a body over the limit, got %d %+v", status, out)
+	}
+
+	t.Setenv("MAX_MESSAGE_LENGTH", "10")
+	status, out = post("/api/messages/send", `{"chat_jid": "14155550000@s.whatsapp.net", "message": "this is too long"}`)
+	if status != http.StatusBadRequest || out.Error.Message != "Message is 16 characters; the maximum is 10" {
+		t.Fatalf("Expected the message length to be checked, got %d %+v", status, out)
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Retention ---
+// Each category of stored data has its own retention window, set with an env var
+// (e.g. RETENTION_MESSAGES=90d, RETENTION_WEBHOOK_LOGS=7d). A background janitor
+// purges what is older every RETENTION_INTERVAL and keeps counts of what it removed.
+// A window of 0 keeps that category forever.
+
+const (
+	RETENTION_MESSAGES     = "messages"     // Message archive, extracted document texts and sent messages
+	RETENTION_WEBHOOK_LOGS = "webhook_logs" // Webhook log entries and stored full payloads
+	RETENTION_MEDIA        = "media"        // Received and uploaded media files
+	RETENTION_AUDIT_LOGS   = "audit_logs"   // Account audit log (see audit.go)
+	RETENTION_INTERVAL     = time.Hour
+)
+
+var retentionWindows = map[string]time.Duration{
+	RETENTION_MESSAGES:     0,
+	RETENTION_WEBHOOK_LOGS: 7 * 24 * time.Hour,
+	RETENTION_MEDIA:        24 * time.Hour,
+	RETENTION_AUDIT_LOGS:   0,
+}
+
+var retentionStats = struct {
+	sync.Mutex
+	lastRun    time.Time
+	lastPurged map[string]int64 // By category, in the last run
+	purged     map[string]int64 // By category, since the server started
+}{purged: make(map[string]int64)}
+
+// Parse a retention window: a Go duration ("36h") or a number of days ("90d")
+func parseRetention(value string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid number of days %q", days)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid duration %q", value)
+	}
+	return d, nil
+}
+
+// Read the RETENTION_* env vars; invalid values keep the default
+func initRetention() {
+	for category := range retentionWindows {
+		env := "RETENTION_" + strings.ToUpper(category)
+		value := os.Getenv(env)
+		if value == "" {
+			continue
+		}
+		d, err := parseRetention(value)
+		if err != nil {
+			fmt.Printf("WARNING: Ignoring %s=%q, expected a duration like 90d or 36h\n", env, value)
+			continue
+		}
+		retentionWindows[category] = d
+	}
+}
+
+// Oldest time still kept for a category (the zero time if it is kept forever)
+func retentionCutoff(category string, now time.Time) time.Time {
+	window := retentionWindows[category]
+	if window <= 0 {
+		return time.Time{}
+	}
+	return now.Add(-window)
+}
+
+// Run the janitor every RETENTION_INTERVAL
+func startRetentionJanitor(mediaDir string) {
+	runEvery(RETENTION_INTERVAL, func(now time.Time) {
+		runRetention(mediaDir, now)
+	})
+}
+
+// Purge everything past its category's window; returns the rows and files removed by category
+func runRetention(mediaDir string, now time.Time) map[string]int64 {
+	purged := map[string]int64{}
+	if cutoff := retentionCutoff(RETENTION_MESSAGES, now); !cutoff.IsZero() {
+		at := cutoff.UTC().Format(time.RFC3339)
+		for _, q := range []string{`DELETE FROM messages WHERE timestamp < ?`, `DELETE FROM document_texts WHERE created_at < ?`, `DELETE FROM sent_messages WHERE server_timestamp < ?`} {
+			purged[RETENTION_MESSAGES] += execPurge(q, at)
+		}
+	}
+	if cutoff := retentionCutoff(RETENTION_WEBHOOK_LOGS, now); !cutoff.IsZero() {
+		purged[RETENTION_WEBHOOK_LOGS] += execPurge(`DELETE FROM webhook_payloads WHERE created_at < ?`, cutoff.Unix())
+		purged[RETENTION_WEBHOOK_LOGS] += int64(pruneWebhookLogs(cutoff))
+	}
+	if cutoff := retentionCutoff(RETENTION_MEDIA, now); !cutoff.IsZero() {
+		purged[RETENTION_MEDIA] += releaseExpiredChatMedia(cutoff)
+		purged[RETENTION_MEDIA] += purgeMediaFiles(mediaDir, cutoff)
+	}
+	purged[RETENTION_MEDIA] += purgeExpiredUploads(now)
+	if cutoff := retentionCutoff(RETENTION_AUDIT_LOGS, now); !cutoff.IsZero() {
+		purged[RETENTION_AUDIT_LOGS] += execPurge(`DELETE FROM audit_logs WHERE created_at < ?`, cutoff.UTC().Format(time.RFC3339))
+	}
+
+	retentionStats.Lock()
+	retentionStats.lastRun = now
+	retentionStats.lastPurged = purged
+	for category, n := range purged {
+		retentionStats.purged[category] += n
+	}
+	retentionStats.Unlock()
+	for category, n := range purged {
+		if n > 0 {
+			fmt.Printf("INFO: Retention purged %d %s\n", n, category)
+		}
+	}
+	return purged
+}
+
+func execPurge(query string, cutoff interface{}) int64 {
+	res, err := db.Exec(query, cutoff)
+	if err != nil {
+		fmt.Printf("ERROR: Retention purge failed (%s): %v\n", query, err)
+		return 0
+	}
+	n, _ := res.RowsAffected()
+	return n
+}
+
+// Drop in-memory webhook log entries older than cutoff; returns how many
+func pruneWebhookLogs(cutoff time.Time) int {
+	webhookLogs.mu.Lock()
+	defer webhookLogs.mu.Unlock()
+	removed := 0
+	for id, entries := range webhookLogs.logs {
+		kept := entries[:0]
+		for _, e := range entries {
+			if e.Timestamp.Before(cutoff) {
+				removed++
+				continue
+			}
+			kept = append(kept, e)
+		}
+		if len(kept) == 0 {
+			delete(webhookLogs.logs, id)
+		} else {
+			webhookLogs.logs[id] = kept
+		}
+	}
+	return removed
+}
+
+// Drop the references of received media indexed before cutoff; a file is deleted with
+// its last reference. Returns how many files were deleted.
+func releaseExpiredChatMedia(cutoff time.Time) int64 {
+	at := cutoff.UTC().Format(time.RFC3339)
+	paths, err := queryStrings(db, `DELETE FROM chat_media WHERE timestamp < ? RETURNING file_path`, at)
+	if err != nil {
+		fmt.Println("ERROR: Could not purge expired chat media", err)
+		return 0
+	}
+	var removed int64
+	for _, path := range paths {
+		if releaseMediaFile(path) {
+			removed++
+		}
+	}
+	return removed
+}
+
+// Delete unreferenced media files last stored (or reused) before cutoff; returns how many.
+// Files still referenced by a message are released by releaseExpiredChatMedia instead, and
+// uploads (which expire through media_uploads.expires_at) and quarantined files are skipped.
+func purgeMediaFiles(mediaDir string, cutoff time.Time) int64 {
+	var removed int64
+	filepath.Walk(mediaDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() {
+			if path != mediaDir && (info.Name() == MEDIA_UPLOADS_SUBDIR || info.Name() == QUARANTINE_SUBDIR) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.ModTime().Before(cutoff) {
+			return nil
+		}
+		if _, _, err := dbGetMediaFileInfo(filepath.Base(path)); err == nil {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			fmt.Printf("ERROR: Could not delete expired media file %s: %v\n", path, err)
+			return nil
+		}
+		removed++
+		return nil
+	})
+	return removed
+}
+
+// Delete media uploads past their expires_at: upload URLs that were never used, and
+// uploaded files past the media retention window. Returns how many uploads were removed.
+func purgeExpiredUploads(now time.Time) int64 {
+	paths, err := queryStrings(db, `DELETE FROM media_uploads WHERE expires_at < ? RETURNING file_path`, now.UTC().Format(time.RFC3339))
+	if err != nil {
+		fmt.Println("ERROR: Could not purge expired media uploads", err)
+		return 0
+	}
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			fmt.Printf("ERROR: Could not delete expired upload %s: %v\n", path, err)
+		}
+	}
+	return int64(len(paths))
+}
+
+// GET /api/admin/retention
+// The retention window of each category and what the janitor has purged.
+func handleRetention(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	windows := map[string]interface{}{}
+	for category, d := range retentionWindows {
+		windows[category] = map[string]interface{}{
+			"seconds": int64(d.Seconds()),
+			"forever": d <= 0,
+		}
+	}
+	retentionStats.Lock()
+	response := map[string]interface{}{
+		"windows":      windows,
+		"purged_total": copyCounts(retentionStats.purged),
+		"last_purged":  copyCounts(retentionStats.lastPurged),
+	}
+	if !retentionStats.lastRun.IsZero() {
+		response["last_run"] = retentionStats.lastRun.UTC().Format(time.RFC3339)
+	}
+	retentionStats.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func copyCounts(counts map[string]int64) map[string]int64 {
+	out := make(map[string]int64, len(counts))
+	for k, v := range counts {
+		out[k] = v
+	}
+	return out
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseRetention(t *testing.T) {
+	for value, want := range map[string]time.Duration{"90d": 90 * 24 * time.Hour, "36h": 36 * time.Hour, "0": 0, "0d": 0} {
+		if d, err := parseRetention(value); err != nil || d != want {
+			t.Fatalf("parseRetention(%q) = %v, %v; want %v", value, d, err, want)
+		}
+	}
+	for _, value := range []string{"", "soon", "-1d", "-5h", "1.5d"} {
+		if _, err := parseRetention(value); err == nil {
+			t.Fatalf("Expected an error for %q", value)
+		}
+	}
+}
+
+func TestRetentionJanitor(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+
+	saved := map[string]time.Duration{}
+	for k, v := range retentionWindows {
+		saved[k] = v
+	}
+	defer func() {
+		for k, v := range saved {
+			retentionWindows[k] = v
+		}
+	}()
+	retentionWindows[RETENTION_MESSAGES] = 90 * 24 * time.Hour
+	retentionWindows[RETENTION_WEBHOOK_LOGS] = 7 * 24 * time.Hour
+	retentionWindows[RETENTION_MEDIA] = 0
+
+	registerWithAPIKey(t, ts, "retention@example.com", "retentionpass123")
+	userID, _ := getUserIDByEmail("retention@example.com")
+	now := time.Now()
+	chat := "14155550003@s.whatsapp.net"
+	archiveMessage(userID, chat, map[string]interface{}{"id": "OLD", "text": "old", "timestamp": now.Add(-100 * 24 * time.Hour).Unix()}, "")
+	archiveMessage(userID, chat, map[string]interface{}{"id": "NEW", "text": "new", "timestamp": now.Add(-time.Hour).Unix()}, "")
+	db.Exec(`INSERT INTO webhook_payloads (id, user_id, webhook_id, payload, created_at) VALUES ('p1', ?, 'w', '{}', ?)`, userID, now.Add(-8*24*time.Hour).Unix())
+
+	webhookLogs.mu.Lock()
+	webhookLogs.logs["retention-hook"] = []WebhookLogEntry{{Timestamp: now.Add(-10 * 24 * time.Hour)}, {Timestamp: now}}
+	webhookLogs.mu.Unlock()
+	defer func() {
+		webhookLogs.mu.Lock()
+		delete(webhookLogs.logs, "retention-hook")
+		webhookLogs.mu.Unlock()
+	}()
+
+	media := filepath.Join("test_media", "old.jpg")
+	os.WriteFile(media, []byte("x"), 0644)
+	old := now.Add(-30 * 24 * time.Hour)
+	os.Chtimes(media, old, old)
+
+	purged := runRetention("test_media", now)
+	if purged[RETENTION_MESSAGES] != 1 || purged[RETENTION_WEBHOOK_LOGS] != 2 {
+		t.Fatalf("Unexpected purge counts: %v", purged)
+	}
+	var left []string
+	rows, _ := db.Query(`SELECT message_id FROM messages WHERE user_id = ?`, userID)
+	for rows.Next() {
+		var id string
+		rows.Scan(&id)
+		left = append(left, id)
+	}
+	rows.Close()
+	if len(left) != 1 || left[0] != "NEW" {
+		t.Fatalf("Expected only the recent message to be kept, got %v", left)
+	}
+	if logs := getWebhookLogs("retention-hook"); len(logs) != 1 {
+		t.Fatalf("Expected 1 webhook log entry left, got %d", len(logs))
+	}
+	if _, err := os.Stat(media); err != nil {
+		t.Fatal("Media should be kept forever with a 0 window")
+	}
+
+	retentionStats.Lock()
+	total := retentionStats.purged[RETENTION_MESSAGES]
+	retentionStats.Unlock()
+	if total < 1 {
+		t.Fatalf("Expected purge metrics to be recorded, got %d", total)
+	}
+}
+
+func TestRetentionMediaFiles(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+
+	saved := retentionWindows[RETENTION_MEDIA]
+	defer func() { retentionWindows[RETENTION_MEDIA] = saved }()
+	retentionWindows[RETENTION_MEDIA] = 24 * time.Hour
+
+	registerWithAPIKey(t, ts, "retention-media@example.com", "retentionpass123")
+	userID, _ := getUserIDByEmail("retention-media@example.com")
+	now := time.Now()
+	old := now.Add(-30 * 24 * time.Hour)
+	chat := "14155550004@s.whatsapp.net"
+	write := func(name string) string {
+		p := filepath.Join("test_media", name)
+		os.MkdirAll(filepath.Dir(p), 0755)
+		os.WriteFile(p, []byte(name), 0644)
+		os.Chtimes(p, old, old)
+		return p
+	}
+
+	orphan := write("orphan.jpg")
+	// Referenced by an old and a recent message: only the old reference expires
+	shared := write("shared.jpg")
+	dbSaveMediaFileInfo(userID, "shared.jpg", "image/jpeg", "", "hash-shared")
+	dbAddMediaFileRef("shared.jpg")
+	dbRecordChatMedia(userID, chat, "OLD", "image", shared, old)
+	dbRecordChatMedia(userID, chat, "NEW", "image", shared, now)
+	expired := write("expired.jpg")
+	dbSaveMediaFileInfo(userID, "expired.jpg", "image/jpeg", "", "hash-expired")
+	dbRecordChatMedia(userID, chat, "GONE", "image", expired, old)
+	quarantined := write(filepath.Join(QUARANTINE_SUBDIR, "infected.pdf"))
+	// Uploads expire through expires_at, whatever the file's age
+	keptUpload := write(filepath.Join(MEDIA_UPLOADS_SUBDIR, "med_kept"))
+	expiredUpload := write(filepath.Join(MEDIA_UPLOADS_SUBDIR, "med_expired"))
+	for id, upload := range map[string]struct {
+		path      string
+		expiresAt time.Time
+	}{"med_kept": {keptUpload, now.Add(time.Hour)}, "med_expired": {expiredUpload, now.Add(-time.Hour)}} {
+		db.Exec(`INSERT INTO media_uploads (id, user_id, status, file_path, expires_at) VALUES (?, ?, ?, ?, ?)`,
+			id, userID, MEDIA_UPLOAD_COMPLETED, upload.path, upload.expiresAt.UTC().Format(time.RFC3339))
+	}
+
+	purged := runRetention("test_media", now)
+	if purged[RETENTION_MEDIA] != 3 {
+		t.Fatalf("Expected 3 media purged, got %v", purged)
+	}
+	for _, p := range []string{orphan, expired, expiredUpload} {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Fatalf("%s should be deleted", p)
+		}
+	}
+	for _, p := range []string{shared, quarantined, keptUpload} {
+		if _, err := os.Stat(p); err != nil {
+			t.Fatalf("%s should be kept: %v", p, err)
+		}
+	}
+	var refcount int
+	db.QueryRow(`SELECT refcount FROM media_files WHERE name = 'shared.jpg'`).Scan(&refcount)
+	if refcount != 1 {
+		t.Fatalf("Expected 1 reference left to the shared file, got %d", refcount)
+	}
+	var uploads int
+	db.QueryRow(`SELECT COUNT(*) FROM media_uploads WHERE user_id = ?`, userID).Scan(&uploads)
+	if uploads != 1 {
+		t.Fatalf("Expected only the unexpired upload left, got %d", uploads)
+	}
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Secret values are stored encrypted with AES-256-GCM. The key is SECRETS_KEY (64 hex
+// characters) or, without it, a key generated once into <DB_PATH>.key; keep that file
+// out of database backups. Values stored before encryption are encrypted at startup.
+const SECRET_VALUE_PREFIX = "enc:v1:"
+
+var secretsAEAD cipher.AEAD
+
+// Secret names are referenced from webhook URLs/headers as {{secret.NAME}}
+var secretNameRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]{0,63}$`)
+var secretTemplateRegex = regexp.MustCompile(`\{\{\s*secret\.([A-Za-z_][A-Za-z0-9_]*)\s*\}\}`)
+
+// Secret metadata returned by the API (values are never returned)
+type SecretInfo struct {
+	Name      string    `json:"name"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Load (or create) the key secret values are encrypted with, and encrypt any stored
+// before encryption was added
+func initSecretsKey(dbPath string) error {
+	var key []byte
+	if value := os.Getenv("SECRETS_KEY"); value != "" {
+		k, err := hex.DecodeString(value)
+		if err != nil || len(k) != 32 {
+			return errors.New("SECRETS_KEY must be 64 hex characters (32 bytes)")
+		}
+		key = k
+	} else {
+		keyPath := dbPath + ".key"
+		data, err := os.ReadFile(keyPath)
+		if os.IsNotExist(err) {
+			data = make([]byte, 32)
+			rand.Read(data)
+			if err := os.WriteFile(keyPath, []byte(hex.EncodeToString(data)), 0600); err != nil {
+				return err
+			}
+			fmt.Printf("INFO: Generated the secrets key %s\n", keyPath)
+		} else if err != nil {
+			return err
+		} else if data, err = hex.DecodeString(strings.TrimSpace(string(data))); err != nil || len(data) != 32 {
+			return fmt.Errorf("%s does not hold a 32-byte hex key", keyPath)
+		}
+		key = data
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	if secretsAEAD, err = cipher.NewGCM(block); err != nil {
+		return err
+	}
+	return encryptPlaintextSecrets()
+}
+
+func encryptSecretValue(value string) (string, error) {
+	nonce := make([]byte, secretsAEAD.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := secretsAEAD.Seal(nonce, nonce, []byte(value), nil)
+	return SECRET_VALUE_PREFIX + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func decryptSecretValue(stored string) (string, error) {
+	if !strings.HasPrefix(stored, SECRET_VALUE_PREFIX) {
+		return stored, nil // Not encrypted yet
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(stored, SECRET_VALUE_PREFIX))
+	if err != nil || len(sealed) < secretsAEAD.NonceSize() {
+		return "", errors.New("malformed secret value")
+	}
+	n := secretsAEAD.NonceSize()
+	value, err := secretsAEAD.Open(nil, sealed[:n], sealed[n:], nil)
+	if err != nil {
+		return "", errors.New("secret value does not decrypt with this SECRETS_KEY")
+	}
+	return string(value), nil
+}
+
+// Encrypt secret values stored in plaintext
+func encryptPlaintextSecrets() error {
+	rows, err := db.Query(`SELECT user_id, name, value FROM secrets WHERE value NOT LIKE ?`, SECRET_VALUE_PREFIX+"%")
+	if err != nil {
+		return err
+	}
+	type plainSecret struct {
+		userID      int64
+		name, value string
+	}
+	var plain []plainSecret
+	for rows.Next() {
+		var s plainSecret
+		if err := rows.Scan(&s.userID, &s.name, &s.value); err != nil {
+			rows.Close()
+			return err
+		}
+		plain = append(plain, s)
+	}
+	rows.Close()
+	for _, s := range plain {
+		encrypted, err := encryptSecretValue(s.value)
+		if err != nil {
+			return err
+		}
+		if _, err := db.Exec(`UPDATE secrets SET value = ? WHERE user_id = ? AND name = ?`, encrypted, s.userID, s.name); err != nil {
+			return err
+		}
+	}
+	if len(plain) > 0 {
+		fmt.Printf("INFO: Encrypted %d stored secrets\n", len(plain))
+	}
+	return nil
+}
+
+// Create or update a secret for a user
+func dbSetSecret(userID int64, name, value string) error {
+	encrypted, err := encryptSecretValue(value)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`INSERT INTO secrets (user_id, name, value, updated_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT(user_id, name) DO UPDATE SET value = excluded.value, updated_at = excluded.updated_at`,
+		userID, name, encrypted, time.Now().UTC().Format(time.RFC3339))
+	return err
+}
+
+// Delete a secret; returns false if it didn't exist
+func dbDeleteSecret(userID int64, name string) (bool, error) {
+	res, err := db.Exec(`DELETE FROM secrets WHERE user_id = ? AND name = ?`, userID, name)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// List secret names for a user
+func dbListSecrets(userID int64) ([]SecretInfo, error) {
+	rows, err := db.Query(`SELECT name, updated_at FROM secrets WHERE user_id = ? ORDER BY name`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	secrets := []SecretInfo{}
+	for rows.Next() {
+		var s SecretInfo
+		var updatedAt string
+		if err := rows.Scan(&s.Name, &updatedAt); err != nil {
+			return nil, err
+		}
+		s.UpdatedAt, _ = time.Parse(time.RFC3339, updatedAt)
+		secrets = append(secrets, s)
+	}
+	return secrets, rows.Err()
+}
+
+// Load all secret values for a user as name -> value
+func dbGetSecretValues(userID int64) (map[string]string, error) {
+	rows, err := preparedQuery(readDB, `SELECT name, value FROM secrets WHERE user_id = ?`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	values := make(map[string]string)
+	for rows.Next() {
+		var name, stored string
+		if err := rows.Scan(&name, &stored); err != nil {
+			return nil, err
+		}
+		value, err := decryptSecretValue(stored)
+		if err != nil {
+			return nil, fmt.Errorf("secret %s: %w", name, err)
+		}
+		values[name] = value
+	}
+	return values, rows.Err()
+}
+
+// Replace {{secret.NAME}} references in s. Fails if a referenced secret doesn't exist.
+func renderSecretTemplate(s string, secrets map[string]string) (string, error) {
+	var missing string
+	rendered := secretTemplateRegex.ReplaceAllStringFunc(s, func(match string) string {
+		name := secretTemplateRegex.FindStringSubmatch(match)[1]
+		value, ok := secrets[name]
+		if !ok {
+			missing = name
+		}
+		return value
+	})
+	if missing != "" {
+		return "", fmt.Errorf("unknown secret %q", missing)
+	}
+	return rendered, nil
+}
+
+// Resolve secret references in a webhook's URLs and headers
+func resolveWebhookSecrets(wh Webhook, secrets map[string]string) (Webhook, error) {
+	resolved := wh
+	var err error
+	resolved.URL, err = renderSecretTemplate(wh.URL, secrets)
+	if err != nil {
+		return wh, err
+	}
+	if len(wh.URLs) > 0 {
+		resolved.URLs = make([]string, len(wh.URLs))
+		for i, u := range wh.URLs {
+			resolved.URLs[i], err = renderSecretTemplate(u, secrets)
+			if err != nil {
+				return wh, err
+			}
+		}
+	}
+	if len(wh.Headers) > 0 {
+		resolved.Headers = make(map[string]string, len(wh.Headers))
+		for k, v := range wh.Headers {
+			resolved.Headers[k], err = renderSecretTemplate(v, secrets)
+			if err != nil {
+				return wh, err
+			}
+		}
+	}
+	return resolved, nil
+}
+
+// GET/POST /api/secrets
+// GET lists secret names; POST {"name": "...", "value": "..."} creates or rotates a secret.
+func handleSecrets(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(int64)
+
+	if r.Method == "POST" {
+		var req struct {
+			Name  string `json:"name"`
+			Value string `json:"value"`
+		}
+		if err := decodeJSONBody(w, r, &req); err != nil {
+			writeBodyError(w, err)
+			return
+		}
+		if req.Value == "" {
+			apiError(w, "Missing value", http.StatusBadRequest)
+			return
+		}
+		if !secretNameRegex.MatchString(req.Name) {
+			apiError(w, "Invalid secret name", http.StatusBadRequest)
+			return
+		}
+		if err := dbSetSecret(userID, req.Name, req.Value); err != nil {
+			fmt.Println("ERROR: Could not save secret", err)
+			apiError(w, "Failed to save secret", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "name": req.Name})
+		return
+	} else if r.Method != "GET" {
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	secrets, err := dbListSecrets(userID)
+	if err != nil {
+		fmt.Println("ERROR: Could not list secrets", err)
+		apiError(w, "Failed to load secrets", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(secrets)
+}
+
+// POST /api/secrets/delete
+func handleDeleteSecret(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID := r.Context().Value("userID").(int64)
+
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	if req.Name == "" {
+		apiError(w, "Missing name", http.StatusBadRequest)
+		return
+	}
+	deleted, err := dbDeleteSecret(userID, req.Name)
+	if err != nil {
+		fmt.Println("ERROR: Could not delete secret", err)
+		apiError(w, "Failed to delete secret", http.StatusInternalServerError)
+		return
+	}
+	if !deleted {
+		apiError(w, "Secret not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"success":true}`))
+}
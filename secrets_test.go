@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRenderSecretTemplate(t *testing.T) {
+	secrets := map[string]string{"CRM_TOKEN": "abc123"}
+
+	got, err := renderSecretTemplate("Bearer {{secret.CRM_TOKEN}}", secrets)
+	if err != nil || got != "Bearer abc123" {
+		t.Fatalf("Unexpected render result: %q, %v", got, err)
+	}
+	got, err = renderSecretTemplate("https://x.example.com/?t={{ secret.CRM_TOKEN }}", secrets)
+	if err != nil || got != "https://x.example.com/?t=abc123" {
+		t.Fatalf("Unexpected render result: %q, %v", got, err)
+	}
+	if _, err := renderSecretTemplate("{{secret.MISSING}}", secrets); err == nil {
+		t.Fatalf("Expected error for unknown secret")
+	}
+}
+
+func TestSecretsInWebhookHeaders(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+
+	// Mock receiver records the Authorization header and query string
+	type hit struct{ auth, token string }
+	received := make(chan hit, 1)
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- hit{r.Header.Get("Authorization"), r.URL.Query().Get("token")}
+	}))
+	defer mockServer.Close()
+
+	_, apiKey := registerWithAPIKey(t, ts, "secretuser@example.com", "secretpass123")
+
+	// Store a secret and check the value is never listed
+	resp := apiRequest(t, "POST", ts.URL+"/api/secrets", apiKey, map[string]string{"name": "CRM_TOKEN", "value": "s3cr3t"}, nil)
+	if resp.StatusCode != 200 {
+		t.Fatalf("Create secret failed, status: %d", resp.StatusCode)
+	}
+	var listed []map[string]interface{}
+	apiRequest(t, "GET", ts.URL+"/api/secrets", apiKey, nil, &listed)
+	if len(listed) != 1 || listed[0]["name"] != "CRM_TOKEN" || listed[0]["value"] != nil {
+		t.Fatalf("Unexpected secrets listing: %v", listed)
+	}
+	var stored string
+	db.QueryRow(`SELECT value FROM secrets WHERE name = 'CRM_TOKEN'`).Scan(&stored)
+	if !strings.HasPrefix(stored, SECRET_VALUE_PREFIX) || strings.Contains(stored, "s3cr3t") {
+		t.Fatalf("Expected the secret to be stored encrypted, got %q", stored)
+	}
+
+	resp = apiRequest(t, "POST", ts.URL+"/api/webhooks/create", apiKey, map[string]interface{}{
+		"url":     mockServer.URL + "/?token={{secret.CRM_TOKEN}}",
+		"method":  "POST",
+		"headers": map[string]string{"Authorization": "Bearer {{secret.CRM_TOKEN}}"},
+	}, nil)
+	if resp.StatusCode != 200 {
+		t.Fatalf("Create webhook failed, status: %d", resp.StatusCode)
+	}
+
+	forwardToWebhooks("secretuser@example.com", map[string]interface{}{"from": "1@s.whatsapp.net", "text": "hi"}, "", "test_media")
+
+	select {
+	case got := <-received:
+		if got.auth != "Bearer s3cr3t" || got.token != "s3cr3t" {
+			t.Fatalf("Secrets not resolved: %+v", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for webhook")
+	}
+
+	// Deleting the secret works once
+	resp = apiRequest(t, "POST", ts.URL+"/api/secrets/delete", apiKey, map[string]string{"name": "CRM_TOKEN"}, nil)
+	if resp.StatusCode != 200 {
+		t.Fatalf("Delete secret failed, status: %d", resp.StatusCode)
+	}
+	resp = apiRequest(t, "POST", ts.URL+"/api/secrets/delete", apiKey, map[string]string{"name": "CRM_TOKEN"}, nil)
+	if resp.StatusCode != 404 {
+		t.Fatalf("Expected 404 deleting missing secret, got %d", resp.StatusCode)
+	}
+}
+
+func TestPlaintextSecretsAreEncrypted(t *testing.T) {
+	_, teardown := setupTestServer()
+	defer teardown()
+
+	db.Exec(`INSERT INTO users (id, email, password_hash) VALUES (7, 'legacy@example.com', 'x')`)
+	db.Exec(`INSERT INTO secrets (user_id, name, value) VALUES (7, 'OLD_TOKEN', 'plain-value')`)
+	if err := encryptPlaintextSecrets(); err != nil {
+		t.Fatal(err)
+	}
+	var stored string
+	db.QueryRow(`SELECT value FROM secrets WHERE name = 'OLD_TOKEN'`).Scan(&stored)
+	if !strings.HasPrefix(stored, SECRET_VALUE_PREFIX) {
+		t.Fatalf("Expected the plaintext secret to be encrypted, got %q", stored)
+	}
+	if values, err := dbGetSecretValues(7); err != nil || values["OLD_TOKEN"] != "plain-value" {
+		t.Fatalf("Expected the secret to decrypt, got %v (%v)", values, err)
+	}
+
+	// A key that doesn't match the stored values is reported, not used to send garbage
+	t.Setenv("SECRETS_KEY", strings.Repeat("ab", 32))
+	if err := initSecretsKey("test_whatsmeow.db"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dbGetSecretValues(7); err == nil {
+		t.Fatal("Expected an error decrypting with another key")
+	}
+}
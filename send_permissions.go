@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+// --- Chat-level send permissions ---
+// The API key and each webhook's /webhook/{id} receiver can be limited to a list of
+// chat JIDs, so a leaked key or automation URL can only message the intended chats.
+// An empty list allows every chat.
+
+const MAX_ALLOWED_CHATS = 100
+
+// Validate and normalize a list of chat JIDs or phone numbers, dropping duplicates
+func normalizeAllowedChats(chats []string) ([]string, error) {
+	if len(chats) > MAX_ALLOWED_CHATS {
+		return nil, fmt.Errorf("Too many allowed_chats (max %d)", MAX_ALLOWED_CHATS)
+	}
+	seen := map[string]bool{}
+	normalized := []string{}
+	for _, c := range chats {
+		jid, err := normalizeChatJID(c)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid chat JID in allowed_chats: %q", c)
+		}
+		if s := jid.String(); !seen[s] {
+			seen[s] = true
+			normalized = append(normalized, s)
+		}
+	}
+	return normalized, nil
+}
+
+// Whether a send to chatJID is permitted by the allowed list
+func chatAllowed(allowed []string, chatJID types.JID) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	target := chatJID.String()
+	for _, c := range allowed {
+		if c == target {
+			return true
+		}
+	}
+	return false
+}
+
+// Encode an allowed chats list for storage ("" when unrestricted)
+func encodeAllowedChats(chats []string) (string, error) {
+	if len(chats) == 0 {
+		return "", nil
+	}
+	data, err := json.Marshal(chats)
+	return string(data), err
+}
+
+func decodeAllowedChats(value string) []string {
+	var chats []string
+	if value != "" {
+		json.Unmarshal([]byte(value), &chats)
+	}
+	return chats
+}
+
+// Limit chats a webhook's receiver may send to by the API key's own allowed chats, so a
+// restricted key can't set up a receiver that sends anywhere else: the lists are
+// intersected, and a webhook without a list gets the key's. Returns a *bodyError.
+func limitToAPIKeyChats(userID int64, chats []string) ([]string, error) {
+	keyChats, err := dbGetAPIKeyAllowedChats(userID)
+	if err != nil {
+		fmt.Println("ERROR: Could not load API key allowed chats", err)
+		return nil, &bodyError{Status: http.StatusInternalServerError, Message: "Failed to load API key restrictions"}
+	}
+	if len(keyChats) == 0 {
+		return chats, nil
+	}
+	if len(chats) == 0 {
+		return keyChats, nil
+	}
+	limited := []string{}
+	for _, c := range chats {
+		if jid, err := types.ParseJID(c); err == nil && chatAllowed(keyChats, jid) {
+			limited = append(limited, c)
+		}
+	}
+	if len(limited) == 0 {
+		return nil, &bodyError{Status: http.StatusForbidden, Message: "None of allowed_chats is allowed for this API key"}
+	}
+	return limited, nil
+}
+
+// Replace a webhook's allowed chats; returns false if the webhook doesn't exist
+func dbSetWebhookAllowedChats(userID int64, webhookID string, chats []string) (bool, error) {
+	defer invalidateWebhooksCache(userID)
+	value, err := encodeAllowedChats(chats)
+	if err != nil {
+		return false, err
+	}
+	res, err := db.Exec(`UPDATE webhooks SET allowed_chats = ? WHERE user_id = ? AND id = ?`, value, userID, webhookID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func dbGetAPIKeyAllowedChats(userID int64) ([]string, error) {
+	var value string
+	err := db.QueryRow(`SELECT api_key_allowed_chats FROM users WHERE id = ?`, userID).Scan(&value)
+	if err != nil {
+		return nil, err
+	}
+	return decodeAllowedChats(value), nil
+}
+
+func dbSetAPIKeyAllowedChats(userID int64, chats []string) error {
+	value, err := encodeAllowedChats(chats)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`UPDATE users SET api_key_allowed_chats = ? WHERE id = ?`, value, userID)
+	return err
+}
+
+// Decode {"allowed_chats": [...]} from a request body
+func decodeAllowedChatsRequest(w http.ResponseWriter, r *http.Request) ([]string, error) {
+	var req struct {
+		AllowedChats []string `json:"allowed_chats"`
+	}
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		return nil, err
+	}
+	return normalizeAllowedChats(req.AllowedChats)
+}
+
+// POST /api/webhooks/{id}/allowed-chats
+// Replaces the chats the webhook's receiver may send to; an empty list removes the restriction.
+func handleSetWebhookAllowedChats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := r.Context().Value("userID").(int64)
+	webhookID := r.PathValue("id")
+
+	chats, err := decodeAllowedChatsRequest(w, r)
+	if err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	if chats, err = limitToAPIKeyChats(userID, chats); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+
+	updated, err := dbSetWebhookAllowedChats(userID, webhookID, chats)
+	if err != nil {
+		fmt.Println("ERROR: Could not update webhook allowed chats", err)
+		apiError(w, "Failed to update allowed chats", http.StatusInternalServerError)
+		return
+	}
+	if !updated {
+		apiError(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":       true,
+		"id":            webhookID,
+		"allowed_chats": chats,
+	})
+}
+
+// GET/POST /api/user/api-key/allowed-chats
+// Session-authenticated, so a leaked API key cannot lift its own restriction.
+func handleAPIKeyAllowedChats(sessionCookieName string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isAuthenticated(r, sessionCookieName) {
+			apiError(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		userID, err := getUserIDByEmail(getUserEmail(r, sessionCookieName))
+		if err != nil {
+			apiError(w, "Failed to get user ID", http.StatusInternalServerError)
+			return
+		}
+
+		var chats []string
+		switch r.Method {
+		case "GET":
+			chats, err = dbGetAPIKeyAllowedChats(userID)
+			if err != nil {
+				apiError(w, "Failed to load allowed chats", http.StatusInternalServerError)
+				return
+			}
+		case "POST":
+			chats, err = decodeAllowedChatsRequest(w, r)
+			if err != nil {
+				writeBodyError(w, err)
+				return
+			}
+			if err := dbSetAPIKeyAllowedChats(userID, chats); err != nil {
+				fmt.Println("ERROR: Could not update API key allowed chats", err)
+				apiError(w, "Failed to update allowed chats", http.StatusInternalServerError)
+				return
+			}
+			fmt.Printf("INFO: API key of user %d limited to %d chats\n", userID, len(chats))
+		default:
+			apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if chats == nil {
+			chats = []string{}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"allowed_chats": chats})
+	}
+}
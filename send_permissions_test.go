@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestNormalizeAllowedChats(t *testing.T) {
+	chats, err := normalizeAllowedChats([]string{" 123@s.whatsapp.net", "123@s.whatsapp.net", "456-789@g.us"})
+	if err != nil || len(chats) != 2 || chats[0] != "123@s.whatsapp.net" || chats[1] != "456-789@g.us" {
+		t.Fatalf("Unexpected normalized chats: %v %v", chats, err)
+	}
+	for _, bad := range []string{"", "@s.whatsapp.net"} {
+		if _, err := normalizeAllowedChats([]string{bad}); err == nil {
+			t.Fatalf("Expected error for %q", bad)
+		}
+	}
+}
+
+func TestChatSendPermissions(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+
+	email := "permuser@example.com"
+	cookies, apiKey := registerWithAPIKey(t, ts, email, "permpass123")
+	sendService.isConnected = func(string) bool { return true }
+	dbSetQueuePaused(email, true)
+	defer func() {
+		sendService.isConnected = isUserWAConnected
+		queueMutex.Lock()
+		delete(messageQueues, email)
+		queueMutex.Unlock()
+	}()
+
+	allowed := "120363000000000001@g.us"
+	other := "5550000@s.whatsapp.net"
+
+	// Webhook receiver limited to one group
+	var created map[string]interface{}
+	resp := apiRequest(t, "POST", ts.URL+"/api/webhooks/create", apiKey, map[string]interface{}{
+		"url": "http://example.com/hook", "method": "POST", "allowed_chats": []string{allowed},
+	}, &created)
+	if resp.StatusCode != 200 {
+		t.Fatalf("Create webhook failed, status: %d", resp.StatusCode)
+	}
+	id, _ := created["id"].(string)
+
+	receive := func(chat string) int {
+		return apiRequest(t, "POST", ts.URL+"/webhook/"+id, "", map[string]string{"chat_id": chat, "message": "hello"}, nil).StatusCode
+	}
+	if status := receive(other); status != http.StatusForbidden {
+		t.Fatalf("Expected 403 for other chat, got %d", status)
+	}
+	if status := receive(allowed); status != 200 {
+		t.Fatalf("Expected 200 for allowed chat, got %d", status)
+	}
+
+	// Lifting the restriction allows any chat
+	resp = apiRequest(t, "POST", ts.URL+"/api/webhooks/"+id+"/allowed-chats", apiKey, map[string]interface{}{"allowed_chats": []string{}}, nil)
+	if resp.StatusCode != 200 {
+		t.Fatalf("Update allowed chats failed, status: %d", resp.StatusCode)
+	}
+	if status := receive(other); status != 200 {
+		t.Fatalf("Expected 200 once unrestricted, got %d", status)
+	}
+
+	// API key restriction is managed with the session cookie
+	var buf bytes.Buffer
+	json.NewEncoder(&buf).Encode(map[string]interface{}{"allowed_chats": []string{allowed}})
+	req, _ := http.NewRequest("POST", ts.URL+"/api/user/api-key/allowed-chats", &buf)
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != 200 {
+		t.Fatalf("Set API key allowed chats failed: %v", err)
+	}
+
+	send := func(chat string) int {
+		return apiRequest(t, "POST", ts.URL+"/api/messages/send", apiKey, map[string]string{"chat_jid": chat, "message": "hi"}, nil).StatusCode
+	}
+	if status := send(other); status != http.StatusForbidden {
+		t.Fatalf("Expected 403 for other chat via API, got %d", status)
+	}
+	if status := send(allowed); status != 200 {
+		t.Fatalf("Expected 200 for allowed chat via API, got %d", status)
+	}
+
+	// The restricted key can't widen a receiver beyond its own chats
+	var limited map[string]interface{}
+	resp = apiRequest(t, "POST", ts.URL+"/api/webhooks/"+id+"/allowed-chats", apiKey, map[string]interface{}{"allowed_chats": []string{}}, &limited)
+	if chats, _ := limited["allowed_chats"].([]interface{}); resp.StatusCode != 200 || len(chats) != 1 || chats[0] != allowed {
+		t.Fatalf("Expected the key's chats to be applied, got %d %v", resp.StatusCode, limited)
+	}
+	if status := receive(other); status != http.StatusForbidden {
+		t.Fatalf("Expected 403 for other chat after the key's limit, got %d", status)
+	}
+	resp = apiRequest(t, "POST", ts.URL+"/api/webhooks/"+id+"/allowed-chats", apiKey, map[string]interface{}{"allowed_chats": []string{other}}, nil)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected 403 for chats outside the key's, got %d", resp.StatusCode)
+	}
+	var unrestricted Webhook
+	resp = apiRequest(t, "POST", ts.URL+"/api/webhooks/create", apiKey, map[string]interface{}{"url": "http://example.com/other", "method": "POST"}, &unrestricted)
+	if resp.StatusCode != 200 || len(unrestricted.AllowedChats) != 1 || unrestricted.AllowedChats[0] != allowed {
+		t.Fatalf("Expected a new webhook limited to the key's chats, got %d %+v", resp.StatusCode, unrestricted)
+	}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Send risk rules ---
+// Outbound heuristics on top of the spam keyword check, for sending patterns that get
+// accounts banned: a link to someone who never messaged first, near-identical text
+// sent to many chats, and a spike in failed sends. Each rule is "off", "warn" (the
+// send goes ahead and the response carries a warning) or "block".
+
+const (
+	RISK_OFF   = "off"
+	RISK_WARN  = "warn"
+	RISK_BLOCK = "block"
+
+	RULE_COLD_LINKS       = "cold_links"
+	RULE_SIMILAR_MESSAGES = "similar_messages"
+	RULE_ERROR_SPIKE      = "error_spike"
+
+	DEFAULT_SIMILAR_RECIPIENTS = 20 // Chats that may get near-identical text within the window
+	MAX_SIMILAR_RECIPIENTS     = 1000
+	SIMILAR_MESSAGE_WINDOW     = time.Hour
+	SIMILARITY_THRESHOLD       = 0.8 // Share of words two messages have in common
+	MAX_TRACKED_MESSAGES       = 2000
+	DEFAULT_ERROR_SPIKE        = 50 // Percent of recent sends failing
+	ERROR_SPIKE_WINDOW         = 15 * time.Minute
+	ERROR_SPIKE_MIN_SENDS      = 10
+)
+
+var linkRegex = regexp.MustCompile(`(?i)\b(?:https?://|www\.)\S+`)
+var wordRegex = regexp.MustCompile(`[\p{L}\p{N}]+`)
+
+type SendRiskSettings struct {
+	ColdLinks         string     `json:"cold_links"`
+	SimilarMessages   string     `json:"similar_messages"`
+	SimilarRecipients int        `json:"similar_recipients"` // Chats within an hour before the rule applies
+	ErrorSpike        string     `json:"error_spike"`
+	ErrorSpikePercent int        `json:"error_spike_percent"` // Failed share of the last 15 minutes' sends
+	UpdatedAt         *time.Time `json:"updated_at,omitempty"`
+}
+
+// A rule that matched a send set to "warn"
+type SendWarning struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+type sentText struct {
+	chatJID string
+	words   map[string]int
+	at      time.Time
+}
+
+type sendOutcome struct {
+	at     time.Time
+	failed bool
+}
+
+// Recent outgoing texts and send outcomes for one user, kept in memory
+type sendRiskState struct {
+	mu       sync.Mutex
+	texts    []sentText
+	outcomes []sendOutcome
+}
+
+var sendRiskStates = map[string]*sendRiskState{}
+var sendRiskMu sync.Mutex
+
+func getSendRiskState(email string) *sendRiskState {
+	sendRiskMu.Lock()
+	defer sendRiskMu.Unlock()
+	state, ok := sendRiskStates[email]
+	if !ok {
+		state = &sendRiskState{}
+		sendRiskStates[email] = state
+	}
+	return state
+}
+
+func defaultSendRiskSettings() SendRiskSettings {
+	return SendRiskSettings{
+		ColdLinks:         RISK_WARN,
+		SimilarMessages:   RISK_WARN,
+		SimilarRecipients: DEFAULT_SIMILAR_RECIPIENTS,
+		ErrorSpike:        RISK_WARN,
+		ErrorSpikePercent: DEFAULT_ERROR_SPIKE,
+	}
+}
+
+func validateSendRiskSettings(s *SendRiskSettings) error {
+	for rule, mode := range map[string]*string{RULE_COLD_LINKS: &s.ColdLinks, RULE_SIMILAR_MESSAGES: &s.SimilarMessages, RULE_ERROR_SPIKE: &s.ErrorSpike} {
+		if *mode == "" {
+			*mode = RISK_WARN
+		}
+		if *mode != RISK_OFF && *mode != RISK_WARN && *mode != RISK_BLOCK {
+			return fmt.Errorf("%s must be \"off\", \"warn\" or \"block\"", rule)
+		}
+	}
+	if s.SimilarRecipients == 0 {
+		s.SimilarRecipients = DEFAULT_SIMILAR_RECIPIENTS
+	}
+	if s.SimilarRecipients < 2 || s.SimilarRecipients > MAX_SIMILAR_RECIPIENTS {
+		return fmt.Errorf("similar_recipients must be between 2 and %d", MAX_SIMILAR_RECIPIENTS)
+	}
+	if s.ErrorSpikePercent == 0 {
+		s.ErrorSpikePercent = DEFAULT_ERROR_SPIKE
+	}
+	if s.ErrorSpikePercent < 1 || s.ErrorSpikePercent > 100 {
+		return fmt.Errorf("error_spike_percent must be between 1 and 100")
+	}
+	return nil
+}
+
+func dbGetSendRiskSettings(userID int64) (SendRiskSettings, error) {
+	s := defaultSendRiskSettings()
+	var updatedAt string
+	err := db.QueryRow(`SELECT cold_links, similar_messages, similar_recipients, error_spike, error_spike_percent, updated_at FROM send_risk_settings WHERE user_id = ?`, userID).
+		Scan(&s.ColdLinks, &s.SimilarMessages, &s.SimilarRecipients, &s.ErrorSpike, &s.ErrorSpikePercent, &updatedAt)
+	if err == sql.ErrNoRows {
+		return s, nil
+	} else if err != nil {
+		return s, err
+	}
+	if t, err := time.Parse(time.RFC3339, updatedAt); err == nil {
+		s.UpdatedAt = &t
+	}
+	return s, nil
+}
+
+func dbSetSendRiskSettings(userID int64, s SendRiskSettings) error {
+	_, err := db.Exec(`INSERT INTO send_risk_settings (user_id, cold_links, similar_messages, similar_recipients, error_spike, error_spike_percent, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(user_id) DO UPDATE SET cold_links = excluded.cold_links, similar_messages = excluded.similar_messages,
+			similar_recipients = excluded.similar_recipients, error_spike = excluded.error_spike,
+			error_spike_percent = excluded.error_spike_percent, updated_at = excluded.updated_at`,
+		userID, s.ColdLinks, s.SimilarMessages, s.SimilarRecipients, s.ErrorSpike, s.ErrorSpikePercent, time.Now().UTC().Format(time.RFC3339))
+	return err
+}
+
+// Whether a chat has ever sent the user a message
+func chatHasMessagedFirst(userID int64, chatJIDs ...string) bool {
+	for _, chatJID := range chatJIDs {
+		var exists int
+		if err := db.QueryRow(`SELECT 1 FROM messages WHERE user_id = ? AND chat_jid = ? LIMIT 1`, userID, chatJID).Scan(&exists); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func messageWords(text string) map[string]int {
+	words := map[string]int{}
+	for _, word := range wordRegex.FindAllString(strings.ToLower(text), -1) {
+		words[word]++
+	}
+	return words
+}
+
+// Share of words two messages have in common, relative to the longer one
+func messageSimilarity(a, b map[string]int) float64 {
+	sizeA, sizeB, common := 0, 0, 0
+	for word, n := range a {
+		sizeA += n
+		common += min(n, b[word])
+	}
+	for _, n := range b {
+		sizeB += n
+	}
+	if sizeA == 0 || sizeB == 0 {
+		return 0
+	}
+	return float64(common) / float64(max(sizeA, sizeB))
+}
+
+// Remember a queued text for the similar messages rule
+func recordSentText(email, chatJID, text string, now time.Time) {
+	if strings.TrimSpace(text) == "" {
+		return
+	}
+	state := getSendRiskState(email)
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	state.texts = append(state.texts, sentText{chatJID: chatJID, words: messageWords(text), at: now})
+	if len(state.texts) > MAX_TRACKED_MESSAGES {
+		state.texts = state.texts[len(state.texts)-MAX_TRACKED_MESSAGES:]
+	}
+}
+
+// Remember whether a queued message was sent or failed, for the error spike rule
+func recordSendOutcome(email string, failed bool) {
+	state := getSendRiskState(email)
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	state.outcomes = append(state.outcomes, sendOutcome{at: time.Now(), failed: failed})
+	if len(state.outcomes) > MAX_TRACKED_MESSAGES {
+		state.outcomes = state.outcomes[len(state.outcomes)-MAX_TRACKED_MESSAGES:]
+	}
+}
+
+// Other chats that got near-identical text within the window
+func similarRecipients(email, chatJID, text string, now time.Time) int {
+	words := messageWords(text)
+	state := getSendRiskState(email)
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	chats := map[string]bool{}
+	kept := state.texts[:0]
+	for _, sent := range state.texts {
+		if now.Sub(sent.at) > SIMILAR_MESSAGE_WINDOW {
+			continue
+		}
+		kept = append(kept, sent)
+		if sent.chatJID != chatJID && messageSimilarity(words, sent.words) >= SIMILARITY_THRESHOLD {
+			chats[sent.chatJID] = true
+		}
+	}
+	state.texts = kept
+	return len(chats)
+}
+
+// Failed and total sends within the error spike window
+func recentSendFailures(email string, now time.Time) (int, int) {
+	state := getSendRiskState(email)
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	kept := state.outcomes[:0]
+	failed := 0
+	for _, o := range state.outcomes {
+		if now.Sub(o.at) > ERROR_SPIKE_WINDOW {
+			continue
+		}
+		kept = append(kept, o)
+		if o.failed {
+			failed++
+		}
+	}
+	state.outcomes = kept
+	return failed, len(kept)
+}
+
+// Apply the user's send risk rules to a send. Returns the warnings for rules set to
+// "warn", or the error for the first rule set to "block" that matched.
+func checkSendRisk(userID int64, email string, chatJID, lid, text string) ([]SendWarning, *SendError) {
+	settings, err := dbGetSendRiskSettings(userID)
+	if err != nil {
+		fmt.Printf("ERROR: Could not load send risk settings for user %d: %v\n", userID, err)
+		return nil, nil
+	}
+	now := time.Now()
+	var warnings []SendWarning
+	apply := func(rule, mode, message string) *SendError {
+		if mode == RISK_BLOCK {
+			fmt.Printf("WARNING: Blocked send to %s from %s: %s\n", chatJID, email, message)
+			return &SendError{Status: http.StatusBadRequest, Code: ERR_RISK_BLOCKED, Message: fmt.Sprintf("Message blocked (%s): %s", rule, message)}
+		}
+		fmt.Printf("WARNING: Risky send to %s from %s: %s\n", chatJID, email, message)
+		warnings = append(warnings, SendWarning{Rule: rule, Message: message})
+		return nil
+	}
+
+	direct := strings.HasSuffix(chatJID, "@s.whatsapp.net") || strings.HasSuffix(chatJID, "@lid")
+	if settings.ColdLinks != RISK_OFF && direct && linkRegex.MatchString(text) && !chatHasMessagedFirst(userID, chatJID, lid) {
+		if sendErr := apply(RULE_COLD_LINKS, settings.ColdLinks, "Link sent to a contact who has never messaged first"); sendErr != nil {
+			return nil, sendErr
+		}
+	}
+	if settings.SimilarMessages != RISK_OFF && strings.TrimSpace(text) != "" {
+		if n := similarRecipients(email, chatJID, text, now); n >= settings.SimilarRecipients {
+			message := fmt.Sprintf("Near-identical text already sent to %d other chats in the last hour", n)
+			if sendErr := apply(RULE_SIMILAR_MESSAGES, settings.SimilarMessages, message); sendErr != nil {
+				return nil, sendErr
+			}
+		}
+	}
+	if settings.ErrorSpike != RISK_OFF {
+		failed, total := recentSendFailures(email, now)
+		if total >= ERROR_SPIKE_MIN_SENDS && failed*100 >= settings.ErrorSpikePercent*total {
+			message := fmt.Sprintf("%d of the last %d sends failed in %d minutes", failed, total, int(ERROR_SPIKE_WINDOW.Minutes()))
+			if sendErr := apply(RULE_ERROR_SPIKE, settings.ErrorSpike, message); sendErr != nil {
+				return nil, sendErr
+			}
+		}
+	}
+	return warnings, nil
+}
+
+// GET/POST /api/send-risk
+// POST replaces the settings: {"cold_links", "similar_messages", "similar_recipients",
+// "error_spike", "error_spike_percent"}; each rule is "off", "warn" or "block".
+func handleSendRiskSettings(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(int64)
+
+	switch r.Method {
+	case "GET":
+		settings, err := dbGetSendRiskSettings(userID)
+		if err != nil {
+			apiError(w, "Failed to load send risk settings", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(settings)
+	case "POST":
+		var settings SendRiskSettings
+		if err := decodeJSONBody(w, r, &settings); err != nil {
+			writeBodyError(w, err)
+			return
+		}
+		if err := validateSendRiskSettings(&settings); err != nil {
+			apiError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := dbSetSendRiskSettings(userID, settings); err != nil {
+			fmt.Println("ERROR: Could not save send risk settings", err)
+			apiError(w, "Failed to save send risk settings", http.StatusInternalServerError)
+			return
+		}
+		fmt.Printf("INFO: Send risk rules for user %d set: cold_links=%s similar_messages=%s error_spike=%s\n",
+			userID, settings.ColdLinks, settings.SimilarMessages, settings.ErrorSpike)
+		saved, _ := dbGetSendRiskSettings(userID)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(saved)
+	default:
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
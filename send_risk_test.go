@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestMessageSimilarity(t *testing.T) {
+	a := messageWords("Hi Ann, our new menu is here: check it out today!")
+	b := messageWords("Hi Bob, our new menu is here: check it out today!")
+	if sim := messageSimilarity(a, b); sim < SIMILARITY_THRESHOLD {
+		t.Fatalf("Expected personalised copies to be similar, got %.2f", sim)
+	}
+	if sim := messageSimilarity(a, messageWords("Are we still on for lunch tomorrow?")); sim >= SIMILARITY_THRESHOLD {
+		t.Fatalf("Expected unrelated text to differ, got %.2f", sim)
+	}
+	if sim := messageSimilarity(a, messageWords("")); sim != 0 {
+		t.Fatalf("Expected 0 for empty text, got %.2f", sim)
+	}
+}
+
+func TestSendRiskRules(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+
+	email := "risk@example.com"
+	_, apiKey := registerWithAPIKey(t, ts, email, "riskpass123")
+	userID, _ := getUserIDByEmail(email)
+	sendService.isConnected = func(string) bool { return true }
+	dbSetQueuePaused(email, true)
+	defer func() {
+		sendService.isConnected = isUserWAConnected
+		queueMutex.Lock()
+		delete(messageQueues, email)
+		queueMutex.Unlock()
+		sendRiskMu.Lock()
+		delete(sendRiskStates, email)
+		sendRiskMu.Unlock()
+	}()
+
+	type sendResponse struct {
+		Warnings []SendWarning `json:"warnings"`
+		Error    struct {
+			Code string `json:"code"`
+		} `json:"error"`
+	}
+	send := func(chatJID, message string) (*http.Response, sendResponse) {
+		var out sendResponse
+		resp := apiRequest(t, "POST", ts.URL+"/api/messages/send", apiKey, map[string]string{"chat_jid": chatJID, "message": message}, &out)
+		return resp, out
+	}
+	configure := func(body map[string]interface{}) *http.Response {
+		return apiRequest(t, "POST", ts.URL+"/api/send-risk", apiKey, body, nil)
+	}
+
+	var settings SendRiskSettings
+	apiRequest(t, "GET", ts.URL+"/api/send-risk", apiKey, nil, &settings)
+	if settings.ColdLinks != RISK_WARN || settings.SimilarRecipients != DEFAULT_SIMILAR_RECIPIENTS || settings.UpdatedAt != nil {
+		t.Fatalf("Unexpected default settings: %+v", settings)
+	}
+	if resp := configure(map[string]interface{}{"cold_links": "loud"}); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for an unknown mode, got %d", resp.StatusCode)
+	}
+	if resp := configure(map[string]interface{}{"error_spike_percent": 150}); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for a percent over 100, got %d", resp.StatusCode)
+	}
+
+	// Links to a contact who never wrote first warn by default
+	resp, out := send("14155550100@s.whatsapp.net", "Our menu: https://example.com/menu")
+	if resp.StatusCode != 200 || len(out.Warnings) != 1 || out.Warnings[0].Rule != RULE_COLD_LINKS {
+		t.Fatalf("Expected a cold link warning, got %d %+v", resp.StatusCode, out)
+	}
+
+	if resp := configure(map[string]interface{}{"cold_links": "block", "similar_messages": "block", "similar_recipients": 2, "error_spike": "off"}); resp.StatusCode != 200 {
+		t.Fatalf("Saving settings failed, status %d", resp.StatusCode)
+	}
+	resp, out = send("14155550101@s.whatsapp.net", "See www.example.com")
+	if resp.StatusCode != http.StatusBadRequest || out.Error.Code != ERR_RISK_BLOCKED {
+		t.Fatalf("Expected the cold link to be blocked, got %d %+v", resp.StatusCode, out)
+	}
+	// Once the contact has messaged first, links are fine
+	archiveMessage(userID, "14155550101@s.whatsapp.net", map[string]interface{}{"id": "in1", "from": "14155550101@s.whatsapp.net", "text": "Hello"}, "")
+	if resp, out = send("14155550101@s.whatsapp.net", "See www.example.com"); resp.StatusCode != 200 || len(out.Warnings) != 0 {
+		t.Fatalf("Expected a link to a known contact to pass, got %d %+v", resp.StatusCode, out)
+	}
+
+	// The same text to a third chat within the hour is blocked
+	for i, name := range []string{"Ann", "Bob"} {
+		if resp, _ := send(fmt.Sprintf("1415555020%d@s.whatsapp.net", i), "Hi "+name+", our summer menu starts on Monday at noon"); resp.StatusCode != 200 {
+			t.Fatalf("Send %d failed, status %d", i, resp.StatusCode)
+		}
+	}
+	if resp, out = send("14155550209@s.whatsapp.net", "Hi Cat, our summer menu starts on Monday at noon"); resp.StatusCode != http.StatusBadRequest || out.Error.Code != ERR_RISK_BLOCKED {
+		t.Fatalf("Expected repeated text to be blocked, got %d %+v", resp.StatusCode, out)
+	}
+	if resp, _ = send("14155550209@s.whatsapp.net", "Are we still on for lunch tomorrow?"); resp.StatusCode != 200 {
+		t.Fatalf("Expected different text to pass, got %d", resp.StatusCode)
+	}
+
+	// Turned off, the rule no longer applies
+	configure(map[string]interface{}{"cold_links": "off", "similar_messages": "off", "error_spike": "warn"})
+	if resp, out = send("14155550209@s.whatsapp.net", "Hi Dan, our summer menu starts on Monday at noon"); resp.StatusCode != 200 || len(out.Warnings) != 0 {
+		t.Fatalf("Expected no checks with rules off, got %d %+v", resp.StatusCode, out)
+	}
+
+	// Half of the recent sends failing triggers the error spike rule
+	for i := 0; i < ERROR_SPIKE_MIN_SENDS; i++ {
+		recordSendOutcome(email, i%2 == 0)
+	}
+	resp, out = send("14155550209@s.whatsapp.net", "Quick question about your order")
+	if resp.StatusCode != 200 || len(out.Warnings) != 1 || out.Warnings[0].Rule != RULE_ERROR_SPIKE {
+		t.Fatalf("Expected an error spike warning, got %d %+v", resp.StatusCode, out)
+	}
+	if failed, total := recentSendFailures(email, time.Now().Add(ERROR_SPIKE_WINDOW+time.Second)); failed != 0 || total != 0 {
+		t.Fatalf("Expected outcomes to expire after the window, got %d of %d", failed, total)
+	}
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+// --- Send Service ---
+// Every outgoing message (/api/messages/send, the /webhook/{id} receiver and webhook
+// auto-replies) is validated and queued here, so all paths share the same checks,
+// logging and callback handling.
+
+type SendRequest struct {
+	UserEmail    string
+	ChatJID      string
+	Message      string
+	MediaID      string // Optional media from /api/media/upload-url; Message is then the caption
+	CallbackURL  string
+	AllowedChats []string            // Chats the API key or webhook may send to (empty = any)
+	Source       string              // Where the send came from, for logging ("api", "webhook abc123", ...)
+	Reservation  string              // Optional capacity reservation the send belongs to
+	Campaign     string              // Campaign the send is for, whose recipient tracks its outcome
+	ExpiresIn    int                 // Optional: seconds after which the message is dropped unsent (expires_in)
+	GroupKey     string              // Optional: sent back-to-back with other messages with the same key (group_key)
+	EditID       string              // Optional: WhatsApp ID of a sent message whose text this replaces (see message_edits.go)
+	Forwarded    bool                // Sent marked as forwarded (see message_forward.go)
+	Interactive  *InteractiveMessage // Optional buttons or list; Message is then the body (see interactive.go)
+}
+
+type SendResult struct {
+	Message        *QueuedMessage
+	Position       int
+	EstimatedDelay time.Duration
+	Warnings       []SendWarning // Send risk rules set to "warn" that matched
+	Pending        bool          // Waiting for approval, not yet queued
+}
+
+// A rejected send, with the HTTP status and API error code that describe it
+type SendError struct {
+	Status     int
+	Code       string // API error code; derived from Status when empty
+	Message    string
+	RetryAfter int        // Seconds, for 503 during maintenance
+	Limit      *SendLimit // The sending limit reached, for 429
+}
+
+func (e *SendError) Error() string {
+	return e.Message
+}
+
+type SendService struct {
+	// Reports whether a user's WhatsApp client is connected
+	isConnected func(email string) bool
+	// Looks up the JID a phone number is registered as (errNotOnWhatsApp if it isn't)
+	resolvePhone func(email, phone string) (types.JID, error)
+	// Maps a LID to its phone-number JID, if known
+	lidToPN func(email string, lid types.JID) (types.JID, bool)
+}
+
+var sendService = &SendService{isConnected: isUserWAConnected, resolvePhone: resolveUserPhone, lidToPN: userLIDToPN}
+
+func isUserWAConnected(email string) bool {
+	return userWAClient(email) != nil && getUserWAStatus(email) == "connected"
+}
+
+// Resolve the chat a send goes to and check it against the allowed list. Phone numbers
+// are looked up with WhatsApp. LIDs are sent to as phone numbers when known, so queues,
+// recent chats and allowed chats see one JID per contact; an allowed list may name
+// either form. Returns the chat and, if it was mapped from one, its LID.
+func (s *SendService) resolveAllowedChat(email, chat string, allowed []string, source string) (types.JID, types.JID, *SendError) {
+	chatJID, isPhone, err := parseChatJID(chat)
+	if err != nil {
+		return chatJID, types.EmptyJID, &SendError{Status: http.StatusBadRequest, Code: ERR_INVALID_JID, Message: "Invalid chat JID or phone number"}
+	}
+	if isPhone {
+		chatJID, err = s.resolvePhone(email, chatJID.User)
+		if errors.Is(err, errNotOnWhatsApp) {
+			return chatJID, types.EmptyJID, &SendError{Status: http.StatusBadRequest, Code: ERR_NOT_ON_WHATSAPP, Message: fmt.Sprintf("Phone number %s is not on WhatsApp", chat)}
+		}
+		if err != nil {
+			fmt.Printf("ERROR: Phone lookup failed for %s (%s): %v\n", email, source, err)
+			return chatJID, types.EmptyJID, &SendError{Status: http.StatusBadGateway, Message: "Could not check phone number with WhatsApp"}
+		}
+	}
+	lid := types.EmptyJID
+	if chatJID.Server == types.HiddenUserServer && s.lidToPN != nil {
+		if pn, ok := s.lidToPN(email, chatJID); ok {
+			lid, chatJID = chatJID, pn
+		}
+	}
+	if !chatAllowed(allowed, chatJID) && (lid.IsEmpty() || !chatAllowed(allowed, lid)) {
+		fmt.Printf("WARNING: Blocked send to %s from %s (%s): chat not allowed\n", chatJID, email, source)
+		return chatJID, lid, &SendError{Status: http.StatusForbidden, Code: ERR_CHAT_NOT_ALLOWED, Message: "Sending to this chat is not allowed"}
+	}
+	return chatJID, lid, nil
+}
+
+// Validate a send and add it to the user's queue
+func (s *SendService) Enqueue(req SendRequest) (*SendResult, error) {
+	if enabled, retryAfter := maintenanceStatus(); enabled {
+		return nil, &SendError{Status: http.StatusServiceUnavailable, Code: ERR_MAINTENANCE, Message: "Service in maintenance mode, not accepting new messages", RetryAfter: retryAfter}
+	}
+	if dbGetReceiveOnly(req.UserEmail) {
+		fmt.Printf("WARNING: Blocked send from receive-only user %s (%s)\n", req.UserEmail, req.Source)
+		return nil, &SendError{Status: http.StatusForbidden, Code: ERR_RECEIVE_ONLY, Message: "Sending is disabled: account is in receive-only mode"}
+	}
+	if req.ChatJID == "" || (req.Message == "" && req.MediaID == "") {
+		return nil, &SendError{Status: http.StatusBadRequest, Message: "Missing chat_jid or message"}
+	}
+	if n := utf8.RuneCountInString(req.Message); n > maxMessageLength() {
+		return nil, &SendError{Status: http.StatusBadRequest, Message: fmt.Sprintf("Message is %d characters; the maximum is %d", n, maxMessageLength())}
+	}
+	ttl, err := messageTTL(req.ExpiresIn)
+	if err != nil {
+		return nil, &SendError{Status: http.StatusBadRequest, Message: err.Error()}
+	}
+	if err := validateGroupKey(req.GroupKey); err != nil {
+		return nil, &SendError{Status: http.StatusBadRequest, Message: err.Error()}
+	}
+	if req.EditID != "" && req.MediaID != "" {
+		return nil, &SendError{Status: http.StatusBadRequest, Message: "Only the text of a message can be edited"}
+	}
+	if req.Interactive != nil {
+		if req.MediaID != "" || req.Message == "" {
+			return nil, &SendError{Status: http.StatusBadRequest, Message: "Interactive messages need a message text and no media"}
+		}
+		if err := validateInteractive(req.Interactive); err != nil {
+			return nil, &SendError{Status: http.StatusBadRequest, Message: err.Error()}
+		}
+	}
+	if req.CallbackURL != "" {
+		if err := validateOutboundURL(req.CallbackURL); err != nil {
+			return nil, &SendError{Status: http.StatusBadRequest, Message: "Invalid callback_url: " + err.Error()}
+		}
+	}
+
+	// Check for spam patterns
+	if req.Message != "" && isSpamPattern(req.Message, req.UserEmail) {
+		fmt.Printf("WARNING: Blocked potential spam message from %s (%s)\n", req.UserEmail, req.Source)
+		return nil, &SendError{Status: http.StatusBadRequest, Code: ERR_SPAM_BLOCKED, Message: "Message blocked: potential spam detected"}
+	}
+
+	userID, err := getUserIDByEmail(req.UserEmail)
+	if err != nil {
+		return nil, &SendError{Status: http.StatusNotFound, Message: "User not found"}
+	}
+	// Media must be fully uploaded by this user before it can be sent
+	if req.MediaID != "" {
+		upload, err := dbGetMediaUpload(userID, req.MediaID)
+		if err != nil || upload.Status != MEDIA_UPLOAD_COMPLETED {
+			return nil, &SendError{Status: http.StatusBadRequest, Message: "Unknown or incomplete media_id"}
+		}
+	}
+
+	if channel := chatChannel(req.ChatJID); channel != "" {
+		// Telegram and Signal chats are sent to with the user's channel instead
+		if req.MediaID != "" {
+			return nil, &SendError{Status: http.StatusBadRequest, Message: fmt.Sprintf("Media can't be sent on %s", channel)}
+		}
+		if req.EditID != "" {
+			return nil, &SendError{Status: http.StatusBadRequest, Message: fmt.Sprintf("Messages can't be edited on %s", channel)}
+		}
+		if userClientForChat(req.UserEmail, types.JID{Server: channel}) == nil {
+			return nil, &SendError{Status: http.StatusServiceUnavailable, Code: ERR_CHANNEL_DISCONNECTED, Message: fmt.Sprintf("No %s channel connected", channel)}
+		}
+	} else if !s.isConnected(req.UserEmail) {
+		fmt.Printf("ERROR: User %s WhatsApp not connected (%s)\n", req.UserEmail, req.Source)
+		return nil, &SendError{Status: http.StatusServiceUnavailable, Code: ERR_WA_DISCONNECTED, Message: "WhatsApp client not connected"}
+	}
+
+	chatJID, lid, sendErr := s.resolveAllowedChat(req.UserEmail, req.ChatJID, req.AllowedChats, req.Source)
+	if sendErr != nil {
+		return nil, sendErr
+	}
+	lidJID := ""
+	if !lid.IsEmpty() {
+		lidJID = lid.String()
+	}
+	var editDeadline time.Time
+	if req.EditID != "" {
+		if editDeadline, err = messageEditDeadline(userID, chatJID.String(), req.EditID, time.Now()); err != nil {
+			if sendErr, ok := err.(*SendError); ok {
+				return nil, sendErr
+			}
+			fmt.Printf("ERROR: Could not look up message %s for an edit by %s: %v\n", req.EditID, req.UserEmail, err)
+			return nil, &SendError{Status: http.StatusInternalServerError, Message: "Failed to look up the message to edit"}
+		}
+	}
+	warnings, sendErr := checkSendRisk(userID, req.UserEmail, chatJID.String(), lidJID, req.Message)
+	if sendErr != nil {
+		return nil, sendErr
+	}
+
+	queue := getOrCreateQueue(req.UserEmail)
+	if limit := queue.reachedLimit(); limit != nil {
+		message := "Hourly message limit reached"
+		if limit.Name == LIMIT_DAILY {
+			message = "Daily message limit reached"
+		}
+		return nil, &SendError{Status: http.StatusTooManyRequests, Code: ERR_RATE_LIMITED, Message: message, Limit: limit}
+	}
+	if sendErr := checkReservedCapacity(userID, req.Reservation, queue); sendErr != nil {
+		return nil, sendErr
+	}
+	if req.Reservation != "" {
+		if ok, err := dbUseReservation(userID, req.Reservation); err != nil || !ok {
+			return nil, &SendError{Status: http.StatusConflict, Message: "Reservation is used up"}
+		}
+	}
+
+	queuedMsg := &QueuedMessage{
+		ID:          generateMessageID(),
+		UserEmail:   req.UserEmail,
+		ChatJID:     chatJID.String(),
+		Message:     req.Message,
+		MediaID:     req.MediaID,
+		CallbackURL: req.CallbackURL,
+		Campaign:    req.Campaign,
+		Source:      req.Source,
+		GroupKey:    req.GroupKey,
+		EditID:      req.EditID,
+		Forwarded:   req.Forwarded,
+		Interactive: req.Interactive,
+		CreatedAt:   time.Now(),
+		Status:      "queued",
+	}
+	if ttl > 0 {
+		expiresAt := queuedMsg.CreatedAt.Add(ttl)
+		queuedMsg.ExpiresAt = &expiresAt
+	}
+	// An edit can't be sent once the edit window has closed
+	if !editDeadline.IsZero() && (queuedMsg.ExpiresAt == nil || editDeadline.Before(*queuedMsg.ExpiresAt)) {
+		queuedMsg.ExpiresAt = &editDeadline
+	}
+	if req.CallbackURL != "" {
+		fmt.Printf("DEBUG: Callback URL received: %s for message %s\n", req.CallbackURL, queuedMsg.ID)
+	}
+
+	if req.MediaID != "" {
+		if err := dbSetMediaUploadChat(req.MediaID, queuedMsg.ChatJID); err != nil {
+			fmt.Printf("ERROR: Could not record the chat of media %s: %v\n", req.MediaID, err)
+		}
+	}
+
+	if needsApproval(req) {
+		if err := queue.addPending(queuedMsg); err != nil {
+			if req.Reservation != "" {
+				dbReleaseReservationUse(userID, req.Reservation)
+			}
+			return nil, &SendError{Status: http.StatusServiceUnavailable, Message: err.Error()}
+		}
+		emitQueueEvent(queuedMsg, "", STATUS_PENDING_APPROVAL)
+		fmt.Printf("INFO: Message %s for user %s via %s is waiting for approval\n", queuedMsg.ID, req.UserEmail, req.Source)
+		return &SendResult{Message: queuedMsg, Warnings: warnings, Pending: true}, nil
+	}
+
+	if err := queue.addMessage(queuedMsg); err != nil {
+		if req.Reservation != "" {
+			dbReleaseReservationUse(userID, req.Reservation)
+		}
+		return nil, &SendError{Status: http.StatusServiceUnavailable, Message: err.Error()}
+	}
+	emitQueueEvent(queuedMsg, "", "queued")
+	recordSentText(req.UserEmail, queuedMsg.ChatJID, req.Message, queuedMsg.CreatedAt)
+
+	position := queue.getQueuePosition(queuedMsg.ID)
+	estimatedDelay := queue.estimateDelay(position)
+	fmt.Printf("SUCCESS: Queued message %s for user %s via %s (position: %d)\n", queuedMsg.ID, req.UserEmail, req.Source, position)
+
+	return &SendResult{Message: queuedMsg, Position: position, EstimatedDelay: estimatedDelay, Warnings: warnings}, nil
+}
+
+// Queue a send made with an API key (requireAPIKey): sets the user, applies the key's
+// allowed chats and daily quota (refunded if the send is rejected). On failure the
+// error response is written and nil returned.
+func enqueueWithAPIKey(w http.ResponseWriter, r *http.Request, req SendRequest) *SendResult {
+	userID := r.Context().Value("userID").(int64)
+	req.UserEmail = getUserEmailByID(userID)
+
+	// Per-key daily quota, on top of the per-user limits
+	apiKey := requestAPIKey(r.Context())
+	if !consumeAPIKeySendQuota(w, apiKey) {
+		return nil
+	}
+
+	allowedChats, err := dbGetAPIKeyAllowedChats(userID)
+	if err != nil {
+		refundAPIKeySendQuota(apiKey)
+		fmt.Printf("ERROR: Failed to load allowed chats for user %d: %v\n", userID, err)
+		apiError(w, "Failed to load send permissions", http.StatusInternalServerError)
+		return nil
+	}
+	req.AllowedChats = allowedChats
+
+	result, err := sendService.Enqueue(req)
+	if err != nil {
+		refundAPIKeySendQuota(apiKey)
+		writeSendError(w, err)
+		return nil
+	}
+	return result
+}
+
+// Write a send failure as an HTTP error response
+func writeSendError(w http.ResponseWriter, err error) {
+	sendErr, ok := err.(*SendError)
+	if !ok {
+		apiError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if sendErr.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(sendErr.RetryAfter))
+	}
+	code := sendErr.Code
+	if code == "" {
+		code = errorCodeForStatus(sendErr.Status)
+	}
+	if limit := sendErr.Limit; limit != nil {
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(limit.Max))
+		w.Header().Set("X-RateLimit-Remaining", "0")
+		w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(limit.Reset.Unix(), 10))
+		writeLimitExceeded(w, code, sendErr.Message, limit.Name, limit.Max, limit.Reset)
+		return
+	}
+	writeAPIError(w, sendErr.Status, code, sendErr.Message)
+}
+
+// JSON response body for a queued message
+func sendResultResponse(result *SendResult) map[string]interface{} {
+	response := map[string]interface{}{
+		"success":         true,
+		"status":          "queued",
+		"queue_id":        result.Message.ID,
+		"position":        result.Position,
+		"estimated_delay": fmt.Sprintf("%.0f seconds", result.EstimatedDelay.Seconds()),
+		"message":         "Message queued successfully",
+	}
+	if result.Pending {
+		response["status"] = STATUS_PENDING_APPROVAL
+		response["message"] = "Message is waiting for approval"
+		delete(response, "position")
+		delete(response, "estimated_delay")
+	}
+	if result.Message.ExpiresAt != nil {
+		response["expires_at"] = result.Message.ExpiresAt.UTC().Format(time.RFC3339)
+	}
+	if result.Message.GroupKey != "" {
+		response["group_key"] = result.Message.GroupKey
+	}
+	if len(result.Warnings) > 0 {
+		response["warnings"] = result.Warnings
+	}
+	return response
+}
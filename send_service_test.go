@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestSendServiceValidation(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+
+	email := "sendservice@example.com"
+	registerWithAPIKey(t, ts, email, "sendservicepass123")
+	dbSetQueuePaused(email, true)
+	defer func() {
+		queueMutex.Lock()
+		delete(messageQueues, email)
+		queueMutex.Unlock()
+	}()
+
+	connected := false
+	svc := &SendService{isConnected: func(string) bool { return connected }}
+	valid := SendRequest{UserEmail: email, ChatJID: "5551234@s.whatsapp.net", Message: "hello", Source: "test"}
+
+	expectStatus := func(name string, req SendRequest, status int) *SendError {
+		_, err := svc.Enqueue(req)
+		sendErr, ok := err.(*SendError)
+		if !ok || sendErr.Status != status {
+			t.Fatalf("%s: expected status %d, got %v", name, status, err)
+		}
+		return sendErr
+	}
+
+	missing := valid
+	missing.Message = ""
+	expectStatus("missing message", missing, http.StatusBadRequest)
+
+	badMedia := missing
+	badMedia.MediaID = "nope"
+	expectStatus("unknown media", badMedia, http.StatusBadRequest)
+
+	expectStatus("not connected", valid, http.StatusServiceUnavailable)
+	connected = true
+
+	badJID := valid
+	badJID.ChatJID = "not:a:jid@@"
+	expectStatus("invalid jid", badJID, http.StatusBadRequest)
+
+	setMaintenance(true, 60, "")
+	if sendErr := expectStatus("maintenance", valid, http.StatusServiceUnavailable); sendErr.RetryAfter != 60 {
+		t.Fatalf("Expected RetryAfter 60, got %d", sendErr.RetryAfter)
+	}
+	setMaintenance(false, 0, "")
+
+	result, err := svc.Enqueue(valid)
+	if err != nil {
+		t.Fatalf("Enqueue failed: %v", err)
+	}
+	if result.Message.ChatJID != valid.ChatJID || result.Position != 1 {
+		t.Fatalf("Unexpected result: %+v %+v", result, result.Message)
+	}
+}
+
+func TestWebhookReceiverUsesSendService(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+
+	_, apiKey := registerWithAPIKey(t, ts, "receiver@example.com", "receiverpass123")
+	var created map[string]interface{}
+	resp := apiRequest(t, "POST", ts.URL+"/api/webhooks/create", apiKey, map[string]interface{}{
+		"url": "http://example.com/hook", "method": "POST",
+	}, &created)
+	if resp.StatusCode != 200 {
+		t.Fatalf("Create webhook failed, status: %d", resp.StatusCode)
+	}
+	id, _ := created["id"].(string)
+
+	// The receiver rejects the same requests as /api/messages/send
+	resp = apiRequest(t, "POST", ts.URL+"/webhook/"+id, "", map[string]string{"message": "hello"}, nil)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected 400 without chat_id, got %d", resp.StatusCode)
+	}
+	resp = apiRequest(t, "POST", ts.URL+"/webhook/"+id, "", map[string]string{"chat_id": "123@s.whatsapp.net", "message": "hello"}, nil)
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("Expected 503 while WhatsApp is not connected, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+)
+
+// --- Sent messages ---
+// Every message the queue sends is recorded with what WhatsApp answered: the message
+// ID and the server timestamp (plus the server ID for channel posts). Downstream systems
+// use them to match receipts and to delete or edit the message later. They are also in
+// the "sent" callback and the queue.status event.
+
+type SentMessage struct {
+	QueueID         string    `json:"queue_id"`
+	ChatJID         string    `json:"chat_jid"`
+	MessageID       string    `json:"message_id"`
+	ServerID        int       `json:"server_id,omitempty"` // Newsletter (channel) posts only
+	ServerTimestamp time.Time `json:"server_timestamp"`
+	Text            string    `json:"text,omitempty"`
+	MediaID         string    `json:"media_id,omitempty"`
+	Source          string    `json:"source,omitempty"`
+	Campaign        string    `json:"campaign_id,omitempty"`
+	EditOf          string    `json:"edit_of,omitempty"` // WhatsApp ID of the message this edited
+}
+
+// Timestamp WhatsApp gave a send, or now if the backend didn't report one
+func sendTimestamp(resp whatsmeow.SendResponse) time.Time {
+	if resp.Timestamp.IsZero() {
+		return time.Now().UTC()
+	}
+	return resp.Timestamp.UTC()
+}
+
+// Fields describing what WhatsApp answered to a send, for callbacks and events
+func sendResponseFields(resp whatsmeow.SendResponse) map[string]interface{} {
+	fields := map[string]interface{}{
+		"message_id":       string(resp.ID),
+		"server_timestamp": sendTimestamp(resp).Format(time.RFC3339),
+	}
+	if resp.ServerID != 0 {
+		fields["server_id"] = int(resp.ServerID)
+	}
+	return fields
+}
+
+// Record a sent message; an edit also replaces the text of the message it edited
+func dbRecordSentMessage(userID int64, msg *QueuedMessage, resp whatsmeow.SendResponse) error {
+	_, err := db.Exec(`INSERT OR REPLACE INTO sent_messages (user_id, queue_id, chat_jid, message_id, server_id, server_timestamp, text, media_id, source, campaign_id, edit_of) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		userID, msg.ID, msg.ChatJID, string(resp.ID), int(resp.ServerID), sendTimestamp(resp).Format(time.RFC3339), msg.Message, msg.MediaID, msg.Source, msg.Campaign, msg.EditID)
+	if err != nil || msg.EditID == "" {
+		return err
+	}
+	_, err = db.Exec(`UPDATE sent_messages SET text = ? WHERE user_id = ? AND chat_jid = ? AND message_id = ? AND edit_of = ''`,
+		msg.Message, userID, msg.ChatJID, msg.EditID)
+	return err
+}
+
+const sentMessageColumns = `queue_id, chat_jid, message_id, server_id, server_timestamp, text, media_id, source, campaign_id, edit_of`
+
+func scanSentMessage(row interface{ Scan(...interface{}) error }) (SentMessage, error) {
+	var m SentMessage
+	var timestamp string
+	err := row.Scan(&m.QueueID, &m.ChatJID, &m.MessageID, &m.ServerID, &timestamp, &m.Text, &m.MediaID, &m.Source, &m.Campaign, &m.EditOf)
+	m.ServerTimestamp, _ = time.Parse(time.RFC3339, timestamp)
+	return m, err
+}
+
+// A sent message by its queue ID
+func dbGetSentMessage(userID int64, queueID string) (SentMessage, error) {
+	return scanSentMessage(db.QueryRow(`SELECT `+sentMessageColumns+` FROM sent_messages WHERE user_id = ? AND queue_id = ?`, userID, queueID))
+}
+
+// Sent messages, newest first, optionally of one chat; also returns the total count
+func dbListSentMessages(userID int64, chatJID string, limit, offset int) ([]SentMessage, int, error) {
+	where, args := `user_id = ?`, []interface{}{userID}
+	if chatJID != "" {
+		where += ` AND chat_jid = ?`
+		args = append(args, chatJID)
+	}
+	var total int
+	if err := readDB.QueryRow(`SELECT COUNT(*) FROM sent_messages WHERE `+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	rows, err := readDB.Query(`SELECT `+sentMessageColumns+` FROM sent_messages WHERE `+where+` ORDER BY server_timestamp DESC, rowid DESC LIMIT ? OFFSET ?`,
+		append(args, limit, offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	messages := []SentMessage{}
+	for rows.Next() {
+		m, err := scanSentMessage(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		messages = append(messages, m)
+	}
+	return messages, total, rows.Err()
+}
+
+// GET /api/messages/sent?chat_jid=&limit=&offset=
+func handleListSentMessages(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID := r.Context().Value("userID").(int64)
+
+	// Same chat_jid, limit and offset rules as the archive listing
+	q := r.URL.Query()
+	opts, err := parseMessageListOptions(url.Values{"chat_jid": {q.Get("chat_jid")}, "limit": {q.Get("limit")}, "offset": {q.Get("offset")}})
+	if err != nil {
+		apiError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	messages, total, err := dbListSentMessages(userID, opts.ChatJID, opts.Limit, opts.Offset)
+	if err != nil && err != sql.ErrNoRows {
+		fmt.Println("ERROR: Could not list sent messages for user", userID, err)
+		apiError(w, "Failed to load sent messages", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	if opts.Offset+len(messages) < total {
+		next := r.URL.Query()
+		next.Set("offset", strconv.Itoa(opts.Offset+opts.Limit))
+		w.Header().Set("Link", fmt.Sprintf(`<%s?%s>; rel="next"`, r.URL.Path, next.Encode()))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(messages)
+}
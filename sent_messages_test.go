@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSentMessagesRecordServerIDs(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+
+	email := "sentids@example.com"
+	_, apiKey := registerWithAPIKey(t, ts, email, "sentidspass123")
+	useFakeWAClient(t, email)
+
+	callbacks := make(chan map[string]interface{}, 1)
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		callbacks <- body
+	}))
+	defer callback.Close()
+
+	var queued map[string]interface{}
+	apiRequest(t, "POST", ts.URL+"/api/messages/send", apiKey, map[string]string{
+		"chat_jid": "14155550100@s.whatsapp.net", "message": "order shipped", "callback_url": callback.URL,
+	}, &queued)
+
+	var body map[string]interface{}
+	select {
+	case body = <-callbacks:
+	case <-time.After(15 * time.Second):
+		t.Fatalf("Timed out waiting for the sent callback")
+	}
+	messageID, _ := body["message_id"].(string)
+	if !strings.HasPrefix(messageID, "FAKE") {
+		t.Fatalf("Expected the WhatsApp message ID in the callback, got %v", body)
+	}
+	if _, err := time.Parse(time.RFC3339, body["server_timestamp"].(string)); err != nil {
+		t.Fatalf("Expected a server_timestamp in the callback, got %v", body)
+	}
+
+	var sent []SentMessage
+	resp := apiRequest(t, "GET", ts.URL+"/api/messages/sent", apiKey, nil, &sent)
+	if resp.StatusCode != 200 || resp.Header.Get("X-Total-Count") != "1" || len(sent) != 1 {
+		t.Fatalf("Unexpected listing: %d %+v", resp.StatusCode, sent)
+	}
+	if sent[0].QueueID != queued["queue_id"] || sent[0].MessageID != messageID || sent[0].Text != "order shipped" || sent[0].ServerTimestamp.IsZero() {
+		t.Fatalf("Unexpected sent message: %+v", sent[0])
+	}
+
+	apiRequest(t, "GET", ts.URL+"/api/messages/sent?chat_jid=14155550199", apiKey, nil, &sent)
+	if len(sent) != 0 {
+		t.Fatalf("Expected no messages for another chat, got %+v", sent)
+	}
+	if resp := apiRequest(t, "GET", ts.URL+"/api/messages/sent?limit=0", apiKey, nil, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for a bad limit, got %d", resp.StatusCode)
+	}
+}
@@ -15,6 +15,7 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -22,7 +23,6 @@ import (
 	"github.com/skip2/go-qrcode"
 	"go.mau.fi/whatsmeow"
 	waProto "go.mau.fi/whatsmeow/binary/proto"
-	"go.mau.fi/whatsmeow/store/sqlstore"
 	"go.mau.fi/whatsmeow/types"
 	"go.mau.fi/whatsmeow/types/events"
 	"golang.org/x/crypto/bcrypt"
@@ -49,19 +49,30 @@ const (
 
 // --- Message Queue System ---
 type QueuedMessage struct {
-	ID          string    `json:"id"`
-	UserEmail   string    `json:"user_email"`
-	ChatJID     string    `json:"chat_jid"`
-	Message     string    `json:"message"`
-	CallbackURL string    `json:"callback_url,omitempty"`
-	CreatedAt   time.Time `json:"created_at"`
-	Retries     int       `json:"retries"`
-	Status      string    `json:"status"` // "queued", "sending", "sent", "failed"
+	ID          string              `json:"id"`
+	UserEmail   string              `json:"user_email"`
+	ChatJID     string              `json:"chat_jid"`
+	Message     string              `json:"message"`
+	MediaID     string              `json:"media_id,omitempty"` // Uploaded media to send, Message is the caption
+	CallbackURL string              `json:"callback_url,omitempty"`
+	Campaign    string              `json:"campaign_id,omitempty"` // Campaign the message was sent for
+	Source      string              `json:"source,omitempty"`      // Where the send came from (SendRequest.Source)
+	CreatedAt   time.Time           `json:"created_at"`
+	Retries     int                 `json:"retries"`
+	Status      string              `json:"status"`                     // "pending_approval", "queued", "sending", "sent", "retrying", "failed", "rejected", "expired"
+	SentID      string              `json:"message_id,omitempty"`       // WhatsApp message ID, once sent
+	SentAt      *time.Time          `json:"server_timestamp,omitempty"` // When WhatsApp accepted it, once sent
+	ExpiresAt   *time.Time          `json:"expires_at,omitempty"`       // Dropped instead of sent after this (see queue_expiry.go)
+	GroupKey    string              `json:"group_key,omitempty"`        // Sent back-to-back with the same key (see queue_groups.go)
+	EditID      string              `json:"edit_of,omitempty"`          // WhatsApp ID of the message this edits (see message_edits.go)
+	Forwarded   bool                `json:"forwarded,omitempty"`        // Sent marked as forwarded (see message_forward.go)
+	Interactive *InteractiveMessage `json:"interactive,omitempty"`      // Buttons or list sent with the text (see interactive.go)
 }
 
 type MessageQueue struct {
 	UserEmail    string
 	Messages     []*QueuedMessage
+	Pending      []*QueuedMessage // Waiting for approval (see approvals.go)
 	LastSent     time.Time
 	BurstCount   int
 	HourlyCount  int
@@ -69,6 +80,9 @@ type MessageQueue struct {
 	HourlyReset  time.Time
 	DailyReset   time.Time
 	IsProcessing bool
+	Paused       bool      // Sending halted by the user; messages stay queued
+	Group        string    // group_key of the message being or last sent
+	GroupUntil   time.Time // Until when new parts of Group go to the front
 	mu           sync.RWMutex
 }
 
@@ -76,6 +90,7 @@ type MessageQueue struct {
 type WebhookLogEntry struct {
 	Timestamp time.Time              `json:"timestamp"`
 	Payload   map[string]interface{} `json:"payload"`
+	Responses []WebhookResponse      `json:"responses,omitempty"` // What each destination tried answered
 }
 
 var webhookLogs = struct {
@@ -85,22 +100,22 @@ var webhookLogs = struct {
 	logs: make(map[string][]WebhookLogEntry),
 }
 
-// Track recent chats per user
-var recentChats = struct {
-	mu   sync.Mutex
-	data map[string][]Chat // email -> recent chats
-}{
-	data: make(map[string][]Chat),
-}
-
 // --- Per-user WhatsApp session state ---
 type UserWAState struct {
 	waClient   *whatsmeow.Client
-	waStatus   string // "disconnected", "waiting_qr", "connected", "error"
+	waStatus   string // "disconnected", "connecting", "waiting_qr", "connected", "reconnecting", "logged_out", "error"
 	qrCode     string
 	loginState string
 	waCancel   context.CancelFunc
 	mu         sync.RWMutex
+
+	connectedSince time.Time // Zero unless connected
+	lastError      string
+	lastErrorAt    time.Time
+	qrExpiresAt    time.Time // When the current QR code is replaced
+	qrAttempt      int       // QR codes shown since the user clicked connect
+	qrRestarts     int       // QR flows restarted after running out of codes
+	lastSeenAt     time.Time // Last event from the client or passed health check (session_health.go)
 }
 
 // Map of email -> UserWAState
@@ -112,12 +127,32 @@ var waUsers = struct {
 }
 
 type Webhook struct {
-	ID          string    `json:"id"`
-	URL         string    `json:"url"`
-	Method      string    `json:"method"`       // "GET" or "POST"
-	FilterType  string    `json:"filter_type"`  // "all", "group", "chat"
-	FilterValue string    `json:"filter_value"` // Group/Chat ID (empty for "all")
-	CreatedAt   time.Time `json:"created_at"`
+	ID             string            `json:"id"`
+	URL            string            `json:"url"`
+	Method         string            `json:"method"`                      // "GET" or "POST"
+	FilterType     string            `json:"filter_type"`                 // "all", "group", "chat"
+	FilterValue    string            `json:"filter_value"`                // Chats, comma-separated; * wildcards, ! excludes (empty = any)
+	Tags           []string          `json:"tags"`                        // Labels for organizing/filtering webhooks
+	Paused         bool              `json:"paused"`                      // Paused webhooks receive no forwarded messages
+	Headers        map[string]string `json:"headers,omitempty"`           // Extra request headers; values may use {{secret.NAME}}
+	URLs           []string          `json:"urls,omitempty"`              // Extra destinations, tried/mirrored after URL in order
+	Policy         string            `json:"delivery_policy"`             // "all", "first-success" or "failover"
+	AutoReply      bool              `json:"auto_reply"`                  // Queue {"reply": ...} from the response back to WhatsApp
+	AllowedChats   []string          `json:"allowed_chats,omitempty"`     // Chats the /webhook/{id} receiver may send to (empty = any)
+	Events         []string          `json:"events,omitempty"`            // Event types delivered besides messages (e.g. "annotation.updated")
+	Keywords       []string          `json:"keywords,omitempty"`          // Route: messages containing one of these words
+	MatchRegex     string            `json:"match_regex,omitempty"`       // Route: messages whose text matches this pattern
+	Priority       int               `json:"priority,omitempty"`          // Routes are tried lowest priority first
+	Fallback       bool              `json:"fallback,omitempty"`          // Receives only messages no route matched
+	MaxPayload     int               `json:"max_payload_bytes,omitempty"` // Larger payloads are truncated (0 = no limit)
+	SampleRate     float64           `json:"sample_rate,omitempty"`       // Share of matching messages delivered (0 = all)
+	Redact         []string          `json:"redact,omitempty"`            // Redaction rules applied before delivery (e.g. "mask_phone")
+	Unverified     bool              `json:"unverified,omitempty"`        // Awaiting the verification challenge; receives nothing until then
+	Schedule       *WebhookSchedule  `json:"schedule,omitempty"`          // Days/hours it receives messages (nil = always)
+	LastDeliveryAt *time.Time        `json:"last_delivery_at,omitempty"`  // Last successful delivery
+	Alerts         []string          `json:"alerts,omitempty"`            // Alert rules firing for it (listing only, not stored)
+	Health         *WebhookHealth    `json:"health,omitempty"`            // Latest delivery outcome (listing only, not stored)
+	CreatedAt      time.Time         `json:"created_at"`
 }
 
 type UserWebhooks struct {
@@ -126,16 +161,18 @@ type UserWebhooks struct {
 
 // For recent chats endpoint
 type Chat struct {
-	ID   string `json:"id"`
-	Name string `json:"name"`
-	Type string `json:"type"` // "group" or "chat"
+	ID            string     `json:"id"`
+	Name          string     `json:"name"`
+	Type          string     `json:"type"` // "group" or "chat"
+	LastMessageAt *time.Time `json:"last_message_at,omitempty"`
+	LastText      string     `json:"last_text,omitempty"` // Snippet of the last message
+	Unread        bool       `json:"unread,omitempty"`
 }
 
 var webhookMu sync.Mutex
 
 func isAuthenticated(r *http.Request, sessionCookieName string) bool {
-	cookie, err := r.Cookie(sessionCookieName)
-	return err == nil && cookie.Value != ""
+	return getUserEmail(r, sessionCookieName) != ""
 }
 
 // API key authentication middleware
@@ -145,7 +182,7 @@ func requireAPIKey(next http.HandlerFunc) http.HandlerFunc {
 		fmt.Printf("DEBUG: Received API key: '%s'\n", apiKey)
 		if apiKey == "" {
 			fmt.Printf("DEBUG: No API key provided\n")
-			http.Error(w, "Missing API key. Include X-API-Key header.", 401)
+			apiError(w, "Missing API key. Include X-API-Key header.", 401)
 			return
 		}
 
@@ -153,13 +190,18 @@ func requireAPIKey(next http.HandlerFunc) http.HandlerFunc {
 		fmt.Printf("DEBUG: API key '%s' maps to user ID: %d\n", apiKey, userID)
 		if userID == 0 {
 			fmt.Printf("DEBUG: Invalid API key: '%s'\n", apiKey)
-			http.Error(w, "Invalid API key", 401)
+			apiError(w, "Invalid API key", 401)
 			return
 		}
 
 		fmt.Printf("DEBUG: API key authentication successful for user ID: %d\n", userID)
-		// Add user ID to request context for later use
+		if !allowAPIKeyRequest(w, apiKey) {
+			fmt.Printf("WARNING: Rate limit exceeded for API key of user ID: %d\n", userID)
+			return
+		}
+		// Add user ID (and the key, for per-key quotas) to request context for later use
 		ctx := context.WithValue(r.Context(), "userID", userID)
+		ctx = context.WithValue(ctx, "apiKey", apiKey)
 		next(w, r.WithContext(ctx))
 	}
 }
@@ -198,18 +240,26 @@ func getOrCreateQueue(userEmail string) *MessageQueue {
 		Messages:    make([]*QueuedMessage, 0),
 		HourlyReset: now.Add(time.Hour),
 		DailyReset:  now.Add(24 * time.Hour),
+		Paused:      dbGetQueuePaused(userEmail),
 	}
 	messageQueues[userEmail] = queue
 	return queue
 }
 
-func (q *MessageQueue) canSendMessage() bool {
-	q.mu.RLock()
-	defer q.mu.RUnlock()
+// A per-user sending limit that has been reached
+type SendLimit struct {
+	Name  string // LIMIT_HOURLY or LIMIT_DAILY
+	Max   int
+	Reset time.Time
+}
 
-	now := time.Now()
+func (q *MessageQueue) canSendMessage() bool {
+	return q.reachedLimit() == nil
+}
 
-	// Reset counters if needed
+// Reset the hourly and daily counters whose window has passed.
+// Must be called with q.mu locked.
+func (q *MessageQueue) resetLimitCounters(now time.Time) {
 	if now.After(q.HourlyReset) {
 		q.HourlyCount = 0
 		q.HourlyReset = now.Add(time.Hour)
@@ -218,18 +268,26 @@ func (q *MessageQueue) canSendMessage() bool {
 		q.DailyCount = 0
 		q.DailyReset = now.Add(24 * time.Hour)
 	}
+}
 
-	// Check daily limit
+// The sending limit the user is at, or nil if they can send
+func (q *MessageQueue) reachedLimit() *SendLimit {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.resetLimitCounters(time.Now())
+
+	// Check daily limit first: it is the longer wait
 	if q.DailyCount >= MAX_DAILY_MESSAGES {
-		return false
+		return &SendLimit{Name: LIMIT_DAILY, Max: MAX_DAILY_MESSAGES, Reset: q.DailyReset}
 	}
 
 	// Check hourly limit
 	if q.HourlyCount >= MAX_HOURLY_MESSAGES {
-		return false
+		return &SendLimit{Name: LIMIT_HOURLY, Max: MAX_HOURLY_MESSAGES, Reset: q.HourlyReset}
 	}
 
-	return true
+	return nil
 }
 
 func (q *MessageQueue) addMessage(msg *QueuedMessage) error {
@@ -240,12 +298,12 @@ func (q *MessageQueue) addMessage(msg *QueuedMessage) error {
 		return fmt.Errorf("queue full (max %d messages)", MAX_QUEUE_PER_USER)
 	}
 
-	q.Messages = append(q.Messages, msg)
+	q.insertAt(q.insertIndex(msg, time.Now()), msg)
 
 	// Start processing if not already running
-	if !q.IsProcessing {
+	if !q.IsProcessing && !q.Paused {
 		q.IsProcessing = true
-		go q.processQueue()
+		goBackground(q.processQueue)
 	}
 
 	return nil
@@ -263,49 +321,41 @@ func (q *MessageQueue) getQueuePosition(msgID string) int {
 	return -1
 }
 
-func (q *MessageQueue) estimateDelay(position int) time.Duration {
-	if position <= 0 {
-		return 0
-	}
-
-	baseDelay := time.Duration(position-1) * MESSAGE_DELAY
-
-	// Add burst cooldown if we're past burst allowance
-	burstCycles := (position - 1) / BURST_ALLOWANCE
-	if burstCycles > 0 {
-		baseDelay += time.Duration(burstCycles) * BURST_COOLDOWN
-	}
-
-	return baseDelay
-}
-
 // --- Anti-Detection Functions ---
 
-func addHumanDelay() {
+func addHumanDelay(ctx context.Context) {
 	// Random delay between 500ms-2000ms to simulate human typing
 	delay := time.Duration(500+mathrand.Intn(1500)) * time.Millisecond
-	time.Sleep(delay)
+	sleepContext(ctx, delay)
+}
+
+// How long typing is shown before a message is sent (simulate ~50 chars per second)
+func typingDuration(message string) time.Duration {
+	d := time.Duration(len(message)*20) * time.Millisecond
+	if d > 5*time.Second {
+		d = 5 * time.Second
+	}
+	if d < 500*time.Millisecond {
+		d = 500 * time.Millisecond
+	}
+	return d
 }
 
-func simulateTyping(client *whatsmeow.Client, chatJID types.JID, message string) {
+// Without indicate, the time is still taken but no typing is shown (presence policy)
+func simulateTyping(client WAClient, chatJID types.JID, message string, indicate bool) {
 	if client == nil {
 		return
 	}
 
-	// Calculate typing duration based on message length (simulate ~50 chars per second)
-	typingDuration := time.Duration(len(message)*20) * time.Millisecond
-	if typingDuration > 5*time.Second {
-		typingDuration = 5 * time.Second
+	// Send typing indicator
+	if indicate {
+		client.SendChatPresence(chatJID, types.ChatPresenceComposing, types.ChatPresenceMediaText)
 	}
-	if typingDuration < 500*time.Millisecond {
-		typingDuration = 500 * time.Millisecond
+	time.Sleep(typingDuration(message))
+	if indicate {
+		client.SendChatPresence(chatJID, types.ChatPresencePaused, types.ChatPresenceMediaText)
 	}
 
-	// Send typing indicator
-	client.SendChatPresence(chatJID, types.ChatPresenceComposing, types.ChatPresenceMediaText)
-	time.Sleep(typingDuration)
-	client.SendChatPresence(chatJID, types.ChatPresencePaused, types.ChatPresenceMediaText)
-
 	// Small pause after typing before sending
 	time.Sleep(time.Duration(100+mathrand.Intn(300)) * time.Millisecond)
 }
@@ -392,42 +442,42 @@ func isSpamPattern(message string, userEmail string) bool {
 	return false
 }
 
-func sendCallback(callbackURL, queueID, status string, messageID interface{}) {
-	if callbackURL == "" {
+// Report how a queued message ended to its callback_url. The callback is stored first
+// and retried until delivered (see callback_outbox.go). sent is WhatsApp's answer, for
+// "sent" callbacks.
+func sendCallback(msg *QueuedMessage, status string, sent *whatsmeow.SendResponse) {
+	if msg.CallbackURL == "" {
+		return
+	}
+	// Stored with its owner, so deleting the account drops it
+	userID, err := getUserIDByEmail(msg.UserEmail)
+	if err != nil {
+		fmt.Printf("WARNING: Dropped %s callback for message %s, its user is gone: %v\n", status, msg.ID, err)
 		return
 	}
 
+	callbackID := "cb_" + generateWebhookID()
 	payload := map[string]interface{}{
-		"queue_id": queueID,
-		"status":   status,
-		"sent_at":  time.Now().UTC().Format(time.RFC3339),
+		"callback_id": callbackID, // Same on every attempt, to drop duplicates
+		"queue_id":    msg.ID,
+		"status":      status,
+		"sent_at":     time.Now().UTC().Format(time.RFC3339),
 	}
 
-	if messageID != nil {
-		payload["message_id"] = messageID
+	if sent != nil {
+		for k, v := range sendResponseFields(*sent) {
+			payload[k] = v
+		}
 	}
 
 	payloadBytes, _ := json.Marshal(payload)
-
-	go func() {
-		resp, err := http.Post(callbackURL, "application/json", bytes.NewBuffer(payloadBytes))
-		if err != nil {
-			fmt.Printf("ERROR: Failed to send callback to %s: %v\n", callbackURL, err)
-			return
-		}
-		defer resp.Body.Close()
-
-		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
-			fmt.Printf("SUCCESS: Callback sent to %s for queue %s\n", callbackURL, queueID)
-		} else {
-			fmt.Printf("WARNING: Callback to %s returned status %d for queue %s\n", callbackURL, resp.StatusCode, queueID)
-		}
-	}()
+	enqueueCallback(userID, msg.CallbackURL, callbackID, payloadBytes)
 }
 
 // --- Queue Processing ---
 
-func (q *MessageQueue) processQueue() {
+// Send the queued messages until the queue is empty or paused, or the server stops
+func (q *MessageQueue) processQueue(ctx context.Context) {
 	defer func() {
 		q.mu.Lock()
 		q.IsProcessing = false
@@ -436,7 +486,7 @@ func (q *MessageQueue) processQueue() {
 
 	for {
 		q.mu.Lock()
-		if len(q.Messages) == 0 {
+		if len(q.Messages) == 0 || q.Paused || ctx.Err() != nil {
 			q.mu.Unlock()
 			break
 		}
@@ -452,7 +502,7 @@ func (q *MessageQueue) processQueue() {
 			q.mu.Lock()
 			q.Messages = append([]*QueuedMessage{msg}, q.Messages...)
 			q.mu.Unlock()
-			time.Sleep(time.Minute) // Wait a minute before retrying
+			sleepContext(ctx, time.Minute) // Wait a minute before retrying
 			continue
 		}
 
@@ -467,7 +517,7 @@ func (q *MessageQueue) processQueue() {
 				waitTime := BURST_COOLDOWN - timeSinceLastBurst
 				q.mu.Unlock()
 				fmt.Printf("INFO: Burst cooldown, waiting %v for user %s\n", waitTime, q.UserEmail)
-				time.Sleep(waitTime)
+				sleepContext(ctx, waitTime)
 				q.mu.Lock()
 				q.BurstCount = 0 // Reset burst count after cooldown
 			} else {
@@ -481,56 +531,91 @@ func (q *MessageQueue) processQueue() {
 			if timeSinceLastMessage < MESSAGE_DELAY {
 				waitTime := MESSAGE_DELAY - timeSinceLastMessage
 				q.mu.Unlock()
-				time.Sleep(waitTime)
+				sleepContext(ctx, waitTime)
 				q.mu.Lock()
 			}
 		}
 
+		// Paused (or stopped) while waiting: keep the message for when the queue resumes
+		if q.Paused || ctx.Err() != nil {
+			q.Messages = append([]*QueuedMessage{msg}, q.Messages...)
+			q.mu.Unlock()
+			break
+		}
+		q.mu.Unlock()
+
+		// Messages queued before receive-only mode was switched on are never sent
+		if dbGetReceiveOnly(q.UserEmail) {
+			q.mu.Lock()
+			previous := msg.Status
+			msg.Status = "failed"
+			q.mu.Unlock()
+			emitQueueEvent(msg, previous, msg.Status)
+			fmt.Printf("WARNING: Dropped message %s for receive-only user %s\n", msg.ID, q.UserEmail)
+			sendCallback(msg, "failed", nil)
+			campaignMessageDone(msg, "failed")
+			continue
+		}
+
+		// Waiting for its turn may have taken it past its expiry
+		if messageExpired(msg, time.Now()) {
+			q.expire(msg)
+			continue
+		}
+
+		q.mu.Lock()
+		previous := msg.Status
+		msg.Status = "sending"
+		q.holdGroup(msg, time.Now())
 		q.mu.Unlock()
+		emitQueueEvent(msg, previous, msg.Status)
 
 		// Send the message
 		success := q.sendMessage(msg)
 
+		done := ""
 		q.mu.Lock()
 		if success {
 			q.LastSent = time.Now()
 			q.BurstCount++
 			q.HourlyCount++
 			q.DailyCount++
+			q.holdGroup(msg, q.LastSent)
 			msg.Status = "sent"
+			done = msg.Status
 			fmt.Printf("SUCCESS: Sent queued message %s for user %s\n", msg.ID, q.UserEmail)
 		} else {
 			msg.Retries++
 			if msg.Retries < MAX_RETRIES {
-				// Put back in queue for retry
-				q.Messages = append(q.Messages, msg)
+				// Put back in queue for retry; a part of a group goes first so the rest follows it
+				if msg.GroupKey != "" {
+					q.insertAt(0, msg)
+				} else {
+					q.Messages = append(q.Messages, msg)
+				}
 				msg.Status = "retrying"
 				fmt.Printf("RETRY: Message %s failed, retry %d/%d for user %s\n", msg.ID, msg.Retries, MAX_RETRIES, q.UserEmail)
 			} else {
 				msg.Status = "failed"
+				done = msg.Status
 				fmt.Printf("FAILED: Message %s failed permanently after %d retries for user %s\n", msg.ID, MAX_RETRIES, q.UserEmail)
-				sendCallback(msg.CallbackURL, msg.ID, "failed", nil)
+				sendCallback(msg, "failed", nil)
 			}
 		}
+		status := msg.Status
 		q.mu.Unlock()
+		emitQueueEvent(msg, "sending", status)
+		if done != "" {
+			campaignMessageDone(msg, done)
+			recordSendOutcome(q.UserEmail, done == "failed")
+		}
 
 		// Random delay between messages to appear more human
-		addHumanDelay()
+		addHumanDelay(ctx)
 	}
 }
 
 func (q *MessageQueue) sendMessage(msg *QueuedMessage) bool {
-	// Get WhatsApp client for this user
-	state := getUserWAState(msg.UserEmail)
-	state.mu.RLock()
-	client := state.waClient
-	state.mu.RUnlock()
-
-	if client == nil {
-		fmt.Printf("ERROR: WhatsApp client not connected for user %s\n", msg.UserEmail)
-		return false
-	}
-
 	// Parse chat JID
 	chatJID, err := types.ParseJID(msg.ChatJID)
 	if err != nil {
@@ -538,20 +623,80 @@ func (q *MessageQueue) sendMessage(msg *QueuedMessage) bool {
 		return false
 	}
 
+	// Get the WhatsApp client (or Telegram/Signal channel) for this chat
+	client := userClientForChat(msg.UserEmail, chatJID)
+	if client == nil {
+		fmt.Printf("ERROR: No client connected for %s of user %s\n", msg.ChatJID, msg.UserEmail)
+		return false
+	}
+
 	// Anti-detection: simulate human behavior
-	simulateTyping(client, chatJID, msg.Message)
+	simulateTyping(client, chatJID, msg.Message, showsTyping(msg.UserEmail))
+
+	// A hung upload or send fails the message instead of stalling the queue
+	ctx, cancel := context.WithTimeout(context.Background(), waSendTimeout)
+	defer cancel()
+	outgoing := &waProto.Message{Conversation: &msg.Message}
+	if msg.MediaID != "" {
+		userID, err := getUserIDByEmail(msg.UserEmail)
+		if err != nil {
+			fmt.Printf("ERROR: Could not resolve user %s: %v\n", msg.UserEmail, err)
+			return false
+		}
+		upload, err := dbGetMediaUpload(userID, msg.MediaID)
+		if err != nil {
+			fmt.Printf("ERROR: Media %s unavailable for message %s: %v\n", msg.MediaID, msg.ID, err)
+			return false
+		}
+		outgoing, err = buildMediaMessage(ctx, client, upload, msg.Message)
+		if err != nil {
+			fmt.Printf("ERROR: Failed to prepare media for message %s: %v\n", msg.ID, err)
+			return false
+		}
+	}
+	if msg.Interactive != nil {
+		if chatChannel(msg.ChatJID) == "" {
+			outgoing = buildInteractiveMessage(msg.Message, msg.Interactive)
+		} else {
+			fallback := interactiveFallbackText(msg.Message, msg.Interactive)
+			outgoing = &waProto.Message{Conversation: &fallback}
+		}
+	}
+	if msg.Forwarded && chatChannel(msg.ChatJID) == "" {
+		outgoing = markForwarded(outgoing)
+	}
+	if msg.EditID != "" {
+		outgoing = buildEditMessage(chatJID, msg.EditID, outgoing)
+	}
 
 	// Send the message
-	msgID, err := client.SendMessage(context.Background(), chatJID, &waProto.Message{
-		Conversation: &msg.Message,
-	})
+	resp, err := client.SendMessage(ctx, chatJID, outgoing)
 	if err != nil {
 		fmt.Printf("ERROR: Failed to send message %s: %v\n", msg.ID, err)
 		return false
 	}
 
+	snippet := truncateRunes(msg.Message, CHAT_SNIPPET_LENGTH)
+	if snippet == "" {
+		snippet = "[media]"
+	}
+	recordChatActivity(msg.UserEmail, chatJID.String(), "", chatTypeForJID(chatJID.String()), snippet, false, time.Now())
+
+	sentAt := sendTimestamp(resp)
+	q.mu.Lock()
+	msg.SentID = string(resp.ID)
+	msg.SentAt = &sentAt
+	q.mu.Unlock()
+
+	// Keep the message and server IDs, for receipts and later deletes or edits
+	if userID, err := getUserIDByEmail(msg.UserEmail); err == nil {
+		if err := dbRecordSentMessage(userID, msg, resp); err != nil {
+			fmt.Printf("ERROR: Could not record sent message %s: %v\n", msg.ID, err)
+		}
+	}
+
 	// Send success callback
-	sendCallback(msg.CallbackURL, msg.ID, "sent", msgID)
+	sendCallback(msg, "sent", &resp)
 
 	return true
 }
@@ -562,7 +707,7 @@ func getUserEmail(r *http.Request, sessionCookieName string) string {
 	if err != nil || cookie.Value == "" {
 		return ""
 	}
-	return cookie.Value
+	return sessionEmail(cookie.Value)
 }
 
 // Helper: get or create the UserWAState for a user
@@ -578,10 +723,19 @@ func getUserWAState(email string) *UserWAState {
 }
 
 // Send the webhook HTTP request (POST or GET)
-func sendWebhook(wh Webhook, payload map[string]interface{}, webhookURL string, method string) error {
+// Returns the (size-limited) response body on success
+func sendWebhook(wh Webhook, payload map[string]interface{}, webhookURL string, method string) ([]byte, error) {
+	body, _, err := sendWebhookCapture(wh, payload, webhookURL, method, 0)
+	return body, err
+}
+
+// sendWebhook, also returning what the destination (its index in the webhook's URLs)
+// answered for the delivery log
+func sendWebhookCapture(wh Webhook, payload map[string]interface{}, webhookURL string, method string, destination int) ([]byte, WebhookResponse, error) {
 	var req *http.Request
 	var err error
-	client := &http.Client{Timeout: 10 * time.Second}
+	client := webhookHTTPClient()
+	start := time.Now()
 
 	if method == "GET" {
 		// For GET, encode payload as query params
@@ -605,16 +759,25 @@ func sendWebhook(wh Webhook, payload map[string]interface{}, webhookURL string,
 		req.Header.Set("Content-Type", "application/json")
 	}
 	if err != nil {
-		return err
+		return nil, captureWebhookResponse(destination, nil, nil, start, err), err
+	}
+	for k, v := range wh.Headers {
+		req.Header.Set(k, v)
 	}
 
 	resp, err := client.Do(req)
 	if err != nil {
-		return err
+		return nil, captureWebhookResponse(destination, nil, nil, start, err), err
 	}
 	defer resp.Body.Close()
 	fmt.Printf("DEBUG: Webhook %s sent, status: %d\n", wh.ID, resp.StatusCode)
-	return nil
+	// Error responses are read too, since they usually say what was wrong
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, MAX_WEBHOOK_RESPONSE_BYTES))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		err = fmt.Errorf("webhook %s returned status %d", wh.ID, resp.StatusCode)
+		return nil, captureWebhookResponse(destination, resp, body, start, err), err
+	}
+	return body, captureWebhookResponse(destination, resp, body, start, nil), nil
 }
 
 // Helper: Forward WhatsApp message to all user webhooks
@@ -626,20 +789,53 @@ func forwardToWebhooks(email string, payload map[string]interface{}, mediaPath s
 		return
 	}
 	fmt.Printf("DEBUG: [FORWARD] userID: %d\n", userID)
+	recordMessageReceived(email, time.Now())
+
+	// Add an ISO-8601 timestamp localized to the user's timezone (epoch is kept as-is)
+	if ts, ok := payload["timestamp"].(int64); ok {
+		loc := getUserLocation(userID)
+		payload["timestamp_iso"] = formatLocalTime(time.Unix(ts, 0), loc)
+		payload["timezone"] = loc.String()
+	}
+
+	// Classify the message with the user's LLM endpoint, if configured
+	enrichPayload(email, userID, payload)
 
 	// Extract message info for filtering and chat tracking
 	fromJID, _ := payload["from"].(string) // Individual sender
 	chatJID, _ := payload["to"].(string)   // Chat/Group where message was sent
+	chatLID, _ := payload["to_lid"].(string)
 	fromName, _ := payload["name"].(string)
 	fmt.Printf("DEBUG: Message from JID: %s, in Chat: %s, Name: %s\n", fromJID, chatJID, fromName)
 
-	// Track recent chat for this user (use chatJID for tracking, not fromJID)
+	// Track recent chat for this user (use chatJID for tracking, not fromJID).
+	// The sender's name only names direct chats, not groups.
 	if chatJID != "" {
-		chatType := "chat"
-		if strings.HasSuffix(chatJID, "@g.us") {
-			chatType = "group"
+		// Group name filters need the group's subject
+		loadGroupSubject(email, chatJID)
+		chatType := chatTypeForJID(chatJID)
+		chatName := fromName
+		if chatType == "group" {
+			chatName = ""
+		}
+		at := time.Now()
+		if ts, ok := payload["timestamp"].(int64); ok {
+			at = time.Unix(ts, 0)
+		}
+		recordChatActivity(email, chatJID, chatName, chatType, chatSnippet(payload), true, at)
+		recordCampaignReply(userID, chatJID, payload, at)
+		assignee := routeConversation(email, userID, chatJID, payload)
+		if err := archiveMessage(userID, chatJID, payload, assignee); err != nil {
+			fmt.Printf("ERROR: Could not archive message for %s: %v\n", email, err)
+		}
+		// Chats handled by the LLM bot don't also get the auto-responder. The bot replies
+		// once the webhooks are delivered, so its writes don't race theirs.
+		if botChat, err := dbGetBotChat(userID, chatJID); err == nil && botChat.Active {
+			defer llmBotRespond(email, userID, chatJID, payload)
+		} else {
+			autoRespond(email, userID, chatJID)
 		}
-		addRecentChat(email, chatJID, fromName, chatType)
+		deliverToSinks(userID, chatJID, chatLID, payload)
 	}
 
 	// Load webhooks from the database for this user
@@ -650,70 +846,82 @@ func forwardToWebhooks(email string, payload map[string]interface{}, mediaPath s
 	}
 	fmt.Printf("DEBUG: Found %d webhooks for user %s\n", len(webhooks), email)
 
+	// Load secrets once for {{secret.NAME}} references in webhook URLs/headers
+	secrets, err := dbGetSecretValues(userID)
+	if err != nil {
+		fmt.Printf("ERROR: [FORWARD] Could not load secrets for user %s: %v\n", email, err)
+		return
+	}
+
 	// Load BASE_URL from environment
 	baseURL := os.Getenv("BASE_URL")
 	if baseURL == "" {
 		fmt.Println("ERROR: BASE_URL environment variable is not set. Media URLs will be invalid for external services.")
 	}
 
-	for _, wh := range webhooks {
-		fmt.Printf("DEBUG: Checking webhook %s with filter_type=%s, filter_value=%s\n",
-			wh.ID, wh.FilterType, wh.FilterValue)
-
-		// Check if message should be forwarded to this webhook
-		shouldForward := false
+	// Pick webhooks by chat filter and keyword routing
+	text, _ := payload["text"].(string)
+	if text == "" {
+		text, _ = payload["caption"].(string)
+	}
+	selected := selectWebhooksForMessage(webhooks, chatJID, chatLID, text)
+	fmt.Printf("DEBUG: %d of %d webhooks selected for message from %s\n", len(selected), len(webhooks), fromJID)
 
-		switch wh.FilterType {
-		case "all", "":
-			shouldForward = true
-			fmt.Printf("DEBUG: Webhook %s accepts all messages\n", wh.ID)
-		case "group":
-			// For group filter, compare chatJID (where message was sent) with filter_value
-			if chatJID != "" && strings.HasSuffix(chatJID, "@g.us") {
-				if wh.FilterValue == "" || chatJID == wh.FilterValue {
-					shouldForward = true
-					fmt.Printf("DEBUG: Webhook %s accepts group message in chat %s\n", wh.ID, chatJID)
-				} else {
-					fmt.Printf("DEBUG: Webhook %s rejects group message - expected %s, got %s\n", wh.ID, wh.FilterValue, chatJID)
-				}
-			}
-		case "chat":
-			// For chat filter, compare chatJID (where message was sent) with filter_value
-			if chatJID != "" && strings.HasSuffix(chatJID, "@s.whatsapp.net") {
-				if wh.FilterValue == "" || chatJID == wh.FilterValue {
-					shouldForward = true
-					fmt.Printf("DEBUG: Webhook %s accepts chat message in chat %s\n", wh.ID, chatJID)
-				} else {
-					fmt.Printf("DEBUG: Webhook %s rejects chat message - expected %s, got %s\n", wh.ID, wh.FilterValue, chatJID)
-				}
+	for _, wh := range selected {
+		// If media_url is present, make it absolute
+		if murl, ok := payload["media_url"].(string); ok && murl != "" && baseURL != "" {
+			if !strings.HasPrefix(murl, "http://") && !strings.HasPrefix(murl, "https://") {
+				payload["media_url"] = strings.TrimRight(baseURL, "/") + murl
 			}
 		}
-
-		if shouldForward {
-			// If media_url is present, make it absolute
-			if murl, ok := payload["media_url"].(string); ok && murl != "" && baseURL != "" {
-				if !strings.HasPrefix(murl, "http://") && !strings.HasPrefix(murl, "https://") {
-					payload["media_url"] = strings.TrimRight(baseURL, "/") + murl
-				}
-			}
-			fmt.Printf("DEBUG: Forwarding to webhook %s (%s) at URL: %s\n", wh.ID, wh.Method, wh.URL)
-			addWebhookLog(wh.ID, payload)
-			err := sendWebhook(wh, payload, wh.URL, wh.Method)
-			if err != nil {
-				fmt.Printf("ERROR: Failed to send webhook: %v\n", err)
-			}
-		} else {
-			fmt.Printf("DEBUG: Webhook %s filtered out message from %s\n", wh.ID, fromJID)
+		if messageID, _ := payload["id"].(string); !webhookSamples(wh, chatJID, messageID) {
+			fmt.Printf("DEBUG: Message not sampled for webhook %s (rate %g)\n", wh.ID, wh.SampleRate)
+			continue
 		}
+		if !webhookScheduleOpen(userID, wh, time.Now()) {
+			holdOffHoursMessage(userID, wh, payload)
+			continue
+		}
+		// Messages held while the window was closed go first
+		if wh.Schedule != nil && wh.Schedule.Buffer {
+			flushWebhookBuffer(email, userID, wh, secrets)
+		}
+		deliverMessageToWebhook(email, userID, wh, secrets, payload)
+	}
+}
+
+// Deliver a message to one webhook with its secrets, redaction and size limit applied,
+// recording the outcome and queueing any auto reply
+func deliverMessageToWebhook(email string, userID int64, wh Webhook, secrets map[string]string, payload map[string]interface{}) {
+	fmt.Printf("DEBUG: Forwarding to webhook %s (%s) at URL: %s\n", wh.ID, wh.Method, wh.URL)
+	resolved, err := resolveWebhookSecrets(wh, secrets)
+	if err != nil {
+		fmt.Printf("ERROR: Webhook %s not sent: %v\n", wh.ID, err)
+		return
+	}
+	redacted := redactWebhookPayload(wh, payload)
+	start := time.Now()
+	respBody, responses, err := deliverWebhookCapture(resolved, limitWebhookPayload(userID, wh, redacted))
+	recordWebhookDelivery(wh.ID, start, err)
+	addWebhookLog(wh.ID, redacted, start, loggedResponses(wh, responses))
+	if err != nil {
+		fmt.Printf("ERROR: Failed to send webhook: %v\n", err)
+	} else {
+		dbSetWebhookLastDelivery(wh.ID, time.Now())
+	}
+	if wh.AutoReply && respBody != nil {
+		chatJID, _ := payload["to"].(string)
+		queueWebhookReply(email, wh, chatJID, respBody)
 	}
 }
 
-func addWebhookLog(webhookID string, payload map[string]interface{}) {
+func addWebhookLog(webhookID string, payload map[string]interface{}, at time.Time, responses []WebhookResponse) {
 	webhookLogs.mu.Lock()
 	defer webhookLogs.mu.Unlock()
 	entry := WebhookLogEntry{
-		Timestamp: time.Now(),
+		Timestamp: at,
 		Payload:   payload,
+		Responses: responses,
 	}
 	entries := webhookLogs.logs[webhookID]
 	entries = append(entries, entry)
@@ -729,71 +937,9 @@ func getWebhookLogs(webhookID string) []WebhookLogEntry {
 	return append([]WebhookLogEntry(nil), webhookLogs.logs[webhookID]...)
 }
 
-// Add or update recent chat for a user
-func addRecentChat(email string, chatID string, chatName string, chatType string) {
-	if chatID == "" {
-		return // Skip empty chat IDs
-	}
-
-	fmt.Printf("DEBUG: Adding recent chat for %s: %s (%s) - %s\n", email, chatID, chatName, chatType)
-
-	recentChats.mu.Lock()
-	defer recentChats.mu.Unlock()
-
-	chats := recentChats.data[email]
-
-	// Check if chat already exists and update it
-	for i, existingChat := range chats {
-		if existingChat.ID == chatID {
-			// Update existing chat (move to front and update name if provided)
-			if chatName != "" {
-				chats[i].Name = chatName
-			}
-			// Move to front
-			chat := chats[i]
-			copy(chats[1:i+1], chats[0:i])
-			chats[0] = chat
-			recentChats.data[email] = chats
-			return
-		}
-	}
-
-	// Add new chat at the front
-	newChat := Chat{
-		ID:   chatID,
-		Name: chatName,
-		Type: chatType,
-	}
-	chats = append([]Chat{newChat}, chats...)
-
-	// Keep only the 10 most recent chats
-	if len(chats) > 10 {
-		chats = chats[:10]
-	}
-
-	recentChats.data[email] = chats
-	fmt.Printf("DEBUG: Now tracking %d recent chats for %s\n", len(chats), email)
-}
-
-// Get recent chats for a user
-func getRecentChats(email string) []Chat {
-	recentChats.mu.Lock()
-	defer recentChats.mu.Unlock()
-
-	chats := recentChats.data[email]
-	if chats == nil {
-		return []Chat{}
-	}
-
-	// Return a copy to avoid concurrent modification
-	result := make([]Chat, len(chats))
-	copy(result, chats)
-	return result
-}
-
 func initDB(dbPath string) error {
-	var err error
-	db, err = sql.Open("sqlite", dbPath)
+	// WAL, busy timeout and the read pool (see db_tuning.go)
+	err := openDB(dbPath)
 	if err != nil {
 		return err
 	}
@@ -818,132 +964,802 @@ func initDB(dbPath string) error {
 		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
 		FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
 	)`)
-	return err
-}
-
-func hashPassword(password string) (string, error) {
-	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-	return string(hash), err
-}
-
-func checkPassword(hash, password string) error {
-	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
-}
-
-// Start media cleanup goroutine
-func startMediaCleanup(mediaDir string) {
-	ticker := time.NewTicker(1 * time.Hour)
-	go func() {
-		for range ticker.C {
-			now := time.Now()
-			filepath.Walk(mediaDir, func(path string, info os.FileInfo, err error) error {
-				if err != nil || info.IsDir() {
-					return nil
-				}
-				// Delete files older than 24 hours
-				if now.Sub(info.ModTime()) > 24*time.Hour {
-					os.Remove(path)
-					fmt.Printf("Deleted expired media file: %s\n", path)
-				}
-				return nil
-			})
-		}
-	}()
-}
-
-// Refactor startServer to accept a *http.ServeMux argument and register all handlers on it
-func startServer(mux *http.ServeMux, port, sessionCookieName, dbPath, mediaDir, waSessionPrefix string) {
-	fmt.Printf("DEBUG: Starting server with API key middleware enabled\n")
-	if err := initDB(dbPath); err != nil {
-		panic("Failed to initialize DB: " + err.Error())
+	if err != nil {
+		return err
 	}
-
-	// Start media cleanup goroutine
-	startMediaCleanup(mediaDir)
-
-	// Register all handlers on mux instead of http.DefaultServeMux
-	mux.HandleFunc("/api/register", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
-		var creds struct {
-			Email    string `json:"email"`
-			Password string `json:"password"`
-		}
-		if err := json.NewDecoder(r.Body).Decode(&creds); err != nil || creds.Email == "" || creds.Password == "" {
-			http.Error(w, "Invalid request", http.StatusBadRequest)
-			return
-		}
-		pwHash, err := hashPassword(creds.Password)
-		if err != nil {
-			http.Error(w, "Failed to hash password", http.StatusInternalServerError)
-			return
-		}
-		_, err = db.Exec("INSERT INTO users (email, password_hash) VALUES (?, ?)", creds.Email, pwHash)
-		if err != nil {
-			if strings.Contains(err.Error(), "UNIQUE") {
-				http.Error(w, "Email already registered", http.StatusConflict)
-				return
-			}
-			http.Error(w, "Failed to register", http.StatusInternalServerError)
-			return
-		}
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(`{"success":true}`))
-	})
-	// --- API: Login (updated for DB users) ---
-	mux.HandleFunc("/api/login", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
-		var creds struct {
-			Email    string `json:"email"`
-			Password string `json:"password"`
-		}
-		err := json.NewDecoder(r.Body).Decode(&creds)
-		if err != nil {
-			http.Error(w, "Invalid request", http.StatusBadRequest)
-			return
-		}
-		var pwHash string
-		row := db.QueryRow("SELECT password_hash FROM users WHERE email = ?", creds.Email)
-		err = row.Scan(&pwHash)
-		if err == sql.ErrNoRows {
-			http.Error(w, "Invalid credentials", http.StatusUnauthorized)
-			return
-		} else if err != nil {
-			http.Error(w, "Server error", http.StatusInternalServerError)
-			return
-		}
-		if checkPassword(pwHash, creds.Password) != nil {
-			http.Error(w, "Invalid credentials", http.StatusUnauthorized)
-			return
-		}
-		http.SetCookie(w, &http.Cookie{
-			Name:     sessionCookieName,
-			Value:    creds.Email,
-			Path:     "/",
-			HttpOnly: true,
-			Expires:  time.Now().Add(24 * time.Hour),
-		})
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(`{"success":true}`))
-	})
-
-	// --- API: Logout ---
-	mux.HandleFunc("/api/logout", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
-		http.SetCookie(w, &http.Cookie{
-			Name:     sessionCookieName,
-			Value:    "",
-			Path:     "/",
-			HttpOnly: true,
-			Expires:  time.Now().Add(-1 * time.Hour),
+	// Per-user timezone for localized timestamps
+	if err := addColumnIfMissing("users", "timezone", "TEXT NOT NULL DEFAULT 'UTC'"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing("users", "queue_paused", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing("users", "receive_only", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing("users", "presence_mode", "TEXT NOT NULL DEFAULT 'default'"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing("users", "approval_mode", "TEXT NOT NULL DEFAULT 'off'"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing("users", "routing_policy", "TEXT NOT NULL DEFAULT 'off'"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing("users", "api_key_allowed_chats", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	// Signing key of status widget tokens; rotated to revoke them
+	if err := addColumnIfMissing("users", "widget_key", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	// Webhook tags (comma-separated) and paused flag
+	if err := addColumnIfMissing("webhooks", "tags", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing("webhooks", "paused", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	// Custom webhook request headers (JSON object)
+	if err := addColumnIfMissing("webhooks", "headers", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing("webhooks", "urls", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing("webhooks", "delivery_policy", "TEXT NOT NULL DEFAULT 'all'"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing("webhooks", "auto_reply", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing("webhooks", "allowed_chats", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing("webhooks", "last_delivery_at", "TEXT"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing("webhooks", "events", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	// Keyword routing rule
+	if err := addColumnIfMissing("webhooks", "keywords", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing("webhooks", "match_regex", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing("webhooks", "priority", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing("webhooks", "fallback", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing("webhooks", "max_payload_bytes", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing("webhooks", "redact", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing("webhooks", "unverified", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing("webhooks", "schedule", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing("webhooks", "sample_rate", "REAL NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	// Send capacity reserved for campaigns (schedule is a JSON array of slots)
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS capacity_reservations (
+		id TEXT PRIMARY KEY,
+		user_id INTEGER NOT NULL,
+		name TEXT NOT NULL DEFAULT '',
+		count INTEGER NOT NULL,
+		used INTEGER NOT NULL DEFAULT 0,
+		schedule TEXT NOT NULL,
+		created_at TEXT NOT NULL,
+		expires_at INTEGER NOT NULL,
+		FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+	)`)
+	if err != nil {
+		return err
+	}
+	// Drip campaigns and their audiences (times as Unix seconds)
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS campaigns (
+		id TEXT PRIMARY KEY,
+		user_id INTEGER NOT NULL,
+		name TEXT NOT NULL DEFAULT '',
+		template TEXT NOT NULL,
+		interval_seconds INTEGER NOT NULL,
+		reservation_id TEXT NOT NULL DEFAULT '',
+		status TEXT NOT NULL,
+		start_at INTEGER NOT NULL,
+		next_send_at INTEGER NOT NULL,
+		created_at TEXT NOT NULL,
+		started_at INTEGER,
+		finished_at INTEGER,
+		FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+	)`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS campaign_recipients (
+		campaign_id TEXT NOT NULL,
+		position INTEGER NOT NULL,
+		chat_jid TEXT NOT NULL,
+		vars TEXT NOT NULL DEFAULT '',
+		status TEXT NOT NULL,
+		queue_id TEXT NOT NULL DEFAULT '',
+		error TEXT NOT NULL DEFAULT '',
+		sent_at INTEGER,
+		replied_at INTEGER,
+		reply TEXT NOT NULL DEFAULT '',
+		PRIMARY KEY(campaign_id, position),
+		FOREIGN KEY(campaign_id) REFERENCES campaigns(id) ON DELETE CASCADE
+	)`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_campaign_recipients_chat ON campaign_recipients(chat_jid, sent_at)`)
+	if err != nil {
+		return err
+	}
+	if err := addColumnIfMissing("campaigns", "variants", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing("campaign_recipients", "variant", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	// Full versions of payloads truncated for a webhook's size limit
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS webhook_payloads (
+		id TEXT PRIMARY KEY,
+		user_id INTEGER NOT NULL,
+		webhook_id TEXT NOT NULL,
+		payload TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+	)`)
+	if err != nil {
+		return err
+	}
+	// Off-hours messages held for webhooks with a buffering schedule
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS webhook_buffer (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		webhook_id TEXT NOT NULL,
+		payload TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+	)`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_webhook_buffer_webhook ON webhook_buffer(webhook_id, id)`)
+	if err != nil {
+		return err
+	}
+	// Send callbacks waiting for delivery or a retry (see callback_outbox.go)
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS callback_outbox (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		callback_id TEXT NOT NULL,
+		callback_url TEXT NOT NULL,
+		payload TEXT NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		next_attempt_at INTEGER NOT NULL,
+		last_error TEXT NOT NULL DEFAULT '',
+		created_at INTEGER NOT NULL
+	)`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_callback_outbox_due ON callback_outbox(next_attempt_at)`)
+	if err != nil {
+		return err
+	}
+	// Owner of a callback, deleted with the account (0 for callbacks stored before)
+	if err := addColumnIfMissing("callback_outbox", "user_id", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	// Messages sent from the queue, with WhatsApp's message ID and server timestamp
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS sent_messages (
+		user_id INTEGER NOT NULL,
+		queue_id TEXT NOT NULL,
+		chat_jid TEXT NOT NULL,
+		message_id TEXT NOT NULL,
+		server_id INTEGER NOT NULL DEFAULT 0,
+		server_timestamp TEXT NOT NULL,
+		text TEXT NOT NULL DEFAULT '',
+		media_id TEXT NOT NULL DEFAULT '',
+		source TEXT NOT NULL DEFAULT '',
+		campaign_id TEXT NOT NULL DEFAULT '',
+		PRIMARY KEY (user_id, queue_id),
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	)`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_sent_messages_chat ON sent_messages(user_id, chat_jid, server_timestamp)`)
+	if err != nil {
+		return err
+	}
+	if err := addColumnIfMissing("sent_messages", "edit_of", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	// Per-user secrets referenced from webhook URLs/headers as {{secret.NAME}}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS secrets (
+		user_id INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		value TEXT NOT NULL,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY(user_id, name),
+		FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+	)`)
+	if err != nil {
+		return err
+	}
+	// Outgoing media uploaded via single-use upload URLs
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS media_uploads (
+		id TEXT PRIMARY KEY,
+		user_id INTEGER NOT NULL,
+		token TEXT UNIQUE,
+		status TEXT NOT NULL,
+		media_type TEXT NOT NULL DEFAULT '',
+		file_name TEXT NOT NULL DEFAULT '',
+		mime_type TEXT NOT NULL DEFAULT '',
+		size INTEGER NOT NULL DEFAULT 0,
+		file_path TEXT NOT NULL DEFAULT '',
+		expires_at DATETIME NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+	)`)
+	if err != nil {
+		return err
+	}
+	// Last activity per chat, for the dashboard's chat picker
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS recent_chats (
+		user_id INTEGER NOT NULL,
+		chat_jid TEXT NOT NULL,
+		name TEXT NOT NULL DEFAULT '',
+		type TEXT NOT NULL,
+		last_message_at TEXT NOT NULL,
+		last_text TEXT NOT NULL DEFAULT '',
+		unread INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY(user_id, chat_jid),
+		FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+	)`)
+	if err != nil {
+		return err
+	}
+	// Full text extracted from received documents
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS document_texts (
+		user_id INTEGER NOT NULL,
+		chat_jid TEXT NOT NULL,
+		message_id TEXT NOT NULL,
+		text TEXT NOT NULL,
+		created_at TEXT NOT NULL,
+		PRIMARY KEY(user_id, chat_jid, message_id),
+		FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+	)`)
+	if err != nil {
+		return err
+	}
+	// Index of received media files per chat (used for archive downloads)
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS chat_media (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		chat_jid TEXT NOT NULL,
+		message_id TEXT NOT NULL,
+		media_type TEXT NOT NULL,
+		file_path TEXT NOT NULL,
+		timestamp TEXT NOT NULL,
+		FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+	)`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_chat_media_chat ON chat_media(user_id, chat_jid, timestamp)`)
+	if err != nil {
+		return err
+	}
+	// Received messages, with their annotation state for the shared inbox
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS messages (
+		user_id INTEGER NOT NULL,
+		chat_jid TEXT NOT NULL,
+		message_id TEXT NOT NULL,
+		sender TEXT NOT NULL DEFAULT '',
+		type TEXT NOT NULL DEFAULT '',
+		text TEXT NOT NULL DEFAULT '',
+		payload TEXT NOT NULL,
+		timestamp TEXT NOT NULL,
+		state TEXT NOT NULL DEFAULT 'open',
+		assigned_to TEXT NOT NULL DEFAULT '',
+		note TEXT NOT NULL DEFAULT '',
+		annotated_at TEXT,
+		PRIMARY KEY(user_id, chat_jid, message_id),
+		FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+	)`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_messages_user_time ON messages(user_id, timestamp)`)
+	if err != nil {
+		return err
+	}
+	// Shared inbox agents and the chats routed to them
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS agents (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		email TEXT NOT NULL DEFAULT '',
+		webhook_url TEXT NOT NULL DEFAULT '',
+		keywords TEXT NOT NULL DEFAULT '',
+		active INTEGER NOT NULL DEFAULT 1,
+		last_assigned_at TEXT,
+		created_at TEXT NOT NULL,
+		UNIQUE(user_id, name),
+		FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+	)`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS conversation_assignments (
+		user_id INTEGER NOT NULL,
+		chat_jid TEXT NOT NULL,
+		agent_id INTEGER NOT NULL,
+		reason TEXT NOT NULL,
+		assigned_at TEXT NOT NULL,
+		PRIMARY KEY(user_id, chat_jid),
+		FOREIGN KEY(agent_id) REFERENCES agents(id) ON DELETE CASCADE
+	)`)
+	if err != nil {
+		return err
+	}
+	// Per-user canned responses, by shortcut
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS canned_responses (
+		user_id INTEGER NOT NULL,
+		shortcut TEXT NOT NULL,
+		text TEXT NOT NULL,
+		updated_at TEXT NOT NULL,
+		PRIMARY KEY(user_id, shortcut),
+		FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+	)`)
+	if err != nil {
+		return err
+	}
+	// Auto-responder settings, and the last auto-reply per chat (Unix seconds)
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS auto_responders (
+		user_id INTEGER PRIMARY KEY,
+		enabled INTEGER NOT NULL DEFAULT 0,
+		mode TEXT NOT NULL,
+		message TEXT NOT NULL,
+		business_hours TEXT NOT NULL DEFAULT '[]',
+		window_minutes INTEGER NOT NULL,
+		updated_at TEXT NOT NULL,
+		FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+	)`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS auto_responder_replies (
+		user_id INTEGER NOT NULL,
+		chat_jid TEXT NOT NULL,
+		replied_at INTEGER NOT NULL,
+		PRIMARY KEY(user_id, chat_jid),
+		FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+	)`)
+	if err != nil {
+		return err
+	}
+	// Device JID of each user's WhatsApp session in the shared store (WA_STORE=shared or main)
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS wa_devices (
+		user_id INTEGER PRIMARY KEY,
+		jid TEXT UNIQUE NOT NULL,
+		updated_at TEXT NOT NULL,
+		FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+	)`)
+	if err != nil {
+		return err
+	}
+	// Name and platform shown in WhatsApp's linked devices list, sent when pairing
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS wa_device_props (
+		user_id INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		platform TEXT NOT NULL,
+		updated_at TEXT NOT NULL,
+		FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+	)`)
+	if err != nil {
+		return err
+	}
+	// WhatsApp contact names, refreshed from the client after each contact sync
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS contacts (
+		user_id INTEGER NOT NULL,
+		jid TEXT NOT NULL,
+		name TEXT NOT NULL DEFAULT '',
+		full_name TEXT NOT NULL DEFAULT '',
+		first_name TEXT NOT NULL DEFAULT '',
+		push_name TEXT NOT NULL DEFAULT '',
+		business_name TEXT NOT NULL DEFAULT '',
+		updated_at TEXT NOT NULL,
+		PRIMARY KEY(user_id, jid),
+		FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+	)`)
+	if err != nil {
+		return err
+	}
+	// Messaging channels besides WhatsApp (Telegram bot, Signal), one per kind per user.
+	// config is the channel's JSON settings, including its credentials.
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS channels (
+		user_id INTEGER NOT NULL,
+		channel TEXT NOT NULL,
+		config TEXT NOT NULL,
+		created_at TEXT NOT NULL,
+		PRIMARY KEY(user_id, channel),
+		FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+	)`)
+	if err != nil {
+		return err
+	}
+	// Destinations received messages are written to (see sinks.go); config is the
+	// type-specific JSON settings, last_error the last failed delivery's error
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS sinks (
+		id TEXT PRIMARY KEY,
+		user_id INTEGER NOT NULL,
+		type TEXT NOT NULL,
+		filter_type TEXT NOT NULL,
+		filter_value TEXT NOT NULL DEFAULT '',
+		config TEXT NOT NULL,
+		paused INTEGER NOT NULL DEFAULT 0,
+		last_error TEXT NOT NULL DEFAULT '',
+		last_delivery_at TEXT NULL,
+		created_at TEXT NOT NULL,
+		FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+	)`)
+	if err != nil {
+		return err
+	}
+	// A user's Google account OAuth tokens, for the Google Sheets sink
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS google_credentials (
+		user_id INTEGER PRIMARY KEY,
+		refresh_token TEXT NOT NULL,
+		access_token TEXT NOT NULL,
+		expires_at TEXT NOT NULL,
+		updated_at TEXT NOT NULL,
+		FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+	)`)
+	if err != nil {
+		return err
+	}
+	// Per-user send risk rules; each is "off", "warn" or "block"
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS send_risk_settings (
+		user_id INTEGER PRIMARY KEY,
+		cold_links TEXT NOT NULL,
+		similar_messages TEXT NOT NULL,
+		similar_recipients INTEGER NOT NULL,
+		error_spike TEXT NOT NULL,
+		error_spike_percent INTEGER NOT NULL,
+		updated_at TEXT NOT NULL,
+		FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+	)`)
+	if err != nil {
+		return err
+	}
+	// Per-user LLM enrichment settings
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS enrichment_settings (
+		user_id INTEGER PRIMARY KEY,
+		enabled INTEGER NOT NULL DEFAULT 0,
+		endpoint TEXT NOT NULL DEFAULT '',
+		api_key TEXT NOT NULL DEFAULT '',
+		model TEXT NOT NULL DEFAULT '',
+		prompt TEXT NOT NULL,
+		timeout_ms INTEGER NOT NULL,
+		updated_at TEXT NOT NULL,
+		FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+	)`)
+	if err != nil {
+		return err
+	}
+	// LLM auto-reply bot: settings, chats it is switched on for, and its replies (Unix seconds)
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS bot_settings (
+		user_id INTEGER PRIMARY KEY,
+		system_prompt TEXT NOT NULL,
+		context_messages INTEGER NOT NULL,
+		max_replies_per_hour INTEGER NOT NULL,
+		off_keyword TEXT NOT NULL,
+		updated_at TEXT NOT NULL,
+		FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+	)`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS bot_chats (
+		user_id INTEGER NOT NULL,
+		chat_jid TEXT NOT NULL,
+		active INTEGER NOT NULL DEFAULT 1,
+		off_reason TEXT NOT NULL DEFAULT '',
+		enabled_at TEXT NOT NULL,
+		PRIMARY KEY(user_id, chat_jid),
+		FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+	)`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS bot_replies (
+		user_id INTEGER NOT NULL,
+		chat_jid TEXT NOT NULL,
+		text TEXT NOT NULL,
+		sent_at INTEGER NOT NULL,
+		FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+	)`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_bot_replies_chat ON bot_replies(user_id, chat_jid, sent_at)`)
+	if err != nil {
+		return err
+	}
+	// Daily analytics counters, by day in the user's timezone
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS daily_stats (
+		user_id INTEGER NOT NULL,
+		day TEXT NOT NULL,
+		metric TEXT NOT NULL,
+		count INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY(user_id, day, metric),
+		FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+	)`)
+	if err != nil {
+		return err
+	}
+	// Dashboard login sessions; the session cookie holds the token
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS sessions (
+		token TEXT PRIMARY KEY,
+		user_id INTEGER NOT NULL,
+		created_at TEXT NOT NULL,
+		expires_at INTEGER NOT NULL,
+		FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+	)`)
+	if err != nil {
+		return err
+	}
+	// Logins with an OIDC provider, mapped to local users (see oidc_login.go)
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS user_identities (
+		provider TEXT NOT NULL,
+		subject TEXT NOT NULL,
+		user_id INTEGER NOT NULL,
+		email TEXT NOT NULL DEFAULT '',
+		created_at TEXT NOT NULL,
+		PRIMARY KEY(provider, subject),
+		FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+	)`)
+	if err != nil {
+		return err
+	}
+	// Security-relevant account changes (see audit.go)
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS audit_logs (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		action TEXT NOT NULL,
+		detail TEXT NOT NULL DEFAULT '',
+		ip TEXT NOT NULL DEFAULT '',
+		created_at TEXT NOT NULL,
+		FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+	)`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_audit_logs_user ON audit_logs(user_id, created_at)`)
+	if err != nil {
+		return err
+	}
+	// Delivery alert rules and their state at the last check (see alerts.go)
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS alert_rules (
+		id TEXT PRIMARY KEY,
+		user_id INTEGER NOT NULL,
+		metric TEXT NOT NULL,
+		webhook_id TEXT NOT NULL DEFAULT '',
+		threshold REAL NOT NULL,
+		window_seconds INTEGER NOT NULL DEFAULT 0,
+		notify_url TEXT NOT NULL DEFAULT '',
+		notify_email TEXT NOT NULL DEFAULT '',
+		firing_resources TEXT NOT NULL DEFAULT '',
+		last_value REAL NULL,
+		fired_at TEXT NULL,
+		checked_at TEXT NULL,
+		created_at TEXT NOT NULL,
+		FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+	)`)
+	if err != nil {
+		return err
+	}
+	// Original mimetype and file name of stored media, keyed by stored file name
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS media_files (
+		name TEXT PRIMARY KEY,
+		mime_type TEXT NOT NULL DEFAULT '',
+		original_name TEXT NOT NULL DEFAULT '',
+		created_at TEXT NOT NULL
+	)`)
+	if err != nil {
+		return err
+	}
+	// Content hash and reference count, used to store identical media only once per user
+	if err := addColumnIfMissing("media_files", "sha256", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing("media_files", "refcount", "INTEGER NOT NULL DEFAULT 1"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing("media_files", "user_id", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	// Chat an upload was sent to, so a per-chat erasure removes it
+	if err := addColumnIfMissing("media_uploads", "chat_jid", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_media_files_sha256 ON media_files(sha256)`)
+	return err
+}
+
+// Add a column to an existing table if it isn't there yet (simple migration helper)
+func addColumnIfMissing(table, column, definition string) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dflt, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+func checkPassword(hash, password string) error {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+}
+
+// Refactor startServer to accept a *http.ServeMux argument and register all handlers on it
+func startServer(mux *http.ServeMux, port, sessionCookieName, dbPath, mediaDir, waSessionPrefix string) {
+	fmt.Printf("DEBUG: Starting server with API key middleware enabled\n")
+	// The jobs of an earlier start must not use the pools initDB replaces
+	stopServer()
+	if err := initDB(dbPath); err != nil {
+		panic("Failed to initialize DB: " + err.Error())
+	}
+	if err := initWAStore(dbPath); err != nil {
+		panic("Failed to initialize WhatsApp store: " + err.Error())
+	}
+	if err := initSecretsKey(dbPath); err != nil {
+		panic("Failed to initialize the secrets key: " + err.Error())
+	}
+	initTimeouts()
+	initOutboundGuard()
+	initEgress()
+	initWAConnects()
+	initSessionHealth()
+	initHeartbeat()
+	initWebhookShaping()
+	initRetention()
+	initLookupCaches()
+
+	// Purge archived messages, webhook logs and media past their retention
+	startRetentionJanitor(mediaDir)
+	startCampaignRunner()
+	startChannels(mediaDir)
+	startSinks()
+	startAlertMonitor()
+	startQueueExpiry()
+	startSessionHealthChecker()
+	startWebhookScheduleFlusher()
+	startHeartbeats()
+	startCallbackOutbox()
+
+	// Register all handlers on mux instead of http.DefaultServeMux
+	mux.HandleFunc("/api/register", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var creds struct {
+			Email    string `json:"email"`
+			Password string `json:"password"`
+		}
+		if err := decodeJSONBody(w, r, &creds); err != nil {
+			writeBodyError(w, err)
+			return
+		}
+		if creds.Email == "" || creds.Password == "" {
+			apiError(w, "Missing email or password", http.StatusBadRequest)
+			return
+		}
+		pwHash, err := hashPassword(creds.Password)
+		if err != nil {
+			apiError(w, "Failed to hash password", http.StatusInternalServerError)
+			return
+		}
+		_, err = db.Exec("INSERT INTO users (email, password_hash) VALUES (?, ?)", creds.Email, pwHash)
+		if err != nil {
+			if strings.Contains(err.Error(), "UNIQUE") {
+				apiError(w, "Email already registered", http.StatusConflict)
+				return
+			}
+			apiError(w, "Failed to register", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"success":true}`))
+	})
+	// --- API: Login (updated for DB users) ---
+	mux.HandleFunc("/api/login", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var creds struct {
+			Email    string `json:"email"`
+			Password string `json:"password"`
+		}
+		err := decodeJSONBody(w, r, &creds)
+		if err != nil {
+			writeBodyError(w, err)
+			return
+		}
+		var userID int64
+		var pwHash string
+		row := db.QueryRow("SELECT id, password_hash FROM users WHERE email = ?", creds.Email)
+		err = row.Scan(&userID, &pwHash)
+		if err == sql.ErrNoRows {
+			apiError(w, "Invalid credentials", http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			apiError(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		if checkPassword(pwHash, creds.Password) != nil {
+			apiError(w, "Invalid credentials", http.StatusUnauthorized)
+			return
+		}
+		token, err := createSession(userID)
+		if err != nil {
+			apiError(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		setSessionCookie(w, sessionCookieName, token)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"success":true}`))
+	})
+
+	// --- API: Logout ---
+	mux.HandleFunc("/api/logout", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if cookie, err := r.Cookie(sessionCookieName); err == nil {
+			deleteSession(cookie.Value)
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     sessionCookieName,
+			Value:    "",
+			Path:     "/",
+			HttpOnly: true,
+			Expires:  time.Now().Add(-1 * time.Hour),
 		})
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte(`{"success":true}`))
@@ -952,8 +1768,8 @@ func startServer(mux *http.ServeMux, port, sessionCookieName, dbPath, mediaDir,
 	// --- API: Session Status ---
 	mux.HandleFunc("/api/session", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
-		if isAuthenticated(r, sessionCookieName) {
-			w.Write([]byte(`{"authenticated":true}`))
+		if email := getUserEmail(r, sessionCookieName); email != "" {
+			json.NewEncoder(w).Encode(map[string]interface{}{"authenticated": true, "email": email})
 		} else {
 			w.Write([]byte(`{"authenticated":false}`))
 		}
@@ -962,7 +1778,7 @@ func startServer(mux *http.ServeMux, port, sessionCookieName, dbPath, mediaDir,
 	// --- API: QR PNG (existing) ---
 	mux.HandleFunc("/qr.png", func(w http.ResponseWriter, r *http.Request) {
 		if !isAuthenticated(r, sessionCookieName) {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			apiError(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
 		email := getUserEmail(r, sessionCookieName)
@@ -973,7 +1789,7 @@ func startServer(mux *http.ServeMux, port, sessionCookieName, dbPath, mediaDir,
 		}
 		png, err := qrcode.Encode(code, qrcode.Medium, 256)
 		if err != nil {
-			http.Error(w, "Failed to generate QR code", http.StatusInternalServerError)
+			apiError(w, "Failed to generate QR code", http.StatusInternalServerError)
 			return
 		}
 		w.Header().Set("Content-Type", "image/png")
@@ -983,29 +1799,23 @@ func startServer(mux *http.ServeMux, port, sessionCookieName, dbPath, mediaDir,
 	// --- API: WhatsApp Status ---
 	mux.HandleFunc("/api/wa/status", func(w http.ResponseWriter, r *http.Request) {
 		if !isAuthenticated(r, sessionCookieName) {
-			w.WriteHeader(http.StatusUnauthorized)
+			apiError(w, "Unauthorized", http.StatusUnauthorized)
 			w.Write([]byte(`{"authenticated":false}`))
 			return
 		}
 		email := getUserEmail(r, sessionCookieName)
 
-		status := getUserWAStatus(email)
-		qr := getUserQRCode(email)
-		loginState := getUserLoginState(email)
-
 		w.Header().Set("Content-Type", "application/json")
-		resp := map[string]interface{}{
-			"status":     status,
-			"qr":         qr,
-			"loginState": loginState,
-		}
-		json.NewEncoder(w).Encode(resp)
+		json.NewEncoder(w).Encode(userWAStatusResponse(email))
 	})
 
+	// --- API: WhatsApp QR login stream (SSE) ---
+	mux.HandleFunc("/api/wa/qr/stream", handleQRStream(sessionCookieName))
+
 	// --- API: WhatsMeow Connect ---
 	mux.HandleFunc("/api/wa/connect", func(w http.ResponseWriter, r *http.Request) {
 		if !isAuthenticated(r, sessionCookieName) {
-			w.WriteHeader(http.StatusUnauthorized)
+			apiError(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
 		email := getUserEmail(r, sessionCookieName)
@@ -1014,38 +1824,82 @@ func startServer(mux *http.ServeMux, port, sessionCookieName, dbPath, mediaDir,
 			return
 		}
 
-		// Start connection in background
-		go startUserWhatsMeowConnection(email, mediaDir, waSessionPrefix)
+		if wait := waConnectCooldown(email, time.Now()); wait > 0 {
+			writeLimitExceeded(w, ERR_RATE_LIMITED, "Connect requested too soon, try again shortly", "wa_connect", 1, time.Now().Add(wait))
+			return
+		}
 
+		// Start connection in background, in the next free start slot
+		resetUserQR(email)
 		w.Header().Set("Content-Type", "application/json")
+		if !scheduleWAConnect(email, func() { startUserWhatsMeowConnection(email, mediaDir, waSessionPrefix) }) {
+			w.Write([]byte(`{"success":true,"message":"Already waiting to connect"}`))
+			return
+		}
 		w.Write([]byte(`{"success":true,"message":"Connecting..."}`))
 	})
 
 	// --- API: WhatsMeow Disconnect ---
 	mux.HandleFunc("/api/wa/disconnect", func(w http.ResponseWriter, r *http.Request) {
 		if !isAuthenticated(r, sessionCookieName) {
-			w.WriteHeader(http.StatusUnauthorized)
+			apiError(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
 		email := getUserEmail(r, sessionCookieName)
-		disconnectUserWhatsMeow(email, mediaDir, waSessionPrefix)
+		disconnectUserWhatsMeow(email)
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte(`{"status":"disconnected"}`))
 	})
 
+	// --- API: WhatsMeow Logout ---
+	mux.HandleFunc("/api/wa/logout", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !isAuthenticated(r, sessionCookieName) {
+			apiError(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		email := getUserEmail(r, sessionCookieName)
+		response := map[string]interface{}{"status": "logged_out"}
+		if err := logoutUserWhatsMeow(email, waSessionPrefix); err != nil {
+			response["warning"] = "Could not unlink the device from WhatsApp; remove it under Linked devices on the phone"
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	})
+
 	// --- API: List Webhooks ---
 	mux.HandleFunc("/api/webhooks", requireAPIKey(func(w http.ResponseWriter, r *http.Request) {
 		// Get user ID from context (set by requireAPIKey middleware)
 		userID := r.Context().Value("userID").(int64)
 
-		webhooks, err := dbListWebhooks(userID)
+		// Optional ?tag=, ?q= search, sorting and limit/offset pagination
+		opts, err := parseWebhookListOptions(r.URL.Query())
+		if err != nil {
+			apiError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ctx, cancel := queryContext(r)
+		defer cancel()
+		webhooks, total, err := dbQueryWebhooks(ctx, userID, opts)
 		if err != nil {
 			fmt.Println("ERROR: Could not list webhooks for user", userID, err)
-			http.Error(w, "Failed to load webhooks", http.StatusInternalServerError)
+			apiError(w, "Failed to load webhooks", http.StatusInternalServerError)
 			return
 		}
-		if webhooks == nil {
-			webhooks = []Webhook{}
+		alerts := firingAlerts(userID)
+		for i := range webhooks {
+			webhooks[i].Alerts = alerts[webhooks[i].ID]
+			webhooks[i].Health = getWebhookHealth(webhooks[i].ID)
+		}
+		// The body stays a plain array; paging info goes in headers
+		w.Header().Set("X-Total-Count", strconv.Itoa(total))
+		if opts.Limit > 0 && opts.Offset+len(webhooks) < total {
+			next := r.URL.Query()
+			next.Set("offset", strconv.Itoa(opts.Offset+opts.Limit))
+			w.Header().Set("Link", fmt.Sprintf(`<%s?%s>; rel="next"`, r.URL.Path, next.Encode()))
 		}
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(webhooks)
@@ -1059,66 +1913,116 @@ func startServer(mux *http.ServeMux, port, sessionCookieName, dbPath, mediaDir,
 		userID := r.Context().Value("userID").(int64)
 		email := getUserEmailByID(userID)
 
-		var req struct {
-			URL         string `json:"url"`
-			Method      string `json:"method"`
-			FilterType  string `json:"filter_type"`
-			FilterValue string `json:"filter_value"`
-		}
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			fmt.Println("DEBUG: Failed to decode request:", err)
-			http.Error(w, "Invalid request", http.StatusBadRequest)
-			return
-		}
-		// Validate required fields
-		if req.URL == "" {
-			http.Error(w, "Missing URL", http.StatusBadRequest)
-			return
-		}
-		// Validate method
-		if req.Method != "GET" && req.Method != "POST" {
-			fmt.Println("DEBUG: Invalid method:", req.Method)
-			http.Error(w, "Invalid method", http.StatusBadRequest)
+		var req struct {
+			URL          string            `json:"url"`
+			Method       string            `json:"method"`
+			FilterType   string            `json:"filter_type"`
+			FilterValue  string            `json:"filter_value"`
+			Tags         []string          `json:"tags"`
+			Headers      map[string]string `json:"headers"`
+			URLs         []string          `json:"urls"`
+			Policy       string            `json:"delivery_policy"`
+			AutoReply    bool              `json:"auto_reply"`
+			AllowedChats []string          `json:"allowed_chats"`
+			Events       []string          `json:"events"`
+			Keywords     []string          `json:"keywords"`
+			MatchRegex   string            `json:"match_regex"`
+			Priority     int               `json:"priority"`
+			Fallback     bool              `json:"fallback"`
+			MaxPayload   int               `json:"max_payload_bytes"`
+			Redact       []string          `json:"redact"`
+			Schedule     *WebhookSchedule  `json:"schedule"`
+			SampleRate   float64           `json:"sample_rate"`
+			Verify       bool              `json:"verify"` // Challenge the destinations before enabling delivery
+		}
+		if err := decodeJSONBody(w, r, &req); err != nil {
+			writeBodyError(w, err)
 			return
 		}
-		// Validate filter type
-		if req.FilterType != "" && req.FilterType != "all" && req.FilterType != "group" && req.FilterType != "chat" {
-			fmt.Println("DEBUG: Invalid filter type:", req.FilterType)
-			http.Error(w, "Invalid filter type", http.StatusBadRequest)
+		// Validate required fields
+		if req.URL == "" {
+			apiError(w, "Missing URL", http.StatusBadRequest)
 			return
 		}
-		// Default to "all" if no filter type specified
-		if req.FilterType == "" {
-			req.FilterType = "all"
-		}
 
 		fmt.Printf("DEBUG: [CREATE] user email: %s, userID: %d\n", email, userID)
 		fmt.Printf("DEBUG: Creating webhook for %s: URL=%s, Method=%s, FilterType=%s, FilterValue=%s\n",
 			email, req.URL, req.Method, req.FilterType, req.FilterValue)
 		id := generateWebhookID()
 		wh := Webhook{
-			ID:          id,
-			URL:         req.URL,
-			Method:      req.Method,
-			FilterType:  req.FilterType,
-			FilterValue: req.FilterValue,
-			CreatedAt:   time.Now(),
+			ID:           id,
+			URL:          req.URL,
+			Method:       req.Method,
+			FilterType:   req.FilterType,
+			FilterValue:  req.FilterValue,
+			Tags:         req.Tags,
+			Headers:      req.Headers,
+			URLs:         req.URLs,
+			Policy:       req.Policy,
+			AutoReply:    req.AutoReply,
+			AllowedChats: req.AllowedChats,
+			Events:       req.Events,
+			Keywords:     req.Keywords,
+			MatchRegex:   req.MatchRegex,
+			Priority:     req.Priority,
+			Fallback:     req.Fallback,
+			MaxPayload:   req.MaxPayload,
+			Redact:       req.Redact,
+			Schedule:     req.Schedule,
+			SampleRate:   req.SampleRate,
+			Unverified:   req.Verify,
+			CreatedAt:    time.Now(),
+		}
+		// Validate method, filter type (defaults to "all") and tags
+		if err := validateWebhookConfig(&wh); err != nil {
+			fmt.Println("DEBUG: Invalid webhook config:", err)
+			apiError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var err error
+		if wh.AllowedChats, err = limitToAPIKeyChats(userID, wh.AllowedChats); err != nil {
+			writeBodyError(w, err)
+			return
 		}
-		err := dbCreateWebhook(userID, wh)
+		req.FilterType = wh.FilterType
+		err = dbCreateWebhook(userID, wh)
 		if err != nil {
 			fmt.Println("ERROR: Could not create webhook in DB", err)
-			http.Error(w, "Failed to create webhook", http.StatusInternalServerError)
+			apiError(w, "Failed to create webhook", http.StatusInternalServerError)
 			return
 		}
 		fmt.Printf("DEBUG: Webhook created with ID: %s\n", id)
+		response := map[string]interface{}{
+			"id":                id,
+			"url":               req.URL,
+			"method":            req.Method,
+			"filter_type":       req.FilterType,
+			"filter_value":      req.FilterValue,
+			"tags":              wh.Tags,
+			"headers":           wh.Headers,
+			"urls":              wh.URLs,
+			"delivery_policy":   wh.Policy,
+			"auto_reply":        wh.AutoReply,
+			"allowed_chats":     wh.AllowedChats,
+			"events":            wh.Events,
+			"keywords":          wh.Keywords,
+			"match_regex":       wh.MatchRegex,
+			"priority":          wh.Priority,
+			"fallback":          wh.Fallback,
+			"max_payload_bytes": wh.MaxPayload,
+			"redact":            wh.Redact,
+			"schedule":          wh.Schedule,
+			"sample_rate":       wh.SampleRate,
+		}
+		if req.Verify {
+			// Kept unverified on failure, so the destination can be fixed and verified again
+			if err := verifyWebhook(userID, &wh); err != nil {
+				response["verification_error"] = err.Error()
+			}
+			response["unverified"] = wh.Unverified
+		}
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"id":           id,
-			"url":          req.URL,
-			"method":       req.Method,
-			"filter_type":  req.FilterType,
-			"filter_value": req.FilterValue,
-		})
+		json.NewEncoder(w).Encode(response)
 	}))
 
 	// --- API: Delete Webhook ---
@@ -1129,26 +2033,60 @@ func startServer(mux *http.ServeMux, port, sessionCookieName, dbPath, mediaDir,
 		var req struct {
 			ID string `json:"id"`
 		}
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID == "" {
-			http.Error(w, "Invalid request", http.StatusBadRequest)
+		if err := decodeJSONBody(w, r, &req); err != nil {
+			writeBodyError(w, err)
+			return
+		}
+		if req.ID == "" {
+			apiError(w, "Missing id", http.StatusBadRequest)
 			return
 		}
 
 		err := dbDeleteWebhook(userID, req.ID)
 		if err != nil {
 			fmt.Println("ERROR: Could not delete webhook in DB", err)
-			http.Error(w, "Failed to delete webhook", http.StatusInternalServerError)
+			apiError(w, "Failed to delete webhook", http.StatusInternalServerError)
 			return
 		}
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte(`{"success":true}`))
 	}))
 
+	// --- API: Set Webhook Tags ---
+	mux.HandleFunc("/api/webhooks/{id}/tags", requireAPIKey(handleSetWebhookTags))
+	mux.HandleFunc("/api/webhooks/{id}/allowed-chats", requireAPIKey(handleSetWebhookAllowedChats))
+	mux.HandleFunc("/api/webhooks/{id}/routing", requireAPIKey(handleSetWebhookRouting))
+
+	// --- API: Bulk Webhook Operations by Tag ---
+	mux.HandleFunc("/api/webhooks/bulk", requireAPIKey(handleBulkWebhooks))
+
+	// --- API: Clone Webhook ---
+	mux.HandleFunc("/api/webhooks/{id}/clone", requireAPIKey(handleCloneWebhook))
+	mux.HandleFunc("/api/webhooks/bulk-create", requireAPIKey(handleBulkCreateWebhooks))
+	mux.HandleFunc("/api/webhooks/for-chat", requireAPIKey(handleCreateChatWebhook))
+
+	// --- API: Webhook Payload Size Limit ---
+	mux.HandleFunc("/api/webhooks/{id}/payload-limit", requireAPIKey(handleSetWebhookPayloadLimit))
+	mux.HandleFunc("/api/webhooks/{id}/payloads/{payload_id}", requireAPIKey(handleGetWebhookPayload))
+
+	// --- API: Webhook Payload Redaction ---
+	mux.HandleFunc("/api/webhooks/{id}/redaction", requireAPIKey(handleSetWebhookRedaction))
+
+	// --- API: Webhook Sampling ---
+	mux.HandleFunc("/api/webhooks/{id}/sampling", requireAPIKey(handleSetWebhookSampling))
+
+	// --- API: Webhook Schedule ---
+	mux.HandleFunc("/api/webhooks/{id}/schedule", requireAPIKey(handleWebhookSchedule))
+	mux.HandleFunc("/api/webhooks/{id}/verify", requireAPIKey(handleVerifyWebhook))
+
+	// --- API: Per-host Delivery Traffic ---
+	mux.HandleFunc("/api/webhooks/hosts", requireAPIKey(handleWebhookHosts))
+
 	// --- API: Webhook Logs ---
 	mux.HandleFunc("/api/webhooks/logs", requireAPIKey(func(w http.ResponseWriter, r *http.Request) {
 		id := r.URL.Query().Get("id")
 		if id == "" {
-			http.Error(w, "Missing id", http.StatusBadRequest)
+			apiError(w, "Missing id", http.StatusBadRequest)
 			return
 		}
 		logs := getWebhookLogs(id)
@@ -1156,10 +2094,18 @@ func startServer(mux *http.ServeMux, port, sessionCookieName, dbPath, mediaDir,
 		json.NewEncoder(w).Encode(logs)
 	}))
 
+	// --- API: Secrets Vault ---
+	mux.HandleFunc("/api/secrets", requireAPIKey(handleSecrets))
+	mux.HandleFunc("/api/secrets/delete", requireAPIKey(handleDeleteSecret))
+
+	// --- API: Media Uploads ---
+	mux.HandleFunc("/api/media/upload-url", requireAPIKey(handleCreateUploadURL))
+	mux.HandleFunc("/api/media/upload/{token}", handleMediaUpload(mediaDir))
+
 	// --- API: Get User's API Key ---
 	mux.HandleFunc("/api/user/api-key", func(w http.ResponseWriter, r *http.Request) {
 		if !isAuthenticated(r, sessionCookieName) {
-			w.WriteHeader(http.StatusUnauthorized)
+			apiError(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
 
@@ -1167,13 +2113,13 @@ func startServer(mux *http.ServeMux, port, sessionCookieName, dbPath, mediaDir,
 			email := getUserEmail(r, sessionCookieName)
 			userID, err := getUserIDByEmail(email)
 			if err != nil {
-				http.Error(w, "Failed to get user ID", http.StatusInternalServerError)
+				apiError(w, "Failed to get user ID", http.StatusInternalServerError)
 				return
 			}
 
 			apiKey, err := getUserAPIKey(userID)
 			if err != nil {
-				http.Error(w, "Failed to get API key", http.StatusInternalServerError)
+				apiError(w, "Failed to get API key", http.StatusInternalServerError)
 				return
 			}
 
@@ -1184,32 +2130,54 @@ func startServer(mux *http.ServeMux, port, sessionCookieName, dbPath, mediaDir,
 			email := getUserEmail(r, sessionCookieName)
 			userID, err := getUserIDByEmail(email)
 			if err != nil {
-				http.Error(w, "Failed to get user ID", http.StatusInternalServerError)
+				apiError(w, "Failed to get user ID", http.StatusInternalServerError)
 				return
 			}
 
 			newAPIKey, err := regenerateAPIKey(userID)
 			if err != nil {
-				http.Error(w, "Failed to regenerate API key", http.StatusInternalServerError)
+				apiError(w, "Failed to regenerate API key", http.StatusInternalServerError)
 				return
 			}
 
 			w.Header().Set("Content-Type", "application/json")
 			json.NewEncoder(w).Encode(map[string]string{"api_key": newAPIKey})
 		} else {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
 		}
 	})
 
+	// --- API: API Key Send Permissions ---
+	mux.HandleFunc("/api/user/api-key/allowed-chats", handleAPIKeyAllowedChats(sessionCookieName))
+
+	// --- API: Receive-only Mode ---
+	mux.HandleFunc("/api/user/receive-only", handleReceiveOnly(sessionCookieName))
+
+	// --- API: Presence Policy ---
+	mux.HandleFunc("/api/user/presence", handlePresenceMode(sessionCookieName))
+
+	// --- API: User Timezone ---
+	mux.HandleFunc("/api/user/timezone", handleUserTimezone(sessionCookieName))
+
+	// --- API: Personal Data Export and Erasure (dashboard session only) ---
+	mux.HandleFunc("/api/user/data/export", handleExportUserData(sessionCookieName))
+	mux.HandleFunc("/api/user/data/delete", handleDeleteUserData(sessionCookieName, waSessionPrefix))
+	mux.HandleFunc("/api/user/delete", handleDeleteAccount(sessionCookieName, waSessionPrefix))
+
+	// --- API: Credential Changes and Audit Log (dashboard session only) ---
+	mux.HandleFunc("/api/user/password", handleChangePassword(sessionCookieName))
+	mux.HandleFunc("/api/user/email", handleChangeEmail(sessionCookieName, mediaDir, waSessionPrefix))
+	mux.HandleFunc("/api/user/audit-log", handleAuditLog(sessionCookieName))
+
 	// --- API: Generate Automation URL ---
 	mux.HandleFunc("/api/automation/generate", func(w http.ResponseWriter, r *http.Request) {
 		if !isAuthenticated(r, sessionCookieName) {
-			w.WriteHeader(http.StatusUnauthorized)
+			apiError(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
 
 		if r.Method != "POST" {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
 
@@ -1217,7 +2185,7 @@ func startServer(mux *http.ServeMux, port, sessionCookieName, dbPath, mediaDir,
 		userID, err := dbGetUserIDByEmail(email)
 		if err != nil {
 			fmt.Printf("ERROR: Failed to get user ID for email %s: %v\n", email, err)
-			http.Error(w, "User not found", http.StatusNotFound)
+			apiError(w, "User not found", http.StatusNotFound)
 			return
 		}
 
@@ -1234,7 +2202,7 @@ func startServer(mux *http.ServeMux, port, sessionCookieName, dbPath, mediaDir,
 		err = dbCreateWebhook(userID, webhook)
 		if err != nil {
 			fmt.Printf("ERROR: Failed to create automation webhook: %v\n", err)
-			http.Error(w, "Failed to create automation URL", http.StatusInternalServerError)
+			apiError(w, "Failed to create automation URL", http.StatusInternalServerError)
 			return
 		}
 
@@ -1260,11 +2228,17 @@ func startServer(mux *http.ServeMux, port, sessionCookieName, dbPath, mediaDir,
 	// --- API: Queue Status ---
 	mux.HandleFunc("/api/queue/status", func(w http.ResponseWriter, r *http.Request) {
 		if !isAuthenticated(r, sessionCookieName) {
-			w.WriteHeader(http.StatusUnauthorized)
+			apiError(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
 
 		email := getUserEmail(r, sessionCookieName)
+		loc := time.UTC
+		var alerts []string
+		if userID, err := getUserIDByEmail(email); err == nil {
+			loc = getUserLocation(userID)
+			alerts = firingAlerts(userID)[ALERT_RESOURCE_QUEUE]
+		}
 
 		// Get queue for this user
 		queueMutex.RLock()
@@ -1274,12 +2248,17 @@ func startServer(mux *http.ServeMux, port, sessionCookieName, dbPath, mediaDir,
 		if !exists {
 			w.Header().Set("Content-Type", "application/json")
 			json.NewEncoder(w).Encode(map[string]interface{}{
-				"queue_length": 0,
-				"messages":     []interface{}{},
-				"hourly_count": 0,
-				"daily_count":  0,
-				"hourly_limit": MAX_HOURLY_MESSAGES,
-				"daily_limit":  MAX_DAILY_MESSAGES,
+				"queue_length":     0,
+				"messages":         []interface{}{},
+				"pending_approval": []interface{}{},
+				"approval_mode":    dbGetApprovalMode(email),
+				"alerts":           alerts,
+				"hourly_count":     0,
+				"daily_count":      0,
+				"hourly_limit":     MAX_HOURLY_MESSAGES,
+				"daily_limit":      MAX_DAILY_MESSAGES,
+				"paused":           dbGetQueuePaused(email),
+				"timezone":         loc.String(),
 			})
 			return
 		}
@@ -1288,21 +2267,53 @@ func startServer(mux *http.ServeMux, port, sessionCookieName, dbPath, mediaDir,
 
 		// Prepare queue status
 		messages := make([]map[string]interface{}, len(queue.Messages))
+		delays := queue.estimateSendTimes(time.Now(), 0)
 		for i, msg := range queue.Messages {
 			messages[i] = map[string]interface{}{
-				"id":         msg.ID,
-				"chat_jid":   msg.ChatJID,
-				"message":    msg.Message,
-				"status":     msg.Status,
-				"created_at": msg.CreatedAt,
-				"retries":    msg.Retries,
-				"position":   i + 1,
+				"id":               msg.ID,
+				"chat_jid":         msg.ChatJID,
+				"message":          msg.Message,
+				"status":           msg.Status,
+				"created_at":       msg.CreatedAt,
+				"retries":          msg.Retries,
+				"position":         i + 1,
+				"estimated_delay":  delays[i].Seconds(),
+				"created_at_epoch": msg.CreatedAt.Unix(),
+				"created_at_local": formatLocalTime(msg.CreatedAt, loc),
+			}
+			if msg.ExpiresAt != nil {
+				messages[i]["expires_at"] = msg.ExpiresAt
+			}
+			if msg.GroupKey != "" {
+				messages[i]["group_key"] = msg.GroupKey
+			}
+		}
+		pending := make([]map[string]interface{}, len(queue.Pending))
+		for i, msg := range queue.Pending {
+			pending[i] = map[string]interface{}{
+				"id":               msg.ID,
+				"chat_jid":         msg.ChatJID,
+				"message":          msg.Message,
+				"status":           msg.Status,
+				"source":           msg.Source,
+				"created_at":       msg.CreatedAt,
+				"created_at_epoch": msg.CreatedAt.Unix(),
+				"created_at_local": formatLocalTime(msg.CreatedAt, loc),
+			}
+			if msg.ExpiresAt != nil {
+				pending[i]["expires_at"] = msg.ExpiresAt
+			}
+			if msg.GroupKey != "" {
+				pending[i]["group_key"] = msg.GroupKey
 			}
 		}
 
 		response := map[string]interface{}{
 			"queue_length":     len(queue.Messages),
 			"messages":         messages,
+			"pending_approval": pending,
+			"approval_mode":    dbGetApprovalMode(email),
+			"alerts":           alerts,
 			"hourly_count":     queue.HourlyCount,
 			"daily_count":      queue.DailyCount,
 			"hourly_limit":     MAX_HOURLY_MESSAGES,
@@ -1310,7 +2321,10 @@ func startServer(mux *http.ServeMux, port, sessionCookieName, dbPath, mediaDir,
 			"hourly_remaining": MAX_HOURLY_MESSAGES - queue.HourlyCount,
 			"daily_remaining":  MAX_DAILY_MESSAGES - queue.DailyCount,
 			"is_processing":    queue.IsProcessing,
+			"paused":           queue.Paused,
 			"last_sent":        queue.LastSent,
+			"last_sent_local":  formatLocalTime(queue.LastSent, loc),
+			"timezone":         loc.String(),
 		}
 
 		queue.mu.RUnlock()
@@ -1319,20 +2333,68 @@ func startServer(mux *http.ServeMux, port, sessionCookieName, dbPath, mediaDir,
 		json.NewEncoder(w).Encode(response)
 	})
 
+	// --- API: Send Capacity Reservations ---
+	mux.HandleFunc("/api/capacity", requireAPIKey(handleGetCapacity))
+	mux.HandleFunc("/api/capacity/reservations", requireAPIKey(handleCapacityReservations))
+	mux.HandleFunc("/api/capacity/reservations/{id}", requireAPIKey(handleDeleteCapacityReservation))
+
+	// --- API: Campaigns ---
+	mux.HandleFunc("/api/campaigns", requireAPIKey(handleCampaigns))
+	mux.HandleFunc("/api/campaigns/{id}", requireAPIKey(handleGetCampaign))
+	mux.HandleFunc("/api/campaigns/{id}/pause", requireAPIKey(handleCampaignAction("pause")))
+	mux.HandleFunc("/api/campaigns/{id}/resume", requireAPIKey(handleCampaignAction("resume")))
+	mux.HandleFunc("/api/campaigns/{id}/cancel", requireAPIKey(handleCampaignAction("cancel")))
+
+	// --- API: Admin Maintenance Mode ---
+	mux.HandleFunc("/api/admin/maintenance", requireAdminToken(handleMaintenance))
+	mux.HandleFunc("/api/admin/retention", requireAdminToken(handleRetention))
+	mux.HandleFunc("/api/admin/webhook-hosts", requireAdminToken(handleAdminWebhookHosts))
+	mux.HandleFunc("/api/admin/diagnostics", requireAdminToken(handleDiagnostics))
+	registerPprof(mux)
+
+	// --- API: Pause/Resume Queue ---
+	mux.HandleFunc("/api/queue/pause", handleSetQueuePaused(sessionCookieName, true))
+	mux.HandleFunc("/api/queue/resume", handleSetQueuePaused(sessionCookieName, false))
+
+	// --- API: Send Approval ---
+	mux.HandleFunc("/api/queue/approval", handleApprovalMode(sessionCookieName))
+	mux.HandleFunc("/api/queue/message/{id}/approve", handleReviewMessage(sessionCookieName, true))
+	mux.HandleFunc("/api/queue/message/{id}/reject", handleReviewMessage(sessionCookieName, false))
+
 	// --- API: Specific Message Status ---
 	mux.HandleFunc("/api/queue/message/", func(w http.ResponseWriter, r *http.Request) {
 		if !isAuthenticated(r, sessionCookieName) {
-			w.WriteHeader(http.StatusUnauthorized)
+			apiError(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
 
 		messageID := path.Base(r.URL.Path)
 		if messageID == "" {
-			http.Error(w, "Missing message ID", http.StatusBadRequest)
+			apiError(w, "Missing message ID", http.StatusBadRequest)
 			return
 		}
 
 		email := getUserEmail(r, sessionCookieName)
+		loc := time.UTC
+		if userID, err := getUserIDByEmail(email); err == nil {
+			loc = getUserLocation(userID)
+
+			// Already sent: report what WhatsApp answered (see sent_messages.go)
+			if sent, err := dbGetSentMessage(userID, messageID); err == nil {
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"id":                     sent.QueueID,
+					"chat_jid":               sent.ChatJID,
+					"message":                sent.Text,
+					"status":                 "sent",
+					"message_id":             sent.MessageID,
+					"server_timestamp":       sent.ServerTimestamp,
+					"server_timestamp_local": formatLocalTime(sent.ServerTimestamp, loc),
+					"timezone":               loc.String(),
+				})
+				return
+			}
+		}
 
 		// Get queue for this user
 		queueMutex.RLock()
@@ -1340,7 +2402,7 @@ func startServer(mux *http.ServeMux, port, sessionCookieName, dbPath, mediaDir,
 		queueMutex.RUnlock()
 
 		if !exists {
-			http.Error(w, "Queue not found", http.StatusNotFound)
+			apiError(w, "Queue not found", http.StatusNotFound)
 			return
 		}
 
@@ -1351,14 +2413,23 @@ func startServer(mux *http.ServeMux, port, sessionCookieName, dbPath, mediaDir,
 		for i, msg := range queue.Messages {
 			if msg.ID == messageID {
 				response := map[string]interface{}{
-					"id":              msg.ID,
-					"chat_jid":        msg.ChatJID,
-					"message":         msg.Message,
-					"status":          msg.Status,
-					"created_at":      msg.CreatedAt,
-					"retries":         msg.Retries,
-					"position":        i + 1,
-					"estimated_delay": queue.estimateDelay(i + 1).Seconds(),
+					"id":               msg.ID,
+					"chat_jid":         msg.ChatJID,
+					"message":          msg.Message,
+					"status":           msg.Status,
+					"created_at":       msg.CreatedAt,
+					"retries":          msg.Retries,
+					"position":         i + 1,
+					"estimated_delay":  queue.estimateSendTimes(time.Now(), 0)[i].Seconds(),
+					"created_at_epoch": msg.CreatedAt.Unix(),
+					"created_at_local": formatLocalTime(msg.CreatedAt, loc),
+					"timezone":         loc.String(),
+				}
+				if msg.ExpiresAt != nil {
+					response["expires_at"] = msg.ExpiresAt
+				}
+				if msg.GroupKey != "" {
+					response["group_key"] = msg.GroupKey
 				}
 
 				w.Header().Set("Content-Type", "application/json")
@@ -1366,34 +2437,58 @@ func startServer(mux *http.ServeMux, port, sessionCookieName, dbPath, mediaDir,
 				return
 			}
 		}
+		for _, msg := range queue.Pending {
+			if msg.ID == messageID {
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"id":               msg.ID,
+					"chat_jid":         msg.ChatJID,
+					"message":          msg.Message,
+					"status":           msg.Status,
+					"source":           msg.Source,
+					"created_at":       msg.CreatedAt,
+					"created_at_epoch": msg.CreatedAt.Unix(),
+					"created_at_local": formatLocalTime(msg.CreatedAt, loc),
+					"timezone":         loc.String(),
+				})
+				return
+			}
+		}
 
-		http.Error(w, "Message not found in queue", http.StatusNotFound)
+		apiError(w, "Message not found in queue", http.StatusNotFound)
 	})
 
+	// --- API: Chat Media Archive (ZIP) ---
+	mux.HandleFunc("/api/wa/chats/{jid}/media/archive", handleChatMediaArchive(sessionCookieName))
+	mux.HandleFunc("/api/wa/chats/{jid}/read", handleMarkChatRead(sessionCookieName))
+	mux.HandleFunc("/api/wa/chats/search", handleChatSearch(sessionCookieName))
+
+	// --- API: Join Group via Invite Link ---
+	mux.HandleFunc("/api/wa/groups/join", requireAPIKey(handleJoinGroup))
+
 	// --- API: Recent Chats ---
 	mux.HandleFunc("/api/wa/chats", func(w http.ResponseWriter, r *http.Request) {
 		fmt.Println("DEBUG: /api/wa/chats called")
 		if !isAuthenticated(r, sessionCookieName) {
 			fmt.Println("DEBUG: Not authenticated for chats endpoint")
-			w.WriteHeader(http.StatusUnauthorized)
+			apiError(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
 		email := getUserEmail(r, sessionCookieName)
 		fmt.Println("DEBUG: Getting chats for:", email)
+		ctx, cancel := queryContext(r)
+		defer cancel()
 
 		// Get WhatsApp client for this user
-		state := getUserWAState(email)
-		state.mu.RLock()
-		client := state.waClient
-		state.mu.RUnlock()
+		client := userWAClient(email)
 
 		var allChats []Chat
 
-		if client != nil && client.Store.ID != nil {
+		if client != nil && client.Paired() {
 			fmt.Println("DEBUG: WhatsApp client available, fetching contacts and groups")
 
 			// Get contacts from the store
-			contacts, err := client.Store.Contacts.GetAllContacts(context.Background())
+			contacts, err := client.GetAllContacts(ctx)
 			if err == nil {
 				fmt.Printf("DEBUG: Found %d contacts\n", len(contacts))
 				for jid, contact := range contacts {
@@ -1443,11 +2538,8 @@ func startServer(mux *http.ServeMux, port, sessionCookieName, dbPath, mediaDir,
 			fmt.Println("DEBUG: WhatsApp client not available or not connected")
 		}
 
-		// If no chats from WhatsApp client, fall back to recent chats
-		if len(allChats) == 0 {
-			fmt.Println("DEBUG: No chats from WhatsApp client, falling back to recent chats")
-			allChats = getRecentChats(email)
-		}
+		// Add recent activity; without a client this is just the recent chats
+		allChats = mergeChatActivity(allChats, getRecentChats(ctx, email))
 
 		// Ensure we return an empty array instead of null
 		if allChats == nil {
@@ -1476,15 +2568,22 @@ func startServer(mux *http.ServeMux, port, sessionCookieName, dbPath, mediaDir,
 		w.Write([]byte(`{"status":"ok"}`))
 	})
 
+	// --- Embeddable status widget ---
+	mux.HandleFunc("/api/widget/token", requireAPIKey(handleWidgetToken))
+	mux.HandleFunc("/widget/status", handleWidgetStatus)
+
+	// --- API: Egress Identity ---
+	mux.HandleFunc("/api/meta/egress", handleEgressInfo)
+
 	// --- API: Delete Message ---
 	mux.HandleFunc("/api/messages/delete", func(w http.ResponseWriter, r *http.Request) {
 		if !isAuthenticated(r, sessionCookieName) {
-			w.WriteHeader(http.StatusUnauthorized)
+			apiError(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
 
 		if r.Method != "POST" {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
 
@@ -1493,32 +2592,31 @@ func startServer(mux *http.ServeMux, port, sessionCookieName, dbPath, mediaDir,
 			MessageID string `json:"message_id"`
 		}
 
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, "Invalid request body", http.StatusBadRequest)
+		if err := decodeJSONBody(w, r, &req); err != nil {
+			writeBodyError(w, err)
 			return
 		}
 
 		if req.ChatJID == "" || req.MessageID == "" {
-			http.Error(w, "Missing chat_jid or message_id", http.StatusBadRequest)
+			apiError(w, "Missing chat_jid or message_id", http.StatusBadRequest)
 			return
 		}
 
 		email := getUserEmail(r, sessionCookieName)
-		state := getUserWAState(email)
-
-		state.mu.RLock()
-		client := state.waClient
-		state.mu.RUnlock()
-
-		if client == nil {
-			http.Error(w, "WhatsApp client not connected", http.StatusServiceUnavailable)
+		if dbGetReceiveOnly(email) {
+			writeAPIError(w, http.StatusForbidden, ERR_RECEIVE_ONLY, "Sending is disabled: account is in receive-only mode")
 			return
 		}
-
 		// Parse chat JID
-		chatJID, err := types.ParseJID(req.ChatJID)
+		chatJID, err := normalizeChatJID(req.ChatJID)
 		if err != nil {
-			http.Error(w, "Invalid chat JID", http.StatusBadRequest)
+			writeAPIError(w, http.StatusBadRequest, ERR_INVALID_JID, "Invalid chat JID")
+			return
+		}
+
+		client := userClientForChat(email, chatJID)
+		if client == nil {
+			writeAPIError(w, http.StatusServiceUnavailable, ERR_WA_DISCONNECTED, "WhatsApp client not connected")
 			return
 		}
 
@@ -1526,7 +2624,7 @@ func startServer(mux *http.ServeMux, port, sessionCookieName, dbPath, mediaDir,
 		_, err = client.RevokeMessage(chatJID, req.MessageID)
 		if err != nil {
 			fmt.Printf("ERROR: Failed to delete message %s in chat %s: %v\n", req.MessageID, req.ChatJID, err)
-			http.Error(w, "Failed to delete message", http.StatusInternalServerError)
+			apiError(w, "Failed to delete message", http.StatusInternalServerError)
 			return
 		}
 
@@ -1540,282 +2638,126 @@ func startServer(mux *http.ServeMux, port, sessionCookieName, dbPath, mediaDir,
 		})
 	})
 
+	// --- API: Message Archive and Annotations ---
+	mux.HandleFunc("/api/messages", requireAPIKey(handleListMessages))
+	mux.HandleFunc("/api/messages/sent", requireAPIKey(handleListSentMessages))
+	mux.HandleFunc("/api/messages/edit", requireAPIKey(handleEditMessage))
+	mux.HandleFunc("/api/messages/forward", requireAPIKey(handleForwardMessage(mediaDir)))
+	mux.HandleFunc("/api/messages/{jid}/{id}/annotation", requireAPIKey(handleAnnotateMessage))
+	mux.HandleFunc("/api/messages/{jid}/{id}/document-text", requireAPIKey(handleGetDocumentText))
+	mux.HandleFunc("/api/messages/{jid}/{id}/star", requireAPIKey(handleMarkMessage("star")))
+	mux.HandleFunc("/api/messages/{jid}/{id}/pin", requireAPIKey(handleMarkMessage("pin")))
+
+	// --- API: Agents and Conversation Routing ---
+	mux.HandleFunc("/api/agents", requireAPIKey(handleAgents))
+	mux.HandleFunc("/api/agents/{id}", requireAPIKey(handleAgent))
+	mux.HandleFunc("/api/routing", requireAPIKey(handleRoutingPolicy))
+	mux.HandleFunc("/api/conversations", requireAPIKey(handleListConversations))
+	mux.HandleFunc("/api/conversations/{jid}/assign", requireAPIKey(handleAssignConversation))
+
+	// --- API: Canned Responses ---
+	mux.HandleFunc("/api/canned-responses", requireAPIKey(handleCannedResponses))
+	mux.HandleFunc("/api/canned-responses/{shortcut}", requireAPIKey(handleDeleteCannedResponse))
+	mux.HandleFunc("/api/canned-responses/expand", requireAPIKey(handleExpandCannedResponse))
+	mux.HandleFunc("/api/canned-responses/send", requireAPIKey(handleSendCannedResponse))
+
+	// --- API: Auto-responder and Analytics ---
+	mux.HandleFunc("/api/auto-responder", requireAPIKey(handleAutoResponder))
+	mux.HandleFunc("/api/analytics", requireAPIKey(handleAnalytics))
+
+	// --- API: Send Risk Rules ---
+	mux.HandleFunc("/api/send-risk", requireAPIKey(handleSendRiskSettings))
+
+	// --- API: WhatsApp Device Properties ---
+	mux.HandleFunc("/api/wa/device-props", requireAPIKey(handleWADeviceProps(waSessionPrefix)))
+
+	// --- API: No-code Triggers (polling and REST hooks) ---
+	mux.HandleFunc("/api/triggers/new-messages", requireAPIKey(handleTriggerNewMessages))
+	mux.HandleFunc("/api/triggers/subscriptions", requireAPIKey(handleTriggerSubscribe))
+	mux.HandleFunc("/api/triggers/subscriptions/{id}", requireAPIKey(handleTriggerUnsubscribe))
+
+	// --- API: Telegram/Signal Channels ---
+	mux.HandleFunc("/api/channels", requireAPIKey(handleChannels(mediaDir)))
+	mux.HandleFunc("/api/channels/{channel}", requireAPIKey(handleDeleteChannel))
+
+	// --- API: Sinks (Google Sheets) ---
+	mux.HandleFunc("/api/sinks", requireAPIKey(handleSinks))
+	mux.HandleFunc("/api/sinks/{id}", requireAPIKey(handleSink))
+
+	// --- API: Delivery Alerts ---
+	mux.HandleFunc("/api/alerts", requireAPIKey(handleAlertRules))
+	mux.HandleFunc("/api/alerts/{id}", requireAPIKey(handleDeleteAlertRule))
+	mux.HandleFunc("/api/google", requireAPIKey(handleGoogleAccount))
+	mux.HandleFunc("/api/google/authorize", requireAPIKey(handleGoogleAuthorize))
+	mux.HandleFunc(GOOGLE_CALLBACK_PATH, handleGoogleCallback)
+
+	// --- OIDC login (Google, generic OpenID Connect) ---
+	mux.HandleFunc("/api/auth/providers", handleOIDCProviders)
+	mux.HandleFunc("/auth/oidc/{provider}/login", handleOIDCLogin)
+	mux.HandleFunc("/auth/oidc/{provider}/callback", handleOIDCCallback(sessionCookieName))
+
+	// --- API: LLM Enrichment ---
+	mux.HandleFunc("/api/enrichment", requireAPIKey(handleEnrichmentSettings))
+	mux.HandleFunc("/api/enrichment/test", requireAPIKey(handleTestEnrichment))
+
+	// --- API: LLM Auto-reply Bot ---
+	mux.HandleFunc("/api/bot", requireAPIKey(handleBotSettings))
+	mux.HandleFunc("/api/bot/chats", requireAPIKey(handleListBotChats))
+	mux.HandleFunc("/api/bot/chats/{jid}", requireAPIKey(handleBotChat))
+
+	// --- API: Config Export/Import ---
+	mux.HandleFunc("/api/config/export", requireAPIKey(handleConfigExport))
+	mux.HandleFunc("/api/config/import", requireAPIKey(handleConfigImport))
+	mux.HandleFunc("/api/config/apply", requireAPIKey(handleConfigApply))
+
 	// --- API: Send Message (with Queue System) ---
 	mux.HandleFunc("/api/messages/send", requireAPIKey(func(w http.ResponseWriter, r *http.Request) {
 
 		if r.Method != "POST" {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
-
 		var req struct {
-			ChatJID     string `json:"chat_jid"`
-			Message     string `json:"message"`
-			CallbackURL string `json:"callback_url,omitempty"` // Optional callback URL
-		}
-
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, "Invalid request body", http.StatusBadRequest)
-			return
-		}
-
-		if req.ChatJID == "" || req.Message == "" {
-			http.Error(w, "Missing chat_jid or message", http.StatusBadRequest)
-			return
-		}
-
-		// Get user ID from context (set by requireAPIKey middleware)
-		userID := r.Context().Value("userID").(int64)
-		email := getUserEmailByID(userID)
-
-		// Check for spam patterns
-		if isSpamPattern(req.Message, email) {
-			fmt.Printf("WARNING: Blocked potential spam message from %s\n", email)
-			http.Error(w, "Message blocked: potential spam detected", http.StatusBadRequest)
-			return
-		}
-
-		// Check if WhatsApp is connected
-		state := getUserWAState(email)
-		state.mu.RLock()
-		client := state.waClient
-		state.mu.RUnlock()
-
-		if client == nil {
-			http.Error(w, "WhatsApp client not connected", http.StatusServiceUnavailable)
-			return
-		}
-
-		// Validate chat JID
-		_, err := types.ParseJID(req.ChatJID)
-		if err != nil {
-			http.Error(w, "Invalid chat JID", http.StatusBadRequest)
+			ChatJID     string              `json:"chat_jid"`
+			Message     string              `json:"message"`
+			MediaID     string              `json:"media_id,omitempty"`       // Optional media from /api/media/upload-url
+			CallbackURL string              `json:"callback_url,omitempty"`   // Optional callback URL
+			Reservation string              `json:"reservation_id,omitempty"` // Optional capacity reservation
+			ExpiresIn   int                 `json:"expires_in,omitempty"`     // Optional: seconds after which the message is dropped unsent
+			GroupKey    string              `json:"group_key,omitempty"`      // Optional: sent back-to-back with other messages with this key
+			Interactive *InteractiveMessage `json:"interactive,omitempty"`    // Optional: buttons or a list to choose from
+		}
+
+		if err := decodeJSONBody(w, r, &req); err != nil {
+			writeBodyError(w, err)
 			return
 		}
 
-		// Get or create queue for this user
-		queue := getOrCreateQueue(email)
-
-		// Check if queue can accept messages
-		if !queue.canSendMessage() {
-			http.Error(w, "Daily or hourly message limit reached", http.StatusTooManyRequests)
-			return
-		}
-
-		// Create queued message
-		queuedMsg := &QueuedMessage{
-			ID:          generateMessageID(),
-			UserEmail:   email,
+		result := enqueueWithAPIKey(w, r, SendRequest{
 			ChatJID:     req.ChatJID,
 			Message:     req.Message,
+			MediaID:     req.MediaID,
 			CallbackURL: req.CallbackURL,
-			CreatedAt:   time.Now(),
-			Status:      "queued",
-		}
-
-		// Debug logging
-		if req.CallbackURL != "" {
-			fmt.Printf("DEBUG: Callback URL received: %s for message %s\n", req.CallbackURL, queuedMsg.ID)
-		} else {
-			fmt.Printf("DEBUG: No callback URL provided for message %s\n", queuedMsg.ID)
-		}
-
-		// Add to queue
-		err = queue.addMessage(queuedMsg)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			Source:      "api",
+			Reservation: req.Reservation,
+			ExpiresIn:   req.ExpiresIn,
+			GroupKey:    req.GroupKey,
+			Interactive: req.Interactive,
+		})
+		if result == nil {
 			return
 		}
 
-		// Get queue position and estimated delay
-		position := queue.getQueuePosition(queuedMsg.ID)
-		estimatedDelay := queue.estimateDelay(position)
-
-		fmt.Printf("SUCCESS: Queued message %s for user %s (position: %d)\n", queuedMsg.ID, email, position)
-
 		// Return immediate response
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"success":         true,
-			"status":          "queued",
-			"queue_id":        queuedMsg.ID,
-			"position":        position,
-			"estimated_delay": fmt.Sprintf("%.0f seconds", estimatedDelay.Seconds()),
-			"message":         "Message queued successfully",
-		})
+		json.NewEncoder(w).Encode(sendResultResponse(result))
 	}))
 
 	// --- Serve media files ---
-	mux.HandleFunc("/media/", func(w http.ResponseWriter, r *http.Request) {
-		mediaFile := path.Base(r.URL.Path)
-		filePath := path.Join(mediaDir, mediaFile)
-		f, err := os.Open(filePath)
-		if err != nil {
-			http.NotFound(w, r)
-			return
-		}
-		defer f.Close()
-		// Set content type based on file extension (simple)
-		ext := path.Ext(mediaFile)
-		if ext == ".jpg" || ext == ".jpeg" {
-			w.Header().Set("Content-Type", "image/jpeg")
-		} else if ext == ".png" {
-			w.Header().Set("Content-Type", "image/png")
-		} else if ext == ".mp3" {
-			w.Header().Set("Content-Type", "audio/mpeg")
-		} else if ext == ".ogg" {
-			w.Header().Set("Content-Type", "audio/ogg")
-		} else {
-			w.Header().Set("Content-Type", "application/octet-stream")
-		}
-		io.Copy(w, f)
-	})
+	mux.HandleFunc("/media/", handleServeMedia(mediaDir))
 
 	// --- Webhook receiver endpoint ---
-	mux.HandleFunc("/webhook/", func(w http.ResponseWriter, r *http.Request) {
-		id := path.Base(r.URL.Path)
-		if id == "" {
-			http.NotFound(w, r)
-			return
-		}
-
-		fmt.Printf("Received webhook call for id: %s\n", id)
-
-		// Check if this is a POST request with a body (from n8n)
-		if r.Method == "POST" && r.Body != nil {
-			var payload map[string]interface{}
-			if err := json.NewDecoder(r.Body).Decode(&payload); err == nil {
-				fmt.Printf("DEBUG: Received JSON payload: %+v\n", payload)
-				// This is likely from n8n - extract message and send to WhatsApp
-				if message, ok := payload["message"].(string); ok && message != "" {
-					fmt.Printf("Received message from webhook %s: %s\n", id, message)
-
-					// Get the webhook owner
-					userID, err := dbGetWebhookOwner(id)
-					if err != nil {
-						fmt.Printf("ERROR: Failed to find webhook owner for ID %s: %v\n", id, err)
-						http.Error(w, "Webhook not found", http.StatusNotFound)
-						return
-					}
-
-					userEmail, err := dbGetUserEmailByID(userID)
-					if err != nil {
-						fmt.Printf("ERROR: Failed to find user email for ID %d: %v\n", userID, err)
-						http.Error(w, "User not found", http.StatusNotFound)
-						return
-					}
-
-					fmt.Printf("DEBUG: Webhook %s belongs to user %s\n", id, userEmail)
-
-					// Check for spam patterns
-					if isSpamPattern(message, userEmail) {
-						fmt.Printf("WARNING: Blocked potential spam message from webhook %s (user %s)\n", id, userEmail)
-						http.Error(w, "Message blocked: potential spam detected", http.StatusBadRequest)
-						return
-					}
-
-					// Get the WhatsApp client for this specific user
-					state := getUserWAState(userEmail)
-					state.mu.RLock()
-					connectedClient := state.waClient
-					waStatus := state.waStatus
-					state.mu.RUnlock()
-
-					if connectedClient == nil || waStatus != "connected" {
-						fmt.Printf("ERROR: User %s WhatsApp not connected (status: %s)\n", userEmail, waStatus)
-						http.Error(w, "WhatsApp not connected for this user", http.StatusServiceUnavailable)
-						return
-					}
-
-					// Try to get chat JID from payload
-					var chatJID types.JID
-					if chatID, ok := payload["chat_id"].(string); ok && chatID != "" {
-						if parsedJID, err := types.ParseJID(chatID); err == nil {
-							chatJID = parsedJID
-						} else {
-							fmt.Printf("ERROR: Invalid chat_id format: %s\n", chatID)
-							http.Error(w, "Invalid chat_id format", http.StatusBadRequest)
-							return
-						}
-					} else if groupID, ok := payload["groupId"].(string); ok && groupID != "" {
-						// Support legacy groupId field
-						if parsedJID, err := types.ParseJID(groupID); err == nil {
-							chatJID = parsedJID
-						}
-					} else {
-						fmt.Printf("ERROR: No chat_id or groupId provided in payload\n")
-						http.Error(w, "Missing chat_id field", http.StatusBadRequest)
-						return
-					}
-
-					// Get or create queue for this user
-					queue := getOrCreateQueue(userEmail)
-
-					// Check if queue can accept messages
-					if !queue.canSendMessage() {
-						http.Error(w, "Daily or hourly message limit reached for this user", http.StatusTooManyRequests)
-						return
-					}
-
-					// Check for optional callback URL in payload
-					callbackURL := ""
-					if callback, ok := payload["callback_url"].(string); ok {
-						callbackURL = callback
-					}
-
-					// Create queued message
-					queuedMsg := &QueuedMessage{
-						ID:          generateMessageID(),
-						UserEmail:   userEmail,
-						ChatJID:     chatJID.String(),
-						Message:     message,
-						CallbackURL: callbackURL,
-						CreatedAt:   time.Now(),
-						Status:      "queued",
-					}
-
-					// Add to queue
-					err = queue.addMessage(queuedMsg)
-					if err != nil {
-						http.Error(w, err.Error(), http.StatusServiceUnavailable)
-						return
-					}
-
-					// Get queue position and estimated delay
-					position := queue.getQueuePosition(queuedMsg.ID)
-					estimatedDelay := queue.estimateDelay(position)
-
-					fmt.Printf("SUCCESS: Queued webhook message %s for user %s (position: %d)\n", queuedMsg.ID, userEmail, position)
-
-					// Return immediate queue response
-					w.Header().Set("Content-Type", "application/json")
-					json.NewEncoder(w).Encode(map[string]interface{}{
-						"success":         true,
-						"status":          "queued",
-						"queue_id":        queuedMsg.ID,
-						"position":        position,
-						"estimated_delay": fmt.Sprintf("%.0f seconds", estimatedDelay.Seconds()),
-						"message":         "Message queued successfully",
-						"chat_id":         chatJID.String(),
-					})
-					return
-				} else {
-					fmt.Printf("DEBUG: No message field found in payload\n")
-					http.Error(w, "Missing message field", http.StatusBadRequest)
-					return
-				}
-			} else {
-				fmt.Printf("DEBUG: Failed to parse JSON body: %v\n", err)
-				http.Error(w, "Invalid JSON", http.StatusBadRequest)
-				return
-			}
-		} else {
-			fmt.Printf("DEBUG: Not a POST request or no body\n")
-		}
-
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(`{"success":true}`))
-	})
+	mux.HandleFunc("/webhook/", handleWebhookReceiver(mediaDir))
 
 	// Serve static files from frontend/dist
 	staticDir := "frontend/dist"
@@ -1825,7 +2767,7 @@ func startServer(mux *http.ServeMux, port, sessionCookieName, dbPath, mediaDir,
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		// If the request is for an API or QR endpoint, skip
 		if strings.HasPrefix(r.URL.Path, "/api/") || r.URL.Path == "/qr.png" {
-			http.NotFound(w, r)
+			apiError(w, "Not found", http.StatusNotFound)
 			return
 		}
 		// Try to serve static file
@@ -1889,78 +2831,121 @@ func getUserWAStatus(email string) string {
 
 // Handle WhatsApp events for a specific user
 func handleUserWAEvent(email string, evt interface{}, mediaDir string, waSessionPrefix string) {
-	state := getUserWAState(email)
 	switch v := evt.(type) {
+	case *events.PairSuccess:
+		rememberUserDevice(email, v.ID)
 	case *events.Message:
 		if v.Info.IsFromMe {
 			return // Ignore own messages
 		}
 		msg := v.Message
-		if msg == nil {
-			return
+		if msg == nil || msg.GetPinInChatMessage() != nil {
+			return // Pins are reported as message.pinned events (see message_marks.go)
+		}
+		if paymentPayload(msg) != nil {
+			return // Reported as payment.activity events (see payments.go)
 		}
 		// Prepare payload
 		payload := map[string]interface{}{
-			"from":      v.Info.Sender.String(),
-			"to":        v.Info.Chat.String(),
 			"timestamp": v.Info.Timestamp.Unix(),
 			"id":        v.Info.ID,
 		}
+		client := userWAClient(email)
+		addMessageAddresses(client, payload, v.Info)
 
 		// Try to get contact name
 		if v.Info.PushName != "" {
 			payload["name"] = v.Info.PushName
-		} else if v.Info.Sender.User != "" {
-			payload["name"] = v.Info.Sender.User
+		} else if from, _ := payload["from"].(string); from != "" {
+			payload["name"] = strings.Split(from, "@")[0]
 		}
 
+		userID, _ := getUserIDByEmail(email) // Owner of stored media, which is only deduplicated per user
 		mediaPath := ""
+		documentText := ""
 		// Text message
 		if msg.GetConversation() != "" {
 			payload["type"] = "text"
 			payload["text"] = msg.GetConversation()
+		} else if ext := msg.GetExtendedTextMessage(); ext != nil && ext.GetText() != "" {
+			// Messages with link previews (e.g. group invite links) arrive as extended text
+			payload["type"] = "text"
+			payload["text"] = ext.GetText()
 		} else if img := msg.GetImageMessage(); img != nil {
 			payload["type"] = "image"
-			filename := fmt.Sprintf("%d_%s.jpg", time.Now().UnixNano(), v.Info.ID)
-			os.MkdirAll("media", 0755)
-			f, err := os.Create(path.Join("media", filename))
-			if err == nil {
-				data, err := state.waClient.Download(context.Background(), img)
-				if err == nil {
-					f.Write(data)
-					f.Close()
-					mediaPath = "/media/" + filename
-					payload["media_url"] = mediaPath
-					payload["caption"] = img.GetCaption()
-				}
+			filename := fmt.Sprintf("%d_%s%s", time.Now().UnixNano(), v.Info.ID, mediaExtension(img.GetMimetype(), ".jpg"))
+			if stored := storeReceivedMedia(client, userID, mediaDir, img, filename, img.GetMimetype(), ""); stored != "" {
+				mediaPath = "/media/" + stored
+				payload["media_url"] = mediaPath
+				payload["mime_type"] = img.GetMimetype()
+				payload["caption"] = img.GetCaption()
+				ocrReceivedImage(filepath.Join(mediaDir, stored), img.GetMimetype(), payload)
+			}
+		} else if video := msg.GetVideoMessage(); video != nil {
+			payload["type"] = "video"
+			filename := fmt.Sprintf("%d_%s%s", time.Now().UnixNano(), v.Info.ID, mediaExtension(video.GetMimetype(), ".mp4"))
+			if stored := storeReceivedMedia(client, userID, mediaDir, video, filename, video.GetMimetype(), ""); stored != "" {
+				mediaPath = "/media/" + stored
+				payload["media_url"] = mediaPath
+				payload["mime_type"] = video.GetMimetype()
+				payload["caption"] = video.GetCaption()
 			}
 		} else if audio := msg.GetAudioMessage(); audio != nil {
 			payload["type"] = "audio"
-			filename := fmt.Sprintf("%d_%s.ogg", time.Now().UnixNano(), v.Info.ID)
-			os.MkdirAll("media", 0755)
-			f, err := os.Create(path.Join("media", filename))
-			if err == nil {
-				data, err := state.waClient.Download(context.Background(), audio)
-				if err == nil {
-					f.Write(data)
-					f.Close()
-					mediaPath = "/media/" + filename
-					payload["media_url"] = mediaPath
-				}
+			filename := fmt.Sprintf("%d_%s%s", time.Now().UnixNano(), v.Info.ID, mediaExtension(audio.GetMimetype(), ".ogg"))
+			if stored := storeReceivedMedia(client, userID, mediaDir, audio, filename, audio.GetMimetype(), ""); stored != "" {
+				mediaPath = "/media/" + stored
+				payload["media_url"] = mediaPath
+				payload["mime_type"] = audio.GetMimetype()
 			}
 		} else if doc := msg.GetDocumentMessage(); doc != nil {
 			payload["type"] = "document"
-			filename := fmt.Sprintf("%d_%s_%s", time.Now().UnixNano(), v.Info.ID, doc.GetFileName())
-			os.MkdirAll("media", 0755)
-			f, err := os.Create(path.Join("media", filename))
-			if err == nil {
-				data, err := state.waClient.Download(context.Background(), doc)
-				if err == nil {
-					f.Write(data)
-					f.Close()
-					mediaPath = "/media/" + filename
+			// Sender-controlled file name: keep only the base name on disk
+			filename := fmt.Sprintf("%d_%s_%s", time.Now().UnixNano(), v.Info.ID, filepath.Base(doc.GetFileName()))
+			if stored := storeReceivedMedia(client, userID, mediaDir, doc, filename, doc.GetMimetype(), doc.GetFileName()); stored != "" {
+				payload["file_name"] = doc.GetFileName()
+				payload["mime_type"] = doc.GetMimetype()
+				// Only expose documents that pass the (optional) scanner
+				if scanReceivedMedia(filepath.Join(mediaDir, stored), payload) {
+					mediaPath = "/media/" + stored
 					payload["media_url"] = mediaPath
-					payload["file_name"] = doc.GetFileName()
+					documentText = extractReceivedDocumentText(filepath.Join(mediaDir, stored), doc.GetMimetype(), payload)
+				}
+			}
+		} else if msg.GetGroupInviteMessage() != nil {
+			payload["type"] = "group_invite"
+		} else if order := msg.GetOrderMessage(); order != nil {
+			// Catalogue orders and products (see business_messages.go)
+			payload["type"] = "order"
+			payload["text"] = order.GetMessage()
+			payload["order"] = orderPayload(order)
+		} else if product := msg.GetProductMessage(); product != nil {
+			payload["type"] = "product"
+			payload["text"] = product.GetProduct().GetTitle()
+			payload["product"] = productPayload(product)
+		} else if reply := interactiveReplyPayload(msg); reply != nil {
+			// A choice picked from buttons or a list (see interactive.go)
+			payload["type"] = "interactive_reply"
+			payload["text"] = reply["title"]
+			payload["reply"] = reply
+		}
+		// Surface group invite links and invite messages as a structured field
+		if invite := groupInvitePayload(msg, v.Info.Sender); invite != nil {
+			payload["group_invite"] = invite
+		}
+		// Index stored media per chat for archive downloads
+		if mediaPath != "" {
+			if userID, err := getUserIDByEmail(email); err == nil {
+				filePath := filepath.Join(mediaDir, path.Base(mediaPath))
+				if err := dbRecordChatMedia(userID, v.Info.Chat.String(), v.Info.ID, payload["type"].(string), filePath, v.Info.Timestamp); err != nil {
+					fmt.Println("ERROR: Could not index chat media", err)
+				}
+				// Keyed by the archived chat JID, as used by the message endpoints
+				if documentText != "" {
+					chatJID, _ := payload["to"].(string)
+					if err := dbSaveDocumentText(userID, chatJID, v.Info.ID, documentText); err != nil {
+						fmt.Println("ERROR: Could not store document text", err)
+					}
 				}
 			}
 		}
@@ -1990,30 +2975,19 @@ func startUserWhatsMeowConnection(email string, mediaDir string, waSessionPrefix
 	state.mu.Lock()
 	state.waCancel = cancel
 	state.mu.Unlock()
+	setUserWAStatus(email, "connecting")
+	updateUserLoginState(email, "Connecting...")
 
-	// Ensure sessions directory exists
-	os.MkdirAll("sessions", 0755)
-	// Use user-specific session file in sessions dir
-	sessionFile := fmt.Sprintf("sessions/%s%s.db", waSessionPrefix, email)
-	fmt.Println("DEBUG: Using session file:", sessionFile)
-	container, err := sqlstore.New(ctx, "sqlite", fmt.Sprintf("file:%s?mode=rwc&_pragma=foreign_keys(1)", sessionFile), nil)
-	if err != nil {
-		fmt.Println("DEBUG: Failed to create store:", err)
-		setUserWAStatus(email, "error")
-		updateUserLoginState(email, "Failed to create store: "+err.Error())
-		return
-	}
-
-	deviceStore, err := container.GetFirstDevice(ctx)
+	deviceStore, err := getUserDevice(ctx, email, waSessionPrefix)
 	if err != nil {
-		fmt.Println("DEBUG: Failed to get device:", err)
-		setUserWAStatus(email, "error")
-		updateUserLoginState(email, "Failed to get device: "+err.Error())
+		fmt.Println("DEBUG: Failed to load device:", err)
+		setUserWAError(email, "Failed to load device: "+err.Error())
 		return
 	}
 
 	fmt.Println("DEBUG: Creating WhatsApp client...")
 	client := whatsmeow.NewClient(deviceStore, nil)
+	applyWADeviceProps(client, email)
 
 	// Set client (with mutex protection)
 	state.mu.Lock()
@@ -2022,17 +2996,26 @@ func startUserWhatsMeowConnection(email string, mediaDir string, waSessionPrefix
 
 	// Add event handler for this user
 	client.AddEventHandler(func(evt interface{}) {
+		handleUserWAStatusEvent(email, client, evt, waSessionPrefix)
+		handleContactSyncEvent(email, client, evt)
+		handleGroupInfoEvent(evt)
+		handleMessageMarkEvent(email, evt)
+		handlePaymentEvent(email, evt)
 		handleUserWAEvent(email, evt, mediaDir, waSessionPrefix)
 	})
 
 	if client.Store.ID == nil {
+		// Need to login; only WA_MAX_PAIRING pairing flows run at once
+		releasePairing, err := acquirePairingSlot(ctx, email)
+		if err != nil {
+			return // Disconnected while waiting
+		}
 		fmt.Println("DEBUG: Need to login, getting QR channel...")
-		// Need to login
 		qrChan, qrErr := client.GetQRChannel(ctx)
 		if qrErr != nil {
+			releasePairing()
 			fmt.Println("DEBUG: Failed to get QR channel:", qrErr)
-			setUserWAStatus(email, "error")
-			updateUserLoginState(email, "Failed to get QR channel: "+qrErr.Error())
+			setUserWAError(email, "Failed to get QR channel: "+qrErr.Error())
 			return
 		}
 
@@ -2045,39 +3028,44 @@ func startUserWhatsMeowConnection(email string, mediaDir string, waSessionPrefix
 			err := client.Connect()
 			if err != nil {
 				fmt.Println("DEBUG: client.Connect() failed:", err)
-				setUserWAStatus(email, "error")
-				updateUserLoginState(email, "Failed to connect: "+err.Error())
+				setUserWAError(email, "Failed to connect: "+err.Error())
 				return
 			}
 			fmt.Println("DEBUG: client.Connect() successful")
 		}()
 
 		go func() {
+			defer releasePairing()
 			fmt.Println("DEBUG: Starting QR code listener...")
 			for evt := range qrChan {
 				fmt.Println("DEBUG: QR event received:", evt.Event)
 				if evt.Event == "code" {
 					fmt.Println("DEBUG: Got QR code, updating...")
-					updateUserQRCode(email, evt.Code)
-					setUserWAStatus(email, "waiting_qr")
-					updateUserLoginState(email, "Waiting for QR code scan...")
+					showUserQRCode(email, evt.Code, evt.Timeout)
 				} else if evt.Event == "error" {
 					fmt.Println("DEBUG: QR channel error:", evt.Error)
-					setUserWAStatus(email, "error")
-					updateUserLoginState(email, "QR channel error: "+evt.Error.Error())
+					setUserWAError(email, "QR channel error: "+evt.Error.Error())
+					publishQREvent(email, QRStreamEvent{Event: QR_EVENT_ERROR, Error: evt.Error.Error()})
 					break
 				} else {
 					fmt.Println("DEBUG: Login event:", evt.Event)
 					updateUserLoginState(email, "Login event: "+evt.Event)
 					if evt.Event == "success" {
-						setUserWAStatus(email, "connected")
-						updateUserLoginState(email, "Successfully logged in!")
-						updateUserQRCode(email, "")
+						// Paired; the status turns connected on the Connected event that follows
+						state.mu.Lock()
+						if state.waStatus != "connected" {
+							state.waStatus = "connecting"
+							state.loginState = "Paired, logging in..."
+						}
+						state.qrCode = ""
+						state.mu.Unlock()
+						publishQREvent(email, QRStreamEvent{Event: QR_EVENT_SUCCESS})
 						break
 					} else if evt.Event == "timeout" {
-						setUserWAStatus(email, "disconnected")
-						updateUserLoginState(email, "QR code timed out. Please try again.")
-						updateUserQRCode(email, "")
+						// whatsmeow has disconnected the client; start over with new codes
+						if expireUserQR(email, client) {
+							go startUserWhatsMeowConnection(email, mediaDir, waSessionPrefix)
+						}
 						break
 					}
 				}
@@ -2091,86 +3079,251 @@ func startUserWhatsMeowConnection(email string, mediaDir string, waSessionPrefix
 			err := client.Connect()
 			if err != nil {
 				fmt.Println("DEBUG: Connect failed for existing session:", err)
-				setUserWAStatus(email, "error")
-				updateUserLoginState(email, "Failed to connect: "+err.Error())
+				setUserWAError(email, "Failed to connect: "+err.Error())
 				return
 			}
-			fmt.Println("DEBUG: Connected with existing session")
-			setUserWAStatus(email, "connected")
-			updateUserLoginState(email, "Already logged in!")
+			// The status turns connected on the Connected event
+			fmt.Println("DEBUG: Connecting with existing session")
 		}()
 	}
 	fmt.Println("DEBUG: startUserWhatsMeowConnection finished setup for:", email)
 }
 
-// Disconnect WhatsApp for a specific user
-func disconnectUserWhatsMeow(email string, mediaDir string, waSessionPrefix string) {
-	state := getUserWAState(email)
-	state.mu.Lock()
+// Disconnect WhatsApp for a specific user, keeping the session so the next connect
+// needs no QR scan
+func disconnectUserWhatsMeow(email string) {
+	cancelScheduledWAConnect(email)
+	if client := detachUserWAClient(email); client != nil {
+		client.Disconnect()
+	}
 
-	if state.waCancel != nil {
-		state.waCancel()
-		state.waCancel = nil
+	markUserWADown(email, "disconnected", "Disconnected", "")
+	updateUserQRCode(email, "")
+}
+
+// How long logout waits for WhatsApp to connect and confirm the unlink
+const WA_LOGOUT_TIMEOUT = 15 * time.Second
+
+// Log out of WhatsApp for a specific user: unlink the device from the phone and delete
+// its credentials. The credentials are deleted even if unlinking fails; the error is
+// returned so the user can remove the device from the phone instead.
+func logoutUserWhatsMeow(email string, waSessionPrefix string) error {
+	client := detachUserWAClient(email)
+	if client == nil {
+		// Not running: connect with the stored session just to unlink it
+		if deviceStore, err := getUserDevice(context.Background(), email, waSessionPrefix); err == nil && deviceStore.ID != nil {
+			client = whatsmeow.NewClient(deviceStore, nil)
+			if err := client.Connect(); err == nil {
+				client.WaitForConnection(WA_LOGOUT_TIMEOUT)
+			}
+		}
 	}
 
-	if state.waClient != nil {
-		state.waClient.Disconnect()
-		state.waClient = nil
+	var err error
+	if client != nil && client.Store.ID != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), WA_LOGOUT_TIMEOUT)
+		err = client.Logout(ctx)
+		cancel()
+		if err != nil {
+			fmt.Printf("WARNING: Could not unlink WhatsApp device of %s, deleting its credentials anyway: %v\n", email, err)
+			client.Disconnect()
+		}
+	} else if client != nil {
+		client.Disconnect()
 	}
+	// Remove the user's session file or shared store device
+	deleteUserDevice(email, waSessionPrefix)
 
-	state.mu.Unlock()
+	markUserWADown(email, "disconnected", "Logged out", "")
+	updateUserQRCode(email, "")
+	return err
+}
 
-	// Remove user's session file from sessions dir
-	sessionFile := fmt.Sprintf("sessions/%s%s.db", waSessionPrefix, email)
-	os.Remove(sessionFile)
+// Stop a user's WhatsApp connection attempt and take their client, if any
+func detachUserWAClient(email string) *whatsmeow.Client {
+	state := getUserWAState(email)
+	state.mu.Lock()
+	defer state.mu.Unlock()
 
-	setUserWAStatus(email, "disconnected")
-	updateUserQRCode(email, "")
-	updateUserLoginState(email, "Disconnected")
+	if state.waCancel != nil {
+		state.waCancel()
+		state.waCancel = nil
+	}
+	client := state.waClient
+	state.waClient = nil
+	return client
 }
 
-// Get user_id from email
+// Get user_id from email (cached; unknown emails are not)
 func getUserIDByEmail(email string) (int64, error) {
+	if id, ok := userIDCache.get(email); ok {
+		return id.(int64), nil
+	}
 	var id int64
-	row := db.QueryRow("SELECT id FROM users WHERE email = ?", email)
+	row := preparedQueryRow(readDB, "SELECT id FROM users WHERE email = ?", email)
 	err := row.Scan(&id)
 	if err != nil {
 		return 0, err
 	}
+	userIDCache.set(email, id)
 	return id, nil
 }
 
+// Satisfied by *sql.DB and *sql.Tx
+type dbExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
 // Create a webhook in the DB
 func dbCreateWebhook(userID int64, wh Webhook) error {
-	_, err := db.Exec(`INSERT INTO webhooks (id, user_id, url, method, filter_type, filter_value, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)`,
-		wh.ID, userID, wh.URL, wh.Method, wh.FilterType, wh.FilterValue, wh.CreatedAt)
+	defer invalidateWebhooksCache(userID)
+	return dbCreateWebhookWith(db, userID, wh)
+}
+
+// The JSON-encoded columns of a webhook
+func encodeWebhookColumns(wh Webhook) (headers, urls, allowedChats, schedule string, err error) {
+	if len(wh.Headers) > 0 {
+		data, err := json.Marshal(wh.Headers)
+		if err != nil {
+			return "", "", "", "", err
+		}
+		headers = string(data)
+	}
+	if len(wh.URLs) > 0 {
+		data, err := json.Marshal(wh.URLs)
+		if err != nil {
+			return "", "", "", "", err
+		}
+		urls = string(data)
+	}
+	if allowedChats, err = encodeAllowedChats(wh.AllowedChats); err != nil {
+		return "", "", "", "", err
+	}
+	schedule, err = encodeWebhookSchedule(wh.Schedule)
+	return headers, urls, allowedChats, schedule, err
+}
+
+// Create a webhook using the given DB or transaction
+func dbCreateWebhookWith(exec dbExecer, userID int64, wh Webhook) error {
+	headers, urls, allowedChats, schedule, err := encodeWebhookColumns(wh)
+	if err != nil {
+		return err
+	}
+	if wh.Policy == "" {
+		wh.Policy = DELIVERY_ALL
+	}
+	_, err = exec.Exec(`INSERT INTO webhooks (id, user_id, url, method, filter_type, filter_value, tags, paused, headers, urls, delivery_policy, auto_reply, allowed_chats, events, keywords, match_regex, priority, fallback, max_payload_bytes, redact, unverified, schedule, sample_rate, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		wh.ID, userID, wh.URL, wh.Method, wh.FilterType, wh.FilterValue, strings.Join(wh.Tags, ","), wh.Paused, headers, urls, wh.Policy, wh.AutoReply, allowedChats, strings.Join(wh.Events, ","),
+		strings.Join(wh.Keywords, ","), wh.MatchRegex, wh.Priority, wh.Fallback, wh.MaxPayload, strings.Join(wh.Redact, ","), wh.Unverified, schedule, wh.SampleRate, wh.CreatedAt)
+	return err
+}
+
+// Replace a webhook's settings using the given DB or transaction. Its ID, creation and
+// delivery times and verification state are kept.
+func dbUpdateWebhookWith(exec dbExecer, userID int64, wh Webhook) error {
+	headers, urls, allowedChats, schedule, err := encodeWebhookColumns(wh)
+	if err != nil {
+		return err
+	}
+	if wh.Policy == "" {
+		wh.Policy = DELIVERY_ALL
+	}
+	_, err = exec.Exec(`UPDATE webhooks SET url = ?, method = ?, filter_type = ?, filter_value = ?, tags = ?, paused = ?, headers = ?, urls = ?, delivery_policy = ?, auto_reply = ?, allowed_chats = ?, events = ?, keywords = ?, match_regex = ?, priority = ?, fallback = ?, max_payload_bytes = ?, redact = ?, schedule = ?, sample_rate = ? WHERE user_id = ? AND id = ?`,
+		wh.URL, wh.Method, wh.FilterType, wh.FilterValue, strings.Join(wh.Tags, ","), wh.Paused, headers, urls, wh.Policy, wh.AutoReply, allowedChats, strings.Join(wh.Events, ","),
+		strings.Join(wh.Keywords, ","), wh.MatchRegex, wh.Priority, wh.Fallback, wh.MaxPayload, strings.Join(wh.Redact, ","), schedule, wh.SampleRate, userID, wh.ID)
 	return err
 }
 
-// List all webhooks for a user from the DB
+// Columns selected for a Webhook, in the order scanWebhook expects
+const webhookColumns = `id, url, method, filter_type, filter_value, tags, paused, headers, urls, delivery_policy, auto_reply, allowed_chats, events, keywords, match_regex, priority, fallback, max_payload_bytes, redact, unverified, schedule, sample_rate, last_delivery_at, created_at`
+
+// Scan a single webhook row (from *sql.Row or *sql.Rows)
+func scanWebhook(row interface{ Scan(...interface{}) error }) (Webhook, error) {
+	var wh Webhook
+	var tags, headers, urls, allowedChats, events, keywords, redact, schedule, createdAt string
+	var lastDelivery sql.NullString
+	err := row.Scan(&wh.ID, &wh.URL, &wh.Method, &wh.FilterType, &wh.FilterValue, &tags, &wh.Paused, &headers, &urls, &wh.Policy, &wh.AutoReply, &allowedChats, &events,
+		&keywords, &wh.MatchRegex, &wh.Priority, &wh.Fallback, &wh.MaxPayload, &redact, &wh.Unverified, &schedule, &wh.SampleRate, &lastDelivery, &createdAt)
+	if err != nil {
+		return wh, err
+	}
+	wh.Tags = []string{}
+	if tags != "" {
+		wh.Tags = strings.Split(tags, ",")
+	}
+	if headers != "" {
+		json.Unmarshal([]byte(headers), &wh.Headers)
+	}
+	if urls != "" {
+		json.Unmarshal([]byte(urls), &wh.URLs)
+	}
+	wh.AllowedChats = decodeAllowedChats(allowedChats)
+	if events != "" {
+		wh.Events = strings.Split(events, ",")
+	}
+	if keywords != "" {
+		wh.Keywords = strings.Split(keywords, ",")
+	}
+	if redact != "" {
+		wh.Redact = strings.Split(redact, ",")
+	}
+	wh.Schedule = decodeWebhookSchedule(schedule)
+	if lastDelivery.Valid {
+		if t, err := time.Parse(time.RFC3339, lastDelivery.String); err == nil {
+			wh.LastDeliveryAt = &t
+		}
+	}
+	wh.CreatedAt, _ = time.Parse(time.RFC3339, createdAt)
+	return wh, nil
+}
+
+// List all webhooks for a user from the DB (cached; callers get their own slice)
 func dbListWebhooks(userID int64) ([]Webhook, error) {
-	rows, err := db.Query(`SELECT id, url, method, filter_type, filter_value, created_at FROM webhooks WHERE user_id = ? ORDER BY created_at DESC`, userID)
+	if cached, ok := webhooksCache.get(userID); ok {
+		return append([]Webhook(nil), cached.([]Webhook)...), nil
+	}
+	rows, err := preparedQuery(readDB, `SELECT `+webhookColumns+` FROM webhooks WHERE user_id = ? ORDER BY created_at DESC, id`, userID)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 	var webhooks []Webhook
 	for rows.Next() {
-		var wh Webhook
-		var createdAt string
-		err := rows.Scan(&wh.ID, &wh.URL, &wh.Method, &wh.FilterType, &wh.FilterValue, &createdAt)
+		wh, err := scanWebhook(rows)
 		if err != nil {
 			return nil, err
 		}
-		wh.CreatedAt, _ = time.Parse(time.RFC3339, createdAt)
 		webhooks = append(webhooks, wh)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	webhooksCache.set(userID, append([]Webhook(nil), webhooks...))
 	return webhooks, nil
 }
 
+// Get a single webhook by ID for a user
+func dbGetWebhook(userID int64, webhookID string) (Webhook, error) {
+	row := db.QueryRow(`SELECT `+webhookColumns+` FROM webhooks WHERE user_id = ? AND id = ?`, userID, webhookID)
+	return scanWebhook(row)
+}
+
 // Delete a webhook by ID for a user
 func dbDeleteWebhook(userID int64, webhookID string) error {
-	_, err := db.Exec(`DELETE FROM webhooks WHERE user_id = ? AND id = ?`, userID, webhookID)
+	defer invalidateWebhooksCache(userID)
+	return dbDeleteWebhookWith(db, userID, webhookID)
+}
+
+// Delete a webhook along with the payloads buffered for it outside its schedule
+func dbDeleteWebhookWith(exec dbExecer, userID int64, webhookID string) error {
+	res, err := exec.Exec(`DELETE FROM webhooks WHERE user_id = ? AND id = ?`, userID, webhookID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil
+	}
+	_, err = exec.Exec(`DELETE FROM webhook_buffer WHERE user_id = ? AND webhook_id = ?`, userID, webhookID)
 	return err
 }
 
@@ -2185,7 +3338,7 @@ func generateAPIKey() string {
 func getUserIDByAPIKey(apiKey string) int64 {
 	var userID int64
 	fmt.Printf("DEBUG: Looking up API key in database: '%s'\n", apiKey)
-	err := db.QueryRow(`SELECT id FROM users WHERE api_key = ?`, apiKey).Scan(&userID)
+	err := preparedQueryRow(readDB, `SELECT id FROM users WHERE api_key = ?`, apiKey).Scan(&userID)
 	if err != nil {
 		fmt.Printf("DEBUG: Database query error for API key '%s': %v\n", apiKey, err)
 		return 0 // Invalid API key
@@ -12,11 +12,17 @@ import (
 	"time"
 )
 
+// Test destinations are httptest servers on loopback
+func init() {
+	os.Setenv("OUTBOUND_ALLOWED_NETWORKS", "127.0.0.0/8,::1/128")
+	initOutboundGuard()
+}
+
 func setupTestServer() (*httptest.Server, func()) {
 	// Use a temporary DB and media dir for tests
 	tmpDB := "test_whatsmeow.db"
 	tmpMedia := "test_media"
-	os.Remove(tmpDB)
+	removeTestDB(tmpDB)
 	os.RemoveAll(tmpMedia)
 	os.Mkdir(tmpMedia, 0755)
 
@@ -26,12 +32,20 @@ func setupTestServer() (*httptest.Server, func()) {
 
 	teardown := func() {
 		ts.Close()
-		os.Remove(tmpDB)
+		stopServer()
+		removeTestDB(tmpDB)
 		os.RemoveAll(tmpMedia)
 	}
 	return ts, teardown
 }
 
+// Remove a test DB along with its WAL files and secrets key, so a new DB doesn't pick up a stale log
+func removeTestDB(path string) {
+	for _, suffix := range []string{"", "-wal", "-shm", ".key"} {
+		os.Remove(path + suffix)
+	}
+}
+
 func TestRegisterLoginLogoutSession(t *testing.T) {
 	ts, teardown := setupTestServer()
 	defer teardown()
@@ -90,6 +104,21 @@ func TestRegisterLoginLogoutSession(t *testing.T) {
 	if sessData2["authenticated"].(bool) {
 		t.Fatalf("Session still authenticated after logout")
 	}
+
+	// The old cookie is revoked server-side
+	req3, _ := http.NewRequest("GET", ts.URL+"/api/session", nil)
+	for _, c := range resp.Cookies() {
+		req3.AddCookie(c)
+	}
+	sessResp3, err := client.Do(req3)
+	if err != nil {
+		t.Fatalf("Session check with the old cookie failed: %v", err)
+	}
+	var sessData3 map[string]interface{}
+	json.NewDecoder(sessResp3.Body).Decode(&sessData3)
+	if sessData3["authenticated"].(bool) {
+		t.Fatalf("Old session cookie still authenticated after logout")
+	}
 }
 
 func TestWebhookManagement(t *testing.T) {
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+)
+
+// --- Session health ---
+// A connection can die silently (a NAT dropping the idle socket) while still looking
+// connected. Every WA_HEALTH_INTERVAL, each connected client that hasn't been heard
+// from in that time is checked: its socket must be up and answer a query within
+// WA_HEALTH_PING_TIMEOUT. A client that fails is reconnected. Any event from a client
+// or a passed check counts as seeing it; last_seen_at is reported by /api/wa/status
+// and in /api/admin/diagnostics.
+
+const (
+	DEFAULT_WA_HEALTH_INTERVAL = time.Minute
+	WA_HEALTH_PING_TIMEOUT     = 15 * time.Second
+)
+
+var waHealthInterval = DEFAULT_WA_HEALTH_INTERVAL
+
+// The parts of a WhatsApp connection the health check uses
+type waSession interface {
+	IsConnected() bool
+	Ping() error
+	Connect() error
+	Disconnect()
+}
+
+type whatsmeowSession struct {
+	*whatsmeow.Client
+}
+
+// Look up the account's own number: a round trip that fails on a dead socket
+func (s whatsmeowSession) Ping() error {
+	if s.Store == nil || s.Store.ID == nil {
+		return errors.New("not logged in")
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.IsOnWhatsApp([]string{"+" + s.Store.ID.User})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(WA_HEALTH_PING_TIMEOUT):
+		return errors.New("no answer")
+	}
+}
+
+// Read WA_HEALTH_INTERVAL; 0 turns the checker off
+func initSessionHealth() {
+	waHealthInterval = DEFAULT_WA_HEALTH_INTERVAL
+	if value := os.Getenv("WA_HEALTH_INTERVAL"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			fmt.Printf("WARNING: Ignoring WA_HEALTH_INTERVAL=%q, expected a duration like 1m\n", value)
+		} else {
+			waHealthInterval = d
+		}
+	}
+}
+
+func markUserWASeen(email string, at time.Time) {
+	state := getUserWAState(email)
+	state.mu.Lock()
+	if at.After(state.lastSeenAt) {
+		state.lastSeenAt = at
+	}
+	state.mu.Unlock()
+}
+
+// Check one user's connection, reconnecting it if it's dead. Reports whether it had
+// to reconnect.
+func checkSessionHealth(email string, session waSession, now time.Time) bool {
+	state := getUserWAState(email)
+	state.mu.RLock()
+	status, lastSeen := state.waStatus, state.lastSeenAt
+	state.mu.RUnlock()
+	if status != "connected" || now.Sub(lastSeen) < waHealthInterval {
+		return false
+	}
+
+	err := errors.New("socket closed")
+	if session.IsConnected() {
+		err = session.Ping()
+	}
+	if err == nil {
+		markUserWASeen(email, now)
+		return false
+	}
+
+	fmt.Printf("WARNING: WhatsApp connection of %s is stale (%v), reconnecting\n", email, err)
+	session.Disconnect()
+	markUserWADown(email, "reconnecting", "Connection went stale, reconnecting...", "Health check failed: "+err.Error())
+	go func() {
+		// Unless the user disconnected meanwhile; the status turns connected on the
+		// Connected event
+		if getUserWAStatus(email) != "reconnecting" {
+			return
+		}
+		if err := session.Connect(); err != nil {
+			setUserWAError(email, "Failed to reconnect: "+err.Error())
+		}
+	}()
+	return true
+}
+
+// Check every connected client, in parallel so dead ones don't hold up the rest
+func checkSessionsHealth(now time.Time) {
+	waUsers.mu.Lock()
+	sessions := map[string]waSession{}
+	for email, state := range waUsers.data {
+		state.mu.RLock()
+		if state.waClient != nil && state.waStatus == "connected" {
+			sessions[email] = whatsmeowSession{state.waClient}
+		}
+		state.mu.RUnlock()
+	}
+	waUsers.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for email, session := range sessions {
+		wg.Add(1)
+		go func(email string, session waSession) {
+			defer wg.Done()
+			checkSessionHealth(email, session, now)
+		}(email, session)
+	}
+	wg.Wait()
+}
+
+func startSessionHealthChecker() {
+	if waHealthInterval <= 0 {
+		return
+	}
+	runEvery(waHealthInterval, func(now time.Time) {
+		checkSessionsHealth(now)
+	})
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeSession struct {
+	mu           sync.Mutex
+	connected    bool
+	pingErr      error
+	pings        int
+	disconnects  int
+	reconnecting chan struct{}
+}
+
+func (s *fakeSession) IsConnected() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.connected
+}
+
+func (s *fakeSession) Ping() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pings++
+	return s.pingErr
+}
+
+func (s *fakeSession) Connect() error {
+	close(s.reconnecting)
+	return nil
+}
+
+func (s *fakeSession) Disconnect() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.disconnects++
+}
+
+func TestSessionHealth(t *testing.T) {
+	email := "health-session@example.com"
+	now := time.Now()
+	check := func(session *fakeSession, lastSeen time.Time) bool {
+		t.Helper()
+		state := getUserWAState(email)
+		state.mu.Lock()
+		state.waStatus, state.lastSeenAt = "connected", lastSeen
+		state.mu.Unlock()
+		return checkSessionHealth(email, session, now)
+	}
+
+	// Recently heard from: not pinged
+	session := &fakeSession{connected: true}
+	if check(session, now.Add(-time.Second)) || session.pings != 0 {
+		t.Fatalf("Expected no ping for a client seen recently, got %d", session.pings)
+	}
+
+	// Idle but alive: pinged and seen
+	if check(session, now.Add(-2*waHealthInterval)) || session.pings != 1 {
+		t.Fatalf("Expected one ping for an idle client, got %d", session.pings)
+	}
+	if resp := userWAStatusResponse(email); resp["last_seen_at"] != now.UTC().Format(time.RFC3339) {
+		t.Fatalf("Expected the ping to count as seen, got %v", resp["last_seen_at"])
+	}
+
+	// Dead socket or no answer: reconnected
+	for _, session := range []*fakeSession{{connected: false}, {connected: true, pingErr: errors.New("timeout")}} {
+		session.reconnecting = make(chan struct{})
+		if !check(session, now.Add(-2*waHealthInterval)) {
+			t.Fatal("Expected a stale client to be reconnected")
+		}
+		select {
+		case <-session.reconnecting:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for the reconnect")
+		}
+		if session.disconnects != 1 {
+			t.Fatalf("Expected the stale connection to be dropped first, got %d disconnects", session.disconnects)
+		}
+		if resp := userWAStatusResponse(email); resp["status"] != "reconnecting" || resp["last_error"] == nil {
+			t.Fatalf("Expected reconnecting with the failure as last_error, got %v", resp)
+		}
+	}
+
+	// Not connected: left alone
+	state := getUserWAState(email)
+	state.mu.Lock()
+	state.waStatus = "disconnected"
+	state.mu.Unlock()
+	if checkSessionHealth(email, &fakeSession{}, now) {
+		t.Fatal("Expected a disconnected user not to be checked")
+	}
+}
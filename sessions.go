@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// --- Dashboard sessions ---
+// Logging in creates a random session token, stored in the sessions table and sent
+// as the session cookie. Sessions can be revoked server-side (logout, password change).
+
+const SESSION_TTL = 24 * time.Hour
+
+// Create a session for a user and return its token. Expired sessions are cleaned up here.
+func createSession(userID int64) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+	now := time.Now()
+	if _, err := db.Exec(`DELETE FROM sessions WHERE expires_at < ?`, now.Unix()); err != nil {
+		fmt.Println("ERROR: Could not delete expired sessions", err)
+	}
+	_, err := db.Exec(`INSERT INTO sessions (token, user_id, created_at, expires_at) VALUES (?, ?, ?, ?)`,
+		token, userID, now.UTC().Format(time.RFC3339), now.Add(SESSION_TTL).Unix())
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func setSessionCookie(w http.ResponseWriter, sessionCookieName, token string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Expires:  time.Now().Add(SESSION_TTL),
+	})
+}
+
+// The email of the user a session belongs to ("" if it is unknown or expired)
+func sessionEmail(token string) string {
+	var email string
+	err := preparedQueryRow(readDB, `SELECT u.email FROM sessions s JOIN users u ON u.id = s.user_id WHERE s.token = ? AND s.expires_at >= ?`,
+		token, time.Now().Unix()).Scan(&email)
+	if err != nil {
+		return ""
+	}
+	return email
+}
+
+// When a session was created, i.e. when its user last logged in with it
+func sessionCreatedAt(token string) (time.Time, error) {
+	var createdAt string
+	err := db.QueryRow(`SELECT created_at FROM sessions WHERE token = ?`, token).Scan(&createdAt)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Parse(time.RFC3339, createdAt)
+}
+
+func deleteSession(token string) {
+	db.Exec(`DELETE FROM sessions WHERE token = ?`, token)
+}
+
+// Revoke all sessions of a user except keepToken; returns how many were revoked
+func dbDeleteUserSessions(userID int64, keepToken string) (int64, error) {
+	res, err := db.Exec(`DELETE FROM sessions WHERE user_id = ? AND token != ?`, userID, keepToken)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+)
+
+// --- Database sink ---
+// Inserts matching messages straight into a table of the user's own Postgres or MySQL
+// database, for data-warehouse use without a webhook receiver in between. Rows are
+// batched (up to batch_size, or dbSinkFlushInterval after the first one) and a
+// failed batch is retried before the error is recorded on the sink.
+
+const (
+	SINK_DATABASE           = "database"
+	DEFAULT_DB_SINK_BATCH   = 50
+	MAX_DB_SINK_BATCH       = 500
+	DB_SINK_RETRIES         = 3
+	DB_SINK_RETRY_DELAY     = time.Second // Doubled after each attempt
+	DB_SINK_MAX_CONNECTIONS = 2
+)
+
+// How long the first row of a batch waits for more (a var, so tests can shorten it)
+var dbSinkFlushInterval = 2 * time.Second
+
+// How a database is spoken to
+type sqlDialect struct {
+	placeholder func(n int) string // The n-th (1-based) bind parameter
+	quote       func(ident string) string
+}
+
+// Supported drivers; tests add the SQLite driver
+var sinkSQLDialects = map[string]sqlDialect{
+	"postgres": {
+		placeholder: func(n int) string { return "$" + strconv.Itoa(n) },
+		quote:       func(ident string) string { return `"` + ident + `"` },
+	},
+	"mysql": {
+		placeholder: func(n int) string { return "?" },
+		quote:       func(ident string) string { return "`" + ident + "`" },
+	},
+}
+
+// Table columns -> payload fields, unless the sink says otherwise
+var defaultDatabaseSinkColumns = map[string]string{
+	"message_id":  "id",
+	"chat_jid":    "to",
+	"sender_jid":  "from",
+	"sender_name": "name",
+	"type":        "type",
+	"text":        "text",
+	"received_at": "timestamp_iso",
+}
+
+// Table and column names; a table may be schema-qualified
+var sqlIdentRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]{0,62}$`)
+
+type DatabaseSinkConfig struct {
+	Driver    string            `json:"driver"`     // "postgres" or "mysql"
+	DSN       string            `json:"dsn"`        // Connection string, in the driver's format
+	Table     string            `json:"table"`      // Existing table, e.g. "whatsapp_messages" or "raw.messages"
+	Columns   map[string]string `json:"columns"`    // Table column -> payload field
+	BatchSize int               `json:"batch_size"` // Rows per INSERT, default 50
+}
+
+// The quoted table name, or an error if it's not a plain (schema.)table name
+func (c DatabaseSinkConfig) quotedTable(d sqlDialect) (string, error) {
+	parts := strings.Split(c.Table, ".")
+	if len(parts) > 2 {
+		return "", errors.New("config.table must be a table name, optionally with its schema")
+	}
+	for i, part := range parts {
+		if !sqlIdentRegex.MatchString(part) {
+			return "", errors.New("config.table must be a table name, optionally with its schema")
+		}
+		parts[i] = d.quote(part)
+	}
+	return strings.Join(parts, "."), nil
+}
+
+// The mapped columns, in a stable order
+func (c DatabaseSinkConfig) columnNames() []string {
+	names := make([]string, 0, len(c.Columns))
+	for name := range c.Columns {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Open connection pools, one per database (pools only hold idle connections briefly)
+var sinkDBs = struct {
+	mu   sync.Mutex
+	data map[string]*sql.DB
+}{
+	data: make(map[string]*sql.DB),
+}
+
+func sinkDB(driver, dsn string) (*sql.DB, error) {
+	sinkDBs.mu.Lock()
+	defer sinkDBs.mu.Unlock()
+	key := driver + "\x00" + dsn
+	if conn, ok := sinkDBs.data[key]; ok {
+		return conn, nil
+	}
+	conn, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetMaxOpenConns(DB_SINK_MAX_CONNECTIONS)
+	conn.SetConnMaxIdleTime(time.Minute)
+	sinkDBs.data[key] = conn
+	return conn, nil
+}
+
+// Forget a pool that couldn't be used, so a corrected DSN isn't stuck behind it
+func closeSinkDB(driver, dsn string) {
+	sinkDBs.mu.Lock()
+	defer sinkDBs.mu.Unlock()
+	key := driver + "\x00" + dsn
+	if conn, ok := sinkDBs.data[key]; ok {
+		conn.Close()
+		delete(sinkDBs.data, key)
+	}
+}
+
+func validateDatabaseSink(userID int64, raw json.RawMessage) (json.RawMessage, error) {
+	var c DatabaseSinkConfig
+	if err := unmarshalStrict(raw, &c); err != nil {
+		return nil, fmt.Errorf("Invalid config: %v", err)
+	}
+	dialect, ok := sinkSQLDialects[c.Driver]
+	if !ok {
+		return nil, errors.New("config.driver must be postgres or mysql")
+	}
+	c.DSN = strings.TrimSpace(c.DSN)
+	if c.DSN == "" {
+		return nil, errors.New("Missing config.dsn")
+	}
+	table, err := c.quotedTable(dialect)
+	if err != nil {
+		return nil, err
+	}
+	if len(c.Columns) == 0 {
+		c.Columns = defaultDatabaseSinkColumns
+	}
+	for column, field := range c.Columns {
+		if !sqlIdentRegex.MatchString(column) {
+			return nil, fmt.Errorf("Invalid column name %q", column)
+		}
+		if field == "" {
+			return nil, fmt.Errorf("Column %q has no payload field", column)
+		}
+	}
+	if c.BatchSize == 0 {
+		c.BatchSize = DEFAULT_DB_SINK_BATCH
+	}
+	if c.BatchSize < 1 || c.BatchSize > MAX_DB_SINK_BATCH {
+		return nil, fmt.Errorf("config.batch_size must be between 1 and %d", MAX_DB_SINK_BATCH)
+	}
+
+	// Check the database is reachable and has the table and columns
+	conn, err := sinkDB(c.Driver, c.DSN)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid config.dsn: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+	quoted := make([]string, 0, len(c.Columns))
+	for _, column := range c.columnNames() {
+		quoted = append(quoted, dialect.quote(column))
+	}
+	rows, err := conn.QueryContext(ctx, `SELECT `+strings.Join(quoted, ", ")+` FROM `+table+` WHERE 1 = 0`)
+	if err != nil {
+		closeSinkDB(c.Driver, c.DSN)
+		return nil, fmt.Errorf("Could not use table %s: %v", c.Table, err)
+	}
+	rows.Close()
+	return json.Marshal(c)
+}
+
+// Passwords in URL (postgres://u:p@h/db), MySQL (u:p@tcp(h)/db) and key=value DSNs
+var mysqlDSNPasswordRegex = regexp.MustCompile(`^([^:@/]*):[^@]*@`)
+var dsnPasswordRegex = regexp.MustCompile(`(?i)(password=)('[^']*'|\S+)`)
+
+func redactDSN(dsn string) string {
+	if u, err := url.Parse(dsn); err == nil && u.Scheme != "" && u.User != nil {
+		return u.Redacted()
+	}
+	dsn = mysqlDSNPasswordRegex.ReplaceAllString(dsn, "$1:xxxxx@")
+	return dsnPasswordRegex.ReplaceAllString(dsn, "${1}xxxxx")
+}
+
+func redactDatabaseSink(raw json.RawMessage) json.RawMessage {
+	var c DatabaseSinkConfig
+	if err := json.Unmarshal(raw, &c); err != nil {
+		return raw
+	}
+	c.DSN = redactDSN(c.DSN)
+	redacted, _ := json.Marshal(c)
+	return redacted
+}
+
+// A payload field as a column value: scalars as they are, anything else as JSON
+func sqlSinkValue(v interface{}) interface{} {
+	switch v.(type) {
+	case nil, string, bool, int, int64, float64:
+		return v
+	}
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+type dbSinkRow struct {
+	values []interface{}
+	done   chan error
+}
+
+// Rows waiting to be inserted, per sink
+var dbSinkBatches = struct {
+	mu   sync.Mutex
+	data map[string][]dbSinkRow
+}{
+	data: make(map[string][]dbSinkRow),
+}
+
+// Take the sink's waiting rows and insert them
+func flushDatabaseSink(id string, c DatabaseSinkConfig) {
+	dbSinkBatches.mu.Lock()
+	rows := dbSinkBatches.data[id]
+	delete(dbSinkBatches.data, id)
+	dbSinkBatches.mu.Unlock()
+	if len(rows) == 0 {
+		return
+	}
+	err := insertDatabaseSinkRows(c, rows)
+	delay := DB_SINK_RETRY_DELAY
+	for attempt := 1; err != nil && attempt < DB_SINK_RETRIES; attempt++ {
+		fmt.Printf("RETRY: Database sink %s insert failed, retry %d/%d: %v\n", id, attempt, DB_SINK_RETRIES-1, err)
+		time.Sleep(delay)
+		delay *= 2
+		err = insertDatabaseSinkRows(c, rows)
+	}
+	for _, row := range rows {
+		row.done <- err
+	}
+}
+
+func insertDatabaseSinkRows(c DatabaseSinkConfig, rows []dbSinkRow) error {
+	dialect := sinkSQLDialects[c.Driver]
+	table, err := c.quotedTable(dialect)
+	if err != nil {
+		return err
+	}
+	columns := c.columnNames()
+	quoted := make([]string, len(columns))
+	for i, column := range columns {
+		quoted[i] = dialect.quote(column)
+	}
+	var query strings.Builder
+	query.WriteString(`INSERT INTO ` + table + ` (` + strings.Join(quoted, ", ") + `) VALUES `)
+	args := make([]interface{}, 0, len(rows)*len(columns))
+	for i, row := range rows {
+		if i > 0 {
+			query.WriteString(", ")
+		}
+		placeholders := make([]string, len(row.values))
+		for j := range row.values {
+			placeholders[j] = dialect.placeholder(len(args) + j + 1)
+		}
+		query.WriteString("(" + strings.Join(placeholders, ", ") + ")")
+		args = append(args, row.values...)
+	}
+
+	conn, err := sinkDB(c.Driver, c.DSN)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+	_, err = conn.ExecContext(ctx, query.String(), args...)
+	return err
+}
+
+// Add the message to the sink's batch and wait for the batch to be inserted
+func deliverDatabaseSink(userID int64, s Sink, payload map[string]interface{}) error {
+	var c DatabaseSinkConfig
+	if err := json.Unmarshal(s.Config, &c); err != nil {
+		return err
+	}
+	columns := c.columnNames()
+	row := dbSinkRow{values: make([]interface{}, len(columns)), done: make(chan error, 1)}
+	for i, column := range columns {
+		row.values[i] = sqlSinkValue(payload[c.Columns[column]])
+	}
+
+	dbSinkBatches.mu.Lock()
+	pending := append(dbSinkBatches.data[s.ID], row)
+	dbSinkBatches.data[s.ID] = pending
+	dbSinkBatches.mu.Unlock()
+	if len(pending) >= c.BatchSize {
+		go flushDatabaseSink(s.ID, c)
+	} else if len(pending) == 1 {
+		time.AfterFunc(dbSinkFlushInterval, func() { flushDatabaseSink(s.ID, c) })
+	}
+	return <-row.done
+}
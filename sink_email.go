@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Email sink ---
+// Emails matching messages to a few addresses through the configured SMTP server (see
+// mailer.go), for low-volume alerting. The subject and body are templates with
+// {{field}} placeholders for payload fields; a sink sends at most
+// MAX_EMAIL_SINK_PER_HOUR emails an hour, so a busy chat can't flood the inboxes.
+
+const (
+	SINK_EMAIL                = "email"
+	MAX_EMAIL_SINK_RECIPIENTS = 10
+	MAX_EMAIL_SINK_PER_HOUR   = 60
+	MAX_EMAIL_TEMPLATE_LENGTH = 4000
+	DEFAULT_EMAIL_SUBJECT     = "WhatsApp message from {{name}}"
+	DEFAULT_EMAIL_BODY        = "{{name}} ({{from}}) in {{to}} at {{timestamp_iso}}:\n\n{{text}}\n"
+)
+
+type EmailSinkConfig struct {
+	To      []string `json:"to"`
+	Subject string   `json:"subject"` // Template, default DEFAULT_EMAIL_SUBJECT
+	Body    string   `json:"body"`    // Template, default DEFAULT_EMAIL_BODY
+}
+
+func validateEmailSink(userID int64, raw json.RawMessage) (json.RawMessage, error) {
+	var c EmailSinkConfig
+	if err := unmarshalStrict(raw, &c); err != nil {
+		return nil, fmt.Errorf("Invalid config: %v", err)
+	}
+	if !emailConfigured() {
+		return nil, errEmailDisabled
+	}
+	if len(c.To) == 0 || len(c.To) > MAX_EMAIL_SINK_RECIPIENTS {
+		return nil, fmt.Errorf("config.to must list 1 to %d email addresses", MAX_EMAIL_SINK_RECIPIENTS)
+	}
+	for i, to := range c.To {
+		addr, err := mail.ParseAddress(strings.TrimSpace(to))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid email %q", to)
+		}
+		c.To[i] = addr.Address
+	}
+	if strings.TrimSpace(c.Subject) == "" {
+		c.Subject = DEFAULT_EMAIL_SUBJECT
+	}
+	if strings.TrimSpace(c.Body) == "" {
+		c.Body = DEFAULT_EMAIL_BODY
+	}
+	if len(c.Subject) > MAX_EMAIL_TEMPLATE_LENGTH || len(c.Body) > MAX_EMAIL_TEMPLATE_LENGTH {
+		return nil, fmt.Errorf("Templates are limited to %d characters", MAX_EMAIL_TEMPLATE_LENGTH)
+	}
+	return json.Marshal(c)
+}
+
+// Fill {{field}} placeholders from the payload; unknown fields are left empty
+func renderSinkTemplate(template string, payload map[string]interface{}) string {
+	return cannedVarRegex.ReplaceAllStringFunc(template, func(match string) string {
+		return sinkFieldText(payload[cannedVarRegex.FindStringSubmatch(match)[1]])
+	})
+}
+
+// Emails sent per sink in the current hour
+var emailSinkSent = struct {
+	mu     sync.Mutex
+	hour   time.Time
+	counts map[string]int
+}{
+	counts: make(map[string]int),
+}
+
+// Count an email against the sink's hourly limit; false once it's reached
+func allowEmailSink(id string) bool {
+	emailSinkSent.mu.Lock()
+	defer emailSinkSent.mu.Unlock()
+	if hour := time.Now().Truncate(time.Hour); !hour.Equal(emailSinkSent.hour) {
+		emailSinkSent.hour = hour
+		emailSinkSent.counts = make(map[string]int)
+	}
+	if emailSinkSent.counts[id] >= MAX_EMAIL_SINK_PER_HOUR {
+		return false
+	}
+	emailSinkSent.counts[id]++
+	return true
+}
+
+func deliverEmailSink(userID int64, s Sink, payload map[string]interface{}) error {
+	var c EmailSinkConfig
+	if err := json.Unmarshal(s.Config, &c); err != nil {
+		return err
+	}
+	if !allowEmailSink(s.ID) {
+		return fmt.Errorf("hourly limit of %d emails reached; message %v not emailed", MAX_EMAIL_SINK_PER_HOUR, payload["id"])
+	}
+	subject := renderSinkTemplate(c.Subject, payload)
+	body := renderSinkTemplate(c.Body, payload)
+	var errs []error
+	for _, to := range c.To {
+		if err := sendEmail(to, subject, body); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", to, err))
+		}
+	}
+	return errors.Join(errs...)
+}
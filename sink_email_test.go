@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestEmailSink(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+
+	email := "alerts@example.com"
+	_, apiKey := registerWithAPIKey(t, ts, email, "alertspass123")
+
+	type sentEmail struct{ to, subject, body string }
+	var mu sync.Mutex
+	var sent []sentEmail
+	sendEmail = func(to, subject, body string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		sent = append(sent, sentEmail{to, subject, body})
+		return nil
+	}
+	defer func() { sendEmail = defaultSendEmail }()
+
+	config := map[string]interface{}{"to": []string{"Ops <ops@example.com>", "oncall@example.com"}, "subject": "[{{name}}] {{text}}"}
+	body := map[string]interface{}{"type": SINK_EMAIL, "filter_type": "group", "filter_value": "120363025000000000@g.us", "config": config}
+	t.Setenv("SMTP_HOST", "")
+	if resp := apiRequest(t, "POST", ts.URL+"/api/sinks", apiKey, body, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected 400 without SMTP, got %d", resp.StatusCode)
+	}
+	t.Setenv("SMTP_HOST", "smtp.example.com")
+
+	for _, bad := range []map[string]interface{}{
+		{"to": []string{}},
+		{"to": []string{"not an email"}},
+		{"to": []string{"ops@example.com"}, "body": strings.Repeat("x", MAX_EMAIL_TEMPLATE_LENGTH+1)},
+	} {
+		if resp := apiRequest(t, "POST", ts.URL+"/api/sinks", apiKey, map[string]interface{}{"type": SINK_EMAIL, "config": bad}, nil); resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("Expected 400 for %v, got %d", bad, resp.StatusCode)
+		}
+	}
+
+	var sink Sink
+	if resp := apiRequest(t, "POST", ts.URL+"/api/sinks", apiKey, body, &sink); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Create sink failed: %d", resp.StatusCode)
+	}
+
+	receive := func(id, chat, text string) {
+		forwardToWebhooks(email, map[string]interface{}{"id": id, "from": "14155550100@s.whatsapp.net", "to": chat,
+			"name": "Alice", "type": "text", "text": text, "timestamp": time.Now().Unix()}, "", "")
+	}
+	receive("MAIL1", "14155550100@s.whatsapp.net", "not from the group")
+	receive("MAIL2", "120363025000000000@g.us", "server down")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		n := len(sent)
+		mu.Unlock()
+		if n >= 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected 2 emails, got %d", n)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	if len(sent) != 2 || sent[0].to == sent[1].to {
+		t.Fatalf("Expected one email to each recipient, got %+v", sent)
+	}
+	for _, m := range sent {
+		if m.to != "ops@example.com" && m.to != "oncall@example.com" {
+			t.Fatalf("Unexpected recipient %q", m.to)
+		}
+		if m.subject != "[Alice] server down" || !strings.Contains(m.body, "Alice (14155550100@s.whatsapp.net) in 120363025000000000@g.us") || !strings.Contains(m.body, "server down") {
+			t.Fatalf("Unexpected email: %+v", m)
+		}
+	}
+}
+
+func TestEmailSinkHourlyLimit(t *testing.T) {
+	for i := 0; i < MAX_EMAIL_SINK_PER_HOUR; i++ {
+		if !allowEmailSink("limit-test") {
+			t.Fatalf("Email %d was refused", i+1)
+		}
+	}
+	if allowEmailSink("limit-test") {
+		t.Fatal("Expected the hourly limit to be enforced")
+	}
+	if !allowEmailSink("another-sink") {
+		t.Fatal("The limit is per sink")
+	}
+}
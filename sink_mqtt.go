@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// --- MQTT sink ---
+// Publishes matching messages as JSON to an MQTT topic and, with a command_topic,
+// subscribes to it: each command published there ({"chat_jid", "message"}, as for
+// /api/messages/send) is sent through the queue. Meant for home-automation setups
+// without an HTTP bridge. Each sink keeps one connection to its broker while active.
+
+const (
+	SINK_MQTT             = "mqtt"
+	MQTT_CONNECT_TIMEOUT  = 10 * time.Second
+	MAX_MQTT_COMMAND_SIZE = 64 * 1024
+)
+
+type MQTTSinkConfig struct {
+	Broker       string `json:"broker"` // tcp://, ssl://, ws:// or wss:// address
+	Username     string `json:"username,omitempty"`
+	Password     string `json:"password,omitempty"`
+	Topic        string `json:"topic"` // May contain {{field}} placeholders, e.g. "whatsapp/{{to}}"
+	QoS          byte   `json:"qos"`
+	Retain       bool   `json:"retain"`
+	CommandTopic string `json:"command_topic,omitempty"` // Optional; may be a filter such as "whatsapp/send/#"
+}
+
+func (c MQTTSinkConfig) clientOptions(clientID string) *mqtt.ClientOptions {
+	return mqtt.NewClientOptions().
+		AddBroker(c.Broker).
+		SetClientID(clientID).
+		SetUsername(c.Username).
+		SetPassword(c.Password).
+		SetConnectTimeout(MQTT_CONNECT_TIMEOUT).
+		SetAutoReconnect(true)
+}
+
+func validateMQTTSink(userID int64, raw json.RawMessage) (json.RawMessage, error) {
+	var c MQTTSinkConfig
+	if err := unmarshalStrict(raw, &c); err != nil {
+		return nil, fmt.Errorf("Invalid config: %v", err)
+	}
+	u, err := url.Parse(strings.TrimSpace(c.Broker))
+	if err != nil || u.Host == "" || (u.Scheme != "tcp" && u.Scheme != "ssl" && u.Scheme != "ws" && u.Scheme != "wss") {
+		return nil, errors.New("config.broker must be a tcp://, ssl://, ws:// or wss:// address")
+	}
+	c.Broker = u.String()
+	c.Topic = strings.TrimSpace(c.Topic)
+	if c.Topic == "" || strings.ContainsAny(c.Topic, "+#") {
+		return nil, errors.New("config.topic must be a topic name, without wildcards")
+	}
+	if c.QoS > 2 {
+		return nil, errors.New("config.qos must be 0, 1 or 2")
+	}
+	c.CommandTopic = strings.TrimSpace(c.CommandTopic)
+
+	// Check the broker accepts the credentials
+	client := mqtt.NewClient(c.clientOptions("wadash-check-" + generateWebhookID()).SetAutoReconnect(false))
+	token := client.Connect()
+	if !token.WaitTimeout(MQTT_CONNECT_TIMEOUT) {
+		return nil, errors.New("Could not connect to the MQTT broker: timed out")
+	}
+	if err := token.Error(); err != nil {
+		return nil, fmt.Errorf("Could not connect to the MQTT broker: %v", err)
+	}
+	client.Disconnect(250)
+	return json.Marshal(c)
+}
+
+func redactMQTTSink(raw json.RawMessage) json.RawMessage {
+	var c MQTTSinkConfig
+	if err := json.Unmarshal(raw, &c); err != nil {
+		return raw
+	}
+	if c.Password != "" {
+		c.Password = "xxxxx"
+	}
+	redacted, _ := json.Marshal(c)
+	return redacted
+}
+
+// Fill the topic's {{field}} placeholders; values can't add levels or wildcards
+func renderMQTTTopic(topic string, payload map[string]interface{}) string {
+	clean := strings.NewReplacer("/", "_", "+", "_", "#", "_")
+	return cannedVarRegex.ReplaceAllStringFunc(topic, func(match string) string {
+		return clean.Replace(sinkFieldText(payload[cannedVarRegex.FindStringSubmatch(match)[1]]))
+	})
+}
+
+// Connected clients, per sink
+var mqttClients = struct {
+	mu   sync.Mutex
+	data map[string]mqtt.Client
+}{
+	data: make(map[string]mqtt.Client),
+}
+
+// The sink's client, connecting (and subscribing to its command topic) if needed
+func mqttSinkClient(userID int64, s Sink) (mqtt.Client, error) {
+	mqttClients.mu.Lock()
+	defer mqttClients.mu.Unlock()
+	if client, ok := mqttClients.data[s.ID]; ok {
+		return client, nil
+	}
+	var c MQTTSinkConfig
+	if err := json.Unmarshal(s.Config, &c); err != nil {
+		return nil, err
+	}
+	opts := c.clientOptions("wadash-" + s.ID).SetConnectRetry(true)
+	if c.CommandTopic != "" {
+		// Subscribing on every (re)connect, as the broker forgets clean sessions
+		opts.SetOnConnectHandler(func(client mqtt.Client) {
+			client.Subscribe(c.CommandTopic, 1, func(_ mqtt.Client, m mqtt.Message) {
+				if err := handleMQTTCommand(userID, s.ID, m.Payload()); err != nil {
+					fmt.Printf("ERROR: MQTT command on %s for sink %s: %v\n", m.Topic(), s.ID, err)
+					dbSetSinkResult(s.ID, fmt.Errorf("command on %s: %v", m.Topic(), err))
+				}
+			})
+		})
+	}
+	client := mqtt.NewClient(opts)
+	client.Connect() // Keeps retrying in the background until the broker is reachable
+	mqttClients.data[s.ID] = client
+	return client, nil
+}
+
+func startMQTTSink(userID int64, s Sink) {
+	if _, err := mqttSinkClient(userID, s); err != nil {
+		fmt.Printf("ERROR: Could not start MQTT sink %s: %v\n", s.ID, err)
+	}
+}
+
+func stopMQTTSink(s Sink) {
+	mqttClients.mu.Lock()
+	client, ok := mqttClients.data[s.ID]
+	delete(mqttClients.data, s.ID)
+	mqttClients.mu.Unlock()
+	if ok {
+		client.Disconnect(250)
+	}
+}
+
+func deliverMQTTSink(userID int64, s Sink, payload map[string]interface{}) error {
+	var c MQTTSinkConfig
+	if err := json.Unmarshal(s.Config, &c); err != nil {
+		return err
+	}
+	client, err := mqttSinkClient(userID, s)
+	if err != nil {
+		return err
+	}
+	if !client.IsConnectionOpen() {
+		return errors.New("not connected to the MQTT broker")
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	token := client.Publish(renderMQTTTopic(c.Topic, payload), c.QoS, c.Retain, data)
+	if !token.WaitTimeout(webhookTimeout) {
+		return errors.New("publish timed out")
+	}
+	return token.Error()
+}
+
+// Send a command received on the command topic through the queue
+func handleMQTTCommand(userID int64, sinkID string, data []byte) error {
+	if len(data) > MAX_MQTT_COMMAND_SIZE {
+		return fmt.Errorf("command larger than %d bytes", MAX_MQTT_COMMAND_SIZE)
+	}
+	var cmd struct {
+		ChatJID string `json:"chat_jid"`
+		Message string `json:"message"`
+	}
+	if err := unmarshalStrict(bytes.TrimSpace(data), &cmd); err != nil {
+		return fmt.Errorf("invalid command: %v", err)
+	}
+	email := getUserEmailByID(userID)
+	if email == "" {
+		return errors.New("user not found")
+	}
+	result, err := sendService.Enqueue(SendRequest{
+		UserEmail: email,
+		ChatJID:   cmd.ChatJID,
+		Message:   cmd.Message,
+		Source:    "mqtt " + sinkID,
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("INFO: Queued message %s from MQTT sink %s\n", result.Message.ID, sinkID)
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestMQTTSinkValidation(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+
+	email := "mqtt@example.com"
+	_, apiKey := registerWithAPIKey(t, ts, email, "mqttpass123")
+
+	for _, config := range []map[string]interface{}{
+		{"broker": "http://broker.example.com", "topic": "whatsapp/in"},
+		{"broker": "tcp://127.0.0.1:1", "topic": "whatsapp/#"},
+		{"broker": "tcp://127.0.0.1:1", "topic": "whatsapp/in", "qos": 3},
+		{"broker": "tcp://127.0.0.1:1", "topic": "whatsapp/in"}, // Nothing listening
+	} {
+		body := map[string]interface{}{"type": SINK_MQTT, "config": config}
+		if resp := apiRequest(t, "POST", ts.URL+"/api/sinks", apiKey, body, nil); resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("Expected 400 for %v, got %d", config, resp.StatusCode)
+		}
+	}
+}
+
+func TestRenderMQTTTopic(t *testing.T) {
+	payload := map[string]interface{}{"to": "120363025000000000@g.us", "from": "a/b+c#d"}
+	if got := renderMQTTTopic("whatsapp/{{to}}/{{from}}/{{missing}}", payload); got != "whatsapp/120363025000000000@g.us/a_b_c_d/" {
+		t.Fatalf("Unexpected topic %q", got)
+	}
+
+	var c MQTTSinkConfig
+	json.Unmarshal(redactMQTTSink(json.RawMessage(`{"broker":"tcp://b:1883","username":"u","password":"hunter2","topic":"t"}`)), &c)
+	if c.Password != "xxxxx" || c.Username != "u" {
+		t.Fatalf("Password not redacted: %+v", c)
+	}
+}
+
+func TestMQTTCommand(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+
+	email := "mqttcmd@example.com"
+	registerWithAPIKey(t, ts, email, "mqttcmdpass123")
+	userID, _ := getUserIDByEmail(email)
+
+	command := []byte(`{"chat_jid": "14155550100@s.whatsapp.net", "message": "lights on"}`)
+	if err := handleMQTTCommand(userID, "sink1", command); err == nil {
+		t.Fatal("Expected a command to fail while WhatsApp is disconnected")
+	}
+	useFakeWAClient(t, email)
+	if err := handleMQTTCommand(userID, "sink1", command); err != nil {
+		t.Fatalf("Command was not queued: %v", err)
+	}
+
+	for _, bad := range []string{`not json`, `{"chat_jid": "14155550100@s.whatsapp.net", "message": "x", "extra": 1}`, `{"message": "no chat"}`} {
+		if err := handleMQTTCommand(userID, "sink1", []byte(bad)); err == nil {
+			t.Fatalf("Expected %s to be rejected", bad)
+		}
+	}
+	if err := handleMQTTCommand(userID, "sink1", []byte(strings.Repeat(" ", MAX_MQTT_COMMAND_SIZE+1))); err == nil {
+		t.Fatal("Expected an oversized command to be rejected")
+	}
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Google Sheets sink ---
+// Appends each matching message as a row to a Google Sheet. Users connect their Google
+// account once with OAuth (GET /api/google/authorize, which needs GOOGLE_CLIENT_ID and
+// GOOGLE_CLIENT_SECRET and BASE_URL/oauth/google/callback as an authorized redirect
+// URI); the refresh token is stored and access tokens are renewed as needed. The
+// drive.file scope only reaches spreadsheets the app created or was given, so a sink
+// without a spreadsheet_id creates one.
+
+const (
+	SINK_GOOGLE_SHEETS     = "google_sheets"
+	GOOGLE_SHEETS_SCOPE    = "https://www.googleapis.com/auth/drive.file"
+	GOOGLE_OAUTH_STATE_TTL = 10 * time.Minute
+	GOOGLE_CALLBACK_PATH   = "/oauth/google/callback"
+	GOOGLE_OAUTH_COOKIE    = "google_oauth" // Ties an authorization to the browser that started it
+	GOOGLE_NEW_SHEET_TITLE = "WhatsApp messages"
+	MAX_SHEETS_COLUMNS     = 26
+)
+
+// Payload fields written as columns, unless the sink says otherwise
+var defaultSheetsColumns = []string{"timestamp_iso", "from", "name", "to", "type", "text", "media_url"}
+
+// The spreadsheet ID in a sheet's URL, e.g. https://docs.google.com/spreadsheets/d/<id>/edit
+var spreadsheetURLRegex = regexp.MustCompile(`/spreadsheets/d/([A-Za-z0-9_-]+)`)
+var spreadsheetIDRegex = regexp.MustCompile(`^[A-Za-z0-9_-]{10,}$`)
+
+type SheetsSinkConfig struct {
+	SpreadsheetID string   `json:"spreadsheet_id"` // The ID or the sheet's URL; empty creates a spreadsheet
+	Sheet         string   `json:"sheet"`          // Tab name, default "Sheet1"
+	Columns       []string `json:"columns"`        // Payload fields, in column order
+}
+
+func googleAuthURL() string {
+	return getEnv("GOOGLE_AUTH_URL", "https://accounts.google.com/o/oauth2/v2/auth")
+}
+
+func googleTokenURL() string {
+	return getEnv("GOOGLE_TOKEN_URL", "https://oauth2.googleapis.com/token")
+}
+
+func googleSheetsAPIURL() string {
+	return strings.TrimRight(getEnv("GOOGLE_SHEETS_API_URL", "https://sheets.googleapis.com"), "/")
+}
+
+func googleConfigured() bool {
+	return os.Getenv("GOOGLE_CLIENT_ID") != "" && os.Getenv("GOOGLE_CLIENT_SECRET") != ""
+}
+
+func validateSheetsSink(userID int64, raw json.RawMessage) (json.RawMessage, error) {
+	var c SheetsSinkConfig
+	if err := unmarshalStrict(raw, &c); err != nil {
+		return nil, fmt.Errorf("Invalid config: %v", err)
+	}
+	c.SpreadsheetID = strings.TrimSpace(c.SpreadsheetID)
+	if m := spreadsheetURLRegex.FindStringSubmatch(c.SpreadsheetID); m != nil {
+		c.SpreadsheetID = m[1]
+	}
+	if c.SpreadsheetID != "" && !spreadsheetIDRegex.MatchString(c.SpreadsheetID) {
+		return nil, errors.New("config.spreadsheet_id must be a spreadsheet ID or URL")
+	}
+	c.Sheet = strings.TrimSpace(c.Sheet)
+	if c.Sheet == "" {
+		c.Sheet = "Sheet1"
+	}
+	if len(c.Columns) == 0 {
+		c.Columns = defaultSheetsColumns
+	}
+	if len(c.Columns) > MAX_SHEETS_COLUMNS {
+		return nil, fmt.Errorf("config.columns has more than %d fields", MAX_SHEETS_COLUMNS)
+	}
+	if _, err := dbGetGoogleCredentials(userID); err == sql.ErrNoRows {
+		return nil, errors.New("Connect a Google account first (/api/google/authorize)")
+	} else if err != nil {
+		return nil, err
+	}
+	if c.SpreadsheetID == "" {
+		id, err := createSpreadsheet(userID, c.Sheet, c.Columns)
+		if err != nil {
+			return nil, fmt.Errorf("Could not create a spreadsheet: %v", err)
+		}
+		c.SpreadsheetID = id
+	}
+	return json.Marshal(c)
+}
+
+// Create a spreadsheet with one tab whose first row holds the column names
+func createSpreadsheet(userID int64, sheet string, columns []string) (string, error) {
+	token, err := googleAccessToken(userID)
+	if err != nil {
+		return "", err
+	}
+	header := make([]map[string]interface{}, len(columns))
+	for i, column := range columns {
+		header[i] = map[string]interface{}{"userEnteredValue": map[string]string{"stringValue": column}}
+	}
+	body, _ := json.Marshal(map[string]interface{}{
+		"properties": map[string]string{"title": GOOGLE_NEW_SHEET_TITLE},
+		"sheets": []map[string]interface{}{{
+			"properties": map[string]string{"title": sheet},
+			"data":       []map[string]interface{}{{"rowData": []map[string]interface{}{{"values": header}}}},
+		}},
+	})
+	req, err := http.NewRequest("POST", googleSheetsAPIURL()+"/v4/spreadsheets", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := serviceHTTPClient().Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var created struct {
+		SpreadsheetID string `json:"spreadsheetId"`
+		Error         struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	json.NewDecoder(resp.Body).Decode(&created)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 || created.SpreadsheetID == "" {
+		return "", fmt.Errorf("Google Sheets returned status %d: %s", resp.StatusCode, created.Error.Message)
+	}
+	return created.SpreadsheetID, nil
+}
+
+func deliverSheetsSink(userID int64, s Sink, payload map[string]interface{}) error {
+	var c SheetsSinkConfig
+	if err := json.Unmarshal(s.Config, &c); err != nil {
+		return err
+	}
+	row := make([]string, len(c.Columns))
+	for i, column := range c.Columns {
+		row[i] = sinkFieldText(payload[column])
+	}
+	token, err := googleAccessToken(userID)
+	if err != nil {
+		return err
+	}
+
+	// RAW keeps text like "=1+1" from being read as a formula
+	sheetRange := "'" + strings.ReplaceAll(c.Sheet, "'", "''") + "'"
+	appendURL := fmt.Sprintf("%s/v4/spreadsheets/%s/values/%s:append?valueInputOption=RAW&insertDataOption=INSERT_ROWS",
+		googleSheetsAPIURL(), url.PathEscape(c.SpreadsheetID), url.PathEscape(sheetRange))
+	body, _ := json.Marshal(map[string]interface{}{"values": [][]string{row}})
+	req, err := http.NewRequest("POST", appendURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := serviceHTTPClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		var apiErr struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&apiErr)
+		return fmt.Errorf("Google Sheets returned status %d: %s", resp.StatusCode, apiErr.Error.Message)
+	}
+	return nil
+}
+
+// --- Google OAuth ---
+
+type googleCredentials struct {
+	RefreshToken string
+	AccessToken  string
+	ExpiresAt    time.Time
+	UpdatedAt    time.Time
+}
+
+func dbGetGoogleCredentials(userID int64) (googleCredentials, error) {
+	var c googleCredentials
+	var expiresAt, updatedAt string
+	err := db.QueryRow(`SELECT refresh_token, access_token, expires_at, updated_at FROM google_credentials WHERE user_id = ?`, userID).
+		Scan(&c.RefreshToken, &c.AccessToken, &expiresAt, &updatedAt)
+	if err != nil {
+		return c, err
+	}
+	c.ExpiresAt, _ = time.Parse(time.RFC3339, expiresAt)
+	c.UpdatedAt, _ = time.Parse(time.RFC3339, updatedAt)
+	return c, nil
+}
+
+func dbSaveGoogleCredentials(userID int64, c googleCredentials) error {
+	_, err := db.Exec(`INSERT INTO google_credentials (user_id, refresh_token, access_token, expires_at, updated_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(user_id) DO UPDATE SET refresh_token = excluded.refresh_token, access_token = excluded.access_token,
+		expires_at = excluded.expires_at, updated_at = excluded.updated_at`,
+		userID, c.RefreshToken, c.AccessToken, c.ExpiresAt.UTC().Format(time.RFC3339), time.Now().UTC().Format(time.RFC3339))
+	return err
+}
+
+// Pending authorizations: OAuth state -> user and the browser that asked
+var googleOAuthStates = struct {
+	mu   sync.Mutex
+	data map[string]googleOAuthState
+}{
+	data: make(map[string]googleOAuthState),
+}
+
+type googleOAuthState struct {
+	userID    int64
+	binding   string // The GOOGLE_OAUTH_COOKIE value set on the browser
+	expiresAt time.Time
+}
+
+// Take (and forget) the user an OAuth state was issued to. The binding must match, so a
+// link started by someone else can't connect their Google account to this browser's user.
+func takeGoogleOAuthState(state, binding string) (int64, bool) {
+	googleOAuthStates.mu.Lock()
+	defer googleOAuthStates.mu.Unlock()
+	s, ok := googleOAuthStates.data[state]
+	delete(googleOAuthStates.data, state)
+	for key, other := range googleOAuthStates.data {
+		if time.Now().After(other.expiresAt) {
+			delete(googleOAuthStates.data, key)
+		}
+	}
+	if !ok || time.Now().After(s.expiresAt) || subtle.ConstantTimeCompare([]byte(s.binding), []byte(binding)) != 1 {
+		return 0, false
+	}
+	return s.userID, true
+}
+
+type googleToken struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+	Error        string `json:"error"`
+	Description  string `json:"error_description"`
+}
+
+// Call Google's token endpoint with the app's client credentials
+func googleTokenRequest(form url.Values) (googleToken, error) {
+	form.Set("client_id", os.Getenv("GOOGLE_CLIENT_ID"))
+	form.Set("client_secret", os.Getenv("GOOGLE_CLIENT_SECRET"))
+	var token googleToken
+	resp, err := serviceHTTPClient().PostForm(googleTokenURL(), form)
+	if err != nil {
+		return token, err
+	}
+	defer resp.Body.Close()
+	json.NewDecoder(resp.Body).Decode(&token)
+	if resp.StatusCode != http.StatusOK || token.AccessToken == "" {
+		return token, fmt.Errorf("Google token request failed (%d): %s %s", resp.StatusCode, token.Error, token.Description)
+	}
+	return token, nil
+}
+
+// Serializes refreshes, so concurrent deliveries don't each renew the token
+var googleTokenMu sync.Mutex
+
+// A valid access token for the user's Google account, renewed if about to expire
+func googleAccessToken(userID int64) (string, error) {
+	googleTokenMu.Lock()
+	defer googleTokenMu.Unlock()
+	c, err := dbGetGoogleCredentials(userID)
+	if err == sql.ErrNoRows {
+		return "", errors.New("no Google account connected")
+	} else if err != nil {
+		return "", err
+	}
+	if c.AccessToken != "" && time.Until(c.ExpiresAt) > time.Minute {
+		return c.AccessToken, nil
+	}
+	token, err := googleTokenRequest(url.Values{"grant_type": {"refresh_token"}, "refresh_token": {c.RefreshToken}})
+	if err != nil {
+		return "", err
+	}
+	c.AccessToken = token.AccessToken
+	c.ExpiresAt = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	if err := dbSaveGoogleCredentials(userID, c); err != nil {
+		return "", err
+	}
+	return c.AccessToken, nil
+}
+
+// GET /api/google/authorize
+// Returns the URL to send the user to, to connect their Google account. The URL must be
+// opened in the browser that made this request, which gets the GOOGLE_OAUTH_COOKIE.
+func handleGoogleAuthorize(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !googleConfigured() {
+		writeAPIError(w, http.StatusServiceUnavailable, ERR_UNAVAILABLE, "Google is not configured (GOOGLE_CLIENT_ID, GOOGLE_CLIENT_SECRET)")
+		return
+	}
+	userID := r.Context().Value("userID").(int64)
+	b := make([]byte, 32)
+	rand.Read(b)
+	state, binding := hex.EncodeToString(b[:16]), hex.EncodeToString(b[16:])
+	googleOAuthStates.mu.Lock()
+	googleOAuthStates.data[state] = googleOAuthState{userID: userID, binding: binding, expiresAt: time.Now().Add(GOOGLE_OAUTH_STATE_TTL)}
+	googleOAuthStates.mu.Unlock()
+	http.SetCookie(w, &http.Cookie{
+		Name:     GOOGLE_OAUTH_COOKIE,
+		Value:    binding,
+		Path:     GOOGLE_CALLBACK_PATH,
+		MaxAge:   int(GOOGLE_OAUTH_STATE_TTL / time.Second),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode, // Sent on the top-level redirect back from Google
+	})
+
+	q := url.Values{
+		"client_id":     {os.Getenv("GOOGLE_CLIENT_ID")},
+		"redirect_uri":  {publicBaseURL(r) + GOOGLE_CALLBACK_PATH},
+		"response_type": {"code"},
+		"scope":         {GOOGLE_SHEETS_SCOPE},
+		"access_type":   {"offline"},
+		"prompt":        {"consent"}, // Always get a refresh token
+		"state":         {state},
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"url": googleAuthURL() + "?" + q.Encode()})
+}
+
+// GET /oauth/google/callback?code=&state=
+// Where Google sends the user back to; opened in the browser, so it answers with text.
+func handleGoogleCallback(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	binding := ""
+	if cookie, err := r.Cookie(GOOGLE_OAUTH_COOKIE); err == nil {
+		binding = cookie.Value
+	}
+	http.SetCookie(w, &http.Cookie{Name: GOOGLE_OAUTH_COOKIE, Path: GOOGLE_CALLBACK_PATH, MaxAge: -1})
+	userID, ok := takeGoogleOAuthState(q.Get("state"), binding)
+	if !ok {
+		http.Error(w, "This authorization link has expired or was opened in another browser; start again from the dashboard.", http.StatusBadRequest)
+		return
+	}
+	if e := q.Get("error"); e != "" {
+		http.Error(w, "Google authorization was not granted: "+e, http.StatusBadRequest)
+		return
+	}
+	token, err := googleTokenRequest(url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {q.Get("code")},
+		"redirect_uri": {publicBaseURL(r) + GOOGLE_CALLBACK_PATH},
+	})
+	if err != nil {
+		fmt.Printf("ERROR: Google authorization for user %d failed: %v\n", userID, err)
+		http.Error(w, "Could not connect the Google account.", http.StatusBadGateway)
+		return
+	}
+	if token.RefreshToken == "" {
+		http.Error(w, "Google did not grant offline access; remove the app's access in your Google account and try again.", http.StatusBadGateway)
+		return
+	}
+	err = dbSaveGoogleCredentials(userID, googleCredentials{
+		RefreshToken: token.RefreshToken,
+		AccessToken:  token.AccessToken,
+		ExpiresAt:    time.Now().Add(time.Duration(token.ExpiresIn) * time.Second),
+	})
+	if err != nil {
+		fmt.Println("ERROR: Could not save Google credentials", err)
+		http.Error(w, "Could not save the Google account.", http.StatusInternalServerError)
+		return
+	}
+	fmt.Printf("INFO: User %d connected a Google account\n", userID)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("Google account connected. You can close this window.\n"))
+}
+
+// GET/DELETE /api/google
+func handleGoogleAccount(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(int64)
+	switch r.Method {
+	case "GET":
+		response := map[string]interface{}{"connected": false, "configured": googleConfigured()}
+		c, err := dbGetGoogleCredentials(userID)
+		if err == nil {
+			response["connected"] = true
+			response["updated_at"] = c.UpdatedAt
+		} else if err != sql.ErrNoRows {
+			apiError(w, "Failed to load Google account", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	case "DELETE":
+		if _, err := db.Exec(`DELETE FROM google_credentials WHERE user_id = ?`, userID); err != nil {
+			apiError(w, "Failed to disconnect Google account", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true})
+	default:
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
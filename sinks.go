@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// --- Sinks ---
+// Besides webhooks, received messages can be written straight to a destination
+// ("sink") such as a Google Sheet, a database table, an email address or an MQTT topic. A sink has the same chat filter as a webhook and
+// a type-specific config; delivery happens in the background, and the last error is
+// kept on the sink so it can be shown.
+
+// A kind of sink. config is the sink's JSON settings.
+type sinkType struct {
+	// Check a new sink's config, returning it normalized
+	validate func(userID int64, config json.RawMessage) (json.RawMessage, error)
+	// Write one received message
+	deliver func(userID int64, s Sink, payload map[string]interface{}) error
+	// Optional: the config with credentials hidden, for API responses
+	redact func(config json.RawMessage) json.RawMessage
+	// Optional, for sinks that keep a connection: called when the sink becomes active
+	// (created, resumed, at startup) and when it stops (paused, deleted)
+	start func(userID int64, s Sink)
+	stop  func(s Sink)
+}
+
+var sinkTypes = map[string]sinkType{
+	SINK_GOOGLE_SHEETS: {validate: validateSheetsSink, deliver: deliverSheetsSink},
+	SINK_DATABASE:      {validate: validateDatabaseSink, deliver: deliverDatabaseSink, redact: redactDatabaseSink},
+	SINK_EMAIL:         {validate: validateEmailSink, deliver: deliverEmailSink},
+	SINK_MQTT:          {validate: validateMQTTSink, deliver: deliverMQTTSink, redact: redactMQTTSink, start: startMQTTSink, stop: stopMQTTSink},
+}
+
+type Sink struct {
+	ID             string          `json:"id"`
+	Type           string          `json:"type"`
+	FilterType     string          `json:"filter_type"`  // "all", "group", "chat", as for webhooks
+	FilterValue    string          `json:"filter_value"` // Group/Chat ID (empty for all)
+	Config         json.RawMessage `json:"config"`
+	Paused         bool            `json:"paused"`
+	LastError      string          `json:"last_error,omitempty"`
+	LastDeliveryAt *time.Time      `json:"last_delivery_at,omitempty"`
+	CreatedAt      time.Time       `json:"created_at"`
+}
+
+// The sink as shown in API responses
+func (s Sink) redacted() Sink {
+	if t, ok := sinkTypes[s.Type]; ok && t.redact != nil {
+		s.Config = t.redact(s.Config)
+	}
+	return s
+}
+
+func sinkTypeNames() []string {
+	var names []string
+	for name := range sinkTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Check and normalize a new sink
+func validateSink(userID int64, s *Sink) error {
+	t, ok := sinkTypes[s.Type]
+	if !ok {
+		return fmt.Errorf("type must be one of %s", strings.Join(sinkTypeNames(), ", "))
+	}
+	// Same chat filter as webhooks
+	wh := Webhook{Method: "POST", FilterType: s.FilterType, FilterValue: s.FilterValue}
+	if err := validateWebhookConfig(&wh); err != nil {
+		return err
+	}
+	s.FilterType, s.FilterValue = wh.FilterType, wh.FilterValue
+	if len(s.Config) == 0 {
+		s.Config = json.RawMessage(`{}`)
+	}
+	config, err := t.validate(userID, s.Config)
+	if err != nil {
+		return err
+	}
+	s.Config = config
+	return nil
+}
+
+// A payload field as text: strings as they are, anything else as JSON
+func sinkFieldText(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	}
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+const sinkColumns = `id, type, filter_type, filter_value, config, paused, last_error, last_delivery_at, created_at`
+
+func scanSink(row interface{ Scan(...interface{}) error }) (Sink, error) {
+	var s Sink
+	var config, createdAt string
+	var lastDelivery sql.NullString
+	err := row.Scan(&s.ID, &s.Type, &s.FilterType, &s.FilterValue, &config, &s.Paused, &s.LastError, &lastDelivery, &createdAt)
+	if err != nil {
+		return s, err
+	}
+	s.Config = json.RawMessage(config)
+	if lastDelivery.Valid {
+		if t, err := time.Parse(time.RFC3339, lastDelivery.String); err == nil {
+			s.LastDeliveryAt = &t
+		}
+	}
+	s.CreatedAt, _ = time.Parse(time.RFC3339, createdAt)
+	return s, nil
+}
+
+func dbCreateSink(userID int64, s Sink) error {
+	_, err := db.Exec(`INSERT INTO sinks (id, user_id, type, filter_type, filter_value, config, paused, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		s.ID, userID, s.Type, s.FilterType, s.FilterValue, string(s.Config), s.Paused, s.CreatedAt.UTC().Format(time.RFC3339))
+	return err
+}
+
+func dbListSinks(userID int64) ([]Sink, error) {
+	rows, err := preparedQuery(readDB, `SELECT `+sinkColumns+` FROM sinks WHERE user_id = ? ORDER BY created_at`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	sinks := []Sink{}
+	for rows.Next() {
+		s, err := scanSink(rows)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, s)
+	}
+	return sinks, rows.Err()
+}
+
+func dbGetSink(userID int64, id string) (Sink, error) {
+	return scanSink(db.QueryRow(`SELECT `+sinkColumns+` FROM sinks WHERE user_id = ? AND id = ?`, userID, id))
+}
+
+func dbDeleteSink(userID int64, id string) error {
+	_, err := db.Exec(`DELETE FROM sinks WHERE user_id = ? AND id = ?`, userID, id)
+	return err
+}
+
+func dbSetSinkPaused(userID int64, id string, paused bool) error {
+	_, err := db.Exec(`UPDATE sinks SET paused = ? WHERE user_id = ? AND id = ?`, paused, userID, id)
+	return err
+}
+
+// Record the outcome of a delivery
+func dbSetSinkResult(id string, deliveryErr error) {
+	var err error
+	if deliveryErr != nil {
+		_, err = db.Exec(`UPDATE sinks SET last_error = ? WHERE id = ?`, deliveryErr.Error(), id)
+	} else {
+		_, err = db.Exec(`UPDATE sinks SET last_error = '', last_delivery_at = ? WHERE id = ?`, time.Now().UTC().Format(time.RFC3339), id)
+	}
+	if err != nil {
+		fmt.Println("ERROR: Could not record sink delivery", err)
+	}
+}
+
+// Start the sinks that keep a connection, for all users
+func startSinks() {
+	rows, err := db.Query(`SELECT user_id, id FROM sinks WHERE paused = 0`)
+	if err != nil {
+		fmt.Println("ERROR: Could not load sinks", err)
+		return
+	}
+	type sinkRef struct {
+		userID int64
+		id     string
+	}
+	var refs []sinkRef
+	for rows.Next() {
+		var ref sinkRef
+		if err := rows.Scan(&ref.userID, &ref.id); err == nil {
+			refs = append(refs, ref)
+		}
+	}
+	rows.Close()
+	for _, ref := range refs {
+		s, err := dbGetSink(ref.userID, ref.id)
+		if err != nil {
+			continue
+		}
+		if t, ok := sinkTypes[s.Type]; ok && t.start != nil {
+			t.start(ref.userID, s)
+		}
+	}
+}
+
+// Write a received message to the user's sinks whose filter matches, in the background
+func deliverToSinks(userID int64, chatJID, chatLID string, payload map[string]interface{}) {
+	sinks, err := dbListSinks(userID)
+	if err != nil {
+		fmt.Printf("ERROR: Could not load sinks for user %d: %v\n", userID, err)
+		return
+	}
+	// forwardToWebhooks goes on to change the payload (e.g. absolute media URLs)
+	payload = maps.Clone(payload)
+	for _, s := range sinks {
+		if s.Paused || !webhookMatchesChat(Webhook{FilterType: s.FilterType, FilterValue: s.FilterValue}, chatJID, chatLID) {
+			continue
+		}
+		t, ok := sinkTypes[s.Type]
+		if !ok {
+			continue
+		}
+		goBackground(func(context.Context) {
+			err := t.deliver(userID, s, payload)
+			if err != nil {
+				fmt.Printf("ERROR: Sink %s (%s) failed: %v\n", s.ID, s.Type, err)
+			}
+			dbSetSinkResult(s.ID, err)
+		})
+	}
+}
+
+// GET/POST /api/sinks
+// POST {"type", "filter_type"?, "filter_value"?, "config"} creates a sink.
+func handleSinks(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(int64)
+	switch r.Method {
+	case "GET":
+		sinks, err := dbListSinks(userID)
+		if err != nil {
+			apiError(w, "Failed to load sinks", http.StatusInternalServerError)
+			return
+		}
+		for i := range sinks {
+			sinks[i] = sinks[i].redacted()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(sinks)
+	case "POST":
+		var req struct {
+			Type        string          `json:"type"`
+			FilterType  string          `json:"filter_type"`
+			FilterValue string          `json:"filter_value"`
+			Config      json.RawMessage `json:"config"`
+		}
+		if err := decodeJSONBody(w, r, &req); err != nil {
+			writeBodyError(w, err)
+			return
+		}
+		s := Sink{
+			ID:          generateWebhookID(),
+			Type:        req.Type,
+			FilterType:  req.FilterType,
+			FilterValue: req.FilterValue,
+			Config:      req.Config,
+			CreatedAt:   time.Now(),
+		}
+		if err := validateSink(userID, &s); err != nil {
+			apiError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := dbCreateSink(userID, s); err != nil {
+			fmt.Println("ERROR: Could not create sink", err)
+			apiError(w, "Failed to create sink", http.StatusInternalServerError)
+			return
+		}
+		fmt.Printf("INFO: User %d created %s sink %s\n", userID, s.Type, s.ID)
+		if t := sinkTypes[s.Type]; t.start != nil {
+			t.start(userID, s)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(s.redacted())
+	default:
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// DELETE /api/sinks/{id}, or POST {"paused": bool} to pause or resume it
+func handleSink(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(int64)
+	s, err := dbGetSink(userID, r.PathValue("id"))
+	if err == sql.ErrNoRows {
+		apiError(w, "Sink not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		apiError(w, "Failed to load sink", http.StatusInternalServerError)
+		return
+	}
+	t := sinkTypes[s.Type]
+	switch r.Method {
+	case "DELETE":
+		if err := dbDeleteSink(userID, s.ID); err != nil {
+			apiError(w, "Failed to delete sink", http.StatusInternalServerError)
+			return
+		}
+		if t.stop != nil {
+			t.stop(s)
+		}
+	case "POST":
+		var req struct {
+			Paused *bool `json:"paused"`
+		}
+		if err := decodeJSONBody(w, r, &req); err != nil {
+			writeBodyError(w, err)
+			return
+		}
+		if req.Paused == nil {
+			apiError(w, "Missing paused", http.StatusBadRequest)
+			return
+		}
+		if err := dbSetSinkPaused(userID, s.ID, *req.Paused); err != nil {
+			apiError(w, "Failed to update sink", http.StatusInternalServerError)
+			return
+		}
+		if *req.Paused && !s.Paused && t.stop != nil {
+			t.stop(s)
+		} else if !*req.Paused && s.Paused && t.start != nil {
+			t.start(userID, s)
+		}
+	default:
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true})
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGoogleSheetsSink(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+
+	email := "sheets@example.com"
+	_, apiKey := registerWithAPIKey(t, ts, email, "sheetspass123")
+
+	// Google's token endpoint: hands out a refresh token for the code, and a new
+	// access token for the refresh token
+	google := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		w.Header().Set("Content-Type", "application/json")
+		if r.Form.Get("client_secret") != "test-secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+			return
+		}
+		switch r.Form.Get("grant_type") {
+		case "authorization_code":
+			if r.Form.Get("code") != "the-code" || r.Form.Get("redirect_uri") != ts.URL+GOOGLE_CALLBACK_PATH {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+				return
+			}
+			// Already expired, so the first delivery refreshes it
+			json.NewEncoder(w).Encode(map[string]interface{}{"access_token": "stale", "refresh_token": "the-refresh-token", "expires_in": 0})
+		case "refresh_token":
+			json.NewEncoder(w).Encode(map[string]interface{}{"access_token": "fresh", "expires_in": 3600})
+		}
+	}))
+	defer google.Close()
+
+	type appendCall struct {
+		path, auth string
+		values     [][]string
+	}
+	appends := make(chan appendCall, 4)
+	created := make(chan []interface{}, 1)
+	sheets := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v4/spreadsheets" {
+			var body struct {
+				Sheets []struct {
+					Data []struct {
+						RowData []struct {
+							Values []interface{} `json:"values"`
+						} `json:"rowData"`
+					} `json:"data"`
+				} `json:"sheets"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			created <- body.Sheets[0].Data[0].RowData[0].Values
+			w.Write([]byte(`{"spreadsheetId": "1NewSheetCreated"}`))
+			return
+		}
+		var body struct {
+			Values [][]string `json:"values"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		appends <- appendCall{path: r.URL.EscapedPath() + "?" + r.URL.RawQuery, auth: r.Header.Get("Authorization"), values: body.Values}
+		w.Write([]byte(`{}`))
+	}))
+	defer sheets.Close()
+
+	t.Setenv("GOOGLE_CLIENT_ID", "test-client")
+	t.Setenv("GOOGLE_CLIENT_SECRET", "test-secret")
+	t.Setenv("GOOGLE_TOKEN_URL", google.URL)
+	t.Setenv("GOOGLE_SHEETS_API_URL", sheets.URL)
+
+	sheetConfig := map[string]interface{}{"spreadsheet_id": "https://docs.google.com/spreadsheets/d/1AbCdEfGhIjKlMnOp/edit#gid=0", "columns": []string{"from", "text"}}
+	resp := apiRequest(t, "POST", ts.URL+"/api/sinks", apiKey, map[string]interface{}{"type": SINK_GOOGLE_SHEETS, "config": sheetConfig}, nil)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected 400 before connecting Google, got %d", resp.StatusCode)
+	}
+
+	// Connect the Google account, from the browser that asked for the URL
+	authorize := func() (string, []*http.Cookie) {
+		t.Helper()
+		var body struct {
+			URL string `json:"url"`
+		}
+		resp := apiRequest(t, "GET", ts.URL+"/api/google/authorize", apiKey, nil, &body)
+		if resp.StatusCode != 200 {
+			t.Fatalf("Authorize failed: %d", resp.StatusCode)
+		}
+		authURL, _ := url.Parse(body.URL)
+		if authURL.Query().Get("access_type") != "offline" || authURL.Query().Get("scope") != GOOGLE_SHEETS_SCOPE {
+			t.Fatalf("Unexpected authorization URL: %s", body.URL)
+		}
+		return authURL.Query().Get("state"), resp.Cookies()
+	}
+	callback := func(state string, cookies []*http.Cookie) int {
+		t.Helper()
+		req, _ := http.NewRequest("GET", ts.URL+GOOGLE_CALLBACK_PATH+"?code=the-code&state="+state, nil)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Callback failed: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	// A link opened in another browser (e.g. sent to someone else) is refused
+	if state, _ := authorize(); callback(state, nil) != http.StatusBadRequest {
+		t.Fatal("Expected a callback without the authorizing browser's cookie to be rejected")
+	}
+	state, cookies := authorize()
+	if status := callback(state, cookies); status != 200 {
+		t.Fatalf("Callback failed: %d", status)
+	}
+	if status := callback(state, cookies); status != http.StatusBadRequest {
+		t.Fatalf("Expected a used state to be rejected, got %d", status)
+	}
+	var account map[string]interface{}
+	apiRequest(t, "GET", ts.URL+"/api/google", apiKey, nil, &account)
+	if account["connected"] != true {
+		t.Fatalf("Expected the Google account to be connected: %v", account)
+	}
+
+	// Invalid sinks
+	for _, body := range []map[string]interface{}{
+		{"type": "carrier_pigeon", "config": sheetConfig},
+		{"type": SINK_GOOGLE_SHEETS, "config": map[string]interface{}{"spreadsheet_id": "not a sheet"}},
+		{"type": SINK_GOOGLE_SHEETS, "config": map[string]interface{}{"spreadsheet_id": "1AbCdEfGhIjKlMnOp", "colour": "red"}},
+		{"type": SINK_GOOGLE_SHEETS, "filter_type": "everything", "config": sheetConfig},
+	} {
+		if resp := apiRequest(t, "POST", ts.URL+"/api/sinks", apiKey, body, nil); resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("Expected 400 for %v, got %d", body, resp.StatusCode)
+		}
+	}
+
+	// Without a spreadsheet_id, a spreadsheet is created with the columns as its header
+	var newSheet Sink
+	resp = apiRequest(t, "POST", ts.URL+"/api/sinks", apiKey, map[string]interface{}{"type": SINK_GOOGLE_SHEETS, "config": map[string]interface{}{"columns": []string{"from", "text"}}}, &newSheet)
+	if resp.StatusCode != http.StatusCreated || !strings.Contains(string(newSheet.Config), `"spreadsheet_id":"1NewSheetCreated"`) {
+		t.Fatalf("Create sink with a new spreadsheet failed: %d %s", resp.StatusCode, newSheet.Config)
+	}
+	if header := <-created; len(header) != 2 {
+		t.Fatalf("Unexpected header row: %v", header)
+	}
+	apiRequest(t, "DELETE", ts.URL+"/api/sinks/"+newSheet.ID, apiKey, nil, nil)
+
+	var sink Sink
+	resp = apiRequest(t, "POST", ts.URL+"/api/sinks", apiKey, map[string]interface{}{"type": SINK_GOOGLE_SHEETS, "config": sheetConfig}, &sink)
+	if resp.StatusCode != http.StatusCreated || sink.FilterType != "all" {
+		t.Fatalf("Create sink failed: %d %+v", resp.StatusCode, sink)
+	}
+
+	forwardToWebhooks(email, map[string]interface{}{"id": "SHEET1", "from": "14155550100@s.whatsapp.net", "to": "14155550100@s.whatsapp.net",
+		"type": "text", "text": "=1+1 please", "timestamp": time.Now().Unix()}, "", "")
+	select {
+	case call := <-appends:
+		if !strings.HasPrefix(call.path, "/v4/spreadsheets/1AbCdEfGhIjKlMnOp/values/%27Sheet1%27:append?valueInputOption=RAW") {
+			t.Fatalf("Unexpected append path: %s", call.path)
+		}
+		if call.auth != "Bearer fresh" {
+			t.Fatalf("Expected the refreshed access token, got %q", call.auth)
+		}
+		if len(call.values) != 1 || len(call.values[0]) != 2 || call.values[0][0] != "14155550100@s.whatsapp.net" || call.values[0][1] != "=1+1 please" {
+			t.Fatalf("Unexpected row: %v", call.values)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Message was not appended to the sheet")
+	}
+
+	// Paused sinks are skipped
+	if resp := apiRequest(t, "POST", ts.URL+"/api/sinks/"+sink.ID, apiKey, map[string]interface{}{"paused": true}, nil); resp.StatusCode != 200 {
+		t.Fatalf("Pause failed: %d", resp.StatusCode)
+	}
+	forwardToWebhooks(email, map[string]interface{}{"id": "SHEET2", "from": "14155550100@s.whatsapp.net", "to": "14155550100@s.whatsapp.net",
+		"type": "text", "text": "skipped", "timestamp": time.Now().Unix()}, "", "")
+	select {
+	case call := <-appends:
+		t.Fatalf("Paused sink was delivered to: %v", call.values)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	var sinks []Sink
+	apiRequest(t, "GET", ts.URL+"/api/sinks", apiKey, nil, &sinks)
+	if len(sinks) != 1 || !sinks[0].Paused || sinks[0].LastDeliveryAt == nil || sinks[0].LastError != "" {
+		t.Fatalf("Unexpected sinks: %+v", sinks)
+	}
+	if resp := apiRequest(t, "DELETE", ts.URL+"/api/sinks/"+sink.ID, apiKey, nil, nil); resp.StatusCode != 200 {
+		t.Fatalf("Delete failed: %d", resp.StatusCode)
+	}
+	if resp := apiRequest(t, "DELETE", ts.URL+"/api/sinks/"+sink.ID, apiKey, nil, nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected 404 deleting twice, got %d", resp.StatusCode)
+	}
+}
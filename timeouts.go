@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// --- Timeouts ---
+// Nothing that waits on WhatsApp, a webhook receiver or the database may block forever.
+// Request handlers pass r.Context() down, so a client going away cancels their work;
+// background work (queued sends, media downloads, webhook deliveries) gets a deadline
+// of its own. Each limit can be changed with an env var, e.g. WA_SEND_TIMEOUT=2m.
+
+var (
+	waSendTimeout     = 60 * time.Second // Uploading media and sending one message
+	waDownloadTimeout = 2 * time.Minute  // Downloading one received media file
+	webhookTimeout    = 10 * time.Second // Delivering one webhook or send callback
+	dbQueryTimeout    = 10 * time.Second // Listing queries in request handlers
+)
+
+// Read the timeout env vars; invalid values keep the default
+func initTimeouts() {
+	for env, timeout := range map[string]*time.Duration{
+		"WA_SEND_TIMEOUT":     &waSendTimeout,
+		"WA_DOWNLOAD_TIMEOUT": &waDownloadTimeout,
+		"WEBHOOK_TIMEOUT":     &webhookTimeout,
+		"DB_QUERY_TIMEOUT":    &dbQueryTimeout,
+	} {
+		value := os.Getenv(env)
+		if value == "" {
+			continue
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			fmt.Printf("WARNING: Ignoring %s=%q, expected a duration like 30s\n", env, value)
+			continue
+		}
+		*timeout = d
+	}
+}
+
+// Context for a handler's database queries: cancelled when the client goes away or
+// after DB_QUERY_TIMEOUT
+func queryContext(r *http.Request) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(r.Context(), dbQueryTimeout)
+}
+
+// HTTP client for webhook deliveries and send callbacks, which refuses non-public
+// destinations (see outbound_guard.go), is shaped per host (see webhook_shaping.go) and
+// identifies itself with WEBHOOK_USER_AGENT (see egress.go)
+func webhookHTTPClient() *http.Client {
+	return &http.Client{Timeout: webhookTimeout, Transport: userAgentTransport{next: shapedTransport{next: guardedTransport}}, CheckRedirect: guardRedirect}
+}
+
+// HTTP client for services the operator configured (Google, the OIDC issuer), which
+// may be on the internal network
+func serviceHTTPClient() *http.Client {
+	return &http.Client{Timeout: webhookTimeout}
+}
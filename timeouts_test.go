@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTimeouts(t *testing.T) {
+	oldSend, oldWebhook := waSendTimeout, webhookTimeout
+	defer func() { waSendTimeout, webhookTimeout = oldSend, oldWebhook }()
+
+	t.Setenv("WA_SEND_TIMEOUT", "2m")
+	t.Setenv("WEBHOOK_TIMEOUT", "soon")
+	initTimeouts()
+	if waSendTimeout != 2*time.Minute || webhookTimeout != oldWebhook {
+		t.Fatalf("Expected WA_SEND_TIMEOUT to apply and an invalid WEBHOOK_TIMEOUT to be ignored, got %s and %s", waSendTimeout, webhookTimeout)
+	}
+
+	// A receiver that never answers fails the delivery instead of blocking it
+	release := make(chan struct{})
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer receiver.Close()
+	defer close(release)
+	webhookTimeout = 100 * time.Millisecond
+	start := time.Now()
+	if _, err := sendWebhook(Webhook{ID: "slow"}, map[string]interface{}{"event": "test"}, receiver.URL, "POST"); err == nil {
+		t.Fatalf("Expected the delivery to time out")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("Expected the delivery to give up after the timeout, took %s", elapsed)
+	}
+}
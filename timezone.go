@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+	_ "time/tzdata" // Embed the zone database so LoadLocation works in minimal images
+)
+
+// Get the configured timezone name for a user
+func getUserTimezone(userID int64) (string, error) {
+	var tz string
+	err := db.QueryRow(`SELECT timezone FROM users WHERE id = ?`, userID).Scan(&tz)
+	if err != nil {
+		return "", err
+	}
+	if tz == "" {
+		tz = "UTC"
+	}
+	return tz, nil
+}
+
+// Set the timezone for a user (must be a valid IANA zone name)
+func setUserTimezone(userID int64, tz string) error {
+	if tz == "Local" {
+		return fmt.Errorf("unknown time zone %s", tz)
+	}
+	if _, err := time.LoadLocation(tz); err != nil {
+		return err
+	}
+	_, err := db.Exec(`UPDATE users SET timezone = ? WHERE id = ?`, tz, userID)
+	return err
+}
+
+// Get the *time.Location for a user, falling back to UTC
+func getUserLocation(userID int64) *time.Location {
+	tz, err := getUserTimezone(userID)
+	if err != nil {
+		return time.UTC
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// Format a time as ISO-8601 in the given location (empty for zero times)
+func formatLocalTime(t time.Time, loc *time.Location) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.In(loc).Format(time.RFC3339)
+}
+
+// GET/POST /api/user/timezone
+func handleUserTimezone(sessionCookieName string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isAuthenticated(r, sessionCookieName) {
+			apiError(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		email := getUserEmail(r, sessionCookieName)
+		userID, err := getUserIDByEmail(email)
+		if err != nil {
+			apiError(w, "Failed to get user ID", http.StatusInternalServerError)
+			return
+		}
+
+		if r.Method == "POST" {
+			var req struct {
+				Timezone string `json:"timezone"`
+			}
+			if err := decodeJSONBody(w, r, &req); err != nil {
+				writeBodyError(w, err)
+				return
+			}
+			if req.Timezone == "" {
+				apiError(w, "Missing timezone", http.StatusBadRequest)
+				return
+			}
+			if err := setUserTimezone(userID, req.Timezone); err != nil {
+				apiError(w, "Invalid timezone", http.StatusBadRequest)
+				return
+			}
+		} else if r.Method != "GET" {
+			apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		tz, err := getUserTimezone(userID)
+		if err != nil {
+			apiError(w, "Failed to get timezone", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"timezone": tz})
+	}
+}
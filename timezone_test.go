@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestUserTimezone(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+
+	client := &http.Client{}
+
+	// Register and login
+	creds, _ := json.Marshal(map[string]string{"email": "tzuser@example.com", "password": "tzpass123"})
+	resp, err := client.Post(ts.URL+"/api/register", "application/json", bytes.NewBuffer(creds))
+	if err != nil || resp.StatusCode != 200 {
+		t.Fatalf("Register failed: %v, status: %d", err, resp.StatusCode)
+	}
+	resp, err = client.Post(ts.URL+"/api/login", "application/json", bytes.NewBuffer(creds))
+	if err != nil || resp.StatusCode != 200 {
+		t.Fatalf("Login failed: %v, status: %d", err, resp.StatusCode)
+	}
+	cookies := resp.Cookies()
+
+	doTZ := func(method string, body map[string]string) (*http.Response, map[string]string) {
+		var buf bytes.Buffer
+		if body != nil {
+			json.NewEncoder(&buf).Encode(body)
+		}
+		req, _ := http.NewRequest(method, ts.URL+"/api/user/timezone", &buf)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Timezone request failed: %v", err)
+		}
+		var data map[string]string
+		json.NewDecoder(resp.Body).Decode(&data)
+		return resp, data
+	}
+
+	// Default is UTC
+	resp, data := doTZ("GET", nil)
+	if resp.StatusCode != 200 || data["timezone"] != "UTC" {
+		t.Fatalf("Expected default timezone UTC, got %d %v", resp.StatusCode, data)
+	}
+
+	// Invalid timezone is rejected
+	resp, _ = doTZ("POST", map[string]string{"timezone": "Mars/Olympus"})
+	if resp.StatusCode != 400 {
+		t.Fatalf("Expected 400 for invalid timezone, got %d", resp.StatusCode)
+	}
+
+	// Valid timezone is stored
+	resp, data = doTZ("POST", map[string]string{"timezone": "Asia/Kolkata"})
+	if resp.StatusCode != 200 || data["timezone"] != "Asia/Kolkata" {
+		t.Fatalf("Expected timezone Asia/Kolkata, got %d %v", resp.StatusCode, data)
+	}
+
+	// Localized formatting keeps the same instant
+	userID, _ := getUserIDByEmail("tzuser@example.com")
+	got := formatLocalTime(time.Unix(0, 0), getUserLocation(userID))
+	if got != "1970-01-01T05:30:00+05:30" {
+		t.Fatalf("Unexpected localized time: %s", got)
+	}
+
+	// Analytics days start at midnight in the user's timezone
+	_, apiKey := registerWithAPIKey(t, ts, "tzstats@example.com", "tzstatspass123")
+	statsUserID, _ := getUserIDByEmail("tzstats@example.com")
+	setUserTimezone(statsUserID, "Asia/Kolkata")
+	incrementStat(statsUserID, STAT_AUTO_RESPONDER_SENT)
+	var stats struct {
+		Timezone string       `json:"timezone"`
+		Daily    []DailyStats `json:"daily"`
+	}
+	apiRequest(t, "GET", ts.URL+"/api/analytics?days=1", apiKey, nil, &stats)
+	if stats.Timezone != "Asia/Kolkata" || len(stats.Daily) != 1 {
+		t.Fatalf("Unexpected analytics: %+v", stats)
+	}
+	day := stats.Daily[0]
+	if day.TimestampISO != day.Date+"T00:00:00+05:30" || formatLocalTime(time.Unix(day.Timestamp, 0), getUserLocation(userID)) != day.TimestampISO {
+		t.Fatalf("Unexpected day timestamps: %+v", day)
+	}
+}
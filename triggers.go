@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// --- No-code triggers ---
+// For Zapier, Make and similar platforms: a polling trigger listing new received
+// messages after a cursor, and REST hook subscriptions, which are webhooks created
+// after a handshake with the target (tagged "trigger", so they show up and can be
+// managed with the other webhooks).
+
+const (
+	DEFAULT_TRIGGER_LIMIT = 50
+	MAX_TRIGGER_LIMIT     = 100
+	TRIGGER_TAG           = "trigger"
+	HOOK_SECRET_HEADER    = "X-Hook-Secret"
+)
+
+// A received message as returned by the polling trigger: the payload forwarded to
+// webhooks, plus its cursor
+type TriggerMessage map[string]interface{}
+
+// Received messages after a cursor (the archive's row ID), oldest first, or the newest
+// ones without a cursor. Each message is listed once, as the archive ignores duplicates.
+func dbNewMessagesSince(userID int64, cursor int64, since time.Time, chatJID string, limit int) ([]TriggerMessage, error) {
+	where := `WHERE user_id = ? AND rowid > ?`
+	args := []interface{}{userID, cursor}
+	if !since.IsZero() {
+		where += ` AND timestamp > ?`
+		args = append(args, since.UTC().Format(time.RFC3339))
+	}
+	if chatJID != "" {
+		where += ` AND chat_jid = ?`
+		args = append(args, chatJID)
+	}
+	order := `ASC`
+	if cursor == 0 && since.IsZero() {
+		order = `DESC` // No cursor yet: a sample of the latest
+	}
+	rows, err := db.Query(`SELECT rowid, chat_jid, message_id, payload FROM messages `+where+` ORDER BY rowid `+order+` LIMIT ?`, append(args, limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	messages := []TriggerMessage{}
+	for rows.Next() {
+		var rowID int64
+		var chat, messageID, payload string
+		if err := rows.Scan(&rowID, &chat, &messageID, &payload); err != nil {
+			return nil, err
+		}
+		m := TriggerMessage{}
+		json.Unmarshal([]byte(payload), &m)
+		m["id"] = messageID
+		m["chat_jid"] = chat
+		m["cursor"] = rowID
+		messages = append(messages, m)
+	}
+	return messages, rows.Err()
+}
+
+// GET /api/triggers/new-messages?since=&chat_jid=&limit=
+// since is the cursor of the last message seen (or an RFC3339 time). Messages are
+// returned newest first, as polling platforms expect; X-Next-Cursor is the since to
+// poll with next, and X-Has-More is set when more messages are waiting.
+func handleTriggerNewMessages(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID := r.Context().Value("userID").(int64)
+	q := r.URL.Query()
+
+	var cursor int64
+	var since time.Time
+	if v := q.Get("since"); v != "" {
+		var err error
+		if cursor, err = strconv.ParseInt(v, 10, 64); err != nil || cursor < 0 {
+			cursor = 0
+			if since, err = time.Parse(time.RFC3339, v); err != nil {
+				apiError(w, "Invalid since (a cursor or an RFC3339 time)", http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	chatJID := ""
+	if v := q.Get("chat_jid"); v != "" {
+		jid, err := normalizeChatJID(v)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, ERR_INVALID_JID, "Invalid chat_jid")
+			return
+		}
+		chatJID = jid.String()
+	}
+	limit := DEFAULT_TRIGGER_LIMIT
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > MAX_TRIGGER_LIMIT {
+			apiError(w, fmt.Sprintf("Invalid limit (1-%d)", MAX_TRIGGER_LIMIT), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	// One extra row tells whether there are more
+	messages, err := dbNewMessagesSince(userID, cursor, since, chatJID, limit+1)
+	if err != nil {
+		fmt.Println("ERROR: Could not list new messages", err)
+		apiError(w, "Failed to list messages", http.StatusInternalServerError)
+		return
+	}
+	polling := cursor > 0 || !since.IsZero()
+	if len(messages) > limit {
+		messages = messages[:limit]
+		if polling {
+			w.Header().Set("X-Has-More", "true")
+		}
+	}
+	next := cursor
+	for _, m := range messages {
+		next = max(next, m["cursor"].(int64))
+	}
+	if polling {
+		// Oldest first from the database; newest first in the response
+		for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+			messages[i], messages[j] = messages[j], messages[i]
+		}
+	}
+	w.Header().Set("X-Next-Cursor", strconv.FormatInt(next, 10))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(messages)
+}
+
+// Confirm a REST hook target: POST a subscription notice with the hook secret, which
+// must be answered with a 2xx. The secret is sent with every delivery afterwards, so
+// the target can tell the deliveries are genuine.
+func confirmHookTarget(targetURL, subscriptionID, secret string) error {
+	body, _ := json.Marshal(map[string]interface{}{"event": "subscription.confirm", "subscription_id": subscriptionID})
+	req, err := http.NewRequest("POST", targetURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HOOK_SECRET_HEADER, secret)
+	resp, err := webhookHTTPClient().Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("target answered with status %d", resp.StatusCode)
+	}
+	if echoed := resp.Header.Get(HOOK_SECRET_HEADER); echoed != "" && echoed != secret {
+		return fmt.Errorf("target echoed a different %s", HOOK_SECRET_HEADER)
+	}
+	return nil
+}
+
+// POST /api/triggers/subscriptions {"target_url", "chat_jid"?}
+// Subscribes a REST hook to new messages (optionally of one chat), after the handshake.
+func handleTriggerSubscribe(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID := r.Context().Value("userID").(int64)
+	var req struct {
+		TargetURL string `json:"target_url"`
+		ChatJID   string `json:"chat_jid"`
+	}
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	if req.TargetURL == "" {
+		apiError(w, "Missing target_url", http.StatusBadRequest)
+		return
+	}
+	secretBytes := make([]byte, 16)
+	rand.Read(secretBytes)
+	secret := hex.EncodeToString(secretBytes)
+
+	wh := Webhook{
+		ID:         generateWebhookID(),
+		URL:        req.TargetURL,
+		Method:     "POST",
+		FilterType: "all",
+		Tags:       []string{TRIGGER_TAG},
+		Headers:    map[string]string{HOOK_SECRET_HEADER: secret},
+		CreatedAt:  time.Now(),
+	}
+	if req.ChatJID != "" {
+		jid, err := normalizeChatJID(req.ChatJID)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, ERR_INVALID_JID, "Invalid chat_jid")
+			return
+		}
+		wh.FilterType, wh.FilterValue = "chat", jid.String()
+		if chatTypeForJID(wh.FilterValue) == "group" {
+			wh.FilterType = "group"
+		}
+	}
+	if err := validateWebhookConfig(&wh); err != nil {
+		apiError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	allowedChats, err := limitToAPIKeyChats(userID, wh.AllowedChats)
+	if err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	wh.AllowedChats = allowedChats
+	if err := confirmHookTarget(wh.URL, wh.ID, secret); err != nil {
+		writeAPIError(w, http.StatusBadRequest, ERR_BAD_REQUEST, "The target did not confirm the subscription: "+err.Error())
+		return
+	}
+	if err := dbCreateWebhook(userID, wh); err != nil {
+		fmt.Println("ERROR: Could not create trigger subscription", err)
+		apiError(w, "Failed to subscribe", http.StatusInternalServerError)
+		return
+	}
+	fmt.Printf("INFO: User %d subscribed REST hook %s\n", userID, wh.ID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":         wh.ID,
+		"target_url": wh.URL,
+		"chat_jid":   wh.FilterValue,
+		"secret":     secret,
+	})
+}
+
+// DELETE /api/triggers/subscriptions/{id}
+func handleTriggerUnsubscribe(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "DELETE" {
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID := r.Context().Value("userID").(int64)
+	wh, err := dbGetWebhook(userID, r.PathValue("id"))
+	if err == sql.ErrNoRows || (err == nil && !slices.Contains(wh.Tags, TRIGGER_TAG)) {
+		apiError(w, "Subscription not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		apiError(w, "Failed to load subscription", http.StatusInternalServerError)
+		return
+	}
+	if err := dbDeleteWebhook(userID, wh.ID); err != nil {
+		apiError(w, "Failed to unsubscribe", http.StatusInternalServerError)
+		return
+	}
+	fmt.Printf("INFO: User %d unsubscribed REST hook %s\n", userID, wh.ID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true})
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTriggerNewMessagesPolling(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+
+	email := "zapier@example.com"
+	_, apiKey := registerWithAPIKey(t, ts, email, "zapierpass123")
+	userID, _ := getUserIDByEmail(email)
+
+	receive := func(i int) {
+		payload := map[string]interface{}{"id": fmt.Sprintf("MSG%d", i), "from": "14155550100@s.whatsapp.net", "to": "14155550100@s.whatsapp.net",
+			"type": "text", "text": fmt.Sprintf("message %d", i), "timestamp": time.Now().Unix()}
+		if err := archiveMessage(userID, "14155550100@s.whatsapp.net", payload, ""); err != nil {
+			t.Fatalf("archiveMessage: %v", err)
+		}
+	}
+	poll := func(query string) ([]map[string]interface{}, *http.Response) {
+		t.Helper()
+		var out []map[string]interface{}
+		resp := apiRequest(t, "GET", ts.URL+"/api/triggers/new-messages"+query, apiKey, nil, &out)
+		if resp.StatusCode != 200 {
+			t.Fatalf("Poll %s failed: %d", query, resp.StatusCode)
+		}
+		return out, resp
+	}
+
+	for i := 1; i <= 3; i++ {
+		receive(i)
+	}
+	receive(2) // A duplicate delivery is listed once
+
+	// First poll: a sample of the newest, with a cursor to continue from
+	messages, resp := poll("?limit=2")
+	if len(messages) != 2 || messages[0]["id"] != "MSG3" || messages[1]["id"] != "MSG2" {
+		t.Fatalf("Unexpected sample: %v", messages)
+	}
+	cursor := resp.Header.Get("X-Next-Cursor")
+
+	messages, _ = poll("?since=" + cursor)
+	if len(messages) != 0 {
+		t.Fatalf("Expected nothing new, got %v", messages)
+	}
+
+	for i := 4; i <= 6; i++ {
+		receive(i)
+	}
+	// Paging forward from the cursor: oldest unseen first, newest first within a page
+	messages, resp = poll("?since=" + cursor + "&limit=2")
+	if len(messages) != 2 || messages[0]["id"] != "MSG5" || messages[1]["id"] != "MSG4" || resp.Header.Get("X-Has-More") != "true" {
+		t.Fatalf("Unexpected page: %v (has more %q)", messages, resp.Header.Get("X-Has-More"))
+	}
+	messages, resp = poll("?since=" + resp.Header.Get("X-Next-Cursor"))
+	if len(messages) != 1 || messages[0]["id"] != "MSG6" || messages[0]["text"] != "message 6" || resp.Header.Get("X-Has-More") != "" {
+		t.Fatalf("Unexpected last page: %v", messages)
+	}
+
+	if resp := apiRequest(t, "GET", ts.URL+"/api/triggers/new-messages?since=yesterday", apiKey, nil, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for an invalid since, got %d", resp.StatusCode)
+	}
+}
+
+func TestTriggerSubscriptions(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+
+	email := "resthook@example.com"
+	_, apiKey := registerWithAPIKey(t, ts, email, "resthookpass123")
+
+	secrets := make(chan string, 4)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		secrets <- r.Header.Get(HOOK_SECRET_HEADER)
+	}))
+	defer target.Close()
+	refusing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusGone)
+	}))
+	defer refusing.Close()
+
+	if resp := apiRequest(t, "POST", ts.URL+"/api/triggers/subscriptions", apiKey, map[string]string{"target_url": refusing.URL}, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected 400 when the target refuses, got %d", resp.StatusCode)
+	}
+
+	var sub map[string]interface{}
+	resp := apiRequest(t, "POST", ts.URL+"/api/triggers/subscriptions", apiKey, map[string]string{"target_url": target.URL}, &sub)
+	if resp.StatusCode != http.StatusCreated || sub["id"] == nil || sub["secret"] == "" {
+		t.Fatalf("Subscribe failed: %d %v", resp.StatusCode, sub)
+	}
+	if got := <-secrets; got != sub["secret"] {
+		t.Fatalf("Handshake secret %q, want %q", got, sub["secret"])
+	}
+
+	// Deliveries carry the secret
+	forwardToWebhooks(email, map[string]interface{}{"id": "HOOK1", "from": "14155550100@s.whatsapp.net", "to": "14155550100@s.whatsapp.net",
+		"type": "text", "text": "hi", "timestamp": time.Now().Unix()}, "", "test_media")
+	select {
+	case got := <-secrets:
+		if got != sub["secret"] {
+			t.Fatalf("Delivery secret %q, want %q", got, sub["secret"])
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for the delivery")
+	}
+
+	// Plain webhooks can't be removed as subscriptions
+	var created map[string]interface{}
+	apiRequest(t, "POST", ts.URL+"/api/webhooks/create", apiKey, map[string]interface{}{"url": target.URL, "method": "POST"}, &created)
+	if resp := apiRequest(t, "DELETE", ts.URL+"/api/triggers/subscriptions/"+created["id"].(string), apiKey, nil, nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected 404 for a plain webhook, got %d", resp.StatusCode)
+	}
+	if resp := apiRequest(t, "DELETE", ts.URL+"/api/triggers/subscriptions/"+sub["id"].(string), apiKey, nil, nil); resp.StatusCode != 200 {
+		t.Fatalf("Unsubscribe failed: %d", resp.StatusCode)
+	}
+	if resp := apiRequest(t, "DELETE", ts.URL+"/api/triggers/subscriptions/"+sub["id"].(string), apiKey, nil, nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected 404 after unsubscribing, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// --- Personal data export and erasure ---
+// For data subject requests: an account can download everything stored about it as a
+// ZIP, and erase its stored data, either all of it or a single chat's. Erasure takes
+// two calls: the first returns what would be deleted and a confirmation token, the
+// second (with the token) deletes it. Account settings and webhooks are kept.
+
+const DATA_DELETE_CONFIRM_TTL = 10 * time.Minute
+
+// The chat of a stored webhook payload: a message's "to", or an event's "chat_jid"
+const payloadChatExpr = `COALESCE(json_extract(payload, '$.to'), json_extract(payload, '$.chat_jid'))`
+
+// Per-user tables holding chat data, purged by an erasure. The chat column (or
+// expression) scopes a per-chat erasure. An upload's chat is the one it was last sent to.
+var erasureTables = []struct {
+	name       string
+	chatColumn string
+}{
+	{"messages", "chat_jid"},
+	{"document_texts", "chat_jid"},
+	{"sent_messages", "chat_jid"},
+	{"chat_media", "chat_jid"},
+	{"recent_chats", "chat_jid"},
+	{"contacts", "jid"},
+	{"conversation_assignments", "chat_jid"},
+	{"bot_chats", "chat_jid"},
+	{"bot_replies", "chat_jid"},
+	{"auto_responder_replies", "chat_jid"},
+	{"webhook_payloads", payloadChatExpr},
+	{"webhook_buffer", payloadChatExpr},
+	{"media_uploads", "chat_jid"},
+}
+
+// Pending erasures: confirmation token -> what it erases
+var dataDeleteConfirmations = struct {
+	mu   sync.Mutex
+	data map[string]dataDeleteConfirmation
+}{
+	data: make(map[string]dataDeleteConfirmation),
+}
+
+type dataDeleteConfirmation struct {
+	userID    int64
+	chatJID   string // Empty for all data
+	expiresAt time.Time
+}
+
+// Take (and forget) a confirmation token, if it was issued for this user and chat
+func takeDataDeleteConfirmation(token string, userID int64, chatJID string) bool {
+	dataDeleteConfirmations.mu.Lock()
+	defer dataDeleteConfirmations.mu.Unlock()
+	c, ok := dataDeleteConfirmations.data[token]
+	delete(dataDeleteConfirmations.data, token)
+	for key, other := range dataDeleteConfirmations.data {
+		if time.Now().After(other.expiresAt) {
+			delete(dataDeleteConfirmations.data, key)
+		}
+	}
+	return ok && c.userID == userID && c.chatJID == chatJID && time.Now().Before(c.expiresAt)
+}
+
+// WHERE clause and arguments selecting a user's rows in a table, optionally for one chat
+func erasureCondition(userID int64, chatColumn, chatJID string) (string, []interface{}) {
+	if chatJID == "" {
+		return `user_id = ?`, []interface{}{userID}
+	}
+	return `user_id = ? AND ` + chatColumn + ` = ?`, []interface{}{userID, chatJID}
+}
+
+// Campaign recipients whose reply text is kept, optionally for one chat
+func campaignReplyCondition(userID int64, chatJID string) (string, []interface{}) {
+	where := `reply != '' AND campaign_id IN (SELECT id FROM campaigns WHERE user_id = ?)`
+	args := []interface{}{userID}
+	if chatJID != "" {
+		where += ` AND chat_jid = ?`
+		args = append(args, chatJID)
+	}
+	return where, args
+}
+
+// Number of rows an erasure would delete, by table
+func dbCountErasure(userID int64, chatJID string) (map[string]int64, error) {
+	counts := map[string]int64{}
+	for _, t := range erasureTables {
+		where, args := erasureCondition(userID, t.chatColumn, chatJID)
+		var n int64
+		if err := db.QueryRow(`SELECT COUNT(*) FROM `+t.name+` WHERE `+where, args...).Scan(&n); err != nil {
+			return nil, err
+		}
+		counts[t.name] = n
+	}
+	where, args := campaignReplyCondition(userID, chatJID)
+	var n int64
+	if err := db.QueryRow(`SELECT COUNT(*) FROM campaign_recipients WHERE `+where, args...).Scan(&n); err != nil {
+		return nil, err
+	}
+	counts["campaign_replies"] = n
+	return counts, nil
+}
+
+// Delete a user's stored chat data (one chat's, if chatJID is set) in one transaction.
+// Returns the deleted rows by table, and the received media and uploaded files they referenced.
+func dbEraseUserData(userID int64, chatJID string) (map[string]int64, []string, []string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer tx.Rollback()
+
+	where, args := erasureCondition(userID, "chat_jid", chatJID)
+	media, err := queryStrings(tx, `SELECT file_path FROM chat_media WHERE `+where, args...)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	uploads, err := queryStrings(tx, `SELECT file_path FROM media_uploads WHERE file_path != '' AND `+where, args...)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	counts := map[string]int64{}
+	for _, t := range erasureTables {
+		where, args := erasureCondition(userID, t.chatColumn, chatJID)
+		res, err := tx.Exec(`DELETE FROM `+t.name+` WHERE `+where, args...)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("%s: %w", t.name, err)
+		}
+		counts[t.name], _ = res.RowsAffected()
+	}
+	where, args = campaignReplyCondition(userID, chatJID)
+	res, err := tx.Exec(`UPDATE campaign_recipients SET reply = '' WHERE `+where, args...)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("campaign_recipients: %w", err)
+	}
+	counts["campaign_replies"], _ = res.RowsAffected()
+
+	return counts, media, uploads, tx.Commit()
+}
+
+// Run a query (on the DB or in a transaction) returning a single string column
+func queryStrings(q interface {
+	Query(string, ...interface{}) (*sql.Rows, error)
+}, query string, args ...interface{}) ([]string, error) {
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var values []string
+	for rows.Next() {
+		var v string
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, rows.Err()
+}
+
+// Drop a user's in-memory webhook log entries (only those about chatJID, if set).
+// Returns the number of entries removed.
+func clearWebhookLogs(webhooks []Webhook, chatJID string) int {
+	webhookLogs.mu.Lock()
+	defer webhookLogs.mu.Unlock()
+	removed := 0
+	for _, wh := range webhooks {
+		entries := webhookLogs.logs[wh.ID]
+		if chatJID == "" {
+			removed += len(entries)
+			delete(webhookLogs.logs, wh.ID)
+			continue
+		}
+		kept := entries[:0]
+		for _, e := range entries {
+			to, _ := e.Payload["to"].(string)
+			chat, _ := e.Payload["chat_jid"].(string)
+			if to == chatJID || chat == chatJID {
+				removed++
+				continue
+			}
+			kept = append(kept, e)
+		}
+		webhookLogs.logs[wh.ID] = kept
+	}
+	return removed
+}
+
+// POST /api/user/data/delete {"chat_jid": "..."} then {"chat_jid": "...", "confirm": "<token>"}
+// Session-authenticated. Without chat_jid all stored chat data is erased, the in-memory
+// webhook logs are cleared and the WhatsApp session is logged out and its files removed.
+func handleDeleteUserData(sessionCookieName, waSessionPrefix string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !isAuthenticated(r, sessionCookieName) {
+			apiError(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		email := getUserEmail(r, sessionCookieName)
+		userID, err := getUserIDByEmail(email)
+		if err != nil {
+			apiError(w, "User not found", http.StatusUnauthorized)
+			return
+		}
+
+		var req struct {
+			ChatJID string `json:"chat_jid"`
+			Confirm string `json:"confirm"`
+		}
+		if err := decodeJSONBody(w, r, &req); err != nil && err != io.EOF {
+			writeBodyError(w, err)
+			return
+		}
+		chatJID := ""
+		if req.ChatJID != "" {
+			jid, err := normalizeChatJID(req.ChatJID)
+			if err != nil {
+				writeAPIError(w, http.StatusBadRequest, ERR_INVALID_JID, "Invalid chat JID")
+				return
+			}
+			chatJID = jid.String()
+		}
+
+		// First call: report what would be deleted and issue a confirmation token
+		if req.Confirm == "" {
+			counts, err := dbCountErasure(userID, chatJID)
+			if err != nil {
+				fmt.Println("ERROR: Could not count data to delete", err)
+				apiError(w, "Failed to prepare deletion", http.StatusInternalServerError)
+				return
+			}
+			b := make([]byte, 16)
+			rand.Read(b)
+			token := hex.EncodeToString(b)
+			expiresAt := time.Now().Add(DATA_DELETE_CONFIRM_TTL)
+			dataDeleteConfirmations.mu.Lock()
+			dataDeleteConfirmations.data[token] = dataDeleteConfirmation{userID: userID, chatJID: chatJID, expiresAt: expiresAt}
+			dataDeleteConfirmations.mu.Unlock()
+
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"confirmation_required": true,
+				"confirmation_token":    token,
+				"expires_at":            expiresAt.UTC(),
+				"chat_jid":              chatJID,
+				"counts":                counts,
+			})
+			return
+		}
+
+		if !takeDataDeleteConfirmation(req.Confirm, userID, chatJID) {
+			writeAPIError(w, http.StatusBadRequest, ERR_BAD_REQUEST, "Invalid or expired confirmation token")
+			return
+		}
+
+		counts, media, uploads, err := dbEraseUserData(userID, chatJID)
+		if err != nil {
+			fmt.Printf("ERROR: Could not delete data of user %s: %v\n", email, err)
+			apiError(w, "Failed to delete data", http.StatusInternalServerError)
+			return
+		}
+		for _, path := range media {
+			releaseMediaFile(path)
+		}
+		for _, path := range uploads {
+			os.Remove(path)
+		}
+		webhooks, err := dbListWebhooks(userID)
+		if err != nil {
+			fmt.Printf("ERROR: Could not load webhooks of user %s to clear logs: %v\n", email, err)
+		}
+		counts["webhook_logs"] = int64(clearWebhookLogs(webhooks, chatJID))
+
+		response := map[string]interface{}{
+			"success":  true,
+			"chat_jid": chatJID,
+			"deleted":  counts,
+		}
+		if chatJID == "" {
+			if err := logoutUserWhatsMeow(email, waSessionPrefix); err != nil {
+				response["warning"] = "Could not unlink the device from WhatsApp; remove it under Linked devices on the phone"
+			}
+		}
+		fmt.Printf("INFO: Erased stored data of user %s (chat %q): %v\n", email, chatJID, counts)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// Tables in a data export: file name in the ZIP, and the query (by user_id) for its rows
+var exportTables = []struct {
+	file  string
+	query string
+}{
+	{"account.json", `SELECT email, timezone, receive_only, created_at FROM users WHERE id = ?`},
+	{"messages.json", `SELECT chat_jid, message_id, sender, type, text, payload, timestamp, state, assigned_to, note, annotated_at FROM messages WHERE user_id = ? ORDER BY timestamp`},
+	{"sent_messages.json", `SELECT queue_id, chat_jid, message_id, server_id, server_timestamp, text, media_id, source, campaign_id, edit_of FROM sent_messages WHERE user_id = ? ORDER BY server_timestamp`},
+	{"document_texts.json", `SELECT chat_jid, message_id, text, created_at FROM document_texts WHERE user_id = ?`},
+	{"contacts.json", `SELECT jid, name, full_name, first_name, push_name, business_name, updated_at FROM contacts WHERE user_id = ?`},
+	{"recent_chats.json", `SELECT chat_jid, name, type, last_message_at, last_text FROM recent_chats WHERE user_id = ?`},
+	{"conversation_assignments.json", `SELECT chat_jid, agent_id, reason, assigned_at FROM conversation_assignments WHERE user_id = ?`},
+	{"bot_replies.json", `SELECT chat_jid, text, sent_at FROM bot_replies WHERE user_id = ?`},
+	{"webhook_payloads.json", `SELECT id, webhook_id, payload, created_at FROM webhook_payloads WHERE user_id = ?`},
+	{"webhook_buffer.json", `SELECT webhook_id, payload, created_at FROM webhook_buffer WHERE user_id = ? ORDER BY id`},
+	{"audit_log.json", `SELECT action, detail, ip, created_at FROM audit_logs WHERE user_id = ? ORDER BY id`},
+}
+
+// Query rows as column -> value maps. JSON payload columns are embedded as JSON.
+func dbQueryExportRows(query string, userID int64) ([]map[string]interface{}, error) {
+	rows, err := db.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	result := []map[string]interface{}{}
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		ptrs := make([]interface{}, len(columns))
+		for i := range values {
+			ptrs[i] = &values[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, err
+		}
+		row := make(map[string]interface{}, len(columns))
+		for i, col := range columns {
+			v := values[i]
+			if b, ok := v.([]byte); ok {
+				v = string(b)
+			}
+			if s, ok := v.(string); ok && col == "payload" && json.Valid([]byte(s)) {
+				v = json.RawMessage(s)
+			}
+			row[col] = v
+		}
+		result = append(result, row)
+	}
+	return result, rows.Err()
+}
+
+func writeZipJSON(zw *zip.Writer, name string, v interface{}) error {
+	entry, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: time.Now()})
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(entry)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// GET /api/user/data/export
+// Session-authenticated. Streams a ZIP of everything stored for the account: the
+// message archive and related chat data, webhook configs and their logs, and the
+// received media files (under media/).
+func handleExportUserData(sessionCookieName string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !isAuthenticated(r, sessionCookieName) {
+			apiError(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		email := getUserEmail(r, sessionCookieName)
+		userID, err := getUserIDByEmail(email)
+		if err != nil {
+			apiError(w, "User not found", http.StatusUnauthorized)
+			return
+		}
+
+		// Load everything before streaming, so a DB error can still be reported
+		files := map[string]interface{}{}
+		for _, t := range exportTables {
+			rows, err := dbQueryExportRows(t.query, userID)
+			if err != nil {
+				fmt.Printf("ERROR: Could not export %s for user %s: %v\n", t.file, email, err)
+				apiError(w, "Failed to export data", http.StatusInternalServerError)
+				return
+			}
+			files[t.file] = rows
+		}
+		webhooks, err := dbListWebhooks(userID)
+		if err != nil {
+			fmt.Printf("ERROR: Could not export webhooks for user %s: %v\n", email, err)
+			apiError(w, "Failed to export data", http.StatusInternalServerError)
+			return
+		}
+		logs := map[string][]WebhookLogEntry{}
+		for _, wh := range webhooks {
+			logs[wh.ID] = getWebhookLogs(wh.ID)
+		}
+		files["webhooks.json"] = webhooks
+		files["webhook_logs.json"] = logs
+		media, err := dbListUserMedia(r.Context(), userID)
+		if err != nil {
+			fmt.Printf("ERROR: Could not export media for user %s: %v\n", email, err)
+			apiError(w, "Failed to export data", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", `attachment; filename="account-data.zip"`)
+		zw := zip.NewWriter(w)
+		for name, v := range files {
+			if err := writeZipJSON(zw, name, v); err != nil {
+				fmt.Printf("ERROR: Data export for %s aborted: %v\n", email, err)
+				return
+			}
+		}
+		seen := map[string]bool{}
+		for _, m := range media {
+			if seen[m.FilePath] {
+				continue
+			}
+			seen[m.FilePath] = true
+			f, err := os.Open(m.FilePath)
+			if err != nil {
+				// Already removed by media cleanup
+				continue
+			}
+			entry, err := zw.CreateHeader(&zip.FileHeader{
+				Name:     "media/" + filepath.Base(m.FilePath),
+				Method:   zip.Deflate,
+				Modified: m.Timestamp,
+			})
+			if err == nil {
+				_, err = io.Copy(entry, f)
+			}
+			f.Close()
+			if err != nil {
+				fmt.Printf("ERROR: Data export for %s aborted: %v\n", email, err)
+				return
+			}
+		}
+		if err := zw.Close(); err != nil {
+			fmt.Printf("ERROR: Could not finish data export for %s: %v\n", email, err)
+			return
+		}
+		fmt.Printf("INFO: Exported stored data of user %s (%d media files)\n", email, len(seen))
+	}
+}
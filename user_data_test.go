@@ -0,0 +1,158 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUserDataExportAndDelete(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+
+	email := "gdpr@example.com"
+	cookies, apiKey := registerWithAPIKey(t, ts, email, "gdprpass123")
+	userID, _ := getUserIDByEmail(email)
+
+	chatA := "14155550001@s.whatsapp.net"
+	chatB := "14155550002@s.whatsapp.net"
+	for i, chat := range []string{chatA, chatB} {
+		archiveMessage(userID, chat, map[string]interface{}{"id": "MSG" + chat[:11], "from": chat, "text": "hello", "timestamp": int64(1700000000 + i)}, "")
+		name := chat[:11] + ".jpg"
+		p := filepath.Join("test_media", name)
+		os.WriteFile(p, []byte("data "+name), 0644)
+		dbSaveMediaFileInfo(userID, name, "image/jpeg", "", "hash"+name)
+		dbRecordChatMedia(userID, chat, "MSG"+chat[:11], "image", p, time.Now())
+	}
+
+	session := func(method, path string, body interface{}, out interface{}) *http.Response {
+		t.Helper()
+		var buf bytes.Buffer
+		if body != nil {
+			json.NewEncoder(&buf).Encode(body)
+		}
+		req, _ := http.NewRequest(method, ts.URL+path, &buf)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s failed: %v", method, path, err)
+		}
+		if out != nil {
+			json.NewDecoder(resp.Body).Decode(out)
+		}
+		return resp
+	}
+
+	// Export: session only
+	if resp := apiRequest(t, "GET", ts.URL+"/api/user/data/export", apiKey, nil, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 for API key, got %d", resp.StatusCode)
+	}
+	resp := session("GET", "/api/user/data/export", nil, nil)
+	if resp.StatusCode != 200 || resp.Header.Get("Content-Type") != "application/zip" {
+		t.Fatalf("Export failed, status: %d", resp.StatusCode)
+	}
+	data, _ := io.ReadAll(resp.Body)
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("Invalid zip: %v", err)
+	}
+	entries := map[string]*zip.File{}
+	for _, f := range zr.File {
+		entries[f.Name] = f
+	}
+	for _, name := range []string{"account.json", "messages.json", "webhooks.json", "webhook_logs.json", "media/14155550001.jpg", "media/14155550002.jpg"} {
+		if entries[name] == nil {
+			t.Fatalf("Export is missing %s (has %v)", name, entries)
+		}
+	}
+	rc, _ := entries["messages.json"].Open()
+	var messages []map[string]interface{}
+	json.NewDecoder(rc).Decode(&messages)
+	rc.Close()
+	if len(messages) != 2 {
+		t.Fatalf("Expected 2 exported messages, got %d", len(messages))
+	}
+	if payload, _ := messages[0]["payload"].(map[string]interface{}); payload["text"] != "hello" {
+		t.Fatalf("Payload should be embedded as JSON, got %v", messages[0]["payload"])
+	}
+
+	// Stored webhook payloads and uploads are scoped to their chat too
+	now := time.Now().Unix()
+	for _, chat := range []string{chatA, chatB} {
+		db.Exec(`INSERT INTO webhook_payloads (id, user_id, webhook_id, payload, created_at) VALUES (?, ?, 'wh', ?, ?)`,
+			"P"+chat[:11], userID, `{"to": "`+chat+`"}`, now)
+		db.Exec(`INSERT INTO webhook_buffer (user_id, webhook_id, payload, created_at) VALUES (?, 'wh', ?, ?)`,
+			userID, `{"event": "reaction", "chat_jid": "`+chat+`"}`, now)
+		upload := filepath.Join("test_media", "upload"+chat[:11])
+		os.WriteFile(upload, []byte("upload"), 0644)
+		db.Exec(`INSERT INTO media_uploads (id, user_id, status, file_path, expires_at) VALUES (?, ?, ?, ?, ?)`,
+			"U"+chat[:11], userID, MEDIA_UPLOAD_COMPLETED, upload, time.Now().Add(time.Hour))
+		dbSetMediaUploadChat("U"+chat[:11], chat)
+	}
+
+	// Deleting a chat needs a confirmation token bound to that chat
+	var pending struct {
+		Token  string           `json:"confirmation_token"`
+		Counts map[string]int64 `json:"counts"`
+	}
+	if resp := session("POST", "/api/user/data/delete", map[string]string{"chat_jid": chatA}, &pending); resp.StatusCode != http.StatusAccepted || pending.Token == "" {
+		t.Fatalf("Expected a confirmation token, got %d", resp.StatusCode)
+	}
+	if pending.Counts["messages"] != 1 || pending.Counts["chat_media"] != 1 || pending.Counts["webhook_payloads"] != 1 ||
+		pending.Counts["webhook_buffer"] != 1 || pending.Counts["media_uploads"] != 1 {
+		t.Fatalf("Unexpected counts: %v", pending.Counts)
+	}
+	if resp := session("POST", "/api/user/data/delete", map[string]string{"chat_jid": chatB, "confirm": pending.Token}, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Token for another chat should be rejected, got %d", resp.StatusCode)
+	}
+	// Tokens are single-use, so ask again
+	session("POST", "/api/user/data/delete", map[string]string{"chat_jid": chatA}, &pending)
+	var deleted struct {
+		Deleted map[string]int64 `json:"deleted"`
+	}
+	if resp := session("POST", "/api/user/data/delete", map[string]string{"chat_jid": chatA, "confirm": pending.Token}, &deleted); resp.StatusCode != 200 {
+		t.Fatalf("Delete chat failed, status: %d", resp.StatusCode)
+	}
+	if deleted.Deleted["messages"] != 1 || deleted.Deleted["webhook_payloads"] != 1 || deleted.Deleted["webhook_buffer"] != 1 || deleted.Deleted["media_uploads"] != 1 {
+		t.Fatalf("Unexpected deleted counts: %v", deleted.Deleted)
+	}
+	if _, err := os.Stat(filepath.Join("test_media", "upload14155550001")); !os.IsNotExist(err) {
+		t.Fatal("Uploads sent to the erased chat should be deleted")
+	}
+	if _, err := os.Stat(filepath.Join("test_media", "upload14155550002")); err != nil {
+		t.Fatal("Uploads sent to other chats should be kept")
+	}
+	if _, err := os.Stat(filepath.Join("test_media", "14155550001.jpg")); !os.IsNotExist(err) {
+		t.Fatal("Media of the erased chat should be deleted")
+	}
+	if _, err := os.Stat(filepath.Join("test_media", "14155550002.jpg")); err != nil {
+		t.Fatal("Media of other chats should be kept")
+	}
+
+	// Erase everything, including payloads buffered for a webhook
+	db.Exec(`INSERT INTO webhook_buffer (user_id, webhook_id, payload, created_at) VALUES (?, 'wh', '{"text": "buffered"}', ?)`, userID, time.Now().Unix())
+	session("POST", "/api/user/data/delete", nil, &pending)
+	if resp := session("POST", "/api/user/data/delete", map[string]string{"confirm": pending.Token}, &deleted); resp.StatusCode != 200 {
+		t.Fatalf("Delete all failed, status: %d", resp.StatusCode)
+	}
+	var remaining int
+	db.QueryRow(`SELECT COUNT(*) FROM messages WHERE user_id = ?`, userID).Scan(&remaining)
+	if remaining != 0 || deleted.Deleted["messages"] != 1 {
+		t.Fatalf("Expected all messages erased, %d left (%v)", remaining, deleted.Deleted)
+	}
+	db.QueryRow(`SELECT COUNT(*) FROM webhook_buffer WHERE user_id = ?`, userID).Scan(&remaining)
+	if remaining != 0 || deleted.Deleted["webhook_buffer"] != 2 {
+		t.Fatalf("Expected buffered payloads erased, %d left (%v)", remaining, deleted.Deleted)
+	}
+	if _, err := getUserIDByEmail(email); err != nil {
+		t.Fatal("The account itself should be kept")
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"io"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/appstate"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// --- WhatsApp client ---
+// Sending, receiving and lookups go through WAClient rather than *whatsmeow.Client, so
+// the queue, webhook and send paths can run against a fake in tests (or another
+// backend). Connecting, pairing and logging out still use the whatsmeow client itself.
+
+type WAClient interface {
+	SendMessage(ctx context.Context, to types.JID, message *waProto.Message, extra ...whatsmeow.SendRequestExtra) (whatsmeow.SendResponse, error)
+	SendChatPresence(jid types.JID, state types.ChatPresence, media types.ChatPresenceMedia) error
+	RevokeMessage(chat types.JID, id types.MessageID) (whatsmeow.SendResponse, error)
+	SendAppState(ctx context.Context, patch appstate.PatchInfo) error
+	UploadReader(ctx context.Context, r io.Reader, tempFile io.ReadWriteSeeker, appInfo whatsmeow.MediaType) (whatsmeow.UploadResponse, error)
+	Download(ctx context.Context, msg whatsmeow.DownloadableMessage) ([]byte, error)
+	GetJoinedGroups() ([]*types.GroupInfo, error)
+	JoinGroupWithLink(code string) (types.JID, error)
+	JoinGroupWithInvite(jid, inviter types.JID, code string, expiration int64) error
+	IsOnWhatsApp(phones []string) ([]types.IsOnWhatsAppResponse, error)
+	// Whether a device is paired, i.e. the stores below belong to an account
+	Paired() bool
+	GetAllContacts(ctx context.Context) (map[types.JID]types.ContactInfo, error)
+	GetPNForLID(ctx context.Context, lid types.JID) (types.JID, error)
+}
+
+// WAClient backed by a real whatsmeow connection
+type whatsmeowClient struct {
+	*whatsmeow.Client
+}
+
+func (c whatsmeowClient) Paired() bool {
+	return c.Store != nil && c.Store.ID != nil
+}
+
+func (c whatsmeowClient) GetAllContacts(ctx context.Context) (map[types.JID]types.ContactInfo, error) {
+	return c.Store.Contacts.GetAllContacts(ctx)
+}
+
+func (c whatsmeowClient) GetPNForLID(ctx context.Context, lid types.JID) (types.JID, error) {
+	if c.Store == nil || c.Store.LIDs == nil {
+		return types.EmptyJID, nil
+	}
+	return c.Store.LIDs.GetPNForLID(ctx, lid)
+}
+
+// The user's WhatsApp client, or nil when not connected; a variable so tests can
+// substitute a fake
+var userWAClient = func(email string) WAClient {
+	state := getUserWAState(email)
+	state.mu.RLock()
+	defer state.mu.RUnlock()
+	if state.waClient == nil {
+		return nil // Not a typed nil, so callers can compare with nil
+	}
+	return whatsmeowClient{state.waClient}
+}
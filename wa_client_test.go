@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/appstate"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+	"google.golang.org/protobuf/proto"
+)
+
+// A WhatsApp client that records what is sent and answers lookups from canned data
+type fakeWAClient struct {
+	mu       sync.Mutex
+	sent     []fakeSentMessage
+	presence []types.ChatPresence
+	revoked  []types.MessageID
+	appState []appstate.PatchInfo
+	uploads  int
+
+	downloads map[string][]byte // Media by direct path
+	groups    []*types.GroupInfo
+	contacts  map[types.JID]types.ContactInfo
+	lids      map[types.JID]types.JID // LID -> phone-number JID
+	onWA      map[string]types.JID    // "+<phone>" -> JID
+	sendErr   error
+}
+
+type fakeSentMessage struct {
+	To      types.JID
+	Message *waProto.Message
+}
+
+func newFakeWAClient() *fakeWAClient {
+	return &fakeWAClient{
+		downloads: map[string][]byte{},
+		contacts:  map[types.JID]types.ContactInfo{},
+		lids:      map[types.JID]types.JID{},
+		onWA:      map[string]types.JID{},
+	}
+}
+
+func (c *fakeWAClient) SendMessage(ctx context.Context, to types.JID, message *waProto.Message, extra ...whatsmeow.SendRequestExtra) (whatsmeow.SendResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sendErr != nil {
+		return whatsmeow.SendResponse{}, c.sendErr
+	}
+	c.sent = append(c.sent, fakeSentMessage{To: to, Message: message})
+	return whatsmeow.SendResponse{ID: types.MessageID("FAKE" + time.Now().Format("150405.000000")), Timestamp: time.Now()}, nil
+}
+
+func (c *fakeWAClient) SendChatPresence(jid types.JID, state types.ChatPresence, media types.ChatPresenceMedia) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.presence = append(c.presence, state)
+	return nil
+}
+
+func (c *fakeWAClient) RevokeMessage(chat types.JID, id types.MessageID) (whatsmeow.SendResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.revoked = append(c.revoked, id)
+	return whatsmeow.SendResponse{ID: id}, nil
+}
+
+func (c *fakeWAClient) SendAppState(ctx context.Context, patch appstate.PatchInfo) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.appState = append(c.appState, patch)
+	return nil
+}
+
+func (c *fakeWAClient) UploadReader(ctx context.Context, r io.Reader, tempFile io.ReadWriteSeeker, appInfo whatsmeow.MediaType) (whatsmeow.UploadResponse, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return whatsmeow.UploadResponse{}, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.uploads++
+	return whatsmeow.UploadResponse{URL: "https://mmg.example.com/fake", DirectPath: "/fake", FileLength: uint64(len(data))}, nil
+}
+
+func (c *fakeWAClient) Download(ctx context.Context, msg whatsmeow.DownloadableMessage) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	data, ok := c.downloads[msg.GetDirectPath()]
+	if !ok {
+		return nil, whatsmeow.ErrMediaDownloadFailedWith404
+	}
+	return data, nil
+}
+
+func (c *fakeWAClient) GetJoinedGroups() ([]*types.GroupInfo, error) {
+	return c.groups, nil
+}
+
+func (c *fakeWAClient) JoinGroupWithLink(code string) (types.JID, error) {
+	return types.NewJID("120363000000000000", types.GroupServer), nil
+}
+
+func (c *fakeWAClient) JoinGroupWithInvite(jid, inviter types.JID, code string, expiration int64) error {
+	return nil
+}
+
+func (c *fakeWAClient) IsOnWhatsApp(phones []string) ([]types.IsOnWhatsAppResponse, error) {
+	var results []types.IsOnWhatsAppResponse
+	for _, phone := range phones {
+		jid, ok := c.onWA[phone]
+		results = append(results, types.IsOnWhatsAppResponse{Query: phone, JID: jid, IsIn: ok})
+	}
+	return results, nil
+}
+
+func (c *fakeWAClient) Paired() bool {
+	return true
+}
+
+func (c *fakeWAClient) GetAllContacts(ctx context.Context) (map[types.JID]types.ContactInfo, error) {
+	return c.contacts, nil
+}
+
+func (c *fakeWAClient) GetPNForLID(ctx context.Context, lid types.JID) (types.JID, error) {
+	return c.lids[lid], nil
+}
+
+func (c *fakeWAClient) sentMessages() []fakeSentMessage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]fakeSentMessage(nil), c.sent...)
+}
+
+// Connect a user to a fake WhatsApp client for the rest of the test
+func useFakeWAClient(t *testing.T, email string) *fakeWAClient {
+	t.Helper()
+	fake := newFakeWAClient()
+	previous := userWAClient
+	userWAClient = func(e string) WAClient {
+		if e == email {
+			return fake
+		}
+		return previous(e)
+	}
+	setUserWAStatus(email, "connected")
+	t.Cleanup(func() {
+		userWAClient = previous
+		waUsers.mu.Lock()
+		delete(waUsers.data, email)
+		waUsers.mu.Unlock()
+	})
+	return fake
+}
+
+func TestSendThroughQueueWithFakeClient(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+
+	email := "fakesend@example.com"
+	_, apiKey := registerWithAPIKey(t, ts, email, "fakesendpass123")
+
+	// Disconnected: nothing can be queued
+	resp := apiRequest(t, "POST", ts.URL+"/api/messages/send", apiKey, map[string]string{"chat_jid": "14155550100@s.whatsapp.net", "message": "hi"}, nil)
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("Expected 503 while disconnected, got %d", resp.StatusCode)
+	}
+
+	fake := useFakeWAClient(t, email)
+	callbacks := make(chan map[string]interface{}, 1)
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		callbacks <- body
+	}))
+	defer callback.Close()
+
+	var queued map[string]interface{}
+	resp = apiRequest(t, "POST", ts.URL+"/api/messages/send", apiKey, map[string]string{
+		"chat_jid": "14155550100@s.whatsapp.net", "message": "hello from the queue", "callback_url": callback.URL,
+	}, &queued)
+	if resp.StatusCode != 200 || queued["queue_id"] == nil {
+		t.Fatalf("Send failed: %d %v", resp.StatusCode, queued)
+	}
+
+	select {
+	case body := <-callbacks:
+		if body["status"] != "sent" || body["queue_id"] != queued["queue_id"] {
+			t.Fatalf("Unexpected callback: %v", body)
+		}
+	case <-time.After(15 * time.Second):
+		t.Fatalf("Timed out waiting for the sent callback")
+	}
+
+	sent := fake.sentMessages()
+	if len(sent) != 1 || sent[0].To.String() != "14155550100@s.whatsapp.net" || sent[0].Message.GetConversation() != "hello from the queue" {
+		t.Fatalf("Unexpected sent messages: %+v", sent)
+	}
+	fake.mu.Lock()
+	presence := fake.presence
+	fake.mu.Unlock()
+	if len(presence) != 2 || presence[0] != types.ChatPresenceComposing || presence[1] != types.ChatPresencePaused {
+		t.Fatalf("Expected typing then paused presence, got %v", presence)
+	}
+}
+
+func TestIncomingMessageWithFakeClient(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+
+	email := "fakereceive@example.com"
+	_, apiKey := registerWithAPIKey(t, ts, email, "fakereceivepass123")
+	fake := useFakeWAClient(t, email)
+
+	received := make(chan map[string]interface{}, 2)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		received <- body
+	}))
+	defer receiver.Close()
+	if resp := apiRequest(t, "POST", ts.URL+"/api/webhooks/create", apiKey, map[string]interface{}{"url": receiver.URL, "method": "POST"}, nil); resp.StatusCode != 200 {
+		t.Fatalf("Create webhook failed, status: %d", resp.StatusCode)
+	}
+
+	mediaDir := t.TempDir()
+	lid := types.NewJID("99887766", types.HiddenUserServer)
+	pn := types.NewJID("14155550101", types.DefaultUserServer)
+	fake.lids[lid] = pn
+	fake.downloads["/v/photo"] = []byte("\xff\xd8\xff fake jpeg")
+
+	info := types.MessageInfo{
+		MessageSource: types.MessageSource{Chat: lid, Sender: lid},
+		ID:            "IN1",
+		PushName:      "Ana",
+		Timestamp:     time.Now(),
+	}
+	handleUserWAEvent(email, &events.Message{Info: info, Message: &waProto.Message{ImageMessage: &waProto.ImageMessage{
+		DirectPath: proto.String("/v/photo"),
+		Mimetype:   proto.String("image/jpeg"),
+		Caption:    proto.String("look"),
+	}}}, mediaDir, "test_whatsmeow_")
+
+	var body map[string]interface{}
+	select {
+	case body = <-received:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Timed out waiting for the webhook")
+	}
+	// The LID is mapped to the phone number through the client
+	if body["from"] != pn.String() || body["from_lid"] != lid.String() || body["type"] != "image" || body["caption"] != "look" {
+		t.Fatalf("Unexpected webhook payload: %v", body)
+	}
+	mediaURL, _ := body["media_url"].(string)
+	if mediaURL == "" {
+		t.Fatalf("Expected a media_url, got %v", body)
+	}
+	data, err := os.ReadFile(mediaDir + "/" + mediaURL[len("/media/"):])
+	if err != nil || string(data) != "\xff\xd8\xff fake jpeg" {
+		t.Fatalf("Stored media mismatch: %q %v", data, err)
+	}
+}
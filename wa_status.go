@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// --- WhatsApp connection status ---
+// waStatus follows the client's own events rather than the result of Connect(), which
+// returns before login finishes and says nothing about later drops:
+// "connecting" → "connected" ⇄ "reconnecting", and "disconnected", "logged_out" or
+// "error" when the session ends. last_error keeps the most recent failure after a
+// later success.
+
+// QR flows restarted automatically after WhatsApp stops sending new codes (about
+// every 2.5 minutes) before the user has to click connect again
+const MAX_QR_RESTARTS = 3
+
+// Mark a user's WhatsApp client as connected; connected_since is kept across reconnects
+// only while the status stays connected
+func markUserWAConnected(email string) {
+	state := getUserWAState(email)
+	state.mu.Lock()
+	if state.waStatus != "connected" {
+		state.connectedSince = time.Now().UTC()
+	}
+	state.waStatus = "connected"
+	state.qrCode = ""
+	state.loginState = "Connected"
+	state.mu.Unlock()
+}
+
+// Set a user's WhatsApp status after the connection ended or failed; message, if set,
+// becomes last_error
+func markUserWADown(email, status, loginState, message string) {
+	state := getUserWAState(email)
+	state.mu.Lock()
+	state.waStatus = status
+	state.loginState = loginState
+	state.connectedSince = time.Time{}
+	if message != "" {
+		state.lastError = message
+		state.lastErrorAt = time.Now().UTC()
+	}
+	state.mu.Unlock()
+}
+
+// Record a failure: status "error", shown as the login state and kept as last_error
+func setUserWAError(email, message string) {
+	markUserWADown(email, "error", message, message)
+}
+
+// Update a user's status from connection events. Events from a client that has since
+// been disconnected or replaced are ignored.
+func handleUserWAStatusEvent(email string, client *whatsmeow.Client, evt interface{}, waSessionPrefix string) {
+	state := getUserWAState(email)
+	state.mu.RLock()
+	current := state.waClient == client
+	state.mu.RUnlock()
+	if !current {
+		return
+	}
+	markUserWASeen(email, time.Now())
+
+	switch v := evt.(type) {
+	case *events.Connected:
+		fmt.Println("INFO: WhatsApp connected for", email)
+		markUserWAConnected(email)
+		go applyPresenceMode(client, email, false)
+		publishQREvent(email, QRStreamEvent{Event: QR_EVENT_CONNECTED})
+	case *events.Disconnected:
+		// whatsmeow reconnects on its own after the server drops the socket
+		fmt.Println("WARNING: WhatsApp connection lost for", email)
+		markUserWADown(email, "reconnecting", "Connection lost, reconnecting...", "Connection lost")
+	case *events.LoggedOut:
+		message := "Logged out from the phone"
+		if v.OnConnect {
+			message = fmt.Sprintf("Logged out: %s", v.Reason)
+		}
+		fmt.Printf("WARNING: WhatsApp logged out for %s: %s\n", email, message)
+		handleUserWALoggedOut(email, waSessionPrefix, message)
+	case *events.StreamReplaced:
+		fmt.Println("WARNING: WhatsApp session replaced for", email)
+		markUserWADown(email, "disconnected", "Disconnected: the session was opened elsewhere", "Session replaced by another connection")
+	case *events.TemporaryBan:
+		setUserWAError(email, v.String())
+	case *events.ConnectFailure:
+		setUserWAError(email, fmt.Sprintf("Connection failed: %s %s", v.Reason, v.Message))
+	case *events.ClientOutdated:
+		setUserWAError(email, "Connection failed: client outdated")
+	}
+}
+
+// The phone unlinked the device (whatsmeow has already deleted its keys): drop the dead
+// client and the session, and tell the user to link WhatsApp again
+func handleUserWALoggedOut(email, waSessionPrefix, message string) {
+	if client := detachUserWAClient(email); client != nil {
+		client.Disconnect()
+	}
+	deleteUserDevice(email, waSessionPrefix)
+	markUserWADown(email, "logged_out", "WhatsApp was unlinked from the phone. Connect again and scan a new QR code.", message)
+	updateUserQRCode(email, "")
+
+	emitWebhookEvent(email, EVENT_SESSION_LOGGED_OUT, "", map[string]interface{}{"reason": message})
+	if emailConfigured() {
+		body := fmt.Sprintf("Hi,\n\nWhatsApp was unlinked from your dashboard account (%s), so messages are no longer received or sent.\n\nLog in to the dashboard and connect WhatsApp again to scan a new QR code.", message)
+		if err := sendEmail(email, "WhatsApp disconnected", body); err != nil {
+			fmt.Printf("ERROR: Could not notify %s of the logout by email: %v\n", email, err)
+		}
+	}
+}
+
+// Show a new QR code, valid until WhatsApp rotates it
+func showUserQRCode(email, code string, timeout time.Duration) {
+	state := getUserWAState(email)
+	state.mu.Lock()
+	state.qrCode = code
+	state.qrExpiresAt = time.Now().Add(timeout).UTC()
+	state.qrAttempt++
+	state.waStatus = "waiting_qr"
+	state.loginState = "Waiting for QR code scan..."
+	evt := QRStreamEvent{Event: QR_EVENT_CODE, Code: code, ExpiresAt: state.qrExpiresAt.Format(time.RFC3339), Attempt: state.qrAttempt}
+	state.mu.Unlock()
+	publishQREvent(email, evt)
+}
+
+// Start counting QR codes and restarts over, when the user asks to connect
+func resetUserQR(email string) {
+	state := getUserWAState(email)
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	state.qrAttempt = 0
+	state.qrRestarts = 0
+}
+
+// The QR channel ran out of codes and whatsmeow disconnected client. Drops the client
+// and reports whether to start a new QR flow; after MAX_QR_RESTARTS the user has to
+// connect again. Does nothing if the user disconnected in the meantime.
+func expireUserQR(email string, client *whatsmeow.Client) bool {
+	state := getUserWAState(email)
+	state.mu.Lock()
+	if state.waClient != client {
+		state.mu.Unlock()
+		return false
+	}
+	if state.waCancel != nil {
+		state.waCancel()
+		state.waCancel = nil
+	}
+	state.waClient = nil
+	state.qrCode = ""
+	state.qrExpiresAt = time.Time{}
+	restart := state.qrRestarts < MAX_QR_RESTARTS
+	if restart {
+		state.qrRestarts++
+	}
+	state.mu.Unlock()
+
+	publishQREvent(email, QRStreamEvent{Event: QR_EVENT_TIMEOUT, Restarting: restart})
+	if restart {
+		fmt.Println("INFO: QR codes expired, restarting the QR flow for", email)
+	} else {
+		markUserWADown(email, "disconnected", "QR code timed out. Please try again.", "")
+	}
+	return restart
+}
+
+// Status fields for /api/wa/status
+func userWAStatusResponse(email string) map[string]interface{} {
+	state := getUserWAState(email)
+	state.mu.RLock()
+	defer state.mu.RUnlock()
+	resp := map[string]interface{}{
+		"status":     state.waStatus,
+		"qr":         state.qrCode,
+		"loginState": state.loginState,
+	}
+	if state.qrCode != "" && !state.qrExpiresAt.IsZero() {
+		resp["qr_expires_at"] = state.qrExpiresAt.Format(time.RFC3339)
+	}
+	if state.qrAttempt > 0 {
+		resp["qr_attempt"] = state.qrAttempt
+	}
+	if !state.connectedSince.IsZero() {
+		resp["connected_since"] = state.connectedSince.Format(time.RFC3339)
+	}
+	if !state.lastSeenAt.IsZero() {
+		resp["last_seen_at"] = state.lastSeenAt.UTC().Format(time.RFC3339)
+	}
+	if state.waStatus == "logged_out" {
+		resp["relink_required"] = true
+	}
+	if state.lastError != "" {
+		resp["last_error"] = state.lastError
+		resp["last_error_at"] = state.lastErrorAt.Format(time.RFC3339)
+	}
+	if sync := getContactSync(email); sync != nil {
+		resp["contact_sync"] = sync
+	}
+	return resp
+}
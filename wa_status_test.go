@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/store/sqlstore"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+func TestWAStatusEvents(t *testing.T) {
+	container, err := sqlstore.New(context.Background(), "sqlite", "file:wa_status_test?mode=memory&_pragma=foreign_keys(1)", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer container.Close()
+	client := whatsmeow.NewClient(container.NewDevice(), nil)
+
+	email := "status@example.com"
+	state := getUserWAState(email)
+	state.mu.Lock()
+	state.waClient = client
+	state.waStatus = "connecting"
+	state.mu.Unlock()
+	defer func() {
+		waUsers.mu.Lock()
+		delete(waUsers.data, email)
+		waUsers.mu.Unlock()
+	}()
+
+	handleUserWAStatusEvent(email, client, &events.Connected{}, "test_whatsmeow_")
+	resp := userWAStatusResponse(email)
+	since := resp["connected_since"]
+	if resp["status"] != "connected" || since == nil || resp["last_error"] != nil {
+		t.Fatalf("Expected connected with connected_since, got %v", resp)
+	}
+	if !isUserWAConnected(email) {
+		t.Fatalf("Expected sends to see the client as connected")
+	}
+
+	// A dropped socket is reported until whatsmeow reconnects
+	handleUserWAStatusEvent(email, client, &events.Disconnected{}, "test_whatsmeow_")
+	resp = userWAStatusResponse(email)
+	if resp["status"] != "reconnecting" || resp["connected_since"] != nil || resp["last_error"] != "Connection lost" {
+		t.Fatalf("Expected reconnecting, got %v", resp)
+	}
+	if isUserWAConnected(email) {
+		t.Fatalf("Expected sends to wait while reconnecting")
+	}
+	handleUserWAStatusEvent(email, client, &events.Connected{}, "test_whatsmeow_")
+	if resp = userWAStatusResponse(email); resp["status"] != "connected" || resp["last_error"] != "Connection lost" {
+		t.Fatalf("Expected connected with the last error kept, got %v", resp)
+	}
+
+	// Events from a client that is no longer the user's are ignored
+	other := whatsmeow.NewClient(container.NewDevice(), nil)
+	handleUserWAStatusEvent(email, other, &events.StreamReplaced{}, "test_whatsmeow_")
+	if status := getUserWAStatus(email); status != "connected" {
+		t.Fatalf("Expected a stale client's event to be ignored, got %s", status)
+	}
+
+	handleUserWAStatusEvent(email, client, &events.StreamReplaced{}, "test_whatsmeow_")
+	if resp = userWAStatusResponse(email); resp["status"] != "disconnected" || resp["last_error"] != "Session replaced by another connection" {
+		t.Fatalf("Expected disconnected after the stream was replaced, got %v", resp)
+	}
+}
+
+func TestWALoggedOut(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+	dir := useTestWAStore(t, WA_STORE_PER_USER)
+
+	email := "unlinked@example.com"
+	_, apiKey := registerWithAPIKey(t, ts, email, "unlinkedpass123")
+	sessionFile := filepath.Join(dir, "test_whatsmeow_"+email+".db")
+	writeTestSession(t, sessionFile, types.NewJID("14155550127", types.DefaultUserServer))
+
+	received := make(chan map[string]interface{}, 5)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&payload)
+		received <- payload
+	}))
+	defer receiver.Close()
+	apiRequest(t, "POST", ts.URL+"/api/webhooks/create", apiKey, map[string]interface{}{
+		"url": receiver.URL, "method": "POST", "events": []string{EVENT_SESSION_LOGGED_OUT},
+	}, nil)
+
+	mails := make(chan string, 5)
+	t.Setenv("SMTP_HOST", "smtp.example.com")
+	sendEmail = func(to, subject, body string) error {
+		mails <- to
+		return nil
+	}
+	defer func() { sendEmail = defaultSendEmail }()
+
+	container, err := sqlstore.New(context.Background(), "sqlite", "file:wa_logged_out_test?mode=memory&_pragma=foreign_keys(1)", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer container.Close()
+	client := whatsmeow.NewClient(container.NewDevice(), nil)
+	state := getUserWAState(email)
+	state.mu.Lock()
+	state.waClient = client
+	state.waStatus = "connected"
+	state.mu.Unlock()
+	defer func() {
+		waUsers.mu.Lock()
+		delete(waUsers.data, email)
+		waUsers.mu.Unlock()
+	}()
+
+	handleUserWAStatusEvent(email, client, &events.LoggedOut{}, "test_whatsmeow_")
+
+	resp := userWAStatusResponse(email)
+	if resp["status"] != "logged_out" || resp["relink_required"] != true || resp["last_error"] != "Logged out from the phone" {
+		t.Fatalf("Expected a relink prompt, got %v", resp)
+	}
+	state.mu.RLock()
+	detached := state.waClient == nil
+	state.mu.RUnlock()
+	if !detached {
+		t.Fatalf("Expected the dead client to be dropped")
+	}
+	if _, err := os.Stat(sessionFile); !os.IsNotExist(err) {
+		t.Fatalf("Expected the session file to be deleted: %v", err)
+	}
+	select {
+	case payload := <-received:
+		if payload["event"] != EVENT_SESSION_LOGGED_OUT || payload["reason"] != "Logged out from the phone" {
+			t.Fatalf("Unexpected event payload: %v", payload)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Expected a %s webhook event", EVENT_SESSION_LOGGED_OUT)
+	}
+	select {
+	case to := <-mails:
+		if to != email {
+			t.Fatalf("Expected the email to go to %s, got %s", email, to)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Expected an email notification")
+	}
+}
+
+func TestQRExpiry(t *testing.T) {
+	container, err := sqlstore.New(context.Background(), "sqlite", "file:wa_qr_test?mode=memory&_pragma=foreign_keys(1)", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer container.Close()
+
+	email := "qr@example.com"
+	defer func() {
+		waUsers.mu.Lock()
+		delete(waUsers.data, email)
+		waUsers.mu.Unlock()
+	}()
+	resetUserQR(email)
+
+	// Codes keep counting across restarts of the QR flow
+	for restart := 1; restart <= MAX_QR_RESTARTS+1; restart++ {
+		client := whatsmeow.NewClient(container.NewDevice(), nil)
+		state := getUserWAState(email)
+		state.mu.Lock()
+		state.waClient = client
+		state.mu.Unlock()
+
+		showUserQRCode(email, "code", 20*time.Second)
+		resp := userWAStatusResponse(email)
+		expires, err := time.Parse(time.RFC3339, fmt.Sprint(resp["qr_expires_at"]))
+		if resp["status"] != "waiting_qr" || resp["qr_attempt"] != restart || err != nil || time.Until(expires) > 21*time.Second {
+			t.Fatalf("Expected QR code %d with its expiry, got %v", restart, resp)
+		}
+
+		if restarted := expireUserQR(email, client); restarted != (restart <= MAX_QR_RESTARTS) {
+			t.Fatalf("Restart %d: expected restarting to be %v", restart, !restarted)
+		}
+		if resp = userWAStatusResponse(email); resp["qr"] != "" || resp["qr_expires_at"] != nil {
+			t.Fatalf("Expected the expired code to be cleared, got %v", resp)
+		}
+	}
+	if resp := userWAStatusResponse(email); resp["status"] != "disconnected" {
+		t.Fatalf("Expected disconnected after the last restart, got %v", resp)
+	}
+
+	// Connecting again starts over
+	resetUserQR(email)
+	showUserQRCode(email, "code", 20*time.Second)
+	if resp := userWAStatusResponse(email); resp["qr_attempt"] != 1 {
+		t.Fatalf("Expected the count to start over, got %v", resp)
+	}
+}
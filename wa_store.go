@@ -0,0 +1,368 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mau.fi/whatsmeow/store"
+	"go.mau.fi/whatsmeow/store/sqlstore"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// --- WhatsApp device store ---
+// By default each user's WhatsApp session is its own sessions/<prefix><email>.db. With
+// WA_STORE=shared all devices live in one whatsmeow container at WA_STORE_PATH, and with
+// WA_STORE=main in the dashboard DB, keyed by device JID. wa_devices maps each user to
+// their device. `migrate-sessions` copies existing per-user files into the shared store.
+
+const (
+	WA_STORE_PER_USER = "per_user"
+	WA_STORE_SHARED   = "shared"
+	WA_STORE_MAIN     = "main"
+
+	DEFAULT_WA_STORE_PATH = "sessions/whatsmeow.db"
+)
+
+var (
+	waStoreMode   = WA_STORE_PER_USER
+	waStorePath   = "" // SQLite file of the shared container
+	waSessionsDir = "sessions"
+
+	sharedContainer   *sqlstore.Container
+	sharedContainerMu sync.Mutex
+)
+
+// Read WA_STORE and WA_STORE_PATH; dbPath is the dashboard DB, used by WA_STORE=main
+func initWAStore(dbPath string) error {
+	sharedContainerMu.Lock()
+	defer sharedContainerMu.Unlock()
+	if sharedContainer != nil {
+		sharedContainer.Close()
+		sharedContainer = nil
+	}
+	waStoreMode = getEnv("WA_STORE", WA_STORE_PER_USER)
+	switch waStoreMode {
+	case WA_STORE_PER_USER:
+		waStorePath = ""
+	case WA_STORE_SHARED:
+		waStorePath = getEnv("WA_STORE_PATH", DEFAULT_WA_STORE_PATH)
+	case WA_STORE_MAIN:
+		waStorePath = dbPath
+	default:
+		return fmt.Errorf("WA_STORE must be %q, %q or %q", WA_STORE_PER_USER, WA_STORE_SHARED, WA_STORE_MAIN)
+	}
+	if waStorePath != "" {
+		fmt.Printf("INFO: WhatsApp devices are stored in %s\n", waStorePath)
+	}
+	return nil
+}
+
+func sessionFilePath(email, waSessionPrefix string) string {
+	return filepath.Join(waSessionsDir, waSessionPrefix+email+".db")
+}
+
+func sqliteStoreAddress(file string) string {
+	return fmt.Sprintf("file:%s?mode=rwc&_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)", file)
+}
+
+// The shared container, opened (and its schema upgraded) on first use
+func getSharedContainer(ctx context.Context) (*sqlstore.Container, error) {
+	sharedContainerMu.Lock()
+	defer sharedContainerMu.Unlock()
+	if sharedContainer != nil {
+		return sharedContainer, nil
+	}
+	if dir := filepath.Dir(waStorePath); dir != "." {
+		os.MkdirAll(dir, 0755)
+	}
+	// A separate connection pool even for WA_STORE=main: whatsmeow relies on foreign
+	// keys to clean up a deleted device's keys and sessions
+	container, err := sqlstore.New(ctx, "sqlite", sqliteStoreAddress(waStorePath), nil)
+	if err != nil {
+		return nil, err
+	}
+	sharedContainer = container
+	return container, nil
+}
+
+func dbGetUserDeviceJID(userID int64) (types.JID, bool, error) {
+	var jid string
+	err := db.QueryRow(`SELECT jid FROM wa_devices WHERE user_id = ?`, userID).Scan(&jid)
+	if err == sql.ErrNoRows {
+		return types.EmptyJID, false, nil
+	} else if err != nil {
+		return types.EmptyJID, false, err
+	}
+	parsed, err := types.ParseJID(jid)
+	if err != nil {
+		return types.EmptyJID, false, err
+	}
+	return parsed, true, nil
+}
+
+func dbSetUserDeviceJID(userID int64, jid types.JID) error {
+	_, err := db.Exec(`INSERT INTO wa_devices (user_id, jid, updated_at) VALUES (?, ?, ?)
+		ON CONFLICT(user_id) DO UPDATE SET jid = excluded.jid, updated_at = excluded.updated_at`,
+		userID, jid.String(), time.Now().UTC().Format(time.RFC3339))
+	return err
+}
+
+func dbDeleteUserDeviceJID(userID int64) error {
+	_, err := db.Exec(`DELETE FROM wa_devices WHERE user_id = ?`, userID)
+	return err
+}
+
+// The user's WhatsApp device, or a new unpaired one if they have none yet
+func getUserDevice(ctx context.Context, email, waSessionPrefix string) (*store.Device, error) {
+	if waStoreMode == WA_STORE_PER_USER {
+		os.MkdirAll(waSessionsDir, 0755)
+		sessionFile := sessionFilePath(email, waSessionPrefix)
+		fmt.Println("DEBUG: Using session file:", sessionFile)
+		container, err := sqlstore.New(ctx, "sqlite", fmt.Sprintf("file:%s?mode=rwc&_pragma=foreign_keys(1)", sessionFile), nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create store: %w", err)
+		}
+		deviceStore, err := container.GetFirstDevice(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get device: %w", err)
+		}
+		return deviceStore, nil
+	}
+
+	container, err := getSharedContainer(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create store: %w", err)
+	}
+	userID, err := getUserIDByEmail(email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get device: %w", err)
+	}
+	jid, ok, err := dbGetUserDeviceJID(userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get device: %w", err)
+	}
+	if ok {
+		deviceStore, err := container.GetDevice(ctx, jid)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get device: %w", err)
+		}
+		if deviceStore != nil {
+			return deviceStore, nil
+		}
+		fmt.Printf("WARNING: Device %s of %s is missing from the store, pairing again\n", jid, email)
+	}
+	return container.NewDevice(), nil
+}
+
+// Remember the device a user paired, so it is found again in the shared store
+func rememberUserDevice(email string, jid types.JID) {
+	if waStoreMode == WA_STORE_PER_USER {
+		return
+	}
+	userID, err := getUserIDByEmail(email)
+	if err != nil {
+		return
+	}
+	if err := dbSetUserDeviceJID(userID, jid); err != nil {
+		fmt.Printf("ERROR: Could not save device %s for %s: %v\n", jid, email, err)
+		return
+	}
+	fmt.Printf("INFO: Device %s paired for %s\n", jid, email)
+}
+
+// Remove a user's WhatsApp session: the session file, or their device in the shared store
+func deleteUserDevice(email, waSessionPrefix string) {
+	if waStoreMode == WA_STORE_PER_USER {
+		os.Remove(sessionFilePath(email, waSessionPrefix))
+		return
+	}
+	userID, err := getUserIDByEmail(email)
+	if err != nil {
+		return
+	}
+	jid, ok, err := dbGetUserDeviceJID(userID)
+	if err != nil || !ok {
+		return
+	}
+	ctx := context.Background()
+	if container, err := getSharedContainer(ctx); err == nil {
+		if deviceStore, err := container.GetDevice(ctx, jid); err == nil && deviceStore != nil {
+			if err := deviceStore.Delete(ctx); err != nil {
+				fmt.Printf("ERROR: Could not delete device %s of %s: %v\n", jid, email, err)
+			}
+		}
+	}
+	dbDeleteUserDeviceJID(userID)
+}
+
+// Move a user's session file to their new email (the shared store is keyed by user ID)
+func renameUserDevice(oldEmail, newEmail, waSessionPrefix string) error {
+	if waStoreMode != WA_STORE_PER_USER {
+		return nil
+	}
+	err := os.Rename(sessionFilePath(oldEmail, waSessionPrefix), sessionFilePath(newEmail, waSessionPrefix))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Result of migrating one per-user session file
+type sessionMigration struct {
+	File   string
+	Email  string
+	JID    string
+	Status string // "migrated", or why the file was skipped
+}
+
+// Copy every per-user session file into the shared store and map its user to the
+// device. Migrated files are renamed to *.migrated; files of unknown users, unpaired
+// sessions and users who already have a device in the shared store are left alone.
+func migrateWASessions(waSessionPrefix string) ([]sessionMigration, error) {
+	if waStoreMode == WA_STORE_PER_USER {
+		return nil, fmt.Errorf("set WA_STORE to %q or %q before migrating", WA_STORE_SHARED, WA_STORE_MAIN)
+	}
+	ctx := context.Background()
+	// Creates the whatsmeow tables in the shared store
+	if _, err := getSharedContainer(ctx); err != nil {
+		return nil, err
+	}
+	files, err := filepath.Glob(filepath.Join(waSessionsDir, waSessionPrefix+"*.db"))
+	if err != nil {
+		return nil, err
+	}
+	shared, err := filepath.Abs(waStorePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []sessionMigration
+	for _, file := range files {
+		if abs, _ := filepath.Abs(file); abs == shared {
+			continue
+		}
+		result := sessionMigration{File: file, Email: strings.TrimSuffix(strings.TrimPrefix(filepath.Base(file), waSessionPrefix), ".db")}
+		result.JID, result.Status = migrateSessionFile(ctx, file, result.Email)
+		if result.Status == "migrated" {
+			if err := os.Rename(file, file+".migrated"); err != nil {
+				fmt.Printf("WARNING: Could not rename %s: %v\n", file, err)
+			}
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func migrateSessionFile(ctx context.Context, file, email string) (string, string) {
+	userID, err := getUserIDByEmail(email)
+	if err != nil {
+		return "", "skipped: no such user"
+	}
+	if _, ok, err := dbGetUserDeviceJID(userID); err != nil {
+		return "", "failed: " + err.Error()
+	} else if ok {
+		return "", "skipped: user already has a device in the shared store"
+	}
+
+	// Opening the file through whatsmeow brings its schema up to date first
+	container, err := sqlstore.New(ctx, "sqlite", sqliteStoreAddress(file), nil)
+	if err != nil {
+		return "", "failed: " + err.Error()
+	}
+	deviceStore, err := container.GetFirstDevice(ctx)
+	container.Close()
+	if err != nil {
+		return "", "failed: " + err.Error()
+	}
+	if deviceStore.ID == nil {
+		return "", "skipped: never paired"
+	}
+	jid := *deviceStore.ID
+
+	if err := copyWhatsmeowTables(ctx, file); err != nil {
+		return jid.String(), "failed: " + err.Error()
+	}
+	if err := dbSetUserDeviceJID(userID, jid); err != nil {
+		return jid.String(), "failed: " + err.Error()
+	}
+	return jid.String(), "migrated"
+}
+
+// Copy all whatsmeow rows from a session file into the shared store. Rows that are
+// already there (e.g. shared LID mappings) are kept.
+func copyWhatsmeowTables(ctx context.Context, file string) error {
+	target, err := sql.Open("sqlite", sqliteStoreAddress(waStorePath))
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+	// ATTACH only applies to one connection
+	conn, err := target.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, `ATTACH DATABASE ? AS src`, file); err != nil {
+		return err
+	}
+	defer conn.ExecContext(ctx, `DETACH DATABASE src`)
+
+	rows, err := conn.QueryContext(ctx, `SELECT name FROM src.sqlite_master WHERE type = 'table' AND name LIKE 'whatsmeow\_%' ESCAPE '\' AND name != 'whatsmeow_version'`)
+	if err != nil {
+		return err
+	}
+	var tables []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		tables = append(tables, name)
+	}
+	rows.Close()
+	// Devices first: the other tables reference them
+	sort.SliceStable(tables, func(i, j int) bool { return tables[i] == "whatsmeow_device" && tables[j] != "whatsmeow_device" })
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, table := range tables {
+		columns, err := tableColumns(ctx, tx, table)
+		if err != nil {
+			return err
+		}
+		list := `"` + strings.Join(columns, `", "`) + `"`
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf(`INSERT OR IGNORE INTO main."%s" (%s) SELECT %s FROM src."%s"`, table, list, list, table)); err != nil {
+			return fmt.Errorf("%s: %w", table, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// Column names of a table in the attached session file
+func tableColumns(ctx context.Context, tx *sql.Tx, table string) ([]string, error) {
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf(`SELECT name FROM pragma_table_info('%s', 'src')`, table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var columns []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		columns = append(columns, name)
+	}
+	return columns, rows.Err()
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.mau.fi/whatsmeow/proto/waAdv"
+	"go.mau.fi/whatsmeow/store/sqlstore"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// Point the WhatsApp store at a temporary directory for one test
+func useTestWAStore(t *testing.T, mode string) string {
+	dir := t.TempDir()
+	oldDir := waSessionsDir
+	waSessionsDir = dir
+	t.Setenv("WA_STORE", mode)
+	t.Setenv("WA_STORE_PATH", filepath.Join(dir, "shared.db"))
+	if err := initWAStore("unused.db"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		waSessionsDir = oldDir
+		os.Unsetenv("WA_STORE")
+		initWAStore("")
+	})
+	return dir
+}
+
+// Placeholder account details for a fake paired device
+func testDeviceAccount() *waAdv.ADVSignedDeviceIdentity {
+	return &waAdv.ADVSignedDeviceIdentity{Details: []byte{1}, AccountSignature: make([]byte, 64), AccountSignatureKey: make([]byte, 32), DeviceSignature: make([]byte, 64)}
+}
+
+// Write a paired per-user session file
+func writeTestSession(t *testing.T, file string, jid types.JID) uint32 {
+	ctx := context.Background()
+	container, err := sqlstore.New(ctx, "sqlite", sqliteStoreAddress(file), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer container.Close()
+	device := container.NewDevice()
+	device.ID = &jid
+	device.Account = testDeviceAccount()
+	if err := container.PutDevice(ctx, device); err != nil {
+		t.Fatal(err)
+	}
+	return device.RegistrationID
+}
+
+func TestSharedWAStore(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+	useTestWAStore(t, WA_STORE_SHARED)
+
+	email := "device@example.com"
+	registerWithAPIKey(t, ts, email, "devicepass123")
+	userID, _ := getUserIDByEmail(email)
+	ctx := context.Background()
+
+	// No device yet: a new, unpaired one
+	device, err := getUserDevice(ctx, email, "test_whatsmeow_")
+	if err != nil || device.ID != nil {
+		t.Fatalf("Expected a new device, got %+v, %v", device, err)
+	}
+
+	// Once paired, the user gets their own device back
+	jid := types.NewJID("14155550123", types.DefaultUserServer)
+	device.ID = &jid
+	device.Account = testDeviceAccount()
+	if err := device.Save(ctx); err != nil {
+		t.Fatal(err)
+	}
+	rememberUserDevice(email, jid)
+	device, err = getUserDevice(ctx, email, "test_whatsmeow_")
+	if err != nil || device.ID == nil || *device.ID != jid {
+		t.Fatalf("Expected device %s, got %+v, %v", jid, device, err)
+	}
+
+	deleteUserDevice(email, "test_whatsmeow_")
+	if _, ok, _ := dbGetUserDeviceJID(userID); ok {
+		t.Fatalf("Expected the device mapping to be removed")
+	}
+	container, _ := getSharedContainer(ctx)
+	if stored, _ := container.GetDevice(ctx, jid); stored != nil {
+		t.Fatalf("Expected the device to be deleted from the store")
+	}
+}
+
+func TestMigrateWASessions(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+	dir := useTestWAStore(t, WA_STORE_PER_USER)
+
+	prefix := "test_whatsmeow_"
+	email := "migrate@example.com"
+	registerWithAPIKey(t, ts, email, "migratepass123")
+	userID, _ := getUserIDByEmail(email)
+	jid := types.NewJID("14155550124", types.DefaultUserServer)
+	registrationID := writeTestSession(t, filepath.Join(dir, prefix+email+".db"), jid)
+	writeTestSession(t, filepath.Join(dir, prefix+"nobody@example.com.db"), types.NewJID("14155550125", types.DefaultUserServer))
+
+	if _, err := migrateWASessions(prefix); err == nil {
+		t.Fatalf("Expected migrating without a shared store to fail")
+	}
+
+	t.Setenv("WA_STORE", WA_STORE_SHARED)
+	initWAStore("unused.db")
+	results, err := migrateWASessions(prefix)
+	if err != nil || len(results) != 2 {
+		t.Fatalf("Expected 2 results, got %+v, %v", results, err)
+	}
+	statuses := map[string]string{}
+	for _, result := range results {
+		statuses[result.Email] = result.Status
+	}
+	if statuses[email] != "migrated" || statuses["nobody@example.com"] != "skipped: no such user" {
+		t.Fatalf("Unexpected results: %+v", results)
+	}
+	if _, err := os.Stat(filepath.Join(dir, prefix+email+".db.migrated")); err != nil {
+		t.Fatalf("Expected the migrated file to be renamed: %v", err)
+	}
+	if mapped, ok, _ := dbGetUserDeviceJID(userID); !ok || mapped != jid {
+		t.Fatalf("Expected user mapped to %s, got %s", jid, mapped)
+	}
+	device, err := getUserDevice(context.Background(), email, prefix)
+	if err != nil || device.ID == nil || *device.ID != jid || device.RegistrationID != registrationID {
+		t.Fatalf("Expected the migrated device, got %+v, %v", device, err)
+	}
+
+	// Running again leaves everything alone
+	if results, _ := migrateWASessions(prefix); len(results) != 1 || results[0].Email != "nobody@example.com" {
+		t.Fatalf("Expected only the unknown user's file on a second run, got %+v", results)
+	}
+}
+
+func TestDisconnectKeepsSession(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+	dir := useTestWAStore(t, WA_STORE_PER_USER)
+
+	email := "logout@example.com"
+	cookies, _ := registerWithAPIKey(t, ts, email, "logoutpass123")
+	post := func(path string, out interface{}) *http.Response {
+		req, _ := http.NewRequest("POST", ts.URL+path, nil)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if out != nil {
+			json.NewDecoder(resp.Body).Decode(out)
+		}
+		return resp
+	}
+	sessionFile := filepath.Join(dir, "test_whatsmeow_"+email+".db")
+
+	writeTestSession(t, sessionFile, types.NewJID("14155550126", types.DefaultUserServer))
+	if resp := post("/api/wa/disconnect", nil); resp.StatusCode != 200 {
+		t.Fatalf("Disconnect failed, status %d", resp.StatusCode)
+	}
+	if _, err := os.Stat(sessionFile); err != nil {
+		t.Fatalf("Expected disconnect to keep the session file: %v", err)
+	}
+	os.Remove(sessionFile)
+
+	// An unpaired session needs no unlinking; its file is removed
+	container, err := sqlstore.New(context.Background(), "sqlite", sqliteStoreAddress(sessionFile), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	container.Close()
+	var result map[string]interface{}
+	if resp := post("/api/wa/logout", &result); resp.StatusCode != 200 || result["status"] != "logged_out" || result["warning"] != nil {
+		t.Fatalf("Unexpected logout response %d %v", resp.StatusCode, result)
+	}
+	if _, err := os.Stat(sessionFile); !os.IsNotExist(err) {
+		t.Fatalf("Expected logout to delete the session file: %v", err)
+	}
+	if status := getUserWAStatus(email); status != "disconnected" {
+		t.Fatalf("Expected status disconnected, got %s", status)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// --- Multi-URL webhook delivery ---
+// A webhook delivers to its URL followed by any extra URLs, according to its policy:
+//   - "all": every URL receives the message (e.g. mirroring to a staging receiver)
+//   - "first-success": URLs are tried in order for each message until one succeeds
+//   - "failover": like first-success, but after a failure the backup stays active
+//     and the primary is only retried once FAILOVER_RETRY_PRIMARY has passed
+
+const (
+	DELIVERY_ALL           = "all"
+	DELIVERY_FIRST_SUCCESS = "first-success"
+	DELIVERY_FAILOVER      = "failover"
+	FAILOVER_RETRY_PRIMARY = 5 * time.Minute
+)
+
+type failoverState struct {
+	active int       // Index of the destination currently in use
+	since  time.Time // When we failed over to it
+}
+
+var webhookFailover = struct {
+	sync.Mutex
+	state map[string]failoverState
+}{state: make(map[string]failoverState)}
+
+// All destinations of a webhook, in order
+func webhookDestinations(wh Webhook) []string {
+	return append([]string{wh.URL}, wh.URLs...)
+}
+
+// Deliver a payload to a webhook's destinations according to its delivery policy.
+// Returns the response body of the destination that handled it (the first
+// successful one for "all"), or nil if none succeeded.
+func deliverWebhook(wh Webhook, payload map[string]interface{}) ([]byte, error) {
+	body, _, err := deliverWebhookCapture(wh, payload)
+	return body, err
+}
+
+// deliverWebhook, also returning what each destination tried answered
+func deliverWebhookCapture(wh Webhook, payload map[string]interface{}) ([]byte, []WebhookResponse, error) {
+	urls := webhookDestinations(wh)
+
+	switch wh.Policy {
+	case DELIVERY_FIRST_SUCCESS:
+		_, body, responses, err := deliverInOrder(wh, payload, urls, 0)
+		return body, responses, err
+	case DELIVERY_FAILOVER:
+		start := failoverStart(wh.ID, len(urls))
+		used, body, responses, err := deliverInOrder(wh, payload, urls, start)
+		if err == nil && used != start {
+			webhookFailover.Lock()
+			if used == 0 {
+				delete(webhookFailover.state, wh.ID)
+			} else {
+				webhookFailover.state[wh.ID] = failoverState{active: used, since: time.Now()}
+			}
+			webhookFailover.Unlock()
+			fmt.Printf("WARNING: Webhook %s switched to destination %d\n", wh.ID, used+1)
+		}
+		return body, responses, err
+	}
+
+	var errs []error
+	var firstBody []byte
+	responses := make([]WebhookResponse, 0, len(urls))
+	for i, u := range urls {
+		body, response, err := sendWebhookCapture(wh, payload, u, wh.Method, i)
+		responses = append(responses, response)
+		if err != nil {
+			errs = append(errs, err)
+		} else if firstBody == nil {
+			firstBody = body
+		}
+	}
+	return firstBody, responses, errors.Join(errs...)
+}
+
+// Try destinations in order, starting at start and wrapping around to the ones
+// before it; returns the index and response body of the destination that succeeded,
+// and the answers of those tried
+func deliverInOrder(wh Webhook, payload map[string]interface{}, urls []string, start int) (int, []byte, []WebhookResponse, error) {
+	var errs []error
+	var responses []WebhookResponse
+	for n := 0; n < len(urls); n++ {
+		i := (start + n) % len(urls)
+		body, response, err := sendWebhookCapture(wh, payload, urls[i], wh.Method, i)
+		responses = append(responses, response)
+		if err == nil {
+			return i, body, responses, nil
+		}
+		fmt.Printf("WARNING: Webhook %s destination %d failed: %v\n", wh.ID, i+1, err)
+		errs = append(errs, err)
+	}
+	return -1, nil, responses, errors.Join(errs...)
+}
+
+// Destination to start from for a failover webhook
+func failoverStart(webhookID string, count int) int {
+	webhookFailover.Lock()
+	defer webhookFailover.Unlock()
+	st, ok := webhookFailover.state[webhookID]
+	if !ok || st.active >= count || time.Since(st.since) >= FAILOVER_RETRY_PRIMARY {
+		delete(webhookFailover.state, webhookID)
+		return 0
+	}
+	return st.active
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// Receiver counting its hits and answering with the given status
+func countingReceiver(status *int32) (*httptest.Server, *int32) {
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.WriteHeader(int(atomic.LoadInt32(status)))
+	}))
+	return srv, &hits
+}
+
+func TestDeliverWebhookPolicies(t *testing.T) {
+	primaryStatus, backupStatus := int32(500), int32(200)
+	primary, primaryHits := countingReceiver(&primaryStatus)
+	defer primary.Close()
+	backup, backupHits := countingReceiver(&backupStatus)
+	defer backup.Close()
+
+	payload := map[string]interface{}{"text": "hi"}
+	reset := func() {
+		atomic.StoreInt32(primaryHits, 0)
+		atomic.StoreInt32(backupHits, 0)
+	}
+
+	// all: every destination gets the message; a failing one is reported
+	wh := Webhook{ID: "wh_all", URL: primary.URL, URLs: []string{backup.URL}, Method: "POST", Policy: DELIVERY_ALL}
+	if _, err := deliverWebhook(wh, payload); err == nil {
+		t.Fatalf("Expected error for failing destination")
+	}
+	if *primaryHits != 1 || *backupHits != 1 {
+		t.Fatalf("Expected both destinations hit, got %d/%d", *primaryHits, *backupHits)
+	}
+
+	// first-success: the primary is tried first for every message
+	reset()
+	wh = Webhook{ID: "wh_first", URL: primary.URL, URLs: []string{backup.URL}, Method: "POST", Policy: DELIVERY_FIRST_SUCCESS}
+	for i := 0; i < 2; i++ {
+		if _, err := deliverWebhook(wh, payload); err != nil {
+			t.Fatalf("Expected delivery to backup, got %v", err)
+		}
+	}
+	if *primaryHits != 2 || *backupHits != 2 {
+		t.Fatalf("Expected 2/2 hits, got %d/%d", *primaryHits, *backupHits)
+	}
+
+	// failover: after one failure the backup stays active
+	reset()
+	wh = Webhook{ID: "wh_failover", URL: primary.URL, URLs: []string{backup.URL}, Method: "POST", Policy: DELIVERY_FAILOVER}
+	for i := 0; i < 3; i++ {
+		if _, err := deliverWebhook(wh, payload); err != nil {
+			t.Fatalf("Expected delivery to backup, got %v", err)
+		}
+	}
+	if *primaryHits != 1 || *backupHits != 3 {
+		t.Fatalf("Expected 1/3 hits, got %d/%d", *primaryHits, *backupHits)
+	}
+
+	// Backup failing too wraps around to the recovered primary
+	reset()
+	atomic.StoreInt32(&primaryStatus, 200)
+	atomic.StoreInt32(&backupStatus, 503)
+	if _, err := deliverWebhook(wh, payload); err != nil {
+		t.Fatalf("Expected delivery to primary, got %v", err)
+	}
+	if *primaryHits != 1 || *backupHits != 1 || failoverStart(wh.ID, 2) != 0 {
+		t.Fatalf("Expected switch back to primary, got %d/%d", *primaryHits, *backupHits)
+	}
+}
+
+func TestCreateWebhookWithURLs(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+
+	_, apiKey := registerWithAPIKey(t, ts, "fanout@example.com", "fanoutpass123")
+
+	var created map[string]interface{}
+	resp := apiRequest(t, "POST", ts.URL+"/api/webhooks/create", apiKey, map[string]interface{}{
+		"url": "https://primary.example.com", "method": "POST",
+		"urls": []string{"https://backup.example.com"}, "delivery_policy": "failover",
+	}, &created)
+	if resp.StatusCode != 200 {
+		t.Fatalf("Create webhook failed, status: %d", resp.StatusCode)
+	}
+
+	var webhooks []Webhook
+	apiRequest(t, "GET", ts.URL+"/api/webhooks", apiKey, nil, &webhooks)
+	if len(webhooks) != 1 || webhooks[0].Policy != DELIVERY_FAILOVER || len(webhooks[0].URLs) != 1 {
+		t.Fatalf("Unexpected webhooks: %+v", webhooks)
+	}
+
+	resp = apiRequest(t, "POST", ts.URL+"/api/webhooks/create", apiKey, map[string]interface{}{
+		"url": "https://primary.example.com", "method": "POST", "delivery_policy": "random",
+	}, nil)
+	if resp.StatusCode != 400 {
+		t.Fatalf("Expected 400 for invalid policy, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// --- Webhook events ---
+// Besides forwarded messages, webhooks can subscribe to events (listed in "events").
+// Event payloads carry an "event" field naming the type, so receivers can tell them
+// apart from messages; webhooks without subscriptions only ever receive messages.
+
+const (
+	EVENT_ANNOTATION_UPDATED    = "annotation.updated"
+	EVENT_CONVERSATION_ASSIGNED = "conversation.assigned"
+	EVENT_BOT_HANDOFF           = "bot.handoff"
+	EVENT_SESSION_LOGGED_OUT    = "session.logged_out"
+	EVENT_QUEUE_STATUS          = "queue.status"
+	EVENT_HEARTBEAT             = "heartbeat"
+	EVENT_MESSAGE_STARRED       = "message.starred"
+	EVENT_MESSAGE_PINNED        = "message.pinned"
+	EVENT_PAYMENT_ACTIVITY      = "payment.activity"
+)
+
+var webhookEventTypes = map[string]bool{
+	EVENT_ANNOTATION_UPDATED:    true,
+	EVENT_CONVERSATION_ASSIGNED: true,
+	EVENT_BOT_HANDOFF:           true,
+	EVENT_SESSION_LOGGED_OUT:    true,
+	EVENT_QUEUE_STATUS:          true,
+	EVENT_HEARTBEAT:             true,
+	EVENT_MESSAGE_STARRED:       true,
+	EVENT_MESSAGE_PINNED:        true,
+	EVENT_PAYMENT_ACTIVITY:      true,
+}
+
+// Validate and dedupe a webhook's event subscriptions
+func normalizeWebhookEvents(events []string) ([]string, error) {
+	result := []string{}
+	seen := map[string]bool{}
+	for _, event := range events {
+		event = strings.ToLower(strings.TrimSpace(event))
+		if event == "" || seen[event] {
+			continue
+		}
+		if !webhookEventTypes[event] {
+			return nil, fmt.Errorf("Unknown event: %q", event)
+		}
+		seen[event] = true
+		result = append(result, event)
+	}
+	return result, nil
+}
+
+func webhookSubscribed(wh Webhook, event string) bool {
+	for _, e := range wh.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether a webhook's filter accepts a message in chatJID (chatLID: the chat's LID, if any)
+func webhookMatchesChat(wh Webhook, chatJID, chatLID string) bool {
+	switch wh.FilterType {
+	case "all", "":
+		return true
+	case "group":
+		return strings.HasSuffix(chatJID, "@g.us") && (wh.FilterValue == "" || chatFilterFor(wh.FilterValue).matches(chatJID, ""))
+	case "chat":
+		// Direct chats, by phone-number JID or LID
+		if !strings.HasSuffix(chatJID, "@s.whatsapp.net") && !strings.HasSuffix(chatJID, "@lid") {
+			return false
+		}
+		return wh.FilterValue == "" || chatFilterFor(wh.FilterValue).matches(chatJID, chatLID)
+	}
+	return false
+}
+
+// emitWebhookEvent in the background, as a job stopServer waits for
+func goEmitWebhookEvent(email, event, chatJID string, data map[string]interface{}) {
+	goBackground(func(context.Context) { emitWebhookEvent(email, event, chatJID, data) })
+}
+
+// Deliver an event to the user's webhooks subscribed to it. If chatJID is set, the
+// webhook's chat filter applies as it would to a message in that chat.
+func emitWebhookEvent(email, event, chatJID string, data map[string]interface{}) {
+	userID, err := getUserIDByEmail(email)
+	if err != nil {
+		fmt.Printf("ERROR: [EVENT] Unknown user %s for event %s\n", email, event)
+		return
+	}
+	webhooks, err := dbListWebhooks(userID)
+	if err != nil {
+		fmt.Printf("ERROR: [EVENT] Could not load webhooks for user %s: %v\n", email, err)
+		return
+	}
+	secrets, err := dbGetSecretValues(userID)
+	if err != nil {
+		fmt.Printf("ERROR: [EVENT] Could not load secrets for user %s: %v\n", email, err)
+		return
+	}
+
+	payload := map[string]interface{}{
+		"event":     event,
+		"timestamp": time.Now().Unix(),
+	}
+	for k, v := range data {
+		payload[k] = v
+	}
+	for _, wh := range webhooks {
+		if wh.Paused || wh.Unverified || !webhookSubscribed(wh, event) {
+			continue
+		}
+		if chatJID != "" && !webhookMatchesChat(wh, chatJID, "") {
+			continue
+		}
+		resolved, err := resolveWebhookSecrets(wh, secrets)
+		if err != nil {
+			fmt.Printf("ERROR: Webhook %s not sent: %v\n", wh.ID, err)
+			continue
+		}
+		redacted := redactWebhookPayload(wh, payload)
+		start := time.Now()
+		_, responses, err := deliverWebhookCapture(resolved, limitWebhookPayload(userID, wh, redacted))
+		recordWebhookDelivery(wh.ID, start, err)
+		addWebhookLog(wh.ID, redacted, start, loggedResponses(wh, responses))
+		if err != nil {
+			fmt.Printf("ERROR: Failed to send %s event to webhook %s: %v\n", event, wh.ID, err)
+			continue
+		}
+		dbSetWebhookLastDelivery(wh.ID, time.Now())
+		fmt.Printf("DEBUG: Sent %s event to webhook %s\n", event, wh.ID)
+	}
+}
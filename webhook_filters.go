@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// --- Chat filter patterns ---
+// A webhook's filter_value can list several chats separated by commas. Each entry is a
+// JID (or phone number), a JID with one * wildcard in the user part ("1*@s.whatsapp.net"
+// for US numbers, "*4321@s.whatsapp.net"), or either of those prefixed with ! to leave
+// the chat out. A chat matches when it matches any entry without ! (or there are none,
+// as in "!120363000000000000@g.us" for every group but one) and no entry with !.
+// Group filters also take group subjects, as "name:" entries (see group_filters.go).
+// Filters are compiled once per distinct filter_value and kept for reuse.
+
+const MAX_FILTER_PATTERNS = 100
+
+// One * wildcard: matches JIDs starting with prefix and ending with suffix
+type jidPattern struct {
+	prefix, suffix string
+}
+
+func (p jidPattern) matches(jid string) bool {
+	return len(jid) >= len(p.prefix)+len(p.suffix) && strings.HasPrefix(jid, p.prefix) && strings.HasSuffix(jid, p.suffix)
+}
+
+type chatFilter struct {
+	include         map[string]bool
+	includePatterns []jidPattern
+	exclude         map[string]bool
+	excludePatterns []jidPattern
+	includeNames    []string // Lowercased "name:" patterns
+	excludeNames    []string
+}
+
+var chatFilters sync.Map // filter_value -> *chatFilter
+
+// The compiled filter for a filter_value, which was validated when stored
+func chatFilterFor(value string) *chatFilter {
+	if cached, ok := chatFilters.Load(value); ok {
+		return cached.(*chatFilter)
+	}
+	f := &chatFilter{include: map[string]bool{}, exclude: map[string]bool{}}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		exact, patterns, names := f.include, &f.includePatterns, &f.includeNames
+		if strings.HasPrefix(entry, "!") {
+			entry = strings.TrimSpace(entry[1:])
+			exact, patterns, names = f.exclude, &f.excludePatterns, &f.excludeNames
+		}
+		if entry == "" {
+			continue
+		}
+		if name, ok := strings.CutPrefix(entry, GROUP_NAME_PREFIX); ok {
+			*names = append(*names, strings.ToLower(strings.TrimSpace(name)))
+		} else if star := strings.Index(entry, "*"); star >= 0 {
+			*patterns = append(*patterns, jidPattern{prefix: entry[:star], suffix: entry[star+1:]})
+		} else {
+			exact[entry] = true
+		}
+	}
+	chatFilters.Store(value, f)
+	return f
+}
+
+func matchesAnyJID(exact map[string]bool, patterns []jidPattern, jids ...string) bool {
+	for _, jid := range jids {
+		if jid == "" {
+			continue
+		}
+		if exact[jid] {
+			return true
+		}
+		for _, p := range patterns {
+			if p.matches(jid) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Whether a chat, by JID and LID (either may be empty), passes the filter
+func (f *chatFilter) matches(chatJID, chatLID string) bool {
+	if matchesAnyJID(f.exclude, f.excludePatterns, chatJID, chatLID) || matchesAnyGroupName(f.excludeNames, chatJID) {
+		return false
+	}
+	if len(f.include) == 0 && len(f.includePatterns) == 0 && len(f.includeNames) == 0 {
+		return true
+	}
+	return matchesAnyJID(f.include, f.includePatterns, chatJID, chatLID) || matchesAnyGroupName(f.includeNames, chatJID)
+}
+
+// Chat servers a filter type can match
+func filterServers(filterType string) []string {
+	if filterType == "group" {
+		return []string{"g.us"}
+	}
+	return []string{"s.whatsapp.net", "lid"}
+}
+
+// Validate and normalize a filter_value for a "group" or "chat" filter: JIDs and phone
+// numbers are normalized, duplicates dropped and entries rejoined with commas
+func normalizeFilterValue(filterType, value string) (string, error) {
+	servers := filterServers(filterType)
+	seen := map[string]bool{}
+	var entries []string
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		negate := strings.HasPrefix(entry, "!")
+		if negate {
+			entry = strings.TrimSpace(entry[1:])
+		}
+		if name, ok := strings.CutPrefix(entry, GROUP_NAME_PREFIX); ok {
+			if filterType != "group" {
+				return "", fmt.Errorf("Invalid filter_value %q: name: entries only apply to group filters", entry)
+			}
+			name = strings.TrimSpace(name)
+			if err := validateGroupNamePattern(name); err != nil {
+				return "", fmt.Errorf("Invalid filter_value %q: %v", entry, err)
+			}
+			entry = GROUP_NAME_PREFIX + name
+		} else if strings.Contains(entry, "*") {
+			if err := validateJIDPattern(entry, servers); err != nil {
+				return "", fmt.Errorf("Invalid filter_value %q: %v", entry, err)
+			}
+		} else {
+			jid, err := normalizeChatJID(entry)
+			if err != nil {
+				return "", fmt.Errorf("Invalid filter_value: %v", err)
+			}
+			if !slices.Contains(servers, jid.Server) {
+				return "", fmt.Errorf("Invalid filter_value %q: not a %s JID", entry, filterType)
+			}
+			entry = jid.String()
+		}
+		if negate {
+			entry = "!" + entry
+		}
+		if !seen[entry] {
+			seen[entry] = true
+			entries = append(entries, entry)
+		}
+	}
+	if len(entries) > MAX_FILTER_PATTERNS {
+		return "", fmt.Errorf("Too many filter_value entries (max %d)", MAX_FILTER_PATTERNS)
+	}
+	return strings.Join(entries, ","), nil
+}
+
+// A wildcard entry: one * in the user part of a JID on one of the servers
+func validateJIDPattern(pattern string, servers []string) error {
+	at := strings.LastIndex(pattern, "@")
+	if at < 0 {
+		return errors.New("a wildcard needs the server, e.g. 1*@s.whatsapp.net")
+	}
+	user, server := pattern[:at], pattern[at+1:]
+	if !slices.Contains(servers, server) {
+		return fmt.Errorf("server must be one of %s", strings.Join(servers, ", "))
+	}
+	if strings.Count(user, "*") != 1 {
+		return errors.New("only one * is allowed, in the part before @")
+	}
+	for _, r := range strings.Replace(user, "*", "", 1) {
+		if (r < '0' || r > '9') && r != '-' {
+			return fmt.Errorf("unexpected %q", r)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import "testing"
+
+func TestChatFilterPatterns(t *testing.T) {
+	// Entries are normalized, deduplicated and checked against the filter type
+	value, err := normalizeFilterValue("chat", " +1 415 555 0001, 1*@s.whatsapp.net ,! 44*@s.whatsapp.net,14155550001@c.us")
+	if err != nil || value != "14155550001@s.whatsapp.net,1*@s.whatsapp.net,!44*@s.whatsapp.net" {
+		t.Fatalf("Unexpected normalized filter: %q %v", value, err)
+	}
+	for filterType, value := range map[string]string{
+		"group": "1*@s.whatsapp.net",       // Wrong server for the type
+		"chat":  "120363000000000001@g.us", // A group in a chat filter
+	} {
+		if _, err := normalizeFilterValue(filterType, value); err == nil {
+			t.Fatalf("Expected %q to be rejected for a %s filter", value, filterType)
+		}
+	}
+	for _, value := range []string{"1*", "1**@s.whatsapp.net", "1*@*.net", "a*@s.whatsapp.net", "!"} {
+		if _, err := normalizeFilterValue("chat", value); err == nil {
+			t.Fatalf("Expected %q to be rejected", value)
+		}
+	}
+
+	tests := []struct {
+		filterType, value, chatJID, chatLID string
+		want                                bool
+	}{
+		{"chat", "1*@s.whatsapp.net", "14155550001@s.whatsapp.net", "", true},
+		{"chat", "1*@s.whatsapp.net", "447700900123@s.whatsapp.net", "", false},
+		{"chat", "*0123@s.whatsapp.net", "447700900123@s.whatsapp.net", "", true},
+		{"chat", "111@s.whatsapp.net,222@s.whatsapp.net", "222@s.whatsapp.net", "", true},
+		{"chat", "99*@lid", "14155550001@s.whatsapp.net", "99123@lid", true},
+		{"chat", "1*@s.whatsapp.net,!14155550001@s.whatsapp.net", "14155550001@s.whatsapp.net", "", false},
+		{"chat", "!1*@s.whatsapp.net", "447700900123@s.whatsapp.net", "", true},
+		{"group", "!120363000000000001@g.us", "120363000000000002@g.us", "", true},
+		{"group", "!120363000000000001@g.us", "120363000000000001@g.us", "", false},
+		{"group", "!120363000000000001@g.us", "14155550001@s.whatsapp.net", "", false}, // Not a group at all
+	}
+	for _, tt := range tests {
+		wh := Webhook{URL: "https://example.com/hook", Method: "POST", FilterType: tt.filterType, FilterValue: tt.value}
+		if err := validateWebhookConfig(&wh); err != nil {
+			t.Fatalf("Filter %q rejected: %v", tt.value, err)
+		}
+		if got := webhookMatchesChat(wh, tt.chatJID, tt.chatLID); got != tt.want {
+			t.Errorf("Filter %s %q on %s/%s: got %v, want %v", tt.filterType, tt.value, tt.chatJID, tt.chatLID, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+// --- Webhooks for one chat ---
+// POST /api/webhooks/for-chat creates a webhook that only receives one chat's messages,
+// working out filter_type and filter_value from the chat: a group JID gives a "group"
+// filter, a phone number or user JID a "chat" filter. Asking again for the same chat
+// and URL returns the existing webhook instead of creating a duplicate.
+
+// The JID to filter a webhook on for a chat given as a JID or phone number. Phone
+// numbers are checked with WhatsApp when the user is connected, and LIDs are turned
+// into the phone-number JID when the mapping is known, matching the chat in payloads.
+func resolveWebhookChat(email, input string) (types.JID, error) {
+	jid, isPhone, err := parseChatJID(input)
+	if err != nil {
+		return jid, err
+	}
+	switch jid.Server {
+	case types.DefaultUserServer, types.HiddenUserServer, types.GroupServer:
+	default:
+		return jid, fmt.Errorf("Only WhatsApp direct and group chats can be filtered, not %q", jid.Server)
+	}
+	if isPhone {
+		resolved, err := resolveUserPhone(email, jid.User)
+		if errors.Is(err, errNotOnWhatsApp) {
+			return jid, err
+		} else if err == nil {
+			jid = resolved
+		}
+		// Not connected: the number is used as given
+	}
+	if pn, ok := lidToPN(userWAClient(email), jid); ok {
+		jid = pn
+	}
+	return jid, nil
+}
+
+// POST /api/webhooks/for-chat
+// Body: {"chat_jid": "...", "url": "..."} plus any /api/webhooks/create field except the
+// filter, which comes from chat_jid. The method defaults to POST.
+func handleCreateChatWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := r.Context().Value("userID").(int64)
+	email := getUserEmailByID(userID)
+
+	var req struct {
+		ChatJID string `json:"chat_jid"`
+		Verify  bool   `json:"verify"` // Challenge the destinations before enabling delivery
+		Webhook
+	}
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	if req.ChatJID == "" {
+		apiError(w, "Missing chat_jid", http.StatusBadRequest)
+		return
+	}
+	if req.URL == "" {
+		apiError(w, "Missing URL", http.StatusBadRequest)
+		return
+	}
+	if req.FilterType != "" || req.FilterValue != "" {
+		apiError(w, "filter_type and filter_value are set from chat_jid", http.StatusBadRequest)
+		return
+	}
+	jid, err := resolveWebhookChat(email, req.ChatJID)
+	if err != nil {
+		apiError(w, "Invalid chat_jid: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	wh := req.Webhook
+	wh.ID = generateWebhookID()
+	if wh.Method == "" {
+		wh.Method = "POST"
+	}
+	wh.FilterType = chatTypeForJID(jid.String())
+	wh.FilterValue = jid.String()
+	wh.Paused = false
+	wh.Unverified = req.Verify
+	wh.LastDeliveryAt, wh.Alerts, wh.Health = nil, nil, nil
+	wh.CreatedAt = time.Now()
+	if err := validateWebhookConfig(&wh); err != nil {
+		apiError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if wh.AllowedChats, err = limitToAPIKeyChats(userID, wh.AllowedChats); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+
+	webhooks, err := dbListWebhooks(userID)
+	if err != nil {
+		fmt.Println("ERROR: Could not list webhooks for chat webhook", err)
+		apiError(w, "Failed to create webhook", http.StatusInternalServerError)
+		return
+	}
+	for _, existing := range webhooks {
+		if existing.URL == wh.URL && existing.FilterType == wh.FilterType && existing.FilterValue == wh.FilterValue {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{"created": false, "webhook": existing})
+			return
+		}
+	}
+
+	if err := dbCreateWebhook(userID, wh); err != nil {
+		fmt.Println("ERROR: Could not create chat webhook in DB", err)
+		apiError(w, "Failed to create webhook", http.StatusInternalServerError)
+		return
+	}
+	fmt.Printf("DEBUG: Webhook %s created for %s %s\n", wh.ID, wh.FilterType, wh.FilterValue)
+
+	response := map[string]interface{}{"created": true}
+	if req.Verify {
+		// Kept unverified on failure, so the destination can be fixed and verified again
+		if err := verifyWebhook(userID, &wh); err != nil {
+			response["verification_error"] = err.Error()
+		}
+	}
+	response["webhook"] = wh
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+func TestCreateChatWebhook(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+
+	email := "forchat@example.com"
+	_, apiKey := registerWithAPIKey(t, ts, email, "forchatpass123")
+	fake := useFakeWAClient(t, email)
+	// Registered without the extra mobile 9
+	fake.onWA["+551187654321"] = types.NewJID("551187654321", types.DefaultUserServer)
+
+	type result struct {
+		Created bool    `json:"created"`
+		Webhook Webhook `json:"webhook"`
+	}
+	create := func(body map[string]interface{}, out *result) int {
+		t.Helper()
+		return apiRequest(t, "POST", ts.URL+"/api/webhooks/for-chat", apiKey, body, out).StatusCode
+	}
+
+	// A group JID gives a group filter; the method defaults to POST
+	var group result
+	if status := create(map[string]interface{}{"chat_jid": "120363000000000001@g.us", "url": "https://example.com/group", "tags": []string{"Sales"}}, &group); status != 201 {
+		t.Fatalf("Expected 201 for a group webhook, got %d", status)
+	}
+	if !group.Created || group.Webhook.FilterType != "group" || group.Webhook.FilterValue != "120363000000000001@g.us" || group.Webhook.Method != "POST" || group.Webhook.Tags[0] != "sales" {
+		t.Fatalf("Unexpected group webhook: %+v", group)
+	}
+
+	// A phone number gives a chat filter on the JID WhatsApp knows it by
+	var chat result
+	if status := create(map[string]interface{}{"chat_jid": "+55 11 98765-4321", "url": "https://example.com/chat"}, &chat); status != 201 {
+		t.Fatalf("Expected 201 for a chat webhook, got %d", status)
+	}
+	if chat.Webhook.FilterType != "chat" || chat.Webhook.FilterValue != "551187654321@s.whatsapp.net" {
+		t.Fatalf("Unexpected chat webhook: %+v", chat.Webhook)
+	}
+
+	// Asking again returns the same webhook
+	var again result
+	if status := create(map[string]interface{}{"chat_jid": "551187654321@c.us", "url": "https://example.com/chat"}, &again); status != 200 || again.Created || again.Webhook.ID != chat.Webhook.ID {
+		t.Fatalf("Expected the existing webhook, got %d %+v", status, again)
+	}
+	userID, _ := getUserIDByEmail(email)
+	webhooks, _ := dbListWebhooks(userID)
+	if len(webhooks) != 2 {
+		t.Fatalf("Expected 2 webhooks, got %d", len(webhooks))
+	}
+
+	for _, body := range []map[string]interface{}{
+		{"url": "https://example.com/x"},
+		{"chat_jid": "120363000000000001@g.us"},
+		{"chat_jid": "4915123456789", "url": "https://example.com/x"}, // Not on WhatsApp
+		{"chat_jid": "120363000000000002@newsletter", "url": "https://example.com/x"},
+		{"chat_jid": "120363000000000001@g.us", "url": "https://example.com/x", "filter_type": "all"},
+	} {
+		if status := create(body, &result{}); status != 400 {
+			t.Fatalf("Expected 400 for %v, got %d", body, status)
+		}
+	}
+}
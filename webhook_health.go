@@ -0,0 +1,61 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// --- Webhook health ---
+// The outcome of each webhook's latest delivery and its run of failures, kept in
+// memory so /api/webhooks can badge broken webhooks without a metrics scrape. After
+// WEBHOOK_CIRCUIT_THRESHOLD failures in a row the circuit reads "open"; deliveries are
+// still attempted, and the first success closes it again.
+
+const (
+	WEBHOOK_CIRCUIT_THRESHOLD = 5
+	CIRCUIT_CLOSED            = "closed"
+	CIRCUIT_OPEN              = "open"
+)
+
+type WebhookHealth struct {
+	LastStatus          string    `json:"last_status"` // "ok" or "failed"
+	LastError           string    `json:"last_error,omitempty"`
+	LastAttemptAt       time.Time `json:"last_attempt_at"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	Circuit             string    `json:"circuit"`
+}
+
+var webhookHealth = struct {
+	sync.Mutex
+	data map[string]WebhookHealth // By webhook ID
+}{data: make(map[string]WebhookHealth)}
+
+func recordWebhookHealth(webhookID string, at time.Time, deliveryErr error) {
+	webhookHealth.Lock()
+	defer webhookHealth.Unlock()
+	h := webhookHealth.data[webhookID]
+	h.LastAttemptAt = at
+	if deliveryErr != nil {
+		h.LastStatus, h.LastError = "failed", deliveryErr.Error()
+		h.ConsecutiveFailures++
+	} else {
+		h.LastStatus, h.LastError = "ok", ""
+		h.ConsecutiveFailures = 0
+	}
+	h.Circuit = CIRCUIT_CLOSED
+	if h.ConsecutiveFailures >= WEBHOOK_CIRCUIT_THRESHOLD {
+		h.Circuit = CIRCUIT_OPEN
+	}
+	webhookHealth.data[webhookID] = h
+}
+
+// Health of a webhook, or nil before its first delivery since the server started
+func getWebhookHealth(webhookID string) *WebhookHealth {
+	webhookHealth.Lock()
+	defer webhookHealth.Unlock()
+	h, ok := webhookHealth.data[webhookID]
+	if !ok {
+		return nil
+	}
+	return &h
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestWebhookHealth(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+
+	_, apiKey := registerWithAPIKey(t, ts, "health@example.com", "healthpass123")
+	var wh Webhook
+	if resp := apiRequest(t, "POST", ts.URL+"/api/webhooks/create", apiKey, map[string]interface{}{"url": "https://example.com/hook", "method": "POST"}, &wh); resp.StatusCode != 200 || wh.ID == "" {
+		t.Fatalf("Create webhook failed: %d", resp.StatusCode)
+	}
+
+	list := func() *WebhookHealth {
+		t.Helper()
+		var webhooks []Webhook
+		apiRequest(t, "GET", ts.URL+"/api/webhooks", apiKey, nil, &webhooks)
+		if len(webhooks) != 1 {
+			t.Fatalf("Expected one webhook, got %d", len(webhooks))
+		}
+		return webhooks[0].Health
+	}
+	if h := list(); h != nil {
+		t.Fatalf("Expected no health before the first delivery, got %+v", h)
+	}
+
+	// Failures in a row open the circuit
+	for i := 0; i < WEBHOOK_CIRCUIT_THRESHOLD-1; i++ {
+		recordWebhookDelivery(wh.ID, time.Now(), errors.New("status 502"))
+	}
+	if h := list(); h == nil || h.LastStatus != "failed" || h.LastError != "status 502" || h.ConsecutiveFailures != WEBHOOK_CIRCUIT_THRESHOLD-1 || h.Circuit != CIRCUIT_CLOSED {
+		t.Fatalf("Unexpected health after failures: %+v", h)
+	}
+	recordWebhookDelivery(wh.ID, time.Now(), errors.New("status 502"))
+	if h := list(); h.Circuit != CIRCUIT_OPEN || h.LastAttemptAt.IsZero() {
+		t.Fatalf("Expected the circuit open, got %+v", h)
+	}
+
+	// A success closes it again
+	recordWebhookDelivery(wh.ID, time.Now(), nil)
+	if h := list(); h.LastStatus != "ok" || h.LastError != "" || h.ConsecutiveFailures != 0 || h.Circuit != CIRCUIT_CLOSED {
+		t.Fatalf("Expected a healthy webhook after a success, got %+v", h)
+	}
+}
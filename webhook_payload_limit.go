@@ -0,0 +1,205 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// --- Webhook payload size limit ---
+// A webhook can set max_payload_bytes for receivers that reject large bodies (long
+// captions, vCards, extracted document text). Oversized payloads have their largest
+// fields cut or dropped until they fit, and are marked with "truncated": true, the
+// "truncated_fields" and a "full_payload_url". The full payload is kept for the
+// webhook_logs retention window and served to the account's API key.
+
+const (
+	MIN_WEBHOOK_PAYLOAD_LIMIT = 1024
+	MAX_WEBHOOK_PAYLOAD_LIMIT = 10 * 1024 * 1024
+	TRUNCATION_SUFFIX         = "…"
+)
+
+// Fields that identify a message or event and are never cut
+var untruncatedPayloadFields = map[string]bool{
+	"id": true, "message_id": true, "event": true, "from": true, "to": true, "from_lid": true, "to_lid": true,
+	"name": true, "type": true, "timestamp": true, "timestamp_iso": true, "timezone": true, "chat_jid": true,
+	"media_url": true, "mime_type": true, "truncated": true, "truncated_fields": true, "full_payload_url": true,
+}
+
+func validateWebhookPayloadLimit(maxBytes int) error {
+	if maxBytes != 0 && (maxBytes < MIN_WEBHOOK_PAYLOAD_LIMIT || maxBytes > MAX_WEBHOOK_PAYLOAD_LIMIT) {
+		return fmt.Errorf("max_payload_bytes must be 0 (no limit) or between %d and %d", MIN_WEBHOOK_PAYLOAD_LIMIT, MAX_WEBHOOK_PAYLOAD_LIMIT)
+	}
+	return nil
+}
+
+// Cut a string to at most n bytes on a rune boundary
+func truncateBytes(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// Shrink a payload to maxBytes of JSON by cutting its largest string fields and
+// dropping its largest other fields. Returns a copy with the truncation markers,
+// or the payload itself if it already fits.
+func truncatePayload(payload map[string]interface{}, maxBytes int, fullURL string) map[string]interface{} {
+	data, _ := json.Marshal(payload)
+	if len(data) <= maxBytes {
+		return payload
+	}
+	out := make(map[string]interface{}, len(payload)+3)
+	for k, v := range payload {
+		out[k] = v
+	}
+	truncated := []string{}
+	out["truncated"] = true
+	out["full_payload_url"] = fullURL
+	out["truncated_fields"] = truncated
+	for {
+		data, _ = json.Marshal(out)
+		excess := len(data) - maxBytes
+		if excess <= 0 {
+			break
+		}
+		largest, largestSize := "", 0
+		for k, v := range out {
+			if untruncatedPayloadFields[k] {
+				continue
+			}
+			if b, _ := json.Marshal(v); len(b) > largestSize {
+				largest, largestSize = k, len(b)
+			}
+		}
+		if largest == "" {
+			fmt.Printf("WARNING: Payload still %d bytes over the limit after truncation\n", excess)
+			break
+		}
+		if s, ok := out[largest].(string); ok && len(s)-excess-len(TRUNCATION_SUFFIX) > 0 {
+			out[largest] = truncateBytes(strings.TrimSuffix(s, TRUNCATION_SUFFIX), len(s)-excess-len(TRUNCATION_SUFFIX)) + TRUNCATION_SUFFIX
+		} else {
+			delete(out, largest)
+		}
+		if !slices.Contains(truncated, largest) {
+			truncated = append(truncated, largest)
+			out["truncated_fields"] = truncated
+		}
+	}
+	return out
+}
+
+// Payload to deliver to a webhook: the payload itself, or a truncated copy whose
+// full version is stored when it exceeds the webhook's limit
+func limitWebhookPayload(userID int64, wh Webhook, payload map[string]interface{}) map[string]interface{} {
+	if wh.MaxPayload <= 0 {
+		return payload
+	}
+	data, err := json.Marshal(payload)
+	if err != nil || len(data) <= wh.MaxPayload {
+		return payload
+	}
+	payloadID := generateMessageID()
+	if err := dbSaveWebhookPayload(userID, wh.ID, payloadID, data); err != nil {
+		fmt.Printf("ERROR: Could not store full payload for webhook %s: %v\n", wh.ID, err)
+	}
+	fullURL := fmt.Sprintf("/api/webhooks/%s/payloads/%s", wh.ID, payloadID)
+	if baseURL := os.Getenv("BASE_URL"); baseURL != "" {
+		fullURL = strings.TrimRight(baseURL, "/") + fullURL
+	}
+	fmt.Printf("INFO: Payload for webhook %s is %d bytes, truncating to %d\n", wh.ID, len(data), wh.MaxPayload)
+	return truncatePayload(payload, wh.MaxPayload, fullURL)
+}
+
+// Store a full payload (the retention janitor removes it once expired)
+func dbSaveWebhookPayload(userID int64, webhookID, payloadID string, data []byte) error {
+	_, err := db.Exec(`INSERT INTO webhook_payloads (id, user_id, webhook_id, payload, created_at) VALUES (?, ?, ?, ?, ?)`,
+		payloadID, userID, webhookID, string(data), time.Now().Unix())
+	return err
+}
+
+func dbGetWebhookPayload(userID int64, webhookID, payloadID string) (string, error) {
+	var payload string
+	err := db.QueryRow(`SELECT payload FROM webhook_payloads WHERE id = ? AND user_id = ? AND webhook_id = ? AND created_at >= ?`,
+		payloadID, userID, webhookID, retentionCutoff(RETENTION_WEBHOOK_LOGS, time.Now()).Unix()).Scan(&payload)
+	return payload, err
+}
+
+func dbSetWebhookPayloadLimit(userID int64, webhookID string, maxBytes int) (bool, error) {
+	defer invalidateWebhooksCache(userID)
+	res, err := db.Exec(`UPDATE webhooks SET max_payload_bytes = ? WHERE user_id = ? AND id = ?`, maxBytes, userID, webhookID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// POST /api/webhooks/{id}/payload-limit {"max_payload_bytes": 65536}
+func handleSetWebhookPayloadLimit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID := r.Context().Value("userID").(int64)
+
+	var req struct {
+		MaxPayloadBytes int `json:"max_payload_bytes"`
+	}
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	if err := validateWebhookPayloadLimit(req.MaxPayloadBytes); err != nil {
+		apiError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	webhookID := r.PathValue("id")
+	updated, err := dbSetWebhookPayloadLimit(userID, webhookID, req.MaxPayloadBytes)
+	if err != nil {
+		fmt.Println("ERROR: Could not update webhook payload limit", err)
+		apiError(w, "Failed to update payload limit", http.StatusInternalServerError)
+		return
+	}
+	if !updated {
+		apiError(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":           true,
+		"id":                webhookID,
+		"max_payload_bytes": req.MaxPayloadBytes,
+	})
+}
+
+// GET /api/webhooks/{id}/payloads/{payload_id}
+// The full version of a truncated payload, as it would have been delivered
+func handleGetWebhookPayload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID := r.Context().Value("userID").(int64)
+
+	payload, err := dbGetWebhookPayload(userID, r.PathValue("id"), r.PathValue("payload_id"))
+	if err == sql.ErrNoRows {
+		apiError(w, "Payload not found or expired", http.StatusNotFound)
+		return
+	} else if err != nil {
+		apiError(w, "Failed to load payload", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(payload))
+}
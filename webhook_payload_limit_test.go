@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTruncatePayload(t *testing.T) {
+	payload := map[string]interface{}{
+		"id": "MSG1", "from": "14155550000@s.whatsapp.net", "type": "document",
+		"caption":       strings.Repeat("ü", 300),
+		"document_text": strings.Repeat("x", 5000),
+		"raw":           map[string]interface{}{"blob": strings.Repeat("y", 3000)},
+	}
+	out := truncatePayload(payload, 2048, "/api/webhooks/w/payloads/p")
+	data, _ := json.Marshal(out)
+	if len(data) > 2048 {
+		t.Fatalf("Truncated payload is %d bytes", len(data))
+	}
+	fields, _ := out["truncated_fields"].([]string)
+	if out["truncated"] != true || out["full_payload_url"] != "/api/webhooks/w/payloads/p" || len(fields) == 0 || fields[0] != "document_text" {
+		t.Fatalf("Unexpected markers: %v %v %v", out["truncated"], out["full_payload_url"], fields)
+	}
+	if out["id"] != "MSG1" || out["from"] != payload["from"] || out["type"] != "document" {
+		t.Fatalf("Identifying fields changed: %v", out)
+	}
+	if text, _ := out["document_text"].(string); text != "" && !strings.HasSuffix(text, TRUNCATION_SUFFIX) {
+		t.Fatalf("Cut text should end with %q", TRUNCATION_SUFFIX)
+	}
+	if caption, ok := out["caption"].(string); ok && !strings.HasPrefix(caption, "ü") {
+		t.Fatalf("Caption cut inside a rune: %q", caption[:4])
+	}
+	if len(payload["document_text"].(string)) != 5000 {
+		t.Fatal("Original payload was modified")
+	}
+
+	// Payloads within the limit are passed through
+	small := map[string]interface{}{"id": "MSG2", "text": "hi"}
+	if out := truncatePayload(small, 2048, ""); out["truncated"] != nil {
+		t.Fatalf("Expected no truncation, got %v", out)
+	}
+}
+
+func TestWebhookPayloadLimit(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+
+	email := "limit@example.com"
+	_, apiKey := registerWithAPIKey(t, ts, email, "limitpass123")
+
+	received := make(chan []byte, 5)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- body
+	}))
+	defer receiver.Close()
+
+	if resp := apiRequest(t, "POST", ts.URL+"/api/webhooks/create", apiKey, map[string]interface{}{"url": receiver.URL, "method": "POST", "max_payload_bytes": 100}, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for a limit below the minimum, got %d", resp.StatusCode)
+	}
+	var created map[string]interface{}
+	apiRequest(t, "POST", ts.URL+"/api/webhooks/create", apiKey, map[string]interface{}{"url": receiver.URL, "method": "POST", "max_payload_bytes": 1024}, &created)
+	id, _ := created["id"].(string)
+	if created["max_payload_bytes"] != float64(1024) {
+		t.Fatalf("Unexpected create response: %v", created)
+	}
+
+	receive := func(text string) map[string]interface{} {
+		t.Helper()
+		forwardToWebhooks(email, map[string]interface{}{"id": "M" + text[:1], "from": "14155550000@s.whatsapp.net", "to": "14155550000@s.whatsapp.net",
+			"type": "text", "text": text, "timestamp": time.Now().Unix()}, "", "test_media")
+		select {
+		case body := <-received:
+			if len(body) > 1024 {
+				t.Fatalf("Delivered %d bytes over a 1024 byte limit", len(body))
+			}
+			var payload map[string]interface{}
+			json.Unmarshal(body, &payload)
+			return payload
+		case <-time.After(5 * time.Second):
+			t.Fatal("Webhook not called")
+			return nil
+		}
+	}
+
+	if payload := receive("short"); payload["truncated"] != nil || payload["text"] != "short" {
+		t.Fatalf("Small payload should be unchanged: %v", payload)
+	}
+	long := strings.Repeat("a", 4000)
+	payload := receive(long)
+	fullURL, _ := payload["full_payload_url"].(string)
+	if payload["truncated"] != true || !strings.HasPrefix(fullURL, "/api/webhooks/"+id+"/payloads/") {
+		t.Fatalf("Expected truncation markers, got %v", payload)
+	}
+
+	var full map[string]interface{}
+	if resp := apiRequest(t, "GET", ts.URL+fullURL, apiKey, nil, &full); resp.StatusCode != 200 || full["text"] != long {
+		t.Fatalf("Full payload not served, status %d", resp.StatusCode)
+	}
+	_, otherKey := registerWithAPIKey(t, ts, "other@example.com", "otherpass123")
+	if resp := apiRequest(t, "GET", ts.URL+fullURL, otherKey, nil, nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected 404 for another account, got %d", resp.StatusCode)
+	}
+
+	// Removing the limit delivers the whole payload
+	if resp := apiRequest(t, "POST", ts.URL+"/api/webhooks/"+id+"/payload-limit", apiKey, map[string]int{"max_payload_bytes": 0}, nil); resp.StatusCode != 200 {
+		t.Fatalf("Update payload limit failed, status %d", resp.StatusCode)
+	}
+	forwardToWebhooks(email, map[string]interface{}{"id": "M9", "from": "14155550000@s.whatsapp.net", "to": "14155550000@s.whatsapp.net",
+		"type": "text", "text": long, "timestamp": time.Now().Unix()}, "", "test_media")
+	select {
+	case body := <-received:
+		if len(body) < 4000 {
+			t.Fatalf("Expected the full payload without a limit, got %d bytes", len(body))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Webhook not called")
+	}
+	if resp := apiRequest(t, "POST", ts.URL+"/api/webhooks/nope/payload-limit", apiKey, map[string]int{"max_payload_bytes": 2048}, nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected 404 for unknown webhook, got %d", resp.StatusCode)
+	}
+}
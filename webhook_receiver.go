@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- Inbound automation receiver ---
+// POST /webhook/{id} lets automations (n8n etc.) send WhatsApp messages through a webhook.
+// Besides a text message, the request can carry one attachment: a previously uploaded
+// media_id, a media_url fetched by the server, base64 media_base64, or a multipart
+// "file" part. The message (or caption) is then sent as the attachment's caption.
+
+const MEDIA_FETCH_TIMEOUT = 60 * time.Second
+
+var mediaFetchClient = guardedHTTPClient(MEDIA_FETCH_TIMEOUT)
+
+// Fields accepted by the receiver, from a JSON body or multipart form
+type receiverRequest struct {
+	ChatID      string `json:"chat_id"`
+	GroupID     string `json:"groupId"` // Legacy name for chat_id
+	Message     string `json:"message"`
+	Caption     string `json:"caption"`
+	CallbackURL string `json:"callback_url"`
+	MediaID     string `json:"media_id"`
+	MediaURL    string `json:"media_url"`
+	MediaBase64 string `json:"media_base64"`
+	MediaType   string `json:"media_type"`
+	FileName    string `json:"file_name"`
+	MimeType    string `json:"mime_type"`
+	ExpiresIn   int    `json:"expires_in"`
+	GroupKey    string `json:"group_key"`
+}
+
+// Attachment content to store before sending
+type receiverAttachment struct {
+	body     io.ReadCloser
+	mimeType string
+	fileName string
+}
+
+func handleWebhookReceiver(mediaDir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := path.Base(r.URL.Path)
+		if id == "" {
+			apiError(w, "Not found", http.StatusNotFound)
+			return
+		}
+
+		fmt.Printf("Received webhook call for id: %s\n", id)
+
+		if r.Method != "POST" || r.Body == nil {
+			fmt.Printf("DEBUG: Not a POST request or no body\n")
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`{"success":true}`))
+			return
+		}
+
+		req, attachment, err := parseReceiverRequest(w, r)
+		if err != nil {
+			fmt.Printf("DEBUG: Failed to parse webhook request: %v\n", err)
+			writeBodyError(w, err)
+			return
+		}
+		if attachment != nil {
+			defer attachment.body.Close()
+		}
+
+		caption := req.Message
+		if req.Caption != "" {
+			caption = req.Caption
+		}
+		hasMedia := req.MediaID != "" || req.MediaURL != "" || req.MediaBase64 != "" || attachment != nil
+		if caption == "" && !hasMedia {
+			fmt.Printf("DEBUG: No message field found in payload\n")
+			apiError(w, "Missing message field", http.StatusBadRequest)
+			return
+		}
+		fmt.Printf("Received message from webhook %s: %s\n", id, caption)
+
+		// Get the webhook owner
+		userID, err := dbGetWebhookOwner(id)
+		if err != nil {
+			fmt.Printf("ERROR: Failed to find webhook owner for ID %s: %v\n", id, err)
+			apiError(w, "Webhook not found", http.StatusNotFound)
+			return
+		}
+
+		userEmail, err := dbGetUserEmailByID(userID)
+		if err != nil {
+			fmt.Printf("ERROR: Failed to find user email for ID %d: %v\n", userID, err)
+			apiError(w, "User not found", http.StatusNotFound)
+			return
+		}
+
+		fmt.Printf("DEBUG: Webhook %s belongs to user %s\n", id, userEmail)
+
+		wh, err := dbGetWebhook(userID, id)
+		if err != nil {
+			fmt.Printf("ERROR: Failed to load webhook %s: %v\n", id, err)
+			apiError(w, "Webhook not found", http.StatusNotFound)
+			return
+		}
+
+		// Chat JID from payload (chat_id, or legacy groupId)
+		chatID := req.ChatID
+		if chatID == "" {
+			chatID = req.GroupID
+		}
+		if chatID == "" {
+			fmt.Printf("ERROR: No chat_id or groupId provided in payload\n")
+			apiError(w, "Missing chat_id field", http.StatusBadRequest)
+			return
+		}
+
+		switch req.MediaType {
+		case "", "image", "video", "audio", "document":
+		default:
+			apiError(w, "Invalid media_type", http.StatusBadRequest)
+			return
+		}
+
+		// Store inline or remote media as an upload, then send it by media_id
+		var stored *MediaUpload
+		if req.MediaID == "" && hasMedia {
+			// Nothing is fetched or stored for a send that would be refused anyway
+			if dbGetReceiveOnly(userEmail) {
+				writeSendError(w, &SendError{Status: http.StatusForbidden, Code: ERR_RECEIVE_ONLY, Message: "Sending is disabled: account is in receive-only mode"})
+				return
+			}
+			if len(wh.AllowedChats) > 0 {
+				if _, _, sendErr := sendService.resolveAllowedChat(userEmail, chatID, wh.AllowedChats, "webhook "+id); sendErr != nil {
+					writeSendError(w, sendErr)
+					return
+				}
+			}
+			if attachment == nil {
+				attachment, err = openReceiverAttachment(req)
+				if err == errUploadTooLarge {
+					apiError(w, "Media too large", http.StatusRequestEntityTooLarge)
+					return
+				} else if err != nil {
+					fmt.Printf("ERROR: Webhook %s attachment unavailable: %v\n", id, err)
+					apiError(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				defer attachment.body.Close()
+			}
+			upload := MediaUpload{
+				ID:        "med_" + generateWebhookID(),
+				UserID:    userID,
+				Status:    MEDIA_UPLOAD_PENDING,
+				MediaType: req.MediaType,
+				FileName:  attachment.fileName,
+				ExpiresAt: time.Now().Add(MEDIA_UPLOAD_URL_TTL),
+			}
+			if err := dbCreateMediaUpload(upload, ""); err != nil {
+				fmt.Println("ERROR: Could not create media upload", err)
+				apiError(w, "Failed to store media", http.StatusInternalServerError)
+				return
+			}
+			if err := storeMediaUpload(mediaDir, &upload, attachment.body, attachment.mimeType); err != nil {
+				discardMediaUpload(upload)
+				switch err {
+				case errUploadTooLarge:
+					apiError(w, "Media too large", http.StatusRequestEntityTooLarge)
+				case errEmptyUpload:
+					apiError(w, "Empty media", http.StatusBadRequest)
+				default:
+					fmt.Printf("ERROR: Could not store media for webhook %s: %v\n", id, err)
+					apiError(w, "Failed to store media", http.StatusBadGateway)
+				}
+				return
+			}
+			stored = &upload
+			req.MediaID = upload.ID
+		}
+
+		result, err := sendService.Enqueue(SendRequest{
+			UserEmail:    userEmail,
+			ChatJID:      chatID,
+			Message:      caption,
+			MediaID:      req.MediaID,
+			CallbackURL:  req.CallbackURL,
+			AllowedChats: wh.AllowedChats,
+			Source:       "webhook " + id,
+			ExpiresIn:    req.ExpiresIn,
+			GroupKey:     req.GroupKey,
+		})
+		if err != nil {
+			if stored != nil {
+				discardMediaUpload(*stored)
+			}
+			writeSendError(w, err)
+			return
+		}
+
+		// Return immediate queue response
+		response := sendResultResponse(result)
+		response["chat_id"] = result.Message.ChatJID
+		if result.Message.MediaID != "" {
+			response["media_id"] = result.Message.MediaID
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// Parse a JSON or multipart/form-data receiver request. For multipart requests
+// a "file" part is returned as the attachment.
+func parseReceiverRequest(w http.ResponseWriter, r *http.Request) (receiverRequest, *receiverAttachment, error) {
+	var req receiverRequest
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "multipart/form-data" {
+		// Room for media_base64 of the largest upload
+		limit := maxUploadBytes()*4/3 + 1<<20
+		if err := decodeJSONLimited(w, r, &req, limit); err != nil {
+			if err == io.EOF {
+				return req, nil, errors.New("Invalid JSON")
+			}
+			return req, nil, err
+		}
+		return req, nil, nil
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadBytes()+1<<20)
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		return req, nil, errors.New("Invalid multipart form")
+	}
+	for field, dest := range map[string]*string{
+		"chat_id": &req.ChatID, "groupId": &req.GroupID, "message": &req.Message, "caption": &req.Caption,
+		"callback_url": &req.CallbackURL, "media_id": &req.MediaID, "media_url": &req.MediaURL, "media_base64": &req.MediaBase64,
+		"media_type": &req.MediaType, "file_name": &req.FileName, "mime_type": &req.MimeType, "group_key": &req.GroupKey,
+	} {
+		*dest = r.FormValue(field)
+	}
+	if value := r.FormValue("expires_in"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return req, nil, errors.New("Invalid expires_in")
+		}
+		req.ExpiresIn = n
+	}
+	file, header, err := r.FormFile("file")
+	if err == http.ErrMissingFile {
+		return req, nil, nil
+	} else if err != nil {
+		return req, nil, errors.New("Invalid file part")
+	}
+	attachment := &receiverAttachment{
+		body:     file,
+		mimeType: header.Header.Get("Content-Type"),
+		fileName: filepath.Base(header.Filename),
+	}
+	if req.MimeType != "" {
+		attachment.mimeType = req.MimeType
+	}
+	if req.FileName != "" {
+		attachment.fileName = filepath.Base(req.FileName)
+	}
+	return req, attachment, nil
+}
+
+// Open the media referenced by media_base64 or media_url
+func openReceiverAttachment(req receiverRequest) (*receiverAttachment, error) {
+	attachment := &receiverAttachment{mimeType: req.MimeType}
+	if req.FileName != "" {
+		attachment.fileName = filepath.Base(req.FileName)
+	}
+
+	if req.MediaBase64 != "" {
+		data := req.MediaBase64
+		// Accept data URIs ("data:image/png;base64,...")
+		if strings.HasPrefix(data, "data:") {
+			meta, payload, ok := strings.Cut(strings.TrimPrefix(data, "data:"), ",")
+			if !ok || !strings.HasSuffix(meta, ";base64") {
+				return nil, errors.New("Invalid media_base64 data URI")
+			}
+			if attachment.mimeType == "" {
+				attachment.mimeType = strings.TrimSuffix(meta, ";base64")
+			}
+			data = payload
+		}
+		decoded, err := base64.StdEncoding.DecodeString(data)
+		if err != nil {
+			return nil, errors.New("Invalid media_base64")
+		}
+		attachment.body = io.NopCloser(bytes.NewReader(decoded))
+		return attachment, nil
+	}
+
+	u, err := url.Parse(req.MediaURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, errors.New("Invalid media_url")
+	}
+	resp, err := mediaFetchClient.Get(u.String())
+	if err != nil {
+		return nil, fmt.Errorf("Failed to fetch media_url: %v", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("Failed to fetch media_url: status %d", resp.StatusCode)
+	}
+	if resp.ContentLength > maxUploadBytes() {
+		resp.Body.Close()
+		return nil, errUploadTooLarge
+	}
+	attachment.body = resp.Body
+	if attachment.mimeType == "" {
+		attachment.mimeType, _, _ = mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	}
+	if attachment.fileName == "" {
+		if name := path.Base(u.Path); name != "/" && name != "." {
+			attachment.fileName = name
+		}
+	}
+	return attachment, nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestWebhookReceiverAttachments(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+
+	email := "receivermedia@example.com"
+	_, apiKey := registerWithAPIKey(t, ts, email, "receivermediapass123")
+	sendService.isConnected = func(string) bool { return true }
+	dbSetQueuePaused(email, true)
+	defer func() {
+		sendService.isConnected = isUserWAConnected
+		queueMutex.Lock()
+		delete(messageQueues, email)
+		queueMutex.Unlock()
+	}()
+	userID, _ := getUserIDByEmail(email)
+
+	var created map[string]interface{}
+	apiRequest(t, "POST", ts.URL+"/api/webhooks/create", apiKey, map[string]interface{}{
+		"url": "http://example.com/hook", "method": "POST",
+	}, &created)
+	id, _ := created["id"].(string)
+
+	pdf := []byte("%PDF-1.4 test document")
+	var fetches atomic.Int32
+	files := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Write(pdf)
+	}))
+	defer files.Close()
+
+	// Checks the response and the stored upload it refers to
+	expectMedia := func(name string, resp *http.Response, mediaType, mimeType string) {
+		t.Helper()
+		var data map[string]interface{}
+		json.NewDecoder(resp.Body).Decode(&data)
+		mediaID, _ := data["media_id"].(string)
+		if resp.StatusCode != 200 || mediaID == "" {
+			t.Fatalf("%s: expected queued media, got %d %v", name, resp.StatusCode, data)
+		}
+		upload, err := dbGetMediaUpload(userID, mediaID)
+		if err != nil || upload.Status != MEDIA_UPLOAD_COMPLETED || upload.MediaType != mediaType || upload.MimeType != mimeType {
+			t.Fatalf("%s: unexpected upload %+v %v", name, upload, err)
+		}
+	}
+
+	resp := apiRequest(t, "POST", ts.URL+"/webhook/"+id, "", map[string]string{
+		"chat_id": "123@s.whatsapp.net", "media_url": files.URL + "/report.pdf", "caption": "Monthly report",
+	}, nil)
+	expectMedia("media_url", resp, "document", "application/pdf")
+
+	png := []byte("\x89PNG\r\n\x1a\n0000")
+	resp = apiRequest(t, "POST", ts.URL+"/webhook/"+id, "", map[string]string{
+		"chat_id": "123@s.whatsapp.net", "media_base64": "data:image/png;base64," + base64.StdEncoding.EncodeToString(png),
+	}, nil)
+	expectMedia("media_base64", resp, "image", "image/png")
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("chat_id", "123@s.whatsapp.net")
+	mw.WriteField("message", "See attached")
+	fw, _ := mw.CreateFormFile("file", "invoice.pdf")
+	fw.Write(pdf)
+	mw.Close()
+	req, _ := http.NewRequest("POST", ts.URL+"/webhook/"+id, &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Multipart request failed: %v", err)
+	}
+	expectMedia("multipart", resp, "document", "application/pdf")
+
+	// Invalid attachments are rejected before anything is queued
+	for _, payload := range []map[string]string{
+		{"chat_id": "123@s.whatsapp.net", "media_base64": "not base64!"},
+		{"chat_id": "123@s.whatsapp.net", "media_url": "ftp://example.com/file.pdf"},
+		{"chat_id": "123@s.whatsapp.net", "media_url": files.URL, "media_type": "sticker"},
+	} {
+		resp = apiRequest(t, "POST", ts.URL+"/webhook/"+id, "", payload, nil)
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("Expected 400 for %v, got %d", payload, resp.StatusCode)
+		}
+	}
+
+	// A chat the webhook may not send to is refused before the media is fetched or stored
+	if resp := apiRequest(t, "POST", ts.URL+"/api/webhooks/"+id+"/allowed-chats", apiKey, map[string]interface{}{
+		"allowed_chats": []string{"123@s.whatsapp.net"},
+	}, nil); resp.StatusCode != 200 {
+		t.Fatalf("Set allowed chats failed, status: %d", resp.StatusCode)
+	}
+	fetched := fetches.Load()
+	resp = apiRequest(t, "POST", ts.URL+"/webhook/"+id, "", map[string]string{
+		"chat_id": "456@s.whatsapp.net", "media_url": files.URL + "/report.pdf",
+	}, nil)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected 403 for a chat that is not allowed, got %d", resp.StatusCode)
+	}
+	var uploads int
+	db.QueryRow(`SELECT COUNT(*) FROM media_uploads WHERE user_id = ?`, userID).Scan(&uploads)
+	if fetches.Load() != fetched || uploads != 3 {
+		t.Fatalf("Expected no fetch or upload for a refused chat, got %d fetches and %d uploads", fetches.Load()-fetched, uploads-3)
+	}
+}
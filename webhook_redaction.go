@@ -0,0 +1,208 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// --- Webhook payload redaction ---
+// A webhook can list redaction rules in "redact", so analytics receivers can be fed
+// without exposing personal data. Rules apply to what the webhook is sent (and to its
+// logs and stored full payloads); the message archive keeps the unredacted copy.
+//   - "mask_phone": phone numbers in JIDs and message text keep only their last 4 digits
+//   - "strip_names": contact names are removed
+//   - "hash_jids": JIDs are replaced by a keyed hash, stable per webhook
+
+const (
+	REDACT_MASK_PHONE  = "mask_phone"
+	REDACT_STRIP_NAMES = "strip_names"
+	REDACT_HASH_JIDS   = "hash_jids"
+	PHONE_VISIBLE      = 4 // Trailing digits left by mask_phone
+)
+
+var webhookRedactRules = map[string]bool{
+	REDACT_MASK_PHONE:  true,
+	REDACT_STRIP_NAMES: true,
+	REDACT_HASH_JIDS:   true,
+}
+
+// Payload fields holding a JID (also inside nested messages of events)
+var jidPayloadFields = map[string]bool{
+	"from": true, "to": true, "from_lid": true, "to_lid": true, "chat_jid": true,
+}
+
+// Payload fields holding a contact name
+var namePayloadFields = map[string]bool{
+	"name": true, "push_name": true, "contact_name": true,
+}
+
+// Free text that may quote phone numbers
+var textPayloadFields = map[string]bool{
+	"text": true, "caption": true, "ocr_text": true, "document_text": true,
+}
+
+// International or local phone numbers: 7+ digits, optionally with +, spaces, dots, dashes or parentheses
+var phoneNumberRegex = regexp.MustCompile(`\+?\d[\d\s.\-()]{5,}\d`)
+
+// Validate and dedupe a webhook's redaction rules
+func normalizeWebhookRedact(rules []string) ([]string, error) {
+	result := []string{}
+	seen := map[string]bool{}
+	for _, rule := range rules {
+		rule = strings.ToLower(strings.TrimSpace(rule))
+		if rule == "" || seen[rule] {
+			continue
+		}
+		if !webhookRedactRules[rule] {
+			return nil, fmt.Errorf("Unknown redaction rule: %q", rule)
+		}
+		seen[rule] = true
+		result = append(result, rule)
+	}
+	return result, nil
+}
+
+// Replace all but the last PHONE_VISIBLE digits with "*", keeping separators
+func maskDigits(s string) string {
+	digits := 0
+	for _, c := range s {
+		if c >= '0' && c <= '9' {
+			digits++
+		}
+	}
+	out := []byte(s)
+	for i := range out {
+		if out[i] >= '0' && out[i] <= '9' {
+			if digits > PHONE_VISIBLE {
+				out[i] = '*'
+			}
+			digits--
+		}
+	}
+	return string(out)
+}
+
+// Mask the user part of a phone-number JID ("14155550123@s.whatsapp.net" -> "*******0123@s.whatsapp.net").
+// Group IDs and LIDs are not phone numbers and are left as they are.
+func maskJIDPhone(jid string) string {
+	user, server, ok := strings.Cut(jid, "@")
+	if !ok {
+		return maskDigits(jid)
+	}
+	if server != "s.whatsapp.net" && server != "c.us" {
+		return jid
+	}
+	device := ""
+	if i := strings.IndexAny(user, ":."); i >= 0 {
+		user, device = user[:i], user[i:]
+	}
+	return maskDigits(user) + device + "@" + server
+}
+
+// Keyed hash of a JID; the server part is kept so receivers can still tell groups from direct chats
+func hashJID(key, jid string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(jid))
+	sum := hex.EncodeToString(mac.Sum(nil))[:32]
+	if _, server, ok := strings.Cut(jid, "@"); ok {
+		return sum + "@" + server
+	}
+	return sum
+}
+
+// Payload to send to a webhook after applying its redaction rules. Returns a copy
+// (nested maps included); the payload itself is left untouched for the archive.
+func redactWebhookPayload(wh Webhook, payload map[string]interface{}) map[string]interface{} {
+	if len(wh.Redact) == 0 {
+		return payload
+	}
+	rules := map[string]bool{}
+	for _, r := range wh.Redact {
+		rules[r] = true
+	}
+	return redactMap(wh.ID, rules, payload)
+}
+
+func redactMap(key string, rules map[string]bool, m map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		if rules[REDACT_STRIP_NAMES] && namePayloadFields[k] {
+			continue
+		}
+		switch val := v.(type) {
+		case map[string]interface{}:
+			out[k] = redactMap(key, rules, val)
+		case string:
+			switch {
+			case jidPayloadFields[k] && val != "" && rules[REDACT_HASH_JIDS]:
+				out[k] = hashJID(key, val)
+			case jidPayloadFields[k] && rules[REDACT_MASK_PHONE]:
+				out[k] = maskJIDPhone(val)
+			case textPayloadFields[k] && rules[REDACT_MASK_PHONE]:
+				out[k] = phoneNumberRegex.ReplaceAllStringFunc(val, maskDigits)
+			default:
+				out[k] = val
+			}
+		default:
+			out[k] = v
+		}
+	}
+	return out
+}
+
+func dbSetWebhookRedact(userID int64, webhookID string, rules []string) (bool, error) {
+	defer invalidateWebhooksCache(userID)
+	res, err := db.Exec(`UPDATE webhooks SET redact = ? WHERE user_id = ? AND id = ?`, strings.Join(rules, ","), userID, webhookID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// POST /api/webhooks/{id}/redaction {"redact": ["mask_phone", "strip_names", "hash_jids"]}
+// An empty list turns redaction off.
+func handleSetWebhookRedaction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID := r.Context().Value("userID").(int64)
+
+	var req struct {
+		Redact []string `json:"redact"`
+	}
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	rules, err := normalizeWebhookRedact(req.Redact)
+	if err != nil {
+		apiError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	webhookID := r.PathValue("id")
+	updated, err := dbSetWebhookRedact(userID, webhookID, rules)
+	if err != nil {
+		fmt.Println("ERROR: Could not update webhook redaction", err)
+		apiError(w, "Failed to update redaction", http.StatusInternalServerError)
+		return
+	}
+	if !updated {
+		apiError(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"id":      webhookID,
+		"redact":  rules,
+	})
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRedactWebhookPayload(t *testing.T) {
+	payload := map[string]interface{}{
+		"from":      "14155550123@s.whatsapp.net",
+		"to":        "120363025246125486@g.us",
+		"from_lid":  "98765432109876@lid",
+		"name":      "Alice",
+		"text":      "Call me at +1 415-555-0199 tomorrow",
+		"timestamp": int64(1700000000),
+		"message":   map[string]interface{}{"from": "14155550123@s.whatsapp.net", "name": "Alice"},
+	}
+
+	masked := redactWebhookPayload(Webhook{ID: "w1", Redact: []string{REDACT_MASK_PHONE, REDACT_STRIP_NAMES}}, payload)
+	if masked["from"] != "*******0123@s.whatsapp.net" {
+		t.Fatalf("Unexpected masked from: %v", masked["from"])
+	}
+	if masked["to"] != payload["to"] || masked["from_lid"] != payload["from_lid"] {
+		t.Fatalf("Group IDs and LIDs should not be masked: %v %v", masked["to"], masked["from_lid"])
+	}
+	if masked["text"] != "Call me at +* ***-***-0199 tomorrow" {
+		t.Fatalf("Unexpected masked text: %v", masked["text"])
+	}
+	if _, ok := masked["name"]; ok {
+		t.Fatal("Name should be stripped")
+	}
+	nested := masked["message"].(map[string]interface{})
+	if _, ok := nested["name"]; ok || nested["from"] != "*******0123@s.whatsapp.net" {
+		t.Fatalf("Nested message not redacted: %v", nested)
+	}
+	if masked["timestamp"] != int64(1700000000) {
+		t.Fatal("Other fields should be kept")
+	}
+
+	// The original stays unredacted for the archive
+	if payload["from"] != "14155550123@s.whatsapp.net" || payload["name"] != "Alice" {
+		t.Fatalf("Original payload was modified: %v", payload)
+	}
+
+	hashed := redactWebhookPayload(Webhook{ID: "w1", Redact: []string{REDACT_HASH_JIDS, REDACT_MASK_PHONE}}, payload)
+	from, _ := hashed["from"].(string)
+	if strings.Contains(from, "4155550123") || !strings.HasSuffix(from, "@s.whatsapp.net") {
+		t.Fatalf("Unexpected hashed from: %q", from)
+	}
+	if again := redactWebhookPayload(Webhook{ID: "w1", Redact: []string{REDACT_HASH_JIDS}}, payload); again["from"] != from {
+		t.Fatal("Hashes should be stable per webhook")
+	}
+	if other := redactWebhookPayload(Webhook{ID: "w2", Redact: []string{REDACT_HASH_JIDS}}, payload); other["from"] == from {
+		t.Fatal("Hashes should differ between webhooks")
+	}
+
+	if out := redactWebhookPayload(Webhook{ID: "w1"}, payload); out["name"] != "Alice" {
+		t.Fatal("Webhooks without rules get the payload unchanged")
+	}
+}
+
+func TestNormalizeWebhookRedact(t *testing.T) {
+	rules, err := normalizeWebhookRedact([]string{" Mask_Phone ", "hash_jids", "mask_phone", ""})
+	if err != nil || len(rules) != 2 || rules[0] != REDACT_MASK_PHONE || rules[1] != REDACT_HASH_JIDS {
+		t.Fatalf("Unexpected rules %v (%v)", rules, err)
+	}
+	if _, err := normalizeWebhookRedact([]string{"strip_everything"}); err == nil {
+		t.Fatal("Expected an error for an unknown rule")
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// --- Webhook response capture ---
+// What each destination answered is kept with the delivery's log entry, so a receiver
+// rejecting payloads (a 422 with validation errors, say) can be seen in the logs.
+// Bodies and header values are truncated; URLs are logged as configured, with
+// {{secret.NAME}} references unresolved.
+
+const (
+	MAX_LOGGED_RESPONSE_BODY   = 2048
+	MAX_LOGGED_RESPONSE_HEADER = 256
+)
+
+type WebhookResponse struct {
+	Destination int               `json:"destination"` // Index in url followed by urls
+	URL         string            `json:"url"`
+	Status      int               `json:"status,omitempty"` // 0 when no response came back
+	Headers     map[string]string `json:"headers,omitempty"`
+	Body        string            `json:"body,omitempty"`
+	Truncated   bool              `json:"truncated,omitempty"`
+	Error       string            `json:"error,omitempty"`
+	DurationMs  int64             `json:"duration_ms"`
+}
+
+// Record a destination's answer; resp is nil when the request failed
+func captureWebhookResponse(destination int, resp *http.Response, body []byte, start time.Time, err error) WebhookResponse {
+	r := WebhookResponse{Destination: destination, DurationMs: time.Since(start).Milliseconds()}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	if resp == nil {
+		return r
+	}
+	r.Status = resp.StatusCode
+	r.Headers = make(map[string]string, len(resp.Header))
+	for name, values := range resp.Header {
+		r.Headers[name], _ = truncateLogged(strings.Join(values, ", "), MAX_LOGGED_RESPONSE_HEADER)
+	}
+	r.Body, r.Truncated = truncateLogged(string(body), MAX_LOGGED_RESPONSE_BODY)
+	return r
+}
+
+// Cut s to at most n bytes without splitting a character
+func truncateLogged(s string, n int) (string, bool) {
+	if len(s) <= n {
+		return s, false
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n], true
+}
+
+// Log the configured URLs rather than the resolved ones, which may hold secrets
+func loggedResponses(wh Webhook, responses []WebhookResponse) []WebhookResponse {
+	urls := webhookDestinations(wh)
+	for i := range responses {
+		if d := responses[i].Destination; d >= 0 && d < len(urls) {
+			responses[i].URL = urls[d]
+		}
+	}
+	return responses
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWebhookResponseCapture(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+
+	email := "responses@example.com"
+	_, apiKey := registerWithAPIKey(t, ts, email, "responsespass123")
+
+	rejecting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Request-Id", "req-42")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte(`{"error": "field 'customer_id' is required"}` + strings.Repeat(" ", MAX_LOGGED_RESPONSE_BODY)))
+	}))
+	defer rejecting.Close()
+	accepting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer accepting.Close()
+
+	apiRequest(t, "POST", ts.URL+"/api/secrets", apiKey, map[string]string{"name": "BACKUP_TOKEN", "value": "s3cr3t"}, nil)
+	backupURL := accepting.URL + "/?token={{secret.BACKUP_TOKEN}}"
+	var wh Webhook
+	if resp := apiRequest(t, "POST", ts.URL+"/api/webhooks/create", apiKey, map[string]interface{}{
+		"url": rejecting.URL, "urls": []string{backupURL}, "method": "POST", "delivery_policy": DELIVERY_FIRST_SUCCESS,
+	}, &wh); resp.StatusCode != 200 {
+		t.Fatalf("Create webhook failed, status: %d", resp.StatusCode)
+	}
+
+	chat := "5551234@s.whatsapp.net"
+	forwardToWebhooks(email, map[string]interface{}{"from": chat, "to": chat, "type": "text", "text": "hello"}, "", "test_media")
+
+	var logs []WebhookLogEntry
+	apiRequest(t, "GET", ts.URL+"/api/webhooks/logs?id="+wh.ID, apiKey, nil, &logs)
+	if len(logs) != 1 || len(logs[0].Responses) != 2 {
+		t.Fatalf("Expected one log entry with both answers, got %+v", logs)
+	}
+	rejected, accepted := logs[0].Responses[0], logs[0].Responses[1]
+	if rejected.Status != http.StatusUnprocessableEntity || rejected.Headers["X-Request-Id"] != "req-42" || rejected.Error == "" {
+		t.Fatalf("Unexpected rejected answer: %+v", rejected)
+	}
+	if !strings.HasPrefix(rejected.Body, `{"error": "field 'customer_id' is required"}`) || !rejected.Truncated || len(rejected.Body) != MAX_LOGGED_RESPONSE_BODY {
+		t.Fatalf("Expected the truncated validation error, got %q", rejected.Body)
+	}
+	if accepted.Destination != 1 || accepted.Status != 200 || accepted.Body != "ok" || accepted.Error != "" {
+		t.Fatalf("Unexpected accepted answer: %+v", accepted)
+	}
+	// The secret isn't written to the log
+	if accepted.URL != backupURL {
+		t.Fatalf("Expected the configured URL, got %s", accepted.URL)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// --- Keyword routing ---
+// Webhooks with keywords or a match_regex are routes: a message goes to the first
+// route (by priority, lowest first) whose rule matches its text, and to no other
+// route. Fallback webhooks receive the messages no route matched. Webhooks without
+// rules keep receiving every message their chat filter accepts.
+
+const (
+	MAX_WEBHOOK_KEYWORDS    = 50
+	MAX_WEBHOOK_REGEX_BYTES = 500
+)
+
+// Compiled match_regex patterns, by pattern
+var webhookRegexCache sync.Map
+
+func compileWebhookRegex(pattern string) (*regexp.Regexp, error) {
+	if re, ok := webhookRegexCache.Load(pattern); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	webhookRegexCache.Store(pattern, re)
+	return re, nil
+}
+
+// Validate and normalize a webhook's routing rule
+func normalizeWebhookRouting(wh *Webhook) error {
+	keywords := []string{}
+	seen := map[string]bool{}
+	for _, k := range wh.Keywords {
+		k = normalizeSearchText(k)
+		if k == "" || seen[k] {
+			continue
+		}
+		seen[k] = true
+		keywords = append(keywords, k)
+	}
+	if len(keywords) > MAX_WEBHOOK_KEYWORDS {
+		return fmt.Errorf("Too many keywords (max %d)", MAX_WEBHOOK_KEYWORDS)
+	}
+	wh.Keywords = keywords
+	if len(wh.MatchRegex) > MAX_WEBHOOK_REGEX_BYTES {
+		return fmt.Errorf("match_regex too long (max %d bytes)", MAX_WEBHOOK_REGEX_BYTES)
+	}
+	if wh.MatchRegex != "" {
+		if _, err := compileWebhookRegex(wh.MatchRegex); err != nil {
+			return fmt.Errorf("Invalid match_regex: %v", err)
+		}
+	}
+	if wh.Fallback && isWebhookRoute(*wh) {
+		return fmt.Errorf("A fallback webhook cannot have keywords or match_regex")
+	}
+	return nil
+}
+
+// Whether the webhook routes by keyword or regex
+func isWebhookRoute(wh Webhook) bool {
+	return len(wh.Keywords) > 0 || wh.MatchRegex != ""
+}
+
+// Whether a route's rule matches the message text (keywords as whole words, case-insensitive)
+func webhookRouteMatches(wh Webhook, text string) bool {
+	padded := " " + normalizeSearchText(text) + " "
+	for _, k := range wh.Keywords {
+		if strings.Contains(padded, " "+k+" ") {
+			return true
+		}
+	}
+	if wh.MatchRegex != "" {
+		if re, err := compileWebhookRegex(wh.MatchRegex); err == nil && re.MatchString(text) {
+			return true
+		}
+	}
+	return false
+}
+
+// The webhooks a message is delivered to, among unpaused, verified webhooks whose chat filter
+// accepts it: plain webhooks, plus the first matching route or else the fallbacks.
+func selectWebhooksForMessage(webhooks []Webhook, chatJID, chatLID, text string) []Webhook {
+	var selected, routes, fallbacks []Webhook
+	for _, wh := range webhooks {
+		if wh.Paused || wh.Unverified || !webhookMatchesChat(wh, chatJID, chatLID) {
+			continue
+		}
+		switch {
+		case isWebhookRoute(wh):
+			routes = append(routes, wh)
+		case wh.Fallback:
+			fallbacks = append(fallbacks, wh)
+		default:
+			selected = append(selected, wh)
+		}
+	}
+	// Equal priorities go to the oldest route first
+	sort.SliceStable(routes, func(i, j int) bool {
+		if routes[i].Priority != routes[j].Priority {
+			return routes[i].Priority < routes[j].Priority
+		}
+		return routes[i].CreatedAt.Before(routes[j].CreatedAt)
+	})
+	for _, wh := range routes {
+		if webhookRouteMatches(wh, text) {
+			fmt.Printf("DEBUG: Message routed to webhook %s (priority %d)\n", wh.ID, wh.Priority)
+			return append(selected, wh)
+		}
+	}
+	return append(selected, fallbacks...)
+}
+
+func dbSetWebhookRouting(userID int64, wh Webhook) (bool, error) {
+	defer invalidateWebhooksCache(userID)
+	res, err := db.Exec(`UPDATE webhooks SET keywords = ?, match_regex = ?, priority = ?, fallback = ? WHERE user_id = ? AND id = ?`,
+		strings.Join(wh.Keywords, ","), wh.MatchRegex, wh.Priority, wh.Fallback, userID, wh.ID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// POST /api/webhooks/{id}/routing
+// Replaces the routing rule: {"keywords": [...], "match_regex": "...", "priority": 10, "fallback": false}.
+// Empty keywords and match_regex make the webhook a plain (non-route) webhook again.
+func handleSetWebhookRouting(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID := r.Context().Value("userID").(int64)
+
+	var req struct {
+		Keywords   []string `json:"keywords"`
+		MatchRegex string   `json:"match_regex"`
+		Priority   int      `json:"priority"`
+		Fallback   bool     `json:"fallback"`
+	}
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	wh := Webhook{ID: r.PathValue("id"), Keywords: req.Keywords, MatchRegex: req.MatchRegex, Priority: req.Priority, Fallback: req.Fallback}
+	if err := normalizeWebhookRouting(&wh); err != nil {
+		apiError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	updated, err := dbSetWebhookRouting(userID, wh)
+	if err != nil {
+		fmt.Println("ERROR: Could not update webhook routing", err)
+		apiError(w, "Failed to update routing", http.StatusInternalServerError)
+		return
+	}
+	if !updated {
+		apiError(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":     true,
+		"id":          wh.ID,
+		"keywords":    wh.Keywords,
+		"match_regex": wh.MatchRegex,
+		"priority":    wh.Priority,
+		"fallback":    wh.Fallback,
+	})
+}
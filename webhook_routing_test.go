@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWebhookKeywordRouting(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+
+	email := "router@example.com"
+	_, apiKey := registerWithAPIKey(t, ts, email, "routerpass123")
+
+	ok := int32(200)
+	finance, financeHits := countingReceiver(&ok)
+	defer finance.Close()
+	helpdesk, helpdeskHits := countingReceiver(&ok)
+	defer helpdesk.Close()
+	fallback, fallbackHits := countingReceiver(&ok)
+	defer fallback.Close()
+	mirror, mirrorHits := countingReceiver(&ok)
+	defer mirror.Close()
+
+	create := func(body map[string]interface{}) string {
+		t.Helper()
+		body["method"] = "POST"
+		var created map[string]interface{}
+		resp := apiRequest(t, "POST", ts.URL+"/api/webhooks/create", apiKey, body, &created)
+		if resp.StatusCode != 200 {
+			t.Fatalf("Create webhook failed, status: %d", resp.StatusCode)
+		}
+		return created["id"].(string)
+	}
+	create(map[string]interface{}{"url": finance.URL, "keywords": []string{"Invoice", "billing"}, "priority": 10})
+	helpdeskID := create(map[string]interface{}{"url": helpdesk.URL, "match_regex": `(?i)\bsupport\b|ticket #\d+`, "priority": 20})
+	create(map[string]interface{}{"url": fallback.URL, "fallback": true})
+	create(map[string]interface{}{"url": mirror.URL})
+
+	invalid := []map[string]interface{}{
+		{"url": "https://x.example.com", "method": "POST", "match_regex": "(unclosed"},
+		{"url": "https://x.example.com", "method": "POST", "keywords": []string{"refund"}, "fallback": true},
+	}
+	for _, body := range invalid {
+		if resp := apiRequest(t, "POST", ts.URL+"/api/webhooks/create", apiKey, body, nil); resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("Expected 400 for %v, got %d", body, resp.StatusCode)
+		}
+	}
+
+	receive := func(text string) {
+		forwardToWebhooks(email, map[string]interface{}{"id": text, "from": "14155550000@s.whatsapp.net", "to": "14155550000@s.whatsapp.net",
+			"type": "text", "text": text, "timestamp": time.Now().Unix()}, "", "test_media")
+	}
+	expect := func(name string, hits *int32, want int32) {
+		t.Helper()
+		if got := atomic.LoadInt32(hits); got != want {
+			t.Errorf("%s: expected %d deliveries, got %d", name, want, got)
+		}
+	}
+
+	receive("Where is my INVOICE?")              // Finance
+	receive("I need support with billing")       // Both match: finance wins on priority
+	receive("Re: ticket #42")                    // Helpdesk
+	receive("Just saying hi, invoices attached") // No whole-word match: fallback
+	expect("finance", financeHits, 2)
+	expect("helpdesk", helpdeskHits, 1)
+	expect("fallback", fallbackHits, 1)
+	expect("mirror", mirrorHits, 4)
+
+	// Raising the helpdesk route above finance changes the winner
+	var updated map[string]interface{}
+	resp := apiRequest(t, "POST", ts.URL+"/api/webhooks/"+helpdeskID+"/routing", apiKey, map[string]interface{}{
+		"match_regex": `(?i)\bsupport\b`, "priority": 5,
+	}, &updated)
+	if resp.StatusCode != 200 {
+		t.Fatalf("Update routing failed, status: %d", resp.StatusCode)
+	}
+	receive("support for billing please")
+	expect("finance", financeHits, 2)
+	expect("helpdesk", helpdeskHits, 2)
+
+	if resp := apiRequest(t, "POST", ts.URL+"/api/webhooks/nope/routing", apiKey, map[string]interface{}{"keywords": []string{"x"}}, nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected 404 for unknown webhook, got %d", resp.StatusCode)
+	}
+}
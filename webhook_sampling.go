@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+)
+
+// --- Sampled forwarding ---
+// A webhook with a sample_rate (e.g. 0.1) receives only that share of the messages it
+// matches, for analytics receivers that don't need every event. Whether a message is
+// sampled depends only on its chat and ID, so every replica (and every webhook with the
+// same rate) picks the same messages, and a redelivered message is picked again.
+
+func validateWebhookSampleRate(rate float64) error {
+	if math.IsNaN(rate) || rate < 0 || rate > 1 {
+		return errors.New("sample_rate must be between 0 and 1 (0 = every message)")
+	}
+	return nil
+}
+
+// Where a message falls in [0, 1), from a hash of its chat and ID
+func messageSamplePoint(chatJID, messageID string) float64 {
+	sum := sha256.Sum256([]byte(chatJID + "\x00" + messageID))
+	return float64(binary.BigEndian.Uint64(sum[:8])>>11) / (1 << 53)
+}
+
+// Whether a webhook receives a message under its sample rate
+func webhookSamples(wh Webhook, chatJID, messageID string) bool {
+	if wh.SampleRate <= 0 || wh.SampleRate >= 1 {
+		return true
+	}
+	return messageSamplePoint(chatJID, messageID) < wh.SampleRate
+}
+
+func dbSetWebhookSampleRate(userID int64, webhookID string, rate float64) (bool, error) {
+	defer invalidateWebhooksCache(userID)
+	res, err := db.Exec(`UPDATE webhooks SET sample_rate = ? WHERE user_id = ? AND id = ?`, rate, userID, webhookID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// POST /api/webhooks/{id}/sampling {"sample_rate": 0.1}
+func handleSetWebhookSampling(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID := r.Context().Value("userID").(int64)
+
+	var req struct {
+		SampleRate float64 `json:"sample_rate"`
+	}
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	if err := validateWebhookSampleRate(req.SampleRate); err != nil {
+		apiError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	webhookID := r.PathValue("id")
+	updated, err := dbSetWebhookSampleRate(userID, webhookID, req.SampleRate)
+	if err != nil {
+		fmt.Println("ERROR: Could not update webhook sample rate", err)
+		apiError(w, "Failed to update sample rate", http.StatusInternalServerError)
+		return
+	}
+	if !updated {
+		apiError(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":     true,
+		"id":          webhookID,
+		"sample_rate": req.SampleRate,
+	})
+}
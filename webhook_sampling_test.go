@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestWebhookSampling(t *testing.T) {
+	tenth := Webhook{SampleRate: 0.1}
+	half := Webhook{SampleRate: 0.5}
+	sampled := 0
+	for i := 0; i < 10000; i++ {
+		id := fmt.Sprintf("3EB0%08X", i)
+		in := webhookSamples(tenth, "14155550000@s.whatsapp.net", id)
+		if in != webhookSamples(tenth, "14155550000@s.whatsapp.net", id) {
+			t.Fatalf("Sampling of %s is not deterministic", id)
+		}
+		// A message sampled at a lower rate is sampled at every higher one
+		if in && !webhookSamples(half, "14155550000@s.whatsapp.net", id) {
+			t.Fatalf("Message %s sampled at 10%% but not at 50%%", id)
+		}
+		if in {
+			sampled++
+		}
+	}
+	if sampled < 800 || sampled > 1200 {
+		t.Fatalf("Expected about 1000 of 10000 messages sampled, got %d", sampled)
+	}
+	if !webhookSamples(Webhook{}, "x@s.whatsapp.net", "id") {
+		t.Fatal("Expected a webhook without a sample rate to receive everything")
+	}
+
+	ts, teardown := setupTestServer()
+	defer teardown()
+	_, apiKey := registerWithAPIKey(t, ts, "sampling@example.com", "samplingpass123")
+
+	if resp := apiRequest(t, "POST", ts.URL+"/api/webhooks/create", apiKey, map[string]interface{}{"url": "https://example.com/analytics", "method": "POST", "sample_rate": 1.5}, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for a rate above 1, got %d", resp.StatusCode)
+	}
+	var created map[string]interface{}
+	apiRequest(t, "POST", ts.URL+"/api/webhooks/create", apiKey, map[string]interface{}{"url": "https://example.com/analytics", "method": "POST", "sample_rate": 0.1}, &created)
+	id, _ := created["id"].(string)
+	if created["sample_rate"] != 0.1 {
+		t.Fatalf("Unexpected create response: %v", created)
+	}
+	if resp := apiRequest(t, "POST", ts.URL+"/api/webhooks/"+id+"/sampling", apiKey, map[string]float64{"sample_rate": 0.25}, nil); resp.StatusCode != 200 {
+		t.Fatalf("Setting the sample rate failed: %d", resp.StatusCode)
+	}
+	userID, _ := getUserIDByEmail("sampling@example.com")
+	if wh, err := dbGetWebhook(userID, id); err != nil || wh.SampleRate != 0.25 {
+		t.Fatalf("Expected the stored rate to be 0.25, got %v %v", wh.SampleRate, err)
+	}
+	if resp := apiRequest(t, "POST", ts.URL+"/api/webhooks/missing/sampling", apiKey, map[string]float64{"sample_rate": 0.5}, nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected 404 for an unknown webhook, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Webhook schedules ---
+// A webhook can have a schedule: days of the week and hour ranges, in the schedule's
+// timezone (the user's by default), outside of which it receives no messages. Days and
+// hours are checked separately, so "22:00-06:00" on "mon" covers Monday from midnight
+// to 06:00 and from 22:00 on. Off-hours messages are dropped, or with "buffer" held in
+// the webhook_buffer table and delivered in order once the window opens again.
+
+const (
+	MAX_SCHEDULE_RANGES        = 10
+	MAX_BUFFERED_MESSAGES      = 1000 // Per webhook; later off-hours messages are dropped
+	WEBHOOK_SCHEDULE_INTERVAL  = time.Minute
+	WEBHOOK_BUFFER_FLUSH_BATCH = 100
+)
+
+type WebhookSchedule struct {
+	Days     []string `json:"days,omitempty"`     // "mon" to "sun"; empty = every day
+	Hours    []string `json:"hours,omitempty"`    // "09:00-17:00"; empty = all day
+	Timezone string   `json:"timezone,omitempty"` // IANA zone; empty = the user's timezone
+	Buffer   bool     `json:"buffer,omitempty"`   // Hold off-hours messages for the next window
+}
+
+var scheduleDays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"} // By time.Weekday
+
+// Serializes flushing each webhook's buffer, keyed by webhook ID
+var webhookBufferFlushes sync.Map
+
+// Minutes since midnight of an "HH:MM" time; 24:00 is the end of the day
+func parseScheduleTime(s string) (int, bool) {
+	var h, m int
+	if len(s) != 5 || s[2] != ':' {
+		return 0, false
+	}
+	if _, err := fmt.Sscanf(s, "%d:%d", &h, &m); err != nil || h < 0 || h > 24 || m < 0 || m > 59 || (h == 24 && m != 0) {
+		return 0, false
+	}
+	return h*60 + m, true
+}
+
+func parseScheduleRange(r string) (start, end int, ok bool) {
+	from, to, found := strings.Cut(strings.TrimSpace(r), "-")
+	if !found {
+		return 0, 0, false
+	}
+	start, ok1 := parseScheduleTime(strings.TrimSpace(from))
+	end, ok2 := parseScheduleTime(strings.TrimSpace(to))
+	return start, end, ok1 && ok2 && start != end && start < 24*60
+}
+
+// Validate a schedule, normalizing days to "mon".."sun" in week order and hours to
+// "HH:MM-HH:MM". A nil schedule is valid (always open).
+func normalizeWebhookSchedule(s *WebhookSchedule) error {
+	if s == nil {
+		return nil
+	}
+	if len(s.Days) == 0 && len(s.Hours) == 0 {
+		return errors.New("A schedule needs days or hours (use null to remove it)")
+	}
+	wanted := map[string]bool{}
+	for _, day := range s.Days {
+		day = strings.ToLower(strings.TrimSpace(day))
+		if len(day) >= 3 {
+			day = day[:3]
+		}
+		if !slices.Contains(scheduleDays, day) {
+			return fmt.Errorf("Invalid schedule day: %q", day)
+		}
+		wanted[day] = true
+	}
+	days := []string{}
+	for i := 1; i <= len(scheduleDays); i++ { // Monday first
+		if day := scheduleDays[i%len(scheduleDays)]; wanted[day] {
+			days = append(days, day)
+		}
+	}
+	s.Days = days
+	if len(s.Hours) > MAX_SCHEDULE_RANGES {
+		return fmt.Errorf("Too many schedule hour ranges (max %d)", MAX_SCHEDULE_RANGES)
+	}
+	for i, r := range s.Hours {
+		start, end, ok := parseScheduleRange(r)
+		if !ok {
+			return fmt.Errorf("Invalid schedule hours: %q (expected HH:MM-HH:MM)", r)
+		}
+		s.Hours[i] = fmt.Sprintf("%02d:%02d-%02d:%02d", start/60, start%60, end/60, end%60)
+	}
+	if s.Timezone != "" {
+		if _, err := time.LoadLocation(s.Timezone); err != nil || s.Timezone == "Local" {
+			return fmt.Errorf("Invalid schedule timezone: %q", s.Timezone)
+		}
+	}
+	return nil
+}
+
+// Whether the schedule's window is open at t; userLoc is used without a timezone
+func (s *WebhookSchedule) open(t time.Time, userLoc *time.Location) bool {
+	if s == nil {
+		return true
+	}
+	loc := userLoc
+	if s.Timezone != "" {
+		if l, err := time.LoadLocation(s.Timezone); err == nil {
+			loc = l
+		}
+	}
+	local := t.In(loc)
+	if len(s.Days) > 0 && !slices.Contains(s.Days, scheduleDays[local.Weekday()]) {
+		return false
+	}
+	if len(s.Hours) == 0 {
+		return true
+	}
+	minute := local.Hour()*60 + local.Minute()
+	for _, r := range s.Hours {
+		start, end, ok := parseScheduleRange(r)
+		if !ok {
+			continue
+		}
+		if (start < end && minute >= start && minute < end) || (start > end && (minute >= start || minute < end)) {
+			return true
+		}
+	}
+	return false
+}
+
+func webhookScheduleOpen(userID int64, wh Webhook, t time.Time) bool {
+	if wh.Schedule == nil {
+		return true
+	}
+	return wh.Schedule.open(t, getUserLocation(userID))
+}
+
+func encodeWebhookSchedule(s *WebhookSchedule) (string, error) {
+	if s == nil {
+		return "", nil
+	}
+	data, err := json.Marshal(s)
+	return string(data), err
+}
+
+func decodeWebhookSchedule(data string) *WebhookSchedule {
+	if data == "" {
+		return nil
+	}
+	var s WebhookSchedule
+	if err := json.Unmarshal([]byte(data), &s); err != nil {
+		return nil
+	}
+	return &s
+}
+
+func dbSetWebhookSchedule(userID int64, webhookID string, s *WebhookSchedule) (bool, error) {
+	defer invalidateWebhooksCache(userID)
+	schedule, err := encodeWebhookSchedule(s)
+	if err != nil {
+		return false, err
+	}
+	res, err := db.Exec(`UPDATE webhooks SET schedule = ? WHERE user_id = ? AND id = ?`, schedule, userID, webhookID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func dbCountBufferedMessages(webhookID string) (int, error) {
+	var n int
+	err := readDB.QueryRow(`SELECT COUNT(*) FROM webhook_buffer WHERE webhook_id = ?`, webhookID).Scan(&n)
+	return n, err
+}
+
+// Hold an off-hours message for a buffering webhook, or drop it
+func holdOffHoursMessage(userID int64, wh Webhook, payload map[string]interface{}) {
+	if !wh.Schedule.Buffer {
+		fmt.Printf("DEBUG: Webhook %s is outside its schedule, message dropped\n", wh.ID)
+		return
+	}
+	n, err := dbCountBufferedMessages(wh.ID)
+	if err != nil {
+		fmt.Printf("ERROR: Could not count buffered messages for webhook %s: %v\n", wh.ID, err)
+		return
+	}
+	if n >= MAX_BUFFERED_MESSAGES {
+		fmt.Printf("WARNING: Webhook %s already holds %d off-hours messages, message dropped\n", wh.ID, n)
+		return
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		fmt.Printf("ERROR: Could not encode message for webhook %s: %v\n", wh.ID, err)
+		return
+	}
+	if _, err := db.Exec(`INSERT INTO webhook_buffer (user_id, webhook_id, payload, created_at) VALUES (?, ?, ?, ?)`,
+		userID, wh.ID, string(data), time.Now().Unix()); err != nil {
+		fmt.Printf("ERROR: Could not buffer message for webhook %s: %v\n", wh.ID, err)
+		return
+	}
+	fmt.Printf("DEBUG: Webhook %s is outside its schedule, message held\n", wh.ID)
+}
+
+// Deliver a webhook's held messages, oldest first. Called with the window open.
+func flushWebhookBuffer(email string, userID int64, wh Webhook, secrets map[string]string) {
+	lock, _ := webhookBufferFlushes.LoadOrStore(wh.ID, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+
+	for {
+		rows, err := db.Query(`SELECT id, payload FROM webhook_buffer WHERE webhook_id = ? ORDER BY id LIMIT ?`, wh.ID, WEBHOOK_BUFFER_FLUSH_BATCH)
+		if err != nil {
+			fmt.Printf("ERROR: Could not load buffered messages for webhook %s: %v\n", wh.ID, err)
+			return
+		}
+		type held struct {
+			id   int64
+			data string
+		}
+		var batch []held
+		for rows.Next() {
+			var h held
+			if err := rows.Scan(&h.id, &h.data); err == nil {
+				batch = append(batch, h)
+			}
+		}
+		rows.Close()
+		if len(batch) == 0 {
+			return
+		}
+		fmt.Printf("INFO: Delivering %d held messages to webhook %s\n", len(batch), wh.ID)
+		for _, h := range batch {
+			// Removed first: a crash mid-flush loses a message rather than sending it twice
+			if _, err := db.Exec(`DELETE FROM webhook_buffer WHERE id = ?`, h.id); err != nil {
+				fmt.Printf("ERROR: Could not remove buffered message %d: %v\n", h.id, err)
+				return
+			}
+			var payload map[string]interface{}
+			if err := json.Unmarshal([]byte(h.data), &payload); err != nil {
+				fmt.Printf("ERROR: Dropping unreadable buffered message %d: %v\n", h.id, err)
+				continue
+			}
+			deliverMessageToWebhook(email, userID, wh, secrets, payload)
+		}
+	}
+}
+
+// Deliver held messages of every webhook whose window is open (or whose schedule
+// was removed); paused and unverified webhooks keep theirs
+func flushWebhookBuffers(now time.Time) {
+	rows, err := db.Query(`SELECT DISTINCT user_id, webhook_id FROM webhook_buffer`)
+	if err != nil {
+		fmt.Println("ERROR: Could not list buffered webhooks", err)
+		return
+	}
+	type pending struct {
+		userID    int64
+		webhookID string
+	}
+	var list []pending
+	for rows.Next() {
+		var p pending
+		if err := rows.Scan(&p.userID, &p.webhookID); err == nil {
+			list = append(list, p)
+		}
+	}
+	rows.Close()
+
+	for _, p := range list {
+		wh, err := dbGetWebhook(p.userID, p.webhookID)
+		if err == sql.ErrNoRows {
+			db.Exec(`DELETE FROM webhook_buffer WHERE webhook_id = ?`, p.webhookID)
+			continue
+		} else if err != nil {
+			fmt.Printf("ERROR: Could not load webhook %s: %v\n", p.webhookID, err)
+			continue
+		}
+		if wh.Paused || wh.Unverified || !webhookScheduleOpen(p.userID, wh, now) {
+			continue
+		}
+		secrets, err := dbGetSecretValues(p.userID)
+		if err != nil {
+			fmt.Printf("ERROR: Could not load secrets for webhook %s: %v\n", wh.ID, err)
+			continue
+		}
+		flushWebhookBuffer(getUserEmailByID(p.userID), p.userID, wh, secrets)
+	}
+}
+
+func startWebhookScheduleFlusher() {
+	runEvery(WEBHOOK_SCHEDULE_INTERVAL, func(now time.Time) {
+		flushWebhookBuffers(now)
+	})
+}
+
+// GET/POST /api/webhooks/{id}/schedule
+// POST {"schedule": {"days": ["mon", ...], "hours": ["09:00-17:00"], "timezone": "", "buffer": true}}
+// sets the schedule; {"schedule": null} removes it, delivering any held messages.
+// GET also reports whether the window is open and how many messages are held.
+func handleWebhookSchedule(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(int64)
+	webhookID := r.PathValue("id")
+
+	switch r.Method {
+	case "GET":
+		wh, err := dbGetWebhook(userID, webhookID)
+		if err == sql.ErrNoRows {
+			apiError(w, "Webhook not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			fmt.Println("ERROR: Could not load webhook schedule", err)
+			apiError(w, "Failed to load schedule", http.StatusInternalServerError)
+			return
+		}
+		buffered, err := dbCountBufferedMessages(webhookID)
+		if err != nil {
+			fmt.Println("ERROR: Could not count buffered messages", err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"id":       webhookID,
+			"schedule": wh.Schedule,
+			"open":     webhookScheduleOpen(userID, wh, time.Now()),
+			"buffered": buffered,
+		})
+	case "POST":
+		var req struct {
+			Schedule *WebhookSchedule `json:"schedule"`
+		}
+		if err := decodeJSONBody(w, r, &req); err != nil {
+			writeBodyError(w, err)
+			return
+		}
+		if err := normalizeWebhookSchedule(req.Schedule); err != nil {
+			apiError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		updated, err := dbSetWebhookSchedule(userID, webhookID, req.Schedule)
+		if err != nil {
+			fmt.Println("ERROR: Could not update webhook schedule", err)
+			apiError(w, "Failed to update schedule", http.StatusInternalServerError)
+			return
+		}
+		if !updated {
+			apiError(w, "Webhook not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success":  true,
+			"id":       webhookID,
+			"schedule": req.Schedule,
+		})
+	default:
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
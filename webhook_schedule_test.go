@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWebhookScheduleWindow(t *testing.T) {
+	s := &WebhookSchedule{Days: []string{"Friday", "mon", "TUE", "mon"}, Hours: []string{"09:00 - 12:30", "22:00-06:00"}, Timezone: "America/New_York"}
+	if err := normalizeWebhookSchedule(s); err != nil {
+		t.Fatalf("Valid schedule rejected: %v", err)
+	}
+	if fmt.Sprint(s.Days) != "[mon tue fri]" || s.Hours[0] != "09:00-12:30" {
+		t.Fatalf("Unexpected normalized schedule: %+v", s)
+	}
+	for _, bad := range []*WebhookSchedule{
+		{},
+		{Days: []string{"someday"}},
+		{Hours: []string{"9-17"}},
+		{Hours: []string{"09:00-09:00"}},
+		{Hours: []string{"24:00-06:00"}},
+		{Hours: []string{"09:00-17:00"}, Timezone: "Mars/Olympus"},
+	} {
+		if err := normalizeWebhookSchedule(bad); err == nil {
+			t.Fatalf("Expected %+v to be rejected", bad)
+		}
+	}
+
+	ny, _ := time.LoadLocation("America/New_York")
+	for _, tt := range []struct {
+		at   time.Time
+		want bool
+	}{
+		{time.Date(2026, 10, 12, 9, 0, 0, 0, ny), true},    // Monday morning
+		{time.Date(2026, 10, 12, 12, 30, 0, 0, ny), false}, // End of the range is excluded
+		{time.Date(2026, 10, 12, 23, 0, 0, 0, ny), true},   // Late range, before midnight
+		{time.Date(2026, 10, 13, 3, 0, 0, 0, ny), true},    // ...and after it
+		{time.Date(2026, 10, 14, 10, 0, 0, 0, ny), false},  // Wednesday
+		{time.Date(2026, 10, 12, 13, 0, 0, 0, time.UTC), true},
+	} {
+		if got := s.open(tt.at, time.UTC); got != tt.want {
+			t.Errorf("open at %s: got %v, want %v", tt.at, got, tt.want)
+		}
+	}
+	// Without a timezone the user's applies
+	local := &WebhookSchedule{Hours: []string{"09:00-17:00"}}
+	if !local.open(time.Date(2026, 10, 12, 18, 0, 0, 0, time.UTC), ny) {
+		t.Fatal("Expected 14:00 in New York to be open")
+	}
+}
+
+func TestWebhookScheduleBuffer(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+
+	email := "schedule@example.com"
+	_, apiKey := registerWithAPIKey(t, ts, email, "schedulepass123")
+
+	received := make(chan map[string]interface{}, 5)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var payload map[string]interface{}
+		json.Unmarshal(body, &payload)
+		received <- payload
+	}))
+	defer receiver.Close()
+
+	// A window starting in two hours, so it's closed now
+	start := time.Now().UTC().Add(2 * time.Hour)
+	closed := map[string]interface{}{
+		"hours":    []string{start.Format("15:04") + "-" + start.Add(time.Hour).Format("15:04")},
+		"timezone": "UTC",
+		"buffer":   true,
+	}
+	var created map[string]interface{}
+	apiRequest(t, "POST", ts.URL+"/api/webhooks/create", apiKey, map[string]interface{}{"url": receiver.URL, "method": "POST", "schedule": closed}, &created)
+	id, _ := created["id"].(string)
+	if id == "" || created["schedule"] == nil {
+		t.Fatalf("Unexpected create response: %v", created)
+	}
+
+	send := func(text string) {
+		forwardToWebhooks(email, map[string]interface{}{"id": "S" + text, "from": "14155550000@s.whatsapp.net", "to": "14155550000@s.whatsapp.net",
+			"type": "text", "text": text, "timestamp": time.Now().Unix()}, "", "test_media")
+	}
+	send("first")
+	send("second")
+	select {
+	case payload := <-received:
+		t.Fatalf("Delivered outside the window: %v", payload)
+	case <-time.After(200 * time.Millisecond):
+	}
+	var status struct {
+		Open     bool `json:"open"`
+		Buffered int  `json:"buffered"`
+	}
+	if resp := apiRequest(t, "GET", ts.URL+"/api/webhooks/"+id+"/schedule", apiKey, nil, &status); resp.StatusCode != 200 || status.Open || status.Buffered != 2 {
+		t.Fatalf("Expected a closed window holding 2 messages, got %d %+v", resp.StatusCode, status)
+	}
+
+	// Held messages go out in order once the webhook may receive again
+	if resp := apiRequest(t, "POST", ts.URL+"/api/webhooks/"+id+"/schedule", apiKey, map[string]interface{}{"schedule": nil}, nil); resp.StatusCode != 200 {
+		t.Fatalf("Removing the schedule failed: %d", resp.StatusCode)
+	}
+	flushWebhookBuffers(time.Now())
+	for _, want := range []string{"first", "second"} {
+		select {
+		case payload := <-received:
+			if payload["text"] != want {
+				t.Fatalf("Expected %q next, got %v", want, payload["text"])
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Held message %q not delivered", want)
+		}
+	}
+
+	// Without buffer, off-hours messages are dropped
+	delete(closed, "buffer")
+	if resp := apiRequest(t, "POST", ts.URL+"/api/webhooks/"+id+"/schedule", apiKey, map[string]interface{}{"schedule": closed}, nil); resp.StatusCode != 200 {
+		t.Fatalf("Setting the schedule failed: %d", resp.StatusCode)
+	}
+	send("dropped")
+	apiRequest(t, "GET", ts.URL+"/api/webhooks/"+id+"/schedule", apiKey, nil, &status)
+	if status.Buffered != 0 {
+		t.Fatalf("Expected nothing held, got %d", status.Buffered)
+	}
+	if resp := apiRequest(t, "POST", ts.URL+"/api/webhooks/"+id+"/schedule", apiKey, map[string]interface{}{"schedule": map[string]interface{}{"days": []string{"funday"}}}, nil); resp.StatusCode != 400 {
+		t.Fatalf("Expected 400 for an invalid schedule, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Per-host traffic shaping ---
+// Webhook deliveries, send callbacks and trigger deliveries are shaped per destination
+// host, so one slow or rate-limited receiver can't tie up every delivery: at most
+// WEBHOOK_HOST_CONCURRENCY requests to a host are in flight at once, and requests to a
+// host start at least WEBHOOK_HOST_INTERVAL apart. Requests waiting for their turn form
+// the host's backlog; a request that is still waiting when WEBHOOK_TIMEOUT runs out
+// fails like a timed-out delivery.
+//
+// WEBHOOK_HOST_LIMITS overrides both for specific hosts, as comma-separated
+// host=concurrency or host=concurrency/interval entries, e.g.
+// "n8n.example.com=1/2s,hooks.internal:8443=8".
+
+const DEFAULT_WEBHOOK_HOST_CONCURRENCY = 4
+
+var errHostBacklogTimeout = errors.New("timed out waiting for a delivery slot")
+
+type hostLimit struct {
+	concurrency int
+	interval    time.Duration
+}
+
+var (
+	defaultHostLimit = hostLimit{concurrency: DEFAULT_WEBHOOK_HOST_CONCURRENCY}
+	hostLimits       = map[string]hostLimit{} // By host, overriding the default
+)
+
+// Traffic state of one destination host
+type hostShaper struct {
+	limit hostLimit
+	slots chan struct{}
+
+	mu        sync.Mutex
+	nextStart time.Time // Earliest start for the next request, for pacing
+	waiting   int
+	inFlight  int
+	delivered int64
+	failed    int64
+	timedOut  int64 // Gave up waiting for a slot
+	lastWait  time.Duration
+	lastUsed  time.Time
+}
+
+var webhookHosts = struct {
+	sync.Mutex
+	data map[string]*hostShaper
+}{data: make(map[string]*hostShaper)}
+
+// Parse a host limit: "4" or "4/500ms"
+func parseHostLimit(value string) (hostLimit, error) {
+	var limit hostLimit
+	concurrency, interval, hasInterval := strings.Cut(value, "/")
+	n, err := strconv.Atoi(strings.TrimSpace(concurrency))
+	if err != nil || n < 1 {
+		return limit, fmt.Errorf("invalid concurrency %q", concurrency)
+	}
+	limit.concurrency = n
+	if hasInterval {
+		d, err := time.ParseDuration(strings.TrimSpace(interval))
+		if err != nil || d < 0 {
+			return limit, fmt.Errorf("invalid interval %q", interval)
+		}
+		limit.interval = d
+	}
+	return limit, nil
+}
+
+// Read WEBHOOK_HOST_CONCURRENCY, WEBHOOK_HOST_INTERVAL and WEBHOOK_HOST_LIMITS; invalid
+// values keep the default. Resets the per-host state.
+func initWebhookShaping() {
+	defaultHostLimit = hostLimit{concurrency: DEFAULT_WEBHOOK_HOST_CONCURRENCY}
+	if value := os.Getenv("WEBHOOK_HOST_CONCURRENCY"); value != "" {
+		if n, err := strconv.Atoi(value); err == nil && n >= 1 {
+			defaultHostLimit.concurrency = n
+		} else {
+			fmt.Printf("WARNING: Ignoring WEBHOOK_HOST_CONCURRENCY=%q, expected a positive number\n", value)
+		}
+	}
+	if value := os.Getenv("WEBHOOK_HOST_INTERVAL"); value != "" {
+		if d, err := time.ParseDuration(value); err == nil && d >= 0 {
+			defaultHostLimit.interval = d
+		} else {
+			fmt.Printf("WARNING: Ignoring WEBHOOK_HOST_INTERVAL=%q, expected a duration like 500ms\n", value)
+		}
+	}
+	hostLimits = map[string]hostLimit{}
+	for _, entry := range strings.Split(os.Getenv("WEBHOOK_HOST_LIMITS"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		host, value, ok := strings.Cut(entry, "=")
+		limit, err := parseHostLimit(value)
+		if !ok || host == "" || err != nil {
+			fmt.Printf("WARNING: Ignoring %q in WEBHOOK_HOST_LIMITS, expected host=concurrency[/interval]\n", entry)
+			continue
+		}
+		hostLimits[strings.ToLower(host)] = limit
+	}
+
+	webhookHosts.Lock()
+	webhookHosts.data = make(map[string]*hostShaper)
+	webhookHosts.Unlock()
+}
+
+// The host a URL is shaped under: its host, with the port if one is given
+func shapingHost(u *url.URL) string {
+	return strings.ToLower(u.Host)
+}
+
+func limitForHost(host string) hostLimit {
+	if limit, ok := hostLimits[host]; ok {
+		return limit
+	}
+	// An override without a port applies to every port of the host
+	if i := strings.LastIndex(host, ":"); i > 0 && !strings.HasSuffix(host, "]") {
+		if limit, ok := hostLimits[host[:i]]; ok {
+			return limit
+		}
+	}
+	return defaultHostLimit
+}
+
+func getHostShaper(host string) *hostShaper {
+	webhookHosts.Lock()
+	defer webhookHosts.Unlock()
+	s, ok := webhookHosts.data[host]
+	if !ok {
+		limit := limitForHost(host)
+		s = &hostShaper{limit: limit, slots: make(chan struct{}, limit.concurrency)}
+		webhookHosts.data[host] = s
+	}
+	return s
+}
+
+// Wait for a slot and the host's pacing interval; returns a func that releases the
+// slot and records the outcome
+func (s *hostShaper) acquire(req *http.Request) (func(ok bool), error) {
+	start := time.Now()
+	s.mu.Lock()
+	s.waiting++
+	s.lastUsed = start
+	s.mu.Unlock()
+
+	giveUp := func() error {
+		s.mu.Lock()
+		s.waiting--
+		s.timedOut++
+		s.mu.Unlock()
+		return fmt.Errorf("%w for %s", errHostBacklogTimeout, req.URL.Host)
+	}
+	select {
+	case s.slots <- struct{}{}:
+	case <-req.Context().Done():
+		return nil, giveUp()
+	}
+
+	if s.limit.interval > 0 {
+		s.mu.Lock()
+		startAt := time.Now()
+		if s.nextStart.After(startAt) {
+			startAt = s.nextStart
+		}
+		s.nextStart = startAt.Add(s.limit.interval)
+		s.mu.Unlock()
+		if d := time.Until(startAt); d > 0 {
+			timer := time.NewTimer(d)
+			select {
+			case <-timer.C:
+			case <-req.Context().Done():
+				timer.Stop()
+				<-s.slots
+				return nil, giveUp()
+			}
+		}
+	}
+
+	s.mu.Lock()
+	s.waiting--
+	s.inFlight++
+	s.lastWait = time.Since(start)
+	s.mu.Unlock()
+
+	var once sync.Once
+	return func(ok bool) {
+		once.Do(func() {
+			<-s.slots
+			s.mu.Lock()
+			s.inFlight--
+			if ok {
+				s.delivered++
+			} else {
+				s.failed++
+			}
+			s.mu.Unlock()
+		})
+	}, nil
+}
+
+// Round tripper that shapes requests per host; the slot is held until the response
+// body is closed
+type shapedTransport struct {
+	next http.RoundTripper
+}
+
+func (t shapedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	release, err := getHostShaper(shapingHost(req.URL)).acquire(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		release(false)
+		return nil, err
+	}
+	ok := resp.StatusCode >= 200 && resp.StatusCode < 300
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: func() { release(ok) }}
+	return resp, nil
+}
+
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
+
+// Backlog and counters of one host
+type HostTrafficStats struct {
+	Host          string  `json:"host"`
+	Concurrency   int     `json:"concurrency"`
+	IntervalMs    int64   `json:"interval_ms"`
+	Waiting       int     `json:"waiting"`
+	InFlight      int     `json:"in_flight"`
+	Delivered     int64   `json:"delivered"`
+	Failed        int64   `json:"failed"`
+	TimedOut      int64   `json:"timed_out"`
+	LastWaitMs    int64   `json:"last_wait_ms"`
+	LastRequestAt *string `json:"last_request_at,omitempty"`
+}
+
+// Stats of the hosts matching keep (all hosts if nil), busiest backlog first
+func webhookHostStats(keep func(host string) bool) []HostTrafficStats {
+	webhookHosts.Lock()
+	shapers := make(map[string]*hostShaper, len(webhookHosts.data))
+	for host, s := range webhookHosts.data {
+		if keep == nil || keep(host) {
+			shapers[host] = s
+		}
+	}
+	webhookHosts.Unlock()
+
+	stats := make([]HostTrafficStats, 0, len(shapers))
+	for host, s := range shapers {
+		s.mu.Lock()
+		st := HostTrafficStats{
+			Host:        host,
+			Concurrency: s.limit.concurrency,
+			IntervalMs:  s.limit.interval.Milliseconds(),
+			Waiting:     s.waiting,
+			InFlight:    s.inFlight,
+			Delivered:   s.delivered,
+			Failed:      s.failed,
+			TimedOut:    s.timedOut,
+			LastWaitMs:  s.lastWait.Milliseconds(),
+		}
+		if !s.lastUsed.IsZero() {
+			at := s.lastUsed.UTC().Format(time.RFC3339)
+			st.LastRequestAt = &at
+		}
+		s.mu.Unlock()
+		stats = append(stats, st)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Waiting != stats[j].Waiting {
+			return stats[i].Waiting > stats[j].Waiting
+		}
+		return stats[i].Host < stats[j].Host
+	})
+	return stats
+}
+
+// GET /api/webhooks/hosts
+// Traffic to the hosts the user's webhooks deliver to. Counts cover every user
+// delivering to the same host.
+func handleWebhookHosts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID := r.Context().Value("userID").(int64)
+	webhooks, err := dbListWebhooks(userID)
+	if err != nil {
+		apiError(w, "Failed to load webhooks", http.StatusInternalServerError)
+		return
+	}
+	hosts := map[string]bool{}
+	for _, wh := range webhooks {
+		for _, dest := range webhookDestinations(wh) {
+			if u, err := url.Parse(dest); err == nil && u.Host != "" {
+				hosts[shapingHost(u)] = true
+			}
+		}
+	}
+	stats := webhookHostStats(func(host string) bool { return hosts[host] })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// GET /api/admin/webhook-hosts
+func handleAdminWebhookHosts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"default_concurrency": defaultHostLimit.concurrency,
+		"default_interval_ms": defaultHostLimit.interval.Milliseconds(),
+		"hosts":               webhookHostStats(nil),
+	})
+}
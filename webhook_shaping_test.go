@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWebhookHostShaping(t *testing.T) {
+	release := make(chan struct{})
+	dest := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer dest.Close()
+	releaseAll := sync.OnceFunc(func() { close(release) })
+	defer releaseAll() // Before dest.Close, which waits for blocked handlers
+	host := url.URL{Host: dest.Listener.Addr().String()}
+	t.Cleanup(initWebhookShaping) // Back to the defaults once t.Setenv restores them
+	t.Setenv("WEBHOOK_HOST_LIMITS", "127.0.0.1=1")
+	initWebhookShaping()
+	ts, teardown := setupTestServer()
+	defer teardown()
+
+	_, apiKey := registerWithAPIKey(t, ts, "shaping@example.com", "shapingpass123")
+	if resp := apiRequest(t, "POST", ts.URL+"/api/webhooks/create", apiKey, map[string]interface{}{"url": dest.URL, "method": "POST"}, nil); resp.StatusCode != 200 {
+		t.Fatalf("Create webhook failed: %d", resp.StatusCode)
+	}
+
+	// One request to the host at a time; the others wait
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := sendWebhook(Webhook{ID: "wh"}, map[string]interface{}{"n": 1}, dest.URL, "POST"); err != nil {
+				t.Errorf("Delivery failed: %v", err)
+			}
+		}()
+	}
+	hostStats := func() HostTrafficStats {
+		var stats []HostTrafficStats
+		apiRequest(t, "GET", ts.URL+"/api/webhooks/hosts", apiKey, nil, &stats)
+		if len(stats) != 1 || stats[0].Host != shapingHost(&host) {
+			t.Fatalf("Expected stats for %s, got %+v", host.Host, stats)
+		}
+		return stats[0]
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for st := hostStats(); st.InFlight != 1 || st.Waiting != 2; st = hostStats() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected 1 in flight and 2 waiting, got %+v", st)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	releaseAll()
+	wg.Wait()
+	if st := hostStats(); st.Concurrency != 1 || st.InFlight != 0 || st.Waiting != 0 || st.Delivered != 3 {
+		t.Fatalf("Unexpected stats after delivery: %+v", st)
+	}
+}
+
+func TestWebhookHostPacingAndTimeout(t *testing.T) {
+	block := make(chan struct{})
+	dest := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-block
+		}
+	}))
+	defer dest.Close()
+	defer close(block)
+	t.Cleanup(initWebhookShaping)
+	t.Setenv("WEBHOOK_HOST_LIMITS", "127.0.0.1=1/200ms")
+	initWebhookShaping()
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if _, err := sendWebhook(Webhook{ID: "wh"}, nil, dest.URL, "GET"); err != nil {
+			t.Fatalf("Delivery failed: %v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Fatalf("Expected requests 200ms apart, 3 took %v", elapsed)
+	}
+
+	// A request stuck behind a slow one gives up when its timeout runs out
+	go webhookHTTPClient().Get(dest.URL + "/slow")
+	time.Sleep(300 * time.Millisecond)
+	client := webhookHTTPClient()
+	client.Timeout = 100 * time.Millisecond
+	// The client replaces the error on timeout, keeping only its message
+	if _, err := client.Get(dest.URL); err == nil || !strings.Contains(err.Error(), errHostBacklogTimeout.Error()) {
+		t.Fatalf("Expected a backlog timeout, got %v", err)
+	}
+	if stats := webhookHostStats(nil); len(stats) != 1 || stats[0].TimedOut != 1 {
+		t.Fatalf("Expected one timed out request, got %+v", stats)
+	}
+}
+
+func TestParseHostLimit(t *testing.T) {
+	if limit, err := parseHostLimit("2/1500ms"); err != nil || limit.concurrency != 2 || limit.interval != 1500*time.Millisecond {
+		t.Fatalf("Unexpected limit %+v, %v", limit, err)
+	}
+	if limit, err := parseHostLimit("8"); err != nil || limit.concurrency != 8 || limit.interval != 0 {
+		t.Fatalf("Unexpected limit %+v, %v", limit, err)
+	}
+	for _, bad := range []string{"", "0", "x", "2/soon", "2/-1s"} {
+		if _, err := parseHostLimit(bad); err == nil {
+			t.Fatalf("Expected %q to be rejected", bad)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// --- Webhook verification ---
+// A webhook created with "verify": true gets a challenge before anything is delivered:
+// each destination receives {"event": "webhook.verification", "challenge": "..."} and
+// must answer 2xx with the challenge, as the plain body or as {"challenge": "..."}.
+// Until all destinations pass, the webhook is unverified and receives nothing, so a
+// mistyped URL fails loudly and third-party URLs can't be made targets without consent.
+
+const EVENT_WEBHOOK_VERIFICATION = "webhook.verification"
+
+// Whether a response body echoes the challenge
+func echoesChallenge(body []byte, challenge string) bool {
+	if strings.TrimSpace(string(body)) == challenge {
+		return true
+	}
+	var echoed struct {
+		Challenge string `json:"challenge"`
+	}
+	return json.Unmarshal(body, &echoed) == nil && echoed.Challenge == challenge
+}
+
+// Send a fresh challenge to every destination of a webhook
+func verifyWebhookDestinations(userID int64, wh Webhook) error {
+	secrets, err := dbGetSecretValues(userID)
+	if err != nil {
+		return err
+	}
+	resolved, err := resolveWebhookSecrets(wh, secrets)
+	if err != nil {
+		return err
+	}
+	for i, u := range webhookDestinations(resolved) {
+		challenge := randomHex(16)
+		payload := map[string]interface{}{
+			"event":      EVENT_WEBHOOK_VERIFICATION,
+			"webhook_id": wh.ID,
+			"challenge":  challenge,
+			"timestamp":  time.Now().Unix(),
+		}
+		body, err := sendWebhook(resolved, payload, u, resolved.Method)
+		if err != nil {
+			return fmt.Errorf("destination %d: %w", i+1, err)
+		}
+		if !echoesChallenge(body, challenge) {
+			return fmt.Errorf("destination %d did not echo the challenge", i+1)
+		}
+	}
+	return nil
+}
+
+func dbSetWebhookUnverified(userID int64, webhookID string, unverified bool) error {
+	defer invalidateWebhooksCache(userID)
+	_, err := db.Exec(`UPDATE webhooks SET unverified = ? WHERE user_id = ? AND id = ?`, unverified, userID, webhookID)
+	return err
+}
+
+// Run the challenge for an unverified webhook and enable it if it passes
+func verifyWebhook(userID int64, wh *Webhook) error {
+	if err := verifyWebhookDestinations(userID, *wh); err != nil {
+		fmt.Printf("WARNING: Webhook %s failed verification: %v\n", wh.ID, err)
+		return err
+	}
+	if err := dbSetWebhookUnverified(userID, wh.ID, false); err != nil {
+		return err
+	}
+	wh.Unverified = false
+	return nil
+}
+
+// POST /api/webhooks/{id}/verify
+// Repeats the challenge, e.g. after fixing the destination.
+func handleVerifyWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID := r.Context().Value("userID").(int64)
+	wh, err := dbGetWebhook(userID, r.PathValue("id"))
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, ERR_NOT_FOUND, "Webhook not found")
+		return
+	}
+	if !wh.Unverified {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"id": wh.ID, "verified": true})
+		return
+	}
+	if err := verifyWebhook(userID, &wh); err != nil {
+		writeAPIError(w, http.StatusBadGateway, ERR_UPSTREAM, "Verification failed: "+err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"id": wh.ID, "verified": true})
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestWebhookVerification(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+
+	_, apiKey := registerWithAPIKey(t, ts, "verify@example.com", "verifypass123")
+	userID, _ := getUserIDByEmail("verify@example.com")
+
+	var echo atomic.Bool
+	dest := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		if body["event"] != EVENT_WEBHOOK_VERIFICATION {
+			t.Errorf("Unexpected delivery before verification: %v", body)
+			return
+		}
+		if echo.Load() {
+			json.NewEncoder(w).Encode(map[string]interface{}{"challenge": body["challenge"]})
+		}
+	}))
+	defer dest.Close()
+
+	// The destination doesn't echo: the webhook is created but stays unverified
+	var created map[string]interface{}
+	resp := apiRequest(t, "POST", ts.URL+"/api/webhooks/create", apiKey, map[string]interface{}{"url": dest.URL, "method": "POST", "verify": true}, &created)
+	if resp.StatusCode != 200 || created["unverified"] != true || created["verification_error"] == nil {
+		t.Fatalf("Expected an unverified webhook, got %d %v", resp.StatusCode, created)
+	}
+	id := created["id"].(string)
+	webhooks, _ := dbListWebhooks(userID)
+	if len(webhooks) != 1 || !webhooks[0].Unverified {
+		t.Fatalf("Expected the webhook to be stored unverified: %+v", webhooks)
+	}
+	if selected := selectWebhooksForMessage(webhooks, "14155550001@s.whatsapp.net", "", "hi"); len(selected) != 0 {
+		t.Fatal("Unverified webhooks should receive no messages")
+	}
+	var clone Webhook
+	apiRequest(t, "POST", ts.URL+"/api/webhooks/"+id+"/clone", apiKey, map[string]interface{}{"unverified": false}, &clone)
+	if !clone.Unverified {
+		t.Fatal("A clone of an unverified webhook should stay unverified")
+	}
+
+	if resp := apiRequest(t, "POST", ts.URL+"/api/webhooks/"+id+"/verify", apiKey, nil, nil); resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("Expected 502 while the destination doesn't echo, got %d", resp.StatusCode)
+	}
+	echo.Store(true)
+	var verified map[string]interface{}
+	if resp := apiRequest(t, "POST", ts.URL+"/api/webhooks/"+id+"/verify", apiKey, nil, &verified); resp.StatusCode != 200 || verified["verified"] != true {
+		t.Fatalf("Verification failed: %d %v", resp.StatusCode, verified)
+	}
+	wh, _ := dbGetWebhook(userID, id)
+	if wh.Unverified {
+		t.Fatal("The webhook should be verified")
+	}
+
+	// Verified at creation
+	created = nil
+	apiRequest(t, "POST", ts.URL+"/api/webhooks/create", apiKey, map[string]interface{}{"url": dest.URL, "method": "POST", "verify": true}, &created)
+	if created["unverified"] != false || created["verification_error"] != nil {
+		t.Fatalf("Expected the webhook to be verified at creation: %v", created)
+	}
+}
+
+func TestEchoesChallenge(t *testing.T) {
+	for body, want := range map[string]bool{
+		"abc123":                  true,
+		" abc123\n":               true,
+		`{"challenge": "abc123"}`: true,
+		`{"challenge": "other"}`:  false,
+		"":                        false,
+		`{"ok": true}`:            false,
+	} {
+		if got := echoesChallenge([]byte(body), "abc123"); got != want {
+			t.Fatalf("echoesChallenge(%q) = %v, want %v", body, got, want)
+		}
+	}
+}
@@ -0,0 +1,580 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	MAX_WEBHOOK_TAGS      = 10
+	MAX_WEBHOOK_URLS      = 5 // Extra destination URLs per webhook
+	MAX_WEBHOOK_PAGE_SIZE = 200
+	MAX_BULK_WEBHOOKS     = 100 // Definitions per bulk-create request
+
+	WEBHOOK_SORT_CREATED_AT    = "created_at"
+	WEBHOOK_SORT_LAST_DELIVERY = "last_delivery"
+)
+
+// Tags are lowercase; "/" allows folder-style names like "clients/acme"
+var webhookTagRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9_\-./]{0,31}$`)
+
+// Valid HTTP header field names (RFC 7230 token characters)
+var headerNameRegex = regexp.MustCompile("^[A-Za-z0-9!#$%&'*+\\-.^_`|~]+$")
+
+// Normalize (trim, lowercase, dedupe) and validate a list of webhook tags
+func normalizeTags(tags []string) ([]string, error) {
+	result := []string{}
+	seen := make(map[string]bool)
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || seen[tag] {
+			continue
+		}
+		if !webhookTagRegex.MatchString(tag) {
+			return nil, fmt.Errorf("Invalid tag: %q", tag)
+		}
+		seen[tag] = true
+		result = append(result, tag)
+	}
+	if len(result) > MAX_WEBHOOK_TAGS {
+		return nil, fmt.Errorf("Too many tags (max %d)", MAX_WEBHOOK_TAGS)
+	}
+	return result, nil
+}
+
+// Query parameters for GET /api/webhooks
+type webhookListOptions struct {
+	Tag    string // Only webhooks with this tag
+	Search string // Case-insensitive substring of url or urls
+	Sort   string // "created_at" or "last_delivery"
+	Desc   bool
+	Limit  int // 0 = no limit
+	Offset int
+}
+
+// Parse ?tag=&q=&sort=&order=&limit=&offset= for the webhooks list.
+// Defaults to newest first and no limit, matching the unpaginated list.
+func parseWebhookListOptions(q url.Values) (webhookListOptions, error) {
+	opts := webhookListOptions{
+		Tag:    strings.ToLower(strings.TrimSpace(q.Get("tag"))),
+		Search: strings.TrimSpace(q.Get("q")),
+		Sort:   WEBHOOK_SORT_CREATED_AT,
+		Desc:   true,
+	}
+	if sort := q.Get("sort"); sort != "" {
+		if sort != WEBHOOK_SORT_CREATED_AT && sort != WEBHOOK_SORT_LAST_DELIVERY {
+			return opts, errors.New("Invalid sort (use created_at or last_delivery)")
+		}
+		opts.Sort = sort
+	}
+	switch q.Get("order") {
+	case "", "desc":
+	case "asc":
+		opts.Desc = false
+	default:
+		return opts, errors.New("Invalid order (use asc or desc)")
+	}
+	var err error
+	if v := q.Get("limit"); v != "" {
+		if opts.Limit, err = strconv.Atoi(v); err != nil || opts.Limit < 1 || opts.Limit > MAX_WEBHOOK_PAGE_SIZE {
+			return opts, fmt.Errorf("Invalid limit (1-%d)", MAX_WEBHOOK_PAGE_SIZE)
+		}
+	}
+	if v := q.Get("offset"); v != "" {
+		if opts.Offset, err = strconv.Atoi(v); err != nil || opts.Offset < 0 {
+			return opts, errors.New("Invalid offset")
+		}
+	}
+	return opts, nil
+}
+
+// Escape % and _ for a LIKE pattern using ESCAPE '\'
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// List a page of a user's webhooks, with the total number matching the filters
+func dbQueryWebhooks(ctx context.Context, userID int64, opts webhookListOptions) ([]Webhook, int, error) {
+	// The plain list (newest first, unfiltered, unpaginated) is the cached one
+	if opts == (webhookListOptions{Sort: WEBHOOK_SORT_CREATED_AT, Desc: true}) {
+		webhooks, err := dbListWebhooks(userID)
+		if webhooks == nil {
+			webhooks = []Webhook{}
+		}
+		return webhooks, len(webhooks), err
+	}
+	where := `WHERE user_id = ?`
+	args := []interface{}{userID}
+	if opts.Tag != "" {
+		where += ` AND ` + webhookHasTagCondition
+		args = append(args, opts.Tag)
+	}
+	if opts.Search != "" {
+		pattern := "%" + escapeLike(strings.ToLower(opts.Search)) + "%"
+		where += ` AND (lower(url) LIKE ? ESCAPE '\' OR lower(urls) LIKE ? ESCAPE '\')`
+		args = append(args, pattern, pattern)
+	}
+
+	var total int
+	if err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM webhooks `+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	direction := "DESC"
+	if !opts.Desc {
+		direction = "ASC"
+	}
+	order := `created_at ` + direction
+	if opts.Sort == WEBHOOK_SORT_LAST_DELIVERY {
+		// Never-delivered webhooks go last in either direction
+		order = `last_delivery_at IS NULL, last_delivery_at ` + direction + `, created_at DESC`
+	}
+	query := `SELECT ` + webhookColumns + ` FROM webhooks ` + where + ` ORDER BY ` + order + `, id`
+	if opts.Limit > 0 {
+		query += ` LIMIT ? OFFSET ?`
+		args = append(args, opts.Limit, opts.Offset)
+	} else if opts.Offset > 0 {
+		query += ` LIMIT -1 OFFSET ?`
+		args = append(args, opts.Offset)
+	}
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	webhooks := []Webhook{}
+	for rows.Next() {
+		wh, err := scanWebhook(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		webhooks = append(webhooks, wh)
+	}
+	return webhooks, total, rows.Err()
+}
+
+// Record a successful delivery for sorting by last_delivery
+func dbSetWebhookLastDelivery(webhookID string, at time.Time) error {
+	_, err := preparedExec(db, `UPDATE webhooks SET last_delivery_at = ? WHERE id = ?`, at.UTC().Format(time.RFC3339), webhookID)
+	return err
+}
+
+// Validate a webhook's method, filter settings, tags, header names, destinations (see
+// validateOutboundURL) and allowed chats.
+// An empty filter type or delivery policy defaults to "all"; tags are normalized in place.
+func validateWebhookConfig(wh *Webhook) error {
+	if wh.Method != "GET" && wh.Method != "POST" {
+		return errors.New("Invalid method")
+	}
+	if wh.FilterType == "" {
+		wh.FilterType = "all"
+	}
+	if wh.FilterType != "all" && wh.FilterType != "group" && wh.FilterType != "chat" {
+		return errors.New("Invalid filter type")
+	}
+	if wh.FilterType != "all" && wh.FilterValue != "" {
+		// A list of JIDs, wildcards and exclusions; phone numbers and @c.us JIDs are
+		// normalized to the JID messages come from
+		value, err := normalizeFilterValue(wh.FilterType, wh.FilterValue)
+		if err != nil {
+			return err
+		}
+		wh.FilterValue = value
+	}
+	tags, err := normalizeTags(wh.Tags)
+	if err != nil {
+		return err
+	}
+	wh.Tags = tags
+	for name := range wh.Headers {
+		if !headerNameRegex.MatchString(name) {
+			return fmt.Errorf("Invalid header name: %q", name)
+		}
+	}
+	if len(wh.URLs) > MAX_WEBHOOK_URLS {
+		return fmt.Errorf("Too many urls (max %d)", MAX_WEBHOOK_URLS)
+	}
+	for _, u := range wh.URLs {
+		if strings.TrimSpace(u) == "" {
+			return errors.New("Empty url in urls")
+		}
+	}
+	for _, u := range webhookDestinations(*wh) {
+		if u == "" {
+			continue // Configs without a URL, such as a sink's chat filter
+		}
+		if err := validateOutboundURL(u); err != nil {
+			return err
+		}
+	}
+	if wh.Policy == "" {
+		wh.Policy = DELIVERY_ALL
+	}
+	if wh.Policy != DELIVERY_ALL && wh.Policy != DELIVERY_FIRST_SUCCESS && wh.Policy != DELIVERY_FAILOVER {
+		return errors.New("Invalid delivery policy")
+	}
+	allowedChats, err := normalizeAllowedChats(wh.AllowedChats)
+	if err != nil {
+		return err
+	}
+	wh.AllowedChats = allowedChats
+	events, err := normalizeWebhookEvents(wh.Events)
+	if err != nil {
+		return err
+	}
+	wh.Events = events
+	if err := validateWebhookPayloadLimit(wh.MaxPayload); err != nil {
+		return err
+	}
+	if err := validateWebhookSampleRate(wh.SampleRate); err != nil {
+		return err
+	}
+	redact, err := normalizeWebhookRedact(wh.Redact)
+	if err != nil {
+		return err
+	}
+	wh.Redact = redact
+	if err := normalizeWebhookSchedule(wh.Schedule); err != nil {
+		return err
+	}
+	return normalizeWebhookRouting(wh)
+}
+
+// POST /api/webhooks/{id}/clone
+// Copies an existing webhook's configuration under a new ID.
+// Any webhook fields present in the (optional) JSON body override the copied values.
+func handleCloneWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := r.Context().Value("userID").(int64)
+	sourceID := r.PathValue("id")
+
+	source, err := dbGetWebhook(userID, sourceID)
+	if err == sql.ErrNoRows {
+		apiError(w, "Webhook not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		fmt.Println("ERROR: Could not load webhook for clone", err)
+		apiError(w, "Failed to load webhook", http.StatusInternalServerError)
+		return
+	}
+
+	// Start from a copy of the source, then apply overrides from the body
+	var raw json.RawMessage
+	if err := decodeJSONBody(w, r, &raw); err != nil && err != io.EOF {
+		writeBodyError(w, err)
+		return
+	}
+	clone := source
+	if len(raw) > 0 {
+		// Headers and a schedule set in the body replace the source's instead of
+		// being merged into them
+		var set struct {
+			Headers  json.RawMessage `json:"headers"`
+			Schedule json.RawMessage `json:"schedule"`
+		}
+		json.Unmarshal(raw, &set)
+		if set.Headers != nil {
+			clone.Headers = nil
+		}
+		if set.Schedule != nil {
+			clone.Schedule = nil
+		}
+		if err := unmarshalStrict(raw, &clone); err != nil {
+			writeBodyError(w, err)
+			return
+		}
+	}
+	clone.ID = generateWebhookID()
+	clone.CreatedAt = time.Now()
+	clone.Unverified = source.Unverified // Only the verify endpoint clears it
+	clone.LastDeliveryAt, clone.Alerts, clone.Health = nil, nil, nil
+
+	// The merged config must pass the same checks as /api/webhooks/create
+	if clone.URL == "" {
+		apiError(w, "Missing URL", http.StatusBadRequest)
+		return
+	}
+	if err := validateWebhookConfig(&clone); err != nil {
+		apiError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if clone.AllowedChats, err = limitToAPIKeyChats(userID, clone.AllowedChats); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+
+	if err := dbCreateWebhook(userID, clone); err != nil {
+		fmt.Println("ERROR: Could not create cloned webhook in DB", err)
+		apiError(w, "Failed to clone webhook", http.StatusInternalServerError)
+		return
+	}
+	fmt.Printf("DEBUG: Webhook %s cloned to %s\n", sourceID, clone.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(clone)
+}
+
+// A webhook definition in a bulk create that failed validation
+type bulkWebhookError struct {
+	Index   int    `json:"index"`
+	Message string `json:"message"`
+}
+
+// A webhook created by a bulk create, with the index of its definition
+type bulkCreatedWebhook struct {
+	Index int `json:"index"`
+	Webhook
+}
+
+// POST /api/webhooks/bulk-create
+// Body: {"webhooks": [...], "partial": false}, or just the array. Every definition is
+// validated like /api/webhooks/create. By default the batch is all-or-nothing: one invalid
+// definition rejects the whole batch, listing every error by index. With "partial": true
+// the valid webhooks are created and the invalid ones reported.
+func handleBulkCreateWebhooks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := r.Context().Value("userID").(int64)
+
+	var raw json.RawMessage
+	if err := decodeJSONBody(w, r, &raw); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	var req struct {
+		Webhooks []Webhook `json:"webhooks"`
+		Partial  bool      `json:"partial"`
+	}
+	var err error
+	if trimmed := strings.TrimSpace(string(raw)); strings.HasPrefix(trimmed, "[") {
+		err = unmarshalStrict(raw, &req.Webhooks)
+	} else {
+		err = unmarshalStrict(raw, &req)
+	}
+	if err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	if len(req.Webhooks) == 0 {
+		apiError(w, "No webhooks to create", http.StatusBadRequest)
+		return
+	}
+	if len(req.Webhooks) > MAX_BULK_WEBHOOKS {
+		apiError(w, fmt.Sprintf("Too many webhooks (max %d per request)", MAX_BULK_WEBHOOKS), http.StatusBadRequest)
+		return
+	}
+
+	valid := []bulkCreatedWebhook{}
+	failures := []bulkWebhookError{}
+	for i, wh := range req.Webhooks {
+		wh.ID = generateWebhookID()
+		wh.LastDeliveryAt = nil
+		wh.CreatedAt = time.Now()
+		if wh.URL == "" {
+			failures = append(failures, bulkWebhookError{Index: i, Message: "Missing URL"})
+			continue
+		}
+		if err := validateWebhookConfig(&wh); err != nil {
+			failures = append(failures, bulkWebhookError{Index: i, Message: err.Error()})
+			continue
+		}
+		if wh.AllowedChats, err = limitToAPIKeyChats(userID, wh.AllowedChats); err != nil {
+			failures = append(failures, bulkWebhookError{Index: i, Message: err.Error()})
+			continue
+		}
+		valid = append(valid, bulkCreatedWebhook{Index: i, Webhook: wh})
+	}
+
+	if len(failures) > 0 && (!req.Partial || len(valid) == 0) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error": map[string]string{
+				"code":    ERR_BAD_REQUEST,
+				"message": fmt.Sprintf("%d of %d webhooks are invalid, none were created", len(failures), len(req.Webhooks)),
+			},
+			"errors": failures,
+		})
+		return
+	}
+
+	// Insert in one transaction so a DB failure leaves nothing half-created
+	tx, err := db.Begin()
+	if err != nil {
+		fmt.Println("ERROR: Could not start bulk create transaction", err)
+		apiError(w, "Failed to create webhooks", http.StatusInternalServerError)
+		return
+	}
+	for _, created := range valid {
+		if err := dbCreateWebhookWith(tx, userID, created.Webhook); err != nil {
+			tx.Rollback()
+			fmt.Println("ERROR: Could not create webhook in bulk create", err)
+			apiError(w, "Failed to create webhooks", http.StatusInternalServerError)
+			return
+		}
+	}
+	err = tx.Commit()
+	invalidateWebhooksCache(userID)
+	if err != nil {
+		fmt.Println("ERROR: Could not commit bulk create", err)
+		apiError(w, "Failed to create webhooks", http.StatusInternalServerError)
+		return
+	}
+	fmt.Printf("DEBUG: Bulk created %d webhooks for user %d (%d rejected)\n", len(valid), userID, len(failures))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":   len(failures) == 0,
+		"created":   valid,
+		"errors":    failures,
+		"requested": len(req.Webhooks),
+	})
+}
+
+// POST /api/webhooks/{id}/tags
+// Replaces the tags of a webhook with the given list.
+func handleSetWebhookTags(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := r.Context().Value("userID").(int64)
+	webhookID := r.PathValue("id")
+
+	var req struct {
+		Tags []string `json:"tags"`
+	}
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	tags, err := normalizeTags(req.Tags)
+	if err != nil {
+		apiError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	updated, err := dbSetWebhookTags(userID, webhookID, tags)
+	if err != nil {
+		fmt.Println("ERROR: Could not update webhook tags", err)
+		apiError(w, "Failed to update tags", http.StatusInternalServerError)
+		return
+	}
+	if !updated {
+		apiError(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"id":      webhookID,
+		"tags":    tags,
+	})
+}
+
+// POST /api/webhooks/bulk
+// Applies an action ("pause", "resume" or "delete") to every webhook with the given tag.
+func handleBulkWebhooks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := r.Context().Value("userID").(int64)
+
+	var req struct {
+		Action string `json:"action"`
+		Tag    string `json:"tag"`
+	}
+	if err := decodeJSONBody(w, r, &req); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	if req.Tag == "" {
+		apiError(w, "Missing tag", http.StatusBadRequest)
+		return
+	}
+	tag := strings.ToLower(strings.TrimSpace(req.Tag))
+
+	var affected int64
+	var err error
+	switch req.Action {
+	case "pause":
+		affected, err = dbSetWebhooksPausedByTag(userID, tag, true)
+	case "resume":
+		affected, err = dbSetWebhooksPausedByTag(userID, tag, false)
+	case "delete":
+		affected, err = dbDeleteWebhooksByTag(userID, tag)
+	default:
+		apiError(w, "Invalid action", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		fmt.Printf("ERROR: Bulk %s by tag %s failed: %v\n", req.Action, tag, err)
+		apiError(w, "Bulk operation failed", http.StatusInternalServerError)
+		return
+	}
+	fmt.Printf("DEBUG: Bulk %s by tag %s affected %d webhooks\n", req.Action, tag, affected)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":  true,
+		"action":   req.Action,
+		"tag":      tag,
+		"affected": affected,
+	})
+}
+
+// SQL condition matching webhooks whose comma-separated tags contain a tag
+const webhookHasTagCondition = `instr(',' || tags || ',', ',' || ? || ',') > 0`
+
+// Replace the tags of a webhook; returns false if the webhook doesn't exist
+func dbSetWebhookTags(userID int64, webhookID string, tags []string) (bool, error) {
+	defer invalidateWebhooksCache(userID)
+	res, err := db.Exec(`UPDATE webhooks SET tags = ? WHERE user_id = ? AND id = ?`, strings.Join(tags, ","), userID, webhookID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// Pause or resume all of a user's webhooks with the given tag
+func dbSetWebhooksPausedByTag(userID int64, tag string, paused bool) (int64, error) {
+	defer invalidateWebhooksCache(userID)
+	res, err := db.Exec(`UPDATE webhooks SET paused = ? WHERE user_id = ? AND `+webhookHasTagCondition, paused, userID, tag)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// Delete all of a user's webhooks with the given tag
+func dbDeleteWebhooksByTag(userID int64, tag string) (int64, error) {
+	defer invalidateWebhooksCache(userID)
+	res, err := db.Exec(`DELETE FROM webhooks WHERE user_id = ? AND `+webhookHasTagCondition, userID, tag)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
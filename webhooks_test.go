@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Register and login a user, returning their session cookies and API key
+func registerWithAPIKey(t *testing.T, ts *httptest.Server, email, password string) ([]*http.Cookie, string) {
+	t.Helper()
+	client := &http.Client{}
+	creds, _ := json.Marshal(map[string]string{"email": email, "password": password})
+	resp, err := client.Post(ts.URL+"/api/register", "application/json", bytes.NewBuffer(creds))
+	if err != nil || resp.StatusCode != 200 {
+		t.Fatalf("Register failed: %v, status: %d", err, resp.StatusCode)
+	}
+	resp, err = client.Post(ts.URL+"/api/login", "application/json", bytes.NewBuffer(creds))
+	if err != nil || resp.StatusCode != 200 {
+		t.Fatalf("Login failed: %v, status: %d", err, resp.StatusCode)
+	}
+	cookies := resp.Cookies()
+
+	req, _ := http.NewRequest("POST", ts.URL+"/api/user/api-key", nil)
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	apiResp, err := client.Do(req)
+	if err != nil || apiResp.StatusCode != 200 {
+		t.Fatalf("Get API key failed: %v, status: %d", err, apiResp.StatusCode)
+	}
+	var apiData map[string]string
+	json.NewDecoder(apiResp.Body).Decode(&apiData)
+	return cookies, apiData["api_key"]
+}
+
+// Send a JSON request authenticated with an API key and decode the JSON response into out
+func apiRequest(t *testing.T, method, url, apiKey string, body interface{}, out interface{}) *http.Response {
+	t.Helper()
+	var buf bytes.Buffer
+	if body != nil {
+		json.NewEncoder(&buf).Encode(body)
+	}
+	req, _ := http.NewRequest(method, url, &buf)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-API-Key", apiKey)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s failed: %v", method, url, err)
+	}
+	if out != nil {
+		json.NewDecoder(resp.Body).Decode(out)
+	}
+	return resp
+}
+
+func TestCloneWebhook(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+
+	_, apiKey := registerWithAPIKey(t, ts, "cloneuser@example.com", "clonepass123")
+
+	var created map[string]interface{}
+	resp := apiRequest(t, "POST", ts.URL+"/api/webhooks/create", apiKey, map[string]interface{}{
+		"url":          "https://example.com/hook",
+		"method":       "POST",
+		"filter_type":  "group",
+		"filter_value": "111-222@g.us",
+		"headers":      map[string]string{"X-Source": "a", "X-Shared": "b"},
+	}, &created)
+	if resp.StatusCode != 200 {
+		t.Fatalf("Create webhook failed, status: %d", resp.StatusCode)
+	}
+	id := created["id"].(string)
+
+	// Clone with an override of the filter value
+	var clone Webhook
+	resp = apiRequest(t, "POST", ts.URL+"/api/webhooks/"+id+"/clone", apiKey, map[string]string{
+		"filter_value": "333-444@g.us",
+	}, &clone)
+	if resp.StatusCode != 200 {
+		t.Fatalf("Clone webhook failed, status: %d", resp.StatusCode)
+	}
+	if clone.ID == "" || clone.ID == id {
+		t.Fatalf("Clone should have a new ID, got %q", clone.ID)
+	}
+	if clone.URL != "https://example.com/hook" || clone.FilterType != "group" || clone.FilterValue != "333-444@g.us" {
+		t.Fatalf("Unexpected clone config: %+v", clone)
+	}
+	if len(clone.Headers) != 2 || clone.Headers["X-Source"] != "a" {
+		t.Fatalf("Clone should keep the source's headers, got %v", clone.Headers)
+	}
+
+	// Headers in the body replace the source's rather than being merged into them
+	var replaced Webhook
+	resp = apiRequest(t, "POST", ts.URL+"/api/webhooks/"+id+"/clone", apiKey, map[string]interface{}{
+		"headers": map[string]string{"X-Shared": "c"},
+	}, &replaced)
+	if resp.StatusCode != 200 || len(replaced.Headers) != 1 || replaced.Headers["X-Shared"] != "c" {
+		t.Fatalf("Expected only the new headers, got %d %v", resp.StatusCode, replaced.Headers)
+	}
+
+	// Overrides the create endpoint would reject are rejected
+	for _, override := range []map[string]interface{}{
+		{"method": "PUT"},
+		{"url": ""},
+		{"url": "http://169.254.169.254/latest/meta-data"},
+		{"urls": []string{"ftp://example.com/hook"}},
+		{"headers": map[string]string{"Bad Header": "x"}},
+	} {
+		resp = apiRequest(t, "POST", ts.URL+"/api/webhooks/"+id+"/clone", apiKey, override, nil)
+		if resp.StatusCode != 400 {
+			t.Fatalf("Expected 400 for override %v, got %d", override, resp.StatusCode)
+		}
+	}
+
+	// Unknown webhook
+	resp = apiRequest(t, "POST", ts.URL+"/api/webhooks/doesnotexist/clone", apiKey, nil, nil)
+	if resp.StatusCode != 404 {
+		t.Fatalf("Expected 404 for unknown webhook, got %d", resp.StatusCode)
+	}
+
+	var webhooks []Webhook
+	apiRequest(t, "GET", ts.URL+"/api/webhooks", apiKey, nil, &webhooks)
+	if len(webhooks) != 3 {
+		t.Fatalf("Expected 3 webhooks after the clones, got %d", len(webhooks))
+	}
+}
+
+func TestWebhookTagsAndBulkOperations(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+
+	_, apiKey := registerWithAPIKey(t, ts, "taguser@example.com", "tagpass123")
+
+	create := func(url string, tags []string) string {
+		var created map[string]interface{}
+		resp := apiRequest(t, "POST", ts.URL+"/api/webhooks/create", apiKey, map[string]interface{}{
+			"url": url, "method": "POST", "filter_type": "all", "tags": tags,
+		}, &created)
+		if resp.StatusCode != 200 {
+			t.Fatalf("Create webhook failed, status: %d", resp.StatusCode)
+		}
+		return created["id"].(string)
+	}
+	create("https://a.example.com", []string{"Finance", "crm"})
+	create("https://b.example.com", []string{"finance"})
+	other := create("https://c.example.com", nil)
+
+	// Invalid tags are rejected
+	resp := apiRequest(t, "POST", ts.URL+"/api/webhooks/create", apiKey, map[string]interface{}{
+		"url": "https://d.example.com", "method": "POST", "tags": []string{"bad,tag"},
+	}, nil)
+	if resp.StatusCode != 400 {
+		t.Fatalf("Expected 400 for invalid tag, got %d", resp.StatusCode)
+	}
+
+	// Filter by tag (case-insensitive)
+	var webhooks []Webhook
+	apiRequest(t, "GET", ts.URL+"/api/webhooks?tag=FINANCE", apiKey, nil, &webhooks)
+	if len(webhooks) != 2 {
+		t.Fatalf("Expected 2 webhooks tagged finance, got %d", len(webhooks))
+	}
+
+	// Tag the third webhook
+	resp = apiRequest(t, "POST", ts.URL+"/api/webhooks/"+other+"/tags", apiKey, map[string]interface{}{"tags": []string{"crm"}}, nil)
+	if resp.StatusCode != 200 {
+		t.Fatalf("Set tags failed, status: %d", resp.StatusCode)
+	}
+
+	// Pause by tag
+	var result map[string]interface{}
+	apiRequest(t, "POST", ts.URL+"/api/webhooks/bulk", apiKey, map[string]string{"action": "pause", "tag": "crm"}, &result)
+	if result["affected"] != float64(2) {
+		t.Fatalf("Expected 2 paused webhooks, got %v", result["affected"])
+	}
+	apiRequest(t, "GET", ts.URL+"/api/webhooks?tag=crm", apiKey, nil, &webhooks)
+	for _, wh := range webhooks {
+		if !wh.Paused {
+			t.Fatalf("Webhook %s should be paused", wh.ID)
+		}
+	}
+
+	// Delete by tag
+	apiRequest(t, "POST", ts.URL+"/api/webhooks/bulk", apiKey, map[string]string{"action": "delete", "tag": "finance"}, &result)
+	if result["affected"] != float64(2) {
+		t.Fatalf("Expected 2 deleted webhooks, got %v", result["affected"])
+	}
+	webhooks = nil
+	apiRequest(t, "GET", ts.URL+"/api/webhooks", apiKey, nil, &webhooks)
+	if len(webhooks) != 1 || webhooks[0].ID != other {
+		t.Fatalf("Expected only the crm-only webhook to remain, got %+v", webhooks)
+	}
+}
+
+func TestWebhookListPaginationSortSearch(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+
+	_, apiKey := registerWithAPIKey(t, ts, "pageuser@example.com", "pagepass123")
+
+	var ids []string
+	for _, u := range []string{"https://crm.example.com/a", "https://billing.example.com/b", "https://crm.example.com/c"} {
+		var created map[string]interface{}
+		apiRequest(t, "POST", ts.URL+"/api/webhooks/create", apiKey, map[string]interface{}{"url": u, "method": "POST"}, &created)
+		ids = append(ids, created["id"].(string))
+	}
+
+	var webhooks []Webhook
+	resp := apiRequest(t, "GET", ts.URL+"/api/webhooks?limit=2&sort=created_at&order=asc", apiKey, nil, &webhooks)
+	if resp.Header.Get("X-Total-Count") != "3" || len(webhooks) != 2 || webhooks[0].ID != ids[0] || webhooks[1].ID != ids[1] {
+		t.Fatalf("Unexpected first page: %s %+v", resp.Header.Get("X-Total-Count"), webhooks)
+	}
+	if link := resp.Header.Get("Link"); !strings.Contains(link, "offset=2") || !strings.Contains(link, `rel="next"`) {
+		t.Fatalf("Expected next link, got %q", link)
+	}
+	resp = apiRequest(t, "GET", ts.URL+"/api/webhooks?limit=2&offset=2&sort=created_at&order=asc", apiKey, nil, &webhooks)
+	if len(webhooks) != 1 || webhooks[0].ID != ids[2] || resp.Header.Get("Link") != "" {
+		t.Fatalf("Unexpected last page: %+v", webhooks)
+	}
+
+	// Search is a case-insensitive substring match on the URL
+	apiRequest(t, "GET", ts.URL+"/api/webhooks?q=CRM.example", apiKey, nil, &webhooks)
+	if len(webhooks) != 2 {
+		t.Fatalf("Expected 2 crm webhooks, got %d", len(webhooks))
+	}
+	apiRequest(t, "GET", ts.URL+"/api/webhooks?q=%25", apiKey, nil, &webhooks)
+	if len(webhooks) != 0 {
+		t.Fatalf("Expected %% to be matched literally, got %d", len(webhooks))
+	}
+
+	// Delivered webhooks sort first by last delivery
+	dbSetWebhookLastDelivery(ids[0], time.Now())
+	apiRequest(t, "GET", ts.URL+"/api/webhooks?sort=last_delivery", apiKey, nil, &webhooks)
+	if len(webhooks) != 3 || webhooks[0].ID != ids[0] || webhooks[0].LastDeliveryAt == nil {
+		t.Fatalf("Expected delivered webhook first, got %+v", webhooks)
+	}
+
+	for _, q := range []string{"limit=0", "limit=1000", "offset=-1", "sort=url", "order=up"} {
+		if resp := apiRequest(t, "GET", ts.URL+"/api/webhooks?"+q, apiKey, nil, nil); resp.StatusCode != 400 {
+			t.Fatalf("Expected 400 for %s, got %d", q, resp.StatusCode)
+		}
+	}
+}
+
+func TestBulkCreateWebhooks(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+
+	_, apiKey := registerWithAPIKey(t, ts, "bulkcreate@example.com", "bulkcreatepass123")
+	count := func() int {
+		var webhooks []Webhook
+		apiRequest(t, "GET", ts.URL+"/api/webhooks", apiKey, nil, &webhooks)
+		return len(webhooks)
+	}
+
+	definitions := []map[string]interface{}{
+		{"url": "https://a.example.com", "method": "POST", "filter_type": "group", "filter_value": "123@g.us"},
+		{"url": "https://b.example.com", "method": "PUT"},
+		{"method": "POST"},
+		{"url": "https://c.example.com", "method": "GET", "tags": []string{"crm"}},
+	}
+
+	// All-or-nothing by default: every error is reported and nothing is created
+	var failed struct {
+		Error  map[string]string  `json:"error"`
+		Errors []bulkWebhookError `json:"errors"`
+	}
+	resp := apiRequest(t, "POST", ts.URL+"/api/webhooks/bulk-create", apiKey, definitions, &failed)
+	if resp.StatusCode != 400 || failed.Error["code"] != ERR_BAD_REQUEST || len(failed.Errors) != 2 || failed.Errors[0].Index != 1 || failed.Errors[1].Index != 2 {
+		t.Fatalf("Unexpected bulk create failure: %d %+v", resp.StatusCode, failed)
+	}
+	if n := count(); n != 0 {
+		t.Fatalf("Expected no webhooks after failed batch, got %d", n)
+	}
+
+	// Partial mode creates the valid definitions
+	var result struct {
+		Success bool                 `json:"success"`
+		Created []bulkCreatedWebhook `json:"created"`
+		Errors  []bulkWebhookError   `json:"errors"`
+	}
+	resp = apiRequest(t, "POST", ts.URL+"/api/webhooks/bulk-create", apiKey, map[string]interface{}{
+		"webhooks": definitions, "partial": true,
+	}, &result)
+	if resp.StatusCode != 200 || result.Success || len(result.Created) != 2 || len(result.Errors) != 2 {
+		t.Fatalf("Unexpected partial result: %d %+v", resp.StatusCode, result)
+	}
+	if result.Created[0].Index != 0 || result.Created[0].FilterValue != "123@g.us" || result.Created[1].Index != 3 || result.Created[1].ID == "" {
+		t.Fatalf("Unexpected created webhooks: %+v", result.Created)
+	}
+	if n := count(); n != 2 {
+		t.Fatalf("Expected 2 webhooks, got %d", n)
+	}
+
+	// A fully valid batch succeeds
+	resp = apiRequest(t, "POST", ts.URL+"/api/webhooks/bulk-create", apiKey, map[string]interface{}{
+		"webhooks": []map[string]interface{}{definitions[0], definitions[3]},
+	}, &result)
+	if resp.StatusCode != 200 || !result.Success || len(result.Created) != 2 {
+		t.Fatalf("Unexpected bulk create result: %d %+v", resp.StatusCode, result)
+	}
+}
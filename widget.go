@@ -0,0 +1,292 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// --- Embeddable status widget ---
+// A signed token opens a read-only status widget (WhatsApp connection, last message,
+// queue depth) that can be put in an iframe on an internal dashboard. The token grants
+// nothing else: no API access, no message content. It is signed with a per-user key, so
+// revoking rotates the key and invalidates every token issued before.
+
+const (
+	WIDGET_TOKEN_SCOPE         = "widget:status"
+	DEFAULT_WIDGET_TOKEN_TTL   = 30 * 24 * time.Hour
+	MAX_WIDGET_TOKEN_TTL       = 365 * 24 * time.Hour
+	MAX_WIDGET_ALLOWED_ORIGINS = 10
+	WIDGET_REFRESH_SECONDS     = 30
+)
+
+var errInvalidWidgetToken = errors.New("Invalid or expired widget token")
+
+// What a widget token carries
+type widgetClaims struct {
+	UserID    int64    `json:"uid"`
+	Scope     string   `json:"scope"`
+	ExpiresAt int64    `json:"exp"`
+	Origins   []string `json:"origins,omitempty"` // Pages allowed to embed the widget; empty = any
+}
+
+// The user's widget signing key, created on first use
+func dbWidgetKey(userID int64, create bool) (string, error) {
+	var key string
+	if err := db.QueryRow(`SELECT widget_key FROM users WHERE id = ?`, userID).Scan(&key); err != nil || key != "" || !create {
+		return key, err
+	}
+	if _, err := db.Exec(`UPDATE users SET widget_key = ? WHERE id = ? AND widget_key = ''`, randomHex(32), userID); err != nil {
+		return "", err
+	}
+	err := db.QueryRow(`SELECT widget_key FROM users WHERE id = ?`, userID).Scan(&key)
+	return key, err
+}
+
+// Replace the signing key, invalidating every widget token of the user
+func dbRotateWidgetKey(userID int64) error {
+	_, err := db.Exec(`UPDATE users SET widget_key = ? WHERE id = ?`, randomHex(32), userID)
+	return err
+}
+
+func signWidgetPayload(key, payload string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Token format: base64url(claims JSON) "." base64url(HMAC-SHA256 of the first part)
+func signWidgetToken(key string, claims widgetClaims) string {
+	data, _ := json.Marshal(claims)
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return payload + "." + signWidgetPayload(key, payload)
+}
+
+// Check a token's signature, scope and expiry
+func verifyWidgetToken(token string, now time.Time) (widgetClaims, error) {
+	var claims widgetClaims
+	payload, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return claims, errInvalidWidgetToken
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil || json.Unmarshal(data, &claims) != nil || claims.UserID == 0 {
+		return claims, errInvalidWidgetToken
+	}
+	key, err := dbWidgetKey(claims.UserID, false)
+	if err != nil || key == "" {
+		return claims, errInvalidWidgetToken
+	}
+	if !hmac.Equal([]byte(sig), []byte(signWidgetPayload(key, payload))) {
+		return claims, errInvalidWidgetToken
+	}
+	if claims.Scope != WIDGET_TOKEN_SCOPE || now.Unix() >= claims.ExpiresAt {
+		return claims, errInvalidWidgetToken
+	}
+	return claims, nil
+}
+
+// Normalize an embedding origin ("https://dash.example.com[:port]", no path)
+func normalizeWidgetOrigin(value string) (string, error) {
+	u, err := url.Parse(strings.TrimSpace(value))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || strings.Trim(u.Path, "/") != "" || u.RawQuery != "" || u.User != nil {
+		return "", fmt.Errorf("Invalid origin %q, expected e.g. https://dashboard.example.com", value)
+	}
+	return u.Scheme + "://" + strings.ToLower(u.Host), nil
+}
+
+// The status shown by the widget: nothing beyond connection state, timing and counts
+func widgetStatus(userID int64, email string) map[string]interface{} {
+	status := map[string]interface{}{"status": "disconnected"}
+	wa := userWAStatusResponse(email)
+	for _, key := range []string{"status", "connected_since", "last_seen_at"} {
+		if value, ok := wa[key]; ok && value != "" {
+			status[key] = value
+		}
+	}
+
+	var lastMessageAt sql.NullString
+	readDB.QueryRow(`SELECT MAX(last_message_at) FROM recent_chats WHERE user_id = ?`, userID).Scan(&lastMessageAt)
+	last, _ := time.Parse(time.RFC3339, lastMessageAt.String)
+	receivedCounters.Lock()
+	if c, ok := receivedCounters.data[email]; ok && c.lastAt.After(last) {
+		last = c.lastAt
+	}
+	receivedCounters.Unlock()
+	if !last.IsZero() {
+		status["last_message_at"] = last.UTC().Format(time.RFC3339)
+	}
+
+	queued, pending, paused := 0, 0, false
+	queueMutex.RLock()
+	q, ok := messageQueues[email]
+	queueMutex.RUnlock()
+	if ok {
+		q.mu.Lock()
+		queued, pending, paused = len(q.Messages), len(q.Pending), q.Paused
+		q.mu.Unlock()
+	}
+	status["queue"] = map[string]interface{}{"queued": queued, "pending_approval": pending, "paused": paused}
+	status["updated_at"] = time.Now().UTC().Format(time.RFC3339)
+	return status
+}
+
+// POST /api/widget/token {"expires_in": 2592000, "allowed_origins": ["https://dash.example.com"]}
+// DELETE /api/widget/token revokes every token issued so far
+func handleWidgetToken(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value("userID").(int64)
+
+	switch r.Method {
+	case "POST":
+	case "DELETE":
+		if err := dbRotateWidgetKey(userID); err != nil {
+			fmt.Println("ERROR: Could not rotate widget key", err)
+			apiError(w, "Failed to revoke widget tokens", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true})
+		return
+	default:
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		ExpiresIn      int      `json:"expires_in"` // Seconds, default 30 days
+		AllowedOrigins []string `json:"allowed_origins"`
+	}
+	if err := decodeJSONBody(w, r, &req); err != nil && err != io.EOF {
+		writeBodyError(w, err)
+		return
+	}
+	ttl := DEFAULT_WIDGET_TOKEN_TTL
+	if req.ExpiresIn < 0 || time.Duration(req.ExpiresIn)*time.Second > MAX_WIDGET_TOKEN_TTL {
+		apiError(w, fmt.Sprintf("expires_in must be between 1 and %d seconds", int(MAX_WIDGET_TOKEN_TTL.Seconds())), http.StatusBadRequest)
+		return
+	} else if req.ExpiresIn > 0 {
+		ttl = time.Duration(req.ExpiresIn) * time.Second
+	}
+	if len(req.AllowedOrigins) > MAX_WIDGET_ALLOWED_ORIGINS {
+		apiError(w, fmt.Sprintf("At most %d allowed_origins", MAX_WIDGET_ALLOWED_ORIGINS), http.StatusBadRequest)
+		return
+	}
+	claims := widgetClaims{UserID: userID, Scope: WIDGET_TOKEN_SCOPE, ExpiresAt: time.Now().Add(ttl).Unix()}
+	for _, value := range req.AllowedOrigins {
+		origin, err := normalizeWidgetOrigin(value)
+		if err != nil {
+			apiError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		claims.Origins = append(claims.Origins, origin)
+	}
+
+	key, err := dbWidgetKey(userID, true)
+	if err != nil {
+		fmt.Println("ERROR: Could not load widget key", err)
+		apiError(w, "Failed to create widget token", http.StatusInternalServerError)
+		return
+	}
+	token := signWidgetToken(key, claims)
+	widgetURL := publicBaseURL(r) + "/widget/status?token=" + url.QueryEscape(token)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"token":           token,
+		"widget_url":      widgetURL,
+		"json_url":        widgetURL + "&format=json",
+		"iframe":          fmt.Sprintf(`<iframe src="%s" width="320" height="180" frameborder="0"></iframe>`, template.HTMLEscapeString(widgetURL)),
+		"expires_at":      time.Unix(claims.ExpiresAt, 0).UTC().Format(time.RFC3339),
+		"allowed_origins": claims.Origins,
+	})
+}
+
+var widgetTemplate = template.Must(template.New("widget").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="{{.Refresh}}">
+<title>WhatsApp status</title>
+<style>
+body { font: 14px system-ui, sans-serif; margin: 12px; color: #1f2937; }
+.state { font-size: 18px; font-weight: 600; }
+.dot { display: inline-block; width: 10px; height: 10px; border-radius: 50%; margin-right: 6px; background: {{if eq .Status "connected"}}#16a34a{{else}}#dc2626{{end}}; }
+dl { display: grid; grid-template-columns: auto 1fr; gap: 4px 12px; margin: 10px 0 0; }
+dt { color: #6b7280; }
+dd { margin: 0; }
+</style>
+</head>
+<body>
+<div class="state"><span class="dot"></span>{{.Status}}</div>
+<dl>
+{{if .ConnectedSince}}<dt>Connected since</dt><dd>{{.ConnectedSince}}</dd>{{end}}
+<dt>Last message</dt><dd>{{if .LastMessageAt}}{{.LastMessageAt}}{{else}}none{{end}}</dd>
+<dt>Queue</dt><dd>{{.Queued}} queued{{if .Pending}}, {{.Pending}} awaiting approval{{end}}{{if .Paused}} (paused){{end}}</dd>
+</dl>
+</body>
+</html>
+`))
+
+// GET /widget/status?token=...[&format=json]
+// Public; the token is the only credential and only opens this view.
+func handleWidgetStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		apiError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	claims, err := verifyWidgetToken(r.URL.Query().Get("token"), time.Now())
+	if err != nil {
+		apiError(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	email := getUserEmailByID(claims.UserID)
+	if email == "" {
+		apiError(w, errInvalidWidgetToken.Error(), http.StatusUnauthorized)
+		return
+	}
+	status := widgetStatus(claims.UserID, email)
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	if r.URL.Query().Get("format") == "json" {
+		if origin := r.Header.Get("Origin"); origin != "" && (len(claims.Origins) == 0 || slices.Contains(claims.Origins, strings.ToLower(origin))) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Vary", "Origin")
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+		return
+	}
+
+	ancestors := "*"
+	if len(claims.Origins) > 0 {
+		ancestors = strings.Join(claims.Origins, " ")
+	}
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; frame-ancestors "+ancestors)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	queue := status["queue"].(map[string]interface{})
+	str := func(key string) string {
+		s, _ := status[key].(string)
+		return s
+	}
+	widgetTemplate.Execute(w, map[string]interface{}{
+		"Refresh":        WIDGET_REFRESH_SECONDS,
+		"Status":         str("status"),
+		"ConnectedSince": str("connected_since"),
+		"LastMessageAt":  str("last_message_at"),
+		"Queued":         queue["queued"],
+		"Pending":        queue["pending_approval"],
+		"Paused":         queue["paused"],
+	})
+}
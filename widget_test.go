@@ -0,0 +1,64 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatusWidget(t *testing.T) {
+	ts, teardown := setupTestServer()
+	defer teardown()
+
+	_, apiKey := registerWithAPIKey(t, ts, "widget@example.com", "widgetpass123")
+
+	var issued struct {
+		Token          string   `json:"token"`
+		WidgetURL      string   `json:"widget_url"`
+		JSONURL        string   `json:"json_url"`
+		AllowedOrigins []string `json:"allowed_origins"`
+	}
+	resp := apiRequest(t, "POST", ts.URL+"/api/widget/token", apiKey, map[string]interface{}{"allowed_origins": []string{"https://Dash.example.com/"}}, &issued)
+	if resp.StatusCode != 200 || issued.Token == "" || len(issued.AllowedOrigins) != 1 || issued.AllowedOrigins[0] != "https://dash.example.com" {
+		t.Fatalf("Unexpected token response: %d %+v", resp.StatusCode, issued)
+	}
+	if resp := apiRequest(t, "POST", ts.URL+"/api/widget/token", apiKey, map[string]interface{}{"allowed_origins": []string{"https://dash.example.com/page"}}, nil); resp.StatusCode != 400 {
+		t.Fatalf("Expected 400 for an origin with a path, got %d", resp.StatusCode)
+	}
+
+	// The widget needs no API key, only the token
+	resp, err := http.Get(issued.WidgetURL)
+	if err != nil || resp.StatusCode != 200 {
+		t.Fatalf("Widget request failed: %v %v", err, resp)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(resp.Header.Get("Content-Security-Policy"), "frame-ancestors https://dash.example.com") || !strings.Contains(string(body), "disconnected") {
+		t.Fatalf("Unexpected widget: %v\n%s", resp.Header, body)
+	}
+	var status struct {
+		Status string `json:"status"`
+		Queue  struct {
+			Queued int `json:"queued"`
+		} `json:"queue"`
+	}
+	if resp := apiRequest(t, "GET", issued.JSONURL, "", nil, &status); resp.StatusCode != 200 || status.Status != "disconnected" {
+		t.Fatalf("Unexpected widget JSON: %d %+v", resp.StatusCode, status)
+	}
+
+	// Tampered, expired and revoked tokens are refused
+	if resp := apiRequest(t, "GET", ts.URL+"/widget/status?token="+issued.Token+"x", "", nil, nil); resp.StatusCode != 401 {
+		t.Fatalf("Expected 401 for a tampered token, got %d", resp.StatusCode)
+	}
+	if _, err := verifyWidgetToken(issued.Token, time.Now().Add(DEFAULT_WIDGET_TOKEN_TTL+time.Minute)); err == nil {
+		t.Fatal("Expected an expired token to be refused")
+	}
+	if resp := apiRequest(t, "DELETE", ts.URL+"/api/widget/token", apiKey, nil, nil); resp.StatusCode != 200 {
+		t.Fatalf("Revoke failed: %d", resp.StatusCode)
+	}
+	if resp := apiRequest(t, "GET", issued.WidgetURL, "", nil, nil); resp.StatusCode != 401 {
+		t.Fatalf("Expected 401 after revoking, got %d", resp.StatusCode)
+	}
+}